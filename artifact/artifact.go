@@ -2,19 +2,35 @@ package artifact
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
-	"mime"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/goamz/s3"
 )
 
 const (
 	defaultCtype = "application/octet-stream"
+
+	// ContentTypePrecedenceExtension detects content types from the
+	// extension, sniffing the content only when it isn't recognized
+	ContentTypePrecedenceExtension = "extension"
+
+	// ContentTypePrecedenceSniff detects content types from the content,
+	// falling back to the extension when sniffing finds nothing specific
+	ContentTypePrecedenceSniff = "sniff"
+
+	// ContentTypePrecedenceOverrideOnly detects content types from the
+	// content alone, never from the extension
+	ContentTypePrecedenceOverrideOnly = "override-only"
 )
 
 // Artifact is the thing that gets uploaded or whatever
@@ -30,7 +46,63 @@ type Artifact struct {
 	Prefix string
 	Perm   s3.ACL
 
+	// ContentTypeByExtensionOnly skips reading the file to detect the
+	// content type when the extension is not recognized
+	ContentTypeByExtensionOnly bool
+
+	// ContentTypePrecedence is one of the ContentTypePrecedence* values,
+	// deciding whether the extension or the content wins
+	ContentTypePrecedence string
+
+	// ContentTypes maps lowercase extensions to content types that win
+	// over both the extension and the content
+	ContentTypes map[string]string
+
+	// DefaultContentType is the content type when neither the extension
+	// nor the content is recognized, instead of application/octet-stream
+	DefaultContentType string
+
+	// ContentEncoding is set for files that are already compressed, whose
+	// content type then comes from the dest rather than the source
+	ContentEncoding string
+
+	// CacheControl overrides the Cache-Control of the upload for this
+	// artifact alone
+	CacheControl string
+
+	// ContentDisposition is stored with the object when set, e.g. to make
+	// browsers download it rather than display it
+	ContentDisposition string
+
+	// RedirectLocation makes a zero-byte object that S3 website hosting
+	// serves as a redirect to this location
+	RedirectLocation string
+
+	// OriginalKey is the full dest from before it was shortened to fit the
+	// longest key allowed
+	OriginalKey string
+
+	// AliasOf is the key of an artifact with the same content, which was
+	// uploaded in place of this one
+	AliasOf string
+
+	// Metadata is stored with the object on top of the --metadata
+	// templates, e.g. to reference a companion object
+	Metadata map[string]string
+
 	UploadResult *Result
+
+	body    []byte
+	stream  *stream
+	modTime time.Time
+	sha256  string
+
+	// encodedSource holds the content under ContentEncoding in place of
+	// the source, which still decided the content type
+	encodedSource string
+	contentType   string
+
+	digestLock sync.Mutex
 }
 
 // New creates a new *Artifact
@@ -47,22 +119,198 @@ func New(prefix, source, dest string, opts *Options) *Artifact {
 		JobID:       opts.JobID,
 		Perm:        opts.Perm,
 
+		ContentTypeByExtensionOnly: opts.ContentTypeByExtensionOnly,
+		ContentTypePrecedence:      opts.ContentTypePrecedence,
+		ContentTypes:               opts.ContentTypes,
+		DefaultContentType:         opts.DefaultContentType,
+
 		UploadResult: &Result{},
 	}
 }
 
+// NewFromBytes creates a new *Artifact with in-memory content rather
+// than a source file, e.g. for generated files
+func NewFromBytes(prefix, dest string, body []byte, opts *Options) *Artifact {
+	a := New(prefix, "", dest, opts)
+	a.body = body
+	a.modTime = time.Now()
+	if a.body == nil {
+		a.body = []byte{}
+	}
+	return a
+}
+
+// Copy is a copy of the artifact with a result of its own, e.g. to upload
+// the same content to another destination.  A stream is shared with the
+// copy, so only one of them can be uploaded.
+func (a *Artifact) Copy() *Artifact {
+	a.digestLock.Lock()
+	sha256 := a.sha256
+	a.digestLock.Unlock()
+
+	return &Artifact{
+		RepoSlug:    a.RepoSlug,
+		BuildNumber: a.BuildNumber,
+		BuildID:     a.BuildID,
+		JobNumber:   a.JobNumber,
+		JobID:       a.JobID,
+
+		Source: a.Source,
+		Dest:   a.Dest,
+		Prefix: a.Prefix,
+		Perm:   a.Perm,
+
+		ContentTypeByExtensionOnly: a.ContentTypeByExtensionOnly,
+		ContentTypePrecedence:      a.ContentTypePrecedence,
+		ContentTypes:               a.ContentTypes,
+		DefaultContentType:         a.DefaultContentType,
+		ContentEncoding:            a.ContentEncoding,
+		CacheControl:               a.CacheControl,
+		ContentDisposition:         a.ContentDisposition,
+		RedirectLocation:           a.RedirectLocation,
+		OriginalKey:                a.OriginalKey,
+		AliasOf:                    a.AliasOf,
+		Metadata:                   a.Metadata,
+
+		UploadResult: &Result{},
+
+		body:    a.body,
+		stream:  a.stream,
+		modTime: a.modTime,
+		sha256:  sha256,
+
+		encodedSource: a.encodedSource,
+		contentType:   a.contentType,
+	}
+}
+
+// Encode makes the artifact upload the content of encodedSource, which is
+// the source's content encoded with the given encoding, while keeping the
+// content type detected from the source
+func (a *Artifact) Encode(encoding, encodedSource string) {
+	a.contentType = a.ContentType()
+	a.ContentEncoding = encoding
+	a.encodedSource = encodedSource
+
+	a.digestLock.Lock()
+	a.sha256 = ""
+	a.digestLock.Unlock()
+}
+
+// SetContentType fixes the content type, over both the ContentTypes
+// overrides and detection
+func (a *Artifact) SetContentType(ctype string) {
+	a.contentType = ctype
+}
+
+// ContentSource is the file that the uploaded content is read from, which
+// is the source unless the artifact was encoded
+func (a *Artifact) ContentSource() string {
+	if a.encodedSource != "" {
+		return a.encodedSource
+	}
+	return a.Source
+}
+
 // ContentType makes it easier to find the perfect match
 func (a *Artifact) ContentType() string {
-	ctype := mime.TypeByExtension(path.Ext(a.Source))
+	if a.contentType != "" {
+		return a.contentType
+	}
+
+	if ctype := a.overriddenContentType(); ctype != "" {
+		return ctype
+	}
+
+	ctype := a.detectContentType()
+	if ctype == defaultCtype && a.DefaultContentType != "" {
+		return a.DefaultContentType
+	}
+	return ctype
+}
+
+// detectContentType is the content type from the extension or the
+// content, in the order of the ContentTypePrecedence, which is
+// application/octet-stream when neither is recognized
+func (a *Artifact) detectContentType() string {
+
+	if a.ContentEncoding != "" {
+		ctype := typeByExtension(path.Ext(a.Dest))
+		if ctype != "" {
+			return ctype
+		}
+		return defaultCtype
+	}
+
+	switch a.ContentTypePrecedence {
+	case ContentTypePrecedenceSniff:
+		ctype := a.sniffContentType()
+		if ctype != defaultCtype {
+			return ctype
+		}
+		ctype = a.extensionContentType()
+		if ctype != "" {
+			return ctype
+		}
+		return defaultCtype
+	case ContentTypePrecedenceOverrideOnly:
+		return a.sniffContentType()
+	}
+
+	ctype := a.extensionContentType()
 	if ctype != "" {
 		return ctype
 	}
 
-	f, err := os.Open(a.Source)
+	// generated content is already in memory, so it's sniffed regardless
+	if a.ContentTypeByExtensionOnly && a.body == nil {
+		return defaultCtype
+	}
+
+	return a.sniffContentType()
+}
+
+// overriddenContentType is the ContentTypes entry for the extension, that
+// of the dest for encoded artifacts and those without a source file
+func (a *Artifact) overriddenContentType() string {
+	if len(a.ContentTypes) == 0 {
+		return ""
+	}
+
+	name := a.Source
+	if a.ContentEncoding != "" || a.stream != nil || a.body != nil {
+		name = a.Dest
+	}
+	return a.ContentTypes[strings.ToLower(path.Ext(name))]
+}
+
+// extensionContentType maps the extension to a content type, that of the
+// dest for artifacts without a source file
+func (a *Artifact) extensionContentType() string {
+	if a.stream != nil || a.body != nil {
+		return typeByExtension(path.Ext(a.Dest))
+	}
+	return typeByExtension(path.Ext(a.Source))
+}
+
+// sniffContentType detects the content type from up to the first 512
+// bytes of content
+func (a *Artifact) sniffContentType() string {
+	if a.stream != nil {
+		return a.stream.ContentType()
+	}
+
+	if a.body != nil {
+		return http.DetectContentType(a.body)
+	}
+
+	f, err := openLimited(a.Source)
 	if err != nil {
 		return defaultCtype
 	}
 
+	defer f.Close()
+
 	var buf bytes.Buffer
 
 	_, err = io.CopyN(&buf, f, int64(512))
@@ -73,9 +321,32 @@ func (a *Artifact) ContentType() string {
 	return http.DetectContentType(buf.Bytes())
 }
 
-// Reader makes an io.Reader out of the filepath
+// Reader makes an io.Reader out of the filepath.  Until the digest is
+// known, the reader also computes it, so that reading the content through
+// once for the upload is all it takes for SHA256 to be free afterwards.
 func (a *Artifact) Reader() (io.Reader, error) {
-	f, err := os.Open(a.Source)
+	r, err := a.rawReader()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.KnownSHA256() != "" {
+		return r, nil
+	}
+
+	return newHashingReader(a, r), nil
+}
+
+func (a *Artifact) rawReader() (io.Reader, error) {
+	if a.stream != nil {
+		return a.stream.Reader()
+	}
+
+	if a.body != nil {
+		return bytes.NewReader(a.body), nil
+	}
+
+	f, err := openLimited(a.ContentSource())
 	if err != nil {
 		return nil, err
 	}
@@ -85,7 +356,15 @@ func (a *Artifact) Reader() (io.Reader, error) {
 
 // Size reports the size of the artifact
 func (a *Artifact) Size() (uint64, error) {
-	fi, err := os.Stat(a.Source)
+	if a.stream != nil {
+		return a.stream.Size(), nil
+	}
+
+	if a.body != nil {
+		return uint64(len(a.body)), nil
+	}
+
+	fi, err := os.Stat(a.ContentSource())
 	if err != nil {
 		return uint64(0), nil
 	}
@@ -93,7 +372,56 @@ func (a *Artifact) Size() (uint64, error) {
 	return uint64(fi.Size()), nil
 }
 
-// FullDest calculates the full remote destination path
+// ModTime reports when the artifact was last modified
+func (a *Artifact) ModTime() (time.Time, error) {
+	if a.body != nil || a.stream != nil {
+		return a.modTime, nil
+	}
+
+	fi, err := os.Stat(a.Source)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+// SHA256 returns the hex digest of the artifact's content.  The digest is
+// computed at most once per artifact, so that everything needing it
+// shares a single read of the content.
+func (a *Artifact) SHA256() (string, error) {
+	a.digestLock.Lock()
+	defer a.digestLock.Unlock()
+
+	if a.sha256 != "" {
+		return a.sha256, nil
+	}
+
+	if a.stream != nil {
+		return "", fmt.Errorf("cannot compute the digest of a streamed artifact before uploading it")
+	}
+
+	reader, err := a.rawReader()
+	if err != nil {
+		return "", err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+
+	a.sha256 = hex.EncodeToString(hash.Sum(nil))
+	return a.sha256, nil
+}
+
+// FullDest calculates the full remote destination path, which is joined
+// with forward slashes on any OS
 func (a *Artifact) FullDest() string {
-	return strings.TrimLeft(filepath.Join(a.Prefix, a.Dest), "/")
+	return strings.TrimLeft(path.Join(filepath.ToSlash(a.Prefix), filepath.ToSlash(a.Dest)), "/")
 }
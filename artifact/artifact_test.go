@@ -1,12 +1,16 @@
 package artifact
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mitchellh/goamz/s3"
 )
@@ -152,3 +156,620 @@ func TestArtifactReader(t *testing.T) {
 		}
 	}
 }
+
+func TestNewArtifactFromBytes(t *testing.T) {
+	a := NewFromBytes("bucket", "linux/index.html", []byte("<html></html>"), &Options{
+		Perm:     s3.PublicRead,
+		RepoSlug: "owner/foo",
+	})
+	if a == nil {
+		t.Fatalf("new artifact is nil")
+	}
+
+	if a.FullDest() != "bucket/linux/index.html" {
+		t.Fatalf("full destination not set correctly: %v", a.FullDest())
+	}
+
+	if a.ContentType() != "text/html; charset=utf-8" {
+		t.Fatalf("content type not detected from dest: %v", a.ContentType())
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 13 {
+		t.Fatalf("size %v != 13", size)
+	}
+
+	reader, err := a.Reader()
+	if err != nil {
+		t.Fatalf("error getting reader: %v", err)
+	}
+
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "<html></html>" {
+		t.Fatalf("body %q != %q", string(b), "<html></html>")
+	}
+
+	empty := NewFromBytes("bucket", "_SUCCESS", nil, &Options{})
+	size, err = empty.Size()
+	if err != nil || size != 0 {
+		t.Fatalf("empty artifact size %v != 0 (err=%v)", size, err)
+	}
+}
+
+func TestArtifactCopy(t *testing.T) {
+	a := NewFromBytes("bucket", "linux/index.html", []byte("<html></html>"), &Options{RepoSlug: "owner/foo"})
+	a.CacheControl = "no-cache"
+	a.UploadResult.OK = true
+
+	sum, err := a.SHA256()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := a.Copy()
+	c.Prefix = "mirror"
+
+	if c.FullDest() != "mirror/linux/index.html" || a.FullDest() != "bucket/linux/index.html" {
+		t.Fatalf("full destinations %v and %v", c.FullDest(), a.FullDest())
+	}
+	if c.CacheControl != "no-cache" || c.RepoSlug != "owner/foo" || c.ContentType() != a.ContentType() {
+		t.Fatalf("copy %#v is missing fields of %#v", c, a)
+	}
+	if c.UploadResult == a.UploadResult || c.UploadResult.OK {
+		t.Fatalf("copy shares the result of the original")
+	}
+
+	copySum, err := c.SHA256()
+	if err != nil || copySum != sum {
+		t.Fatalf("copy sha256 %v != %v (err=%v)", copySum, sum, err)
+	}
+}
+
+func TestArtifactContentTypeByExtensionOnly(t *testing.T) {
+	opts := &Options{
+		Perm:                       s3.PublicRead,
+		ContentTypeByExtensionOnly: true,
+	}
+
+	for _, p := range testArtifactPaths {
+		if !p.Valid {
+			continue
+		}
+
+		a := New("bucket", p.Path, "linux/foo", opts)
+		expected := p.ContentType
+		if filepath.Ext(p.Path) == "" {
+			// the contents would be sniffed as text, so getting the default
+			// means that nothing was read
+			expected = defaultCtype
+		}
+
+		actualCtype := a.ContentType()
+		if expected != actualCtype {
+			t.Fatalf("%v: %v != %v", p.Path, expected, actualCtype)
+		}
+	}
+}
+
+// misleadingFiles have extensions that disagree with their contents,
+// mapped to the content type expected for each precedence
+var misleadingFiles = map[string]map[string]string{
+	"archive.txt": map[string]string{
+		ContentTypePrecedenceExtension:    "text/plain; charset=utf-8",
+		ContentTypePrecedenceSniff:        "application/x-gzip",
+		ContentTypePrecedenceOverrideOnly: "application/x-gzip",
+	},
+	"page.csv": map[string]string{
+		ContentTypePrecedenceExtension:    "text/csv; charset=utf-8",
+		ContentTypePrecedenceSniff:        "text/html; charset=utf-8",
+		ContentTypePrecedenceOverrideOnly: "text/html; charset=utf-8",
+	},
+	"blob.csv": map[string]string{
+		ContentTypePrecedenceExtension:    "text/csv; charset=utf-8",
+		ContentTypePrecedenceSniff:        "text/csv; charset=utf-8",
+		ContentTypePrecedenceOverrideOnly: defaultCtype,
+	},
+}
+
+var misleadingContents = map[string][]byte{
+	"archive.txt": []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"),
+	"page.csv":    []byte("<!DOCTYPE html><html><body>hi</body></html>"),
+	"blob.csv":    []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff},
+}
+
+func TestArtifactContentTypePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test-precedence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range misleadingContents {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, expected := range misleadingFiles {
+		for precedence, ctype := range expected {
+			opts := &Options{ContentTypePrecedence: precedence}
+
+			a := New("bucket", filepath.Join(dir, name), "linux/"+name, opts)
+			if a.ContentType() != ctype {
+				t.Fatalf("%v with %v precedence: %v != %v", name, precedence, a.ContentType(), ctype)
+			}
+
+			a = NewFromBytes("bucket", name, misleadingContents[name], opts)
+			if a.ContentType() != ctype {
+				t.Fatalf("%v bytes with %v precedence: %v != %v", name, precedence, a.ContentType(), ctype)
+			}
+
+			r := strings.NewReader(string(misleadingContents[name]))
+			a = NewFromStream("bucket", name, r, uint64(r.Len()), opts)
+			if a.ContentType() != ctype {
+				t.Fatalf("%v stream with %v precedence: %v != %v", name, precedence, a.ContentType(), ctype)
+			}
+		}
+	}
+}
+
+func TestArtifactContentTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test-content-types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wasm := filepath.Join(dir, "app.WASM")
+	if err := ioutil.WriteFile(wasm, []byte("\x00asm\x01\x00\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(dir, "build.log")
+	if err := ioutil.WriteFile(log, []byte("<html>not really</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	contentTypes := map[string]string{
+		".wasm": "application/wasm",
+		".log":  "text/plain; charset=utf-8",
+		".js":   "text/javascript",
+	}
+
+	for _, precedence := range []string{
+		ContentTypePrecedenceExtension,
+		ContentTypePrecedenceSniff,
+		ContentTypePrecedenceOverrideOnly,
+	} {
+		opts := &Options{ContentTypePrecedence: precedence, ContentTypes: contentTypes}
+
+		if ctype := New("bucket", wasm, "app.wasm", opts).ContentType(); ctype != "application/wasm" {
+			t.Fatalf("wasm with %v precedence: %v != application/wasm", precedence, ctype)
+		}
+
+		if ctype := New("bucket", log, "build.log", opts).ContentType(); ctype != "text/plain; charset=utf-8" {
+			t.Fatalf("log with %v precedence: %v != text/plain; charset=utf-8", precedence, ctype)
+		}
+
+		if ctype := NewFromBytes("bucket", "gen.js", []byte("x"), opts).ContentType(); ctype != "text/javascript" {
+			t.Fatalf("generated js with %v precedence: %v != text/javascript", precedence, ctype)
+		}
+	}
+
+	a := New("bucket", filepath.Join(dir, "bundle.js.gz"), "bundle.js", &Options{ContentTypes: contentTypes})
+	a.ContentEncoding = "gzip"
+	if a.ContentType() != "text/javascript" {
+		t.Fatalf("encoded js: %v != text/javascript", a.ContentType())
+	}
+
+	a = New("bucket", log, "build.log", &Options{})
+	if a.ContentType() == "text/plain; charset=utf-8" {
+		t.Fatalf("log without content types was overridden")
+	}
+}
+
+func TestArtifactBuiltinContentTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test-builtin-content-types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, expected := range map[string]string{
+		"trace.har":       "application/json",
+		"app.js.map":      "application/json",
+		"results.sarif":   "application/sarif+json",
+		"CHANGES.md":      "text/markdown; charset=utf-8",
+		"pkg.tar.zst":     "application/zstd",
+		"release.tgz.asc": "application/pgp-signature",
+		"index.html":      "text/html; charset=utf-8",
+	} {
+		if ctype := NewFromBytes("bucket", name, []byte("x"), &Options{}).ContentType(); ctype != expected {
+			t.Fatalf("%s: %v != %v", name, ctype, expected)
+		}
+	}
+
+	unknown := filepath.Join(dir, "core.bin9")
+	if err := ioutil.WriteFile(unknown, []byte{0, 1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{DefaultContentType: "application/x-unknown"}
+	if ctype := New("bucket", unknown, "core.bin9", opts).ContentType(); ctype != "application/x-unknown" {
+		t.Fatalf("unknown file: %v != application/x-unknown", ctype)
+	}
+	if ctype := NewFromBytes("bucket", "a.txt", []byte("x"), opts).ContentType(); ctype != "text/plain; charset=utf-8" {
+		t.Fatalf("known file got the default: %v", ctype)
+	}
+}
+
+func BenchmarkArtifactContentType(b *testing.B) {
+	a := New("bucket", testArtifactPaths[0].Path, "linux/foo", &Options{})
+	for i := 0; i < b.N; i++ {
+		a.ContentType()
+	}
+}
+
+func BenchmarkArtifactContentTypeByExtensionOnly(b *testing.B) {
+	a := New("bucket", testArtifactPaths[0].Path, "linux/foo", &Options{
+		ContentTypeByExtensionOnly: true,
+	})
+	for i := 0; i < b.N; i++ {
+		a.ContentType()
+	}
+}
+
+func TestArtifactSHA256(t *testing.T) {
+	a := NewFromBytes("bucket", "hello.txt", []byte("hello"), &Options{})
+
+	for i := 0; i < 2; i++ {
+		digest, err := a.SHA256()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if digest != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+			t.Fatalf("unexpected digest: %v", digest)
+		}
+	}
+
+	if _, err := New("bucket", "/nonexistent", "x", &Options{}).SHA256(); err == nil {
+		t.Fatalf("expected error for nonexistent source")
+	}
+}
+
+func writeHashingTestFile(tb testing.TB, size int) (string, string) {
+	f, err := ioutil.TempFile("", "artifacts-hashing")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	if _, err := f.Write(content); err != nil {
+		tb.Fatal(err)
+	}
+
+	return f.Name(), fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+func TestArtifactReaderComputesSHA256(t *testing.T) {
+	name, reference := writeHashingTestFile(t, 3*1024*1024+17)
+	defer os.Remove(name)
+
+	a := New("bucket", name, "big.bin", &Options{})
+	r, err := a.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	r.(io.Closer).Close()
+
+	if a.KnownSHA256() != reference {
+		t.Fatalf("digest from reading %q != %q", a.KnownSHA256(), reference)
+	}
+
+	digest, err := a.SHA256()
+	if err != nil || digest != reference {
+		t.Fatalf("digest %q != %q (err %v)", digest, reference, err)
+	}
+
+	// once the digest is known, readers are no longer wrapped
+	r, _ = a.Reader()
+	defer r.(io.Closer).Close()
+	if _, ok := r.(io.Seeker); !ok {
+		t.Fatalf("file reader can't seek")
+	}
+}
+
+func TestArtifactReaderSHA256AfterSeek(t *testing.T) {
+	name, reference := writeHashingTestFile(t, 1024)
+	defer os.Remove(name)
+
+	a := New("bucket", name, "big.bin", &Options{})
+	r, err := a.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+
+	if _, err := r.(io.Seeker).Seek(512, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, r)
+
+	if a.KnownSHA256() != "" {
+		t.Fatalf("digest was recorded from part of the content: %q", a.KnownSHA256())
+	}
+
+	if digest, _ := a.SHA256(); digest != reference {
+		t.Fatalf("digest %q != %q", digest, reference)
+	}
+}
+
+func TestArtifactStreamSHA256AfterReading(t *testing.T) {
+	a := NewFromStream("bucket", "stdin.txt", strings.NewReader("hello"), 5, &Options{})
+	if _, err := a.SHA256(); err == nil {
+		t.Fatalf("digest of an unread stream was computed")
+	}
+
+	r, err := a.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, r)
+
+	digest, err := a.SHA256()
+	if err != nil || digest != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected digest %q (err %v)", digest, err)
+	}
+}
+
+// slowSink stands in for a network connection, accepting writes into a
+// buffer that drains at a fixed rate in the background, the way a socket
+// buffer drains onto the wire
+type slowSink struct {
+	chunks chan int
+	done   chan bool
+}
+
+func newSlowSink(bytesPerSecond int64) *slowSink {
+	ss := &slowSink{chunks: make(chan int, 64), done: make(chan bool)}
+	go func() {
+		start := time.Now()
+		sent := int64(0)
+		for n := range ss.chunks {
+			sent += int64(n)
+			due := start.Add(time.Duration(sent * int64(time.Second) / bytesPerSecond))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		ss.done <- true
+	}()
+	return ss
+}
+
+func (ss *slowSink) Write(p []byte) (int, error) {
+	ss.chunks <- len(p)
+	return len(p), nil
+}
+
+func (ss *slowSink) Wait() {
+	close(ss.chunks)
+	<-ss.done
+}
+
+func benchmarkUploadWithDigest(b *testing.B, prePass bool) {
+	size := 16 * 1024 * 1024
+	name, _ := writeHashingTestFile(b, size)
+	defer os.Remove(name)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		a := New("bucket", name, "big.bin", &Options{})
+		if prePass {
+			if _, err := a.SHA256(); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		// about as fast as sha256 itself, where a pre-pass costs the most
+		sink := newSlowSink(1024 * 1024 * 1024)
+		r, _ := a.Reader()
+		io.CopyBuffer(sink, r, make([]byte, 32*1024))
+		r.(io.Closer).Close()
+		sink.Wait()
+
+		if _, err := a.SHA256(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkArtifactUploadSHA256PrePass hashes the content in a pass of
+// its own before uploading it, as uploads that needed the digest first
+// used to, so the hashing and the upload take turns
+func BenchmarkArtifactUploadSHA256PrePass(b *testing.B) {
+	benchmarkUploadWithDigest(b, true)
+}
+
+// BenchmarkArtifactUploadSHA256Tee hashes the content as the upload reads
+// it, so the hashing overlaps with the upload draining
+func BenchmarkArtifactUploadSHA256Tee(b *testing.B) {
+	benchmarkUploadWithDigest(b, false)
+}
+
+func TestArtifactFromStream(t *testing.T) {
+	a := NewFromStream("bucket", "stdin.txt", strings.NewReader("hello"), 5, &Options{})
+
+	if !a.IsStream() {
+		t.Fatalf("artifact from stream is not a stream")
+	}
+
+	if a.ContentType() != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected content type: %v", a.ContentType())
+	}
+
+	r, err := a.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "hello" {
+		t.Fatalf("stream body %q != hello", string(body))
+	}
+
+	if _, err := a.Reader(); err == nil {
+		t.Fatalf("stream was read twice")
+	}
+}
+
+func TestArtifactFromStreamSizeMismatch(t *testing.T) {
+	for _, size := range []uint64{3, 8} {
+		a := NewFromStream("bucket", "stdin.txt", strings.NewReader("hello"), size, &Options{})
+
+		r, err := a.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatalf("size %v: mismatched stream was read without error", size)
+		}
+	}
+}
+
+func TestArtifactFromUnsizedStream(t *testing.T) {
+	a := NewFromUnsizedStream("bucket", "stdin.txt", strings.NewReader("hello"), &Options{})
+
+	if !a.IsStream() || !a.SizeUnknown() {
+		t.Fatalf("artifact from unsized stream is not an unsized stream")
+	}
+
+	if size, _ := a.Size(); size != 0 {
+		t.Fatalf("unread stream size %v != 0", size)
+	}
+
+	r, err := a.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("stream body %q: %v", string(body), err)
+	}
+
+	if size, _ := a.Size(); size != 5 {
+		t.Fatalf("read stream size %v != 5", size)
+	}
+}
+
+func TestLimitOpenFiles(t *testing.T) {
+	throttled := make(chan bool, 10)
+	LimitOpenFiles(2, func() { throttled <- true })
+	defer LimitOpenFiles(0, nil)
+
+	readers := []io.Reader{}
+	for i := 0; i < 2; i++ {
+		r, err := New("bucket", testArtifactPaths[0].Path, "foo", &Options{}).Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, r)
+	}
+
+	opened := make(chan io.Reader)
+	go func() {
+		r, _ := New("bucket", testArtifactPaths[0].Path, "foo", &Options{}).Reader()
+		opened <- r
+	}()
+
+	select {
+	case <-opened:
+		t.Fatalf("third file was opened while two were open")
+	case <-throttled:
+	}
+
+	readers[0].(io.Closer).Close()
+	readers[0].(io.Closer).Close()
+
+	r := <-opened
+	r.(io.Closer).Close()
+	readers[1].(io.Closer).Close()
+
+	// closing twice only gives back one slot, so two can be open again
+	for i := 0; i < 2; i++ {
+		release := AcquireOpenFile()
+		defer release()
+	}
+}
+
+func TestArtifactEncode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-encode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "report.json")
+	encoded := filepath.Join(dir, "encoded")
+	if err := ioutil.WriteFile(source, []byte(`{"passed": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(encoded, []byte("tiny"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New("bucket", source, "report.json", &Options{})
+	a.Encode("gzip", encoded)
+
+	if a.ContentEncoding != "gzip" {
+		t.Fatalf("content encoding %q != gzip", a.ContentEncoding)
+	}
+
+	if a.ContentType() != "application/json" {
+		t.Fatalf("content type %q != application/json", a.ContentType())
+	}
+
+	if a.ContentSource() != encoded || a.Source != source {
+		t.Fatalf("content source %q != %q, or source %q != %q", a.ContentSource(), encoded, a.Source, source)
+	}
+
+	if size, _ := a.Size(); size != 4 {
+		t.Fatalf("encoded size %v != 4", size)
+	}
+
+	r, err := a.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+
+	content, _ := ioutil.ReadAll(r)
+	if string(content) != "tiny" {
+		t.Fatalf("encoded content %q != tiny", content)
+	}
+}
@@ -0,0 +1,10 @@
+package artifact
+
+import "testing"
+
+func TestArtifactFullDestWindows(t *testing.T) {
+	a := New(`builds\1`, `C:\build\out\logs\a.log`, `logs\a.log`, &Options{})
+	if a.FullDest() != "builds/1/logs/a.log" {
+		t.Fatalf("full destination not set correctly: %v", a.FullDest())
+	}
+}
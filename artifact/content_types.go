@@ -0,0 +1,66 @@
+package artifact
+
+import (
+	"mime"
+	"strings"
+)
+
+// builtinContentTypes are the content types of extensions common among
+// build artifacts that the mime package doesn't know, or that the host's
+// mime.types may not, so that they get the same content type on any host.
+// They win over the mime package, and ContentTypes overrides win over
+// them.
+var builtinContentTypes = map[string]string{
+	".wasm":        "application/wasm",
+	".map":         "application/json",
+	".har":         "application/json",
+	".ndjson":      "application/x-ndjson",
+	".jsonl":       "application/x-ndjson",
+	".webmanifest": "application/manifest+json",
+	".sarif":       "application/sarif+json",
+	".yaml":        "application/yaml",
+	".yml":         "application/yaml",
+	".toml":        "application/toml",
+
+	".md":       "text/markdown; charset=utf-8",
+	".markdown": "text/markdown; charset=utf-8",
+	".tsv":      "text/tab-separated-values; charset=utf-8",
+	".diff":     "text/x-diff; charset=utf-8",
+	".patch":    "text/x-diff; charset=utf-8",
+	".md5":      "text/plain; charset=utf-8",
+	".sha1":     "text/plain; charset=utf-8",
+	".sha256":   "text/plain; charset=utf-8",
+	".sha512":   "text/plain; charset=utf-8",
+
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+
+	".tgz": "application/gzip",
+	".bz2": "application/x-bzip2",
+	".xz":  "application/x-xz",
+	".zst": "application/zstd",
+	".tar": "application/x-tar",
+	".7z":  "application/x-7z-compressed",
+	".jar": "application/java-archive",
+	".war": "application/java-archive",
+	".whl": "application/zip",
+	".deb": "application/vnd.debian.binary-package",
+	".rpm": "application/x-rpm",
+	".dmg": "application/x-apple-diskimage",
+	".iso": "application/x-iso9660-image",
+
+	".asc": "application/pgp-signature",
+	".sig": "application/pgp-signature",
+	".pem": "application/x-pem-file",
+}
+
+// typeByExtension is the content type of the extension from the built-in
+// table, or else from the mime package, or "" if neither knows it
+func typeByExtension(ext string) string {
+	if ctype, ok := builtinContentTypes[strings.ToLower(ext)]; ok {
+		return ctype
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,73 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// KnownSHA256 returns the digest if it has already been computed, either
+// by SHA256 or by reading the content through, and "" otherwise
+func (a *Artifact) KnownSHA256() string {
+	a.digestLock.Lock()
+	defer a.digestLock.Unlock()
+	return a.sha256
+}
+
+func (a *Artifact) setSHA256(digest string) {
+	a.digestLock.Lock()
+	defer a.digestLock.Unlock()
+	if a.sha256 == "" {
+		a.sha256 = digest
+	}
+}
+
+// hashingReader tees everything read from r into a sha256 hash, and
+// records the digest on the artifact once r is read through to the end.
+// A seek anywhere means the hash no longer covers the content as a
+// whole, so nothing is recorded after one.
+type hashingReader struct {
+	r    io.Reader
+	a    *Artifact
+	hash hash.Hash
+	done bool
+}
+
+// hashingReadSeeker is a hashingReader over a reader that can seek, such
+// as a file, so that callers that seek still can
+type hashingReadSeeker struct {
+	*hashingReader
+}
+
+func newHashingReader(a *Artifact, r io.Reader) io.Reader {
+	hr := &hashingReader{r: r, a: a, hash: sha256.New()}
+	if _, ok := r.(io.Seeker); ok {
+		return &hashingReadSeeker{hr}
+	}
+	return hr
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.hash.Write(p[:n])
+
+	if err == io.EOF && !hr.done {
+		hr.done = true
+		hr.a.setSHA256(hex.EncodeToString(hr.hash.Sum(nil)))
+	}
+
+	return n, err
+}
+
+func (hr *hashingReader) Close() error {
+	if closer, ok := hr.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (hrs *hashingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	hrs.done = true
+	return hrs.r.(io.Seeker).Seek(offset, whence)
+}
@@ -0,0 +1,77 @@
+package artifact
+
+import (
+	"os"
+	"sync"
+)
+
+// openFiles limits how many source files are open at once.  It is
+// process-wide since the open file limit is.
+var openFiles struct {
+	sync.Mutex
+	slots      chan bool
+	onThrottle func()
+}
+
+// LimitOpenFiles caps how many source files may be open at once, or
+// removes the cap if n is 0.  The onThrottle func, if given, is called
+// each time an open has to wait for another file to be closed.
+func LimitOpenFiles(n uint64, onThrottle func()) {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+
+	openFiles.slots = nil
+	if n > 0 {
+		openFiles.slots = make(chan bool, n)
+	}
+	openFiles.onThrottle = onThrottle
+}
+
+// AcquireOpenFile waits until another source file may be opened, and
+// returns the func to call once it has been closed
+func AcquireOpenFile() func() {
+	openFiles.Lock()
+	slots, onThrottle := openFiles.slots, openFiles.onThrottle
+	openFiles.Unlock()
+
+	if slots == nil {
+		return func() {}
+	}
+
+	select {
+	case slots <- true:
+	default:
+		if onThrottle != nil {
+			onThrottle()
+		}
+		slots <- true
+	}
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() { <-slots })
+	}
+}
+
+// limitedFile gives back its open file slot when closed
+type limitedFile struct {
+	*os.File
+	release func()
+}
+
+func openLimited(name string) (*limitedFile, error) {
+	release := AcquireOpenFile()
+
+	f, err := os.Open(name)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return &limitedFile{File: f, release: release}, nil
+}
+
+func (lf *limitedFile) Close() error {
+	defer lf.release()
+	return lf.File.Close()
+}
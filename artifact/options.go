@@ -12,4 +12,15 @@ type Options struct {
 	JobNumber   string
 	JobID       string
 	Perm        s3.ACL
+
+	ContentTypeByExtensionOnly bool
+	ContentTypePrecedence      string
+
+	// ContentTypes maps lowercase extensions, including the ".", to the
+	// content types that override detection
+	ContentTypes map[string]string
+
+	// DefaultContentType replaces application/octet-stream for content
+	// that isn't recognized
+	DefaultContentType string
 }
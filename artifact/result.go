@@ -1,7 +1,17 @@
 package artifact
 
+import "time"
+
 // Result contains some lame simple crap about things done with artifacts
 type Result struct {
-	OK  bool
-	Err error
+	OK       bool
+	Err      error
+	URL      string
+	Duration time.Duration
+
+	// SignedURL downloads the object without credentials until it expires
+	SignedURL string
+
+	// Attempts counts the times the upload was tried, including retries
+	Attempts uint64
 }
@@ -0,0 +1,145 @@
+package artifact
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stream is the content of an artifact that can only be read once, such
+// as stdin, along with the size it promises to have
+type stream struct {
+	// read counts what has been read of an unsized stream, first so that
+	// it is aligned for atomic access
+	read uint64
+
+	sync.Mutex
+
+	r       *bufio.Reader
+	size    uint64
+	unsized bool
+	used    bool
+}
+
+// NewFromStream creates a new *Artifact whose content is read once from
+// r rather than from a source file.  Reading it fails if r turns out to
+// have more or less than size bytes.
+func NewFromStream(prefix, dest string, r io.Reader, size uint64, opts *Options) *Artifact {
+	a := New(prefix, "", dest, opts)
+	a.stream = &stream{r: bufio.NewReader(r), size: size}
+	a.modTime = time.Now()
+	return a
+}
+
+// NewFromUnsizedStream creates a new *Artifact whose content is read once
+// from r, for streams whose size isn't known until they end.  Its size is
+// however much has been read so far.
+func NewFromUnsizedStream(prefix, dest string, r io.Reader, opts *Options) *Artifact {
+	a := NewFromStream(prefix, dest, r, 0, opts)
+	a.stream.unsized = true
+	return a
+}
+
+// SizeUnknown reports whether the artifact is a stream whose size is only
+// known once it has all been read
+func (a *Artifact) SizeUnknown() bool {
+	return a.stream != nil && a.stream.unsized
+}
+
+// IsStream reports whether the artifact's content can only be read once
+func (a *Artifact) IsStream() bool {
+	return a.stream != nil
+}
+
+func (s *stream) ContentType() string {
+	s.Lock()
+	defer s.Unlock()
+
+	// peeking doesn't consume anything, so the upload still gets it all
+	buf, err := s.r.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return defaultCtype
+	}
+
+	return http.DetectContentType(buf)
+}
+
+func (s *stream) Reader() (io.Reader, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.used {
+		return nil, fmt.Errorf("streamed artifact can only be read once")
+	}
+
+	s.used = true
+	if s.unsized {
+		return &countingReader{r: s.r, read: &s.read}, nil
+	}
+	return &sizedReader{r: s.r, size: s.size}, nil
+}
+
+func (s *stream) Size() uint64 {
+	if s.unsized {
+		return atomic.LoadUint64(&s.read)
+	}
+	return s.size
+}
+
+// countingReader counts what it reads into read
+type countingReader struct {
+	r    io.Reader
+	read *uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.read, uint64(n))
+	return n, err
+}
+
+// sizedReader fails reads once it's clear that the underlying reader has
+// a different size than expected.  A stream that is too large fails the
+// read that would have returned its last expected bytes, so that nothing
+// downstream sees a complete body.
+type sizedReader struct {
+	r    *bufio.Reader
+	size uint64
+	read uint64
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	if sr.read == sr.size {
+		if _, err := sr.r.Peek(1); err == nil {
+			return 0, sr.tooLarge()
+		}
+		return 0, io.EOF
+	}
+
+	if remaining := sr.size - sr.read; uint64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := sr.r.Read(p)
+	sr.read += uint64(n)
+
+	if err == io.EOF && sr.read < sr.size {
+		return n, fmt.Errorf("stream ended after %d bytes, expected %d", sr.read, sr.size)
+	}
+
+	if sr.read == sr.size {
+		if _, peekErr := sr.r.Peek(1); peekErr == nil {
+			return 0, sr.tooLarge()
+		}
+	}
+
+	return n, err
+}
+
+func (sr *sizedReader) tooLarge() error {
+	return fmt.Errorf("stream is larger than the expected %d bytes", sr.size)
+}
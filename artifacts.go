@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -18,8 +22,29 @@ var (
 )
 
 func main() {
-	app := buildApp()
-	app.Run(os.Args)
+	os.Exit(run(os.Args))
+}
+
+// exitCode unwinds a command that failed through its deferred cleanup
+// and back to run, which returns it
+type exitCode int
+
+// run runs the app and returns the code to exit with, once the profiles
+// have been written
+func run(args []string) (code int) {
+	defer stopProfiling()
+	defer func() {
+		if r := recover(); r != nil {
+			ec, ok := r.(exitCode)
+			if !ok {
+				panic(r)
+			}
+			code = int(ec)
+		}
+	}()
+
+	buildApp().Run(args)
+	return 0
 }
 
 func buildApp() *cli.App {
@@ -33,6 +58,17 @@ func buildApp() *cli.App {
 			EnvVar: "ARTIFACTS_LOG_FORMAT",
 			Usage:  "log output format (text, json, or multiline)",
 		},
+		cli.StringFlag{
+			Name:   "log-file",
+			EnvVar: "ARTIFACTS_LOG_FILE",
+			Usage:  "log to this file (created or truncated) in the --log-format instead of to stdout",
+		},
+		cli.StringSliceFlag{
+			Name:   "log-output",
+			EnvVar: "ARTIFACTS_LOG_OUTPUTS",
+			Value:  &cli.StringSlice{},
+			Usage:  "log to this destination instead, which may be given more than once (console:<format>, stdout:<format>, or file:<path>:<format>)",
+		},
 		cli.BoolFlag{
 			Name:   "debug, D",
 			EnvVar: "ARTIFACTS_DEBUG",
@@ -43,7 +79,18 @@ func buildApp() *cli.App {
 			EnvVar: "ARTIFACTS_QUIET",
 			Usage:  "set log level to panic",
 		},
+		hiddenFlag{cli.StringFlag{
+			Name:   "profile-cpu",
+			EnvVar: "ARTIFACTS_PROFILE_CPU",
+			Usage:  "write a pprof cpu profile of the run to this file (for debugging)",
+		}},
+		hiddenFlag{cli.StringFlag{
+			Name:   "profile-mem",
+			EnvVar: "ARTIFACTS_PROFILE_MEM",
+			Usage:  "write a pprof heap profile at the end of the run to this file (for debugging)",
+		}},
 	}
+	app.Before = startProfiling
 	app.Commands = []cli.Command{
 		{
 			Name:        "upload",
@@ -53,6 +100,163 @@ func buildApp() *cli.App {
 			Flags:       upload.DefaultOptions.Flags(),
 			Action:      runUpload,
 		},
+		{
+			Name:        "sync",
+			Usage:       "make the target paths mirror the local paths",
+			Description: upload.SyncCommandDescription,
+			Flags: append(upload.DefaultOptions.Flags(),
+				cli.BoolFlag{
+					Name:   "delete",
+					EnvVar: "ARTIFACTS_SYNC_DELETE",
+					Usage:  "delete remote objects with no local counterpart (dry run unless --confirm is set)",
+				},
+				cli.BoolFlag{
+					Name:   "confirm",
+					EnvVar: "ARTIFACTS_SYNC_CONFIRM",
+					Usage:  "actually delete remote objects when --delete is set",
+				}),
+			Action: runSync,
+		},
+		{
+			Name:        "list",
+			Usage:       "list the objects under the target paths",
+			Description: upload.ListCommandDescription,
+			Flags: append(upload.DefaultOptions.Flags(),
+				cli.StringFlag{
+					Name:   "filter-glob",
+					EnvVar: "ARTIFACTS_LIST_FILTER_GLOB",
+					Usage:  "only list keys matching this glob, where ** matches any number of path segments",
+				},
+				cli.StringFlag{
+					Name:   "filter-min-size",
+					EnvVar: "ARTIFACTS_LIST_FILTER_MIN_SIZE",
+					Usage:  "only list objects of at least this size, e.g. 100MB",
+				},
+				cli.StringFlag{
+					Name:   "filter-max-size",
+					EnvVar: "ARTIFACTS_LIST_FILTER_MAX_SIZE",
+					Usage:  "only list objects of at most this size",
+				},
+				cli.StringFlag{
+					Name:   "filter-older-than",
+					EnvVar: "ARTIFACTS_LIST_FILTER_OLDER_THAN",
+					Usage:  "only list objects last modified longer ago than this, e.g. 36h or 7d",
+				},
+				cli.StringFlag{
+					Name:   "filter-newer-than",
+					EnvVar: "ARTIFACTS_LIST_FILTER_NEWER_THAN",
+					Usage:  "only list objects last modified more recently than this",
+				},
+				cli.StringFlag{
+					Name:   "prefix",
+					EnvVar: "ARTIFACTS_LIST_PREFIX",
+					Usage:  "list the objects under this key prefix instead of the target paths",
+				},
+				cli.BoolTFlag{
+					Name:   "recursive",
+					EnvVar: "ARTIFACTS_LIST_RECURSIVE",
+					Usage:  "list every object below the prefixes, or with --recursive=false, only one level down",
+				}),
+			Action: runList,
+		},
+		{
+			Name:        "prune",
+			Usage:       "delete old builds under the target paths",
+			Description: upload.PruneCommandDescription,
+			Flags: append(upload.DefaultOptions.Flags(),
+				cli.StringFlag{
+					Name:   "prefix",
+					EnvVar: "ARTIFACTS_PRUNE_PREFIX",
+					Usage:  "prune under this key prefix instead of the target paths",
+				},
+				cli.StringFlag{
+					Name:   "older-than",
+					EnvVar: "ARTIFACTS_PRUNE_OLDER_THAN",
+					Usage:  "prune the builds last modified longer ago than this, e.g. 30d",
+				},
+				cli.IntFlag{
+					Name:   "keep-last",
+					EnvVar: "ARTIFACTS_PRUNE_KEEP_LAST",
+					Usage:  "keep this many of the newest builds under each prefix",
+				}),
+			Action: runPrune,
+		},
+		{
+			Name:        "delete",
+			ShortName:   "clean",
+			Usage:       "delete objects by key, or everything under some prefixes",
+			Description: upload.DeleteCommandDescription,
+			Flags: append(upload.DefaultOptions.Flags(),
+				cli.BoolFlag{
+					Name:   "recursive",
+					EnvVar: "ARTIFACTS_DELETE_RECURSIVE",
+					Usage:  "delete every object under each argument, as a prefix",
+				},
+				cli.BoolFlag{
+					Name:   "force",
+					EnvVar: "ARTIFACTS_DELETE_FORCE",
+					Usage:  "delete under prefixes without asking first",
+				}),
+			Action: runDelete,
+		},
+		{
+			Name:        "watch",
+			ShortName:   "w",
+			Usage:       "keep uploading the files under some paths as they are added or changed",
+			Description: upload.WatchCommandDescription,
+			Flags: append(upload.DefaultOptions.Flags(),
+				cli.DurationFlag{
+					Name:   "interval",
+					EnvVar: "ARTIFACTS_WATCH_INTERVAL",
+					Value:  upload.DefaultWatchInterval,
+					Usage:  "how often to scan the paths for changes, since they are polled rather than watched with filesystem events",
+				},
+				cli.DurationFlag{
+					Name:   "debounce",
+					EnvVar: "ARTIFACTS_WATCH_DEBOUNCE",
+					Value:  upload.DefaultWatchDebounce,
+					Usage:  "how long a file has to go unchanged before it is uploaded",
+				},
+				cli.DurationFlag{
+					Name:   "summary-interval",
+					EnvVar: "ARTIFACTS_WATCH_SUMMARY_INTERVAL",
+					Value:  upload.DefaultWatchSummaryInterval,
+					Usage:  "how often to log the totals so far, or never if 0",
+				},
+				cli.StringFlag{
+					Name:   "status-addr",
+					EnvVar: "ARTIFACTS_WATCH_STATUS_ADDR",
+					Usage:  "serve the watch status as JSON on this host:port",
+				}),
+			Action: runWatch,
+		},
+		{
+			Name:        "download",
+			ShortName:   "d",
+			Usage:       "download the objects under some prefixes into a local directory",
+			Description: upload.DownloadCommandDescription,
+			Flags: append(upload.DefaultOptions.Flags(),
+				cli.StringFlag{
+					Name:   "target-dir",
+					EnvVar: "ARTIFACTS_DOWNLOAD_TARGET_DIR",
+					Usage:  "local directory to download into, making every argument a prefix",
+				}),
+			Action: runDownload,
+		},
+		{
+			Name:        "validate",
+			Usage:       "check the options and that the destination can be reached and written to",
+			Description: upload.ValidateCommandDescription,
+			Flags:       upload.DefaultOptions.Flags(),
+			Action:      runValidate,
+		},
+		{
+			Name:        "verify",
+			Usage:       "check that the artifacts under the target paths match the local files",
+			Description: upload.VerifyCommandDescription,
+			Flags:       upload.DefaultOptions.Flags(),
+			Action:      runVerify,
+		},
 	}
 
 	return app
@@ -60,29 +264,321 @@ func buildApp() *cli.App {
 
 func runUpload(c *cli.Context) {
 	log := configureLog(c)
+	uploadWithOptions(log, loadOptions(c, log))
+}
 
-	opts := upload.NewOptions()
-	opts.UpdateFromCLI(c)
+func uploadWithOptions(log *logrus.Logger, opts *upload.Options) {
+	// the result document has stdout to itself
+	if opts.ResultFile == "-" && log.Out == os.Stdout {
+		log.Out = os.Stderr
+	}
+
+	if opts.ValidateOnly {
+		count, err := upload.ValidateOnly(opts, log)
+		if err != nil {
+			exitWithError(log, opts, err)
+		}
+
+		log.WithField("files", count).Info("options and paths are valid")
+		return
+	}
+
+	if err := opts.Validate(); err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	// an interrupted or terminated upload stops its requests in flight (or
+	// lets them finish, with --shutdown-grace) and still reports what it
+	// got done.  A second signal kills it outright.
+	ctx, stop := signalContext()
+	defer stop()
+
+	if err := upload.Upload(ctx, opts, log); err != nil {
+		exitWithError(log, opts, err)
+	}
+}
+
+// signalContext is canceled by the first interrupt or termination, after
+// which signals are handled as usual again, so a second one kills the
+// process outright
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+func runSync(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+
+	// sync is upload --sync, with its own names for the deletion options
+	opts.Sync = true
+	opts.SyncDelete = opts.SyncDelete || c.Bool("delete")
+	opts.SyncConfirm = opts.SyncConfirm || c.Bool("confirm")
+
+	uploadWithOptions(log, opts)
+}
+
+func runList(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+
+	if err := opts.Validate(); err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	listOpts, err := upload.NewListOptions(c.String("filter-glob"),
+		c.String("filter-min-size"), c.String("filter-max-size"),
+		c.String("filter-older-than"), c.String("filter-newer-than"))
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+	listOpts.Prefix = c.String("prefix")
+	listOpts.Shallow = !c.BoolT("recursive")
+	listOpts.Format = opts.DryRunFormat
+
+	count, err := upload.List(opts, listOpts, os.Stdout, log)
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	log.WithField("objects", count).Debug("list complete")
+}
+
+func runPrune(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+	opts.Paths = nil
+
+	if err := opts.Validate(); err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	pruneOpts, err := upload.NewPruneOptions(c.String("prefix"), c.String("older-than"), c.Int("keep-last"))
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	result, err := upload.Prune(opts, pruneOpts, log)
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"pruned":  result.Pruned,
+		"kept":    result.Kept,
+		"deleted": result.Deleted,
+		"bytes":   result.Bytes,
+		"dry_run": result.DryRun,
+	}).Info("prune complete")
+}
+
+func runDelete(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+	opts.Paths = nil
+
+	keys := []string(c.Args())
+	if len(keys) == 0 {
+		exitWithError(log, opts, fmt.Errorf("usage: artifacts delete [options] <key>..., or --recursive <prefix>..."))
+	}
 
 	if err := opts.Validate(); err != nil {
-		log.Fatal(err)
+		exitWithError(log, opts, err)
 	}
 
-	if err := upload.Upload(opts, log); err != nil {
-		log.Fatal(err)
+	result, err := upload.Delete(opts, &upload.DeleteOptions{
+		Keys:      keys,
+		Recursive: c.Bool("recursive"),
+		Force:     c.Bool("force"),
+	}, log)
+	if err != nil {
+		exitWithError(log, opts, err)
 	}
+
+	log.WithFields(logrus.Fields{
+		"deleted": result.Deleted,
+		"missing": result.Missing,
+		"bytes":   result.Bytes,
+		"dry_run": result.DryRun,
+	}).Info("delete complete")
+}
+
+func runWatch(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+
+	if err := opts.Validate(); err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	watchOpts, err := upload.NewWatchOptions(c.Duration("interval"), c.Duration("debounce"),
+		c.Duration("summary-interval"), c.String("status-addr"))
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	// watching goes on until interrupted or terminated, letting the batch
+	// in flight stop as an upload would
+	ctx, stop := signalContext()
+	defer stop()
+
+	if err := upload.Watch(ctx, opts, watchOpts, log); err != nil {
+		exitWithError(log, opts, err)
+	}
+}
+
+func runDownload(c *cli.Context) {
+	log := configureLog(c)
+
+	prefixes, dest := []string(c.Args()), c.String("target-dir")
+	if dest == "" && len(prefixes) > 1 {
+		prefixes, dest = prefixes[:len(prefixes)-1], prefixes[len(prefixes)-1]
+	}
+	opts := loadOptions(c, log)
+	opts.Paths = nil
+
+	if dest == "" || len(prefixes) == 0 {
+		exitWithError(log, opts, fmt.Errorf("usage: artifacts download [options] <prefix>... <dest-dir>, or --target-dir <dest-dir> <prefix>..."))
+	}
+
+	if err := opts.Validate(); err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	result, err := upload.Download(opts, &upload.DownloadOptions{
+		Prefixes: prefixes,
+		Dest:     dest,
+	}, log)
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"downloaded": result.Downloaded,
+		"skipped":    result.Skipped,
+		"bytes":      result.Bytes,
+	}).Info("download complete")
+}
+
+func runValidate(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+
+	if err := upload.ValidateDestination(opts, os.Stdout, log); err != nil {
+		exitWithError(log, opts, err)
+	}
+}
+
+func runVerify(c *cli.Context) {
+	log := configureLog(c)
+
+	opts := loadOptions(c, log)
+
+	if err := opts.Validate(); err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	result, err := upload.Verify(opts, os.Stdout, log)
+	if result != nil {
+		log.WithFields(logrus.Fields{
+			"verified":   result.Verified,
+			"size_only":  result.SizeOnly,
+			"missing":    result.Missing,
+			"mismatched": result.Mismatched,
+			"errored":    result.Errored,
+		}).Info("verify complete")
+	}
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+}
+
+// exitWithError logs the error and exits with the code that
+// --exit-code-map gives its failure category, by way of run so that
+// deferred cleanup and profiling still happen
+func exitWithError(log *logrus.Logger, opts *upload.Options, err error) {
+	log.Error(err)
+
+	// the log is configured before there are any options to map codes by
+	exitCodeMap := ""
+	if opts != nil {
+		exitCodeMap = opts.ExitCodeMap
+	}
+	panic(exitCode(upload.ExitCode(err, exitCodeMap)))
+}
+
+// loadOptions layers the --config file, $ARTIFACTS_CONFIG_JSON, the
+// environment, and the command line over the defaults, each winning over
+// the ones before it.  Without --config, the config file is looked for in
+// --working-dir, if it was given.
+func loadOptions(c *cli.Context, log *logrus.Logger) *upload.Options {
+	workingDir := ""
+	if c.IsSet("working-dir") {
+		workingDir = c.String("working-dir")
+	}
+
+	opts, err := upload.LoadOptionsIn(c.String("config"), workingDir)
+	if err != nil {
+		exitWithError(log, opts, err)
+	}
+
+	opts.UpdateFromCLI(c)
+	return opts
 }
 
 func configureLog(c *cli.Context) *logrus.Logger {
 	log := logrus.New()
 
-	switch c.GlobalString("log-format") {
-	case "json":
-		log.Formatter = &logrus.JSONFormatter{}
-	case "multiline":
-		log.Formatter = &logging.MultiLineFormatter{}
-	default:
-		log.Formatter = &logrus.TextFormatter{}
+	formatter, err := logging.NewFormatter(c.GlobalString("log-format"))
+	if err != nil {
+		formatter = &logrus.TextFormatter{}
+	}
+	log.Formatter = formatter
+
+	if path := c.GlobalString("log-file"); path != "" {
+		if len(c.GlobalStringSlice("log-output")) > 0 {
+			exitWithError(log, nil, fmt.Errorf("--log-file and --log-output cannot be combined"))
+		}
+
+		// each entry is written straight to the file, so nothing is lost
+		// when a failed command exits
+		f, err := os.Create(path)
+		if err != nil {
+			exitWithError(log, nil, fmt.Errorf("could not open --log-file: %v", err))
+		}
+		log.Out = f
+	}
+
+	if specs := c.GlobalStringSlice("log-output"); len(specs) > 0 {
+		hook := &logging.FanOutHook{}
+		for _, spec := range specs {
+			output, err := logging.ParseOutput(spec)
+			if err != nil {
+				exitWithError(log, nil, err)
+			}
+			hook.Outputs = append(hook.Outputs, output)
+		}
+
+		log.Out = ioutil.Discard
+		log.Hooks.Add(hook)
 	}
 
 	if c.GlobalBool("debug") {
@@ -94,5 +590,9 @@ func configureLog(c *cli.Context) *logrus.Logger {
 		log.Level = logrus.PanicLevel
 	}
 
+	if activeProfiler != nil {
+		log.Hooks.Add(activeProfiler)
+	}
+
 	return log
 }
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +20,41 @@ func TestBuildApp(t *testing.T) {
 		t.Errorf("unexpected app name: %v", app.Name)
 	}
 }
+
+func TestLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-log-file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "artifacts.log")
+	if err := ioutil.WriteFile(logPath, []byte("left over\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	code := run([]string{"artifacts", "--log-file", logPath, "--log-format", "json",
+		"upload", "--config", filepath.Join(dir, "missing.json")})
+	if code == 0 {
+		t.Fatalf("upload with a missing config file exited 0")
+	}
+
+	body, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("log file %q is not json: %v", body, err)
+	}
+
+	if entry["level"] != "error" || !strings.Contains(fmt.Sprint(entry["msg"]), "config file cannot be read") {
+		t.Fatalf("unexpected log entry %#v", entry)
+	}
+
+	if strings.Contains(string(body), "left over") {
+		t.Fatalf("log file was not truncated: %q", body)
+	}
+}
@@ -6,3 +6,16 @@ import "github.com/travis-ci/artifacts/artifact"
 type ArtifactPutter interface {
 	PutArtifact(*artifact.Artifact) error
 }
+
+// ArtifactResumer is implemented by clients that can pick an interrupted
+// put up where the save host left off rather than starting over
+type ArtifactResumer interface {
+	ArtifactOffset(*artifact.Artifact) (uint64, error)
+	ResumeArtifact(*artifact.Artifact, uint64) error
+}
+
+// ArtifactChunker is implemented by clients that can put an artifact a
+// chunk at a time, each appended by the save host to the ones before it
+type ArtifactChunker interface {
+	PutArtifactChunk(a *artifact.Artifact, offset, length uint64) error
+}
@@ -2,26 +2,72 @@ package client
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/travis-ci/artifacts/artifact"
 )
 
+const (
+	// offsetHeader is how the save host reports the bytes it already has
+	// of an interrupted put, and how a resumed put says where it starts
+	offsetHeader = "Artifacts-Offset"
+)
+
 var (
-	errFailedPut = fmt.Errorf("failed to put artifact to artifacts service")
+	// ErrOffsetUnsupported is returned by ArtifactOffset when the save
+	// host doesn't report offsets, so puts have to start over
+	ErrOffsetUnsupported = fmt.Errorf("save host does not report upload offsets")
 
 	defaultRetryInterval = 3 * time.Second
 )
 
+// PutError is a put that the save host answered with something other
+// than a 200, along with how long it asked to be left alone for with a
+// Retry-After header, if it did
+type PutError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (pe *PutError) Error() string {
+	return fmt.Sprintf("failed to put artifact to artifacts service: %s", pe.Status)
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of
+// seconds or an http date, as of now
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
 // Client does stuff with the server
 type Client struct {
 	SaveHost      string
 	Token         string
 	RetryInterval time.Duration
+	HTTPClient    *http.Client
+
+	// TokenSource, if set, gives the token for each request in place of
+	// Token, so that a token refreshed mid-run is picked up
+	TokenSource func() string
 
 	log *logrus.Logger
 }
@@ -32,6 +78,7 @@ func New(host, token string, log *logrus.Logger) *Client {
 		SaveHost:      host,
 		Token:         token,
 		RetryInterval: defaultRetryInterval,
+		HTTPClient:    &http.Client{},
 
 		log: log,
 	}
@@ -39,48 +86,144 @@ func New(host, token string, log *logrus.Logger) *Client {
 
 // PutArtifact puts ... an ... artifact
 func (c *Client) PutArtifact(a *artifact.Artifact) error {
-	reader, err := a.Reader()
+	return c.putArtifact(a, 0, 0)
+}
+
+// PutArtifactChunk puts length bytes of the artifact from the offset, for
+// the save host to append to what it already has of the artifact, which
+// must be exactly the bytes before the offset
+func (c *Client) PutArtifactChunk(a *artifact.Artifact, offset, length uint64) error {
+	return c.putArtifact(a, offset, length)
+}
+
+// ArtifactOffset asks the save host how many bytes of the artifact it
+// already has, failing with ErrOffsetUnsupported if it doesn't say
+func (c *Client) ArtifactOffset(a *artifact.Artifact) (uint64, error) {
+	req, err := http.NewRequest("HEAD", c.artifactURL(a), nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	c.setHeaders(req, a)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	header := resp.Header.Get(offsetHeader)
+	if resp.StatusCode != 200 || header == "" {
+		return 0, ErrOffsetUnsupported
 	}
 
-	// e.g. hostname.example.org/owner/repo/jobs/123456/path/to/artifact
-	fullURL := fmt.Sprintf("%s/%s",
+	offset, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q from save host", offsetHeader, header)
+	}
+
+	return offset, nil
+}
+
+// ResumeArtifact puts the rest of the artifact, from the offset that the
+// save host already has
+func (c *Client) ResumeArtifact(a *artifact.Artifact, offset uint64) error {
+	return c.putArtifact(a, offset, 0)
+}
+
+// e.g. hostname.example.org/owner/repo/jobs/123456/path/to/artifact
+func (c *Client) artifactURL(a *artifact.Artifact) string {
+	return fmt.Sprintf("%s/%s",
 		c.SaveHost,
 		path.Join(a.RepoSlug, "jobs", a.JobID, a.Dest))
+}
+
+func (c *Client) setHeaders(req *http.Request, a *artifact.Artifact) {
+	req.Header.Set("Artifacts-Repo-Slug", a.RepoSlug)
+	req.Header.Set("Artifacts-Source", a.Source)
+	req.Header.Set("Artifacts-Dest", a.FullDest())
+	req.Header.Set("Artifacts-Job-Number", a.JobNumber)
+
+	token := c.Token
+	if c.TokenSource != nil {
+		token = c.TokenSource()
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+}
+
+// putArtifact puts the artifact from the offset, and only length bytes of
+// it unless that is 0.  Puts of less than the whole artifact say where
+// they start and end, so that the save host can append them.
+func (c *Client) putArtifact(a *artifact.Artifact, offset, length uint64) error {
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	if length == 0 || offset+length > size {
+		length = size - offset
+	}
+
+	// the client closes the request body once it's sent
+	reader, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		if err := skipTo(reader, offset); err != nil {
+			if closer, ok := reader.(io.Closer); ok {
+				closer.Close()
+			}
+			return err
+		}
+	}
+
+	fullURL := c.artifactURL(a)
 
 	c.log.WithFields(logrus.Fields{
 		"url":    fullURL,
 		"source": a.Source,
+		"offset": offset,
 	}).Debug("putting artifact to url")
 
-	req, err := http.NewRequest("PUT", fullURL, reader)
-	if err != nil {
-		return err
+	reqBody := reader
+	if offset+length < size {
+		reqBody = &limitedBody{Reader: io.LimitReader(reader, int64(length)), source: reader}
 	}
 
-	size, err := a.Size()
+	req, err := http.NewRequest("PUT", fullURL, reqBody)
 	if err != nil {
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
 		return err
 	}
 
-	req.Header.Set("Artifacts-Repo-Slug", a.RepoSlug)
-	req.Header.Set("Artifacts-Source", a.Source)
-	req.Header.Set("Artifacts-Dest", a.FullDest())
-	req.Header.Set("Artifacts-Job-Number", a.JobNumber)
+	c.setHeaders(req, a)
 	req.Header.Set("Artifacts-Size", fmt.Sprintf("%d", size))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	if offset > 0 || length < size {
+		req.ContentLength = int64(length)
+		req.Header.Set(offsetHeader, fmt.Sprintf("%d", offset))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return errFailedPut
+		return &PutError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
@@ -93,3 +236,29 @@ func (c *Client) PutArtifact(a *artifact.Artifact) error {
 
 	return nil
 }
+
+// limitedBody is the part of an artifact's reader that a chunk sends,
+// which closes the whole reader once the chunk is sent
+type limitedBody struct {
+	io.Reader
+	source io.Reader
+}
+
+func (lb *limitedBody) Close() error {
+	if closer, ok := lb.source.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// skipTo moves the reader past the bytes that were already sent, seeking
+// if it can
+func skipTo(reader io.Reader, offset uint64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(int64(offset), io.SeekStart)
+		return err
+	}
+
+	_, err := io.CopyN(ioutil.Discard, reader, int64(offset))
+	return err
+}
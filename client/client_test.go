@@ -1,9 +1,17 @@
 package client
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
 )
 
 func TestNew(t *testing.T) {
@@ -23,3 +31,175 @@ func TestNew(t *testing.T) {
 		t.Fatalf("RetryInterval %v != %v", c.RetryInterval, defaultRetryInterval)
 	}
 }
+
+// fakeSaveHost keeps what it receives of each put, cutting the first put
+// of each path off after FailAfter bytes when that is set.  Only with
+// Resumable does it report offsets and accept resumed puts.
+type fakeSaveHost struct {
+	sync.Mutex
+	Resumable bool
+	FailAfter int
+	Received  map[string][]byte
+	Puts      []string
+
+	Authorization string
+}
+
+func (fs *fakeSaveHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	switch r.Method {
+	case "HEAD":
+		if !fs.Resumable {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Artifacts-Offset", strconv.Itoa(len(fs.Received[r.URL.Path])))
+	case "PUT":
+		fs.Authorization = r.Header.Get("Authorization")
+		fs.Puts = append(fs.Puts, r.Header.Get("Artifacts-Offset"))
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if offset := r.Header.Get("Artifacts-Offset"); offset != "" {
+			if !fs.Resumable || offset != strconv.Itoa(len(fs.Received[r.URL.Path])) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			fs.Received[r.URL.Path] = append(fs.Received[r.URL.Path], body...)
+			return
+		}
+
+		if fs.FailAfter > 0 && len(fs.Puts) == 1 {
+			fs.Received[r.URL.Path] = body[:fs.FailAfter]
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fs.Received[r.URL.Path] = body
+	}
+}
+
+func getFakeSaveHostClient(t *testing.T, fs *fakeSaveHost) (*Client, *httptest.Server) {
+	fs.Received = map[string][]byte{}
+	server := httptest.NewServer(fs)
+
+	log := logrus.New()
+	log.Level = logrus.PanicLevel
+	return New(server.URL, "foo-bar", log), server
+}
+
+func TestClientResumeArtifact(t *testing.T) {
+	fs := &fakeSaveHost{Resumable: true, FailAfter: 4}
+	c, server := getFakeSaveHostClient(t, fs)
+	defer server.Close()
+
+	a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{
+		RepoSlug: "owner/repo",
+		JobID:    "123",
+	})
+
+	if c.PutArtifact(a) == nil {
+		t.Fatalf("cut off put did not fail")
+	}
+
+	offset, err := c.ArtifactOffset(a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if offset != 4 {
+		t.Fatalf("offset %v != 4", offset)
+	}
+
+	if err := c.ResumeArtifact(a, offset); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	received := string(fs.Received["/owner/repo/jobs/123/out.txt"])
+	if received != "0123456789" {
+		t.Fatalf("save host received %q != 0123456789", received)
+	}
+}
+
+func TestClientPutArtifactChunk(t *testing.T) {
+	fs := &fakeSaveHost{Resumable: true}
+	c, server := getFakeSaveHostClient(t, fs)
+	defer server.Close()
+
+	tokens := []string{}
+	c.TokenSource = func() string {
+		tokens = append(tokens, "refreshed")
+		return "refreshed"
+	}
+
+	a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{
+		RepoSlug: "owner/repo",
+		JobID:    "123",
+	})
+
+	for _, offset := range []uint64{0, 4, 8} {
+		if err := c.PutArtifactChunk(a, offset, 4); err != nil {
+			t.Fatalf("offset %v: unexpected error: %v", offset, err)
+		}
+	}
+
+	received := string(fs.Received["/owner/repo/jobs/123/out.txt"])
+	if received != "0123456789" {
+		t.Fatalf("save host received %q != 0123456789", received)
+	}
+	if !reflect.DeepEqual(fs.Puts, []string{"0", "4", "8"}) {
+		t.Fatalf("put offsets %v != [0 4 8]", fs.Puts)
+	}
+	if len(tokens) != 3 || fs.Authorization != "token refreshed" {
+		t.Fatalf("token asked for %v times, sent %q", len(tokens), fs.Authorization)
+	}
+}
+
+func TestClientArtifactOffsetUnsupported(t *testing.T) {
+	fs := &fakeSaveHost{}
+	c, server := getFakeSaveHostClient(t, fs)
+	defer server.Close()
+
+	a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{})
+	if _, err := c.ArtifactOffset(a); err != ErrOffsetUnsupported {
+		t.Fatalf("error %v != %v", err, ErrOffsetUnsupported)
+	}
+}
+
+func TestClientPutError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	log := logrus.New()
+	log.Level = logrus.PanicLevel
+	c := New(server.URL, "sekrit", log)
+
+	a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{})
+	err := c.PutArtifact(a)
+	putErr, ok := err.(*PutError)
+	if !ok {
+		t.Fatalf("error %#v is not a *PutError", err)
+	}
+
+	if putErr.StatusCode != http.StatusServiceUnavailable || putErr.RetryAfter != 7*time.Second {
+		t.Fatalf("unexpected put error %#v", putErr)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2014, 10, 14, 12, 0, 0, 0, time.UTC)
+	for header, expected := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"Tue, 14 Oct 2014 12:00:30 GMT": 30 * time.Second,
+		"Tue, 14 Oct 2014 11:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if d := parseRetryAfter(header, now); d != expected {
+			t.Fatalf("Retry-After %q: %v != %v", header, d, expected)
+		}
+	}
+}
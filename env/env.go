@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // CascadeMatch is like Cascade, but also returns which env var
@@ -53,6 +54,37 @@ func Uint(key string, dflt uint64) uint64 {
 	return uintVal
 }
 
+// Bool returns a bool from the env
+func Bool(key string, dflt bool) bool {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return dflt
+	}
+
+	boolVal, err := strconv.ParseBool(value)
+	if err != nil {
+		return dflt
+	}
+
+	return boolVal
+}
+
+// Duration returns the time.Duration from the environment or the
+// default if unset or unparseable
+func Duration(key string, dflt time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return dflt
+	}
+
+	durVal, err := time.ParseDuration(value)
+	if err != nil {
+		return dflt
+	}
+
+	return durVal
+}
+
 func expandSlice(vars []string) []string {
 	expanded := []string{}
 	for _, s := range vars {
@@ -4,6 +4,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -11,6 +12,8 @@ func init() {
 	os.Setenv("BAR", "")
 	os.Setenv("BAZ", "a:b:c::")
 	os.Setenv("MOAR", "32GB")
+	os.Setenv("YEP", "true")
+	os.Setenv("LATER", "2m30s")
 }
 
 type sliceCase struct {
@@ -52,6 +55,32 @@ func TestUint(t *testing.T) {
 	}
 }
 
+func TestBool(t *testing.T) {
+	for _, c := range [][]bool{
+		[]bool{true, Bool("YEP", false)},
+		[]bool{true, Bool("FOO", false)},
+		[]bool{true, Bool("BAR", true)},
+		[]bool{false, Bool("MOAR", false)},
+		[]bool{true, Bool("NOPE", true)},
+	} {
+		if c[0] != c[1] {
+			t.Fatalf("%v != %v", c[0], c[1])
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for _, c := range [][]time.Duration{
+		[]time.Duration{150 * time.Second, Duration("LATER", time.Second)},
+		[]time.Duration{time.Second, Duration("BAZ", time.Second)},
+		[]time.Duration{time.Minute, Duration("NOPE", time.Minute)},
+	} {
+		if c[0] != c[1] {
+			t.Fatalf("%v != %v", c[0], c[1])
+		}
+	}
+}
+
 func TestExpandSlice(t *testing.T) {
 	for _, c := range []sliceCase{
 		sliceCase{
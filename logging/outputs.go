@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// NewFormatter returns the formatter for a log format name, which is
+// one of text, json, or multiline
+func NewFormatter(name string) (logrus.Formatter, error) {
+	switch name {
+	case "text", "":
+		return &logrus.TextFormatter{}, nil
+	case "json":
+		return &logrus.JSONFormatter{}, nil
+	case "multiline":
+		return &MultiLineFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected text, json, or multiline)", name)
+	}
+}
+
+// Output is a destination for log entries, each formatted its own way
+type Output struct {
+	Writer    io.Writer
+	Formatter logrus.Formatter
+}
+
+// ParseOutput parses a log output given as "console:<format>",
+// "stdout:<format>", or "file:<path>:<format>", where the format is
+// optional and defaults to text, and opens its file if it has one
+func ParseOutput(spec string) (*Output, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	kind, rest := parts[0], ""
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+
+	format := ""
+	if kind == "file" {
+		if i := strings.LastIndex(rest, ":"); i > -1 {
+			if _, err := NewFormatter(rest[i+1:]); err == nil {
+				rest, format = rest[:i], rest[i+1:]
+			}
+		}
+	} else {
+		format = rest
+	}
+
+	formatter, err := NewFormatter(format)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "console", "stderr":
+		return &Output{Writer: os.Stderr, Formatter: formatter}, nil
+	case "stdout":
+		return &Output{Writer: os.Stdout, Formatter: formatter}, nil
+	case "file":
+		if rest == "" {
+			return nil, fmt.Errorf("log output %q has no file path", spec)
+		}
+
+		f, err := os.OpenFile(rest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		// colors only make sense on a terminal, which a file never is
+		if tf, ok := formatter.(*logrus.TextFormatter); ok {
+			tf.DisableColors = true
+		}
+		return &Output{Writer: f, Formatter: formatter}, nil
+	default:
+		return nil, fmt.Errorf("unknown log output %q (expected console, stdout, or file)", kind)
+	}
+}
+
+// FanOutHook is a logrus hook that writes every entry to each of its
+// outputs, for logging to more than one place at once.  The logger's own
+// output should be discarded so that entries aren't written twice.
+type FanOutHook struct {
+	Outputs []*Output
+
+	mu sync.Mutex
+}
+
+// Levels returns every level, since the logger has already filtered out
+// entries below its own level
+func (h *FanOutHook) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+		logrus.DebugLevel,
+	}
+}
+
+// Fire formats the entry once per output, each from a copy, since
+// formatters add the time, level, and message to the entry's fields
+func (h *FanOutHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, o := range h.Outputs {
+		data := logrus.Fields{}
+		for k, v := range entry.Data {
+			data[k] = v
+		}
+
+		serialized, err := o.Formatter.Format(&logrus.Entry{
+			Logger:  entry.Logger,
+			Data:    data,
+			Time:    entry.Time,
+			Level:   entry.Level,
+			Message: entry.Message,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := o.Writer.Write(serialized); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
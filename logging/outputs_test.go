@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestParseOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-log-outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for spec, expected := range map[string]logrus.Formatter{
+		"console":                 &logrus.TextFormatter{},
+		"console:json":            &logrus.JSONFormatter{},
+		"stdout:multiline":        &MultiLineFormatter{},
+		"file:" + dir + "/a.json": &logrus.TextFormatter{DisableColors: true},
+		"file:" + dir + "/b:json": &logrus.JSONFormatter{},
+	} {
+		output, err := ParseOutput(spec)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", spec, err)
+		}
+
+		if !formattersEqual(output.Formatter, expected) {
+			t.Fatalf("%q formatter %#v != %#v", spec, output.Formatter, expected)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.json")); err != nil {
+		t.Fatalf("log file was not created: %v", err)
+	}
+
+	for spec, msg := range map[string]string{
+		"console:xml":  "unknown log format",
+		"syslog:json":  "unknown log output",
+		"file:":        "has no file path",
+		"file::json":   "has no file path",
+		"stdout:yaml:": "unknown log format",
+	} {
+		_, err := ParseOutput(spec)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("error for %q does not contain %q: %v", spec, msg, err)
+		}
+	}
+}
+
+func formattersEqual(a, b logrus.Formatter) bool {
+	switch af := a.(type) {
+	case *logrus.TextFormatter:
+		bf, ok := b.(*logrus.TextFormatter)
+		return ok && *af == *bf
+	case *logrus.JSONFormatter:
+		_, ok := b.(*logrus.JSONFormatter)
+		return ok
+	case *MultiLineFormatter:
+		_, ok := b.(*MultiLineFormatter)
+		return ok
+	}
+	return false
+}
+
+func TestFanOutHook(t *testing.T) {
+	textOut := &bytes.Buffer{}
+	jsonOut := &bytes.Buffer{}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(&FanOutHook{Outputs: []*Output{
+		&Output{Writer: textOut, Formatter: &logrus.TextFormatter{DisableColors: true}},
+		&Output{Writer: jsonOut, Formatter: &logrus.JSONFormatter{}},
+	}})
+
+	log.WithField("size", 42).Info("uploading")
+	log.Debug("not at this level")
+
+	lines := strings.Split(strings.TrimSpace(jsonOut.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("json lines %v != 1: %q", len(lines), jsonOut.String())
+	}
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("malformed json record %q: %v", lines[0], err)
+	}
+
+	for key, value := range map[string]interface{}{
+		"msg":   "uploading",
+		"level": "info",
+		"size":  float64(42),
+	} {
+		if record[key] != value {
+			t.Fatalf("json record %s %v != %v", key, record[key], value)
+		}
+	}
+
+	if _, ok := record["fields.level"]; ok {
+		t.Fatalf("json record has fields from another output's formatter: %v", record)
+	}
+
+	text := textOut.String()
+	if strings.Count(text, "\n") != 1 {
+		t.Fatalf("text lines != 1: %q", text)
+	}
+
+	for _, expected := range []string{`level="info"`, `msg="uploading"`, `size=42`} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("text record does not contain %q: %q", expected, text)
+		}
+	}
+
+	if strings.Contains(text, "{") {
+		t.Fatalf("text record looks like json: %q", text)
+	}
+}
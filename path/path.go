@@ -24,7 +24,7 @@ func New(root, from, to string) *Path {
 
 // Fullpath returns the full file/dir path
 func (p *Path) Fullpath() string {
-	if p.IsAbs() || strings.HasPrefix(p.From, "/") {
+	if p.IsAbs() || filepath.IsAbs(p.From) || strings.HasPrefix(p.From, "/") {
 		return p.From
 	}
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+var (
+	activeProfiler *profiler
+)
+
+// hiddenFlag is a flag left out of the help, as this version of cli has
+// no Hidden field.  The help templates skip flags that print as nothing.
+type hiddenFlag struct {
+	cli.StringFlag
+}
+
+func (hf hiddenFlag) String() string {
+	return ""
+}
+
+func init() {
+	for _, tmpl := range []*string{&cli.AppHelpTemplate, &cli.CommandHelpTemplate, &cli.SubcommandHelpTemplate} {
+		*tmpl = strings.Replace(*tmpl, "{{range .Flags}}{{.}}\n   {{end}}",
+			"{{range .Flags}}{{with printf \"%s\" .}}{{.}}\n   {{end}}{{end}}", -1)
+	}
+}
+
+// profiler writes pprof cpu and/or heap profiles for the duration of a
+// run, and doubles as a log hook so that the profiles are flushed before
+// a fatal log entry exits the process
+type profiler struct {
+	cpuFile *os.File
+	memPath string
+	once    sync.Once
+}
+
+func startProfiling(c *cli.Context) error {
+	cpuPath := c.GlobalString("profile-cpu")
+	memPath := c.GlobalString("profile-mem")
+
+	if cpuPath == "" && memPath == "" {
+		return nil
+	}
+
+	p, err := newProfiler(cpuPath, memPath)
+	if err != nil {
+		return err
+	}
+
+	activeProfiler = p
+	return nil
+}
+
+func stopProfiling() {
+	if activeProfiler != nil {
+		activeProfiler.Stop()
+		activeProfiler = nil
+	}
+}
+
+func newProfiler(cpuPath, memPath string) (*profiler, error) {
+	p := &profiler{memPath: memPath}
+
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		p.cpuFile = f
+	}
+
+	return p, nil
+}
+
+// Stop finishes the cpu profile and writes the heap profile, if any.  It
+// is safe to call more than once.
+func (p *profiler) Stop() {
+	p.once.Do(func() {
+		if p.cpuFile != nil {
+			pprof.StopCPUProfile()
+			p.cpuFile.Close()
+		}
+
+		if p.memPath != "" {
+			f, err := os.Create(p.memPath)
+			if err != nil {
+				return
+			}
+			defer f.Close()
+
+			runtime.GC()
+			pprof.WriteHeapProfile(f)
+		}
+	})
+}
+
+func (p *profiler) Levels() []logrus.Level {
+	return []logrus.Level{logrus.FatalLevel, logrus.PanicLevel}
+}
+
+func (p *profiler) Fire(entry *logrus.Entry) error {
+	p.Stop()
+	return nil
+}
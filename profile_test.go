@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func assertPprofFile(t *testing.T, filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("profile not written: %v", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("profile %v is not gzipped protobuf: %v", filename, err)
+	}
+
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("profile %v could not be read: %v", filename, err)
+	}
+
+	if len(body) == 0 {
+		t.Fatalf("profile %v is empty", filename)
+	}
+}
+
+func TestProfilerWritesProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-profile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cpuPath := filepath.Join(dir, "cpu.pprof")
+	memPath := filepath.Join(dir, "mem.pprof")
+
+	p, err := newProfiler(cpuPath, memPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sum := 0
+	for i := 0; i < 1000000; i++ {
+		sum += i
+	}
+
+	p.Stop()
+	p.Stop()
+
+	assertPprofFile(t, cpuPath)
+	assertPprofFile(t, memPath)
+}
+
+func TestProfilerStopsOnFatalHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-profile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	memPath := filepath.Join(dir, "mem.pprof")
+
+	p, err := newProfiler("", memPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(p)
+	log.Hooks.Fire(logrus.FatalLevel, logrus.NewEntry(log))
+
+	assertPprofFile(t, memPath)
+}
+
+func TestRunStopsProfilingOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-profile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	memPath := filepath.Join(dir, "mem.pprof")
+	code := run([]string{"artifacts", "--quiet", "--profile-mem", memPath,
+		"upload", "--config", filepath.Join(dir, "missing.json")})
+	if code == 0 {
+		t.Fatalf("upload with a missing config file exited 0")
+	}
+
+	assertPprofFile(t, memPath)
+}
+
+func TestProfilingFlagsHidden(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	buildApp().Run([]string{"artifacts", "help"})
+	os.Stdout = stdout
+	w.Close()
+
+	help, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(help), "--log-format") {
+		t.Fatalf("help does not list the global options:\n%s", help)
+	}
+
+	if strings.Contains(string(help), "profile") {
+		t.Fatalf("help lists the profiling flags:\n%s", help)
+	}
+}
@@ -1,6 +1,7 @@
 package upload
 
 import (
+	"context"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -9,6 +10,10 @@ import (
 	"github.com/travis-ci/artifacts/client"
 )
 
+const (
+	artifactsProviderRetries = 2
+)
+
 var (
 	defaultProviderRetryInterval = 3 * time.Second
 )
@@ -16,28 +21,32 @@ var (
 type artifactsProvider struct {
 	RetryInterval time.Duration
 
-	opts *Options
-	log  *logrus.Logger
+	opts   *Options
+	log    *logrus.Logger
+	tokens *authTokenSource
 
 	overrideClient client.ArtifactPutter
 }
 
 func newArtifactsProvider(opts *Options, log *logrus.Logger) *artifactsProvider {
 	return &artifactsProvider{
-		RetryInterval: defaultProviderRetryInterval,
+		RetryInterval: opts.retryInterval(defaultProviderRetryInterval),
 
-		opts: opts,
-		log:  log,
+		opts:   opts,
+		log:    log,
+		tokens: newAuthTokenSource(opts, log),
 	}
 }
 
-func (ap *artifactsProvider) Upload(id string, opts *Options,
+func (ap *artifactsProvider) Upload(ctx context.Context, id string, opts *Options,
 	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
 
 	cl := ap.getClient()
 
 	for a := range in {
-		err := ap.uploadFile(cl, a)
+		start := time.Now()
+		err := ap.uploadFile(ctx, cl, a)
+		a.UploadResult.Duration = time.Since(start)
 		if err != nil {
 			a.UploadResult.OK = false
 			a.UploadResult.Err = err
@@ -51,22 +60,38 @@ func (ap *artifactsProvider) Upload(id string, opts *Options,
 	return
 }
 
-func (ap *artifactsProvider) uploadFile(cl client.ArtifactPutter, a *artifact.Artifact) error {
+func (ap *artifactsProvider) uploadFile(ctx context.Context, cl client.ArtifactPutter, a *artifact.Artifact) error {
+	if chunker, ok := cl.(client.ArtifactChunker); ok && ap.opts.ArtifactsChunkSize > 0 && !a.IsStream() {
+		size, err := a.Size()
+		if err != nil {
+			return err
+		}
+		if size > ap.opts.ArtifactsChunkSize {
+			return ap.chunkedUpload(ctx, cl, chunker, a, size)
+		}
+	}
+
 	retries := uint64(0)
 
 	for {
-		err := ap.rawUpload(cl, a)
+		a.UploadResult.Attempts++
+		err := ap.withTokenRefresh(ctx, func() error { return ap.rawUpload(cl, a, retries > 0) })
 		if err == nil {
 			return nil
 		}
-		if retries < ap.opts.Retries {
+		if retryable(err) && retries < ap.opts.Retries && !ap.opts.pastRetryDeadline() && ctx.Err() == nil && !a.IsStream() {
 			retries++
+			sleep := ap.opts.retrySleep(ap.RetryInterval, retries, err)
 			ap.log.WithFields(logrus.Fields{
 				"artifact": a.Source,
 				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
 				"err":      err,
 			}).Debug("retrying")
-			time.Sleep(ap.RetryInterval)
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
 			continue
 		} else {
 			return err
@@ -75,7 +100,7 @@ func (ap *artifactsProvider) uploadFile(cl client.ArtifactPutter, a *artifact.Ar
 	return nil
 }
 
-func (ap *artifactsProvider) rawUpload(cl client.ArtifactPutter, a *artifact.Artifact) error {
+func (ap *artifactsProvider) rawUpload(cl client.ArtifactPutter, a *artifact.Artifact, retry bool) error {
 	ctype := a.ContentType()
 	size, err := a.Size()
 	if err != nil {
@@ -91,9 +116,104 @@ func (ap *artifactsProvider) rawUpload(cl client.ArtifactPutter, a *artifact.Art
 		"cache_control":    ap.opts.CacheControl,
 	}).Debug("more artifact details")
 
+	if retry {
+		if resumer, ok := cl.(client.ArtifactResumer); ok {
+			return ap.resumeUpload(cl, resumer, a, size)
+		}
+	}
+
 	return cl.PutArtifact(a)
 }
 
+// resumeUpload sends only what the save host doesn't already have of an
+// interrupted upload, starting over if it can't say how much that is
+func (ap *artifactsProvider) resumeUpload(cl client.ArtifactPutter, resumer client.ArtifactResumer,
+	a *artifact.Artifact, size uint64) error {
+
+	offset, err := resumer.ArtifactOffset(a)
+	if err != nil {
+		ap.log.WithFields(logrus.Fields{
+			"artifact": a.Source,
+			"err":      err,
+		}).Debug("restarting upload from the beginning")
+		return cl.PutArtifact(a)
+	}
+
+	if offset == 0 || offset >= size {
+		return cl.PutArtifact(a)
+	}
+
+	ap.log.WithFields(logrus.Fields{
+		"artifact": a.Source,
+		"offset":   offset,
+		"size":     size,
+	}).Debug("resuming upload")
+
+	return resumer.ResumeArtifact(a, offset)
+}
+
+// chunkedUpload puts the artifact --save-host-chunk-size at a time, each
+// chunk retried on its own up to --retries times.  A chunk that the save
+// host kept some of before failing is resumed from there, if the host says
+// how much that was.
+func (ap *artifactsProvider) chunkedUpload(ctx context.Context, cl client.ArtifactPutter,
+	chunker client.ArtifactChunker, a *artifact.Artifact, size uint64) error {
+
+	resumer, canResume := cl.(client.ArtifactResumer)
+	chunkSize := ap.opts.ArtifactsChunkSize
+
+	ap.log.WithFields(logrus.Fields{
+		"artifact":   a.Source,
+		"chunks":     (size + chunkSize - 1) / chunkSize,
+		"chunk_size": humanize.Bytes(chunkSize),
+	}).Debug("starting chunked upload")
+
+	a.UploadResult.Attempts++
+	for offset := uint64(0); offset < size; {
+		length := chunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		retries := uint64(0)
+		for {
+			err := ap.withTokenRefresh(ctx, func() error { return chunker.PutArtifactChunk(a, offset, length) })
+			if err == nil {
+				break
+			}
+
+			if !retryable(err) || retries >= ap.opts.Retries || ap.opts.pastRetryDeadline() || ctx.Err() != nil {
+				return err
+			}
+
+			retries++
+			a.UploadResult.Attempts++
+			sleep := ap.opts.retrySleep(ap.RetryInterval, retries, err)
+			ap.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"offset":   offset,
+				"retry":    retries,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying chunk")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+
+			if canResume {
+				if kept, err := resumer.ArtifactOffset(a); err == nil && kept > offset && kept < offset+length {
+					length -= kept - offset
+					offset = kept
+				}
+			}
+		}
+
+		offset += length
+	}
+
+	return nil
+}
+
 func (ap *artifactsProvider) getClient() client.ArtifactPutter {
 	if ap.overrideClient != nil {
 		ap.log.WithField("client", ap.overrideClient).Debug("using override client")
@@ -101,7 +221,15 @@ func (ap *artifactsProvider) getClient() client.ArtifactPutter {
 	}
 
 	ap.log.Debug("creating new client")
-	return client.New(ap.opts.ArtifactsSaveHost, ap.opts.ArtifactsAuthToken, ap.log)
+	cl := client.New(ap.opts.ArtifactsSaveHost, ap.opts.ArtifactsAuthToken, ap.log)
+	cl.HTTPClient = ap.opts.httpClient()
+	cl.TokenSource = ap.tokens.Token
+	return cl
+}
+
+// RetryDefaults are gentle since the artifacts service is a single host
+func (ap *artifactsProvider) RetryDefaults() (uint64, time.Duration) {
+	return artifactsProviderRetries, defaultProviderRetryInterval
 }
 
 func (ap *artifactsProvider) Name() string {
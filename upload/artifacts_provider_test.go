@@ -1,12 +1,16 @@
 package upload
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mitchellh/goamz/s3"
 	"github.com/travis-ci/artifacts/artifact"
+	"github.com/travis-ci/artifacts/client"
 )
 
 type nullPutter struct {
@@ -53,7 +57,7 @@ func TestArtifactsUpload(t *testing.T) {
 	out := make(chan *artifact.Artifact)
 	done := make(chan bool)
 
-	go ap.Upload("test-0", opts, in, out, done)
+	go ap.Upload(context.Background(), "test-0", opts, in, out, done)
 
 	go func() {
 		for _, p := range testArtifactPaths {
@@ -87,3 +91,153 @@ func TestArtifactsUpload(t *testing.T) {
 		}
 	}
 }
+
+// resumingPutter fails the first put of each artifact, then reports the
+// offset it was given, or that it can't report one
+type resumingPutter struct {
+	Offset    uint64
+	OffsetErr error
+	Puts      int
+	Resumed   []uint64
+}
+
+func (rp *resumingPutter) PutArtifact(a *artifact.Artifact) error {
+	rp.Puts++
+	if rp.Puts == 1 {
+		return fmt.Errorf("connection reset")
+	}
+	return nil
+}
+
+func (rp *resumingPutter) ArtifactOffset(a *artifact.Artifact) (uint64, error) {
+	return rp.Offset, rp.OffsetErr
+}
+
+func (rp *resumingPutter) ResumeArtifact(a *artifact.Artifact, offset uint64) error {
+	rp.Resumed = append(rp.Resumed, offset)
+	return nil
+}
+
+func TestArtifactsProviderResumesRetries(t *testing.T) {
+	for _, c := range []struct {
+		Putter  *resumingPutter
+		Puts    int
+		Resumed []uint64
+	}{
+		{&resumingPutter{Offset: 4}, 1, []uint64{4}},
+		{&resumingPutter{Offset: 0}, 2, nil},
+		{&resumingPutter{Offset: 10}, 2, nil},
+		{&resumingPutter{OffsetErr: client.ErrOffsetUnsupported}, 2, nil},
+	} {
+		opts := NewOptions()
+		opts.Retries = 1
+		ap := newArtifactsProvider(opts, getPanicLogger())
+		ap.RetryInterval = 0
+
+		a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{})
+		if err := ap.uploadFile(context.Background(), c.Putter, a); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.Putter.Puts != c.Puts || !reflect.DeepEqual(c.Putter.Resumed, c.Resumed) {
+			t.Fatalf("offset %v: puts %v != %v, resumed %v != %v",
+				c.Putter.Offset, c.Putter.Puts, c.Puts, c.Putter.Resumed, c.Resumed)
+		}
+	}
+}
+
+// chunkingPutter fails the chunk at FailAt once, after the save host
+// kept Kept bytes of it
+type chunkingPutter struct {
+	resumingPutter
+	FailAt uint64
+	Kept   uint64
+	Chunks [][2]uint64
+	failed bool
+}
+
+func (cp *chunkingPutter) PutArtifactChunk(a *artifact.Artifact, offset, length uint64) error {
+	cp.Chunks = append(cp.Chunks, [2]uint64{offset, length})
+	if offset == cp.FailAt && !cp.failed {
+		cp.failed = true
+		cp.Offset = offset + cp.Kept
+		return fmt.Errorf("connection reset")
+	}
+	return nil
+}
+
+func TestArtifactsProviderChunkedUpload(t *testing.T) {
+	for _, c := range []struct {
+		Kept   uint64
+		Chunks [][2]uint64
+	}{
+		{0, [][2]uint64{{0, 4}, {4, 4}, {4, 4}, {8, 2}}},
+		{3, [][2]uint64{{0, 4}, {4, 4}, {7, 1}, {8, 2}}},
+	} {
+		opts := NewOptions()
+		opts.Retries = 1
+		opts.ArtifactsChunkSize = 4
+		ap := newArtifactsProvider(opts, getPanicLogger())
+		ap.RetryInterval = 0
+
+		cp := &chunkingPutter{FailAt: 4, Kept: c.Kept}
+		a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{})
+		if err := ap.uploadFile(context.Background(), cp, a); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !reflect.DeepEqual(cp.Chunks, c.Chunks) || cp.Puts != 0 {
+			t.Fatalf("kept %v: chunks %v != %v, puts %v", c.Kept, cp.Chunks, c.Chunks, cp.Puts)
+		}
+		if a.UploadResult.Attempts != 2 {
+			t.Fatalf("kept %v: attempts %v != 2", c.Kept, a.UploadResult.Attempts)
+		}
+	}
+}
+
+// unauthorizedPutter rejects every token but the one it wants
+type unauthorizedPutter struct {
+	Token  func() string
+	Wanted string
+	Tokens []string
+}
+
+func (up *unauthorizedPutter) PutArtifact(a *artifact.Artifact) error {
+	token := up.Token()
+	up.Tokens = append(up.Tokens, token)
+	if token != up.Wanted {
+		return &client.PutError{StatusCode: 401, Status: "401 Unauthorized"}
+	}
+	return nil
+}
+
+func TestArtifactsProviderAuthTokenCommand(t *testing.T) {
+	for _, c := range []struct {
+		Token   string
+		Command string
+		Tokens  []string
+		Err     string
+	}{
+		{"expired", "echo fresh", []string{"expired", "fresh"}, ""},
+		{"", "echo fresh", []string{"fresh"}, ""},
+		{"expired", "", []string{"expired"}, "401 Unauthorized"},
+		{"expired", "echo nope >&2; exit 1", []string{"expired"}, "--auth-token-command failed: exit status 1: nope"},
+	} {
+		opts := NewOptions()
+		opts.ArtifactsAuthToken = c.Token
+		opts.ArtifactsAuthTokenCommand = c.Command
+		ap := newArtifactsProvider(opts, getPanicLogger())
+		ap.RetryInterval = 0
+
+		up := &unauthorizedPutter{Token: ap.tokens.Token, Wanted: "fresh"}
+		a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{})
+		err := ap.uploadFile(context.Background(), up, a)
+		if (c.Err == "" && err != nil) || (c.Err != "" && (err == nil || !strings.Contains(err.Error(), c.Err))) {
+			t.Fatalf("%q: unexpected error: %v", c.Command, err)
+		}
+
+		if !reflect.DeepEqual(up.Tokens, c.Tokens) {
+			t.Fatalf("%q: tokens %v != %v", c.Command, up.Tokens, c.Tokens)
+		}
+	}
+}
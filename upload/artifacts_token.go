@@ -0,0 +1,93 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/client"
+)
+
+// authTokenSource is the save host token that the workers share, which
+// --auth-token-command replaces whenever the save host rejects it, so
+// that a short-lived token running out doesn't fail a long upload
+type authTokenSource struct {
+	command string
+	log     *logrus.Logger
+
+	lock  sync.Mutex
+	token string
+}
+
+func newAuthTokenSource(opts *Options, log *logrus.Logger) *authTokenSource {
+	return &authTokenSource{
+		command: opts.ArtifactsAuthTokenCommand,
+		log:     log,
+		token:   opts.ArtifactsAuthToken,
+	}
+}
+
+// Token is the token to send with the next request
+func (ts *authTokenSource) Token() string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.token
+}
+
+// Refresh runs the command for a new token, unless another worker has
+// already replaced the rejected one while this one was waiting
+func (ts *authTokenSource) Refresh(ctx context.Context, rejected string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.token != rejected {
+		return nil
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", ts.command)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--auth-token-command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return fmt.Errorf("--auth-token-command printed no token")
+	}
+
+	ts.log.Debug("refreshed save host auth token")
+	ts.token = token
+	return nil
+}
+
+// withTokenRefresh makes the request, and with --auth-token-command, makes
+// it once more with a new token if the save host rejected the one it had
+func (ap *artifactsProvider) withTokenRefresh(ctx context.Context, request func() error) error {
+	token := ap.tokens.Token()
+	if token == "" && ap.tokens.command != "" {
+		// nothing to start with, so the command gives the first token too
+		if err := ap.tokens.Refresh(ctx, token); err != nil {
+			return categorize(FailureCredentials, err)
+		}
+		token = ap.tokens.Token()
+	}
+
+	err := request()
+
+	var putErr *client.PutError
+	if err == nil || ap.tokens.command == "" || !errors.As(err, &putErr) || putErr.StatusCode != http.StatusUnauthorized {
+		return err
+	}
+
+	if err := ap.tokens.Refresh(ctx, token); err != nil {
+		return categorize(FailureCredentials, err)
+	}
+	return request()
+}
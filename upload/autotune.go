@@ -0,0 +1,286 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// autoConcurrencyStart is how many workers --concurrency auto starts
+	// with, and autoConcurrencyMax the most it grows to
+	autoConcurrencyStart = uint64(2)
+	autoConcurrencyMax   = uint64(32)
+
+	// autoChunkSizeMax is the largest multipart chunk size --concurrency
+	// auto grows to
+	autoChunkSizeMax = int64(64 * 1024 * 1024)
+
+	// autoTuneGain is how much the throughput has to change between two
+	// measurements to count as better or worse rather than noise
+	autoTuneGain = 0.1
+)
+
+// autoTuneInterval is how often --concurrency auto measures the uploads
+// done since the last time and decides whether to scale
+var autoTuneInterval = 5 * time.Second
+
+// setConcurrency sets --concurrency from its string form, where "auto"
+// tunes the workers during the run.  Values that aren't either are left
+// alone like those of the other numeric options.
+func (opts *Options) setConcurrency(value string) {
+	if value == "auto" {
+		opts.concurrencyAuto = true
+		return
+	}
+
+	if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+		opts.Concurrency = n
+		opts.concurrencyAuto = false
+	}
+}
+
+// maxWorkers is the most upload workers there will be at once
+func (opts *Options) maxWorkers() uint64 {
+	if opts.concurrencyAuto {
+		return autoConcurrencyMax
+	}
+	return opts.Concurrency
+}
+
+// autoTuner runs the upload workers for --concurrency auto, starting a few
+// and then growing or shrinking the pool, and the multipart chunk size of
+// providers that have one, by how the uploads since the last measurement
+// went: retries and failures back off, and more throughput than before
+// grows until it stops helping.
+type autoTuner struct {
+	ctx      context.Context
+	provider Provider
+	opts     *Options
+	log      *logrus.Logger
+
+	in   chan *artifact.Artifact
+	out  chan *artifact.Artifact
+	done chan bool
+
+	// retire has a channel for each running worker, closed to stop
+	// feeding it so that it finishes once its upload is done
+	retire  []chan bool
+	started uint64
+
+	ticker *time.Ticker
+	last   time.Time
+
+	// what finished since the last measurement
+	bytes    uint64
+	retries  uint64
+	failures uint64
+
+	lastRate float64
+	previous uint64
+	grew     bool
+}
+
+func (u *uploader) startAutoTuner(ctx context.Context, in, out chan *artifact.Artifact, done chan bool) *autoTuner {
+	at := &autoTuner{
+		ctx:      ctx,
+		provider: u.Provider,
+		opts:     u.Opts,
+		log:      u.log,
+
+		in:   in,
+		out:  out,
+		done: done,
+
+		ticker: time.NewTicker(autoTuneInterval),
+		last:   time.Now(),
+	}
+
+	at.scale(autoConcurrencyStart)
+	at.log.WithFields(logrus.Fields{
+		"workers":     autoConcurrencyStart,
+		"max_workers": autoConcurrencyMax,
+		"interval":    autoTuneInterval,
+	}).Debug("starting auto-tuned upload workers")
+
+	return at
+}
+
+// C ticks whenever it's time to Tune
+func (at *autoTuner) C() <-chan time.Time {
+	return at.ticker.C
+}
+
+// Stop stops the ticks, leaving the workers to finish
+func (at *autoTuner) Stop() {
+	at.ticker.Stop()
+}
+
+// Started is how many workers were started in all, including those that
+// were retired, since each of them is done once
+func (at *autoTuner) Started() uint64 {
+	return at.started
+}
+
+// Completed counts a finished upload towards the next measurement
+func (at *autoTuner) Completed(a *artifact.Artifact) {
+	if a.UploadResult.Attempts > 1 {
+		at.retries += a.UploadResult.Attempts - 1
+	}
+
+	if !a.UploadResult.OK {
+		if !isCanceled(a.UploadResult.Err) {
+			at.failures++
+		}
+		return
+	}
+
+	size, _ := a.Size()
+	at.bytes += size
+}
+
+// Tune measures the throughput since the last time and scales the workers
+// and chunk size by it
+func (at *autoTuner) Tune() {
+	now := time.Now()
+	elapsed := now.Sub(at.last).Seconds()
+	at.last = now
+
+	workers := uint64(len(at.retire))
+	rate := float64(at.bytes) / elapsed
+	fields := logrus.Fields{
+		"workers":    workers,
+		"rate":       humanize.Bytes(uint64(rate)) + "/s",
+		"per_worker": humanize.Bytes(uint64(rate/float64(workers))) + "/s",
+		"retries":    at.retries,
+		"failures":   at.failures,
+	}
+
+	target, grew := workers, false
+	chunkSize := int64(0)
+	reason := ""
+
+	switch {
+	case at.retries > 0 || at.failures > 0:
+		// and smaller parts cost less to send again
+		target = workers / 2
+		chunkSize = -1
+		reason = "uploads were retried or failed"
+	case at.bytes == 0:
+		reason = "nothing finished since the last measurement"
+	case at.lastRate == 0 || rate > at.lastRate*(1+autoTuneGain):
+		if workers < autoConcurrencyMax {
+			target, grew = workers+(workers+1)/2, true
+		} else {
+			// out of workers, so get more out of each request instead
+			chunkSize = 1
+		}
+		reason = "throughput grew"
+	case at.grew && rate < at.lastRate*(1-autoTuneGain):
+		target = at.previous
+		reason = "throughput dropped after the last scale up"
+	default:
+		reason = "throughput held"
+	}
+
+	if target < 1 {
+		target = 1
+	}
+	if target > autoConcurrencyMax {
+		target = autoConcurrencyMax
+	}
+
+	if at.bytes > 0 {
+		at.lastRate = rate
+	}
+	at.bytes, at.retries, at.failures = 0, 0, 0
+	at.previous, at.grew = workers, grew
+
+	fields["target"] = target
+	if chunkSize != 0 {
+		if size, ok := at.scaleChunkSize(chunkSize > 0); ok {
+			fields["chunk_size"] = humanize.Bytes(uint64(size))
+		}
+	}
+	at.log.WithFields(fields).Debug(fmt.Sprintf("auto-tuning concurrency: %s", reason))
+
+	at.scale(target)
+}
+
+// scale starts or retires workers until there are n of them
+func (at *autoTuner) scale(n uint64) {
+	for uint64(len(at.retire)) < n {
+		at.startWorker()
+	}
+
+	for uint64(len(at.retire)) > n {
+		last := len(at.retire) - 1
+		close(at.retire[last])
+		at.retire = at.retire[:last]
+	}
+}
+
+func (at *autoTuner) startWorker() {
+	workerIn := make(chan *artifact.Artifact)
+	retire := make(chan bool)
+
+	go func() {
+		defer close(workerIn)
+
+		for {
+			select {
+			case <-retire:
+				return
+			case a, ok := <-at.in:
+				if !ok {
+					return
+				}
+				workerIn <- a
+			}
+		}
+	}()
+
+	at.log.WithField("uploader", at.started).Debug("starting uploader worker")
+	go at.provider.Upload(at.ctx, fmt.Sprintf("%d", at.started), at.opts, workerIn, at.out, at.done)
+
+	at.retire = append(at.retire, retire)
+	at.started++
+}
+
+// scaleChunkSize doubles or halves the chunk size of a provider that has
+// one, within what S3 accepts and autoChunkSizeMax
+func (at *autoTuner) scaleChunkSize(grow bool) (int64, bool) {
+	cs, ok := at.provider.(chunkSizer)
+	if !ok {
+		return 0, false
+	}
+
+	size := cs.ChunkSize()
+	if grow && size < autoChunkSizeMax {
+		size *= 2
+		if size > autoChunkSizeMax {
+			size = autoChunkSizeMax
+		}
+	} else if !grow && size > defaultMultipartPartSize {
+		size /= 2
+		if size < defaultMultipartPartSize {
+			size = defaultMultipartPartSize
+		}
+	}
+
+	cs.SetChunkSize(size)
+	return size, true
+}
+
+// concurrencyField is --concurrency as logged with the upload settings
+func (u *uploader) concurrencyField() interface{} {
+	if u.Opts.concurrencyAuto {
+		return "auto"
+	}
+	return u.Opts.Concurrency
+}
@@ -0,0 +1,159 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// chunkedNullProvider is a null provider with a chunk size to tune
+type chunkedNullProvider struct {
+	nullProvider
+	size int64
+}
+
+func (cp *chunkedNullProvider) ChunkSize() int64 {
+	return cp.size
+}
+
+func (cp *chunkedNullProvider) SetChunkSize(size int64) {
+	cp.size = size
+}
+
+func TestConcurrencyAutoOptions(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("ARTIFACTS_CONCURRENCY", "auto")
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	if !opts.concurrencyAuto || opts.Concurrency != 5 || opts.maxWorkers() != autoConcurrencyMax {
+		t.Fatalf("concurrency from env %v auto=%v", opts.Concurrency, opts.concurrencyAuto)
+	}
+
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{"--concurrency", "3"}))
+	if opts.concurrencyAuto || opts.Concurrency != 3 || opts.maxWorkers() != 3 {
+		t.Fatalf("concurrency from cli %v auto=%v", opts.Concurrency, opts.concurrencyAuto)
+	}
+
+	os.Clearenv()
+	opts = NewOptions()
+	if err := opts.UpdateFromConfig(map[string]interface{}{"concurrency": "auto"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.concurrencyAuto {
+		t.Fatalf("concurrency from config %v is not auto", opts.Concurrency)
+	}
+}
+
+func TestAutoTunerTune(t *testing.T) {
+	cp := &chunkedNullProvider{size: defaultMultipartPartSize}
+	cp.Log = getPanicLogger()
+
+	in := make(chan *artifact.Artifact)
+	out := make(chan *artifact.Artifact)
+	done := make(chan bool)
+
+	u := getTestUploader(nil, nil)
+	u.Provider = cp
+	at := u.startAutoTuner(context.Background(), in, out, done)
+	defer at.Stop()
+
+	uploaded := func(attempts uint64) *artifact.Artifact {
+		a := artifact.NewFromBytes("", "x", make([]byte, 1024), &artifact.Options{})
+		a.UploadResult.OK = true
+		a.UploadResult.Attempts = attempts
+		return a
+	}
+
+	for i, tc := range []struct {
+		completed []*artifact.Artifact
+		workers   int
+		chunkSize int64
+	}{
+		// the first measurement grows, then again while it helps
+		{[]*artifact.Artifact{uploaded(1)}, 3, defaultMultipartPartSize},
+		{[]*artifact.Artifact{uploaded(1), uploaded(1), uploaded(1)}, 5, defaultMultipartPartSize},
+		// worse than before the last growth goes back
+		{[]*artifact.Artifact{uploaded(1)}, 3, defaultMultipartPartSize},
+		// nothing finished says nothing about the workers
+		{nil, 3, defaultMultipartPartSize},
+		// retries back off
+		{[]*artifact.Artifact{uploaded(1), uploaded(3)}, 1, defaultMultipartPartSize},
+	} {
+		at.last = time.Now().Add(-time.Second)
+		for _, a := range tc.completed {
+			at.Completed(a)
+		}
+		at.Tune()
+
+		if len(at.retire) != tc.workers {
+			t.Fatalf("%d: workers %v != %v", i, len(at.retire), tc.workers)
+		}
+		if cp.size != tc.chunkSize {
+			t.Fatalf("%d: chunk size %v != %v", i, cp.size, tc.chunkSize)
+		}
+	}
+
+	// out of workers grows the chunk size, and failures shrink it
+	at.scale(autoConcurrencyMax)
+	at.lastRate, at.grew = 1, false
+	at.last = time.Now().Add(-time.Second)
+	at.Completed(uploaded(1))
+	at.Tune()
+	if uint64(len(at.retire)) != autoConcurrencyMax || cp.size != 2*defaultMultipartPartSize {
+		t.Fatalf("workers %v, chunk size %v", len(at.retire), cp.size)
+	}
+
+	failed := uploaded(1)
+	failed.UploadResult.OK = false
+	failed.UploadResult.Err = fmt.Errorf("nope")
+	at.Completed(failed)
+	at.Tune()
+	if uint64(len(at.retire)) != autoConcurrencyMax/2 || cp.size != defaultMultipartPartSize {
+		t.Fatalf("workers %v, chunk size %v", len(at.retire), cp.size)
+	}
+
+	// every worker ever started is done once there's nothing left
+	close(in)
+	for i := uint64(0); i < at.Started(); i++ {
+		<-done
+	}
+}
+
+func TestUploaderConcurrencyAuto(t *testing.T) {
+	defer func(interval time.Duration) { autoTuneInterval = interval }(autoTuneInterval)
+	autoTuneInterval = time.Millisecond
+
+	os.Clearenv()
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("out/%02d.txt", i)] = "artifact"
+	}
+	dir := writeTestFiles(t, files)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"builds/1"}
+		opts.setConcurrency("auto")
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.results) != 50 {
+		t.Fatalf("results %v != 50", len(u.results))
+	}
+	for _, a := range u.results {
+		if !a.UploadResult.OK {
+			t.Fatalf("%s failed: %v", a.FullDest(), a.UploadResult.Err)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package upload
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// azureAPIVersion is the first to allow single Put Blob requests of
+	// up to 5000 MiB
+	azureAPIVersion = "2019-12-12"
+)
+
+// azureProvider uploads each artifact as a block blob in an Azure Blob
+// Storage container with a single Put Blob request, signed with the
+// account's shared key
+type azureProvider struct {
+	RetryInterval time.Duration
+
+	opts   *Options
+	log    *logrus.Logger
+	client *http.Client
+	now    func() time.Time
+}
+
+func newAzureProvider(opts *Options, log *logrus.Logger) *azureProvider {
+	return &azureProvider{
+		RetryInterval: opts.retryInterval(defaultProviderRetryInterval),
+
+		opts:   opts,
+		log:    log,
+		client: opts.httpClient(),
+		now:    time.Now,
+	}
+}
+
+func (opts *Options) validateAzure() error {
+	if opts.azureContainer() == "" {
+		return fmt.Errorf("no bucket name given (the azure container)")
+	}
+
+	if opts.AzureAccount == "" {
+		return fmt.Errorf("no azure storage account given")
+	}
+
+	if opts.AzureKey == "" && opts.AzureSASToken == "" {
+		return fmt.Errorf("no azure storage key or sas token given")
+	}
+
+	if opts.AzureKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(opts.AzureKey); err != nil {
+			return fmt.Errorf("invalid azure storage key, expected base64: %v", err)
+		}
+	} else if _, err := url.ParseQuery(opts.azureSASToken()); err != nil {
+		return fmt.Errorf("invalid azure sas token: %v", err)
+	}
+
+	if opts.AzureEndpoint != "" {
+		u, err := url.Parse(opts.AzureEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --azure-endpoint %q (expected an http or https URL)", opts.AzureEndpoint)
+		}
+	}
+
+	return nil
+}
+
+// azureContainer is --azure-container, or else --bucket
+func (opts *Options) azureContainer() string {
+	if opts.AzureContainer != "" {
+		return opts.AzureContainer
+	}
+	return opts.BucketName
+}
+
+// azureSASToken is --azure-sas-token as a query string, without the "?"
+// it is often copied with
+func (opts *Options) azureSASToken() string {
+	return strings.TrimPrefix(opts.AzureSASToken, "?")
+}
+
+// azureEndpoint is --azure-endpoint, or the account's blob endpoint
+func (opts *Options) azureEndpoint() string {
+	if opts.AzureEndpoint != "" {
+		return strings.TrimRight(opts.AzureEndpoint, "/")
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net", opts.AzureAccount)
+}
+
+func (ap *azureProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		start := time.Now()
+		err := ap.uploadFile(ctx, opts, a)
+		a.UploadResult.Duration = time.Since(start)
+		if err != nil {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = err
+		} else {
+			a.UploadResult.OK = true
+		}
+		out <- a
+	}
+
+	done <- true
+	return
+}
+
+func (ap *azureProvider) uploadFile(ctx context.Context, opts *Options, a *artifact.Artifact) error {
+	retries := uint64(0)
+
+	for {
+		a.UploadResult.Attempts++
+		err := ap.rawUpload(opts, a)
+		if err == nil {
+			return nil
+		}
+		// bad credentials and rejected requests won't get any better by
+		// trying again
+		if retryable(err) && retries < opts.Retries &&
+			!opts.pastRetryDeadline() && ctx.Err() == nil && !a.IsStream() {
+			retries++
+			sleep := opts.retryBackoff(ap.RetryInterval, retries)
+			ap.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+func (ap *azureProvider) rawUpload(opts *Options, a *artifact.Artifact) error {
+	key := a.FullDest()
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	withoutDigest, deferred := withoutDigestMetadata(opts.Metadata, a)
+	metadata, err := resolveMetadata(withoutDigest, a)
+	if err != nil {
+		return err
+	}
+
+	blobURL := opts.azureEndpoint() + (&url.URL{Path: "/" + opts.azureContainer() + "/" + key}).EscapedPath()
+	a.UploadResult.URL = blobURL
+
+	// the sas token is a credential, so it is only in the request's url
+	requestURL := blobURL
+	if opts.AzureKey == "" {
+		requestURL += "?" + opts.azureSASToken()
+	}
+
+	ap.log.WithFields(logrus.Fields{
+		"download_url": a.UploadResult.URL,
+	}).Info(fmt.Sprintf("uploading: %s (size: %d)", a.Source, size))
+
+	reader, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	req, err := http.NewRequest("PUT", requestURL, reader)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(size)
+	if size == 0 {
+		// an empty body still needs its Content-Length: 0
+		req.Body = http.NoBody
+	}
+
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-blob-content-type", a.ContentType())
+	if a.ContentEncoding != "" {
+		req.Header.Set("x-ms-blob-content-encoding", a.ContentEncoding)
+	}
+	if a.ContentDisposition != "" {
+		req.Header.Set("x-ms-blob-content-disposition", a.ContentDisposition)
+	}
+	if cc := cacheControl(opts, a); cc != "" {
+		req.Header.Set("x-ms-blob-cache-control", cc)
+	}
+	for k, v := range metadata {
+		req.Header.Set("x-ms-meta-"+k, v)
+	}
+
+	if err := ap.sign(opts, req); err != nil {
+		return err
+	}
+
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("azure upload failed: %s %s", resp.Status, strings.TrimSpace(string(respBody)))
+		if resp.StatusCode == http.StatusForbidden {
+			return categorize(FailureCredentials, err)
+		}
+		return err
+	}
+
+	ap.log.WithFields(logrus.Fields{
+		"key":  key,
+		"etag": resp.Header.Get("ETag"),
+	}).Debug("uploaded azure blob")
+
+	if deferred {
+		return ap.setMetadata(opts, a, blobURL)
+	}
+
+	return nil
+}
+
+// setMetadata stores the blob's metadata again once the upload has hashed
+// the content, for the metadata using {sha256}.  Set Blob Metadata
+// replaces all of it, so all of it is sent.
+func (ap *azureProvider) setMetadata(opts *Options, a *artifact.Artifact, blobURL string) error {
+	metadata, err := resolveMetadata(opts.Metadata, a)
+	if err != nil {
+		return err
+	}
+
+	requestURL := blobURL + "?comp=metadata"
+	if opts.AzureKey == "" {
+		requestURL += "&" + opts.azureSASToken()
+	}
+
+	req, err := http.NewRequest("PUT", requestURL, http.NoBody)
+	if err != nil {
+		return err
+	}
+	for k, v := range metadata {
+		req.Header.Set("x-ms-meta-"+k, v)
+	}
+
+	if err := ap.sign(opts, req); err != nil {
+		return err
+	}
+
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("azure metadata update of %s failed: %s", a.FullDest(), resp.Status)
+	}
+
+	ap.log.WithField("key", a.FullDest()).Debug("stored metadata with the uploaded digest")
+	return nil
+}
+
+// sign adds the date and version headers and signs the request with the
+// account's shared key, over the headers Put Blob sends.  With a sas
+// token instead, the token in the url is all the authorization needed.
+func (ap *azureProvider) sign(opts *Options, req *http.Request) error {
+	req.Header.Set("x-ms-date", ap.now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	if opts.AzureKey == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(opts.AzureKey)
+	if err != nil {
+		return categorize(FailureCredentials, fmt.Errorf("invalid azure storage key: %v", err))
+	}
+
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(azureStringToSign(opts.AzureAccount, req)))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s",
+		opts.AzureAccount, base64.StdEncoding.EncodeToString(hash.Sum(nil))))
+
+	return nil
+}
+
+// azureStringToSign is the request as the shared key scheme canonicalizes
+// it, with an empty length for empty bodies as of version 2015-02-21
+func azureStringToSign(account string, req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	msHeaders := []string{}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := []string{}
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := query[k]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, which x-ms-date stands in for
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(msHeaders, "\n") + "\n" + resource
+}
+
+// RetryDefaults are those of the s3 provider, since Azure throttles with
+// transient 503s much like S3 does
+func (ap *azureProvider) RetryDefaults() (uint64, time.Duration) {
+	return s3ProviderRetries, defaultProviderRetryInterval
+}
+
+func (ap *azureProvider) Name() string {
+	return "azure"
+}
+
+func (ap *azureProvider) storesMetadata() {}
@@ -0,0 +1,320 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testAzureKey = base64.StdEncoding.EncodeToString([]byte("not a real azure key"))
+
+type fakeAzureBlob struct {
+	Header  http.Header
+	Content []byte
+}
+
+// fakeAzure stores block blobs put with a valid shared key signature or
+// the sas token SAS, failing the first Failures requests with a 503
+type fakeAzure struct {
+	srv *httptest.Server
+
+	lock     sync.Mutex
+	blobs    map[string]*fakeAzureBlob
+	requests int
+	Failures int
+	SAS      string
+}
+
+func newFakeAzure() *fakeAzure {
+	fa := &fakeAzure{blobs: map[string]*fakeAzureBlob{}}
+	fa.srv = httptest.NewServer(fa)
+	return fa
+}
+
+func (fa *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	fa.requests++
+	if fa.requests <= fa.Failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(testAzureKey)
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(azureStringToSign("account", r)))
+	expected := "SharedKey account:" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	setMetadata := strings.HasPrefix(r.URL.RawQuery, "comp=metadata")
+	sas := strings.TrimPrefix(strings.TrimPrefix(r.URL.RawQuery, "comp=metadata"), "&")
+	if sas != "" {
+		if fa.SAS == "" || sas != fa.SAS || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("AuthenticationFailed"))
+			return
+		}
+	} else if r.Header.Get("Authorization") != expected {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("AuthenticationFailed"))
+		return
+	}
+
+	if blob, ok := fa.blobs[r.URL.Path]; r.Method == "PUT" && setMetadata {
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for k := range blob.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				blob.Header.Del(k)
+			}
+		}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				blob.Header[k] = v
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "PUT" || r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, _ := ioutil.ReadAll(r.Body)
+	fa.blobs[r.URL.Path] = &fakeAzureBlob{Header: r.Header, Content: content}
+	w.Header().Set("ETag", "0x1")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func azureTestOpts(dir, endpoint string) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "azure"
+		opts.AzureAccount = "account"
+		opts.AzureKey = testAzureKey
+		opts.AzureEndpoint = endpoint
+		opts.BucketName = "container"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"builds/1"}
+		opts.CacheControl = "public, max-age=60"
+		opts.Metadata = []string{"build=1"}
+	}
+}
+
+func writeAzureTestFiles(t *testing.T) string {
+	os.Clearenv()
+	return writeTestFiles(t, map[string]string{
+		"out/report.json": `{"passed": true}`,
+		"out/empty.txt":   "",
+	})
+}
+
+func TestAzureUpload(t *testing.T) {
+	dir := writeAzureTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	fa := newFakeAzure()
+	defer fa.srv.Close()
+
+	u := getTestUploader(nil, azureTestOpts(dir, fa.srv.URL))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	blob, ok := fa.blobs["/container/builds/1/out/report.json"]
+	if !ok {
+		t.Fatalf("report.json was not uploaded: %v", fa.blobs)
+	}
+
+	if string(blob.Content) != `{"passed": true}` {
+		t.Fatalf("unexpected content %q", blob.Content)
+	}
+
+	for header, expected := range map[string]string{
+		"x-ms-blob-content-type":  "application/json",
+		"x-ms-blob-cache-control": "public, max-age=60",
+		"x-ms-meta-build":         "1",
+		"x-ms-version":            azureAPIVersion,
+	} {
+		if blob.Header.Get(header) != expected {
+			t.Fatalf("%s %q != %q", header, blob.Header.Get(header), expected)
+		}
+	}
+
+	if blob, ok := fa.blobs["/container/builds/1/out/empty.txt"]; !ok || len(blob.Content) != 0 {
+		t.Fatalf("empty.txt was not uploaded empty: %v", fa.blobs)
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.URL != fa.srv.URL+"/container/"+a.FullDest() {
+			t.Fatalf("unexpected url %q for %s", a.UploadResult.URL, a.FullDest())
+		}
+	}
+}
+
+func TestAzureUploadDigestMetadata(t *testing.T) {
+	dir := writeAzureTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	fa := newFakeAzure()
+	defer fa.srv.Close()
+
+	u := getTestUploader(nil, func(opts *Options) {
+		azureTestOpts(dir, fa.srv.URL)(opts)
+		opts.Paths = []string{"out/report.json"}
+		opts.Metadata = []string{"build=1", "sum={sha256}"}
+	})
+	if err := u.Upload(); err != nil || len(u.failedResults()) != 0 {
+		t.Fatalf("unexpected error: %v %v", err, u.failedResults())
+	}
+
+	blob := fa.blobs["/container/builds/1/out/report.json"]
+	if blob == nil || blob.Header.Get("x-ms-meta-build") != "1" ||
+		blob.Header.Get("x-ms-meta-sum") != "748eda8085f7e3c82149775d9542083427f0f8a955173c4a0ed18c85c69c5c09" {
+		t.Fatalf("unexpected blob %#v", blob)
+	}
+}
+
+func TestAzureUploadRetries(t *testing.T) {
+	dir := writeAzureTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	fa := newFakeAzure()
+	fa.Failures = 1
+	defer fa.srv.Close()
+
+	u := getTestUploader(nil, func(opts *Options) {
+		azureTestOpts(dir, fa.srv.URL)(opts)
+		opts.Paths = []string{"out/report.json"}
+		opts.Retries = 2
+	})
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if attempts := u.results[0].UploadResult.Attempts; attempts != 2 {
+		t.Fatalf("attempts %v != 2", attempts)
+	}
+}
+
+func TestAzureUploadBadKey(t *testing.T) {
+	dir := writeAzureTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	fa := newFakeAzure()
+	defer fa.srv.Close()
+
+	u := getTestUploader(nil, func(opts *Options) {
+		azureTestOpts(dir, fa.srv.URL)(opts)
+		opts.Paths = []string{"out/report.json"}
+		opts.AzureKey = base64.StdEncoding.EncodeToString([]byte("the wrong key"))
+		opts.Retries = 2
+	})
+
+	u.Upload()
+
+	a := u.results[0]
+	if FailureCategory(a.UploadResult.Err) != FailureCredentials || a.UploadResult.Attempts != 1 {
+		t.Fatalf("wrong key error %v after %v attempts", a.UploadResult.Err, a.UploadResult.Attempts)
+	}
+}
+
+func TestAzureStringToSign(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "https://account.blob.core.windows.net/container/a%20b.txt?comp=block&blockid=QQ==", nil)
+	req.ContentLength = 11
+	req.Header.Set("x-ms-date", time.Date(2014, 10, 14, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+
+	expected := "PUT\n\n\n11\n\n\n\n\n\n\n\n\n" +
+		"x-ms-blob-type:BlockBlob\n" +
+		"x-ms-date:Tue, 14 Oct 2014 12:00:00 GMT\n" +
+		"x-ms-version:" + azureAPIVersion + "\n" +
+		"/account/container/a%20b.txt\nblockid:QQ==\ncomp:block"
+	if actual := azureStringToSign("account", req); actual != expected {
+		t.Fatalf("string to sign %q != %q", actual, expected)
+	}
+}
+
+func TestValidateAzure(t *testing.T) {
+	os.Clearenv()
+	for name, configure := range map[string]func(*Options){
+		"": func(opts *Options) {},
+		"no bucket name given (the azure container)": func(opts *Options) { opts.BucketName = "" },
+		"no azure storage account given":             func(opts *Options) { opts.AzureAccount = "" },
+		"no azure storage key or sas token given":    func(opts *Options) { opts.AzureKey = "" },
+		"invalid azure sas token: invalid semicolon separator in query": func(opts *Options) {
+			opts.AzureKey = ""
+			opts.AzureSASToken = "sv=1;sig=abc"
+		},
+		"invalid azure storage key, expected base64: illegal base64 data at input byte 3": func(opts *Options) {
+			opts.AzureKey = "not base64"
+		},
+		`invalid --azure-endpoint "localhost:10000" (expected an http or https URL)`: func(opts *Options) {
+			opts.AzureEndpoint = "localhost:10000"
+		},
+	} {
+		opts := NewOptions()
+		azureTestOpts("", "")(opts)
+		configure(opts)
+
+		err := opts.Validate()
+		if name == "" && err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if name != "" && (err == nil || err.Error() != name) {
+			t.Fatalf("error %v != %v", err, name)
+		}
+	}
+	opts := NewOptions()
+	azureTestOpts("", "")(opts)
+	opts.AzureKey = ""
+	opts.AzureSASToken = "?sv=2019-12-12&sig=abc"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error with a sas token: %v", err)
+	}
+}
+
+func TestAzureUploadSASToken(t *testing.T) {
+	dir := writeAzureTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	fa := newFakeAzure()
+	fa.SAS = "sv=2019-12-12&sp=cw&sig=c2lnbmVk"
+	defer fa.srv.Close()
+
+	u := getTestUploader(nil, func(opts *Options) {
+		azureTestOpts(dir, fa.srv.URL)(opts)
+		opts.AzureKey = ""
+		opts.AzureSASToken = "?" + fa.SAS
+		opts.AzureContainer = "other-container"
+	})
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("upload failed: %v", u.failedResults()[0].UploadResult.Err)
+	}
+
+	if _, ok := fa.blobs["/other-container/builds/1/out/report.json"]; !ok {
+		t.Fatalf("report.json was not uploaded to --azure-container: %v", fa.blobs)
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.URL != fa.srv.URL+"/other-container/"+a.FullDest() {
+			t.Fatalf("unexpected url %q for %s", a.UploadResult.URL, a.FullDest())
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// bandwidthChunkSize is the most that a throttled body reads at once,
+	// so that a new limit takes effect soon after its window starts
+	bandwidthChunkSize = 32 * 1024
+
+	bandwidthUnlimited = "unlimited"
+	bandwidthElse      = "else"
+)
+
+// bandwidthWindow is a time of day with its own rate, where the times are
+// minutes since midnight and a window ending before it starts wraps past
+// midnight
+type bandwidthWindow struct {
+	Start int
+	End   int
+	Rate  uint64
+}
+
+func (bw *bandwidthWindow) Contains(minute int) bool {
+	if bw.Start < bw.End {
+		return minute >= bw.Start && minute < bw.End
+	}
+	return minute >= bw.Start || minute < bw.End
+}
+
+// bandwidthSchedule is the parsed --bandwidth-schedule, with rates in
+// bytes per second and 0 for unlimited
+type bandwidthSchedule struct {
+	Windows  []*bandwidthWindow
+	Else     uint64
+	Location *time.Location
+}
+
+// parseBandwidthSchedule reads comma-separated "HH:MM-HH:MM=RATE" windows,
+// and optionally "else=RATE" for the rest of the day, e.g.
+//
+//	09:00-17:00=5MB,else=unlimited
+func parseBandwidthSchedule(spec, timezone string) (*bandwidthSchedule, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --bandwidth-schedule-timezone %q: %v", timezone, err)
+	}
+
+	bs := &bandwidthSchedule{Windows: []*bandwidthWindow{}, Location: loc}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth window %q (expected HH:MM-HH:MM=RATE)", entry)
+		}
+
+		rate, err := parseBandwidthRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if key == bandwidthElse {
+			bs.Else = rate
+			continue
+		}
+
+		times := strings.SplitN(key, "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth window %q (expected HH:MM-HH:MM=RATE)", entry)
+		}
+
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("bandwidth window %q is empty", entry)
+		}
+
+		bs.Windows = append(bs.Windows, &bandwidthWindow{Start: start, End: end, Rate: rate})
+	}
+
+	if len(bs.Windows) == 0 {
+		return nil, fmt.Errorf("no bandwidth windows in %q", spec)
+	}
+
+	return bs, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseBandwidthRate reads a size in bytes per second, optionally with a
+// "/s" suffix, or "unlimited"
+func parseBandwidthRate(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == bandwidthUnlimited {
+		return 0, nil
+	}
+
+	rate, err := humanize.ParseBytes(s)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("invalid bandwidth rate %q (expected a size per second or unlimited)", s)
+	}
+	return rate, nil
+}
+
+// RateAt is the limit in effect at t, from the first window containing it
+func (bs *bandwidthSchedule) RateAt(t time.Time) uint64 {
+	t = t.In(bs.Location)
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, bw := range bs.Windows {
+		if bw.Contains(minute) {
+			return bw.Rate
+		}
+	}
+	return bs.Else
+}
+
+// bandwidthLimiter paces every upload body through one shared budget, at
+// whatever rate the schedule gives for the time of each read, but never
+// faster than max.  Either may be unset.
+type bandwidthLimiter struct {
+	schedule *bandwidthSchedule
+	max      uint64
+	log      *logrus.Logger
+
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	// quiet keeps the limiter of each connection from logging its rate,
+	// which limitBandwidth logs once for all of them
+	quiet bool
+
+	sync.Mutex
+	next     time.Time
+	lastRate uint64
+	started  bool
+}
+
+func newBandwidthLimiter(schedule *bandwidthSchedule, max uint64, log *logrus.Logger) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		schedule: schedule,
+		max:      max,
+		log:      log,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Wait accounts for n bytes, sleeping long enough that the bytes sent so
+// far stay within the current rate
+func (bl *bandwidthLimiter) Wait(n int) {
+	bl.Lock()
+	now := bl.now()
+	rate := bl.rateAt(now)
+
+	if !bl.quiet && (!bl.started || rate != bl.lastRate) {
+		bl.log.WithField("rate", bandwidthRateString(rate)).Info("bandwidth limit in effect")
+		bl.started = true
+		bl.lastRate = rate
+	}
+
+	if rate == 0 {
+		bl.next = now
+		bl.Unlock()
+		return
+	}
+
+	if bl.next.Before(now) {
+		bl.next = now
+	}
+	wait := bl.next.Sub(now)
+	bl.next = bl.next.Add(time.Duration(uint64(n) * uint64(time.Second) / rate))
+	bl.Unlock()
+
+	if wait > 0 {
+		bl.sleep(wait)
+	}
+}
+
+// rateAt is the schedule's rate at t capped by max, with 0 for unlimited
+func (bl *bandwidthLimiter) rateAt(t time.Time) uint64 {
+	rate := uint64(0)
+	if bl.schedule != nil {
+		rate = bl.schedule.RateAt(t)
+	}
+
+	if bl.max > 0 && (rate == 0 || rate > bl.max) {
+		return bl.max
+	}
+	return rate
+}
+
+func bandwidthRateString(rate uint64) string {
+	if rate == 0 {
+		return bandwidthUnlimited
+	}
+	return humanize.Bytes(rate) + "/s"
+}
+
+// throttledTransport paces request bodies through the shared limiter, if
+// any, and through one of their own at the rate of each connection, if
+// that is limited
+type throttledTransport struct {
+	transport      http.RoundTripper
+	limiter        *bandwidthLimiter
+	connectionRate uint64
+	log            *logrus.Logger
+}
+
+func (tt *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return tt.transport.RoundTrip(req)
+	}
+
+	limiters := []*bandwidthLimiter{}
+	if tt.limiter != nil {
+		limiters = append(limiters, tt.limiter)
+	}
+	if tt.connectionRate > 0 {
+		own := newBandwidthLimiter(nil, tt.connectionRate, tt.log)
+		own.quiet = true
+		limiters = append(limiters, own)
+	}
+
+	throttled := req.Clone(req.Context())
+	throttled.Body = &throttledBody{ReadCloser: req.Body, limiters: limiters}
+	return tt.transport.RoundTrip(throttled)
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	limiters []*bandwidthLimiter
+}
+
+func (tb *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+
+	n, err := tb.ReadCloser.Read(p)
+	if n > 0 {
+		for _, limiter := range tb.limiters {
+			limiter.Wait(n)
+		}
+	}
+	return n, err
+}
+
+// limitBandwidth wraps the transport to follow --bandwidth-schedule,
+// --max-bandwidth, and --max-connection-bandwidth, if any are set
+func limitBandwidth(opts *Options, log *logrus.Logger, transport http.RoundTripper) http.RoundTripper {
+	if opts.BandwidthSchedule == "" && opts.MaxBandwidth == 0 && opts.MaxConnectionBandwidth == 0 {
+		return transport
+	}
+
+	tt := &throttledTransport{transport: transport, connectionRate: opts.MaxConnectionBandwidth, log: log}
+	if opts.MaxConnectionBandwidth > 0 {
+		log.WithField("rate", bandwidthRateString(opts.MaxConnectionBandwidth)).Info("connection bandwidth limit in effect")
+	}
+
+	var schedule *bandwidthSchedule
+	if opts.BandwidthSchedule != "" {
+		var err error
+		schedule, err = parseBandwidthSchedule(opts.BandwidthSchedule, opts.BandwidthScheduleTimezone)
+		if err != nil {
+			// Validate has already complained about it
+			schedule = nil
+		}
+	}
+
+	if schedule != nil || opts.MaxBandwidth > 0 {
+		tt.limiter = newBandwidthLimiter(schedule, opts.MaxBandwidth, log)
+	} else if tt.connectionRate == 0 {
+		return transport
+	}
+
+	return tt
+}
@@ -0,0 +1,310 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	bs, err := parseBandwidthSchedule("09:00-17:00=5MB, 22:00-06:00=1MB/s, else=unlimited", "UTC")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(bs.Windows) != 2 {
+		t.Fatalf("windows %v != 2", len(bs.Windows))
+	}
+
+	if bs.Windows[0].Start != 9*60 || bs.Windows[0].End != 17*60 || bs.Windows[0].Rate != 5000000 {
+		t.Fatalf("unexpected first window: %#v", bs.Windows[0])
+	}
+
+	if bs.Windows[1].Rate != 1000000 || bs.Else != 0 {
+		t.Fatalf("unexpected rates: %#v %v", bs.Windows[1], bs.Else)
+	}
+}
+
+func TestParseBandwidthScheduleInvalid(t *testing.T) {
+	for _, c := range [][]string{
+		[]string{"09:00-17:00=5MB", "Nowhere/Special"},
+		[]string{"09:00-17:00", "UTC"},
+		[]string{"9am-5pm=5MB", "UTC"},
+		[]string{"09:00-25:00=5MB", "UTC"},
+		[]string{"09:00-17:00=fast", "UTC"},
+		[]string{"09:00-17:00=0", "UTC"},
+		[]string{"09:00-09:00=5MB", "UTC"},
+		[]string{"else=5MB", "UTC"},
+	} {
+		if _, err := parseBandwidthSchedule(c[0], c[1]); err == nil {
+			t.Errorf("schedule %q in %q was accepted", c[0], c[1])
+		}
+	}
+}
+
+func TestBandwidthScheduleRateAt(t *testing.T) {
+	bs, _ := parseBandwidthSchedule("09:00-17:00=5MB,22:00-06:00=1MB,else=unlimited", "UTC")
+	day := time.Date(2014, 10, 14, 0, 0, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		At   string
+		Rate uint64
+	}{
+		{"08:59:59", 0},
+		{"09:00:00", 5000000},
+		{"16:59:59", 5000000},
+		{"17:00:00", 0},
+		{"21:59:59", 0},
+		{"22:00:00", 1000000},
+		{"00:00:00", 1000000},
+		{"05:59:59", 1000000},
+		{"06:00:00", 0},
+	} {
+		clock, _ := time.Parse("15:04:05", c.At)
+		at := day.Add(time.Duration(clock.Hour())*time.Hour +
+			time.Duration(clock.Minute())*time.Minute +
+			time.Duration(clock.Second())*time.Second)
+
+		if rate := bs.RateAt(at); rate != c.Rate {
+			t.Errorf("rate at %v %v != %v", c.At, rate, c.Rate)
+		}
+	}
+}
+
+func TestBandwidthScheduleTimezone(t *testing.T) {
+	bs, err := parseBandwidthSchedule("09:00-17:00=5MB", "America/New_York")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 14:00 UTC is 10:00 in New York during daylight saving time
+	if rate := bs.RateAt(time.Date(2014, 10, 14, 14, 0, 0, 0, time.UTC)); rate != 5000000 {
+		t.Fatalf("rate in new york %v != 5000000", rate)
+	}
+
+	if rate := bs.RateAt(time.Date(2014, 10, 14, 10, 0, 0, 0, time.UTC)); rate != 0 {
+		t.Fatalf("rate before new york business hours %v != 0", rate)
+	}
+}
+
+// fakeClock moves time forward only when slept
+type fakeClock struct {
+	sync.Mutex
+	Now   time.Time
+	Slept time.Duration
+}
+
+func (fc *fakeClock) now() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.Now
+}
+
+func (fc *fakeClock) sleep(d time.Duration) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.Now = fc.Now.Add(d)
+	fc.Slept += d
+}
+
+func getFakeClockLimiter(t *testing.T, spec string, start time.Time) (*bandwidthLimiter, *fakeClock) {
+	bs, err := parseBandwidthSchedule(spec, "UTC")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fc := &fakeClock{Now: start}
+	bl := newBandwidthLimiter(bs, 0, getPanicLogger())
+	bl.now = fc.now
+	bl.sleep = fc.sleep
+	return bl, fc
+}
+
+func TestBandwidthLimiterWindowBoundary(t *testing.T) {
+	start := time.Date(2014, 10, 14, 16, 59, 57, 0, time.UTC)
+	bl, fc := getFakeClockLimiter(t, "09:00-17:00=1KB,else=unlimited", start)
+
+	// 1KB/s during the window, so each 1000 bytes costs a second
+	for i := 0; i < 3; i++ {
+		bl.Wait(1000)
+	}
+	if fc.Slept != 2*time.Second {
+		t.Fatalf("slept %v != 2s inside the window", fc.Slept)
+	}
+
+	// the third wait ends the window, so the rest goes unthrottled
+	bl.Wait(1000)
+	if fc.Now.Before(start.Add(3 * time.Second)) {
+		t.Fatalf("clock %v is before the end of the window", fc.Now)
+	}
+
+	slept := fc.Slept
+	for i := 0; i < 10; i++ {
+		bl.Wait(1000000)
+	}
+	if fc.Slept != slept {
+		t.Fatalf("slept %v after the window ended", fc.Slept-slept)
+	}
+}
+
+func TestBandwidthLimiterWindowStart(t *testing.T) {
+	start := time.Date(2014, 10, 14, 8, 59, 59, 0, time.UTC)
+	bl, fc := getFakeClockLimiter(t, "09:00-17:00=1KB,else=unlimited", start)
+
+	bl.Wait(1000000)
+	if fc.Slept != 0 {
+		t.Fatalf("slept %v before the window", fc.Slept)
+	}
+
+	fc.Now = start.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		bl.Wait(500)
+	}
+	if fc.Slept != time.Second {
+		t.Fatalf("slept %v != 1s once the window started", fc.Slept)
+	}
+}
+
+func TestThrottledTransport(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = len(body)
+	}))
+	defer server.Close()
+
+	bl, fc := getFakeClockLimiter(t, "00:00-12:00=100KB,12:00-00:00=100KB",
+		time.Date(2014, 10, 14, 10, 0, 0, 0, time.UTC))
+
+	client := &http.Client{Transport: &throttledTransport{
+		transport: http.DefaultTransport,
+		limiter:   bl,
+	}}
+
+	resp, err := client.Post(server.URL, "application/octet-stream", bytes.NewReader(make([]byte, 300000)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	fc.Lock()
+	defer fc.Unlock()
+
+	if received != 300000 {
+		t.Fatalf("server received %v bytes != 300000", received)
+	}
+
+	// the last chunk's time is owed to whatever is sent next
+	if fc.Slept < 2*time.Second || fc.Slept > 3*time.Second {
+		t.Fatalf("slept %v for 300KB at 100KB/s", fc.Slept)
+	}
+}
+
+func TestBandwidthLimiterMax(t *testing.T) {
+	start := time.Date(2014, 10, 14, 16, 59, 50, 0, time.UTC)
+	bl, fc := getFakeClockLimiter(t, "09:00-17:00=500,else=unlimited", start)
+	bl.max = 1000
+
+	// the window is slower than the max, so it wins
+	for i := 0; i < 3; i++ {
+		bl.Wait(1000)
+	}
+	if fc.Slept != 4*time.Second {
+		t.Fatalf("slept %v != 4s inside the window", fc.Slept)
+	}
+
+	// outside of it, the max caps what would be unlimited
+	fc.Now = start.Add(time.Minute)
+	slept := fc.Slept
+	for i := 0; i < 3; i++ {
+		bl.Wait(1000)
+	}
+	if fc.Slept-slept != 2*time.Second {
+		t.Fatalf("slept %v != 2s at the max", fc.Slept-slept)
+	}
+}
+
+func TestLimitBandwidthMax(t *testing.T) {
+	opts := NewOptions()
+	if _, ok := limitBandwidth(opts, getPanicLogger(), http.DefaultTransport).(*throttledTransport); ok {
+		t.Fatalf("transport throttled without --max-bandwidth")
+	}
+
+	if err := opts.UpdateFromConfig(map[string]interface{}{"max_bandwidth": "10MB"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tt, ok := limitBandwidth(opts, getPanicLogger(), http.DefaultTransport).(*throttledTransport)
+	if !ok {
+		t.Fatalf("transport not throttled with --max-bandwidth")
+	}
+
+	if tt.limiter.schedule != nil || tt.limiter.rateAt(time.Now()) != 10000000 {
+		t.Fatalf("limiter rate %v != 10MB/s", tt.limiter.rateAt(time.Now()))
+	}
+}
+
+func TestMaxBandwidthPerSecond(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+	os.Setenv("ARTIFACTS_MAX_BANDWIDTH", "10MB/s")
+	os.Setenv("ARTIFACTS_MAX_CONNECTION_BANDWIDTH", "2MB")
+
+	opts := NewOptions()
+	if opts.MaxBandwidth != 10000000 || opts.MaxConnectionBandwidth != 2000000 {
+		t.Fatalf("bandwidth %v and connection bandwidth %v from the environment", opts.MaxBandwidth, opts.MaxConnectionBandwidth)
+	}
+
+	os.Clearenv()
+	opts = NewOptions()
+	if err := opts.UpdateFromConfig(map[string]interface{}{"max_connection_bandwidth": "1MB/s"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.MaxConnectionBandwidth != 1000000 {
+		t.Fatalf("connection bandwidth %v != 1MB/s from the config", opts.MaxConnectionBandwidth)
+	}
+}
+
+func TestLimitConnectionBandwidth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	// each connection gets 64KB/s of its own, so two 64KB bodies (two
+	// chunks each, the second paced half a second) take half a second
+	// side by side rather than the second and a half a shared limit would
+	opts := NewOptions()
+	opts.MaxConnectionBandwidth = 64 * 1024
+	tt, ok := limitBandwidth(opts, getPanicLogger(), http.DefaultTransport).(*throttledTransport)
+	if !ok || tt.limiter != nil {
+		t.Fatalf("transport not throttled per connection: %#v", tt)
+	}
+
+	client := &http.Client{Transport: tt}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(srv.URL, "text/plain", bytes.NewReader(make([]byte, 64*1024)))
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > 1200*time.Millisecond {
+		t.Fatalf("two 64KB bodies at 64KB/s each took %v", elapsed)
+	}
+}
@@ -0,0 +1,71 @@
+package upload
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers that content is copied
+// through, the same as io.Copy's own
+const copyBufferSize = 32 * 1024
+
+// bufferPool hands out buffers of one size to be used again, so that
+// workers going through one small file after another don't allocate a
+// buffer for each
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() interface{} {
+		b := make([]byte, bp.size)
+		return &b
+	}
+	return bp
+}
+
+// Get is a buffer of the pool's size, which goes back with Put
+func (bp *bufferPool) Get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+// Put gives the buffer back to the pool
+func (bp *bufferPool) Put(b *[]byte) {
+	bp.pool.Put(b)
+}
+
+var copyBuffers = newBufferPool(copyBufferSize)
+
+// partBuffers pools the multipart part buffers by size, since the part
+// size only changes with --multipart-chunk-size or auto-tuning
+var partBuffers = struct {
+	sync.Mutex
+	pools map[int64]*bufferPool
+}{pools: map[int64]*bufferPool{}}
+
+// partBuffer is a pooled buffer for a part of the size, and the func
+// that gives it back once the upload is done with it
+func partBuffer(size int64) ([]byte, func()) {
+	partBuffers.Lock()
+	bp, ok := partBuffers.pools[size]
+	if !ok {
+		bp = newBufferPool(int(size))
+		partBuffers.pools[size] = bp
+	}
+	partBuffers.Unlock()
+
+	b := bp.Get()
+	return *b, func() { bp.Put(b) }
+}
+
+// copyPooled is io.Copy through a pooled buffer.  The reader and writer
+// are wrapped so that a WriteTo or ReadFrom allocating a buffer of its
+// own isn't used instead.
+func copyPooled(w io.Writer, r io.Reader) (int64, error) {
+	b := copyBuffers.Get()
+	defer copyBuffers.Put(b)
+
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, *b)
+}
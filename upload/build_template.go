@@ -0,0 +1,66 @@
+package upload
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// buildTemplateData is what the {{...}} templates in target paths and
+// metadata values are executed against, with anything the environment
+// doesn't say left empty
+type buildTemplateData struct {
+	RepoSlug    string
+	Branch      string
+	Commit      string
+	BuildNumber string
+	BuildID     string
+	JobNumber   string
+	JobID       string
+}
+
+func newBuildTemplateData(opts *Options) *buildTemplateData {
+	data := &buildTemplateData{
+		RepoSlug:    opts.RepoSlug,
+		BuildNumber: opts.BuildNumber,
+		BuildID:     opts.BuildID,
+		JobNumber:   opts.JobNumber,
+		JobID:       opts.JobID,
+	}
+
+	if run := detectCIRun(); run != nil {
+		data.Branch = run.Branch
+		data.Commit = run.Commit
+		if data.BuildID == "" {
+			data.BuildID = run.BuildID
+		}
+	}
+
+	return data
+}
+
+// Env is the value of an environment variable, so that {{.Env "FOO"}}
+// renders as empty when FOO is unset
+func (d *buildTemplateData) Env(key string) string {
+	return os.Getenv(key)
+}
+
+// expandBuildTemplate executes the text as a template if it has any
+// {{...}} in it, leaving literal text as it is
+func expandBuildTemplate(text string, data *buildTemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("build").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,338 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// bundleManifestPath is where --bundle-manifest-inside puts the
+	// manifest in the bundle
+	bundleManifestPath = "MANIFEST.json"
+)
+
+// bundleManifest lists the files in a bundle, as the last entry of the
+// bundle itself
+type bundleManifest struct {
+	Version int                    `json:"version"`
+	Entries []*bundleManifestEntry `json:"entries"`
+}
+
+type bundleManifestEntry struct {
+	Path   string `json:"path"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// bundleContentTypes are the content types of the bundle unless
+// --content-type says otherwise, since neither is sniffed or known to
+// mime by default
+var bundleContentTypes = map[string]string{
+	".tar": "application/x-tar",
+	".gz":  "application/gzip",
+	".zip": "application/zip",
+}
+
+// archiveFormats are the formats --archive can write
+var archiveFormats = map[string]bool{
+	"tar":    true,
+	"tar.gz": true,
+	"zip":    true,
+}
+
+// bundling reports whether everything goes into a single archive, with
+// --bundle or --archive
+func (opts *Options) bundling() bool {
+	return opts.Bundle || opts.Archive != ""
+}
+
+// archiveFormat is --archive, or for --bundle, a tar that is gzipped with
+// --gzip
+func (opts *Options) archiveFormat() string {
+	if opts.Archive != "" {
+		return opts.Archive
+	}
+
+	if opts.Gzip {
+		return "tar.gz"
+	}
+	return "tar"
+}
+
+// bundleKey expands the --bundle-name template, adding .gz to that of a
+// gzipped tar unless it is there already, and making that of a zip end in
+// .zip instead of .tar
+func (opts *Options) bundleKey() (string, error) {
+	key, err := expandBuildTemplate(opts.BundleName, newBuildTemplateData(opts))
+	if err != nil {
+		return "", err
+	}
+
+	switch opts.archiveFormat() {
+	case "tar.gz":
+		if !strings.HasSuffix(key, ".gz") && !strings.HasSuffix(key, ".tgz") {
+			key += ".gz"
+		}
+	case "zip":
+		if !strings.HasSuffix(key, ".zip") {
+			key = strings.TrimSuffix(key, ".tar") + ".zip"
+		}
+	}
+
+	return strings.TrimLeft(key, "/"), nil
+}
+
+// archiveWriter is a tar or zip being written, one entry at a time
+type archiveWriter interface {
+	Create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (ta tarArchive) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return ta.Writer, ta.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (za zipArchive) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return za.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+}
+
+func validateBundleName(name string) error {
+	key, err := expandBuildTemplate(name, &buildTemplateData{})
+	if err != nil {
+		return fmt.Errorf("invalid --bundle-name %q: %v", name, err)
+	}
+
+	if strings.Trim(key, "/") == "" && !strings.Contains(name, "{{") {
+		return fmt.Errorf("--bundle-name must not be empty")
+	}
+
+	return nil
+}
+
+// bundle resolves every artifact up front when --bundle or --archive is
+// set, and writes them to a single tar or zip whose entries are the keys
+// they would have been uploaded as, which is then uploaded in their place.
+// Each file is copied into the archive as it is found, but the archive
+// itself is a temp file, since every provider needs its size up front.
+func (u *uploader) bundle(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if !u.Opts.bundling() {
+		return in, nil
+	}
+
+	key, err := u.Opts.bundleKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// the free space needed isn't known until the files are found, so
+	// this can only check that the temp dir isn't already short of it
+	f, err := u.tempFile("artifacts-bundle-*"+bundleExt(key), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	count, writeErr := u.writeBundle(f, in)
+	closeErr := f.Close()
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	if writeErr != nil {
+		return nil, fmt.Errorf("could not write bundle: %v", writeErr)
+	}
+
+	if closeErr != nil {
+		return nil, fmt.Errorf("could not write bundle: %v", closeErr)
+	}
+
+	a := artifact.New("", f.Name(), key, u.artifactOptions())
+	a.ContentTypes = map[string]string{}
+	for ext, ctype := range bundleContentTypes {
+		a.ContentTypes[ext] = ctype
+	}
+	for ext, ctype := range u.contentTypes {
+		a.ContentTypes[ext] = ctype
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	logFields := logrus.Fields{
+		"key":      key,
+		"files":    count,
+		"size":     humanize.Bytes(size),
+		"max_size": humanize.Bytes(u.Opts.MaxSize),
+	}
+
+	if size > u.Opts.MaxSize {
+		u.log.WithFields(logFields).Error("max-size would be exceeded")
+		return nil, categorize(FailureSizeLimit,
+			fmt.Errorf("bundle of %d files is %s, more than --max-size %s",
+				count, humanize.Bytes(size), humanize.Bytes(u.Opts.MaxSize)))
+	}
+
+	u.log.WithFields(logFields).Info("bundled artifacts")
+
+	out := make(chan *artifact.Artifact, 1)
+	out <- a
+	close(out)
+	return out, nil
+}
+
+// writeBundle writes each artifact to the archive as it comes in, draining
+// the rest once writing fails so that the walk can finish.  With
+// --bundle-manifest-inside, the manifest of what was written goes last,
+// so nothing has to be held back for it.
+func (u *uploader) writeBundle(f *os.File, in chan *artifact.Artifact) (int, error) {
+	var w io.Writer = f
+	var gz io.WriteCloser
+	if u.Opts.archiveFormat() == "tar.gz" {
+		gz = newGzipWriter(f, u.Opts.CompressParallel)
+		w = gz
+	}
+
+	var aw archiveWriter = tarArchive{tar.NewWriter(w)}
+	if u.Opts.archiveFormat() == "zip" {
+		aw = zipArchive{zip.NewWriter(w)}
+	}
+	m := &bundleManifest{Version: manifestVersion, Entries: []*bundleManifestEntry{}}
+	count := 0
+	var err error
+
+	for a := range in {
+		if err != nil {
+			continue
+		}
+
+		if u.Opts.BundleManifestInside && a.FullDest() == bundleManifestPath {
+			err = fmt.Errorf("%s is in the bundle already, so --bundle-manifest-inside can't add it", bundleManifestPath)
+			continue
+		}
+
+		var entry *bundleManifestEntry
+		entry, err = addToBundle(aw, a)
+		if err == nil {
+			m.Entries = append(m.Entries, entry)
+			count++
+		}
+	}
+
+	if err != nil {
+		return count, err
+	}
+
+	if u.Opts.BundleManifestInside {
+		if err := addBundleManifest(aw, m); err != nil {
+			return count, err
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		return count, err
+	}
+
+	if gz != nil {
+		return count, gz.Close()
+	}
+
+	return count, nil
+}
+
+func addToBundle(aw archiveWriter, a *artifact.Artifact) (*bundleManifestEntry, error) {
+	size, err := a.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	modTime, err := a.ModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := a.Reader()
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	w, err := aw.Create(a.FullDest(), int64(size), modTime)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := copyPooled(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(n) != size {
+		return nil, fmt.Errorf("%s changed size while being bundled", artifactSourceName(a))
+	}
+
+	// reading the content through computed the digest
+	sum, err := a.SHA256()
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundleManifestEntry{Path: a.FullDest(), Size: size, SHA256: sum}, nil
+}
+
+func addBundleManifest(aw archiveWriter, m *bundleManifest) error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	w, err := aw.Create(bundleManifestPath, int64(len(body)), time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+func bundleExt(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".gz"):
+		return ".gz"
+	case strings.HasSuffix(key, ".zip"):
+		return ".zip"
+	}
+	return ".tar"
+}
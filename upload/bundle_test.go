@@ -0,0 +1,415 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// bundleReadingProvider reads each upload while the temp files behind
+// it are still there
+type bundleReadingProvider struct {
+	recordingProvider
+	Bodies map[string][]byte
+	Sizes  map[string]uint64
+}
+
+func (bp *bundleReadingProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	read := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			size, _ := a.Size()
+			r, err := a.Reader()
+			if err == nil {
+				body, _ := ioutil.ReadAll(r)
+				bp.Lock()
+				bp.Bodies[a.FullDest()] = body
+				bp.Sizes[a.FullDest()] = size
+				bp.Unlock()
+			}
+			read <- a
+		}
+		close(read)
+	}()
+
+	bp.recordingProvider.Upload(ctx, id, opts, read, out, done)
+}
+
+func bundleOpts(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"builds/7", "latest"}
+		opts.BuildNumber = "7"
+		opts.Bundle = true
+	}
+}
+
+func writeBundleFiles(t *testing.T) string {
+	os.Clearenv()
+	return writeTestFiles(t, map[string]string{
+		"out/build.log":     strings.Repeat("ok\n", 100),
+		"out/report/a.json": `{"passed": true}`,
+	})
+}
+
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+	entries := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if int64(len(body)) != hdr.Size {
+			t.Fatalf("entry %s size %v != %v", hdr.Name, len(body), hdr.Size)
+		}
+		entries[hdr.Name] = string(body)
+	}
+	return entries
+}
+
+func TestUploadBundle(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, bundleOpts(dir))
+	bp := &bundleReadingProvider{Bodies: map[string][]byte{}, Sizes: map[string]uint64{}}
+	u.Provider = bp
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dests := bp.FullDests()
+	if len(dests) != 1 || dests[0] != "artifacts/build-7.tar" {
+		t.Fatalf("uploaded %v instead of the bundle", dests)
+	}
+
+	if ctype := bp.Uploaded[0].ContentType(); ctype != "application/x-tar" {
+		t.Fatalf("bundle content type %q", ctype)
+	}
+
+	entries := readBundle(t, bytes.NewReader(bp.Bodies["artifacts/build-7.tar"]))
+	expected := map[string]string{
+		"builds/7/out/build.log":     strings.Repeat("ok\n", 100),
+		"builds/7/out/report/a.json": `{"passed": true}`,
+		"latest/out/build.log":       strings.Repeat("ok\n", 100),
+		"latest/out/report/a.json":   `{"passed": true}`,
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("bundle entries %v != %v", entries, expected)
+	}
+	for name, body := range expected {
+		if entries[name] != body {
+			t.Fatalf("bundle entry %s is %q, not %q", name, entries[name], body)
+		}
+	}
+}
+
+func TestUploadBundleGzip(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.BundleName = "bundles/{{.BuildNumber}}.tar"
+		opts.Gzip = true
+	})
+	bp := &bundleReadingProvider{Bodies: map[string][]byte{}, Sizes: map[string]uint64{}}
+	u.Provider = bp
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, ok := bp.Bodies["bundles/7.tar.gz"]
+	if !ok {
+		t.Fatalf("uploaded %v instead of the gzipped bundle", bp.FullDests())
+	}
+
+	if ctype := bp.Uploaded[0].ContentType(); ctype != "application/gzip" {
+		t.Fatalf("bundle content type %q", ctype)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("bundle is not gzipped: %v", err)
+	}
+
+	// the files in the bundle aren't gzipped on their own
+	entries := readBundle(t, gz)
+	if entries["latest/out/report/a.json"] != `{"passed": true}` {
+		t.Fatalf("unexpected bundle entries %v", entries)
+	}
+}
+
+func TestUploadArchiveZip(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.Bundle = false
+		opts.Archive = "zip"
+	})
+	bp := &bundleReadingProvider{Bodies: map[string][]byte{}, Sizes: map[string]uint64{}}
+	u.Provider = bp
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, ok := bp.Bodies["artifacts/build-7.zip"]
+	if !ok {
+		t.Fatalf("uploaded %v instead of the zip", bp.FullDests())
+	}
+
+	if ctype := bp.Uploaded[0].ContentType(); ctype != "application/zip" {
+		t.Fatalf("archive content type %q", ctype)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("archive is not a zip: %v", err)
+	}
+
+	entries := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		entries[f.Name] = string(b)
+	}
+
+	if len(entries) != 4 || entries["builds/7/out/build.log"] != strings.Repeat("ok\n", 100) ||
+		entries["latest/out/report/a.json"] != `{"passed": true}` {
+		t.Fatalf("unexpected archive entries %v", entries)
+	}
+}
+
+func TestUploadArchiveTarGz(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	// gzipped as a whole without --gzip, which would gzip nothing else here
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.Bundle = false
+		opts.Archive = "tar.gz"
+	})
+	bp := &bundleReadingProvider{Bodies: map[string][]byte{}, Sizes: map[string]uint64{}}
+	u.Provider = bp
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, ok := bp.Bodies["artifacts/build-7.tar.gz"]
+	if !ok {
+		t.Fatalf("uploaded %v instead of the gzipped tar", bp.FullDests())
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("archive is not gzipped: %v", err)
+	}
+
+	if entries := readBundle(t, gz); len(entries) != 4 {
+		t.Fatalf("unexpected archive entries %v", entries)
+	}
+}
+
+func TestBundleKeyArchive(t *testing.T) {
+	for _, tc := range []struct {
+		name, archive, key string
+	}{
+		{"a/{{.BuildNumber}}.tar", "zip", "a/7.zip"},
+		{"a/{{.BuildNumber}}.zip", "zip", "a/7.zip"},
+		{"a/{{.BuildNumber}}.tar", "tar.gz", "a/7.tar.gz"},
+		{"a/{{.BuildNumber}}.tgz", "tar.gz", "a/7.tgz"},
+		{"a/{{.BuildNumber}}.tar", "tar", "a/7.tar"},
+	} {
+		opts := NewOptions()
+		opts.BuildNumber = "7"
+		opts.BundleName = tc.name
+		opts.Archive = tc.archive
+
+		key, err := opts.bundleKey()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if key != tc.key {
+			t.Fatalf("bundle key for %s as %s %q != %q", tc.name, tc.archive, key, tc.key)
+		}
+	}
+}
+
+func TestValidateArchive(t *testing.T) {
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.AccessKey = "AKIAFOO"
+	opts.SecretKey = "bar"
+	opts.Archive = "rar"
+
+	err := opts.Validate()
+	if err == nil || err.Error() != `unknown --archive "rar" (expected tar, tar.gz, or zip)` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploadBundleMaxSize(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	// the files fit, but not with the tar headers around them
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.TargetPaths = []string{"builds/7"}
+		opts.MaxSize = 1024
+	})
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err == nil || FailureCategory(err) != FailureSizeLimit {
+		t.Fatalf("oversized bundle error %v is not a size limit failure", err)
+	}
+
+	if !strings.Contains(err.Error(), "bundle of 2 files") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rp.Uploaded) != 0 {
+		t.Fatalf("uploaded %v despite the oversized bundle", rp.FullDests())
+	}
+}
+
+func TestUploadWithoutBundle(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.Bundle = false
+	})
+	rp := &recordingProvider{}
+	u.Provider = rp
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rp.Uploaded) != 4 {
+		t.Fatalf("uploaded %v instead of each file", rp.FullDests())
+	}
+}
+
+func TestValidateBundleName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"artifacts/build-{{.BuildNumber}}.tar": true,
+		"run.tar":                              true,
+		"run-{{.BuildNumber}.tar":              false,
+		"/":                                    false,
+	} {
+		err := validateBundleName(name)
+		if (err == nil) != valid {
+			t.Fatalf("validateBundleName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestUploadBundleManifestInside(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.TargetPaths = []string{"builds/7"}
+		opts.BundleManifestInside = true
+		opts.Gzip = true
+	})
+	bp := &bundleReadingProvider{Bodies: map[string][]byte{}, Sizes: map[string]uint64{}}
+	u.Provider = bp
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := bp.Bodies["artifacts/build-7.tar.gz"]
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("bundle is not gzipped: %v", err)
+	}
+	entries := readBundle(t, gz)
+	if len(entries) != 3 {
+		t.Fatalf("bundle entries %v are not the files and the manifest", entries)
+	}
+
+	m := &bundleManifest{}
+	if err := json.Unmarshal([]byte(entries[bundleManifestPath]), m); err != nil {
+		t.Fatalf("malformed bundle manifest %q: %v", entries[bundleManifestPath], err)
+	}
+
+	if m.Version != manifestVersion || len(m.Entries) != 2 {
+		t.Fatalf("unexpected bundle manifest %#v", m)
+	}
+
+	for _, entry := range m.Entries {
+		content, ok := entries[entry.Path]
+		if !ok {
+			t.Fatalf("manifest lists %s, which isn't in the bundle", entry.Path)
+		}
+
+		sum := sha256.Sum256([]byte(content))
+		if entry.Size != uint64(len(content)) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("manifest entry %#v doesn't match the content %q", entry, content)
+		}
+	}
+
+	// the size counted against --max-size is the bundle's, manifest and all
+	if size := bp.Sizes["artifacts/build-7.tar.gz"]; size != uint64(len(body)) {
+		t.Fatalf("bundle size %v != %v", size, len(body))
+	}
+}
+
+func TestUploadBundleManifestInsideConflict(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"MANIFEST.json": "{}",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.WorkingDir = dir
+		opts.Paths = []string{"MANIFEST.json"}
+		opts.TargetPaths = []string{"/"}
+		opts.Bundle = true
+		opts.BundleManifestInside = true
+	})
+	u.Provider = &recordingProvider{}
+
+	err := u.Upload()
+	if err == nil || !strings.Contains(err.Error(), "MANIFEST.json is in the bundle already") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var caseCollisionsPolicies = map[string]bool{
+	"off":  true,
+	"warn": true,
+	"fail": true,
+}
+
+// caseCollision is a key that differs only by case from a remote key,
+// which CDNs that serve keys case-insensitively can't tell apart
+type caseCollision struct {
+	Key    string
+	Remote string
+}
+
+// checkCaseCollisions resolves every artifact up front when
+// --case-collisions is "warn" or "fail", and reports each one whose key
+// matches an object under the target paths except for case.  With
+// "fail", nothing is uploaded if any key collides.
+func (u *uploader) checkCaseCollisions(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if u.Opts.CaseCollisions == "off" || u.Opts.CaseCollisions == "" {
+		return in, nil
+	}
+
+	held := []*artifact.Artifact{}
+	for a := range in {
+		held = append(held, a)
+	}
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	remote, err := u.remoteKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	collisions := findCaseCollisions(held, remote)
+	for _, c := range collisions {
+		u.log.WithFields(logrus.Fields{
+			"key":    c.Key,
+			"remote": c.Remote,
+		}).Warn("key differs only by case from an existing object")
+	}
+
+	if len(collisions) > 0 && u.Opts.CaseCollisions == "fail" {
+		return nil, fmt.Errorf("found %d keys that differ only by case from existing objects, first %q and %q",
+			len(collisions), collisions[0].Key, collisions[0].Remote)
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for _, a := range held {
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// remoteKeys are the objects under the target paths, reusing the sync
+// listing if there is one
+func (u *uploader) remoteKeys() (map[string]s3.Key, error) {
+	if u.remote != nil {
+		return u.remote.Keys, nil
+	}
+
+	s3p, ok := u.Provider.(*s3Provider)
+	if !ok {
+		return nil, fmt.Errorf("--case-collisions requires the s3 provider")
+	}
+
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return nil, err
+	}
+
+	return listTargetPaths(bucket, u.Opts.TargetPaths)
+}
+
+func findCaseCollisions(artifacts []*artifact.Artifact, remote map[string]s3.Key) []*caseCollision {
+	folded := map[string][]string{}
+	for key := range remote {
+		lower := strings.ToLower(key)
+		folded[lower] = append(folded[lower], key)
+	}
+
+	collisions := []*caseCollision{}
+	seen := map[string]bool{}
+	for _, a := range artifacts {
+		key := a.FullDest()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		for _, remoteKey := range folded[strings.ToLower(key)] {
+			if remoteKey != key {
+				collisions = append(collisions, &caseCollision{Key: key, Remote: remoteKey})
+			}
+		}
+	}
+
+	sort.Slice(collisions, func(i, j int) bool {
+		if collisions[i].Key != collisions[j].Key {
+			return collisions[i].Key < collisions[j].Key
+		}
+		return collisions[i].Remote < collisions[j].Remote
+	})
+
+	return collisions
+}
@@ -0,0 +1,128 @@
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+// writeCaseCollisionsFiles writes the local files, and the remote objects
+// under the target path that they collide with
+func writeCaseCollisionsFiles(t *testing.T, targetPath string) string {
+	bucket := testS3.Bucket("bucket")
+	for _, key := range []string{"Foo.txt", "docs/README.md", "docs/ReadMe.md", "same.txt"} {
+		if err := bucket.Put(targetPath+"/"+key, []byte("remote"), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	return writeTestFiles(t, map[string]string{
+		"foo.txt":        "local",
+		"docs/readme.md": "local",
+		"same.txt":       "local",
+	})
+}
+
+func caseCollisionsOpts(dir, targetPath, policy string) func(*Options) {
+	return func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"foo.txt", "docs/", "same.txt"}
+		opts.TargetPaths = []string{targetPath}
+		opts.CaseCollisions = policy
+	}
+}
+
+func TestUploaderCaseCollisionsFail(t *testing.T) {
+	dir := writeCaseCollisionsFiles(t, "case-fail")
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	u := getTestUploader(log, caseCollisionsOpts(dir, "case-fail", "fail"))
+	err := u.Upload()
+	if err == nil {
+		t.Fatalf("upload with case collisions succeeded")
+	}
+
+	if !strings.Contains(err.Error(), "found 3 keys") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, pair := range [][]string{
+		[]string{"case-fail/foo.txt", "case-fail/Foo.txt"},
+		[]string{"case-fail/docs/readme.md", "case-fail/docs/README.md"},
+		[]string{"case-fail/docs/readme.md", "case-fail/docs/ReadMe.md"},
+	} {
+		reported := false
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, `key="`+pair[0]+`"`) && strings.Contains(line, `remote="`+pair[1]+`"`) {
+				reported = true
+			}
+		}
+
+		if !reported {
+			t.Fatalf("collision %v is not reported:\n%s", pair, buf.String())
+		}
+	}
+
+	if strings.Contains(buf.String(), "same.txt") {
+		t.Fatalf("exact match was reported as a collision:\n%s", buf.String())
+	}
+
+	if _, err := testS3.Bucket("bucket").Get("case-fail/foo.txt"); err == nil {
+		t.Fatalf("colliding key was uploaded")
+	}
+}
+
+func TestUploaderCaseCollisionsWarn(t *testing.T) {
+	dir := writeCaseCollisionsFiles(t, "case-warn")
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	u := getTestUploader(log, caseCollisionsOpts(dir, "case-warn", "warn"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Count(buf.String(), "differs only by case") != 3 {
+		t.Fatalf("unexpected warnings:\n%s", buf.String())
+	}
+
+	if _, err := testS3.Bucket("bucket").Get("case-warn/foo.txt"); err != nil {
+		t.Fatalf("upload did not go ahead: %v", err)
+	}
+}
+
+func TestUploaderCaseCollisionsOff(t *testing.T) {
+	dir := writeCaseCollisionsFiles(t, "case-off")
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	u := getTestUploader(log, caseCollisionsOpts(dir, "case-off", "off"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "differs only by case") {
+		t.Fatalf("collisions were checked while off:\n%s", buf.String())
+	}
+}
+
+func TestValidateCaseCollisions(t *testing.T) {
+	opts := NewOptions()
+	opts.CaseCollisions = "shout"
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "--case-collisions") {
+		t.Fatalf("unknown --case-collisions policy was accepted: %v", err)
+	}
+
+	opts.CaseCollisions = "fail"
+	opts.Provider = "null"
+	err = opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "requires the s3 provider") {
+		t.Fatalf("--case-collisions without s3 was accepted: %v", err)
+	}
+}
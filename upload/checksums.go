@@ -0,0 +1,118 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	checksumsKey      = "SHA256SUMS"
+	sha256MetadataKey = "sha256"
+)
+
+// contentMD5 is the base64 md5 that S3 checks the body of a put against.
+// Reading the content through for it also records the artifact's sha256,
+// so that the metadata costs nothing more.
+func contentMD5(a *artifact.Artifact) (string, error) {
+	sum, err := artifactMD5(a)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// checksumHeaders are the headers --checksums adds to an s3 upload.
+// Streams can't be read ahead of uploading, so they go without.
+func checksumHeaders(opts *Options, a *artifact.Artifact, singlePut bool) (map[string][]string, error) {
+	headers := map[string][]string{}
+	if !opts.Checksums || a.IsStream() {
+		return headers, nil
+	}
+
+	if singlePut {
+		sum, err := contentMD5(a)
+		if err != nil {
+			return nil, err
+		}
+		headers["Content-MD5"] = []string{sum}
+	}
+
+	sum, err := a.SHA256()
+	if err != nil {
+		return nil, err
+	}
+	headers["x-amz-meta-"+sha256MetadataKey] = []string{sum}
+
+	return headers, nil
+}
+
+// checksumArtifacts builds a SHA256SUMS per target path, listing every
+// artifact uploaded there as sha256sum would, so that a downloaded copy
+// of the target path can be checked with sha256sum -c
+func (u *uploader) checksumArtifacts() ([]*artifact.Artifact, error) {
+	sums := []*artifact.Artifact{}
+	for _, targetPath := range u.Opts.TargetPaths {
+		names := []string{}
+		byName := map[string]string{}
+		clobbered := false
+
+		for _, a := range u.results {
+			if a.Prefix != targetPath || !a.UploadResult.OK {
+				continue
+			}
+
+			name := strings.TrimLeft(filepath.ToSlash(a.Dest), "/")
+			if name == checksumsKey {
+				clobbered = true
+				break
+			}
+
+			sum := a.KnownSHA256()
+			if sum == "" {
+				var err error
+				sum, err = a.SHA256()
+				if err != nil {
+					u.log.WithFields(logrus.Fields{
+						"artifact": name,
+						"err":      err,
+					}).Warn("leaving artifact out of " + checksumsKey)
+					continue
+				}
+			}
+
+			names = append(names, name)
+			byName[name] = sum
+		}
+
+		if clobbered {
+			u.log.WithField("target_path", targetPath).Warn("not writing " + checksumsKey + " over an uploaded " + checksumsKey)
+			continue
+		}
+
+		sort.Strings(names)
+
+		body := &bytes.Buffer{}
+		for _, name := range names {
+			fmt.Fprintf(body, "%s  %s\n", byName[name], name)
+		}
+
+		sums = append(sums,
+			artifact.NewFromBytes(targetPath, checksumsKey, body.Bytes(), u.artifactOptions()))
+	}
+
+	return sums, nil
+}
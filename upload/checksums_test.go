@@ -0,0 +1,105 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestS3ProviderChecksums(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+	req := <-reqs
+	if req.Header.Get("Content-MD5") != "" || req.Header.Get("X-Amz-Meta-Sha256") != "" {
+		t.Fatalf("checksums were sent without --checksums: %v", req.Header)
+	}
+
+	opts.Checksums = true
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+	req = <-reqs
+
+	// md5 and sha256 of "hello"
+	if req.Header.Get("Content-MD5") != "XUFAKrxLKna5cZ2REBfFkg==" {
+		t.Fatalf("Content-MD5 %q != XUFAKrxLKna5cZ2REBfFkg==", req.Header.Get("Content-MD5"))
+	}
+
+	if req.Header.Get("X-Amz-Meta-Sha256") != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected sha256 metadata %q", req.Header.Get("X-Amz-Meta-Sha256"))
+	}
+}
+
+func TestUploaderWriteChecksums(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/b.txt":     "hello",
+		"out/a/one.txt": "",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"one", "two"}
+		opts.WriteChecksums = true
+	})
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  out/a/one.txt\n" +
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  out/b.txt\n"
+
+	sums := map[string]string{}
+	for _, a := range rp.Uploaded {
+		if a.Dest != checksumsKey {
+			continue
+		}
+
+		r, err := a.Reader()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		body, _ := ioutil.ReadAll(r)
+		sums[a.FullDest()] = string(body)
+	}
+
+	if len(sums) != 2 || sums["one/SHA256SUMS"] != expected || sums["two/SHA256SUMS"] != expected {
+		t.Fatalf("unexpected %s: %q", checksumsKey, sums)
+	}
+}
+
+func TestUploaderWriteChecksumsNotAfterFailure(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{"out/b.txt": "hello"})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"one"}
+		opts.WriteChecksums = true
+	})
+	rp := &recordingProvider{FailSources: map[string]bool{filepath.Join(dir, "out", "b.txt"): true}}
+	u.Provider = rp
+	u.Upload()
+
+	for _, a := range rp.Uploaded {
+		if a.Dest == checksumsKey {
+			t.Fatalf("%s was written after a failure", checksumsKey)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package upload
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const maxS3TagValueLength = 256
+
+// s3TagValueInvalidRegexp matches what S3 doesn't accept in tag values
+var s3TagValueInvalidRegexp = regexp.MustCompile(`[^\pL\pN\s_.:/=+\-@]`)
+
+// ciRun is the build that is running, as told by the CI environment
+type ciRun struct {
+	CI      string
+	BuildID string
+	Commit  string
+	Branch  string
+}
+
+// ciEnv names the variables that a CI service sets, with the first
+// non-empty variable of each list winning
+type ciEnv struct {
+	Name    string
+	Marker  string
+	BuildID []string
+	Commit  []string
+	Branch  []string
+}
+
+var ciEnvs = []*ciEnv{
+	&ciEnv{
+		Name:    "travis",
+		Marker:  "TRAVIS",
+		BuildID: []string{"TRAVIS_BUILD_ID"},
+		Commit:  []string{"TRAVIS_COMMIT"},
+		Branch:  []string{"TRAVIS_PULL_REQUEST_BRANCH", "TRAVIS_BRANCH"},
+	},
+	&ciEnv{
+		Name:    "github-actions",
+		Marker:  "GITHUB_ACTIONS",
+		BuildID: []string{"GITHUB_RUN_ID"},
+		Commit:  []string{"GITHUB_SHA"},
+		Branch:  []string{"GITHUB_HEAD_REF", "GITHUB_REF_NAME"},
+	},
+	&ciEnv{
+		Name:    "gitlab",
+		Marker:  "GITLAB_CI",
+		BuildID: []string{"CI_PIPELINE_ID"},
+		Commit:  []string{"CI_COMMIT_SHA"},
+		Branch:  []string{"CI_COMMIT_REF_NAME"},
+	},
+	&ciEnv{
+		Name:    "circleci",
+		Marker:  "CIRCLECI",
+		BuildID: []string{"CIRCLE_WORKFLOW_ID", "CIRCLE_BUILD_NUM"},
+		Commit:  []string{"CIRCLE_SHA1"},
+		Branch:  []string{"CIRCLE_BRANCH"},
+	},
+	&ciEnv{
+		Name:    "buildkite",
+		Marker:  "BUILDKITE",
+		BuildID: []string{"BUILDKITE_BUILD_ID"},
+		Commit:  []string{"BUILDKITE_COMMIT"},
+		Branch:  []string{"BUILDKITE_BRANCH"},
+	},
+	&ciEnv{
+		Name:    "jenkins",
+		Marker:  "JENKINS_URL",
+		BuildID: []string{"BUILD_TAG"},
+		Commit:  []string{"GIT_COMMIT"},
+		Branch:  []string{"GIT_BRANCH"},
+	},
+}
+
+// detectCIRun returns the build of the first CI service whose marker
+// variable is set, or nil outside of any recognized CI
+func detectCIRun() *ciRun {
+	for _, ce := range ciEnvs {
+		if os.Getenv(ce.Marker) == "" {
+			continue
+		}
+
+		return &ciRun{
+			CI:      ce.Name,
+			BuildID: firstEnv(ce.BuildID),
+			Commit:  firstEnv(ce.Commit),
+			Branch:  firstEnv(ce.Branch),
+		}
+	}
+
+	return nil
+}
+
+func firstEnv(keys []string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Tags are the object tags for --auto-tag-run, leaving out anything the
+// CI service didn't say
+func (cr *ciRun) Tags() map[string]string {
+	tags := map[string]string{}
+	for key, value := range map[string]string{
+		"build-id": cr.BuildID,
+		"commit":   cr.Commit,
+		"branch":   cr.Branch,
+	} {
+		if value == "" {
+			continue
+		}
+		tags[key] = s3TagValue(value)
+	}
+	return tags
+}
+
+// s3TagValue replaces characters that S3 rejects in tag values, such as
+// the "#" of a branch name, and trims the value to the longest allowed
+func s3TagValue(value string) string {
+	value = s3TagValueInvalidRegexp.ReplaceAllString(value, "_")
+	if runes := []rune(value); len(runes) > maxS3TagValueLength {
+		value = string(runes[:maxS3TagValueLength])
+	}
+	return value
+}
+
+// s3Tagging encodes the tags for the x-amz-tagging header
+func s3Tagging(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// autoRunTagging detects the CI build for --auto-tag-run, returning no
+// tagging at all outside of a recognized CI
+func autoRunTagging(log *logrus.Logger) string {
+	run := detectCIRun()
+	if run == nil {
+		log.Info("no recognized ci environment, not tagging objects with the run")
+		return ""
+	}
+
+	tags := run.Tags()
+	log.WithFields(logrus.Fields{
+		"ci":   run.CI,
+		"tags": tags,
+	}).Debug("tagging objects with the run")
+
+	return s3Tagging(tags)
+}
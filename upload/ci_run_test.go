@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestDetectCIRun(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	if run := detectCIRun(); run != nil {
+		t.Fatalf("ci run detected outside of ci: %#v", run)
+	}
+
+	setenvs(map[string]string{
+		"GITHUB_ACTIONS":  "true",
+		"GITHUB_RUN_ID":   "8675309",
+		"GITHUB_SHA":      "deadbeef",
+		"GITHUB_REF_NAME": "main",
+	})
+
+	run := detectCIRun()
+	if run == nil || run.CI != "github-actions" {
+		t.Fatalf("github actions not detected: %#v", run)
+	}
+
+	expected := map[string]string{
+		"build-id": "8675309",
+		"commit":   "deadbeef",
+		"branch":   "main",
+	}
+	if !reflect.DeepEqual(run.Tags(), expected) {
+		t.Fatalf("tags %v != %v", run.Tags(), expected)
+	}
+
+	os.Setenv("GITHUB_HEAD_REF", "feature/fix#12")
+	if branch := detectCIRun().Tags()["branch"]; branch != "feature/fix_12" {
+		t.Fatalf("pull request branch %q != feature/fix_12", branch)
+	}
+}
+
+func TestDetectCIRunPartial(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	setenvs(map[string]string{
+		"TRAVIS":          "true",
+		"TRAVIS_BUILD_ID": "42",
+	})
+
+	tags := detectCIRun().Tags()
+	if !reflect.DeepEqual(tags, map[string]string{"build-id": "42"}) {
+		t.Fatalf("tags %v != map[build-id:42]", tags)
+	}
+}
+
+func TestS3TagValue(t *testing.T) {
+	if s3TagValue("ok value_1.2:3/4=5+6-7@8") != "ok value_1.2:3/4=5+6-7@8" {
+		t.Fatalf("valid characters were replaced")
+	}
+
+	if len(s3TagValue(strings.Repeat("x", 300))) != maxS3TagValueLength {
+		t.Fatalf("long tag value was not trimmed")
+	}
+}
+
+func TestS3ProviderAutoTagRunHeader(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	setenvs(map[string]string{
+		"GITLAB_CI":          "true",
+		"CI_PIPELINE_ID":     "1001",
+		"CI_COMMIT_SHA":      "cafe",
+		"CI_COMMIT_REF_NAME": "release",
+	})
+
+	opts := NewOptions()
+	a := artifact.New("bucket", "/tmp/whatever.txt", "whatever.txt", &artifact.Options{})
+
+	headers, _ := newS3Provider(opts, getPanicLogger()).objectHeaders(opts, a)
+	if _, ok := headers["x-amz-tagging"]; ok {
+		t.Fatalf("tagging header set without --auto-tag-run")
+	}
+
+	opts.AutoTagRun = true
+	headers, _ = newS3Provider(opts, getPanicLogger()).objectHeaders(opts, a)
+	expected := []string{"branch=release&build-id=1001&commit=cafe"}
+	if !reflect.DeepEqual(headers["x-amz-tagging"], expected) {
+		t.Fatalf("tagging header %v != %v", headers["x-amz-tagging"], expected)
+	}
+
+	os.Clearenv()
+	headers, _ = newS3Provider(opts, getPanicLogger()).objectHeaders(opts, a)
+	if _, ok := headers["x-amz-tagging"]; ok {
+		t.Fatalf("tagging header set outside of ci")
+	}
+}
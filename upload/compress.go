@@ -0,0 +1,210 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// compressibleTypes are the content types besides text/* that --gzip
+// compresses.  Everything else, e.g. images and archives, is usually
+// compressed already.
+var compressibleTypes = map[string]bool{
+	"application/javascript":   true,
+	"application/json":         true,
+	"application/x-javascript": true,
+	"application/x-ndjson":     true,
+	"application/x-sh":         true,
+	"application/x-yaml":       true,
+	"application/xhtml+xml":    true,
+	"application/xml":          true,
+	"application/yaml":         true,
+	"image/svg+xml":            true,
+}
+
+// mediaTypeRoots are the top-level media types, which tell the content
+// types given to --gzip-types apart from file globs
+var mediaTypeRoots = map[string]bool{
+	"*":           true,
+	"application": true,
+	"audio":       true,
+	"font":        true,
+	"image":       true,
+	"message":     true,
+	"model":       true,
+	"multipart":   true,
+	"text":        true,
+	"video":       true,
+}
+
+// gzipStats counts what --gzip compressed, for the summary at the end
+type gzipStats struct {
+	Count          int
+	Size           uint64
+	CompressedSize uint64
+}
+
+// isCompressible reports whether --gzip compresses the content type
+func isCompressible(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		compressibleTypes[mediaType]
+}
+
+// isMediaTypePattern reports whether the --gzip-types entry is a content
+// type such as text/* rather than a file glob
+func isMediaTypePattern(pattern string) bool {
+	parts := strings.SplitN(pattern, "/", 2)
+	return len(parts) == 2 && mediaTypeRoots[strings.ToLower(parts[0])] && !strings.Contains(parts[1], "/")
+}
+
+// gzips reports whether --gzip compresses the artifact at dest with the
+// content type: those matching --gzip-types if given, by content type or
+// by a glob of the dest (or of its name, for globs without a /), and
+// otherwise those with compressible content types
+func (u *uploader) gzips(dest, ctype string) bool {
+	if len(u.Opts.GzipTypes) == 0 {
+		return isCompressible(ctype)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	dest = filepath.ToSlash(dest)
+
+	for _, pattern := range u.Opts.GzipTypes {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if isMediaTypePattern(pattern) {
+			if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+				return true
+			}
+			continue
+		}
+
+		if matchGlob(pattern, dest) || (!strings.Contains(pattern, "/") && matchGlob(pattern, path.Base(dest))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyGzip encodes a walked artifact with a gzipped temp copy of its
+// source when --gzip is set and it is one --gzip compresses, so its
+// size is the compressed size from then on.  Artifacts that are already
+// encoded, or will be by --content-encoding-by-ext, are left alone.  Each
+// source is compressed once, however many target paths it goes to.  With
+// --bundle, the bundle is gzipped as a whole instead.
+func (u *uploader) applyGzip(a *artifact.Artifact) error {
+	if !u.Opts.Gzip || u.Opts.bundling() || a.Source == "" || a.ContentEncoding != "" || u.contentEncodingFor(a.Dest) != nil {
+		return nil
+	}
+
+	ctype := a.ContentType()
+	if !u.gzips(a.Dest, ctype) {
+		return nil
+	}
+
+	gzipped, ok := u.gzipped[a.Source]
+	if !ok {
+		var err error
+		gzipped, err = u.gzipSource(a.Source)
+		if err != nil {
+			return err
+		}
+
+		if u.gzipped == nil {
+			u.gzipped = map[string]string{}
+		}
+		u.gzipped[a.Source] = gzipped
+	}
+
+	origSize, _ := a.Size()
+	a.Encode("gzip", gzipped)
+	size, _ := a.Size()
+
+	u.gzipStats.Count++
+	u.gzipStats.Size += origSize
+	u.gzipStats.CompressedSize += size
+
+	u.log.WithFields(logrus.Fields{
+		"source":          a.Source,
+		"content_type":    ctype,
+		"size":            humanize.Bytes(origSize),
+		"compressed_size": humanize.Bytes(size),
+	}).Debug("gzipped artifact")
+
+	return nil
+}
+
+// logGzipped logs how much --gzip compressed in all, with both the raw
+// and compressed sizes
+func (u *uploader) logGzipped() {
+	stats := u.gzipStats
+	if stats.Count == 0 {
+		return
+	}
+
+	saved := 0.0
+	if stats.Size > 0 {
+		saved = 100 * (1 - float64(stats.CompressedSize)/float64(stats.Size))
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"gzipped":         stats.Count,
+		"size":            humanize.Bytes(stats.Size),
+		"compressed_size": humanize.Bytes(stats.CompressedSize),
+	}).Info(fmt.Sprintf("gzipped %d artifacts from %s to %s (%.0f%% smaller)",
+		stats.Count, humanize.Bytes(stats.Size), humanize.Bytes(stats.CompressedSize), saved))
+}
+
+// gzipSource writes a gzipped copy of the source to a temp file
+func (u *uploader) gzipSource(source string) (string, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// the compressed size isn't known yet, but is rarely more than this
+	f, err := u.tempFile("artifacts-gzip", uint64(fi.Size()))
+	if err != nil {
+		return "", err
+	}
+
+	w := newGzipWriter(f, u.Opts.CompressParallel)
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		f.Close()
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	return f.Name(), f.Close()
+}
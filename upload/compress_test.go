@@ -0,0 +1,217 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestIsCompressible(t *testing.T) {
+	for ctype, expected := range map[string]bool{
+		"text/plain; charset=utf-8":       true,
+		"text/html":                       true,
+		"application/json":                true,
+		"application/xml":                 true,
+		"application/vnd.api+json":        true,
+		"image/svg+xml":                   true,
+		"image/png":                       false,
+		"application/zip":                 false,
+		"application/x-gzip":              false,
+		"application/octet-stream":        false,
+		"not a content type; at all; ===": false,
+	} {
+		if isCompressible(ctype) != expected {
+			t.Errorf("isCompressible(%q) != %v", ctype, expected)
+		}
+	}
+}
+
+func TestUploadGzip(t *testing.T) {
+	os.Clearenv()
+	report := strings.Repeat(`{"suite": "unit", "passed": true}`+"\n", 1000)
+	dir := writeTestFiles(t, map[string]string{
+		"out/report.json": report,
+		"out/build.log":   strings.Repeat("ok\n", 1000),
+		"out/logo.png":    "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100),
+		"out/bundle.zip":  "PK\x03\x04" + strings.Repeat("\x00", 100),
+		"out/pre.html.gz": "\x1f\x8b\x08\x00",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"out/"}
+	opts.TargetPaths = []string{"a", "b"}
+	opts.ContentEncodingByExt = []string{".gz=gzip"}
+	opts.Gzip = true
+	// both copies of report.json only fit once compressed
+	opts.MaxSize = uint64(len(report))
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byDest := map[string]*artifact.Artifact{}
+	for _, a := range rp.Uploaded {
+		byDest[a.FullDest()] = a
+	}
+
+	for dest, encoding := range map[string]string{
+		"a/out/report.json": "gzip",
+		"b/out/report.json": "gzip",
+		"a/out/build.log":   "gzip",
+		"a/out/logo.png":    "",
+		"a/out/bundle.zip":  "",
+		"a/out/pre.html":    "gzip",
+	} {
+		a, ok := byDest[dest]
+		if !ok {
+			t.Fatalf("%v was not uploaded: %v", dest, byDest)
+		}
+
+		if a.ContentEncoding != encoding {
+			t.Fatalf("%v content encoding %q != %q", dest, a.ContentEncoding, encoding)
+		}
+	}
+
+	a := byDest["a/out/report.json"]
+	if a.ContentType() != "application/json" {
+		t.Fatalf("gzipped content type %q != application/json", a.ContentType())
+	}
+
+	if a.ContentSource() != byDest["b/out/report.json"].ContentSource() {
+		t.Fatalf("report.json was gzipped once per target path")
+	}
+
+	if pre := byDest["a/out/pre.html"]; pre.ContentSource() != pre.Source {
+		t.Fatalf("already-encoded artifact was gzipped again")
+	}
+}
+
+func TestApplyGzip(t *testing.T) {
+	os.Clearenv()
+	report := strings.Repeat("all tests passed\n", 1000)
+	dir := writeTestFiles(t, map[string]string{"report.txt": report})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Gzip = true
+
+	u := newUploader(opts, getPanicLogger())
+	defer u.removeTempFiles()
+
+	a := artifact.New("a", filepath.Join(dir, "report.txt"), "report.txt", u.artifactOptions())
+	if err := u.applyGzip(a); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if a.Dest != "report.txt" {
+		t.Fatalf("gzipped dest %q != report.txt", a.Dest)
+	}
+
+	size, _ := a.Size()
+	if size == 0 || size >= uint64(len(report)) {
+		t.Fatalf("gzipped size %v is not between 0 and %v", size, len(report))
+	}
+
+	reader, err := a.Reader()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reader.(io.Closer).Close()
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(content) != report {
+		t.Fatalf("gunzipped content differs from report.txt")
+	}
+}
+
+func TestGzipTypes(t *testing.T) {
+	opts := NewOptions()
+	opts.Gzip = true
+	opts.GzipTypes = []string{"application/*+json", "text/x-log", "*.xml", "coverage/**"}
+	u := &uploader{Opts: opts}
+
+	for _, c := range []struct {
+		Dest     string
+		Ctype    string
+		Expected bool
+	}{
+		{"api.json", "application/vnd.api+json", true},
+		{"build.log", "text/x-log; charset=utf-8", true},
+		{"reports/junit.xml", "application/octet-stream", true},
+		{"coverage/lcov/index.html", "text/html", true},
+		{"index.html", "text/html", false},
+		{"data.json", "application/json", false},
+	} {
+		if u.gzips(c.Dest, c.Ctype) != c.Expected {
+			t.Fatalf("gzips(%q, %q) != %v", c.Dest, c.Ctype, c.Expected)
+		}
+	}
+
+	opts.GzipTypes = nil
+	if !u.gzips("index.html", "text/html") || u.gzips("logo.png", "image/png") {
+		t.Fatalf("default gzip types not used without --gzip-types")
+	}
+}
+
+func TestGzipSummary(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"report.txt": strings.Repeat("all tests passed\n", 1000),
+		"logo.png":   "not really a png",
+	})
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = buf
+	log.Level = logrus.InfoLevel
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"report.txt", "logo.png"}
+	opts.Gzip = true
+
+	if err := newUploader(opts, log).Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "gzipped 1 artifacts from 17KB to ") {
+		t.Fatalf("no gzip summary in %q", buf.String())
+	}
+}
+
+func TestValidateGzipTypes(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.AccessKey, opts.SecretKey, opts.BucketName = "key", "secret", "bucket"
+	opts.GzipTypes = []string{"*.log"}
+
+	if err := opts.Validate(); err == nil || err.Error() != "--gzip-types requires --gzip" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travis-ci/artifacts/env"
+)
+
+const (
+	// ConfigJSONEnvVar is the env var that may contain a JSON object
+	// of config values, e.g. as injected by an orchestration platform
+	ConfigJSONEnvVar = "ARTIFACTS_CONFIG_JSON"
+
+	// headerRulesConfigKey is the config key of header rules given inline,
+	// as a list of lines like those of a --header-rules-from file, since
+	// there is no flag for them
+	headerRulesConfigKey = "header_rules"
+)
+
+// UpdateFromConfigEnv overlays the JSON object from
+// $ARTIFACTS_CONFIG_JSON (if any) onto internal options
+func (opts *Options) UpdateFromConfigEnv() error {
+	raw := strings.TrimSpace(os.Getenv(ConfigJSONEnvVar))
+	if raw == "" {
+		return nil
+	}
+
+	cfg, err := parseConfigJSON([]byte(raw))
+	if err != nil {
+		return fmt.Errorf("invalid $%s: %v", ConfigJSONEnvVar, err)
+	}
+
+	err = opts.UpdateFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid $%s: %v", ConfigJSONEnvVar, err)
+	}
+
+	return nil
+}
+
+// UpdateFromConfig overlays a map of config values onto internal
+// options.  Any option that has been set via the environment is left
+// alone so that precedence is defaults < config < env < command line.
+// Keys must match an option's config name, e.g. "bucket" or
+// "target_paths", or be headerRulesConfigKey.  Values are taken
+// literally, without expanding $VARS.
+func (opts *Options) UpdateFromConfig(cfg map[string]interface{}) error {
+	fieldNames := configFieldNames()
+
+	unknown := []string{}
+	for key := range cfg {
+		if _, ok := fieldNames[key]; !ok && key != headerRulesConfigKey {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+	}
+
+	s := reflect.ValueOf(opts).Elem()
+
+	keys := []string{}
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == headerRulesConfigKey {
+			rules, err := configHeaderRules(cfg[key])
+			if err != nil {
+				return fmt.Errorf("config key %q: %v", key, err)
+			}
+			opts.headerRules = rules
+			continue
+		}
+
+		name := fieldNames[key]
+		if isSetInEnv(name) {
+			continue
+		}
+
+		if name == "Concurrency" && cfg[key] == "auto" {
+			opts.setConcurrency("auto")
+			continue
+		}
+
+		err := setConfigField(s.FieldByName(name), name, cfg[key])
+		if err != nil {
+			return fmt.Errorf("config key %q: %v", key, err)
+		}
+
+		if name == "Concurrency" {
+			opts.concurrencyAuto = false
+		}
+
+		if name == "Retries" {
+			opts.retriesSet = true
+		}
+
+		if name == "RetryInterval" {
+			opts.retryIntervalSet = true
+		}
+	}
+
+	return nil
+}
+
+func parseConfigJSON(b []byte) (map[string]interface{}, error) {
+	cfg := map[string]interface{}{}
+	err := json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// configFieldNames maps each config key to its Options field name.  The
+// config key is the long command line name with underscores instead of
+// dashes, e.g. "target-paths" becomes "target_paths".
+func configFieldNames() map[string]string {
+	names := map[string]string{}
+	for fieldName, cliNames := range optsMaps["cli"] {
+		// a config file cannot point at another one
+		if fieldName == "ConfigFile" {
+			continue
+		}
+		names[configName(fieldName, cliNames)] = fieldName
+	}
+	return names
+}
+
+func configName(fieldName, cliNames string) string {
+	name := strings.TrimSpace(strings.Split(cliNames, ",")[0])
+	if name == "" {
+		name = strings.ToLower(fieldName)
+	}
+	return strings.Replace(name, "-", "_", -1)
+}
+
+func isSetInEnv(fieldName string) bool {
+	for _, key := range strings.Split(optsMaps["env"][fieldName], ",") {
+		// $PWD is only ever a fallback, not something set on purpose
+		if key == "" || key == "PWD" {
+			continue
+		}
+		if _, envVar := env.CascadeMatch([]string{key}, ""); envVar != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func setConfigField(f reflect.Value, fieldName string, value interface{}) error {
+	switch f.Kind() {
+	case reflect.String:
+		s, err := configString(value)
+		if err != nil {
+			return err
+		}
+		f.SetString(s)
+	case reflect.Uint64:
+		u, err := configUint(fieldName, value)
+		if err != nil {
+			return err
+		}
+		f.SetUint(u)
+	case reflect.Bool:
+		b, err := configBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int64:
+		if f.Type() != durationType {
+			return fmt.Errorf("unsupported option type %v", f.Type())
+		}
+		d, err := configDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case reflect.Slice:
+		if s, ok := value.(string); ok && urlListOpts[fieldName] {
+			f.Set(reflect.ValueOf(strings.Fields(s)))
+			break
+		}
+		sl, err := configSlice(fieldName, value)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(sl))
+	case reflect.Map:
+		m, err := configMap(value)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported option kind %v", f.Kind())
+	}
+
+	return nil
+}
+
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("expected a string, got %T", value)
+}
+
+func configUint(fieldName string, value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case float64:
+		if v < 0 || v != float64(uint64(v)) {
+			return 0, fmt.Errorf("expected a non-negative integer, got %v", v)
+		}
+		return uint64(v), nil
+	case string:
+		if sizeOpts[fieldName] {
+			return parseSizeOpt(fieldName, v)
+		}
+		return strconv.ParseUint(v, 10, 64)
+	}
+	return 0, fmt.Errorf("expected an integer, got %T", value)
+}
+
+func configDuration(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	case string:
+		return time.ParseDuration(v)
+	}
+	return 0, fmt.Errorf("expected a duration, got %T", value)
+}
+
+func configBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, fmt.Errorf("expected a boolean, got %T", value)
+}
+
+// configMap accepts an object as well as the key=value pairs of the flag
+func configMap(value interface{}) (map[string]string, error) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		pairs, err := configSlice("", value)
+		if err != nil {
+			return nil, fmt.Errorf("expected an object, a list, or a ':'-delimited string, got %T", value)
+		}
+		return pairsMap(pairs), nil
+	}
+
+	m := map[string]string{}
+	for key, item := range obj {
+		s, err := configString(item)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = s
+	}
+	return m, nil
+}
+
+func configSlice(fieldName string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return splitList(fieldName, v), nil
+	case []interface{}:
+		ret := []string{}
+		for _, item := range v {
+			s, err := configString(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("expected a list or ':'-delimited string, got %T", value)
+}
+
+// configHeaderRules parses each line of the list as parseHeaderRule does
+func configHeaderRules(value interface{}) ([]*headerRule, error) {
+	lines, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %T", value)
+	}
+
+	rules := []*headerRule{}
+	for _, item := range lines {
+		line, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %T", item)
+		}
+
+		rule, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,80 @@
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadOptions layers the config file (or $ARTIFACTS_CONFIG, or one found
+// in the working dir, when it is empty), $ARTIFACTS_CONFIG_JSON, and the
+// environment over the defaults, as the command does before the command
+// line is applied
+func LoadOptions(configFile string) (*Options, error) {
+	return LoadOptionsIn(configFile, "")
+}
+
+// LoadOptionsIn is LoadOptions, but looks for a config file in workingDir
+// instead of the working dir from the environment, as the command does
+// with --working-dir
+func LoadOptionsIn(configFile, workingDir string) (*Options, error) {
+	opts := NewOptions()
+	if configFile != "" {
+		opts.ConfigFile = configFile
+	}
+	if workingDir != "" {
+		opts.WorkingDir = workingDir
+	}
+
+	if err := opts.UpdateFromConfigFile(); err != nil {
+		return opts, err
+	}
+
+	if err := opts.UpdateFromConfigEnv(); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// configFileName is the config file looked for in the working dir when
+// none is given
+const configFileName = ".artifacts.json"
+
+// UpdateFromConfigFile overlays the JSON file given as --config, or else
+// the configFileName in the working dir (if any), onto internal options,
+// with the same precedence and keys as UpdateFromConfig.  Files ending in
+// .yml, .yaml, or .toml are rejected, since only JSON is supported.
+func (opts *Options) UpdateFromConfigFile() error {
+	if opts.ConfigFile == "" {
+		path := filepath.Join(opts.WorkingDir, configFileName)
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			return nil
+		}
+		opts.ConfigFile = path
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(opts.ConfigFile)); ext {
+	case ".yml", ".yaml", ".toml":
+		return fmt.Errorf("config file %s is %s, which is not supported (use json instead)", opts.ConfigFile, ext[1:])
+	}
+
+	b, err := ioutil.ReadFile(opts.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("config file cannot be read: %v", err)
+	}
+
+	cfg, err := parseConfigJSON(b)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", opts.ConfigFile, err)
+	}
+
+	err = opts.UpdateFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", opts.ConfigFile, err)
+	}
+
+	return nil
+}
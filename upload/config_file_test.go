@@ -0,0 +1,236 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testConfigJSON = `{
+  "bucket": "config-bucket",
+  "target_paths": ["artifacts/one", "artifacts/two"],
+  "concurrency": 9,
+  "max_size": "10MB",
+  "retry_interval": 5,
+  "cache_control": "public, max-age=60",
+  "skip_unchanged": true,
+  "paths": ["log/", "coverage/"],
+  "content_type": {
+    ".wasm": "application/wasm",
+    ".log": "text/plain; charset=utf-8"
+  }
+}`
+
+func writeTestConfigFile(t *testing.T, name, content string) (string, string) {
+	dir, err := ioutil.TempDir("", "artifacts-config")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return dir, path
+}
+
+func TestUpdateFromConfigFile(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"ARTIFACTS_CONCURRENCY": "3",
+	})
+	defer os.Clearenv()
+
+	dir, path := writeTestConfigFile(t, ".artifacts.json", testConfigJSON)
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.ConfigFile = path
+	if err := opts.UpdateFromConfigFile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.BucketName != "config-bucket" {
+		t.Fatalf("bucket name %v != config-bucket", opts.BucketName)
+	}
+
+	if opts.MaxSize != 10000000 {
+		t.Fatalf("max size %v != 10000000", opts.MaxSize)
+	}
+
+	if !reflect.DeepEqual(opts.Paths, []string{"log/", "coverage/"}) {
+		t.Fatalf("paths %v != [log/ coverage/]", opts.Paths)
+	}
+
+	if opts.ContentTypes[".wasm"] != "application/wasm" {
+		t.Fatalf("content types %v do not include .wasm", opts.ContentTypes)
+	}
+
+	if opts.RetryInterval.Seconds() != 5 {
+		t.Fatalf("retry interval %v != 5s", opts.RetryInterval)
+	}
+
+	if opts.Concurrency != 3 {
+		t.Fatalf("env var did not take precedence over config file: concurrency %v != 3", opts.Concurrency)
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	dir, path := writeTestConfigFile(t, ".artifacts.json", testConfigJSON)
+	defer os.RemoveAll(dir)
+
+	setenvs(map[string]string{
+		"ARTIFACTS_CONFIG":      path,
+		ConfigJSONEnvVar:        `{"concurrency": 4, "cache_control": "private"}`,
+		"ARTIFACTS_BUCKET":      "env-bucket",
+		"ARTIFACTS_CONCURRENCY": "3",
+	})
+
+	opts, err := LoadOptions("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(opts.Paths, []string{"log/", "coverage/"}) {
+		t.Fatalf("paths %v != [log/ coverage/]", opts.Paths)
+	}
+
+	if opts.CacheControl != "private" {
+		t.Fatalf("$%s did not take precedence over the config file: cache control %q", ConfigJSONEnvVar, opts.CacheControl)
+	}
+
+	if opts.Concurrency != 3 || opts.BucketName != "env-bucket" {
+		t.Fatalf("env vars did not take precedence: concurrency %v, bucket %v", opts.Concurrency, opts.BucketName)
+	}
+
+	if _, err := LoadOptions(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatalf("no error for a missing config file")
+	}
+}
+
+func TestUpdateFromConfigFileNotJSON(t *testing.T) {
+	os.Clearenv()
+
+	for _, name := range []string{"artifacts.yml", ".artifacts.YAML", "artifacts.toml"} {
+		dir, path := writeTestConfigFile(t, name, "bucket: config-bucket\n")
+		defer os.RemoveAll(dir)
+
+		opts := NewOptions()
+		opts.ConfigFile = path
+		err := opts.UpdateFromConfigFile()
+		if err == nil || !strings.Contains(err.Error(), "use json instead") {
+			t.Fatalf("config file %s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestUpdateFromConfigFileDiscovered(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	dir, path := writeTestConfigFile(t, ".artifacts.json", `{"bucket": "discovered"}`)
+	defer os.RemoveAll(dir)
+
+	opts, err := LoadOptionsIn("", dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.BucketName != "discovered" || opts.ConfigFile != path {
+		t.Fatalf("config file was not discovered in the working dir: bucket %q, config %q", opts.BucketName, opts.ConfigFile)
+	}
+
+	os.Setenv("ARTIFACTS_WORKING_DIR", dir)
+	opts, err = LoadOptions("")
+	if err != nil || opts.BucketName != "discovered" {
+		t.Fatalf("config file was not discovered in $ARTIFACTS_WORKING_DIR: bucket %q, %v", opts.BucketName, err)
+	}
+
+	opts, err = LoadOptionsIn("", os.TempDir())
+	if err != nil || opts.BucketName == "discovered" {
+		t.Fatalf("config file was discovered outside of the working dir given: %v", err)
+	}
+
+	opts, err = LoadOptions(filepath.Join(dir, "missing.json"))
+	if err == nil || opts.BucketName == "discovered" {
+		t.Fatalf("discovered config file was read over a given one: %v", err)
+	}
+}
+
+func TestUpdateFromConfigFileHeaderRules(t *testing.T) {
+	os.Clearenv()
+
+	dir, path := writeTestConfigFile(t, "artifacts.json", `{
+  "header_rules": [
+    "site/**     Cache-Control: public, max-age=31536000",
+    "site/*.html Cache-Control: no-cache"
+  ]
+}`)
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.ConfigFile = path
+	if err := opts.UpdateFromConfigFile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(opts.headerRules) != 2 || opts.headerRules[1].Pattern != "site/*.html" ||
+		opts.headerRules[1].Header != "cache-control" || opts.headerRules[1].Value != "no-cache" {
+		t.Fatalf("unexpected header rules: %#v", opts.headerRules)
+	}
+
+	for _, content := range []string{
+		`{"header_rules": "site/** Cache-Control: no-cache"}`,
+		`{"header_rules": ["site/** Expires: never"]}`,
+	} {
+		dir, path := writeTestConfigFile(t, "artifacts.json", content)
+		defer os.RemoveAll(dir)
+
+		opts := NewOptions()
+		opts.ConfigFile = path
+		if opts.UpdateFromConfigFile() == nil {
+			t.Fatalf("invalid header rules %q were accepted", content)
+		}
+	}
+}
+
+func TestUpdateFromConfigFileErrors(t *testing.T) {
+	os.Clearenv()
+
+	opts := NewOptions()
+	opts.ConfigFile = "/nonexistent/artifacts.json"
+	if opts.UpdateFromConfigFile() == nil {
+		t.Fatalf("missing config file was accepted")
+	}
+
+	for _, content := range []string{
+		`{"wat": "nope"}`,
+		`{"config": "other.json"}`,
+		`{"concurrency": "lots"}`,
+		`bucket: not-json`,
+	} {
+		dir, path := writeTestConfigFile(t, "artifacts.json", content)
+		defer os.RemoveAll(dir)
+
+		opts := NewOptions()
+		opts.ConfigFile = path
+		if opts.UpdateFromConfigFile() == nil {
+			t.Fatalf("invalid config file %q was accepted", content)
+		}
+	}
+
+	opts = NewOptions()
+	if err := opts.UpdateFromConfigFile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(opts, NewOptions()) {
+		t.Fatalf("options changed without a config file: %#v", opts)
+	}
+}
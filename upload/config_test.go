@@ -0,0 +1,220 @@
+package upload
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpdateFromConfig(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+
+	err := opts.UpdateFromConfig(map[string]interface{}{
+		"bucket":         "config-bucket",
+		"concurrency":    float64(9),
+		"max_size":       "10MB",
+		"target_paths":   []interface{}{"foo", "bar/baz"},
+		"paths":          "one:two",
+		"retry_deadline": "10m",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.BucketName != "config-bucket" {
+		t.Fatalf("bucket name %v != config-bucket", opts.BucketName)
+	}
+
+	if opts.Concurrency != 9 {
+		t.Fatalf("concurrency %v != 9", opts.Concurrency)
+	}
+
+	if opts.MaxSize != 10000000 {
+		t.Fatalf("max size %v != 10000000", opts.MaxSize)
+	}
+
+	if !reflect.DeepEqual(opts.TargetPaths, []string{"foo", "bar/baz"}) {
+		t.Fatalf("target paths %v != [foo bar/baz]", opts.TargetPaths)
+	}
+
+	if !reflect.DeepEqual(opts.Paths, []string{"one", "two"}) {
+		t.Fatalf("paths %v != [one two]", opts.Paths)
+	}
+
+	if opts.RetryDeadline != 10*time.Minute {
+		t.Fatalf("retry deadline %v != 10m", opts.RetryDeadline)
+	}
+}
+
+func TestUpdateFromConfigUnknownKeys(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+
+	err := opts.UpdateFromConfig(map[string]interface{}{
+		"bucket": "foo",
+		"wat":    "nope",
+		"bogus":  true,
+	})
+	if err == nil {
+		t.Fatalf("unknown keys were accepted")
+	}
+
+	if err.Error() != "unknown config keys: bogus, wat" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUpdateFromConfigBadValue(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+
+	err := opts.UpdateFromConfig(map[string]interface{}{
+		"concurrency": "lots",
+	})
+	if err == nil {
+		t.Fatalf("bad concurrency value was accepted")
+	}
+}
+
+func TestSetConfigFieldInt64(t *testing.T) {
+	var d time.Duration
+	err := setConfigField(reflect.ValueOf(&d).Elem(), "RetryInterval", "2s")
+	if err != nil || d != 2*time.Second {
+		t.Fatalf("duration %v != 2s (err %v)", d, err)
+	}
+
+	var n int64
+	err = setConfigField(reflect.ValueOf(&n).Elem(), "Count", "2s")
+	if err == nil || n != 0 {
+		t.Fatalf("plain int64 taken as a duration: %v", n)
+	}
+}
+
+func TestUpdateFromConfigEnv(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"ARTIFACTS_CONFIG_JSON": `{"bucket": "from-json", "retries": 7, "cache_control": "public"}`,
+		"ARTIFACTS_RETRIES":     "4",
+	})
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	err := opts.UpdateFromConfigEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.BucketName != "from-json" {
+		t.Fatalf("bucket name %v != from-json", opts.BucketName)
+	}
+
+	if opts.CacheControl != "public" {
+		t.Fatalf("cache control %v != public", opts.CacheControl)
+	}
+
+	if opts.Retries != 4 {
+		t.Fatalf("env var did not take precedence over config: retries %v != 4", opts.Retries)
+	}
+}
+
+func TestUpdateFromConfigEnvInvalid(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"ARTIFACTS_CONFIG_JSON": `{"bucket": `,
+	})
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	if opts.UpdateFromConfigEnv() == nil {
+		t.Fatalf("invalid json was accepted")
+	}
+}
+
+func TestUpdateFromConfigEnvUnset(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	if err := opts.UpdateFromConfigEnv(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(opts, NewOptions()) {
+		t.Fatalf("options changed without config: %#v", opts)
+	}
+}
+
+func TestUpdateFromConfigContentTypes(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+
+	err := opts.UpdateFromConfig(map[string]interface{}{
+		"content_type": map[string]interface{}{".wasm": "application/wasm"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(opts.ContentTypes, map[string]string{".wasm": "application/wasm"}) {
+		t.Fatalf("content types %v != map[.wasm:application/wasm]", opts.ContentTypes)
+	}
+
+	err = opts.UpdateFromConfig(map[string]interface{}{
+		"content_type": []interface{}{".log=text/plain"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(opts.ContentTypes, map[string]string{".log": "text/plain"}) {
+		t.Fatalf("content types %v != map[.log:text/plain]", opts.ContentTypes)
+	}
+}
+
+func TestUpdateFromConfigLiteralDollars(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{"HOME": "/home/whoever"})
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	err := opts.UpdateFromConfig(map[string]interface{}{
+		"cache_control": "private, $HOME",
+		"paths":         []interface{}{"build/$1.log"},
+		"content_type":  map[string]interface{}{".x": "text/$HOME"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.CacheControl != "private, $HOME" {
+		t.Fatalf("cache control %q was expanded", opts.CacheControl)
+	}
+
+	if !reflect.DeepEqual(opts.Paths, []string{"build/$1.log"}) {
+		t.Fatalf("paths %v were expanded", opts.Paths)
+	}
+
+	if opts.ContentTypes[".x"] != "text/$HOME" {
+		t.Fatalf("content types %v were expanded", opts.ContentTypes)
+	}
+}
+
+func TestUpdateFromConfigSizes(t *testing.T) {
+	os.Clearenv()
+	fields := reflect.ValueOf(NewOptions()).Elem()
+	for fieldName := range sizeOpts {
+		if f := fields.FieldByName(fieldName); !f.IsValid() || f.Kind() != reflect.Uint64 {
+			t.Fatalf("size option %v is not a uint64 option", fieldName)
+		}
+
+		opts := NewOptions()
+		key := configName(fieldName, optsMaps["cli"][fieldName])
+		if err := opts.UpdateFromConfig(map[string]interface{}{key: "2KB"}); err != nil {
+			t.Fatalf("%v: unexpected error: %v", key, err)
+		}
+
+		if v := reflect.ValueOf(opts).Elem().FieldByName(fieldName).Uint(); v != 2000 {
+			t.Fatalf("%v %v != 2000", key, v)
+		}
+	}
+}
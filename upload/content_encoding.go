@@ -0,0 +1,67 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+type contentEncodingEntry struct {
+	Ext      string
+	Encoding string
+}
+
+// parseContentEncodings returns the entries longest extension first, so
+// that e.g. ".tar.gz" wins over ".gz"
+func parseContentEncodings(byExt []string) ([]*contentEncodingEntry, error) {
+	entries := []*contentEncodingEntry{}
+
+	for _, s := range byExt {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], ".") || len(parts[0]) < 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid content encoding %q, expected .ext=encoding", s)
+		}
+
+		entries = append(entries, &contentEncodingEntry{
+			Ext:      strings.ToLower(parts[0]),
+			Encoding: strings.TrimSpace(parts[1]),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return len(entries[i].Ext) > len(entries[j].Ext)
+	})
+
+	return entries, nil
+}
+
+// applyContentEncoding marks an artifact whose dest has one of the
+// --content-encoding-by-ext extensions as already encoded, and strips the
+// extension from its dest unless --content-encoding-keep-ext is set.  The
+// artifact's bytes are uploaded untouched either way.
+func (u *uploader) applyContentEncoding(a *artifact.Artifact) {
+	entry := u.contentEncodingFor(a.Dest)
+	if entry == nil {
+		return
+	}
+
+	a.ContentEncoding = entry.Encoding
+
+	stripped := a.Dest[:len(a.Dest)-len(entry.Ext)]
+	if !u.Opts.ContentEncodingKeepExt && stripped != "" && !strings.HasSuffix(stripped, "/") {
+		a.Dest = stripped
+	}
+}
+
+// contentEncodingFor returns the --content-encoding-by-ext entry for the
+// dest's extension, if it has one
+func (u *uploader) contentEncodingFor(dest string) *contentEncodingEntry {
+	for _, entry := range u.contentEncodings {
+		if strings.HasSuffix(strings.ToLower(dest), entry.Ext) {
+			return entry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package upload
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestParseContentEncodings(t *testing.T) {
+	entries, err := parseContentEncodings([]string{".gz=gzip", ".BR=br", ".svgz=gzip", ".tar.gz=identity"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exts := []string{}
+	for _, entry := range entries {
+		exts = append(exts, entry.Ext)
+	}
+
+	if !reflect.DeepEqual(exts, []string{".tar.gz", ".svgz", ".gz", ".br"}) {
+		t.Fatalf("extensions %v are not longest first", exts)
+	}
+
+	for _, bad := range []string{"gz=gzip", ".gz", ".gz=", "=gzip", ".=gzip"} {
+		if _, err := parseContentEncodings([]string{bad}); err == nil {
+			t.Fatalf("invalid content encoding %q was accepted", bad)
+		}
+	}
+}
+
+func writeContentEncodingFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"report.html.gz": "not really gzip",
+		"app.js.BR":      "not really brotli",
+		"plain.txt":      "plain",
+		"sub/.gz":        "oddly named",
+	})
+}
+
+func contentEncodingOpts(dir string, keepExt bool) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"report.html.gz", "app.js.BR", "plain.txt", "sub/"}
+		opts.TargetPaths = []string{"enc"}
+		opts.ContentEncodingByExt = []string{".gz=gzip", ".br=br"}
+		opts.ContentEncodingKeepExt = keepExt
+	}
+}
+
+func uploadedByDest(rp *recordingProvider) map[string]*artifact.Artifact {
+	byDest := map[string]*artifact.Artifact{}
+	for _, a := range rp.Uploaded {
+		byDest[a.FullDest()] = a
+	}
+	return byDest
+}
+
+func TestUploaderContentEncodingByExt(t *testing.T) {
+	dir := writeContentEncodingFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, contentEncodingOpts(dir, false))
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dests := rp.FullDests()
+	sort.Strings(dests)
+	if !reflect.DeepEqual(dests, []string{"enc/app.js", "enc/plain.txt", "enc/report.html", "enc/sub/.gz"}) {
+		t.Fatalf("unexpected dests: %v", dests)
+	}
+
+	byDest := uploadedByDest(rp)
+	for dest, encoding := range map[string]string{
+		"enc/report.html": "gzip",
+		"enc/app.js":      "br",
+		"enc/plain.txt":   "",
+		"enc/sub/.gz":     "gzip",
+	} {
+		if byDest[dest].ContentEncoding != encoding {
+			t.Fatalf("%v: content encoding %q != %q", dest, byDest[dest].ContentEncoding, encoding)
+		}
+	}
+
+	if byDest["enc/report.html"].ContentType() != "text/html; charset=utf-8" {
+		t.Fatalf("unexpected content type %v", byDest["enc/report.html"].ContentType())
+	}
+
+	s3p := newS3Provider(u.Opts, getPanicLogger())
+	headers, err := s3p.objectHeaders(u.Opts, byDest["enc/report.html"])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(headers["Content-Encoding"], []string{"gzip"}) {
+		t.Fatalf("content encoding header %v != [gzip]", headers["Content-Encoding"])
+	}
+
+	headers, _ = s3p.objectHeaders(u.Opts, byDest["enc/plain.txt"])
+	if _, ok := headers["Content-Encoding"]; ok {
+		t.Fatalf("plain file got a content encoding header")
+	}
+}
+
+func TestUploaderContentEncodingKeepExt(t *testing.T) {
+	dir := writeContentEncodingFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, contentEncodingOpts(dir, true))
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byDest := uploadedByDest(rp)
+	if byDest["enc/report.html.gz"] == nil || byDest["enc/report.html.gz"].ContentEncoding != "gzip" {
+		t.Fatalf("unexpected dests: %v", rp.FullDests())
+	}
+}
@@ -0,0 +1,130 @@
+package upload
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// contentTypeRule gives the artifacts matching a glob a content type
+type contentTypeRule struct {
+	Pattern     string
+	ContentType string
+}
+
+// contentTypesByExt normalizes the --content-type extensions to the
+// lowercase, dotted form that artifacts look them up by
+func contentTypesByExt(contentTypes map[string]string) map[string]string {
+	if len(contentTypes) == 0 {
+		return nil
+	}
+
+	byExt := map[string]string{}
+	for ext, ctype := range contentTypes {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		byExt[ext] = ctype
+	}
+	return byExt
+}
+
+func validateContentTypes(contentTypes map[string]string) error {
+	exts := []string{}
+	for ext := range contentTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		ctype := contentTypes[ext]
+		if strings.Trim(ext, ".") == "" || strings.ContainsAny(ext, "/\\") || ctype == "" {
+			return fmt.Errorf("invalid --content-type %q, expected ext=type", ext+"="+ctype)
+		}
+
+		if _, _, err := mime.ParseMediaType(ctype); err != nil {
+			return fmt.Errorf("invalid --content-type %q: %v", ext+"="+ctype, err)
+		}
+	}
+
+	return nil
+}
+
+// loadContentTypes reads one mapping per line, as an extension or a glob
+// (matched against the path relative to the working dir) followed by a
+// content type, skipping blank lines and lines starting with "#", e.g.:
+//
+//	.har            application/json
+//	dist/*.map      application/json
+//	reports/**.txt  text/plain; charset=utf-8
+//
+// Extensions are returned the way --content-type gives them, and globs as
+// rules in the order of the file.
+func loadContentTypes(filename string) (map[string]string, []*contentTypeRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer f.Close()
+
+	byExt := map[string]string{}
+	rules := []*contentTypeRule{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: %q has no content type", filename, lineno, line)
+		}
+
+		pattern, ctype := strings.TrimPrefix(line[:i], "./"), strings.TrimSpace(line[i:])
+		if _, _, err := mime.ParseMediaType(ctype); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: invalid content type %q: %v", filename, lineno, ctype, err)
+		}
+
+		if strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "/\\*?[") {
+			byExt[pattern] = ctype
+			continue
+		}
+		rules = append(rules, &contentTypeRule{Pattern: pattern, ContentType: ctype})
+	}
+
+	return byExt, rules, scanner.Err()
+}
+
+// applyContentTypeRules gives the artifact the content type of the last
+// --content-types-from glob it matches, over --content-type and detection.
+// Header rules still win over it.  Stdin is matched by its dest.
+func (u *uploader) applyContentTypeRules(a *artifact.Artifact, relPath string) {
+	if relPath == stdinPath {
+		relPath = a.Dest
+	}
+
+	for _, r := range u.contentTypeRules {
+		if matchGlob(r.Pattern, relPath) {
+			a.SetContentType(r.ContentType)
+		}
+	}
+}
+
+func (opts *Options) validateDefaultContentType() error {
+	if opts.DefaultContentType == "" {
+		return nil
+	}
+
+	if _, _, err := mime.ParseMediaType(opts.DefaultContentType); err != nil {
+		return fmt.Errorf("invalid --default-content-type %q: %v", opts.DefaultContentType, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeContentTypesFile(t *testing.T, dir, content string) string {
+	filename := filepath.Join(dir, "content-types.txt")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return filename
+}
+
+func TestLoadContentTypes(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	byExt, rules, err := loadContentTypes(writeContentTypesFile(t, dir, `
+# extensions, then globs
+.log          text/plain; charset=utf-8
+./dist/*.map  application/json
+reports/**    text/html; charset=utf-8
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(byExt, map[string]string{".log": "text/plain; charset=utf-8"}) {
+		t.Fatalf("unexpected extensions: %v", byExt)
+	}
+	if len(rules) != 2 || rules[0].Pattern != "dist/*.map" || rules[1].ContentType != "text/html; charset=utf-8" {
+		t.Fatalf("unexpected rules: %#v", rules)
+	}
+
+	for content, msg := range map[string]string{
+		".log":            "has no content type",
+		"*.log /":         "invalid content type",
+		"\n\n.txt a/b; x": "content-types.txt:3:",
+	} {
+		_, _, err := loadContentTypes(writeContentTypesFile(t, dir, content))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("error for %q does not contain %q: %v", content, msg, err)
+		}
+	}
+}
+
+func TestUploaderContentTypesFrom(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/app.js.map":     "{}",
+		"out/build.log":      "<html>not really</html>",
+		"out/notes.log":      "notes",
+		"out/core.dump":      "\x00\x01\x02\x03",
+		"out/reports/a.html": "<html></html>",
+		"out/reports/b.txt":  "b",
+	})
+	defer os.RemoveAll(dir)
+
+	contentTypesFile := writeContentTypesFile(t, dir, `
+.log          text/x-log
+**/*.map      application/x-map
+out/reports/  text/html; charset=utf-8
+`)
+	headerRulesFile := writeHeaderRulesFile(t, dir, "out/notes.log Content-Type: text/markdown\n")
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"ct"}
+		opts.ContentTypes = map[string]string{"log": "text/plain; charset=utf-8"}
+		opts.ContentTypesFrom = contentTypesFile
+		opts.HeaderRulesFrom = headerRulesFile
+		opts.DefaultContentType = "application/x-unknown"
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actual := map[string]string{}
+	for _, a := range rp.Uploaded {
+		actual[a.FullDest()] = a.ContentType()
+	}
+
+	expected := map[string]string{
+		"ct/out/app.js.map":     "application/x-map",
+		"ct/out/build.log":      "text/plain; charset=utf-8",
+		"ct/out/notes.log":      "text/markdown",
+		"ct/out/core.dump":      "application/x-unknown",
+		"ct/out/reports/a.html": "text/html; charset=utf-8",
+		"ct/out/reports/b.txt":  "text/html; charset=utf-8",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("content types %v != %v", actual, expected)
+	}
+}
+
+func TestValidateContentTypesFrom(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.ContentTypesFrom = writeContentTypesFile(t, dir, "*.log\n")
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "content types file cannot be loaded") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts = NewOptions()
+	opts.BucketName = "foo"
+	opts.DefaultContentType = "nope/"
+
+	err = opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid --default-content-type") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
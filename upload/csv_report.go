@@ -0,0 +1,87 @@
+package upload
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var (
+	csvReportHeader = []string{"path", "key", "url", "size", "content-type", "status", "error"}
+)
+
+// writeCSVReport writes one row per artifact with the outcome of its
+// upload, including failed ones
+func writeCSVReport(filename string, artifacts []*artifact.Artifact) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	err = w.Write(csvReportHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range artifacts {
+		err = w.Write(csvReportRow(a))
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func csvReportRow(a *artifact.Artifact) []string {
+	size, _ := a.Size()
+	status, errString := uploadStatus(a)
+
+	return []string{
+		a.Source,
+		a.FullDest(),
+		a.UploadResult.URL,
+		fmt.Sprintf("%d", size),
+		a.ContentType(),
+		status,
+		errString,
+	}
+}
+
+// uploadStatus describes the outcome of the artifact's upload for reports
+func uploadStatus(a *artifact.Artifact) (string, string) {
+	status := "failed"
+	errString := ""
+
+	if a.UploadResult.OK {
+		status = "uploaded"
+	}
+
+	if a.UploadResult.OK && a.AliasOf != "" {
+		status = "aliased"
+	}
+
+	if a.UploadResult.Err == errGCSPreconditionFailed {
+		status = "conflict"
+	}
+
+	if isCanceled(a.UploadResult.Err) {
+		status = "canceled"
+	}
+
+	if a.UploadResult.Err != nil {
+		errString = a.UploadResult.Err.Error()
+	}
+
+	return status, errString
+}
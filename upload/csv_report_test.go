@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func readCSVReport(t *testing.T, filename string) [][]string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("csv report not written: %v", err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("csv report could not be parsed: %v", err)
+	}
+
+	return records
+}
+
+func TestWriteCSVReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ok := artifact.NewFromBytes("t1", `a,b "quoted".txt`, []byte("hello"), &artifact.Options{})
+	ok.UploadResult.OK = true
+	ok.UploadResult.URL = "https://s3.amazonaws.com/bucket/t1/a,b \"quoted\".txt"
+
+	bad := artifact.NewFromBytes("t1", "bad.txt", []byte("nope"), &artifact.Options{})
+	bad.UploadResult.Err = errors.New("it broke, \"badly\"\non two lines")
+
+	filename := filepath.Join(dir, "report.csv")
+	err = writeCSVReport(filename, []*artifact.Artifact{ok, bad})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	raw, _ := ioutil.ReadFile(filename)
+	if !strings.HasPrefix(string(raw), "path,key,url,size,content-type,status,error\n") {
+		t.Fatalf("unexpected header row: %q", raw)
+	}
+
+	if !strings.Contains(string(raw), `"t1/a,b ""quoted"".txt"`) {
+		t.Fatalf("key was not escaped: %q", raw)
+	}
+
+	records := readCSVReport(t, filename)
+	if len(records) != 3 {
+		t.Fatalf("records %v != 3: %v", len(records), records)
+	}
+
+	expected := []string{"", `t1/a,b "quoted".txt`, ok.UploadResult.URL, "5", "text/plain; charset=utf-8", "uploaded", ""}
+	if !reflect.DeepEqual(records[1], expected) {
+		t.Fatalf("row %#v != %#v", records[1], expected)
+	}
+
+	if records[2][5] != "failed" || records[2][6] != bad.UploadResult.Err.Error() {
+		t.Fatalf("unexpected failure row: %#v", records[2])
+	}
+}
+
+func TestUploaderOutputCSVOnPartialFailure(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Paths = []string{dir}
+	opts.TargetPaths = []string{"t1"}
+	opts.OutputCSV = filepath.Join(dir, "report.csv")
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{
+		FailSources: map[string]bool{filepath.Join(dir, "b.txt"): true},
+	}
+
+	u.Upload()
+
+	statuses := map[string]string{}
+	for _, record := range readCSVReport(t, opts.OutputCSV)[1:] {
+		statuses[filepath.Base(record[0])] = record[5]
+	}
+
+	expected := map[string]string{"a.txt": "uploaded", "b.txt": "failed"}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("statuses %v != %v", statuses, expected)
+	}
+}
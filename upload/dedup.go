@@ -0,0 +1,290 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// s3MaxCopySize is the largest object that s3 copies in a single request
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// dedupModes are the values of --dedup, where "" uploads every artifact
+var dedupModes = map[string]bool{
+	"":      true,
+	"alias": true,
+	"copy":  true,
+}
+
+// duplicate is an artifact held back by --dedup, along with the artifact
+// with the same content that was uploaded first
+type duplicate struct {
+	a     *artifact.Artifact
+	first *artifact.Artifact
+}
+
+func (opts *Options) validateDedup() error {
+	if !dedupModes[opts.Dedup] {
+		return fmt.Errorf("unknown --dedup %q (expected alias or copy)", opts.Dedup)
+	}
+
+	if opts.Dedup == "alias" && opts.OutputManifest == "" && opts.ManifestKey == "" {
+		return fmt.Errorf("--dedup alias requires --output-manifest or --manifest-key")
+	}
+
+	if opts.Dedup == "copy" && opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--dedup copy requires the s3 provider")
+	}
+
+	// the copy would need the key again to read the object it copies
+	if opts.Dedup == "copy" && opts.SSECustomerKey != "" {
+		return fmt.Errorf("--dedup copy cannot be used with --sse-c-key")
+	}
+
+	return nil
+}
+
+// dedupFilter holds back each artifact with the same content as one that
+// already went by when --dedup is set, for finishDuplicates to alias or
+// copy once the uploads are done
+func (u *uploader) dedupFilter(in chan *artifact.Artifact) chan *artifact.Artifact {
+	if u.Opts.Dedup == "" || u.Opts.DryRun {
+		return in
+	}
+
+	out := make(chan *artifact.Artifact)
+
+	go func() {
+		defer close(out)
+
+		firsts := map[string]*artifact.Artifact{}
+		for a := range in {
+			key, ok := dedupKey(u.Opts, a)
+			if !ok {
+				out <- a
+				continue
+			}
+
+			if first, seen := firsts[key]; seen {
+				u.log.WithFields(logrus.Fields{
+					"key":   a.FullDest(),
+					"first": first.FullDest(),
+				}).Debug("holding back duplicate")
+				u.duplicates = append(u.duplicates, &duplicate{a: a, first: first})
+				continue
+			}
+
+			firsts[key] = a
+			out <- a
+		}
+	}()
+
+	return out
+}
+
+// dedupKey is what an artifact shares with the others it duplicates: its
+// content, and for --dedup alias its target path, since an alias doesn't
+// put an object under the target path that it is listed in.  Empty and
+// streamed artifacts are never duplicates.
+func dedupKey(opts *Options, a *artifact.Artifact) (string, bool) {
+	if a.IsStream() {
+		return "", false
+	}
+
+	size, err := a.Size()
+	if err != nil || size == 0 {
+		return "", false
+	}
+
+	sum, err := a.SHA256()
+	if err != nil {
+		return "", false
+	}
+
+	if opts.Dedup == "alias" {
+		return a.Prefix + "\x00" + sum, true
+	}
+	return sum, true
+}
+
+// finishDuplicates aliases or copies the artifacts held back by
+// dedupFilter, or fails them if what they duplicate failed to upload,
+// returning the ones that failed.  Providers that can't copy, such as
+// routes to other providers, upload the duplicates instead.
+func (u *uploader) finishDuplicates(ctx context.Context) []*artifact.Artifact {
+	failed := []*artifact.Artifact{}
+	uploads := []*artifact.Artifact{}
+	copier, canCopy := u.Provider.(objectCopier)
+	deduplicated, saved := 0, uint64(0)
+
+	for _, d := range u.duplicates {
+		a := d.a
+
+		if !d.first.UploadResult.OK {
+			a.UploadResult.Err = fmt.Errorf("not deduplicated, since %s failed to upload", d.first.FullDest())
+			if isCanceled(d.first.UploadResult.Err) {
+				a.UploadResult.Err = d.first.UploadResult.Err
+			}
+			u.results = append(u.results, a)
+			failed = append(failed, a)
+			continue
+		}
+
+		size, _ := a.Size()
+
+		if u.Opts.Dedup == "alias" {
+			a.AliasOf = d.first.FullDest()
+			a.UploadResult.OK = true
+			a.UploadResult.URL = d.first.UploadResult.URL
+			u.aliases = append(u.aliases, a)
+			deduplicated++
+			saved += size
+			continue
+		}
+
+		if !canCopy {
+			uploads = append(uploads, a)
+			continue
+		}
+
+		start := time.Now()
+		err := copier.CopyObject(ctx, u.Opts, a, d.first.FullDest())
+		a.UploadResult.Duration = time.Since(start)
+		a.UploadResult.OK = err == nil
+		a.UploadResult.Err = err
+
+		u.results = append(u.results, a)
+		if err != nil {
+			failed = append(failed, a)
+			continue
+		}
+		deduplicated++
+		saved += size
+	}
+
+	if len(uploads) > 0 {
+		u.log.WithField("provider", u.Provider.Name()).Warn(
+			fmt.Sprintf("provider cannot copy objects, uploading %d duplicates", len(uploads)))
+		failed = append(failed, u.uploadExtra(uploads)...)
+	}
+
+	if deduplicated > 0 {
+		u.log.WithFields(logrus.Fields{
+			"duplicates": len(u.duplicates),
+			"saved":      humanize.Bytes(saved),
+		}).Info(fmt.Sprintf("deduplicated %d artifacts (--dedup %s)", deduplicated, u.Opts.Dedup))
+	}
+
+	sortArtifacts(u.results)
+	sortArtifacts(u.aliases)
+	return failed
+}
+
+// manifestResults are the results along with the --dedup alias artifacts,
+// which are only listed in manifests
+func (u *uploader) manifestResults() []*artifact.Artifact {
+	if len(u.aliases) == 0 {
+		return u.results
+	}
+
+	listed := append(append([]*artifact.Artifact{}, u.results...), u.aliases...)
+	sortArtifacts(listed)
+	return listed
+}
+
+// CopyObject copies the object at sourceKey to the artifact's key with the
+// artifact's own headers, retrying like an upload.  Artifacts too large
+// to copy in one request are uploaded instead.
+func (s3p *s3Provider) CopyObject(ctx context.Context, opts *Options, a *artifact.Artifact, sourceKey string) error {
+	auth, err := s3p.getAuth(opts.AccessKey, opts.SecretKey)
+	if err != nil {
+		return err
+	}
+
+	conn := s3p.getConn(auth)
+	b := conn.Bucket(opts.BucketName)
+
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	if size > s3MaxCopySize {
+		return s3p.uploadFile(ctx, opts, b, a)
+	}
+
+	retries := uint64(0)
+	for {
+		a.UploadResult.Attempts++
+		err := s3p.rawCopy(opts, b, a, sourceKey)
+		if err == nil {
+			break
+		}
+		if retryable(err) && retries < opts.Retries && !opts.pastRetryDeadline() && ctx.Err() == nil {
+			retries++
+			sleep := opts.retryBackoff(s3p.RetryInterval, retries)
+			s3p.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying copy")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+			continue
+		}
+		return err
+	}
+
+	if opts.SignedURLs {
+		s3p.signURL(conn, opts, a, time.Now())
+	}
+	return nil
+}
+
+func (s3p *s3Provider) rawCopy(opts *Options, b *s3.Bucket, a *artifact.Artifact, sourceKey string) error {
+	dest := a.FullDest()
+	a.UploadResult.URL = s3ObjectURL(s3p.getRegion(), b.Name, dest)
+
+	s3p.log.WithFields(logrus.Fields{
+		"download_url": a.UploadResult.URL,
+		"copy_source":  sourceKey,
+	}).Info(fmt.Sprintf("copying: %s", a.Source))
+
+	return s3p.putCopy(opts, b, a, sourceKey)
+}
+
+// putCopy copies the source key to the artifact's key with a server-side
+// copy, with the artifact's headers rather than those of the source
+func (s3p *s3Provider) putCopy(opts *Options, b *s3.Bucket, a *artifact.Artifact, sourceKey string) error {
+	dest := a.FullDest()
+	headers, err := s3p.objectHeaders(opts, a)
+	if err != nil {
+		return err
+	}
+
+	checksums, err := checksumHeaders(opts, a, false)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range checksums {
+		headers[key] = value
+	}
+
+	headers["Content-Type"] = []string{a.ContentType()}
+	headers["x-amz-copy-source"] = []string{(&url.URL{Path: "/" + b.Name + "/" + sourceKey}).EscapedPath()}
+	// the copy gets the artifact's headers rather than those of the source
+	headers["x-amz-metadata-directive"] = []string{"REPLACE"}
+
+	return b.PutReaderHeader(dest, bytes.NewReader(nil), 0, headers, a.Perm)
+}
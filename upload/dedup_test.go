@@ -0,0 +1,212 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func writeDedupFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"out/a/vendor.js":  "same",
+		"out/b/vendor.js":  "same",
+		"out/c/copy.txt":   "same",
+		"out/other.txt":    "other",
+		"out/empty-1.txt":  "",
+		"out/empty-2.txt":  "",
+		"out/fixtures.txt": "other",
+	})
+}
+
+func TestUploaderDedupAlias(t *testing.T) {
+	os.Clearenv()
+	dir := writeDedupFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"one", "two"}
+		opts.Dedup = "alias"
+		opts.OutputManifest = filepath.Join(dir, "manifest.json")
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := rp.FullDests()
+	sort.Strings(keys)
+	expected := []string{
+		"one/out/a/vendor.js", "one/out/empty-1.txt", "one/out/empty-2.txt", "one/out/fixtures.txt",
+		"two/out/a/vendor.js", "two/out/empty-1.txt", "two/out/empty-2.txt", "two/out/fixtures.txt",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("uploaded %v != %v", keys, expected)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	aliases := map[string]string{}
+	for _, entry := range m.Artifacts {
+		if entry.Status == "aliased" {
+			aliases[entry.Key] = entry.AliasOf
+		}
+	}
+
+	expectedAliases := map[string]string{
+		"one/out/b/vendor.js": "one/out/a/vendor.js",
+		"one/out/c/copy.txt":  "one/out/a/vendor.js",
+		"one/out/other.txt":   "one/out/fixtures.txt",
+		"two/out/b/vendor.js": "two/out/a/vendor.js",
+		"two/out/c/copy.txt":  "two/out/a/vendor.js",
+		"two/out/other.txt":   "two/out/fixtures.txt",
+	}
+	if !reflect.DeepEqual(aliases, expectedAliases) || len(m.Artifacts) != 14 {
+		t.Fatalf("manifest aliases %v != %v in %s", aliases, expectedAliases, b)
+	}
+}
+
+func TestUploaderDedupAliasFailed(t *testing.T) {
+	os.Clearenv()
+	// a single path, so that the order the artifacts go by is the walk's
+	dir := writeTestFiles(t, map[string]string{
+		"out/a/vendor.js": "same",
+		"out/b/vendor.js": "same",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"one"}
+		opts.Dedup = "alias"
+		opts.OutputManifest = filepath.Join(dir, "manifest.json")
+	})
+	u.Provider.(*nullProvider).SourcesToFail = []string{filepath.Join(dir, "out/a/vendor.js")}
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.OK || a.AliasOf != "" {
+			t.Fatalf("%s was uploaded or aliased when what it duplicates failed", a.FullDest())
+		}
+	}
+	if len(u.results) != 2 {
+		t.Fatalf("results %v != 2", len(u.results))
+	}
+}
+
+func TestUploaderDedupCopy(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a/vendor.js": "same",
+		"out/c/copy.txt":  "same",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"one", "two"}
+		opts.Dedup = "copy"
+		opts.Concurrency = 1
+	})
+	u.Provider.(*s3Provider).overrideConn = s3.New(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"},
+		aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(reqs)
+
+	puts, copies := []string{}, map[string]string{}
+	for req := range reqs {
+		if source := req.Header.Get("X-Amz-Copy-Source"); source != "" {
+			if req.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+				t.Fatalf("copy kept the source's headers: %v", req.Header)
+			}
+			copies[req.URL.Path] = source
+			continue
+		}
+		puts = append(puts, req.URL.Path)
+	}
+
+	if !reflect.DeepEqual(puts, []string{"/bucket/one/out/a/vendor.js"}) {
+		t.Fatalf("puts %v != [/bucket/one/out/a/vendor.js]", puts)
+	}
+
+	expected := map[string]string{
+		"/bucket/one/out/c/copy.txt":  "/bucket/one/out/a/vendor.js",
+		"/bucket/two/out/a/vendor.js": "/bucket/one/out/a/vendor.js",
+		"/bucket/two/out/c/copy.txt":  "/bucket/one/out/a/vendor.js",
+	}
+	if !reflect.DeepEqual(copies, expected) {
+		t.Fatalf("copies %v != %v", copies, expected)
+	}
+
+	for _, a := range u.results {
+		if !a.UploadResult.OK || !strings.HasSuffix(a.UploadResult.URL, a.FullDest()) {
+			t.Fatalf("%s result %#v", a.FullDest(), a.UploadResult)
+		}
+	}
+}
+
+func TestValidateDedup(t *testing.T) {
+	for _, tc := range []struct {
+		configure func(*Options)
+		msg       string
+	}{
+		{func(opts *Options) { opts.Dedup = "hardlink" }, "unknown --dedup"},
+		{func(opts *Options) { opts.Dedup = "alias" }, "requires --output-manifest"},
+		{func(opts *Options) { opts.Dedup = "copy"; opts.Provider = "gcs" }, "requires the s3 provider"},
+		{func(opts *Options) {
+			opts.Dedup = "copy"
+			opts.SSECustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+		}, "--sse-c-key"},
+	} {
+		opts := NewOptions()
+		opts.BucketName = "foo"
+		tc.configure(opts)
+
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%v: unexpected error: %v", tc.msg, err)
+		}
+	}
+
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.Provider = "null"
+	opts.Dedup = "alias"
+	opts.ManifestKey = "manifest.json"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
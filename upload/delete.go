@@ -0,0 +1,219 @@
+package upload
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// s3DeleteBatchSize is the most keys that s3 deletes in one request
+const s3DeleteBatchSize = 1000
+
+// DeleteOptions are the objects for Delete to remove
+type DeleteOptions struct {
+	// Keys are object keys, or prefixes with Recursive
+	Keys []string
+	// Recursive deletes every object under each of the keys, as a prefix
+	Recursive bool
+	// Force deletes under prefixes without asking first
+	Force bool
+}
+
+// DeleteResult counts what Delete did, or with --dry-run, what it would
+// have done
+type DeleteResult struct {
+	Deleted int
+	Missing int
+	Bytes   uint64
+	DryRun  bool
+}
+
+// batchDeleter is implemented by the providers that can delete many
+// objects in one request
+type batchDeleter interface {
+	DeleteRemoteBatch(keys []string) error
+}
+
+// Delete removes the objects at the keys, or with Recursive, under them.
+// Deleting under a prefix needs Force, or else a yes to the question on a
+// terminal.  With --dry-run, what would be deleted is only logged.
+func Delete(opts *Options, delOpts *DeleteOptions, log *logrus.Logger) (*DeleteResult, error) {
+	return newUploader(opts, log).delete(delOpts)
+}
+
+func (u *uploader) delete(delOpts *DeleteOptions) (*DeleteResult, error) {
+	result := &DeleteResult{DryRun: u.Opts.DryRun}
+
+	lp, canList := u.Provider.(ObjectLister)
+	dp, canDelete := u.Provider.(ObjectDeleter)
+	if !canList || !canDelete {
+		return result, fmt.Errorf("delete is not supported by the %s provider", u.Provider.Name())
+	}
+
+	if len(delOpts.Keys) == 0 {
+		return result, fmt.Errorf("delete needs at least one key")
+	}
+
+	keys := []string{}
+	for _, arg := range delOpts.Keys {
+		target, found, err := u.deleteTargets(lp, arg, delOpts)
+		if err != nil {
+			return result, err
+		}
+
+		if len(found) == 0 {
+			u.log.WithField("key", target).Warn("nothing to delete")
+			result.Missing++
+			continue
+		}
+
+		if delOpts.Recursive && !u.Opts.DryRun && !delOpts.Force {
+			if err := u.confirmDelete(target, found); err != nil {
+				return result, err
+			}
+		}
+
+		for _, obj := range found {
+			keys = append(keys, obj.Key)
+			result.Bytes += uint64(obj.Size)
+		}
+	}
+
+	for _, key := range keys {
+		if u.Opts.DryRun {
+			u.log.WithField("key", key).Info("would delete (dry run)")
+		} else {
+			u.log.WithField("key", key).Debug("deleting")
+		}
+	}
+
+	if !u.Opts.DryRun {
+		if err := deleteKeys(dp, keys); err != nil {
+			return result, err
+		}
+	}
+
+	result.Deleted = len(keys)
+	return result, nil
+}
+
+// deleteTargets lists the objects that the key stands for, along with
+// the key or prefix they were listed by: the object at it, or with
+// --recursive every object under it as a directory
+func (u *uploader) deleteTargets(lp ObjectLister, key string, delOpts *DeleteOptions) (string, []*RemoteObject, error) {
+	key = strings.TrimLeft(key, "/")
+
+	if !delOpts.Recursive {
+		if key == "" || strings.HasSuffix(key, "/") {
+			return key, nil, fmt.Errorf("%q is a prefix, delete everything under it with --recursive", key)
+		}
+
+		objects, _, err := lp.ListRemote(key, false)
+		if err != nil {
+			return key, nil, err
+		}
+		for _, obj := range objects {
+			if obj.Key == key {
+				return key, []*RemoteObject{obj}, nil
+			}
+		}
+		return key, nil, nil
+	}
+
+	// the prefix is a directory, so that builds/1 doesn't take builds/10
+	// along with it
+	if strings.TrimRight(key, "/") == "" {
+		return key, nil, fmt.Errorf("refusing to delete everything in the bucket, give a prefix")
+	}
+	prefix := strings.TrimRight(key, "/") + "/"
+
+	objects, _, err := lp.ListRemote(prefix, true)
+	return prefix, objects, err
+}
+
+// confirmDelete asks on the terminal before deleting under a prefix, and
+// fails without one
+func (u *uploader) confirmDelete(prefix string, objects []*RemoteObject) error {
+	if f, ok := u.stdin.(*os.File); !u.terminal || (ok && !isTerminal(f)) {
+		return fmt.Errorf("deleting under %q needs --force when not run from a terminal", prefix)
+	}
+
+	size := uint64(0)
+	for _, obj := range objects {
+		size += uint64(obj.Size)
+	}
+
+	fmt.Fprintf(u.stderr, "delete %d objects (%s) under %s? [y/N] ", len(objects), humanize.Bytes(size), prefix)
+	answer, err := bufio.NewReader(u.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not deleting under %q", prefix)
+}
+
+// deleteKeys deletes in batches where the provider can, and one at a time
+// otherwise
+func deleteKeys(dp ObjectDeleter, keys []string) error {
+	if bd, ok := dp.(batchDeleter); ok {
+		return bd.DeleteRemoteBatch(keys)
+	}
+
+	for _, key := range keys {
+		if err := dp.DeleteRemote(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRemoteBatch deletes up to 1000 keys a request with s3's multi-
+// object delete, falling back to one at a time for stores that don't
+// have it
+func (s3p *s3Provider) DeleteRemoteBatch(keys []string) error {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += s3DeleteBatchSize {
+		end := start + s3DeleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		err := bucket.MultiDel(keys[start:end])
+		var s3Err *s3.Error
+		if errors.As(err, &s3Err) && multiDelUnsupported(s3Err.StatusCode) {
+			s3p.log.WithField("err", err).Debug("multi-object delete not supported, deleting one at a time")
+			for _, key := range keys[start:] {
+				if err := bucket.Del(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func multiDelUnsupported(status int) bool {
+	return status == http.StatusBadRequest || status == http.StatusMethodNotAllowed ||
+		status == http.StatusNotImplemented
+}
@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func putDeleteTestObjects(t *testing.T, b *s3.Bucket, keys ...string) {
+	for _, key := range keys {
+		if err := b.Put(key, []byte("content"), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func deleteTestKeys(t *testing.T, b *s3.Bucket, prefix string) []string {
+	keys := []string{}
+	marker := ""
+	for {
+		resp, err := b.List(prefix, "", marker, 1000)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, key := range resp.Contents {
+			keys = append(keys, key.Key)
+			marker = key.Key
+		}
+		if !resp.IsTruncated {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDelete(t *testing.T) {
+	os.Clearenv()
+	b := testS3.Bucket("bucket")
+	putDeleteTestObjects(t, b,
+		"delete-test/1/app.tar.gz",
+		"delete-test/1/logs/test.log",
+		"delete-test/10/app.tar.gz",
+		"delete-test/2/app.tar.gz",
+		"delete-test/2/build.log",
+	)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+	})
+
+	result, err := u.delete(&DeleteOptions{Keys: []string{"delete-test/2/build.log", "delete-test/2/nope.log"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Deleted != 1 || result.Missing != 1 || result.Bytes != 7 {
+		t.Fatalf("unexpected result %#v", result)
+	}
+
+	if _, err := u.delete(&DeleteOptions{Keys: []string{"delete-test/1/"}}); err == nil ||
+		!strings.Contains(err.Error(), "with --recursive") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// not from a terminal, a prefix needs --force
+	u.terminal = false
+	if _, err := u.delete(&DeleteOptions{Keys: []string{"delete-test/1"}, Recursive: true}); err == nil ||
+		!strings.Contains(err.Error(), "needs --force") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u.terminal = true
+	u.stderr = &strings.Builder{}
+	u.stdin = strings.NewReader("n\n")
+	if _, err := u.delete(&DeleteOptions{Keys: []string{"delete-test/1"}, Recursive: true}); err == nil ||
+		!strings.Contains(err.Error(), "not deleting") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := deleteTestKeys(t, b, "delete-test/1"); len(keys) != 3 {
+		t.Fatalf("deleted without a yes: %v", keys)
+	}
+
+	u.Opts.DryRun = true
+	result, err = u.delete(&DeleteOptions{Keys: []string{"delete-test/1"}, Recursive: true})
+	if err != nil || !result.DryRun || result.Deleted != 2 {
+		t.Fatalf("dry run %#v: %v", result, err)
+	}
+	if keys := deleteTestKeys(t, b, "delete-test/1"); len(keys) != 3 {
+		t.Fatalf("dry run deleted objects: %v", keys)
+	}
+
+	u.Opts.DryRun = false
+	u.stdin = strings.NewReader("yes\n")
+	result, err = u.delete(&DeleteOptions{Keys: []string{"/delete-test/1/"}, Recursive: true})
+	if err != nil || result.Deleted != 2 {
+		t.Fatalf("delete %#v: %v", result, err)
+	}
+	if !strings.Contains(u.stderr.(*strings.Builder).String(), "delete 2 objects (14B) under delete-test/1/?") {
+		t.Fatalf("unexpected prompt %q", u.stderr)
+	}
+
+	keys := deleteTestKeys(t, b, "delete-test/1")
+	if strings.Join(keys, " ") != "delete-test/10/app.tar.gz" {
+		t.Fatalf("unexpected remaining objects %v", keys)
+	}
+
+	if _, err := u.delete(&DeleteOptions{Keys: []string{"/"}, Recursive: true, Force: true}); err == nil ||
+		!strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDeleteManyObjects(t *testing.T) {
+	os.Clearenv()
+	b := testS3.Bucket("bucket")
+	for i := 0; i < s3DeleteBatchSize+1; i++ {
+		putDeleteTestObjects(t, b, fmt.Sprintf("delete-test/many/%04d", i))
+	}
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+	})
+
+	result, err := u.delete(&DeleteOptions{Keys: []string{"delete-test/many"}, Recursive: true, Force: true})
+	if err != nil || result.Deleted != s3DeleteBatchSize+1 {
+		t.Fatalf("delete %#v: %v", result, err)
+	}
+	if keys := deleteTestKeys(t, b, "delete-test/many/"); len(keys) != 0 {
+		t.Fatalf("%d objects left", len(keys))
+	}
+}
+
+func TestDeleteRequiresDeletion(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	_, err := newUploader(opts, getPanicLogger()).delete(&DeleteOptions{Keys: []string{"a"}})
+	if err == nil || err.Error() != "delete is not supported by the null provider" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
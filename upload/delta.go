@@ -0,0 +1,507 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// deltaManifestSuffix is added to the key of a file uploaded with
+	// --delta for its patch manifest, which stands in for the object
+	deltaManifestSuffix = ".delta.json"
+	// deltaBlocksSuffix is added to the key for the prefix that its
+	// blocks are stored under, each keyed by its sha256
+	deltaBlocksSuffix = ".delta/"
+
+	deltaFormat = "artifacts-delta/1"
+)
+
+// deltaManifest is the patch manifest of a file uploaded with --delta: its
+// blocks in order, which are also the signature that the next upload
+// compares the file with
+type deltaManifest struct {
+	Format    string   `json:"format"`
+	Size      uint64   `json:"size"`
+	SHA256    string   `json:"sha256"`
+	BlockSize uint64   `json:"block_size"`
+	Blocks    []string `json:"blocks"`
+}
+
+func (opts *Options) validateDelta() error {
+	if !opts.Delta {
+		return nil
+	}
+
+	if opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--delta requires the s3 provider")
+	}
+
+	if opts.DeltaBlockSize == 0 {
+		return fmt.Errorf("--delta-block-size must be more than 0")
+	}
+
+	// these look for the object at the file's key, which is only the
+	// manifest's prefix with --delta
+	for _, conflict := range []struct {
+		flag string
+		set  bool
+	}{
+		{"dedup copy", opts.Dedup == "copy"},
+		{"skip-unchanged", opts.SkipUnchanged},
+		{"sync", opts.Sync},
+		{"verify-headers", opts.VerifyHeaders != "off" && opts.VerifyHeaders != ""},
+		{"fail-if-grew", opts.FailIfGrew},
+		{"routes-from", opts.RoutesFrom != ""},
+		{"sse-c-key", opts.SSECustomerKey != ""},
+	} {
+		if conflict.set {
+			return fmt.Errorf("--delta cannot be used with --%s", conflict.flag)
+		}
+	}
+
+	return nil
+}
+
+// deltaApplies reports whether the artifact is uploaded as blocks with
+// --delta, which are the files of at least --delta-min-size that can be
+// read more than once and aren't encoded
+func (opts *Options) deltaApplies(a *artifact.Artifact) bool {
+	if !opts.Delta || a.IsStream() || a.ContentEncoding != "" || a.RedirectLocation != "" {
+		return false
+	}
+
+	size, err := a.Size()
+	return err == nil && size > 0 && size >= opts.DeltaMinSize
+}
+
+// deltaSignature reads the artifact once to checksum each of its blocks,
+// and the whole of it
+func deltaSignature(a *artifact.Artifact, blockSize uint64) (*deltaManifest, error) {
+	r, err := a.Reader()
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	m := &deltaManifest{Format: deltaFormat, BlockSize: blockSize, Blocks: []string{}}
+	whole := sha256.New()
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			m.Blocks = append(m.Blocks, hex.EncodeToString(sum[:]))
+			whole.Write(buf[:n])
+			m.Size += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return m, nil
+}
+
+// decodeDeltaManifest reads a patch manifest, failing on anything that was
+// not written by --delta
+func decodeDeltaManifest(r io.Reader) (*deltaManifest, error) {
+	m := &deltaManifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Format != deltaFormat {
+		return nil, fmt.Errorf("unknown delta manifest format %q", m.Format)
+	}
+	return m, nil
+}
+
+// fetchDeltaManifest gets the patch manifest stored at the key, which is
+// nil without an error if there is none
+func fetchDeltaManifest(dp downloadProvider, key string) (*deltaManifest, error) {
+	body, err := dp.getObject(key)
+	if err != nil {
+		var s3Err *s3.Error
+		if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	defer body.Close()
+	return decodeDeltaManifest(body)
+}
+
+// deltaProvider uploads the artifacts that --delta applies to as the
+// blocks that their last patch manifest doesn't have, then the new patch
+// manifest, handing each to the provider it wraps like any other artifact.
+// The manifest goes last, so that its blocks are all there by the time it
+// is, and a failed block fails the artifact with its manifest unchanged.
+// Other artifacts are passed along as they are.
+type deltaProvider struct {
+	opts *Options
+	log  *logrus.Logger
+
+	inner Provider
+	dp    downloadProvider
+}
+
+func newDeltaProvider(opts *Options, log *logrus.Logger, inner Provider, dp downloadProvider) *deltaProvider {
+	return &deltaProvider{opts: opts, log: log, inner: inner, dp: dp}
+}
+
+func (d *deltaProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	innerIn := make(chan *artifact.Artifact)
+	innerOut := make(chan *artifact.Artifact)
+	innerDone := make(chan bool)
+	go d.inner.Upload(ctx, id, opts, innerIn, innerOut, innerDone)
+
+	// the wrapped worker stops early if it can't get started, e.g.
+	// without credentials, and this one stops with it
+	upload := func(a *artifact.Artifact) bool {
+		select {
+		case innerIn <- a:
+		case <-innerDone:
+			return false
+		}
+		<-innerOut
+		return true
+	}
+
+	for a := range in {
+		var ok bool
+		if opts.deltaApplies(a) {
+			ok = d.uploadDelta(a, opts, upload)
+		} else {
+			ok = upload(a)
+		}
+
+		if !ok {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = fmt.Errorf("uploader %s stopped", id)
+			out <- a
+			done <- true
+			return
+		}
+		out <- a
+	}
+
+	close(innerIn)
+	<-innerDone
+	done <- true
+}
+
+// uploadDelta uploads the artifact's changed blocks and its manifest,
+// filling in its result from theirs.  It returns false only if the
+// wrapped worker has stopped.
+func (d *deltaProvider) uploadDelta(a *artifact.Artifact, opts *Options, upload func(*artifact.Artifact) bool) bool {
+	start := time.Now()
+	defer func() { a.UploadResult.Duration = time.Since(start) }()
+
+	manifestKey := a.FullDest() + deltaManifestSuffix
+
+	m, err := deltaSignature(a, opts.DeltaBlockSize)
+	if err != nil {
+		a.UploadResult.OK, a.UploadResult.Err = false, err
+		return true
+	}
+
+	previous, err := fetchDeltaManifest(d.dp, manifestKey)
+	if err != nil {
+		d.log.WithFields(logrus.Fields{
+			"key": manifestKey,
+			"err": err,
+		}).Warn("cannot read the last delta manifest, uploading every block")
+	}
+
+	// blocks of another size share no checksums
+	stored := map[string]bool{}
+	if previous != nil && previous.BlockSize == m.BlockSize {
+		for _, sum := range previous.Blocks {
+			stored[sum] = true
+		}
+	}
+
+	r, err := a.Reader()
+	if err != nil {
+		a.UploadResult.OK, a.UploadResult.Err = false, err
+		return true
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// each block is uploaded before the next is read, so one buffer does
+	sent, sentSize := 0, uint64(0)
+	buf := make([]byte, opts.DeltaBlockSize)
+	for i, sum := range m.Blocks {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			a.UploadResult.OK, a.UploadResult.Err = false, err
+			return true
+		}
+
+		// a block the manifest has, or one this file repeats, is there
+		// already
+		if stored[sum] {
+			continue
+		}
+
+		block := d.part(a, a.Dest+deltaBlocksSuffix+sum, buf[:n], "application/octet-stream")
+		if !upload(block) {
+			return false
+		}
+		a.UploadResult.Attempts += block.UploadResult.Attempts
+		if !block.UploadResult.OK {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = fmt.Errorf("block %d of %d: %w", i+1, len(m.Blocks), block.UploadResult.Err)
+			return true
+		}
+
+		stored[sum] = true
+		sent++
+		sentSize += uint64(n)
+	}
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		a.UploadResult.OK, a.UploadResult.Err = false, err
+		return true
+	}
+
+	manifest := d.part(a, a.Dest+deltaManifestSuffix, body, "application/json")
+	manifest.CacheControl = a.CacheControl
+	manifest.Metadata = a.Metadata
+	if !upload(manifest) {
+		return false
+	}
+
+	a.UploadResult.Attempts += manifest.UploadResult.Attempts
+	a.UploadResult.OK = manifest.UploadResult.OK
+	a.UploadResult.Err = manifest.UploadResult.Err
+	a.UploadResult.URL = manifest.UploadResult.URL
+	a.UploadResult.SignedURL = manifest.UploadResult.SignedURL
+
+	if a.UploadResult.OK {
+		d.log.WithFields(logrus.Fields{
+			"artifact":  a.FullDest(),
+			"blocks":    len(m.Blocks),
+			"sent":      sent,
+			"sent_size": humanize.Bytes(sentSize),
+			"size":      humanize.Bytes(m.Size),
+		}).Info("uploaded delta")
+	}
+
+	return true
+}
+
+// part is a block or the manifest of the artifact, to be uploaded with its
+// permissions
+func (d *deltaProvider) part(a *artifact.Artifact, dest string, body []byte, ctype string) *artifact.Artifact {
+	p := artifact.NewFromBytes(a.Prefix, dest, body, &artifact.Options{
+		RepoSlug:    a.RepoSlug,
+		BuildNumber: a.BuildNumber,
+		BuildID:     a.BuildID,
+		JobNumber:   a.JobNumber,
+		JobID:       a.JobID,
+		Perm:        a.Perm,
+	})
+	p.SetContentType(ctype)
+	return p
+}
+
+func (d *deltaProvider) Name() string {
+	return d.inner.Name()
+}
+
+// Finish finishes the wrapped provider if it needs it
+func (d *deltaProvider) Finish(opts *Options) error {
+	if finisher, ok := d.inner.(uploadFinisher); ok {
+		return finisher.Finish(opts)
+	}
+	return nil
+}
+
+// downloadDelta rebuilds the file of a patch manifest at the local path,
+// reading the blocks that the file already there has from it and fetching
+// the rest, and reports whether it was written and how much was fetched
+func (u *uploader) downloadDelta(dp downloadProvider, key, localPath string, m *deltaManifest) (bool, uint64, error) {
+	local := map[string]int64{}
+	var existing *os.File
+	if f, err := os.Open(localPath); err == nil {
+		existing = f
+		defer existing.Close()
+
+		sig, err := deltaSignature(artifact.New("", localPath, "", &artifact.Options{}), m.BlockSize)
+		if err != nil {
+			return false, 0, err
+		}
+		if sig.SHA256 == m.SHA256 && sig.Size == m.Size {
+			u.log.WithField("path", localPath).Debug("skipping unchanged file")
+			return false, 0, nil
+		}
+		for i, sum := range sig.Blocks {
+			if _, ok := local[sum]; !ok {
+				local[sum] = int64(i) * int64(m.BlockSize)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return false, 0, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(localPath), ".artifacts-download")
+	if err != nil {
+		return false, 0, err
+	}
+
+	fetched, err := u.writeDeltaBlocks(dp, key, m, f, existing, local)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if existing != nil {
+		existing.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), localPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, fetched, err
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"key":     key,
+		"path":    localPath,
+		"size":    humanize.Bytes(m.Size),
+		"fetched": humanize.Bytes(fetched),
+	}).Info("downloaded delta")
+
+	return true, fetched, nil
+}
+
+// writeDeltaBlocks writes the manifest's blocks to w in order, checking
+// each block and then the whole against their checksums
+func (u *uploader) writeDeltaBlocks(dp downloadProvider, key string, m *deltaManifest,
+	w io.Writer, existing *os.File, local map[string]int64) (uint64, error) {
+
+	blocksPrefix := key[:len(key)-len(deltaManifestSuffix)] + deltaBlocksSuffix
+	whole := sha256.New()
+	fetched := uint64(0)
+	buf := make([]byte, m.BlockSize)
+
+	for i, sum := range m.Blocks {
+		var block []byte
+		if offset, ok := local[sum]; ok {
+			n, err := existing.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return fetched, err
+			}
+			block = buf[:n]
+		} else {
+			err := u.withDownloadRetries(dp, blocksPrefix+sum, func() error {
+				body, err := dp.getObject(blocksPrefix + sum)
+				if err != nil {
+					return err
+				}
+				defer body.Close()
+
+				block, err = ioutil.ReadAll(body)
+				return err
+			})
+			if err != nil {
+				return fetched, fmt.Errorf("block %d of %d: %v", i+1, len(m.Blocks), err)
+			}
+			fetched += uint64(len(block))
+		}
+
+		if got := sha256.Sum256(block); hex.EncodeToString(got[:]) != sum {
+			return fetched, fmt.Errorf("block %d of %d does not match its checksum", i+1, len(m.Blocks))
+		}
+
+		whole.Write(block)
+		if _, err := w.Write(block); err != nil {
+			return fetched, err
+		}
+	}
+
+	if hex.EncodeToString(whole.Sum(nil)) != m.SHA256 {
+		return fetched, fmt.Errorf("rebuilt file does not match the sha256 of its manifest")
+	}
+
+	return fetched, nil
+}
+
+// verifyDelta compares the artifact to the patch manifest stored for it
+func (u *uploader) verifyDelta(a *artifact.Artifact) *verifyOutcome {
+	key := a.FullDest()
+
+	dp, ok := u.Provider.(downloadProvider)
+	if !ok {
+		return &verifyOutcome{Key: key, Status: "error", Reason: "delta manifests cannot be read back"}
+	}
+
+	m, err := fetchDeltaManifest(dp, key+deltaManifestSuffix)
+	if err != nil {
+		return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+	}
+	if m == nil {
+		return &verifyOutcome{Key: key, Status: "missing"}
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+	}
+	if size != m.Size {
+		return &verifyOutcome{Key: key, Status: "mismatched", Reason: fmt.Sprintf("size %d != %d", m.Size, size)}
+	}
+
+	sum, err := a.SHA256()
+	if err != nil {
+		return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+	}
+	if sum != m.SHA256 {
+		return &verifyOutcome{Key: key, Status: "mismatched", Reason: fmt.Sprintf("sha256 %s != %s", m.SHA256, sum)}
+	}
+
+	return &verifyOutcome{Key: key, Status: "ok"}
+}
+
+// isDeltaBlock reports whether the key is a block of one of the patch
+// manifests among the items, which is downloaded as part of its file
+func isDeltaBlock(key string, items map[string]*downloadItem) bool {
+	i := strings.LastIndex(key, deltaBlocksSuffix)
+	if i < 0 {
+		return false
+	}
+	_, ok := items[key[:i]+deltaManifestSuffix]
+	return ok
+}
@@ -0,0 +1,257 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func deltaOpts(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"delta-test"}
+		opts.Delta = true
+		opts.DeltaBlockSize = 4
+		opts.DeltaMinSize = 8
+	}
+}
+
+func deltaBlockKeys(t *testing.T) []string {
+	resp, err := testS3.Bucket("bucket").List("delta-test/out/big.bin.delta/", "", "", 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := []string{}
+	for _, key := range resp.Contents {
+		keys = append(keys, key.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestUploaderDelta(t *testing.T) {
+	os.Clearenv()
+	clearTestS3Prefix(t, "delta-test/")
+	dir := writeTestFiles(t, map[string]string{
+		"out/big.bin":   "aaaabbbbccccdd",
+		"out/small.txt": "small",
+	})
+	defer os.RemoveAll(dir)
+
+	if err := getTestUploader(nil, deltaOpts(dir)).Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bucket := testS3.Bucket("bucket")
+	if _, err := bucket.Get("delta-test/out/big.bin"); err == nil {
+		t.Fatalf("file uploaded with --delta was also uploaded whole")
+	}
+	if b, err := bucket.Get("delta-test/out/small.txt"); err != nil || string(b) != "small" {
+		t.Fatalf("file smaller than --delta-min-size: %q, %v", b, err)
+	}
+
+	b, err := bucket.Get("delta-test/out/big.bin.delta.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := decodeDeltaManifest(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.Size != 14 || m.BlockSize != 4 || len(m.Blocks) != 4 {
+		t.Fatalf("unexpected manifest: %s", b)
+	}
+	first := deltaBlockKeys(t)
+	if len(first) != 4 {
+		t.Fatalf("blocks %v != 4", first)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "out/big.bin"), []byte("aaaaBBBBccccdd"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := getTestUploader(nil, deltaOpts(dir)).Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second := deltaBlockKeys(t); len(second) != 5 {
+		t.Fatalf("blocks %v != 5 after changing one", second)
+	}
+
+	result, err := getTestUploader(nil, deltaOpts(dir)).verify(ioutil.Discard)
+	if err != nil || result.Verified != 2 {
+		t.Fatalf("verify %#v: %v", result, err)
+	}
+
+	// a stale copy of the file is rebuilt from its own blocks and the
+	// changed one alone
+	dest, err := ioutil.TempDir("", "artifacts-delta-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	if err := ioutil.WriteFile(filepath.Join(dest, "big.bin"), []byte("aaaabbbbccccdd"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dlOpts := &DownloadOptions{Prefix: "delta-test/out", Dest: dest}
+	dlResult, err := getTestUploader(nil, downloadOpts).download(dlOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dlResult.Downloaded != 2 || dlResult.Bytes != 4+5 {
+		t.Fatalf("download result %#v != 2 downloaded, 9 bytes", dlResult)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "big.bin"))
+	if err != nil || string(content) != "aaaaBBBBccccdd" {
+		t.Fatalf("rebuilt %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "big.bin.delta")); err == nil {
+		t.Fatalf("blocks were downloaded as files")
+	}
+
+	dlResult, err = getTestUploader(nil, downloadOpts).download(dlOpts)
+	if err != nil || dlResult.Skipped != 2 {
+		t.Fatalf("download again %#v: %v", dlResult, err)
+	}
+}
+
+// fakeDeltaStore serves the objects that the delta provider reads back
+type fakeDeltaStore struct {
+	objects map[string][]byte
+}
+
+func (fs *fakeDeltaStore) listObjects(prefix string) (map[string]s3.Key, error) {
+	return map[string]s3.Key{}, nil
+}
+
+func (fs *fakeDeltaStore) getObject(key string) (io.ReadCloser, error) {
+	b, ok := fs.objects[key]
+	if !ok {
+		return nil, &s3.Error{StatusCode: 404}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (fs *fakeDeltaStore) downloadRetryInterval() time.Duration {
+	return 0
+}
+
+func runDeltaProvider(t *testing.T, opts *Options, p Provider, a *artifact.Artifact) {
+	in := make(chan *artifact.Artifact)
+	out := make(chan *artifact.Artifact)
+	done := make(chan bool)
+	go p.Upload(context.Background(), "0", opts, in, out, done)
+
+	in <- a
+	<-out
+	close(in)
+	<-done
+}
+
+func TestDeltaProviderSendsChangedBlocks(t *testing.T) {
+	opts := NewOptions()
+	opts.Delta = true
+	opts.DeltaBlockSize = 4
+	opts.DeltaMinSize = 8
+
+	old := artifact.NewFromBytes("bucket", "big.bin", []byte("aaaabbbbcccc"), &artifact.Options{})
+	m, err := deltaSignature(old, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ := json.Marshal(m)
+	store := &fakeDeltaStore{objects: map[string][]byte{"bucket/big.bin.delta.json": b}}
+
+	rp := &recordingProvider{}
+	a := artifact.NewFromBytes("bucket", "big.bin", []byte("aaaaBBBBccccBBBB"), &artifact.Options{})
+	runDeltaProvider(t, opts, newDeltaProvider(opts, getPanicLogger(), rp, store), a)
+
+	if !a.UploadResult.OK {
+		t.Fatalf("unexpected error: %v", a.UploadResult.Err)
+	}
+
+	dests := rp.FullDests()
+	if len(dests) != 2 || !strings.HasPrefix(dests[0], "bucket/big.bin.delta/") ||
+		dests[1] != "bucket/big.bin.delta.json" {
+		t.Fatalf("uploaded %v, expected the one changed block and the manifest", dests)
+	}
+
+	r, err := rp.Uploaded[1].Reader()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := decodeDeltaManifest(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated.Blocks) != 4 || updated.Blocks[1] != updated.Blocks[3] || updated.Blocks[0] != m.Blocks[0] {
+		t.Fatalf("unexpected manifest: %#v", updated)
+	}
+
+	// a failed block leaves the manifest alone
+	rp = &recordingProvider{FailSources: map[string]bool{"": true}}
+	a = artifact.NewFromBytes("bucket", "big.bin", []byte("ddddbbbbcccc"), &artifact.Options{})
+	runDeltaProvider(t, opts, newDeltaProvider(opts, getPanicLogger(), rp, store), a)
+
+	if a.UploadResult.OK || !strings.Contains(a.UploadResult.Err.Error(), "block 1 of 3") {
+		t.Fatalf("unexpected result: %#v", a.UploadResult)
+	}
+	if dests := rp.FullDests(); len(dests) != 1 {
+		t.Fatalf("uploaded %v after a failed block", dests)
+	}
+
+	// small files go by whole
+	rp = &recordingProvider{}
+	a = artifact.NewFromBytes("bucket", "small.txt", []byte("small"), &artifact.Options{})
+	runDeltaProvider(t, opts, newDeltaProvider(opts, getPanicLogger(), rp, store), a)
+	if !reflect.DeepEqual(rp.FullDests(), []string{"bucket/small.txt"}) {
+		t.Fatalf("uploaded %v", rp.FullDests())
+	}
+}
+
+func TestValidateDelta(t *testing.T) {
+	for _, tc := range []struct {
+		configure func(*Options)
+		msg       string
+	}{
+		{func(opts *Options) { opts.Provider = "gcs" }, "requires the s3 provider"},
+		{func(opts *Options) { opts.DeltaBlockSize = 0 }, "--delta-block-size"},
+		{func(opts *Options) { opts.SkipUnchanged = true }, "cannot be used with --skip-unchanged"},
+		{func(opts *Options) { opts.Sync = true }, "cannot be used with --sync"},
+	} {
+		opts := NewOptions()
+		opts.BucketName = "foo"
+		opts.Delta = true
+		tc.configure(opts)
+
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%v: unexpected error: %v", tc.msg, err)
+		}
+	}
+
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.AccessKey = "AKIAFOO"
+	opts.SecretKey = "bar"
+	opts.Delta = true
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+// Package upload is what the artifacts command runs, and can be used on
+// its own by programs that upload artifacts themselves.  Options are
+// loaded the way the command loads them with LoadOptions (or built up
+// from NewOptions), and then passed to Upload, or to UploadWithResult to
+// get back what happened to each artifact:
+//
+//	opts, err := upload.LoadOptions("")
+//	if err != nil {
+//		return err
+//	}
+//	opts.Paths = []string{"build/"}
+//	opts.TargetPaths = []string{"artifacts/42"}
+//
+//	if err := opts.Validate(); err != nil {
+//		return err
+//	}
+//
+//	result, err := upload.UploadWithResult(ctx, opts, nil)
+//
+// Cancelling the context stops the requests in flight, and the result
+// still covers what got done.  Download, List, Prune, and Sync work the
+// same way, and the log given to any of them may be nil to log nothing.
+// Errors can be told apart with FailureCategory.
+package upload
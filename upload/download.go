@@ -0,0 +1,392 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// DownloadOptions says what to fetch and where to put it
+type DownloadOptions struct {
+	// Prefix is the key prefix of the objects to download, which is
+	// replaced by Dest in their local paths
+	Prefix string
+	// Prefixes are more prefixes to download from in the same way, after
+	// Prefix if it is set too
+	Prefixes []string
+	// Dest is the local directory that the objects are written under
+	Dest string
+}
+
+func (dlOpts *DownloadOptions) prefixes() []string {
+	prefixes := []string{}
+	if dlOpts.Prefix != "" || len(dlOpts.Prefixes) == 0 {
+		prefixes = append(prefixes, dlOpts.Prefix)
+	}
+	return append(prefixes, dlOpts.Prefixes...)
+}
+
+// downloadItem is an object to download, and the prefix it was listed
+// under, which its local path is relative to
+type downloadItem struct {
+	Key    s3.Key
+	Prefix string
+}
+
+// DownloadResult counts what a download did
+type DownloadResult struct {
+	Downloaded int
+	Skipped    int
+	Failed     int
+	Bytes      uint64
+}
+
+// downloadProvider is implemented by the providers that objects can be
+// fetched back from
+type downloadProvider interface {
+	listObjects(prefix string) (map[string]s3.Key, error)
+	getObject(key string) (io.ReadCloser, error)
+	downloadRetryInterval() time.Duration
+}
+
+func (s3p *s3Provider) listObjects(prefix string) (map[string]s3.Key, error) {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]s3.Key{}
+	return keys, listS3Keys(bucket, prefix, keys)
+}
+
+func (s3p *s3Provider) getObject(key string) (io.ReadCloser, error) {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket.GetReader(key)
+}
+
+// symlinkDownloader is implemented by the download providers that can
+// read back the target of a symlink uploaded by --symlinks preserve
+type symlinkDownloader interface {
+	symlinkTarget(key string) (string, error)
+}
+
+func (s3p *s3Provider) symlinkTarget(key string) (string, error) {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := bucket.Head(key)
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+	return resp.Header.Get("x-amz-meta-" + symlinkTargetMetadataKey), nil
+}
+
+func (s3p *s3Provider) downloadRetryInterval() time.Duration {
+	return s3p.RetryInterval
+}
+
+// Download fetches every object under the prefixes into the dest dir with
+// --concurrency workers, recreating the directory structure below each
+// prefix, and retrying each object up to --retries times.  Files that
+// already exist with the object's size and md5 are skipped, so an
+// interrupted download may be re-run cheaply.  Symlinks uploaded by
+// --symlinks preserve are made again.  The null provider has nothing to
+// download.
+func Download(opts *Options, dlOpts *DownloadOptions, log *logrus.Logger) (*DownloadResult, error) {
+	return newUploader(opts, log).download(dlOpts)
+}
+
+func (u *uploader) download(dlOpts *DownloadOptions) (*DownloadResult, error) {
+	result := &DownloadResult{}
+
+	if _, ok := u.Provider.(*nullProvider); ok {
+		u.log.Info("nothing to download with the null provider")
+		return result, nil
+	}
+
+	dp, ok := u.Provider.(downloadProvider)
+	if !ok {
+		return nil, fmt.Errorf("download requires the s3 provider")
+	}
+
+	items := map[string]*downloadItem{}
+	names := []string{}
+	for _, prefix := range dlOpts.prefixes() {
+		prefix = strings.TrimLeft(prefix, "/")
+		keys, err := dp.listObjects(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		u.log.WithFields(logrus.Fields{
+			"prefix": prefix,
+			"remote": len(keys),
+		}).Debug("listed remote objects")
+
+		for name, key := range keys {
+			// an object under more than one of the prefixes goes where the
+			// first one puts it
+			if _, ok := items[name]; ok || !underPrefix(name, prefix) {
+				continue
+			}
+			items[name] = &downloadItem{Key: key, Prefix: prefix}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	work := make(chan *downloadItem)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	concurrency := int(u.Opts.Concurrency)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				key := item.Key
+				downloaded, size, err := u.downloadObject(dp, key, item.Prefix, dlOpts.Dest)
+
+				lock.Lock()
+				switch {
+				case err != nil:
+					result.Failed++
+				case downloaded:
+					result.Downloaded++
+					result.Bytes += size
+				default:
+					result.Skipped++
+				}
+				lock.Unlock()
+
+				if err != nil {
+					u.log.WithFields(logrus.Fields{
+						"key": key.Key,
+						"err": err,
+					}).Error("failed to download")
+				}
+			}
+		}()
+	}
+
+	for _, name := range names {
+		// the blocks of a --delta upload come down with its manifest
+		if isDeltaBlock(name, items) {
+			continue
+		}
+		work <- items[name]
+	}
+	close(work)
+	wg.Wait()
+
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d of %d objects failed to download", result.Failed, result.Failed+result.Downloaded+result.Skipped)
+	}
+
+	return result, nil
+}
+
+// underPrefix reports whether the key is the prefix or below it as a
+// directory, so that builds/1 does not also match builds/10/
+func underPrefix(key, prefix string) bool {
+	if prefix == "" || key == prefix {
+		return true
+	}
+	return strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// downloadObject writes the object under the dest dir unless a file with
+// the same content is already there, reporting whether it was written and
+// how much was fetched.  The patch manifest of a --delta upload is written
+// as the file it was made from, at its key without the suffix.
+func (u *uploader) downloadObject(dp downloadProvider, key s3.Key, prefix, dest string) (bool, uint64, error) {
+	rel := strings.TrimLeft(strings.TrimPrefix(key.Key, prefix), "/")
+	if rel == "" || strings.HasSuffix(key.Key, "/") {
+		return false, 0, nil
+	}
+
+	localPath := filepath.Join(dest, filepath.FromSlash(rel))
+	if r, err := filepath.Rel(dest, localPath); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return false, 0, fmt.Errorf("key %q is outside of the dest dir", key.Key)
+	}
+
+	if restored, err := u.restoreSymlink(dp, key, dest, localPath); restored || err != nil {
+		return restored, 0, err
+	}
+
+	if strings.HasSuffix(key.Key, deltaManifestSuffix) && strings.TrimSuffix(rel, deltaManifestSuffix) != "" {
+		var m *deltaManifest
+		err := u.withDownloadRetries(dp, key.Key, func() error {
+			var err error
+			m, err = fetchDeltaManifest(dp, key.Key)
+			return err
+		})
+		if err != nil {
+			return false, 0, err
+		}
+		// anything else by the name is downloaded as it is
+		if m != nil {
+			return u.downloadDelta(dp, key.Key, strings.TrimSuffix(localPath, deltaManifestSuffix), m)
+		}
+	}
+
+	if _, err := os.Stat(localPath); err == nil {
+		if !remoteChanged(artifact.New("", localPath, rel, &artifact.Options{}), key) {
+			u.log.WithField("path", localPath).Debug("skipping unchanged file")
+			return false, 0, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return false, 0, err
+	}
+
+	err := u.withDownloadRetries(dp, key.Key, func() error {
+		return fetchObject(dp, key.Key, localPath)
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"key":  key.Key,
+		"path": localPath,
+		"size": humanize.Bytes(uint64(key.Size)),
+	}).Info("downloaded")
+
+	return true, uint64(key.Size), nil
+}
+
+// withDownloadRetries runs fetch until it succeeds, up to --retries times
+func (u *uploader) withDownloadRetries(dp downloadProvider, key string, fetch func() error) error {
+	retries := uint64(0)
+	for {
+		err := fetch()
+		if err == nil {
+			return nil
+		}
+
+		if retries >= u.Opts.Retries || u.Opts.pastRetryDeadline() {
+			return err
+		}
+
+		retries++
+		sleep := u.Opts.retryBackoff(dp.downloadRetryInterval(), retries)
+		u.log.WithFields(logrus.Fields{
+			"key":   key,
+			"retry": retries,
+			"sleep": sleep,
+			"err":   err,
+		}).Debug("retrying download")
+		time.Sleep(sleep)
+	}
+}
+
+// restoreSymlink makes the symlink that an empty object uploaded by
+// --symlinks preserve stands for, reporting whether it was made.  Targets
+// that are absolute or outside of the dest dir aren't restored, so the
+// object is downloaded as the empty file it is.
+func (u *uploader) restoreSymlink(dp downloadProvider, key s3.Key, dest, localPath string) (bool, error) {
+	sd, ok := dp.(symlinkDownloader)
+	if !ok || key.Size != 0 {
+		return false, nil
+	}
+
+	target, err := sd.symlinkTarget(key.Key)
+	if err != nil || target == "" {
+		return false, err
+	}
+
+	resolved := filepath.Join(filepath.Dir(localPath), target)
+	if r, err := filepath.Rel(dest, resolved); filepath.IsAbs(target) || err != nil ||
+		r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		u.log.WithFields(logrus.Fields{
+			"key":    key.Key,
+			"target": target,
+		}).Warn("not restoring symlink to outside of the dest dir")
+		return false, nil
+	}
+
+	if existing, err := os.Readlink(localPath); err == nil && existing == target {
+		u.log.WithField("path", localPath).Debug("skipping unchanged symlink")
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := os.Symlink(target, localPath); err != nil {
+		return false, err
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"key":    key.Key,
+		"path":   localPath,
+		"target": target,
+	}).Info("restored symlink")
+
+	return true, nil
+}
+
+// fetchObject writes the object to the local path, next to it first and
+// then renamed, so that an interrupted download never leaves a partial
+// file at the path
+func fetchObject(dp downloadProvider, key, localPath string) error {
+	body, err := dp.getObject(key)
+	if err != nil {
+		return err
+	}
+
+	defer body.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(localPath), ".artifacts-download")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, body)
+	if err == nil {
+		// temp files are only readable by their owner
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), localPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,227 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func downloadOpts(opts *Options) {
+	opts.BucketName = "bucket"
+	opts.Concurrency = 2
+}
+
+func TestUploaderDownload(t *testing.T) {
+	bucket := testS3.Bucket("bucket")
+	objects := map[string]string{
+		"download-test/42/build.log":         "ok",
+		"download-test/42/coverage/index.js": "covered()",
+		"download-test/42/a/b/c.txt":         "deep",
+		"download-test/43/other.txt":         "not this build",
+		"download-test/420/other.txt":        "nor this one",
+	}
+	for key, body := range objects {
+		if err := bucket.Put(key, []byte(body), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	dest, err := ioutil.TempDir("", "artifacts-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	os.Clearenv()
+	dlOpts := &DownloadOptions{Prefix: "download-test/42", Dest: dest}
+	result, err := getTestUploader(nil, downloadOpts).download(dlOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Downloaded != 3 || result.Skipped != 0 || result.Bytes != 15 {
+		t.Fatalf("download result %#v != 3 downloaded, 0 skipped, 15 bytes", result)
+	}
+
+	for rel, body := range map[string]string{
+		"build.log":         "ok",
+		"coverage/index.js": "covered()",
+		"a/b/c.txt":         "deep",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if string(content) != body {
+			t.Fatalf("%v content %q != %q", rel, content, body)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "other.txt")); err == nil {
+		t.Fatalf("object outside the prefix was downloaded")
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "0")); err == nil {
+		t.Fatalf("object under a longer prefix was downloaded")
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "build.log"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("downloaded file mode %v != 0644", fi.Mode().Perm())
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dest, "build.log"), []byte("no"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = getTestUploader(nil, downloadOpts).download(dlOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Downloaded != 1 || result.Skipped != 2 {
+		t.Fatalf("re-run result %#v != 1 downloaded, 2 skipped", result)
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(dest, "build.log"))
+	if string(content) != "ok" {
+		t.Fatalf("changed file %q was not downloaded again", content)
+	}
+}
+
+func TestUploaderDownloadNullProvider(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	result, err := newUploader(opts, getPanicLogger()).download(&DownloadOptions{Prefix: "x", Dest: "nowhere"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Downloaded != 0 {
+		t.Fatalf("null provider downloaded %v objects", result.Downloaded)
+	}
+
+	if _, err := os.Stat("nowhere"); err == nil {
+		t.Fatalf("null provider created the dest dir")
+	}
+}
+
+func TestUploaderDownloadUnsupportedProvider(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "artifacts"
+
+	if _, err := newUploader(opts, getPanicLogger()).download(&DownloadOptions{}); err == nil {
+		t.Fatalf("download was allowed with the artifacts provider")
+	}
+}
+
+func TestUploaderDownloadPrefixes(t *testing.T) {
+	bucket := testS3.Bucket("bucket")
+	for key, body := range map[string]string{
+		"download-prefixes/logs/build.log":   "ok",
+		"download-prefixes/coverage/lcov.js": "covered()",
+		"download-prefixes/other/skip.txt":   "not this",
+	} {
+		if err := bucket.Put(key, []byte(body), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	dest, err := ioutil.TempDir("", "artifacts-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	os.Clearenv()
+	dlOpts := &DownloadOptions{
+		Prefixes: []string{"download-prefixes/logs", "download-prefixes/coverage"},
+		Dest:     dest,
+	}
+	result, err := getTestUploader(nil, downloadOpts).download(dlOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Downloaded != 2 {
+		t.Fatalf("download result %#v != 2 downloaded", result)
+	}
+
+	for _, rel := range []string{"build.log", "lcov.js"} {
+		if _, err := os.Stat(filepath.Join(dest, rel)); err != nil {
+			t.Fatalf("%s was not downloaded: %v", rel, err)
+		}
+	}
+}
+
+// flakyDownloadProvider serves one object, failing the first Failures
+// times it's fetched
+type flakyDownloadProvider struct {
+	nullProvider
+	Failures int
+	Fetches  int
+}
+
+func (fp *flakyDownloadProvider) listObjects(prefix string) (map[string]s3.Key, error) {
+	return map[string]s3.Key{"flaky/a.txt": {Key: "flaky/a.txt", Size: 1}}, nil
+}
+
+func (fp *flakyDownloadProvider) getObject(key string) (io.ReadCloser, error) {
+	fp.Fetches++
+	if fp.Fetches <= fp.Failures {
+		return nil, fmt.Errorf("flaky")
+	}
+	return ioutil.NopCloser(strings.NewReader("a")), nil
+}
+
+func (fp *flakyDownloadProvider) downloadRetryInterval() time.Duration {
+	return 0
+}
+
+func TestUploaderDownloadRetries(t *testing.T) {
+	dest, err := ioutil.TempDir("", "artifacts-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	os.Clearenv()
+	u := getTestUploader(nil, func(opts *Options) {
+		downloadOpts(opts)
+		opts.Retries = 1
+	})
+	fp := &flakyDownloadProvider{Failures: 1}
+	u.Provider = fp
+
+	result, err := u.download(&DownloadOptions{Prefix: "flaky", Dest: dest})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Downloaded != 1 || fp.Fetches != 2 {
+		t.Fatalf("download result %#v after %v fetches", result, fp.Fetches)
+	}
+
+	os.Remove(filepath.Join(dest, "a.txt"))
+	fp = &flakyDownloadProvider{Failures: 2}
+	u.Provider = fp
+	if _, err := u.download(&DownloadOptions{Prefix: "flaky", Dest: dest}); err == nil {
+		t.Fatalf("download succeeded after running out of retries")
+	}
+	if fp.Fetches != 2 {
+		t.Fatalf("fetched %v times with 1 retry", fp.Fetches)
+	}
+}
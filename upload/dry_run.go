@@ -0,0 +1,317 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var dryRunFormats = map[string]bool{
+	"text": true,
+	"diff": true,
+	"json": true,
+}
+
+// dryRunOp is one operation an upload would make.  A Size of -1 is
+// unknown, as for stdin without --stdin-size.  Source and ContentType are
+// empty for keys that only exist in the bucket.
+type dryRunOp struct {
+	Op          string
+	Key         string
+	Size        int64
+	Source      string
+	ContentType string
+}
+
+type dryRunOps []*dryRunOp
+
+func (ops dryRunOps) Len() int      { return len(ops) }
+func (ops dryRunOps) Swap(i, j int) { ops[i], ops[j] = ops[j], ops[i] }
+func (ops dryRunOps) Less(i, j int) bool {
+	if ops[i].Key != ops[j].Key {
+		return ops[i].Key < ops[j].Key
+	}
+	if ops[i].Op != ops[j].Op {
+		return ops[i].Op < ops[j].Op
+	}
+	return ops[i].Size < ops[j].Size
+}
+
+// DryRun writes the operations an upload would make to w, sorted by key,
+// as Upload does with DryRun set.  With the s3 provider, each file is
+// compared to the object already at its key to tell whether it would be
+// added, changed, or skipped, and with any other provider every file
+// would be added.
+func DryRun(opts *Options, w io.Writer, log *logrus.Logger) error {
+	return newUploader(opts, log).dryRun(w)
+}
+
+// dryRun is an upload with DryRun set that writes its plan to w
+func (u *uploader) dryRun(w io.Writer) error {
+	u.Opts.DryRun = true
+	u.stdout = w
+	return u.Upload()
+}
+
+// newDryRunProvider stands in for the uploader's provider, having listed
+// the objects under the target paths first if it is s3
+func (u *uploader) newDryRunProvider() (*dryRunProvider, error) {
+	dp := &dryRunProvider{log: u.log, ops: dryRunOps{}}
+
+	if s3p, ok := u.Provider.(*s3Provider); ok {
+		bucket, err := s3p.bucket()
+		if err != nil {
+			return nil, err
+		}
+
+		dp.remote, err = listTargetPaths(bucket, u.Opts.TargetPaths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dp, nil
+}
+
+// writeDryRun writes the plan in --format, failing with
+// --assert-no-changes if anything but a skip is in it
+func (u *uploader) writeDryRun(dp *dryRunProvider) error {
+	ops := dp.Plan(u.Opts)
+
+	write := writeDryRunText
+	switch u.Opts.DryRunFormat {
+	case "diff":
+		write = writeDryRunDiff
+	case "json":
+		write = writeDryRunJSON
+	}
+
+	if err := write(u.stdout, ops); err != nil {
+		return err
+	}
+
+	if u.Opts.AssertNoChanges {
+		return u.assertNoChanges(ops)
+	}
+
+	return nil
+}
+
+// assertNoChanges fails if any operation but a skip would be made,
+// logging each drifted key
+func (u *uploader) assertNoChanges(ops dryRunOps) error {
+	drifted := []string{}
+	for _, op := range ops {
+		if op.Op == "skip" {
+			continue
+		}
+
+		u.log.WithFields(logrus.Fields{
+			"key": op.Key,
+			"op":  op.Op,
+		}).Error("drifted from bucket")
+		drifted = append(drifted, fmt.Sprintf("%s (%s)", op.Key, op.Op))
+	}
+
+	if len(drifted) > 0 {
+		return fmt.Errorf("%d keys drifted from the bucket: %s", len(drifted), strings.Join(drifted, ", "))
+	}
+
+	return nil
+}
+
+// writeDryRunDiff writes one "op key size" line per operation, with
+// nothing that varies between runs, so that the output can be checked in
+// and diffed
+func writeDryRunDiff(w io.Writer, ops dryRunOps) error {
+	for _, op := range ops {
+		size := "-"
+		if op.Size >= 0 {
+			size = fmt.Sprintf("%d", op.Size)
+		}
+
+		if _, err := fmt.Fprintf(w, "%s %s %s\n", op.Op, op.Key, size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeDryRunJSON writes one JSON object per operation, leaving out the
+// size when it is unknown
+func writeDryRunJSON(w io.Writer, ops dryRunOps) error {
+	enc := json.NewEncoder(w)
+	for _, op := range ops {
+		line := struct {
+			Op          string `json:"op"`
+			Key         string `json:"key"`
+			Size        *int64 `json:"size,omitempty"`
+			Source      string `json:"source,omitempty"`
+			ContentType string `json:"content_type,omitempty"`
+		}{Op: op.Op, Key: op.Key, Source: op.Source, ContentType: op.ContentType}
+		if op.Size >= 0 {
+			line.Size = &op.Size
+		}
+
+		if err := enc.Encode(&line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeDryRunText(w io.Writer, ops dryRunOps) error {
+	counts := map[string]int{}
+	for _, op := range ops {
+		counts[op.Op]++
+
+		size := "unknown size"
+		if op.Size >= 0 {
+			size = humanize.Bytes(uint64(op.Size))
+		}
+
+		verb := "would " + op.Op
+		if op.Op == "extraneous" {
+			verb = "extraneous"
+		}
+
+		if _, err := fmt.Fprintf(w, "%s: %s (%s)\n", verb, op.Key, size); err != nil {
+			return err
+		}
+	}
+
+	summary := fmt.Sprintf("%d to add, %d to change, %d to skip", counts["add"], counts["change"], counts["skip"])
+	if counts["extraneous"] > 0 {
+		summary += fmt.Sprintf(", %d extraneous", counts["extraneous"])
+	}
+
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
+
+// dryRunProvider stands in for the real provider when Upload is called
+// with DryRun set, logging what each upload would be without sending
+// anything, and planning it against the remote objects, if listed
+type dryRunProvider struct {
+	log    *logrus.Logger
+	remote map[string]s3.Key
+
+	sync.Mutex
+	Count     int
+	TotalSize uint64
+
+	ops dryRunOps
+}
+
+func (dp *dryRunProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		size, _ := a.Size()
+
+		dp.log.WithFields(logrus.Fields{
+			"source":       artifactSourceName(a),
+			"dest":         a.FullDest(),
+			"content_type": a.ContentType(),
+			"size":         humanize.Bytes(size),
+		}).Info("would upload")
+
+		op := dp.op(opts, a, size)
+
+		dp.Lock()
+		dp.Count++
+		dp.TotalSize += size
+		dp.ops = append(dp.ops, op)
+		dp.Unlock()
+
+		a.UploadResult.OK = true
+		out <- a
+	}
+
+	done <- true
+}
+
+// op is what uploading the artifact would do to the object at its key.
+// Stdin isn't read, so it would change an object that's already there.
+func (dp *dryRunProvider) op(opts *Options, a *artifact.Artifact, size uint64) *dryRunOp {
+	op := &dryRunOp{
+		Op:          "add",
+		Key:         a.FullDest(),
+		Size:        int64(size),
+		ContentType: a.ContentType(),
+	}
+
+	switch {
+	case a.IsStream():
+		op.Source, op.ContentType = stdinPath, ""
+		if a.SizeUnknown() {
+			op.Size = -1
+		}
+	case a.Source != "":
+		op.Source = relToWorkingDir(opts.WorkingDir, a.Source)
+	}
+
+	if remoteKey, ok := dp.remote[op.Key]; ok {
+		op.Op = "skip"
+		if a.IsStream() || remoteChanged(a, remoteKey) {
+			op.Op = "change"
+		}
+	}
+
+	return op
+}
+
+func (dp *dryRunProvider) Name() string {
+	return "dry-run"
+}
+
+// Plan is the operations planned so far sorted by key, along with the
+// remote objects that nothing would be uploaded to with
+// --assert-no-extraneous
+func (dp *dryRunProvider) Plan(opts *Options) dryRunOps {
+	dp.Lock()
+	defer dp.Unlock()
+
+	ops := append(dryRunOps{}, dp.ops...)
+
+	if opts.AssertNoExtraneous {
+		planned := map[string]bool{}
+		for _, op := range ops {
+			planned[op.Key] = true
+		}
+
+		for key, remoteKey := range dp.remote {
+			if !planned[key] {
+				ops = append(ops, &dryRunOp{Op: "extraneous", Key: key, Size: remoteKey.Size})
+			}
+		}
+	}
+
+	sort.Sort(ops)
+	return ops
+}
+
+// LogTotal logs the combined size of everything that would have been
+// uploaded, against --max-size
+func (dp *dryRunProvider) LogTotal(opts *Options) {
+	dp.Lock()
+	defer dp.Unlock()
+
+	dp.log.WithFields(logrus.Fields{
+		"files":            dp.Count,
+		"total_size":       humanize.Bytes(dp.TotalSize),
+		"max_size":         humanize.Bytes(opts.MaxSize),
+		"percent_max_size": pctMax(dp.TotalSize, opts.MaxSize),
+	}).Info("dry run complete, nothing was uploaded")
+}
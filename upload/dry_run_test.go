@@ -0,0 +1,352 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func dryRunOpts(dir, format string) func(*Options) {
+	return func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"site/", "-:build.log"}
+		opts.TargetPaths = []string{"dry-run-test"}
+		opts.StdinSize = 42
+		opts.DryRunFormat = format
+	}
+}
+
+func TestUploaderDryRunDiff(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"site/same.txt":       "same",
+		"site/changed.txt":    "changed locally",
+		"site/new/z.txt":      "zzz",
+		"site/new/a.txt":      "a",
+		"site/index.html":     "<p>index</p>",
+		"site/sub/deeper.css": "p{}",
+	})
+	defer os.RemoveAll(dir)
+
+	bucket := testS3.Bucket("bucket")
+	for key, body := range map[string]string{
+		"dry-run-test/site/same.txt":    "same",
+		"dry-run-test/site/changed.txt": "changed",
+	} {
+		if err := bucket.Put(key, []byte(body), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	expected := strings.Join([]string{
+		"add dry-run-test/build.log 42",
+		"change dry-run-test/site/changed.txt 15",
+		"add dry-run-test/site/index.html 12",
+		"add dry-run-test/site/new/a.txt 1",
+		"add dry-run-test/site/new/z.txt 3",
+		"skip dry-run-test/site/same.txt 4",
+		"add dry-run-test/site/sub/deeper.css 3",
+	}, "\n") + "\n"
+
+	for i := 0; i < 3; i++ {
+		u := getTestUploader(nil, dryRunOpts(dir, "diff"))
+		u.stdin = strings.NewReader("never read")
+
+		buf := &bytes.Buffer{}
+		if err := u.dryRun(buf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if buf.String() != expected {
+			t.Fatalf("run %d: dry run output:\n%s\n!=\n%s", i, buf.String(), expected)
+		}
+	}
+
+	if _, err := bucket.Get("dry-run-test/site/new/a.txt"); err == nil {
+		t.Fatalf("dry run uploaded files")
+	}
+}
+
+func TestUploaderDryRunText(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"site/a.txt": "a"})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, dryRunOpts(dir, "text"))
+	u.stdin = strings.NewReader("never read")
+	u.Opts.TargetPaths = []string{"dry-run-text-test"}
+
+	buf := &bytes.Buffer{}
+	if err := u.dryRun(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, line := range []string{
+		"would add: dry-run-text-test/site/a.txt (1B)",
+		"would add: dry-run-text-test/build.log (42B)",
+		"2 to add, 0 to change, 0 to skip",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("dry run output does not contain %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestUploaderDryRunWithoutS3(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"site/a.txt": "a", "site/b.txt": "bb"})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"site/"}
+	opts.TargetPaths = []string{"two", "one"}
+	opts.DryRunFormat = "diff"
+
+	buf := &bytes.Buffer{}
+	if err := newUploader(opts, getPanicLogger()).dryRun(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "add one/site/a.txt 1\nadd one/site/b.txt 2\nadd two/site/a.txt 1\nadd two/site/b.txt 2\n"
+	if buf.String() != expected {
+		t.Fatalf("dry run output:\n%s\n!=\n%s", buf.String(), expected)
+	}
+}
+
+func TestUploaderDryRunJSON(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"site/index.html": "<html></html>"})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"site/", "-:build.log"}
+	opts.TargetPaths = []string{"json"}
+	opts.DryRunFormat = "json"
+
+	u := newUploader(opts, getPanicLogger())
+	u.stdin = strings.NewReader("never read")
+
+	buf := &bytes.Buffer{}
+	if err := u.dryRun(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{"op":"add","key":"json/build.log","source":"-"}` + "\n" +
+		`{"op":"add","key":"json/site/index.html","size":13,"source":"site/index.html","content_type":"text/html; charset=utf-8"}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("dry run output:\n%s\n!=\n%s", buf.String(), expected)
+	}
+}
+
+func TestUploaderDryRunMaxSize(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"site/a.txt": "aaaa", "site/b.txt": "bbbb"})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"site/"}
+	opts.MaxSize = 6
+
+	err := newUploader(opts, getPanicLogger()).dryRun(&bytes.Buffer{})
+	if err == nil || FailureCategory(err) != FailureSizeLimit {
+		t.Fatalf("dry run past --max-size was not an error: %v", err)
+	}
+}
+
+func TestValidateDryRunFormat(t *testing.T) {
+	opts := NewOptions()
+	opts.DryRunFormat = "yaml"
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "--format") {
+		t.Fatalf("unknown --format was accepted: %v", err)
+	}
+}
+
+func TestUploadDryRun(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"site/index.html":  "<html></html>",
+		"site/css/app.css": "body {}",
+	})
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = buf
+	log.Level = logrus.InfoLevel
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"site/"}
+	opts.TargetPaths = []string{"builds/1"}
+	opts.SuccessMarker = "_SUCCESS"
+	opts.DryRun = true
+
+	u := newUploader(opts, log)
+	rp := &recordingProvider{}
+	u.Provider = rp
+	plan := &bytes.Buffer{}
+	u.stdout = plan
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rp.Uploaded) != 0 {
+		t.Fatalf("dry run uploaded %v artifacts", len(rp.Uploaded))
+	}
+
+	if len(u.results) != 3 {
+		t.Fatalf("dry run results %v != 3", len(u.results))
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		`dest="builds/1/site/index.html"`,
+		`content_type="text/html; charset=utf-8"`,
+		`dest="builds/1/site/css/app.css"`,
+		`content_type="text/css; charset=utf-8"`,
+		`dest="builds/1/_SUCCESS"`,
+		`size="13B"`,
+		"files=3",
+		`total_size="20B"`,
+		"dry run complete",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("dry run log has no %s: %s", expected, out)
+		}
+	}
+
+	if !strings.Contains(plan.String(), "would add: builds/1/_SUCCESS (0B)\n") {
+		t.Fatalf("dry run plan has no success marker:\n%s", plan.String())
+	}
+}
+
+func TestUploaderDryRunBundle(t *testing.T) {
+	dir := writeBundleFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		bundleOpts(dir)(opts)
+		opts.Provider = "null"
+	})
+
+	buf := &bytes.Buffer{}
+	if err := u.dryRun(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "would add: artifacts/build-7.tar") ||
+		!strings.HasSuffix(buf.String(), "1 to add, 0 to change, 0 to skip\n") {
+		t.Fatalf("dry run did not plan the bundle:\n%s", buf.String())
+	}
+}
+
+func TestUploaderDryRunMaxFiles(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"site/a.txt": "a", "site/b.txt": "b"})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"site/"}
+	opts.MaxFiles = 1
+
+	buf := &bytes.Buffer{}
+	if err := newUploader(opts, getPanicLogger()).dryRun(buf); err == nil {
+		t.Fatalf("dry run past --max-files was not an error")
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("failed dry run wrote a plan:\n%s", buf.String())
+	}
+}
+
+func assertNoChangesOpts(dir string, extraneous bool) func(*Options) {
+	return func(opts *Options) {
+		dryRunOpts(dir, "diff")(opts)
+		opts.Paths = []string{"site/"}
+		opts.TargetPaths = []string{"assert-no-changes-test"}
+		opts.AssertNoChanges = true
+		opts.AssertNoExtraneous = extraneous
+	}
+}
+
+func TestUploaderDryRunAssertNoChanges(t *testing.T) {
+	clearTestS3Prefix(t, "assert-no-changes-test/")
+	dir := writeTestFiles(t, map[string]string{
+		"site/index.html": "<p>index</p>",
+		"site/app.css":    "p{}",
+	})
+	defer os.RemoveAll(dir)
+
+	bucket := testS3.Bucket("bucket")
+	for key, body := range map[string]string{
+		"assert-no-changes-test/site/index.html": "<p>index</p>",
+		"assert-no-changes-test/site/app.css":    "p{}",
+	} {
+		if err := bucket.Put(key, []byte(body), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := getTestUploader(nil, assertNoChangesOpts(dir, true)).dryRun(&bytes.Buffer{}); err != nil {
+		t.Fatalf("unexpected error without drift: %v", err)
+	}
+
+	err := bucket.Put("assert-no-changes-test/site/app.css", []byte("p{color:red}"), "text/plain", s3.Private)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = bucket.Put("assert-no-changes-test/site/stray.js", []byte("stray"), "text/plain", s3.Private)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "site", "new.html"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = getTestUploader(nil, assertNoChangesOpts(dir, false)).dryRun(&bytes.Buffer{})
+	expected := "2 keys drifted from the bucket: assert-no-changes-test/site/app.css (change), " +
+		"assert-no-changes-test/site/new.html (add)"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("drift error %v != %q", err, expected)
+	}
+
+	buf := &bytes.Buffer{}
+	err = getTestUploader(nil, assertNoChangesOpts(dir, true)).dryRun(buf)
+	if err == nil || !strings.Contains(err.Error(), "assert-no-changes-test/site/stray.js (extraneous)") {
+		t.Fatalf("extraneous object was not reported: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "extraneous assert-no-changes-test/site/stray.js 5\n") {
+		t.Fatalf("dry run output does not list the extraneous object:\n%s", buf.String())
+	}
+}
+
+func TestValidateAssertNoChanges(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.AssertNoChanges = true
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "--dry-run") {
+		t.Fatalf("--assert-no-changes was accepted without --dry-run: %v", err)
+	}
+
+	opts.DryRun = true
+	err = opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "s3") {
+		t.Fatalf("--assert-no-changes was accepted without s3: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var duplicateKeysPolicies = map[string]bool{
+	"warn":  true,
+	"fail":  true,
+	"allow": true,
+}
+
+// checkDuplicateKeys reports each key that more than one source would be
+// uploaded to, unless --duplicate-keys is "allow" or --stream is set.
+// With "warn", artifacts pass straight through as they are checked.  With
+// "fail", every artifact is resolved up front, so that nothing is uploaded
+// if any key collides.
+func (u *uploader) checkDuplicateKeys(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if u.Opts.DuplicateKeys == "allow" || u.Opts.Stream {
+		return in, nil
+	}
+
+	if u.Opts.DuplicateKeys == "warn" {
+		return u.warnDuplicateKeys(in), nil
+	}
+
+	sources := map[string][]string{}
+	held := []*artifact.Artifact{}
+
+	for a := range in {
+		key := a.FullDest()
+		source := artifactSourceName(a)
+		if !containsString(sources[key], source) {
+			sources[key] = append(sources[key], source)
+		}
+		held = append(held, a)
+	}
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	duplicates := []string{}
+	for key, keySources := range sources {
+		if len(keySources) > 1 {
+			duplicates = append(duplicates, key)
+		}
+	}
+	sort.Strings(duplicates)
+
+	for _, key := range duplicates {
+		u.log.WithFields(logrus.Fields{
+			"key":     key,
+			"sources": strings.Join(sources[key], ", "),
+		}).Warn("more than one file would be uploaded to the same key")
+	}
+
+	if len(duplicates) > 0 && u.Opts.DuplicateKeys == "fail" {
+		return nil, fmt.Errorf("found %d keys that more than one file would be uploaded to, first %q from %s",
+			len(duplicates), duplicates[0], strings.Join(sources[duplicates[0]], ", "))
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for _, a := range held {
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// warnDuplicateKeys passes the artifacts through, keeping only the first
+// source of each key to warn about the next ones with
+func (u *uploader) warnDuplicateKeys(in chan *artifact.Artifact) chan *artifact.Artifact {
+	out := make(chan *artifact.Artifact)
+	go func() {
+		firstSources := map[string]string{}
+		for a := range in {
+			key := a.FullDest()
+			source := artifactSourceName(a)
+			if first, ok := firstSources[key]; !ok {
+				firstSources[key] = source
+			} else if first != source {
+				u.log.WithFields(logrus.Fields{
+					"key":     key,
+					"sources": first + ", " + source,
+				}).Warn("more than one file would be uploaded to the same key")
+			}
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// artifactSourceName is the source of the artifact, or "-" for stdin
+func artifactSourceName(a *artifact.Artifact) string {
+	if a.IsStream() {
+		return stdinPath
+	}
+	return a.Source
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+type duplicateKeysCase struct {
+	paths      []string
+	policy     string
+	duplicates int
+}
+
+var duplicateKeysCases = []*duplicateKeysCase{
+	&duplicateKeysCase{[]string{"a/x.txt:x.txt", "b/x.txt:x.txt"}, "fail", 1},
+	&duplicateKeysCase{[]string{"a/x.txt:x.txt", "b/x.txt:x.txt", "b/y.txt:a/x.txt"}, "fail", 1},
+	&duplicateKeysCase{[]string{"a/x.txt:same", "a/y.txt:same", "b/x.txt:other", "b/y.txt:other"}, "fail", 2},
+	&duplicateKeysCase{[]string{"a/x.txt:b/x.txt", "b/"}, "fail", 1},
+	&duplicateKeysCase{[]string{"a/x.txt", "a/x.txt", "a/"}, "fail", 0},
+	&duplicateKeysCase{[]string{"a/x.txt:x.txt", "b/x.txt:x.txt"}, "warn", 1},
+	&duplicateKeysCase{[]string{"a/x.txt:x.txt", "b/x.txt:x.txt"}, "allow", 0},
+}
+
+func writeDuplicateKeysFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"a/x.txt": "ax",
+		"a/y.txt": "ay",
+		"b/x.txt": "bx",
+		"b/y.txt": "by",
+	})
+}
+
+func duplicateKeysOpts(dir string, c *duplicateKeysCase) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = c.paths
+		opts.TargetPaths = []string{"one", "two"}
+		opts.DuplicateKeys = c.policy
+	}
+}
+
+func TestUploaderDuplicateKeys(t *testing.T) {
+	for _, c := range duplicateKeysCases {
+		dir := writeDuplicateKeysFiles(t)
+		defer os.RemoveAll(dir)
+
+		log, buf := getBufferLogger()
+		rp := &recordingProvider{}
+		u := getTestUploader(log, duplicateKeysOpts(dir, c))
+		u.Provider = rp
+
+		err := u.Upload()
+
+		// each duplicate key is reported once per target path
+		warnings := strings.Count(buf.String(), "more than one file would be uploaded to the same key")
+		if warnings != c.duplicates*2 {
+			t.Fatalf("%v %v: duplicate key warnings %v != %v\n%s", c.policy, c.paths, warnings, c.duplicates*2, buf.String())
+		}
+
+		if c.policy == "fail" && c.duplicates > 0 {
+			if err == nil {
+				t.Fatalf("%v: upload with duplicate keys succeeded", c.paths)
+			}
+
+			if len(rp.FullDests()) != 0 {
+				t.Fatalf("%v: artifacts were uploaded: %v", c.paths, rp.FullDests())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%v %v: unexpected error: %v", c.policy, c.paths, err)
+		}
+
+		if len(rp.FullDests()) == 0 {
+			t.Fatalf("%v %v: nothing was uploaded", c.policy, c.paths)
+		}
+	}
+}
+
+func TestUploaderDuplicateKeysReportsSources(t *testing.T) {
+	dir := writeDuplicateKeysFiles(t)
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	u := getTestUploader(log, duplicateKeysOpts(dir, duplicateKeysCases[0]))
+	u.Provider = &recordingProvider{}
+
+	err := u.Upload()
+	if err == nil {
+		t.Fatalf("upload with duplicate keys succeeded")
+	}
+
+	if !strings.Contains(err.Error(), `"one/x.txt"`) {
+		t.Fatalf("error does not give the key: %v", err)
+	}
+
+	for _, source := range []string{"a/x.txt", "b/x.txt"} {
+		if !strings.Contains(err.Error(), source) || !strings.Contains(buf.String(), source) {
+			t.Fatalf("source %v is not reported: %v\n%s", source, err, buf.String())
+		}
+	}
+}
+
+func TestUploaderDuplicateKeysWarnPassesThrough(t *testing.T) {
+	log, buf := getBufferLogger()
+	u := getTestUploader(log, func(opts *Options) {
+		opts.DuplicateKeys = "warn"
+	})
+
+	in := make(chan *artifact.Artifact)
+	out, err := u.checkDuplicateKeys(in)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// each artifact comes out before the next one goes in
+	for _, source := range []string{"a/x.txt", "b/x.txt"} {
+		in <- artifact.New("one", source, "x.txt", &artifact.Options{})
+		if a := <-out; a.Source != source {
+			t.Fatalf("passed through %v != %v", a.Source, source)
+		}
+	}
+	close(in)
+
+	if _, ok := <-out; ok {
+		t.Fatalf("more artifacts came out than went in")
+	}
+
+	if !strings.Contains(buf.String(), "a/x.txt, b/x.txt") {
+		t.Fatalf("duplicate key was not reported:\n%s", buf.String())
+	}
+}
+
+func TestValidateDuplicateKeysPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.DuplicateKeys = "explode"
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "--duplicate-keys") {
+		t.Fatalf("unknown --duplicate-keys policy was accepted: %v", err)
+	}
+}
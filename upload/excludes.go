@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const artifactsIgnoreFile = ".artifactsignore"
+
+// excludes skips walked paths matching gitignore-style globs relative to
+// the working dir.  A pattern without a "/" matches at any depth, a
+// leading "/" anchors it to the working dir, a trailing "/" matches the
+// directory and everything under it, and a leading "!" re-includes paths
+// excluded by an earlier pattern.
+type excludes struct {
+	Patterns []string
+}
+
+// newExcludes combines the patterns in the working dir's .artifactsignore,
+// if there is one, with those given as options, which come last
+func newExcludes(workingDir string, patterns []string) (*excludes, error) {
+	ex := &excludes{Patterns: []string{}}
+
+	f, err := os.Open(filepath.Join(workingDir, artifactsIgnoreFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			ex.Patterns = append(ex.Patterns, line)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			ex.Patterns = append(ex.Patterns, pattern)
+		}
+	}
+
+	return ex, nil
+}
+
+// Excluded reports whether the relative path is excluded, and by which
+// pattern, with the last matching pattern winning
+func (ex *excludes) Excluded(relPath string, isDir bool) (string, bool) {
+	relPath = filepath.ToSlash(relPath)
+	if relPath == "." || relPath == "" || path.IsAbs(relPath) {
+		return "", false
+	}
+
+	matched, excluded := "", false
+	for _, line := range ex.Patterns {
+		negated := strings.HasPrefix(line, "!")
+		pattern := strings.TrimPrefix(line, "!")
+
+		// a directory pattern only matches a file through its parent
+		target := relPath
+		if strings.HasSuffix(pattern, "/") && !isDir {
+			target = path.Dir(relPath)
+			if target == "." {
+				continue
+			}
+		}
+
+		if matchGlob(excludeGlob(pattern), target) {
+			matched, excluded = line, !negated
+		}
+	}
+
+	return matched, excluded
+}
+
+// excludeGlob turns a gitignore-style pattern into one for matchGlob
+func excludeGlob(pattern string) string {
+	pattern = filepath.ToSlash(strings.TrimPrefix(pattern, "./"))
+
+	if strings.HasPrefix(pattern, "/") {
+		return strings.TrimPrefix(pattern, "/")
+	}
+
+	if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+		return "**/" + pattern
+	}
+
+	return pattern
+}
+
+// includes limits the walked files to those matching any of the globs
+// given as --include, written as excludes are but without "!"
+type includes struct {
+	Patterns []string
+}
+
+// newIncludes is nil when no patterns are given, so that everything is
+// included
+func newIncludes(patterns []string) *includes {
+	in := &includes{Patterns: []string{}}
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			in.Patterns = append(in.Patterns, pattern)
+		}
+	}
+
+	if len(in.Patterns) == 0 {
+		return nil
+	}
+	return in
+}
+
+// Included reports whether the file at the relative path matches any
+// pattern, and which
+func (in *includes) Included(relPath string) (string, bool) {
+	if in == nil {
+		return "", true
+	}
+
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range in.Patterns {
+		target := relPath
+		if strings.HasSuffix(pattern, "/") {
+			target = path.Dir(relPath)
+			if target == "." {
+				continue
+			}
+		}
+
+		if matchGlob(excludeGlob(pattern), target) {
+			return pattern, true
+		}
+	}
+
+	return "", false
+}
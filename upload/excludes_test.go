@@ -0,0 +1,221 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type excludeCase struct {
+	pattern  string
+	path     string
+	isDir    bool
+	excluded bool
+}
+
+var excludeCases = []*excludeCase{
+	&excludeCase{"node_modules/", "node_modules", true, true},
+	&excludeCase{"node_modules/", "web/node_modules", true, true},
+	&excludeCase{"node_modules/", "node_modules/left-pad/index.js", false, true},
+	&excludeCase{"node_modules/", "node_modules", false, false},
+	&excludeCase{"*.log", "build.log", false, true},
+	&excludeCase{"*.log", "logs/build.log", false, true},
+	&excludeCase{"/*.log", "logs/build.log", false, false},
+	&excludeCase{"coverage/tmp", "coverage/tmp", true, true},
+	&excludeCase{"coverage/tmp", "web/coverage/tmp", true, false},
+	&excludeCase{"**/*.tmp", "a/b/c.tmp", false, true},
+	&excludeCase{"*.log", ".", true, false},
+	&excludeCase{"*.log", "/elsewhere/build.log", false, false},
+}
+
+func TestExcludesExcluded(t *testing.T) {
+	for _, c := range excludeCases {
+		ex := &excludes{Patterns: []string{c.pattern}}
+		_, excluded := ex.Excluded(c.path, c.isDir)
+		if excluded != c.excluded {
+			t.Errorf("%q excluding %q (dir %v): %v != %v", c.pattern, c.path, c.isDir, excluded, c.excluded)
+		}
+	}
+}
+
+func TestExcludesNegated(t *testing.T) {
+	ex := &excludes{Patterns: []string{"*.log", "!keep.log"}}
+
+	if pattern, excluded := ex.Excluded("drop.log", false); !excluded || pattern != "*.log" {
+		t.Fatalf("drop.log not excluded by *.log: %q %v", pattern, excluded)
+	}
+
+	if pattern, excluded := ex.Excluded("keep.log", false); excluded || pattern != "!keep.log" {
+		t.Fatalf("keep.log not re-included by !keep.log: %q %v", pattern, excluded)
+	}
+}
+
+func TestNewExcludes(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		".artifactsignore": "# deps\nnode_modules/\n\n.git/\n",
+	})
+	defer os.RemoveAll(dir)
+
+	ex, err := newExcludes(dir, []string{"*.tmp", " "})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"node_modules/", ".git/", "*.tmp"}
+	if !reflect.DeepEqual(ex.Patterns, expected) {
+		t.Fatalf("patterns %v != %v", ex.Patterns, expected)
+	}
+
+	empty, err := ioutil.TempDir("", "artifacts-test-excludes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+
+	ex, err = newExcludes(empty, nil)
+	if err != nil {
+		t.Fatalf("unexpected error without %s: %v", artifactsIgnoreFile, err)
+	}
+
+	if len(ex.Patterns) != 0 {
+		t.Fatalf("patterns without %s: %v", artifactsIgnoreFile, ex.Patterns)
+	}
+}
+
+func TestUploadExcludes(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		".artifactsignore":                 "node_modules/\n.git/\n*.log\n!keep.log\n",
+		"build/app.js":                     "app",
+		"build/node_modules/pad/index.js":  "pad",
+		"build/.git/HEAD":                  "ref: refs/heads/master",
+		"build/coverage/tmp/coverage.json": "{}",
+		"build/coverage/index.html":        "<html></html>",
+		"build/keep.log":                   "keep",
+		"build/drop.log":                   "drop",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"build/"}
+	opts.TargetPaths = []string{"builds/1"}
+	opts.Excludes = []string{"build/coverage/tmp/"}
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	uploaded := []string{}
+	for _, a := range rp.Uploaded {
+		uploaded = append(uploaded, a.FullDest())
+	}
+	sort.Strings(uploaded)
+
+	expected := []string{
+		"builds/1/build/app.js",
+		"builds/1/build/coverage/index.html",
+		"builds/1/build/keep.log",
+	}
+	if !reflect.DeepEqual(uploaded, expected) {
+		t.Fatalf("uploaded %v != %v", uploaded, expected)
+	}
+}
+
+func TestValidateOnlyExcludes(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		".artifactsignore":        "node_modules/\n",
+		"build/app.js":            "app",
+		"build/node_modules/a.js": "a",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"build/"}
+
+	count, err := ValidateOnly(opts, getPanicLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("count %v != 1", count)
+	}
+}
+
+func TestIncludesIncluded(t *testing.T) {
+	in := newIncludes([]string{"*.html", "reports/", "/coverage/*.json", " "})
+
+	for relPath, expected := range map[string]bool{
+		"index.html":            true,
+		"web/about.html":        true,
+		"reports/junit.xml":     true,
+		"web/reports/junit.xml": true,
+		"coverage/summary.json": true,
+		"web/coverage/sum.json": false,
+		"build/app.o":           false,
+		"reports":               false,
+		"logs/build.log":        false,
+	} {
+		if _, included := in.Included(relPath); included != expected {
+			t.Errorf("%q included %v != %v", relPath, included, expected)
+		}
+	}
+
+	none := newIncludes([]string{""})
+	if _, included := none.Included("anything.o"); !included {
+		t.Fatalf("file not included without any --include")
+	}
+}
+
+func TestUploadIncludes(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		".artifactsignore":    "*.skip.html\n",
+		"build/app.o":         "obj",
+		"build/build.log":     "log",
+		"build/index.html":    "<html></html>",
+		"build/old.skip.html": "<html></html>",
+		"build/docs/a.html":   "<html></html>",
+		"build/junit/a.xml":   "<xml/>",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"build/"}
+	opts.TargetPaths = []string{"builds/1"}
+	opts.Includes = []string{"*.html", "junit/"}
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	uploaded := []string{}
+	for _, a := range rp.Uploaded {
+		uploaded = append(uploaded, a.FullDest())
+	}
+	sort.Strings(uploaded)
+
+	expected := []string{
+		"builds/1/build/docs/a.html",
+		"builds/1/build/index.html",
+		"builds/1/build/junit/a.xml",
+	}
+	if !reflect.DeepEqual(uploaded, expected) {
+		t.Fatalf("uploaded %v != %v", uploaded, expected)
+	}
+}
@@ -0,0 +1,207 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// The categories of failure that --exit-code-map gives exit codes to
+const (
+	FailureValidation  = "validation"
+	FailureCredentials = "credentials"
+	FailureSizeLimit   = "size-limit"
+	FailurePartial     = "partial-failure"
+	FailureTotal       = "total-failure"
+	FailureTimeout     = "timeout"
+	FailureInterrupted = "interrupted"
+)
+
+// defaultExitCodes are the exit codes of the failure categories unless
+// --exit-code-map says otherwise.  Any other failure exits with 1.
+var defaultExitCodes = map[string]int{
+	FailureValidation:  2,
+	FailureCredentials: 3,
+	FailureSizeLimit:   4,
+	FailurePartial:     5,
+	FailureTotal:       6,
+	FailureTimeout:     7,
+	FailureInterrupted: 8,
+}
+
+// s3CredentialErrorCodes are the S3 error codes that mean the credentials
+// are wrong rather than that the request failed
+var s3CredentialErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"ExpiredToken":          true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// Error is a failure in one of the categories that have their own exit
+// codes
+type Error struct {
+	Category string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// categorize puts the error in the category, leaving nil alone
+func categorize(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Category: category, Err: err}
+}
+
+// FailureCategory is the category of the error, or "" if it has none
+func FailureCategory(err error) string {
+	var catErr *Error
+	if errors.As(err, &catErr) {
+		return catErr.Category
+	}
+
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) && s3CredentialErrorCodes[s3Err.Code] {
+		return FailureCredentials
+	}
+
+	return ""
+}
+
+// parseExitCodeMap parses comma-separated category=code pairs on top of
+// the default exit codes
+func parseExitCodeMap(s string) (map[string]int, error) {
+	codes := map[string]int{}
+	for category, code := range defaultExitCodes {
+		codes[category] = code
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid exit code mapping %q, expected category=code", pair)
+		}
+
+		category := strings.TrimSpace(parts[0])
+		if _, ok := defaultExitCodes[category]; !ok {
+			return nil, fmt.Errorf("unknown failure category %q (expected one of %s)",
+				category, strings.Join(failureCategories(), ", "))
+		}
+
+		code, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || code < 1 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code %q for %s, expected 1-255", parts[1], category)
+		}
+		codes[category] = code
+	}
+
+	return codes, nil
+}
+
+func failureCategories() []string {
+	categories := []string{}
+	for category := range defaultExitCodes {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// ExitCode is the exit code for the error under the --exit-code-map,
+// which is 0 without an error and 1 for errors outside of the failure
+// categories.  An invalid map falls back to the default exit codes.
+func ExitCode(err error, exitCodeMap string) int {
+	if err == nil {
+		return 0
+	}
+
+	codes, mapErr := parseExitCodeMap(exitCodeMap)
+	if mapErr != nil {
+		codes = defaultExitCodes
+	}
+
+	if code, ok := codes[FailureCategory(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// failureError categorizes the artifacts that failed to upload, if any.
+// Bad credentials outrank being interrupted, which outranks the retry
+// deadline and --timeout, which outrank how many artifacts failed, since
+// they say more about what to do next.
+func (u *uploader) failureError() error {
+	failed := u.failedResults()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	category := FailurePartial
+	if len(failed) == u.resultCount() {
+		category = FailureTotal
+	}
+	if u.interrupted() {
+		category = FailureInterrupted
+	}
+
+	for _, a := range failed {
+		switch {
+		case FailureCategory(a.UploadResult.Err) == FailureCredentials:
+			category = FailureCredentials
+		case (a.UploadResult.Err == errRetryDeadline || errors.Is(a.UploadResult.Err, context.DeadlineExceeded)) &&
+			category != FailureCredentials && category != FailureInterrupted:
+			category = FailureTimeout
+		}
+	}
+
+	if u.firstFailure != nil {
+		a := u.firstFailure
+		return categorize(category, fmt.Errorf("stopped after %s failed to upload (--fail-fast), %s: %v",
+			artifactSourceName(a), attemptsString(a), a.UploadResult.Err))
+	}
+
+	return categorize(category, &uploadFailures{Failed: failed, Total: u.resultCount()})
+}
+
+// uploadFailures lists every artifact that failed to upload, in order of
+// key, with the error of its last attempt
+type uploadFailures struct {
+	Failed []*artifact.Artifact
+	Total  int
+}
+
+func (uf *uploadFailures) Error() string {
+	failed := make([]*artifact.Artifact, len(uf.Failed))
+	copy(failed, uf.Failed)
+	sortArtifacts(failed)
+
+	details := []string{}
+	for _, a := range failed {
+		details = append(details, fmt.Sprintf("%s (%s): %v", a.FullDest(), attemptsString(a), a.UploadResult.Err))
+	}
+
+	return fmt.Sprintf("%d of %d artifacts failed to upload: %s", len(uf.Failed), uf.Total, strings.Join(details, "; "))
+}
+
+func attemptsString(a *artifact.Artifact) string {
+	if a.UploadResult.Attempts == 1 {
+		return "1 attempt"
+	}
+	return fmt.Sprintf("%d attempts", a.UploadResult.Attempts)
+}
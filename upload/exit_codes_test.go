@@ -0,0 +1,145 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{fmt.Errorf("boom"), 1},
+		{categorize(FailureValidation, fmt.Errorf("bad option")), 2},
+		{categorize(FailureCredentials, fmt.Errorf("no auth")), 3},
+		{categorize(FailureSizeLimit, fmt.Errorf("too big")), 4},
+		{categorize(FailurePartial, fmt.Errorf("some failed")), 5},
+		{categorize(FailureTotal, fmt.Errorf("all failed")), 6},
+		{categorize(FailureTimeout, fmt.Errorf("too slow")), 7},
+		{fmt.Errorf("wrapped: %w", categorize(FailureTimeout, fmt.Errorf("too slow"))), 7},
+		{categorize(FailureInterrupted, fmt.Errorf("interrupted")), 8},
+		{&s3.Error{StatusCode: 403, Code: "InvalidAccessKeyId"}, 3},
+		{&s3.Error{StatusCode: 500, Code: "InternalError"}, 1},
+	} {
+		if code := ExitCode(tc.err, ""); code != tc.code {
+			t.Fatalf("exit code for %v: %v != %v", tc.err, code, tc.code)
+		}
+	}
+}
+
+func TestExitCodeMap(t *testing.T) {
+	err := categorize(FailurePartial, fmt.Errorf("some failed"))
+
+	if code := ExitCode(err, "partial-failure=75, timeout=75"); code != 75 {
+		t.Fatalf("mapped exit code %v != 75", code)
+	}
+
+	if code := ExitCode(categorize(FailureTotal, err), "partial-failure=75"); code != 6 {
+		t.Fatalf("unmapped category exit code %v != 6", code)
+	}
+
+	if code := ExitCode(err, "wat=75"); code != 5 {
+		t.Fatalf("invalid map exit code %v != default 5", code)
+	}
+
+	for _, bad := range []string{"wat=3", "timeout", "timeout=0", "timeout=256", "timeout=x"} {
+		if _, err := parseExitCodeMap(bad); err == nil {
+			t.Fatalf("invalid exit code map %q was accepted", bad)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.ExitCodeMap = "wat=3"
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("invalid --exit-code-map was accepted")
+	}
+}
+
+// failingProvider fails every artifact with the same error
+type failingProvider struct {
+	recordingProvider
+	Err error
+}
+
+func (fp *failingProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		a.UploadResult.OK = false
+		a.UploadResult.Err = fp.Err
+		out <- a
+	}
+
+	done <- true
+}
+
+func exitCodeTestUpload(t *testing.T, configure func(*Options, *uploader)) int {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bb",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "b.txt"}
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{}
+	configure(opts, u)
+
+	err := u.Upload()
+	if err == nil {
+		err = u.failureError()
+	}
+	return ExitCode(err, "")
+}
+
+func TestUploadExitCodes(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		configure func(*Options, *uploader)
+		code      int
+	}{
+		{"success", func(opts *Options, u *uploader) {}, 0},
+		{"partial failure", func(opts *Options, u *uploader) {
+			u.Provider = &recordingProvider{FailSources: map[string]bool{
+				filepath.Join(opts.WorkingDir, "b.txt"): true,
+			}}
+		}, 5},
+		{"total failure", func(opts *Options, u *uploader) {
+			u.Provider = &failingProvider{Err: errUploadFailed}
+		}, 6},
+		{"credentials", func(opts *Options, u *uploader) {
+			u.Provider = &failingProvider{Err: &s3.Error{StatusCode: 403, Code: "SignatureDoesNotMatch"}}
+		}, 3},
+		{"size limit", func(opts *Options, u *uploader) {
+			opts.MaxSize = 3
+		}, 4},
+		{"timeout", func(opts *Options, u *uploader) {
+			opts.RetryDeadline = time.Nanosecond
+		}, 7},
+	} {
+		if code := exitCodeTestUpload(t, tc.configure); code != tc.code {
+			t.Fatalf("%s: exit code %v != %v", tc.desc, code, tc.code)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.DryRunFormat = "nope"
+	if code := ExitCode(opts.Validate(), ""); code != 2 {
+		t.Fatalf("validation: exit code %v != 2", code)
+	}
+}
@@ -0,0 +1,97 @@
+package upload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// countRange is the number of files --expected-count allows, inclusive
+type countRange struct {
+	Min uint64
+	Max uint64
+}
+
+func (cr *countRange) String() string {
+	if cr.Min == cr.Max {
+		return fmt.Sprintf("%d", cr.Min)
+	}
+	return fmt.Sprintf("%d-%d", cr.Min, cr.Max)
+}
+
+// Check fails unless the count is within the range
+func (cr *countRange) Check(count uint64) error {
+	if count >= cr.Min && count <= cr.Max {
+		return nil
+	}
+	return fmt.Errorf("expected %s files, but found %d", cr, count)
+}
+
+// parseExpectedCount parses either an exact count, e.g. "42", or an
+// inclusive range, e.g. "40-50", returning nil for ""
+func parseExpectedCount(value string) (*countRange, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	invalid := fmt.Errorf("invalid --expected-count %q (expected N or MIN-MAX)", value)
+
+	parts := strings.SplitN(value, "-", 2)
+	min, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+
+	max := min
+	if len(parts) == 2 {
+		max, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || max < min {
+			return nil, invalid
+		}
+	}
+
+	return &countRange{Min: min, Max: max}, nil
+}
+
+// checkExpectedCount resolves every artifact up front when
+// --expected-count is set, failing before anything is uploaded unless
+// the number of files is as expected.  A file uploaded to more than one
+// target path counts once.
+func (u *uploader) checkExpectedCount(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	expected, err := parseExpectedCount(u.Opts.ExpectedCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if expected == nil {
+		return in, nil
+	}
+
+	sources := map[string]bool{}
+	held := []*artifact.Artifact{}
+
+	for a := range in {
+		sources[artifactSourceName(a)] = true
+		held = append(held, a)
+	}
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	if err := expected.Check(uint64(len(sources))); err != nil {
+		return nil, err
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for _, a := range held {
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,107 @@
+package upload
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseExpectedCount(t *testing.T) {
+	for value, expected := range map[string]*countRange{
+		"":        nil,
+		"42":      &countRange{Min: 42, Max: 42},
+		"40-50":   &countRange{Min: 40, Max: 50},
+		" 0 - 3 ": &countRange{Min: 0, Max: 3},
+	} {
+		actual, err := parseExpectedCount(value)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", value, err)
+		}
+
+		if (actual == nil) != (expected == nil) || (actual != nil && *actual != *expected) {
+			t.Fatalf("expected count %q %#v != %#v", value, actual, expected)
+		}
+	}
+
+	for _, value := range []string{"lots", "-3", "5-", "50-40", "1-2-3"} {
+		_, err := parseExpectedCount(value)
+		if err == nil {
+			t.Fatalf("invalid expected count %q was accepted", value)
+		}
+	}
+}
+
+func uploadExpectingCount(t *testing.T, expected string) (*recordingProvider, error) {
+	dir := writeTestFiles(t, map[string]string{
+		"reports/a.xml": "a",
+		"reports/b.xml": "b",
+		"reports/c.xml": "c",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{dir}
+	opts.TargetPaths = []string{"one", "two"}
+	opts.ExpectedCount = expected
+
+	fake := &recordingProvider{}
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = fake
+	return fake, u.Upload()
+}
+
+func TestUploaderExpectedCountMatch(t *testing.T) {
+	for _, expected := range []string{"3", "2-4", "3-3"} {
+		fake, err := uploadExpectingCount(t, expected)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", expected, err)
+		}
+
+		if len(fake.Uploaded) != 6 {
+			t.Fatalf("uploaded %v != 6", len(fake.Uploaded))
+		}
+	}
+}
+
+func TestUploaderExpectedCountTooFew(t *testing.T) {
+	fake, err := uploadExpectingCount(t, "42")
+	if err == nil {
+		t.Fatalf("upload with too few files succeeded")
+	}
+
+	if err.Error() != "expected 42 files, but found 3" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fake.Uploaded) != 0 {
+		t.Fatalf("uploaded %v files despite the count", len(fake.Uploaded))
+	}
+}
+
+func TestUploaderExpectedCountTooMany(t *testing.T) {
+	fake, err := uploadExpectingCount(t, "1-2")
+	if err == nil {
+		t.Fatalf("upload with too many files succeeded")
+	}
+
+	if err.Error() != "expected 1-2 files, but found 3" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fake.Uploaded) != 0 {
+		t.Fatalf("uploaded %v files despite the count", len(fake.Uploaded))
+	}
+}
+
+func TestValidateOnlyExpectedCount(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	defer os.RemoveAll(dir)
+
+	opts := getValidateOnlyOptions(dir)
+	opts.ExpectedCount = "3-5"
+	_, err := ValidateOnly(opts, getPanicLogger())
+	if err == nil || err.Error() != "expected 3-5 files, but found 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
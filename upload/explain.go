@@ -0,0 +1,48 @@
+package upload
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// walkDecision records which rule caused a candidate file to be
+// included or excluded, for use with --explain
+type walkDecision struct {
+	Source   string
+	Included bool
+	Rule     string
+	Detail   string
+}
+
+func (d *walkDecision) String() string {
+	verb := "excluded"
+	if d.Included {
+		verb = "included"
+	}
+
+	return fmt.Sprintf("%s %s by %s (%s)", verb, d.Source, d.Rule, d.Detail)
+}
+
+// decide records and logs a decision about a candidate file when
+// explaining.  It is only called from the artifact feeder.
+func (u *uploader) decide(source string, included bool, rule, detail string) {
+	if !u.Opts.Explain {
+		return
+	}
+
+	d := &walkDecision{
+		Source:   source,
+		Included: included,
+		Rule:     rule,
+		Detail:   detail,
+	}
+	u.decisions = append(u.decisions, d)
+
+	u.log.WithFields(logrus.Fields{
+		"source":   d.Source,
+		"included": d.Included,
+		"rule":     d.Rule,
+		"detail":   d.Detail,
+	}).Info(fmt.Sprintf("explain: %s", d))
+}
@@ -0,0 +1,82 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploaderExplain(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":   "a",
+		"big.bin": "0123456789",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.Paths = []string{dir}
+	opts.TargetPaths = []string{"explained"}
+	opts.MaxSize = 5
+	opts.Explain = true
+
+	u := newUploader(opts, getPanicLogger())
+	if u.Upload() == nil {
+		t.Fatalf("max-size was not enforced")
+	}
+
+	if len(u.decisions) != 2 {
+		t.Fatalf("decisions length %v != 2: %v", len(u.decisions), u.decisions)
+	}
+
+	for i, expected := range []*walkDecision{
+		&walkDecision{filepath.Join(dir, "a.txt"), true, "path", dir},
+		&walkDecision{filepath.Join(dir, "big.bin"), false, "max-size", "5B"},
+	} {
+		actual := u.decisions[i]
+		if *actual != *expected {
+			t.Fatalf("decision %v != %v", actual, expected)
+		}
+	}
+}
+
+func TestUploaderExplainUnreadable(t *testing.T) {
+	u := getTestUploader(nil, walkErrorOpts(writeWalkErrorFiles(t), true))
+	u.Opts.Explain = true
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := map[string]string{}
+	for _, d := range u.decisions {
+		rules[filepath.Base(d.Source)] = d.Rule
+	}
+
+	for base, rule := range map[string]string{
+		"ok":         "path",
+		"unreadable": "unreadable",
+		"locked":     "unreadable",
+	} {
+		if rules[base] != rule {
+			t.Fatalf("rule for %v %q != %q", base, rules[base], rule)
+		}
+	}
+}
+
+func TestUploaderNoExplain(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"a.txt": "a"})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.Paths = []string{dir}
+
+	u := newUploader(opts, getPanicLogger())
+	u.Upload()
+
+	if len(u.decisions) != 0 {
+		t.Fatalf("decisions recorded without explain: %v", u.decisions)
+	}
+}
@@ -0,0 +1,54 @@
+package upload
+
+import (
+	"context"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// failsFast is --fail-fast, or --on-error fail
+func (opts *Options) failsFast() bool {
+	return opts.FailFast || opts.OnError == "fail"
+}
+
+// startFailFast derives a context for the workers that --fail-fast
+// cancels at the first failure, stopping the uploads in flight along with
+// the rest
+func (opts *Options) startFailFast(ctx context.Context) (context.Context, func()) {
+	if !opts.failsFast() {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	opts.ctx = ctx
+	return ctx, cancel
+}
+
+// failedFast notes the first artifact to fail with --fail-fast, returning
+// true if the upload should stop because of it
+func (u *uploader) failedFast(a *artifact.Artifact) bool {
+	if !u.Opts.failsFast() || a.UploadResult.OK || u.firstFailure != nil || isCanceled(a.UploadResult.Err) {
+		return false
+	}
+
+	u.firstFailure = a
+	u.log.WithFields(logrus.Fields{
+		"artifact": artifactSourceName(a),
+		"err":      a.UploadResult.Err,
+	}).Error("stopping at the first failure (--fail-fast)")
+	return true
+}
+
+// sortArtifacts puts artifacts in order of key, and source for the same
+// key, so that what's reported doesn't depend on which worker finished
+// first
+func sortArtifacts(artifacts []*artifact.Artifact) {
+	sort.SliceStable(artifacts, func(i, j int) bool {
+		if artifacts[i].FullDest() != artifacts[j].FullDest() {
+			return artifacts[i].FullDest() < artifacts[j].FullDest()
+		}
+		return artifactSourceName(artifacts[i]) < artifactSourceName(artifacts[j])
+	})
+}
@@ -0,0 +1,187 @@
+package upload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// attemptingProvider fails its FailSources after Attempts tries, waiting
+// for the upload to be canceled after each failure, and fails anything
+// after that as canceled the way requests in flight are
+type attemptingProvider struct {
+	recordingProvider
+	Attempts uint64
+}
+
+func (ap *attemptingProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		ap.Lock()
+		ap.Uploaded = append(ap.Uploaded, a)
+		ap.Unlock()
+
+		switch {
+		case ctx.Err() != nil:
+			a.UploadResult.Attempts = 1
+			a.UploadResult.Err = ctx.Err()
+			out <- a
+		case ap.FailSources[a.Source]:
+			a.UploadResult.Attempts = ap.Attempts
+			a.UploadResult.Err = errUploadFailed
+			out <- a
+
+			if opts.FailFast {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		default:
+			a.UploadResult.Attempts = 1
+			a.UploadResult.OK = true
+			out <- a
+		}
+	}
+
+	done <- true
+}
+
+func failFastOpts(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"builds/1"}
+		opts.Concurrency = 1
+	}
+}
+
+func writeFailFastFiles(t *testing.T) string {
+	os.Clearenv()
+	return writeTestFiles(t, map[string]string{
+		"out/a.txt": "a",
+		"out/b.txt": "b",
+		"out/c.txt": "c",
+		"out/d.txt": "d",
+		"out/e.txt": "e",
+	})
+}
+
+func newAttemptingProvider(dir string, failing ...string) *attemptingProvider {
+	ap := &attemptingProvider{Attempts: 3, recordingProvider: recordingProvider{FailSources: map[string]bool{}}}
+	for _, name := range failing {
+		ap.FailSources[filepath.Join(dir, "out", name)] = true
+	}
+	return ap
+}
+
+func TestUploadFailuresListed(t *testing.T) {
+	dir := writeFailFastFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		failFastOpts(dir)(opts)
+		opts.Concurrency = 3
+	})
+	ap := newAttemptingProvider(dir, "d.txt", "b.txt")
+	u.Provider = ap
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(ap.Uploaded) != 5 {
+		t.Fatalf("uploaded %v instead of every file", ap.FullDests())
+	}
+
+	err := u.failureError()
+	if FailureCategory(err) != FailurePartial {
+		t.Fatalf("error %v is not a partial failure", err)
+	}
+
+	expected := "2 of 5 artifacts failed to upload: " +
+		"builds/1/out/b.txt (3 attempts): upload failed; " +
+		"builds/1/out/d.txt (3 attempts): upload failed"
+	if err.Error() != expected {
+		t.Fatalf("error %q != %q", err.Error(), expected)
+	}
+
+	keys := []string{}
+	for _, a := range u.results {
+		keys = append(keys, a.FullDest())
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatalf("results %v are not sorted", keys)
+	}
+}
+
+func TestUploadFailFast(t *testing.T) {
+	dir := writeFailFastFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		failFastOpts(dir)(opts)
+		opts.FailFast = true
+	})
+	u.Provider = newAttemptingProvider(dir, "b.txt")
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, a := range u.results {
+		switch a.FullDest() {
+		case "builds/1/out/a.txt":
+			if !a.UploadResult.OK {
+				t.Fatalf("a.txt failed before b.txt: %v", a.UploadResult.Err)
+			}
+		case "builds/1/out/b.txt":
+			if a.UploadResult.Err != errUploadFailed {
+				t.Fatalf("unexpected b.txt error: %v", a.UploadResult.Err)
+			}
+		default:
+			if !isCanceled(a.UploadResult.Err) {
+				t.Fatalf("%s was not canceled after b.txt failed: %v", a.FullDest(), a.UploadResult.Err)
+			}
+		}
+	}
+
+	err := u.failureError()
+	if err == nil || !strings.HasPrefix(err.Error(), "stopped after "+filepath.Join(dir, "out/b.txt")+" failed to upload (--fail-fast), 3 attempts") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if FailureCategory(err) != FailurePartial {
+		t.Fatalf("error %v is not a partial failure", err)
+	}
+}
+
+func TestUploadOnErrorFail(t *testing.T) {
+	dir := writeFailFastFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		failFastOpts(dir)(opts)
+		opts.OnError = "fail"
+	})
+	u.Provider = newAttemptingProvider(dir, "b.txt")
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := u.failureError(); err == nil || !strings.HasPrefix(err.Error(), "stopped after ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.OnError = "ignore"
+	if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "invalid --on-error") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
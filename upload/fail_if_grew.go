@@ -0,0 +1,149 @@
+package upload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// growthTolerance is how much larger than its object an artifact may be
+// with --fail-if-grew, either a number of bytes or a percentage of the
+// object's size
+type growthTolerance struct {
+	Bytes   uint64
+	Percent float64
+}
+
+// parseGrowthTolerance parses e.g. "10KB" or "5%", with "" allowing no
+// growth at all
+func parseGrowthTolerance(s string) (*growthTolerance, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return &growthTolerance{}, nil
+	}
+
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent < 0 {
+			return nil, fmt.Errorf("invalid --fail-if-grew-tolerance %q", s)
+		}
+		return &growthTolerance{Percent: percent}, nil
+	}
+
+	bytes, err := humanize.ParseBytes(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --fail-if-grew-tolerance %q", s)
+	}
+	return &growthTolerance{Bytes: bytes}, nil
+}
+
+// Allows reports whether going from the remote size to the local size is
+// within the tolerance
+func (gt *growthTolerance) Allows(local, remote uint64) bool {
+	if local <= remote {
+		return true
+	}
+
+	if gt.Percent > 0 {
+		return float64(local-remote) <= float64(remote)*gt.Percent/100
+	}
+
+	return local-remote <= gt.Bytes
+}
+
+// failIfGrew reports whether --fail-if-grew covers the path, which is all
+// paths unless --fail-if-grew-paths narrows it down
+func (u *uploader) failIfGrew(relPath string) bool {
+	if !u.Opts.FailIfGrew {
+		return false
+	}
+
+	if len(u.Opts.FailIfGrewPaths) == 0 {
+		return true
+	}
+
+	for _, pattern := range u.Opts.FailIfGrewPaths {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// grewFilter fails the artifacts covered by --fail-if-grew that are larger
+// than the objects they would overwrite by more than the tolerance,
+// sending them straight to failed.  Artifacts without an object yet have
+// nothing to grow from and are passed along.
+func (u *uploader) grewFilter(in chan *artifact.Artifact, failed chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if !u.Opts.FailIfGrew || u.Opts.DryRun {
+		return in, nil
+	}
+
+	fetcher, ok := u.Provider.(HeaderFetcher)
+	if !ok {
+		return nil, fmt.Errorf("--fail-if-grew is not supported by the %s provider", u.Provider.Name())
+	}
+
+	tolerance, err := parseGrowthTolerance(u.Opts.FailIfGrewTolerance)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			if err := u.checkGrowth(fetcher, tolerance, a); err != nil {
+				a.UploadResult.OK = false
+				a.UploadResult.Err = err
+				failed <- a
+				continue
+			}
+
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
+
+func (u *uploader) checkGrowth(fetcher HeaderFetcher, tolerance *growthTolerance, a *artifact.Artifact) error {
+	relPath := a.Dest
+	if a.Source != "" {
+		relPath = relToWorkingDir(u.Opts.WorkingDir, a.Source)
+	}
+
+	if !u.failIfGrew(relPath) {
+		return nil
+	}
+
+	headers, err := fetcher.FetchHeaders(u.Opts, a)
+	if err != nil {
+		u.log.WithFields(logrus.Fields{
+			"key": a.FullDest(),
+			"err": err,
+		}).Debug("no remote object to compare size with")
+		return nil
+	}
+
+	remote, err := strconv.ParseUint(headers.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	local, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	if !tolerance.Allows(local, remote) {
+		return fmt.Errorf("grew from %s to %s, more than --fail-if-grew allows",
+			humanize.Bytes(remote), humanize.Bytes(local))
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func grewTestUpload(t *testing.T, dir string, configure func(*Options)) map[string]bool {
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"fail-if-grew-test"}
+		configure(opts)
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ok := map[string]bool{}
+	for _, a := range u.results {
+		ok[filepath.Base(a.Source)] = a.UploadResult.OK
+	}
+	return ok
+}
+
+func writeGrewTestFile(t *testing.T, dir, name string, size int) {
+	err := ioutil.WriteFile(filepath.Join(dir, "out", name), []byte(strings.Repeat("x", size)), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func failedNames(ok map[string]bool) []string {
+	names := []string{}
+	for name, uploaded := range ok {
+		if !uploaded {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestUploadFailIfGrew(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"out/grew.js":   strings.Repeat("x", 100),
+		"out/shrank.js": strings.Repeat("x", 100),
+		"out/within.js": strings.Repeat("x", 100),
+		"out/new.js":    "",
+	})
+	defer os.RemoveAll(dir)
+
+	grewTestUpload(t, dir, func(opts *Options) {})
+
+	writeGrewTestFile(t, dir, "grew.js", 120)
+	writeGrewTestFile(t, dir, "shrank.js", 80)
+	writeGrewTestFile(t, dir, "within.js", 105)
+	writeGrewTestFile(t, dir, "brand-new.js", 500)
+
+	ok := grewTestUpload(t, dir, func(opts *Options) {
+		opts.FailIfGrew = true
+		opts.FailIfGrewTolerance = "10%"
+	})
+
+	if len(ok) != 5 {
+		t.Fatalf("results %v != 5 artifacts", ok)
+	}
+
+	failed := failedNames(ok)
+	if len(failed) != 1 || failed[0] != "grew.js" {
+		t.Fatalf("failed %v != [grew.js]", failed)
+	}
+
+	ok = grewTestUpload(t, dir, func(opts *Options) {
+		opts.FailIfGrew = true
+	})
+
+	failed = failedNames(ok)
+	if len(failed) != 1 || failed[0] != "grew.js" {
+		t.Fatalf("failed %v != [grew.js] after the other objects were overwritten", failed)
+	}
+}
+
+func TestUploadFailIfGrewPaths(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"out/app.min.js": "x",
+		"out/notes.txt":  "x",
+	})
+	defer os.RemoveAll(dir)
+
+	grewTestUpload(t, dir, func(opts *Options) {})
+
+	writeGrewTestFile(t, dir, "app.min.js", 10)
+	writeGrewTestFile(t, dir, "notes.txt", 10)
+
+	ok := grewTestUpload(t, dir, func(opts *Options) {
+		opts.FailIfGrew = true
+		opts.FailIfGrewPaths = []string{"**/*.min.js"}
+	})
+
+	failed := failedNames(ok)
+	if len(failed) != 1 || failed[0] != "app.min.js" {
+		t.Fatalf("failed %v != [app.min.js]", failed)
+	}
+}
+
+func TestGrowthTolerance(t *testing.T) {
+	for _, tc := range []struct {
+		tolerance     string
+		local, remote uint64
+		allowed       bool
+	}{
+		{"", 100, 100, true},
+		{"", 101, 100, false},
+		{"", 50, 100, true},
+		{"10B", 110, 100, true},
+		{"10B", 111, 100, false},
+		{"1KB", 1100, 100, true},
+		{"5%", 105, 100, true},
+		{"5%", 106, 100, false},
+		{"5%", 1, 0, false},
+	} {
+		gt, err := parseGrowthTolerance(tc.tolerance)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if gt.Allows(tc.local, tc.remote) != tc.allowed {
+			t.Fatalf("%q: %v -> %v allowed != %v", tc.tolerance, tc.remote, tc.local, tc.allowed)
+		}
+	}
+
+	for _, bad := range []string{"lots", "-5%", "%"} {
+		if _, err := parseGrowthTolerance(bad); err == nil {
+			t.Fatalf("invalid tolerance %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// fanout reports whether --upload-provider names more than one provider,
+// e.g. "s3,artifacts", for each artifact to be uploaded to all of them
+func (opts *Options) fanout() bool {
+	return strings.Contains(opts.Provider, ",")
+}
+
+// providerList is each provider named by --upload-provider
+func (opts *Options) providerList() []string {
+	names := []string{}
+	for _, name := range strings.Split(opts.Provider, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// providerOption is one --provider-option, setting an option for the
+// named provider alone
+type providerOption struct {
+	Provider  string
+	FieldName string
+	Value     string
+}
+
+// parseProviderOption parses a --provider-option of the form
+// provider.option=value, where the option is a long flag name without the
+// dashes in front, e.g. artifacts.target-paths=builds
+func parseProviderOption(s string) (*providerOption, error) {
+	parts := strings.SplitN(s, "=", 2)
+	nameParts := strings.SplitN(parts[0], ".", 2)
+	if len(parts) != 2 || len(nameParts) != 2 || nameParts[0] == "" || nameParts[1] == "" {
+		return nil, fmt.Errorf("invalid --provider-option %q, expected provider.option=value", s)
+	}
+
+	key := strings.Replace(nameParts[1], "-", "_", -1)
+	fieldName, ok := configFieldNames()[key]
+	if !ok {
+		return nil, fmt.Errorf("--provider-option %q has an unknown option %q", s, nameParts[1])
+	}
+
+	if fieldName == "Provider" || fieldName == "ProviderOptions" {
+		return nil, fmt.Errorf("--provider-option %q cannot set --%s", s, nameParts[1])
+	}
+
+	return &providerOption{Provider: nameParts[0], FieldName: fieldName, Value: parts[1]}, nil
+}
+
+// destinationOptions are the options for one provider of a fan-out, which
+// are the usual options with that provider's --provider-option values
+// over them.  Any that are invalid are left out, and the first of them is
+// returned along with the options.
+func (opts *Options) destinationOptions(name string) (*Options, error) {
+	destOpts := *opts
+	destOpts.Provider = name
+
+	var firstErr error
+	s := reflect.ValueOf(&destOpts).Elem()
+	for _, raw := range opts.ProviderOptions {
+		po, err := parseProviderOption(raw)
+		if err == nil && po.Provider != name {
+			continue
+		}
+		if err == nil {
+			err = setConfigField(s.FieldByName(po.FieldName), po.FieldName, po.Value)
+			if err != nil {
+				err = fmt.Errorf("--provider-option %q: %v", raw, err)
+			}
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if po.FieldName == "Retries" {
+			destOpts.retriesSet = true
+		}
+		if po.FieldName == "RetryInterval" {
+			destOpts.retryIntervalSet = true
+		}
+	}
+
+	return &destOpts, firstErr
+}
+
+func (opts *Options) validateFanout() error {
+	names := opts.providerList()
+	if len(names) < 2 {
+		return fmt.Errorf("invalid --upload-provider %q, expected providers separated by commas", opts.Provider)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := lookupProvider(name); !ok {
+			return fmt.Errorf("unknown --upload-provider %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("--upload-provider %q names %s more than once", opts.Provider, name)
+		}
+		seen[name] = true
+	}
+
+	for _, raw := range opts.ProviderOptions {
+		po, err := parseProviderOption(raw)
+		if err != nil {
+			return err
+		}
+		if !seen[po.Provider] {
+			return fmt.Errorf("--provider-option %q is for %s, which is not an --upload-provider", raw, po.Provider)
+		}
+	}
+
+	// a stream can only be read once, and each destination reads it
+	if opts.readsStdin() && (opts.StdinSize > 0 || opts.StdinStream) {
+		return fmt.Errorf("stdin cannot be streamed to several providers, leave out --stdin-size and --stdin-stream")
+	}
+
+	for _, name := range names {
+		destOpts, err := opts.destinationOptions(name)
+		if err != nil {
+			return err
+		}
+		if len(destOpts.TargetPaths) != len(opts.TargetPaths) {
+			return fmt.Errorf("%s: --provider-option target-paths must give as many target paths as --target-paths", name)
+		}
+		if err := destOpts.validateProvider(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// fanoutDestination is one of the providers that a fan-out uploads to
+type fanoutDestination struct {
+	Name     string
+	Provider Provider
+	Opts     *Options
+
+	Uploaded int
+	Failed   int
+}
+
+// fanoutProvider uploads each artifact to every provider of a fan-out at
+// once.  The artifact is walked, filtered, and checksummed once, and each
+// destination gets a copy of it with a result of its own, which makes up
+// the artifact's result: it is uploaded once every destination has it,
+// and fails with the errors of those that don't.
+type fanoutProvider struct {
+	opts *Options
+	log  *logrus.Logger
+
+	dests []*fanoutDestination
+
+	// observe, if set, is given each destination's copy as it finishes,
+	// for --metrics-file and --statsd-addr
+	observe func(a *artifact.Artifact, provider string)
+
+	sync.Mutex
+}
+
+func newFanoutProvider(opts *Options, log *logrus.Logger) Provider {
+	fp := &fanoutProvider{opts: opts, log: log}
+
+	for _, name := range opts.providerList() {
+		destOpts, err := opts.destinationOptions(name)
+		if err != nil {
+			log.WithField("err", err).Warn("ignoring invalid provider option")
+		}
+		if !reflect.DeepEqual(destOpts.TargetPaths, opts.TargetPaths) {
+			destOpts.TargetPaths = resolveTargetPaths(expandTargetPaths(destOpts, log), log)
+		}
+
+		p := newProvider(destOpts, log)
+		destOpts.applyRetryDefaults(p)
+
+		fp.dests = append(fp.dests, &fanoutDestination{Name: name, Provider: p, Opts: destOpts})
+	}
+
+	return fp
+}
+
+// Upload starts a worker of each destination's provider, and hands each
+// of them a copy of every artifact
+func (fp *fanoutProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	ins := make([]chan *artifact.Artifact, len(fp.dests))
+	outs := make([]chan *artifact.Artifact, len(fp.dests))
+	dones := make([]chan bool, len(fp.dests))
+	for i, dest := range fp.dests {
+		ins[i] = make(chan *artifact.Artifact)
+		outs[i] = make(chan *artifact.Artifact)
+		dones[i] = make(chan bool)
+		go dest.Provider.Upload(ctx, fmt.Sprintf("%s-%s", id, dest.Name), dest.Opts, ins[i], outs[i], dones[i])
+	}
+
+	for a := range in {
+		copies := make([]*artifact.Artifact, len(fp.dests))
+		wg := &sync.WaitGroup{}
+		for i, dest := range fp.dests {
+			copies[i] = a.Copy()
+			copies[i].Prefix = fp.destinationPrefix(dest, a.Prefix)
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ins[i] <- copies[i]
+				<-outs[i]
+			}(i)
+		}
+		wg.Wait()
+
+		fp.merge(a, copies)
+		out <- a
+	}
+
+	for i := range fp.dests {
+		close(ins[i])
+		<-dones[i]
+	}
+	done <- true
+}
+
+// destinationPrefix is the destination's own target path in place of the
+// usual one, for target paths given with --provider-option
+func (fp *fanoutProvider) destinationPrefix(dest *fanoutDestination, prefix string) string {
+	for i, targetPath := range fp.opts.TargetPaths {
+		if targetPath == prefix && i < len(dest.Opts.TargetPaths) {
+			return dest.Opts.TargetPaths[i]
+		}
+	}
+	return prefix
+}
+
+// merge fills in the artifact's result from those of its copies, taking
+// the url of the first destination
+func (fp *fanoutProvider) merge(a *artifact.Artifact, copies []*artifact.Artifact) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	var err error
+	for i, c := range copies {
+		dest := fp.dests[i]
+		if c.UploadResult.OK {
+			dest.Uploaded++
+		} else {
+			// the first error is kept whole, e.g. to tell a cancel
+			dest.Failed++
+			if err == nil {
+				err = fmt.Errorf("%s: %w", dest.Name, c.UploadResult.Err)
+			} else {
+				err = fmt.Errorf("%w; %s: %v", err, dest.Name, c.UploadResult.Err)
+			}
+		}
+
+		// the destinations are uploaded to at once, so the slowest of them
+		// is how long the artifact took
+		if c.UploadResult.Duration > a.UploadResult.Duration {
+			a.UploadResult.Duration = c.UploadResult.Duration
+		}
+		if c.UploadResult.Attempts > a.UploadResult.Attempts {
+			a.UploadResult.Attempts = c.UploadResult.Attempts
+		}
+
+		if fp.observe != nil {
+			fp.observe(c, dest.Name)
+		}
+	}
+
+	first := copies[0].UploadResult
+	a.UploadResult.URL = first.URL
+	a.UploadResult.SignedURL = first.SignedURL
+
+	a.UploadResult.OK = err == nil
+	a.UploadResult.Err = err
+}
+
+// providerStoresMetadata reports whether the provider stores --metadata,
+// which a fan-out does if any of its destinations do
+func providerStoresMetadata(p Provider) bool {
+	if fp, ok := p.(*fanoutProvider); ok {
+		for _, dest := range fp.dests {
+			if providerStoresMetadata(dest.Provider) {
+				return true
+			}
+		}
+		return false
+	}
+
+	_, ok := p.(metadataStorer)
+	return ok
+}
+
+func (fp *fanoutProvider) Name() string {
+	names := []string{}
+	for _, dest := range fp.dests {
+		names = append(names, dest.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Finish finishes each destination's provider that needs it
+func (fp *fanoutProvider) Finish(opts *Options) error {
+	for _, dest := range fp.dests {
+		if finisher, ok := dest.Provider.(uploadFinisher); ok {
+			if err := finisher.Finish(dest.Opts); err != nil {
+				return fmt.Errorf("%s: %v", dest.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// LogCounts logs how many artifacts each destination has, and how many
+// failed to get there
+func (fp *fanoutProvider) LogCounts() {
+	fp.Lock()
+	defer fp.Unlock()
+
+	for _, dest := range fp.dests {
+		fp.log.WithFields(logrus.Fields{
+			"destination": dest.Name,
+			"uploaded":    dest.Uploaded,
+			"failed":      dest.Failed,
+		}).Info("uploaded to destination")
+	}
+}
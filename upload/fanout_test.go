@@ -0,0 +1,132 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fanoutTestOpts(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "s3,file"
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"fanout-test"}
+		opts.ProviderOptions = []string{
+			"file.file-root=" + filepath.Join(dir, "share"),
+			"file.target-paths=mirror",
+		}
+	}
+}
+
+func TestUploaderFanout(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+		"out/b.txt": "bbbb",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, fanoutTestOpts(dir))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.results) != 2 {
+		t.Fatalf("results %v != 2", len(u.results))
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		b, err := testS3.Bucket("bucket").Get("fanout-test/out/" + name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if name == "a.txt" && string(b) != "aaaa" {
+			t.Fatalf("s3 %s content %q != aaaa", name, b)
+		}
+
+		if _, err := ioutil.ReadFile(filepath.Join(dir, "share/mirror/out", name)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for _, dest := range u.Provider.(*fanoutProvider).dests {
+		if dest.Uploaded != 2 || dest.Failed != 0 {
+			t.Fatalf("%s uploaded %v, failed %v", dest.Name, dest.Uploaded, dest.Failed)
+		}
+	}
+}
+
+func TestUploaderFanoutFailed(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, fanoutTestOpts(dir))
+	fp := u.Provider.(*fanoutProvider)
+	fp.dests[0].Provider = newNullProvider([]string{filepath.Join(dir, "out/a.txt")}, getPanicLogger())
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a := u.results[0]
+	if a.UploadResult.OK || a.UploadResult.Err == nil || a.UploadResult.Err.Error() != "s3: upload failed" {
+		t.Fatalf("unexpected result: %#v", a.UploadResult)
+	}
+
+	// the other destination has it all the same
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "share/mirror/out/a.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fp.dests[0].Failed != 1 || fp.dests[1].Uploaded != 1 {
+		t.Fatalf("s3 failed %v, file uploaded %v", fp.dests[0].Failed, fp.dests[1].Uploaded)
+	}
+}
+
+func TestValidateFanout(t *testing.T) {
+	for _, tc := range []struct {
+		provider string
+		options  []string
+		msg      string
+	}{
+		{"s3,nope", nil, `unknown --upload-provider "nope"`},
+		{"null,null", nil, "names null more than once"},
+		{"null,file", []string{"file.file-root"}, "expected provider.option=value"},
+		{"null,file", []string{"file.nope=1"}, `unknown option "nope"`},
+		{"null,file", []string{"file.upload-provider=s3"}, "cannot set --upload-provider"},
+		{"null,file", []string{"s3.bucket=other"}, "which is not an --upload-provider"},
+		{"null,file", []string{"file.retries=many", "file.file-root=/tmp"}, `"file.retries=many"`},
+		{"null,file", []string{"file.file-root=/tmp", "file.target-paths=a:b"}, "as many target paths"},
+		{"null,file", nil, "file: no destination root given"},
+	} {
+		opts := NewOptions()
+		opts.Provider = tc.provider
+		opts.ProviderOptions = tc.options
+
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%v %v: unexpected error: %v", tc.provider, tc.options, err)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Provider = "null,file"
+	opts.ProviderOptions = []string{"file.file-root=/tmp", "file.retries=1"}
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	destOpts, err := opts.destinationOptions("file")
+	if err != nil || destOpts.FileRoot != "/tmp" || destOpts.Retries != 1 || !destOpts.retriesSet {
+		t.Fatalf("file options %#v, err %v", destOpts, err)
+	}
+	if opts.FileRoot != "" || opts.Retries == 1 {
+		t.Fatalf("the usual options were changed")
+	}
+}
@@ -0,0 +1,209 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// fileProvider copies each artifact to its key under a local directory,
+// such as a network share or a build cache, by writing a temporary file
+// next to it and renaming that into place, so that nothing reading the
+// directory sees a partial artifact
+type fileProvider struct {
+	RetryInterval time.Duration
+
+	opts *Options
+	log  *logrus.Logger
+}
+
+func newFileProvider(opts *Options, log *logrus.Logger) *fileProvider {
+	return &fileProvider{
+		RetryInterval: opts.retryInterval(defaultProviderRetryInterval),
+
+		opts: opts,
+		log:  log,
+	}
+}
+
+// fileRoot is --file-root, or else --bucket
+func (opts *Options) fileRoot() string {
+	if opts.FileRoot != "" {
+		return opts.FileRoot
+	}
+	return opts.BucketName
+}
+
+func (fp *fileProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		start := time.Now()
+		err := fp.uploadFile(ctx, opts, a)
+		a.UploadResult.Duration = time.Since(start)
+		if err != nil {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = err
+		} else {
+			a.UploadResult.OK = true
+		}
+		out <- a
+	}
+
+	done <- true
+	return
+}
+
+func (fp *fileProvider) uploadFile(ctx context.Context, opts *Options, a *artifact.Artifact) error {
+	retries := uint64(0)
+
+	for {
+		a.UploadResult.Attempts++
+		err := fp.rawUpload(opts, a)
+		if err == nil {
+			return nil
+		}
+		if retryable(err) && retries < opts.Retries &&
+			!opts.pastRetryDeadline() && ctx.Err() == nil && !a.IsStream() {
+			retries++
+			sleep := opts.retryBackoff(fp.RetryInterval, retries)
+			fp.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+func (fp *fileProvider) rawUpload(opts *Options, a *artifact.Artifact) error {
+	root, err := filepath.Abs(opts.fileRoot())
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(root, filepath.FromSlash(a.FullDest()))
+	if rel, err := filepath.Rel(root, dest); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return categorize(FailureValidation, fmt.Errorf("key %q is outside of %s", a.FullDest(), root))
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	a.UploadResult.URL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(dest)}).String()
+
+	fp.log.WithFields(logrus.Fields{
+		"download_url": a.UploadResult.URL,
+	}).Info(fmt.Sprintf("uploading: %s (size: %d)", a.Source, size))
+
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	reader, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(dest)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = copyPooled(tmp, reader)
+	if err == nil && opts.FileFsync {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), localFileMode(a)); err != nil {
+		return err
+	}
+
+	if modTime, err := a.ModTime(); err == nil && !modTime.IsZero() {
+		os.Chtimes(tmp.Name(), modTime, modTime)
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+	renamed = true
+
+	if opts.FileFsync {
+		// the rename itself is only durable once the directory is synced
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	fp.log.WithField("path", dest).Debug("copied artifact")
+	return nil
+}
+
+// localFileMode is the permissions of the artifact's source file, for
+// providers that write files, or 0644 for generated artifacts
+func localFileMode(a *artifact.Artifact) os.FileMode {
+	if a.Source != "" {
+		if fi, err := os.Stat(a.Source); err == nil && fi.Mode().IsRegular() {
+			return fi.Mode().Perm()
+		}
+	}
+	return 0644
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RetryDefaults are no retries, since a local filesystem that failed to
+// take a file once will most likely fail again, although --retries still
+// applies for network shares
+func (fp *fileProvider) RetryDefaults() (uint64, time.Duration) {
+	return 0, defaultProviderRetryInterval
+}
+
+func (fp *fileProvider) Name() string {
+	return "file"
+}
@@ -0,0 +1,116 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestFileProviderUpload(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"build/bin/tool":            "#!/bin/sh\n",
+		"build/logs/test.log":       "ok\n",
+		"share/1/1.1/logs/test.log": "stale\n",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Chmod(filepath.Join(dir, "build/bin/tool"), 0755)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "file"
+		opts.FileRoot = filepath.Join(dir, "share")
+		opts.FileFsync = true
+		opts.WorkingDir = dir
+		opts.Paths = []string{"build/"}
+		opts.TargetPaths = []string{"1/1.1"}
+		opts.GenerateIndex = true
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, expected := range map[string]string{
+		"1/1.1/build/bin/tool":      "#!/bin/sh\n",
+		"1/1.1/build/logs/test.log": "ok\n",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "share", name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(b) != expected {
+			t.Fatalf("%s content %q != %q", name, string(b), expected)
+		}
+	}
+
+	for name, expected := range map[string]os.FileMode{
+		"1/1.1/build/bin/tool": 0755,
+		"1/1.1/index.html":     0644,
+	} {
+		fi, err := os.Stat(filepath.Join(dir, "share", name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode().Perm() != expected {
+			t.Fatalf("%s mode %v != %v", name, fi.Mode().Perm(), expected)
+		}
+	}
+
+	// a file that was there but isn't an artifact of this run is kept
+	if _, err := os.Stat(filepath.Join(dir, "share/1/1.1/logs/test.log")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	filepath.Walk(filepath.Join(dir, "share"), func(p string, fi os.FileInfo, err error) error {
+		if strings.Contains(filepath.Base(p), ".tmp") {
+			t.Fatalf("temporary file left behind: %s", p)
+		}
+		return nil
+	})
+
+	for _, a := range u.results {
+		expected := "file://" + filepath.ToSlash(filepath.Join(dir, "share", a.FullDest()))
+		if a.UploadResult.URL != expected {
+			t.Fatalf("url %q != %q", a.UploadResult.URL, expected)
+		}
+	}
+}
+
+func TestFileProviderOutsideRoot(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "file"
+	opts.FileRoot = filepath.Join(dir, "share")
+
+	fp := newFileProvider(opts, getPanicLogger())
+	err := fp.rawUpload(opts, artifact.NewFromBytes("", "../escaped", []byte("x"), &artifact.Options{}))
+	if err == nil || FailureCategory(err) != FailureValidation {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+		t.Fatalf("artifact was written outside of the root")
+	}
+}
+
+func TestValidateFileRoot(t *testing.T) {
+	opts := NewOptions()
+	opts.Provider = "file"
+	opts.BucketName = ""
+
+	if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "no destination root given") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.BucketName = "/tmp/artifacts"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dustin/go-humanize"
+)
+
+// freeDiskSpace returns the bytes available to us on the filesystem the
+// dir is on, and is a var so that tests can fake a full disk
+var freeDiskSpace = diskFree
+
+// tempDir is --temp-dir, or the system temp dir if it isn't set
+func (opts *Options) tempDir() string {
+	if opts.TempDir != "" {
+		return opts.TempDir
+	}
+	return os.TempDir()
+}
+
+// checkFreeDisk fails if writing need bytes of temp files would leave
+// less than --min-free-disk free, where need may be 0 if the size isn't
+// known up front
+func (opts *Options) checkFreeDisk(need uint64) error {
+	if opts.MinFreeDisk == 0 {
+		return nil
+	}
+
+	dir := opts.tempDir()
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return fmt.Errorf("could not check free disk space in %s: %v", dir, err)
+	}
+
+	if free < need+opts.MinFreeDisk {
+		return fmt.Errorf("not enough free disk space in %s for temp files: %s free, need %s plus --min-free-disk %s",
+			dir, humanize.Bytes(free), humanize.Bytes(need), humanize.Bytes(opts.MinFreeDisk))
+	}
+
+	return nil
+}
+
+// tempFile creates a temp file under the temp dir once there is room for
+// need more bytes, and tracks it for removal at the end of the upload
+func (u *uploader) tempFile(prefix string, need uint64) (*os.File, error) {
+	if err := u.Opts.checkFreeDisk(need); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(u.Opts.tempDir(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	u.tempFilesLock.Lock()
+	u.tempFiles = append(u.tempFiles, f.Name())
+	u.tempFilesLock.Unlock()
+	return f, nil
+}
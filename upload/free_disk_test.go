@@ -0,0 +1,100 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func fakeFreeDiskSpace(free uint64) func() {
+	orig := freeDiskSpace
+	freeDiskSpace = func(dir string) (uint64, error) {
+		return free, nil
+	}
+	return func() { freeDiskSpace = orig }
+}
+
+func TestCheckFreeDisk(t *testing.T) {
+	defer fakeFreeDiskSpace(100)()
+
+	opts := NewOptions()
+	if err := opts.checkFreeDisk(1000); err != nil {
+		t.Fatalf("check ran without --min-free-disk: %v", err)
+	}
+
+	opts.MinFreeDisk = 50
+	if err := opts.checkFreeDisk(50); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := opts.checkFreeDisk(51)
+	if err == nil {
+		t.Fatalf("low free space was not caught")
+	}
+
+	if !strings.Contains(err.Error(), "100B free, need 51B plus --min-free-disk 50B") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploaderStdinTempDir(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	tempDir, err := ioutil.TempDir("", "artifacts-temp-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	u := getTestUploader(nil, stdinTestOpts(dir, 0))
+	u.stdin = strings.NewReader("buffered")
+	u.Opts.TempDir = tempDir
+
+	f, err := u.tempFile("artifacts-test", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+
+	if !strings.HasPrefix(f.Name(), tempDir) {
+		t.Fatalf("temp file %v is not under %v", f.Name(), tempDir)
+	}
+
+	u.removeTempFiles()
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Fatalf("temp file was not removed: %v", err)
+	}
+}
+
+func TestUploaderStdinLowFreeDisk(t *testing.T) {
+	defer fakeFreeDiskSpace(1024)()
+
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, stdinTestOpts(dir, 0))
+	u.stdin = strings.NewReader("buffered")
+	u.Opts.TargetPaths = []string{"stdin-low-disk"}
+	u.Opts.MinFreeDisk = 4096
+
+	err := u.Upload()
+	if err == nil || !strings.Contains(err.Error(), "not enough free disk space") {
+		t.Fatalf("low free space did not fail the upload: %v", err)
+	}
+
+	if _, err := testS3.Bucket("bucket").Get("stdin-low-disk/from-stdin.txt"); err == nil {
+		t.Fatalf("stdin was uploaded")
+	}
+}
+
+func TestValidateTempDir(t *testing.T) {
+	opts := NewOptions()
+	opts.TempDir = "/nonexistent/artifacts-temp"
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "temp dir") {
+		t.Fatalf("missing temp dir was accepted: %v", err)
+	}
+}
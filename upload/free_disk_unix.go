@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package upload
+
+import "syscall"
+
+func diskFree(dir string) (uint64, error) {
+	st := &syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,188 @@
+package upload
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	gcsTokenScope      = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsTokenGrant      = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	gcsDefaultTokenURI = "https://oauth2.googleapis.com/token"
+
+	// gcsTokenSlack is how long before it expires that a token is
+	// exchanged for a fresh one, so that none expires mid-upload
+	gcsTokenSlack = time.Minute
+)
+
+// gcsServiceAccount is as much of a service account JSON key as is
+// needed to sign for an access token
+type gcsServiceAccount struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// loadGCSServiceAccount reads --gcs-credentials, which is either the JSON
+// key itself or the path to a file holding it
+func loadGCSServiceAccount(credentials string) (*gcsServiceAccount, error) {
+	b := []byte(credentials)
+	if !strings.HasPrefix(strings.TrimSpace(credentials), "{") {
+		var err error
+		b, err = ioutil.ReadFile(credentials)
+		if err != nil {
+			return nil, fmt.Errorf("gcs credentials cannot be read: %v", err)
+		}
+	}
+
+	sa := &gcsServiceAccount{}
+	if err := json.Unmarshal(b, sa); err != nil {
+		return nil, fmt.Errorf("invalid gcs credentials: %v", err)
+	}
+
+	if sa.Type != "service_account" {
+		return nil, fmt.Errorf("gcs credentials are of type %q, expected a service_account key", sa.Type)
+	}
+
+	if sa.ClientEmail == "" {
+		return nil, fmt.Errorf("gcs credentials have no client_email")
+	}
+
+	if sa.TokenURI == "" {
+		sa.TokenURI = gcsDefaultTokenURI
+	}
+
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("gcs credentials have no pem private_key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid gcs credentials private_key: %v", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("gcs credentials private_key is not an rsa key")
+	}
+
+	sa.key = rsaKey
+	return sa, nil
+}
+
+// assertion is the signed JWT that the token endpoint exchanges for an
+// access token
+func (sa *gcsServiceAccount) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": sa.PrivateKeyID,
+	})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": gcsTokenScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// accessToken is --gcs-token if given, or else a token for the service
+// account in --gcs-credentials, which is kept until shortly before it
+// expires
+func (gp *gcsProvider) accessToken() (string, error) {
+	if gp.opts.GCSToken != "" || gp.opts.GCSCredentials == "" {
+		return gp.opts.GCSToken, nil
+	}
+
+	gp.tokenLock.Lock()
+	defer gp.tokenLock.Unlock()
+
+	if gp.token != "" && time.Now().Before(gp.tokenExpiry) {
+		return gp.token, nil
+	}
+
+	if gp.account == nil {
+		sa, err := loadGCSServiceAccount(gp.opts.GCSCredentials)
+		if err != nil {
+			return "", categorize(FailureCredentials, err)
+		}
+		gp.account = sa
+	}
+
+	token, expiry, err := gp.exchangeToken(gp.account)
+	if err != nil {
+		return "", err
+	}
+
+	gp.log.WithField("client_email", gp.account.ClientEmail).Debug("got gcs access token")
+	gp.token, gp.tokenExpiry = token, expiry
+	return token, nil
+}
+
+func (gp *gcsProvider) exchangeToken(sa *gcsServiceAccount) (string, time.Time, error) {
+	now := time.Now()
+	assertion, err := sa.assertion(now)
+	if err != nil {
+		return "", time.Time{}, categorize(FailureCredentials, err)
+	}
+
+	resp, err := gp.client.PostForm(sa.TokenURI, url.Values{
+		"grant_type": []string{gcsTokenGrant},
+		"assertion":  []string{assertion},
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("gcs token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("gcs token request failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			return "", time.Time{}, categorize(FailureCredentials, err)
+		}
+		return "", time.Time{}, err
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("gcs token response has no access_token")
+	}
+
+	return token.AccessToken, now.Add(time.Duration(token.ExpiresIn)*time.Second - gcsTokenSlack), nil
+}
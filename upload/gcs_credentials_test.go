@@ -0,0 +1,205 @@
+package upload
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGCSTokens is a token endpoint that checks each assertion against
+// the service account's public key
+type fakeGCSTokens struct {
+	srv *httptest.Server
+	key *rsa.PublicKey
+
+	lock     sync.Mutex
+	requests int
+	claims   map[string]interface{}
+}
+
+func newFakeGCSTokens(key *rsa.PublicKey) *fakeGCSTokens {
+	ft := &fakeGCSTokens{key: key}
+	ft.srv = httptest.NewServer(ft)
+	return ft
+}
+
+func (ft *fakeGCSTokens) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.requests++
+
+	if r.FormValue("grant_type") != gcsTokenGrant {
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.Split(r.FormValue("assertion"), ".")
+	if len(parts) != 3 {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(ft.key, crypto.SHA256, sum[:], sig); err != nil {
+		http.Error(w, `{"error": "invalid_grant", "error_description": "Invalid JWT Signature."}`, http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(claims, &ft.claims)
+	fmt.Fprintf(w, `{"access_token": "sa-token", "expires_in": 3599, "token_type": "Bearer"}`)
+}
+
+func testServiceAccountKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return key
+}
+
+func writeTestServiceAccount(t *testing.T, dir string, key *rsa.PrivateKey, tokenURI string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "uploader@project.iam.gserviceaccount.com",
+		"private_key_id": "abc123",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+
+	path := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestGCSProviderServiceAccount(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{
+		"report.html": "<html></html>",
+		"build.log":   "ok",
+	})
+	defer os.RemoveAll(dir)
+
+	keyDir, _ := ioutil.TempDir("", "artifacts-gcs-key")
+	defer os.RemoveAll(keyDir)
+
+	key := testServiceAccountKey(t)
+	ft := newFakeGCSTokens(&key.PublicKey)
+	defer ft.srv.Close()
+	keyPath := writeTestServiceAccount(t, keyDir, key, ft.srv.URL+"/token")
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "report.html", "build.log"))
+	u.Opts.GCSToken = ""
+	u.Opts.GCSCredentials = keyPath
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("upload failed: %v", u.failedResults()[0].UploadResult.Err)
+	}
+
+	if len(fg.tokens) != 2 {
+		t.Fatalf("uploads %v != 2", len(fg.tokens))
+	}
+
+	for _, token := range fg.tokens {
+		if token != "Bearer sa-token" {
+			t.Fatalf("authorization %q != Bearer sa-token", token)
+		}
+	}
+
+	if ft.requests != 1 {
+		t.Fatalf("token requests %v != 1", ft.requests)
+	}
+
+	if ft.claims["iss"] != "uploader@project.iam.gserviceaccount.com" ||
+		ft.claims["scope"] != gcsTokenScope || ft.claims["aud"] != ft.srv.URL+"/token" {
+		t.Fatalf("unexpected claims: %v", ft.claims)
+	}
+}
+
+func TestGCSProviderServiceAccountRejected(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"build.log": "ok"})
+	defer os.RemoveAll(dir)
+
+	ft := newFakeGCSTokens(&testServiceAccountKey(t).PublicKey)
+	defer ft.srv.Close()
+
+	keyDir, _ := ioutil.TempDir("", "artifacts-gcs-key")
+	defer os.RemoveAll(keyDir)
+	keyPath := writeTestServiceAccount(t, keyDir, testServiceAccountKey(t), ft.srv.URL+"/token")
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "build.log"))
+	u.Opts.GCSToken = ""
+	u.Opts.GCSCredentials = keyPath
+	u.Upload()
+
+	failed := u.failedResults()
+	if len(failed) != 1 || FailureCategory(failed[0].UploadResult.Err) != FailureCredentials {
+		t.Fatalf("unexpected results: %v", failed)
+	}
+
+	if ft.requests != 1 || len(fg.tokens) != 0 {
+		t.Fatalf("rejected credentials were retried or used: %v token requests, %v uploads", ft.requests, len(fg.tokens))
+	}
+}
+
+func TestLoadGCSServiceAccount(t *testing.T) {
+	keyDir, _ := ioutil.TempDir("", "artifacts-gcs-key")
+	defer os.RemoveAll(keyDir)
+
+	keyPath := writeTestServiceAccount(t, keyDir, testServiceAccountKey(t), "")
+	b, _ := ioutil.ReadFile(keyPath)
+
+	for _, credentials := range []string{keyPath, string(b)} {
+		sa, err := loadGCSServiceAccount(credentials)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if sa.TokenURI != gcsDefaultTokenURI || sa.key == nil {
+			t.Fatalf("unexpected service account: %#v", sa)
+		}
+	}
+
+	for credentials, expected := range map[string]string{
+		`{"type": "authorized_user"}`: `gcs credentials are of type "authorized_user", expected a service_account key`,
+		`{"type": "service_account", "client_email": "a@b", "private_key": "nope"}`: "gcs credentials have no pem private_key",
+		filepath.Join(keyDir, "missing.json"):                                       "gcs credentials cannot be read: ",
+	} {
+		_, err := loadGCSServiceAccount(credentials)
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("unexpected error for %s: %v", credentials, err)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var errGCSPreconditionFailed = fmt.Errorf("object generation does not match --if-generation-match")
+
+// gcsPredefinedACLs are the predefined ACLs of objects for each of the
+// canned ACLs of --permissions that has one
+var gcsPredefinedACLs = map[string]string{
+	"private":                   "private",
+	"public-read":               "publicRead",
+	"authenticated-read":        "authenticatedRead",
+	"bucket-owner-read":         "bucketOwnerRead",
+	"bucket-owner-full-control": "bucketOwnerFullControl",
+	"project-private":           "projectPrivate",
+}
+
+// gcsObject is the object resource of the Cloud Storage JSON API, as
+// much of it as is sent or read back
+type gcsObject struct {
+	Name               string            `json:"name"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Generation         string            `json:"generation,omitempty"`
+	Size               string            `json:"size,omitempty"`
+	Updated            string            `json:"updated,omitempty"`
+}
+
+// gcsProvider uploads each artifact as an object in a Google Cloud
+// Storage bucket with the JSON API's multipart upload, so that its
+// metadata goes along with its content in a single request
+type gcsProvider struct {
+	RetryInterval time.Duration
+
+	opts   *Options
+	log    *logrus.Logger
+	client *http.Client
+
+	tokenLock   sync.Mutex
+	account     *gcsServiceAccount
+	token       string
+	tokenExpiry time.Time
+}
+
+func newGCSProvider(opts *Options, log *logrus.Logger) *gcsProvider {
+	return &gcsProvider{
+		RetryInterval: opts.retryInterval(defaultProviderRetryInterval),
+
+		opts:   opts,
+		log:    log,
+		client: opts.httpClient(),
+	}
+}
+
+func (opts *Options) validateGCS() error {
+	if opts.BucketName == "" {
+		return fmt.Errorf("no bucket name given")
+	}
+
+	if opts.IfGenerationMatch != "" {
+		if _, err := strconv.ParseUint(opts.IfGenerationMatch, 10, 64); err != nil {
+			return fmt.Errorf("invalid --if-generation-match %q, expected a generation number", opts.IfGenerationMatch)
+		}
+	}
+
+	if _, ok := gcsPredefinedACLs[opts.Perm]; !ok && !opts.InheritBucketACL {
+		return fmt.Errorf("--permissions %q has no gcs equivalent", opts.Perm)
+	}
+
+	if opts.GCSToken == "" && opts.GCSCredentials != "" {
+		if _, err := loadGCSServiceAccount(opts.GCSCredentials); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (gp *gcsProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		start := time.Now()
+		err := gp.uploadFile(ctx, opts, a)
+		a.UploadResult.Duration = time.Since(start)
+		if err != nil {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = err
+		} else {
+			a.UploadResult.OK = true
+		}
+		out <- a
+	}
+
+	done <- true
+	return
+}
+
+func (gp *gcsProvider) uploadFile(ctx context.Context, opts *Options, a *artifact.Artifact) error {
+	retries := uint64(0)
+
+	for {
+		a.UploadResult.Attempts++
+		err := gp.rawUpload(opts, a)
+		if err == nil {
+			return nil
+		}
+		// neither a generation mismatch nor bad credentials nor a rejected
+		// request will go away by trying again
+		if err != errGCSPreconditionFailed && retryable(err) && retries < opts.Retries &&
+			!opts.pastRetryDeadline() && ctx.Err() == nil && !a.IsStream() {
+			retries++
+			sleep := opts.retryBackoff(gp.RetryInterval, retries)
+			gp.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+func (gp *gcsProvider) rawUpload(opts *Options, a *artifact.Artifact) error {
+	key := a.FullDest()
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	withoutDigest, deferred := withoutDigestMetadata(opts.Metadata, a)
+	metadata, err := resolveMetadata(withoutDigest, a)
+	if err != nil {
+		return err
+	}
+
+	object := &gcsObject{
+		Name:               key,
+		ContentType:        a.ContentType(),
+		ContentEncoding:    a.ContentEncoding,
+		ContentDisposition: a.ContentDisposition,
+		CacheControl:       cacheControl(opts, a),
+		Metadata:           metadata,
+	}
+
+	token, err := gp.accessToken()
+	if err != nil {
+		return err
+	}
+
+	a.UploadResult.URL = strings.TrimRight(opts.GCSEndpoint, "/") + "/" + opts.BucketName + "/" + key
+
+	gp.log.WithFields(logrus.Fields{
+		"download_url": a.UploadResult.URL,
+	}).Info(fmt.Sprintf("uploading: %s (size: %d)", a.Source, size))
+
+	reader, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	body, ctype := gcsMultipartBody(object, reader)
+
+	req, err := http.NewRequest("POST", gp.uploadURL(opts, key), body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+
+	req.Header.Set("Content-Type", ctype)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := gp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		gp.log.WithFields(logrus.Fields{
+			"key":                 key,
+			"if_generation_match": opts.IfGenerationMatch,
+		}).Error("object generation does not match")
+		return errGCSPreconditionFailed
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("gcs upload failed: %s %s", resp.Status, strings.TrimSpace(string(respBody)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return categorize(FailureCredentials, err)
+		}
+		return err
+	}
+
+	stored := &gcsObject{}
+	if err := json.NewDecoder(resp.Body).Decode(stored); err == nil {
+		gp.log.WithFields(logrus.Fields{
+			"key":        key,
+			"generation": stored.Generation,
+		}).Debug("uploaded gcs object")
+	}
+
+	if deferred {
+		return gp.patchMetadata(opts, a, token)
+	}
+
+	return nil
+}
+
+// patchMetadata stores the object's metadata again once the upload has
+// hashed the content, for the metadata using {sha256}
+func (gp *gcsProvider) patchMetadata(opts *Options, a *artifact.Artifact, token string) error {
+	key := a.FullDest()
+	metadata, err := resolveMetadata(opts.Metadata, a)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/storage/v1/b/%s/o/%s",
+		strings.TrimRight(opts.GCSEndpoint, "/"), url.PathEscape(opts.BucketName), url.PathEscape(key)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := gp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gcs metadata update of %s failed: %s", key, resp.Status)
+	}
+
+	gp.log.WithField("key", key).Debug("stored metadata with the uploaded digest")
+	return nil
+}
+
+func (gp *gcsProvider) uploadURL(opts *Options, key string) string {
+	q := url.Values{}
+	q.Set("uploadType", "multipart")
+	q.Set("name", key)
+	if opts.IfGenerationMatch != "" {
+		q.Set("ifGenerationMatch", opts.IfGenerationMatch)
+	}
+	if !opts.InheritBucketACL {
+		q.Set("predefinedAcl", gcsPredefinedACLs[opts.Perm])
+	}
+
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s",
+		strings.TrimRight(opts.GCSEndpoint, "/"), url.PathEscape(opts.BucketName), q.Encode())
+}
+
+// gcsMultipartBody streams the object's metadata followed by its content
+// as a multipart/related body, returning the body and its content type
+func gcsMultipartBody(object *gcsObject, content io.Reader) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": []string{"application/json; charset=UTF-8"},
+		})
+		if err == nil {
+			err = json.NewEncoder(part).Encode(object)
+		}
+
+		if err == nil {
+			part, err = mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": []string{object.ContentType},
+			})
+		}
+
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+
+		if err == nil {
+			err = mw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, "multipart/related; boundary=" + mw.Boundary()
+}
+
+func (gp *gcsProvider) Name() string {
+	return "gcs"
+}
+
+func (gp *gcsProvider) storesMetadata() {}
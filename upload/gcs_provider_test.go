@@ -0,0 +1,407 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeGCSObject struct {
+	Object     *gcsObject
+	Content    []byte
+	Generation uint64
+}
+
+// fakeGCS implements just enough of the JSON API to upload objects, with
+// generation preconditions, and list and delete them, listing two to a
+// page
+type fakeGCS struct {
+	srv *httptest.Server
+
+	lock       sync.Mutex
+	objects    map[string]*fakeGCSObject
+	generation uint64
+	tokens     []string
+	acls       map[string]string
+}
+
+func newFakeGCS() *fakeGCS {
+	fg := &fakeGCS{objects: map[string]*fakeGCSObject{}, acls: map[string]string{}}
+	fg.srv = httptest.NewServer(fg)
+	return fg
+}
+
+func (fg *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+
+	fg.tokens = append(fg.tokens, r.Header.Get("Authorization"))
+
+	if r.Method == "GET" && r.URL.Path == "/storage/v1/b/bucket/o" {
+		fg.list(w, r)
+		return
+	}
+
+	if name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"); r.Method == "PATCH" && name != r.URL.Path {
+		object, ok := fg.objects[name]
+		patch := &gcsObject{}
+		if !ok || json.NewDecoder(r.Body).Decode(patch) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if object.Object.Metadata == nil {
+			object.Object.Metadata = map[string]string{}
+		}
+		for k, v := range patch.Metadata {
+			object.Object.Metadata[k] = v
+		}
+		json.NewEncoder(w).Encode(object.Object)
+		return
+	}
+
+	if name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"); r.Method == "DELETE" && name != r.URL.Path {
+		if _, ok := fg.objects[name]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(fg.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != "POST" || r.URL.Path != "/upload/storage/v1/b/bucket/o" ||
+		r.URL.Query().Get("uploadType") != "multipart" {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	existing, exists := fg.objects[name]
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" {
+		generation, _ := strconv.ParseUint(match, 10, 64)
+		if (generation == 0 && exists) || (generation != 0 && (!exists || existing.Generation != generation)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, `{"error": {"code": 412, "message": "conditionNotMet"}}`)
+			return
+		}
+	}
+
+	object, content, err := readGCSMultipart(r)
+	if err != nil || object.Name != name {
+		http.Error(w, fmt.Sprintf("bad upload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	fg.generation++
+	fg.acls[name] = r.URL.Query().Get("predefinedAcl")
+	fg.objects[name] = &fakeGCSObject{Object: object, Content: content, Generation: fg.generation}
+	json.NewEncoder(w).Encode(&gcsObject{Name: name, Generation: fmt.Sprintf("%d", fg.generation)})
+}
+
+func (fg *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	prefix, delim := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+
+	names := []string{}
+	seen := map[string]bool{}
+	for name := range fg.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], delim); delim != "" && i >= 0 {
+			name = name[:len(prefix)+i+len(delim)]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	page := map[string]interface{}{}
+	items, prefixes := []*gcsObject{}, []string{}
+	for i := start; i < len(names) && i < start+2; i++ {
+		object, ok := fg.objects[names[i]]
+		if !ok {
+			prefixes = append(prefixes, names[i])
+			continue
+		}
+		items = append(items, &gcsObject{
+			Name:        names[i],
+			ContentType: object.Object.ContentType,
+			Size:        fmt.Sprintf("%d", len(object.Content)),
+			Updated:     "2014-10-14T12:00:00.000Z",
+		})
+	}
+	page["items"], page["prefixes"] = items, prefixes
+	if start+2 < len(names) {
+		page["nextPageToken"] = fmt.Sprintf("%d", start+2)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func readGCSMultipart(r *http.Request) (*gcsObject, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		return nil, nil, fmt.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	object := &gcsObject{}
+	if err := json.NewDecoder(part).Decode(object); err != nil {
+		return nil, nil, err
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if part.Header.Get("Content-Type") != object.ContentType {
+		return nil, nil, fmt.Errorf("content part type %q != %q", part.Header.Get("Content-Type"), object.ContentType)
+	}
+
+	content, err := ioutil.ReadAll(part)
+	return object, content, err
+}
+
+func gcsTestOpts(fg *fakeGCS, dir, generation string, paths ...string) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "gcs"
+		opts.BucketName = "bucket"
+		opts.GCSEndpoint = fg.srv.URL
+		opts.GCSToken = "sekrit"
+		opts.WorkingDir = dir
+		opts.Paths = paths
+		opts.TargetPaths = []string{"gcs"}
+		opts.IfGenerationMatch = generation
+		opts.Retries = 2
+	}
+}
+
+func TestGCSProviderUpload(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{
+		"report.html": "<html></html>",
+		"build.log":   "ok",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "report.html", "build.log"))
+	u.Opts.CacheControl = "private"
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("upload failed: %v", u.failedResults()[0].UploadResult.Err)
+	}
+
+	obj := fg.objects["gcs/report.html"]
+	if obj == nil {
+		t.Fatalf("report was not uploaded: %v", fg.objects)
+	}
+
+	if string(obj.Content) != "<html></html>" {
+		t.Fatalf("content %q != <html></html>", obj.Content)
+	}
+
+	if obj.Object.ContentType != "text/html; charset=utf-8" || obj.Object.CacheControl != "private" {
+		t.Fatalf("unexpected metadata: %#v", obj.Object)
+	}
+
+	for _, token := range fg.tokens {
+		if token != "Bearer sekrit" {
+			t.Fatalf("authorization %q != Bearer sekrit", token)
+		}
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.URL != fg.srv.URL+"/bucket/"+a.FullDest() {
+			t.Fatalf("unexpected url %v", a.UploadResult.URL)
+		}
+	}
+}
+
+func TestGCSProviderDigestMetadata(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"build.log": "ok"})
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "build.log"))
+	u.Opts.Metadata = []string{"sum={sha256}", "name={basename}"}
+	if err := u.Upload(); err != nil || len(u.failedResults()) != 0 {
+		t.Fatalf("unexpected error: %v %v", err, u.failedResults())
+	}
+
+	// the digest is only known once the upload has read the content
+	obj := fg.objects["gcs/build.log"]
+	if obj == nil || obj.Object.Metadata["name"] != "build.log" ||
+		obj.Object.Metadata["sum"] != "2689367b205c16ce32ed4200942b8b8b1e262dfc70d9bc9fbc77c49699a4f1df" {
+		t.Fatalf("unexpected metadata: %#v", obj)
+	}
+}
+
+func TestGCSProviderIfGenerationMatch(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{
+		"report.html": "<html></html>",
+		"build.log":   "ok",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "0", "report.html", "build.log"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("create-only upload of new objects failed: %v", u.failedResults()[0].UploadResult.Err)
+	}
+
+	requests := len(fg.tokens)
+
+	u = getTestUploader(nil, gcsTestOpts(fg, dir, "0", "report.html", "build.log"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	failed := u.failedResults()
+	if len(failed) != 2 {
+		t.Fatalf("failed results %v != 2", len(failed))
+	}
+
+	for _, a := range failed {
+		if a.UploadResult.Err != errGCSPreconditionFailed {
+			t.Fatalf("unexpected error: %v", a.UploadResult.Err)
+		}
+
+		if status, _ := uploadStatus(a); status != "conflict" {
+			t.Fatalf("status %q != conflict", status)
+		}
+	}
+
+	if len(fg.tokens)-requests != 2 {
+		t.Fatalf("conflicts were retried: %v requests != 2", len(fg.tokens)-requests)
+	}
+
+	generation := fg.objects["gcs/build.log"].Generation
+	u = getTestUploader(nil, gcsTestOpts(fg, dir, fmt.Sprintf("%d", generation), "build.log"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("upload at the current generation failed: %v", u.failedResults()[0].UploadResult.Err)
+	}
+
+	if fg.objects["gcs/build.log"].Generation == generation {
+		t.Fatalf("object was not replaced")
+	}
+}
+
+func TestValidateIfGenerationMatch(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.BucketName = "bucket"
+	opts.IfGenerationMatch = "0"
+
+	err := opts.Validate()
+	if err == nil || err.Error() != "--if-generation-match only works with the gcs provider" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.Provider = "s3"
+	opts.AccessKey = "whatever"
+	opts.SecretKey = "whatever"
+	err = opts.Validate()
+	if err == nil || err.Error() != "--if-generation-match only works with the gcs provider" {
+		t.Fatalf("unexpected error with the s3 provider: %v", err)
+	}
+
+	opts.Provider = "gcs"
+	opts.IfGenerationMatch = "latest"
+	err = opts.Validate()
+	if err == nil || err.Error() != `invalid --if-generation-match "latest", expected a generation number` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.IfGenerationMatch = "1234"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGCSProviderPredefinedACL(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"build.log": "ok"})
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		Perm    string
+		Inherit bool
+		ACL     string
+	}{
+		{"private", false, "private"},
+		{"public-read", false, "publicRead"},
+		{"bucket-owner-full-control", false, "bucketOwnerFullControl"},
+		{"public-read", true, ""},
+	} {
+		os.Clearenv()
+		u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "build.log"))
+		u.Opts.Perm = c.Perm
+		u.Opts.InheritBucketACL = c.Inherit
+		if err := u.Upload(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if acl := fg.acls["gcs/build.log"]; acl != c.ACL {
+			t.Fatalf("predefinedAcl for %v (inherit %v) %q != %q", c.Perm, c.Inherit, acl, c.ACL)
+		}
+	}
+}
+
+func TestValidateGCSPermissions(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "gcs"
+	opts.BucketName = "bucket"
+	opts.Perm = "public-read-write"
+
+	err := opts.Validate()
+	if err == nil || err.Error() != `--permissions "public-read-write" has no gcs equivalent` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.InheritBucketACL = true
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
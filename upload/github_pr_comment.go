@@ -0,0 +1,245 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// githubCommentMarker identifies the comment to update on re-runs
+	githubCommentMarker = "<!-- travis-ci/artifacts -->"
+
+	githubCommentsPerPage = 100
+
+	// githubActionsLogin is the author of comments made with the token
+	// github actions provides, which cannot look itself up
+	githubActionsLogin = "github-actions[bot]"
+)
+
+var githubPullRefRegexp = regexp.MustCompile(`^refs/pull/(\d+)/`)
+
+type githubComment struct {
+	ID   uint64      `json:"id,omitempty"`
+	Body string      `json:"body"`
+	User *githubUser `json:"user,omitempty"`
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+// githubError is a response from the github api outside of 2xx
+type githubError struct {
+	Method     string
+	Path       string
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (ge *githubError) Error() string {
+	return fmt.Sprintf("github %s %s returned %s: %s", ge.Method, ge.Path, ge.Status, ge.Body)
+}
+
+// githubPR is the pull request to comment on, resolved from the options
+// and, under github actions, GITHUB_REF
+type githubPR struct {
+	APIURL string
+	Repo   string
+	Number uint64
+	Token  string
+}
+
+func (opts *Options) githubPR() (*githubPR, error) {
+	pr := &githubPR{
+		APIURL: strings.TrimSuffix(opts.GithubAPIURL, "/"),
+		Repo:   opts.GithubRepo,
+		Number: opts.GithubPR,
+		Token:  opts.GithubToken,
+	}
+
+	if pr.Number == 0 {
+		if m := githubPullRefRegexp.FindStringSubmatch(os.Getenv("GITHUB_REF")); m != nil {
+			pr.Number, _ = strconv.ParseUint(m[1], 10, 64)
+		}
+	}
+
+	if pr.Token == "" {
+		return nil, fmt.Errorf("no github token given for --github-pr-comment")
+	}
+
+	if len(strings.Split(pr.Repo, "/")) != 2 {
+		return nil, fmt.Errorf("github repo %q is not owner/repo", pr.Repo)
+	}
+
+	if pr.Number == 0 {
+		return nil, fmt.Errorf("no github pull request number given or detected")
+	}
+
+	return pr, nil
+}
+
+// commentOnPR posts a comment listing the uploaded artifact urls on the
+// pull request, editing the comment from an earlier run if there is one
+func (u *uploader) commentOnPR() error {
+	pr, err := u.Opts.githubPR()
+	if err != nil {
+		return err
+	}
+
+	client := u.Opts.httpClient()
+	body := githubCommentBody(u.results)
+
+	existing, err := pr.findComment(client)
+	if err != nil {
+		return err
+	}
+
+	comment := &githubComment{Body: body}
+	if existing == nil {
+		u.log.WithField("pr", pr.Number).Debug("posting pull request comment")
+		return pr.do(client, "POST", fmt.Sprintf("/repos/%s/issues/%d/comments", pr.Repo, pr.Number), comment, nil)
+	}
+
+	u.log.WithField("comment", existing.ID).Debug("updating pull request comment")
+	return pr.do(client, "PATCH", fmt.Sprintf("/repos/%s/issues/comments/%d", pr.Repo, existing.ID), comment, nil)
+}
+
+// login is the user the token belongs to, and so the author of the
+// comment to update
+func (pr *githubPR) login(client *http.Client) (string, error) {
+	user := &githubUser{}
+	err := pr.do(client, "GET", "/user", nil, user)
+	if ge, ok := err.(*githubError); ok && ge.StatusCode == http.StatusForbidden && os.Getenv("GITHUB_ACTIONS") == "true" {
+		return githubActionsLogin, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+// findComment finds an earlier comment with the marker by the same user,
+// since anyone may post a comment that starts with it
+func (pr *githubPR) findComment(client *http.Client) (*githubComment, error) {
+	login, err := pr.login(client)
+	if err != nil {
+		return nil, err
+	}
+
+	for page := 1; ; page++ {
+		comments := []*githubComment{}
+		err := pr.do(client, "GET", fmt.Sprintf("/repos/%s/issues/%d/comments?per_page=%d&page=%d",
+			pr.Repo, pr.Number, githubCommentsPerPage, page), nil, &comments)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, comment := range comments {
+			if strings.HasPrefix(comment.Body, githubCommentMarker) && comment.User != nil && comment.User.Login == login {
+				return comment, nil
+			}
+		}
+
+		if len(comments) < githubCommentsPerPage {
+			return nil, nil
+		}
+	}
+}
+
+func (pr *githubPR) do(client *http.Client, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, pr.APIURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+pr.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &githubError{
+			Method:     method,
+			Path:       path,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(respBody)),
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(respBody, out)
+}
+
+// githubCommentBody is markdown listing the uploaded artifacts by key
+func githubCommentBody(results []*artifact.Artifact) string {
+	links := []string{}
+	failed := 0
+
+	for _, a := range results {
+		if !a.UploadResult.OK {
+			failed++
+			continue
+		}
+
+		if a.UploadResult.URL == "" {
+			links = append(links, fmt.Sprintf("- `%s`", a.FullDest()))
+			continue
+		}
+
+		links = append(links, fmt.Sprintf("- [%s](%s)", a.FullDest(), a.UploadResult.URL))
+	}
+
+	sort.Strings(links)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s\n### Uploaded artifacts\n\n", githubCommentMarker)
+
+	if len(links) == 0 {
+		fmt.Fprintf(buf, "No artifacts were uploaded.\n")
+	} else {
+		fmt.Fprintf(buf, "%s\n", strings.Join(links, "\n"))
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(buf, "\n%d artifacts failed to upload.\n", failed)
+	}
+
+	return buf.String()
+}
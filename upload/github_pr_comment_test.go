@@ -0,0 +1,282 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGithub implements just enough of the github issue comments api to
+// exercise the pull request comment
+type fakeGithub struct {
+	sync.Mutex
+	Comments []*githubComment
+	Posts    int
+	Patches  int
+	Fail     bool
+	Login    string
+	nextID   uint64
+}
+
+func (fg *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.Lock()
+	defer fg.Unlock()
+
+	if fg.Fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer gh-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/user" && fg.Login == "":
+		w.WriteHeader(http.StatusForbidden)
+	case r.Method == "GET" && r.URL.Path == "/user":
+		json.NewEncoder(w).Encode(&githubUser{Login: fg.Login})
+	case r.Method == "GET" && r.URL.Path == "/repos/owner/repo/issues/7/comments":
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start := (page - 1) * perPage
+		end := start + perPage
+		if start > len(fg.Comments) {
+			start = len(fg.Comments)
+		}
+		if end > len(fg.Comments) {
+			end = len(fg.Comments)
+		}
+		json.NewEncoder(w).Encode(fg.Comments[start:end])
+	case r.Method == "POST" && r.URL.Path == "/repos/owner/repo/issues/7/comments":
+		comment := &githubComment{}
+		json.NewDecoder(r.Body).Decode(comment)
+		fg.nextID++
+		comment.ID = 1000 + fg.nextID
+		comment.User = &githubUser{Login: fg.login()}
+		fg.Comments = append(fg.Comments, comment)
+		fg.Posts++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(comment)
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/repos/owner/repo/issues/comments/"):
+		id, _ := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/repos/owner/repo/issues/comments/"), 10, 64)
+		comment := &githubComment{}
+		json.NewDecoder(r.Body).Decode(comment)
+		for _, existing := range fg.Comments {
+			if existing.ID == id {
+				existing.Body = comment.Body
+				fg.Patches++
+				json.NewEncoder(w).Encode(existing)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (fg *fakeGithub) login() string {
+	if fg.Login == "" {
+		return githubActionsLogin
+	}
+	return fg.Login
+}
+
+func (fg *fakeGithub) markerComments() []*githubComment {
+	comments := []*githubComment{}
+	for _, comment := range fg.Comments {
+		if strings.HasPrefix(comment.Body, githubCommentMarker) {
+			comments = append(comments, comment)
+		}
+	}
+	return comments
+}
+
+func githubCommentOpts(dir, apiURL string, files ...string) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = files
+		opts.TargetPaths = []string{"pr-7"}
+		opts.GithubPRComment = true
+		opts.GithubToken = "gh-token"
+		opts.GithubRepo = "owner/repo"
+		opts.GithubPR = 7
+		opts.GithubAPIURL = apiURL
+	}
+}
+
+func TestUploaderGithubPRCommentPostsThenUpdates(t *testing.T) {
+	fg := &fakeGithub{Login: "artifacts-bot", Comments: []*githubComment{&githubComment{ID: 1, Body: "lgtm"}}}
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>", "coverage.txt": "99%"})
+	defer os.RemoveAll(dir)
+
+	err := getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html")).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html", "coverage.txt")).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fg.Posts != 1 || fg.Patches != 1 {
+		t.Fatalf("posts %v, patches %v != 1, 1", fg.Posts, fg.Patches)
+	}
+
+	comments := fg.markerComments()
+	if len(comments) != 1 {
+		t.Fatalf("artifact comments %v != 1", len(comments))
+	}
+
+	for _, key := range []string{"pr-7/report.html", "pr-7/coverage.txt"} {
+		if !strings.Contains(comments[0].Body, key) {
+			t.Fatalf("comment does not list %v:\n%s", key, comments[0].Body)
+		}
+	}
+
+	if fg.Comments[0].Body != "lgtm" {
+		t.Fatalf("unrelated comment was changed: %q", fg.Comments[0].Body)
+	}
+}
+
+func TestUploaderGithubPRCommentFindsCommentOnLaterPage(t *testing.T) {
+	fg := &fakeGithub{Login: "artifacts-bot"}
+	for i := 0; i < githubCommentsPerPage+30; i++ {
+		fg.Comments = append(fg.Comments, &githubComment{ID: uint64(i + 1), Body: fmt.Sprintf("comment %d", i)})
+	}
+	fg.Comments[githubCommentsPerPage+10].Body = githubCommentMarker + "\nold"
+	fg.Comments[githubCommentsPerPage+10].User = &githubUser{Login: "artifacts-bot"}
+
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	err := getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html")).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fg.Posts != 0 || fg.Patches != 1 {
+		t.Fatalf("posts %v, patches %v != 0, 1", fg.Posts, fg.Patches)
+	}
+}
+
+func TestUploaderGithubPRCommentIgnoresOtherUsers(t *testing.T) {
+	fg := &fakeGithub{Login: "artifacts-bot", Comments: []*githubComment{
+		&githubComment{ID: 1, Body: githubCommentMarker + "\nquoted", User: &githubUser{Login: "someone"}},
+	}}
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	err := getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html")).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fg.Posts != 1 || fg.Patches != 0 {
+		t.Fatalf("posts %v, patches %v != 1, 0", fg.Posts, fg.Patches)
+	}
+
+	if fg.Comments[0].Body != githubCommentMarker+"\nquoted" {
+		t.Fatalf("another user's comment was changed: %q", fg.Comments[0].Body)
+	}
+}
+
+func TestUploaderGithubPRCommentActionsToken(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{"GITHUB_ACTIONS": "true"})
+	defer os.Clearenv()
+
+	// the actions token cannot fetch /user
+	fg := &fakeGithub{}
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 2; i++ {
+		err := getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html")).Upload()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if fg.Posts != 1 || fg.Patches != 1 {
+		t.Fatalf("posts %v, patches %v != 1, 1", fg.Posts, fg.Patches)
+	}
+}
+
+func TestUploaderGithubPRCommentFailure(t *testing.T) {
+	fg := &fakeGithub{Fail: true}
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("failed comment was fatal: %v", err)
+	}
+
+	u = getTestUploader(nil, githubCommentOpts(dir, srv.URL, "report.html"))
+	u.Opts.GithubPRCommentRequired = true
+	if err := u.Upload(); err == nil {
+		t.Fatalf("failed required comment was not fatal")
+	}
+}
+
+func TestGithubPRDetectedUnderActions(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"GITHUB_TOKEN":      "gh-token",
+		"GITHUB_REPOSITORY": "owner/repo",
+		"GITHUB_REF":        "refs/pull/7/merge",
+		"GITHUB_API_URL":    "https://github.example.com/api/v3",
+	})
+	defer os.Clearenv()
+
+	pr, err := NewOptions().githubPR()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := &githubPR{APIURL: "https://github.example.com/api/v3", Repo: "owner/repo", Number: 7, Token: "gh-token"}
+	if *pr != *expected {
+		t.Fatalf("pr %#v != %#v", pr, expected)
+	}
+}
+
+func TestGithubPRMissing(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{"GITHUB_TOKEN": "gh-token", "GITHUB_REPOSITORY": "owner/repo", "GITHUB_REF": "refs/heads/master"})
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	opts.GithubPRComment = true
+	opts.GithubPRCommentRequired = true
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "pull request number") {
+		t.Fatalf("missing pull request number was accepted: %v", err)
+	}
+}
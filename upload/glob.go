@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// matchGlob reports whether the slash-separated relative path matches
+// the pattern.  In addition to the path.Match syntax, a "**" segment
+// matches zero or more path segments, and a pattern ending in "/"
+// matches the directory and everything under it.
+func matchGlob(pattern, relPath string) bool {
+	pattern = filepath.ToSlash(pattern)
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+
+	if strings.HasSuffix(pattern, "/") {
+		pattern = pattern + "**"
+	}
+	pattern = strings.Trim(pattern, "/")
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+func matchSegments(patParts, pathParts []string) bool {
+	for len(patParts) > 0 {
+		if patParts[0] == "**" {
+			rest := patParts[1:]
+			for i := 0; i <= len(pathParts); i++ {
+				if matchSegments(rest, pathParts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(pathParts) == 0 {
+			return false
+		}
+
+		ok, err := path.Match(patParts[0], pathParts[0])
+		if err != nil || !ok {
+			return false
+		}
+
+		patParts = patParts[1:]
+		pathParts = pathParts[1:]
+	}
+
+	return len(pathParts) == 0
+}
+
+// relToWorkingDir returns the source path relative to the working dir,
+// or the cleaned source path if it is not under the working dir
+func relToWorkingDir(workingDir, source string) string {
+	absWorkingDir, err := filepath.Abs(workingDir)
+	if err != nil {
+		return filepath.Clean(source)
+	}
+
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		return filepath.Clean(source)
+	}
+
+	rel, err := filepath.Rel(absWorkingDir, absSource)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.Clean(source)
+	}
+
+	return rel
+}
@@ -0,0 +1,47 @@
+package upload
+
+import "testing"
+
+type globCase struct {
+	pattern string
+	path    string
+	match   bool
+}
+
+var globCases = []*globCase{
+	&globCase{"index.html", "index.html", true},
+	&globCase{"index.html", "sub/index.html", false},
+	&globCase{"*.html", "index.html", true},
+	&globCase{"*.html", "sub/index.html", false},
+	&globCase{"**/*.html", "sub/index.html", true},
+	&globCase{"**/*.html", "index.html", true},
+	&globCase{"assets/", "assets/app.css", true},
+	&globCase{"assets/", "assets/img/logo.png", true},
+	&globCase{"assets/", "other/app.css", false},
+	&globCase{"a/**/z", "a/b/c/z", true},
+	&globCase{"a/**/z", "a/z", true},
+	&globCase{"a/**/z", "a/b/c/y", false},
+	&globCase{"a/?.txt", "a/b.txt", true},
+	&globCase{"a/[", "a/[", false},
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range globCases {
+		if matchGlob(c.pattern, c.path) != c.match {
+			t.Errorf("matchGlob(%q, %q) != %v", c.pattern, c.path, c.match)
+		}
+	}
+}
+
+func TestRelToWorkingDir(t *testing.T) {
+	for _, c := range [][]string{
+		[]string{"/foo", "/foo/bar/baz", "bar/baz"},
+		[]string{"/foo", "/elsewhere/baz", "/elsewhere/baz"},
+		[]string{"/foo", "/foo", "."},
+	} {
+		actual := relToWorkingDir(c[0], c[1])
+		if actual != c[2] {
+			t.Errorf("relToWorkingDir(%q, %q) %q != %q", c[0], c[1], actual, c[2])
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package upload
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+const (
+	gzipBlockSize = 1024 * 1024
+	gzipDictSize  = 32 * 1024
+)
+
+var (
+	gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+)
+
+// newGzipWriter returns a gzip writer that compresses with up to
+// `parallel` goroutines, or a plain gzip.Writer if parallel is 1 or less
+func newGzipWriter(w io.Writer, parallel uint64) io.WriteCloser {
+	if parallel <= 1 {
+		return gzip.NewWriter(w)
+	}
+
+	return newParallelGzipWriter(w, int(parallel), gzipBlockSize)
+}
+
+type compressedBlock struct {
+	Data []byte
+	Err  error
+}
+
+// parallelGzipWriter splits its input into blocks that are deflated
+// concurrently, each primed with the end of the block before it, and
+// written out in order.  Every block but the last ends with a sync flush,
+// so together they make up a single deflate stream, and the output is
+// ordinary gzip that any decoder can read.
+type parallelGzipWriter struct {
+	w         io.Writer
+	blockSize int
+
+	buf  []byte
+	dict []byte
+	crc  hash.Hash32
+	size uint32
+
+	sem    chan bool
+	blocks chan chan *compressedBlock
+	done   chan error
+	closed bool
+
+	errLock sync.Mutex
+	err     error
+}
+
+func newParallelGzipWriter(w io.Writer, parallel, blockSize int) *parallelGzipWriter {
+	pw := &parallelGzipWriter{
+		w:         w,
+		blockSize: blockSize,
+
+		buf: make([]byte, 0, blockSize),
+		crc: crc32.NewIEEE(),
+
+		sem:    make(chan bool, parallel),
+		blocks: make(chan chan *compressedBlock, parallel),
+		done:   make(chan error, 1),
+	}
+
+	go pw.writeBlocks()
+	return pw
+}
+
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if err := pw.getErr(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	pw.crc.Write(p)
+	pw.size += uint32(n)
+
+	for len(p) > 0 {
+		space := pw.blockSize - len(pw.buf)
+		if space > len(p) {
+			space = len(p)
+		}
+
+		pw.buf = append(pw.buf, p[:space]...)
+		p = p[space:]
+
+		if len(pw.buf) == pw.blockSize {
+			pw.dispatch(false)
+		}
+	}
+
+	return n, nil
+}
+
+func (pw *parallelGzipWriter) Close() error {
+	if pw.closed {
+		return pw.getErr()
+	}
+	pw.closed = true
+
+	pw.dispatch(true)
+	close(pw.blocks)
+
+	if err := <-pw.done; err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[:4], pw.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], pw.size)
+
+	_, err := pw.w.Write(trailer)
+	pw.setErr(err)
+	return err
+}
+
+func (pw *parallelGzipWriter) dispatch(final bool) {
+	block, dict := pw.buf, pw.dict
+
+	if len(block) >= gzipDictSize {
+		pw.dict = block[len(block)-gzipDictSize:]
+	} else {
+		pw.dict = append(append([]byte{}, dict...), block...)
+		if len(pw.dict) > gzipDictSize {
+			pw.dict = pw.dict[len(pw.dict)-gzipDictSize:]
+		}
+	}
+
+	pw.buf = make([]byte, 0, pw.blockSize)
+
+	result := make(chan *compressedBlock, 1)
+	pw.sem <- true
+	pw.blocks <- result
+
+	go func() {
+		defer func() { <-pw.sem }()
+		result <- compressBlock(block, dict, final)
+	}()
+}
+
+func (pw *parallelGzipWriter) writeBlocks() {
+	_, err := pw.w.Write(gzipHeader)
+	pw.setErr(err)
+
+	for result := range pw.blocks {
+		block := <-result
+		if pw.getErr() != nil {
+			continue
+		}
+
+		if block.Err != nil {
+			pw.setErr(block.Err)
+			continue
+		}
+
+		_, err := pw.w.Write(block.Data)
+		pw.setErr(err)
+	}
+
+	pw.done <- pw.getErr()
+}
+
+func (pw *parallelGzipWriter) getErr() error {
+	pw.errLock.Lock()
+	defer pw.errLock.Unlock()
+	return pw.err
+}
+
+func (pw *parallelGzipWriter) setErr(err error) {
+	pw.errLock.Lock()
+	defer pw.errLock.Unlock()
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+func compressBlock(block, dict []byte, final bool) *compressedBlock {
+	buf := &bytes.Buffer{}
+	fw, err := flate.NewWriterDict(buf, flate.DefaultCompression, dict)
+	if err != nil {
+		return &compressedBlock{Err: err}
+	}
+
+	if _, err := fw.Write(block); err != nil {
+		return &compressedBlock{Err: err}
+	}
+
+	if final {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+
+	return &compressedBlock{Data: buf.Bytes(), Err: err}
+}
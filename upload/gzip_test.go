@@ -0,0 +1,113 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func gzipTestData(size int) []byte {
+	r := rand.New(rand.NewSource(int64(size)))
+	buf := &bytes.Buffer{}
+	for buf.Len() < size {
+		fmt.Fprintf(buf, "line %d: %x\n", buf.Len(), r.Int63n(int64(1+buf.Len()%4096)))
+	}
+	return buf.Bytes()[:size]
+}
+
+func gzipWithWriter(t testing.TB, w io.WriteCloser, buf *bytes.Buffer, data []byte) []byte {
+	// write in uneven chunks to cross block boundaries mid-write
+	for i := 0; i < len(data); i += 7777 {
+		end := i + 7777
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := w.Write(data[i:end]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	for _, size := range []int{0, 1, gzipDictSize - 1, 100000, 3*65536 + 17} {
+		data := gzipTestData(size)
+		buf := &bytes.Buffer{}
+		compressed := gzipWithWriter(t, newParallelGzipWriter(buf, 4, 65536), buf, data)
+
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %v", size, err)
+		}
+
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %v", size, err)
+		}
+
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("size %d: decompressed data does not match", size)
+		}
+	}
+}
+
+func TestParallelGzipWriterGzipCommand(t *testing.T) {
+	gzipPath, err := exec.LookPath("gzip")
+	if err != nil {
+		t.Skip("gzip not found")
+	}
+
+	data := gzipTestData(5*65536 + 3)
+	buf := &bytes.Buffer{}
+	compressed := gzipWithWriter(t, newParallelGzipWriter(buf, 3, 65536), buf, data)
+
+	cmd := exec.Command(gzipPath, "-dc")
+	cmd.Stdin = bytes.NewReader(compressed)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("gzip failed to decompress: %v", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Fatalf("gzip decompressed data does not match")
+	}
+}
+
+func TestNewGzipWriterSerial(t *testing.T) {
+	if _, ok := newGzipWriter(ioutil.Discard, 1).(*gzip.Writer); !ok {
+		t.Fatalf("parallel 1 did not use gzip.Writer")
+	}
+
+	if _, ok := newGzipWriter(ioutil.Discard, 4).(*parallelGzipWriter); !ok {
+		t.Fatalf("parallel 4 did not use parallelGzipWriter")
+	}
+}
+
+func benchmarkGzipWriter(b *testing.B, parallel uint64) {
+	data := gzipTestData(16 * 1024 * 1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf := &bytes.Buffer{}
+		gzipWithWriter(b, newGzipWriter(buf, parallel), buf, data)
+	}
+}
+
+func BenchmarkGzipWriterSerial(b *testing.B) {
+	benchmarkGzipWriter(b, 1)
+}
+
+func BenchmarkGzipWriterParallel(b *testing.B) {
+	benchmarkGzipWriter(b, 4)
+}
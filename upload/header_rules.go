@@ -0,0 +1,115 @@
+package upload
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const metadataHeaderPrefix = "x-amz-meta-"
+
+// headerRule sets one header on the artifacts matching a glob
+type headerRule struct {
+	Pattern string
+	Header  string
+	Value   string
+}
+
+// loadHeaderRules reads one rule per line, as a glob followed by a header
+// the way it would be sent, skipping blank lines and lines starting with
+// "#", e.g.:
+//
+//	*.html        Cache-Control: public, max-age=300
+//	dist/*.tar.gz Content-Disposition: attachment
+//	*.log         x-amz-meta-retention: short
+func loadHeaderRules(filename string) ([]*headerRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	rules := []*headerRule{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, scanner.Err()
+}
+
+func parseHeaderRule(line string) (*headerRule, error) {
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return nil, fmt.Errorf("header rule %q has no header", line)
+	}
+
+	header := strings.TrimSpace(line[i:])
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return nil, fmt.Errorf("invalid header %q, expected Name: value", header)
+	}
+
+	r := &headerRule{
+		Pattern: strings.TrimPrefix(line[:i], "./"),
+		Header:  strings.ToLower(strings.TrimSpace(parts[0])),
+		Value:   strings.TrimSpace(parts[1]),
+	}
+
+	switch {
+	case r.Header == "cache-control", r.Header == "content-disposition":
+	case r.Header == "content-type":
+		if _, _, err := mime.ParseMediaType(r.Value); err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %v", r.Value, err)
+		}
+	case strings.HasPrefix(r.Header, metadataHeaderPrefix) && len(r.Header) > len(metadataHeaderPrefix):
+	default:
+		return nil, fmt.Errorf("unsupported header %q, expected Cache-Control, Content-Type, Content-Disposition, or x-amz-meta-*", parts[0])
+	}
+
+	return r, nil
+}
+
+// applyHeaderRules sets the headers of every rule matching the artifact,
+// in order, so that a later rule wins over an earlier one for the same
+// header.  They in turn win over --cache-control, --no-cache,
+// --content-type, and --metadata.  Stdin is matched by its dest.
+func (u *uploader) applyHeaderRules(a *artifact.Artifact, relPath string) {
+	if relPath == stdinPath {
+		relPath = a.Dest
+	}
+
+	for _, r := range u.headerRules {
+		if !matchGlob(r.Pattern, relPath) {
+			continue
+		}
+
+		switch r.Header {
+		case "cache-control":
+			a.CacheControl = r.Value
+		case "content-type":
+			a.SetContentType(r.Value)
+		case "content-disposition":
+			a.ContentDisposition = r.Value
+		default:
+			if a.Metadata == nil {
+				a.Metadata = map[string]string{}
+			}
+			a.Metadata[strings.TrimPrefix(r.Header, metadataHeaderPrefix)] = r.Value
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func writeHeaderRulesFile(t *testing.T, dir, content string) string {
+	filename := filepath.Join(dir, "headers.txt")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return filename
+}
+
+func TestLoadHeaderRulesInvalid(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	for content, msg := range map[string]string{
+		"*.log":                        "has no header",
+		"*.log Cache-Control":          "expected Name: value",
+		"*.log Cache-Control:":         "expected Name: value",
+		"*.log Expires: never":         "unsupported header",
+		"*.log x-amz-meta-: short":     "unsupported header",
+		"*.log Content-Type: /":        "invalid content type",
+		"\n\n*.txt Cache-Control nope": "headers.txt:3:",
+	} {
+		_, err := loadHeaderRules(writeHeaderRulesFile(t, dir, content))
+		if err == nil {
+			t.Fatalf("invalid header rule %q was accepted", content)
+		}
+
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("error for %q does not contain %q: %v", content, msg, err)
+		}
+	}
+}
+
+func TestUploaderHeaderRules(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"site/index.html":     "<html></html>",
+		"site/app.js":         "var x;",
+		"dist/build.tar.gz":   "tarball",
+		"logs/build.log":      "log",
+		"secrets/token.txt":   "hunter2",
+		"site/assets/app.css": "body {}",
+	})
+	defer os.RemoveAll(dir)
+
+	rulesFile := writeHeaderRulesFile(t, dir, `
+# cache the site, but not its pages
+./site/**      Cache-Control: public, max-age=31536000
+site/*.html    Cache-Control: no-cache
+*.js           Content-Type: text/javascript; charset=utf-8
+dist/*.tar.gz  Content-Disposition: attachment; filename="build.tar.gz"
+logs/*         X-Amz-Meta-Retention: short
+secrets/*      Cache-Control: max-age=1
+`)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"site/", "dist/", "logs/", "secrets/"}
+		opts.TargetPaths = []string{"hr"}
+		opts.CacheControl = "private"
+		opts.NoCache = true
+		opts.NoCachePaths = []string{"secrets/*"}
+		opts.Metadata = []string{"retention=long"}
+		opts.HeaderRulesFrom = rulesFile
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byDest := map[string]*artifact.Artifact{}
+	for _, a := range rp.Uploaded {
+		byDest[a.FullDest()] = a
+	}
+
+	expected := map[string]string{
+		"hr/site/index.html":     "no-cache",
+		"hr/site/app.js":         "public, max-age=31536000",
+		"hr/site/assets/app.css": "public, max-age=31536000",
+		"hr/dist/build.tar.gz":   "private",
+		"hr/logs/build.log":      "private",
+		"hr/secrets/token.txt":   "max-age=1",
+	}
+	if actual := uploadedCacheControls(u, rp); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("cache controls %v != %v", actual, expected)
+	}
+
+	if ctype := byDest["hr/site/app.js"].ContentType(); ctype != "text/javascript; charset=utf-8" {
+		t.Fatalf("content type %q != text/javascript; charset=utf-8", ctype)
+	}
+
+	s3p := newS3Provider(u.Opts, getPanicLogger())
+	headers, err := s3p.objectHeaders(u.Opts, byDest["hr/dist/build.tar.gz"])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(headers["Content-Disposition"], []string{`attachment; filename="build.tar.gz"`}) {
+		t.Fatalf("unexpected content disposition: %v", headers["Content-Disposition"])
+	}
+
+	headers, _ = s3p.objectHeaders(u.Opts, byDest["hr/logs/build.log"])
+	if !reflect.DeepEqual(headers["x-amz-meta-retention"], []string{"short"}) {
+		t.Fatalf("unexpected retention metadata: %v", headers["x-amz-meta-retention"])
+	}
+	if _, ok := headers["Content-Disposition"]; ok {
+		t.Fatalf("unexpected content disposition: %v", headers["Content-Disposition"])
+	}
+
+	headers, _ = s3p.objectHeaders(u.Opts, byDest["hr/site/app.js"])
+	if !reflect.DeepEqual(headers["x-amz-meta-retention"], []string{"long"}) {
+		t.Fatalf("unexpected retention metadata: %v", headers["x-amz-meta-retention"])
+	}
+}
+
+func TestValidateHeaderRulesFrom(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.HeaderRulesFrom = writeHeaderRulesFile(t, dir, "*.log Expires: never\n")
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "header rules file cannot be loaded") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploaderHeaderRulesInline(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"site/index.html": "<html></html>",
+		"site/app.css":    "body {}",
+	})
+	defer os.RemoveAll(dir)
+
+	rulesFile := writeHeaderRulesFile(t, dir, "site/*.css Cache-Control: public\n")
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"site/"}
+		opts.TargetPaths = []string{"hr"}
+		opts.HeaderRulesFrom = rulesFile
+
+		err := opts.UpdateFromConfig(map[string]interface{}{
+			"header_rules": []interface{}{"site/* Cache-Control: no-cache"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"hr/site/index.html": "no-cache",
+		"hr/site/app.css":    "public",
+	}
+	if actual := uploadedCacheControls(u, rp); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("cache controls %v != %v", actual, expected)
+	}
+}
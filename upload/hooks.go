@@ -0,0 +1,127 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// hookEnvPrefix starts the names of the environment variables that the
+// post-hook is given, apart from the ARTIFACTS_* ones read as options so
+// that a hook running artifacts again doesn't pick them up as its own
+const hookEnvPrefix = "ARTIFACTS_HOOK_"
+
+// hookCommand runs the hook with the shell, as cmd on Windows
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// runHook runs the hook in the working dir with the extra environment,
+// its output going to stderr so that it stays out of what the upload
+// prints to stdout
+func (u *uploader) runHook(ctx context.Context, flag, command string, env map[string]string) error {
+	cmd := hookCommand(ctx, command)
+	cmd.Dir = u.Opts.WorkingDir
+	cmd.Stdout, cmd.Stderr = u.stderr, u.stderr
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, hookEnvPrefix+key+"="+value)
+	}
+
+	u.log.WithField("command", command).Debug(fmt.Sprintf("running %s", flag))
+	t0 := time.Now()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", flag, err)
+	}
+
+	u.log.WithField("duration", time.Since(t0)).Debug(fmt.Sprintf("ran %s", flag))
+	return nil
+}
+
+// preHook runs --pre-hook before the paths are walked, so that it can
+// write the artifacts to upload
+func (u *uploader) preHook(ctx context.Context) error {
+	if u.Opts.PreHook == "" {
+		return nil
+	}
+	if u.Opts.DryRun {
+		u.log.Info("not running --pre-hook in a dry run")
+		return nil
+	}
+
+	return u.runHook(ctx, "--pre-hook", u.Opts.PreHook, nil)
+}
+
+// postHook runs --post-hook once the upload and the reports written after
+// it are done, whether or not it succeeded.  A failing hook fails an
+// otherwise successful upload.
+func (u *uploader) postHook(err error) error {
+	if u.Opts.PostHook == "" {
+		return err
+	}
+	if u.Opts.DryRun {
+		u.log.Info("not running --post-hook in a dry run")
+		return err
+	}
+
+	// the run's context may be what ended the upload, and the hook is
+	// still run to hear about it
+	hookErr := u.runHook(context.Background(), "--post-hook", u.Opts.PostHook, u.postHookEnv(err))
+	if hookErr == nil {
+		return err
+	}
+	if err != nil {
+		u.log.WithField("err", hookErr).Error("post-hook failed")
+		return err
+	}
+	return hookErr
+}
+
+// postHookEnv describes the results of the upload to --post-hook
+func (u *uploader) postHookEnv(err error) map[string]string {
+	summary := u.outputTemplateResult(u.results).Summary
+
+	result := "success"
+	if err != nil || summary.Failed > 0 {
+		result = "failure"
+	}
+
+	env := map[string]string{
+		"RESULT":           result,
+		"PROVIDER":         u.Opts.Provider,
+		"BUCKET":           u.Opts.BucketName,
+		"TOTAL":            strconv.Itoa(summary.Total),
+		"UPLOADED":         strconv.Itoa(summary.Uploaded),
+		"FAILED":           strconv.Itoa(summary.Failed),
+		"BYTES":            strconv.FormatUint(summary.Bytes, 10),
+		"DURATION_SECONDS": formatFloat(summary.Duration.Seconds()),
+	}
+	if err != nil {
+		env["ERROR"] = err.Error()
+	}
+
+	// the hook runs in the working dir, so the files are given absolute
+	for key, filename := range map[string]string{
+		"MANIFEST":    u.Opts.OutputManifest,
+		"CSV":         u.Opts.OutputCSV,
+		"RESULT_FILE": u.Opts.ResultFile,
+	} {
+		if filename == "" || filename == "-" {
+			continue
+		}
+		if abs, err := filepath.Abs(filename); err == nil {
+			filename = abs
+		}
+		env[key] = filename
+	}
+
+	return env
+}
@@ -0,0 +1,119 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func skipHooksOnWindows(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands are written for /bin/sh")
+	}
+}
+
+func hookTestOpts(dir string, configure func(*Options)) func(*Options) {
+	return func(opts *Options) {
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"hooks-test"}
+		configure(opts)
+	}
+}
+
+func readHookOutput(t *testing.T, filename string) string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(b)
+}
+
+func TestUploaderHooks(t *testing.T) {
+	skipHooksOnWindows(t)
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "manifest.json")
+	u := getTestUploader(nil, hookTestOpts(dir, func(opts *Options) {
+		opts.PreHook = "echo generated > out/notes.txt"
+		opts.PostHook = `echo "$ARTIFACTS_HOOK_RESULT $ARTIFACTS_HOOK_UPLOADED/$ARTIFACTS_HOOK_TOTAL ` +
+			`$ARTIFACTS_HOOK_BYTES $ARTIFACTS_HOOK_MANIFEST $(wc -c < "$ARTIFACTS_HOOK_MANIFEST")" > post.txt`
+		opts.OutputManifest = manifest
+	}))
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dests := strings.Join(rp.FullDests(), " ")
+	if !strings.Contains(dests, "hooks-test/out/notes.txt") {
+		t.Fatalf("the pre-hook's file was not uploaded: %v", dests)
+	}
+
+	post := readHookOutput(t, filepath.Join(dir, "post.txt"))
+	fields := strings.Fields(post)
+	if len(fields) != 5 || strings.Join(fields[:4], " ") != "success 2/2 14 "+manifest || fields[4] == "0" {
+		t.Fatalf("unexpected post-hook output %q", post)
+	}
+}
+
+func TestUploaderPreHookFails(t *testing.T) {
+	skipHooksOnWindows(t)
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, hookTestOpts(dir, func(opts *Options) {
+		opts.PreHook = "exit 3"
+		opts.PostHook = `echo "$ARTIFACTS_HOOK_RESULT $ARTIFACTS_HOOK_ERROR" > post.txt`
+	}))
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err == nil || err.Error() != "--pre-hook failed: exit status 3" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rp.Uploaded) != 0 {
+		t.Fatalf("uploaded %v after the pre-hook failed", rp.FullDests())
+	}
+
+	post := readHookOutput(t, filepath.Join(dir, "post.txt"))
+	if post != "failure --pre-hook failed: exit status 3\n" {
+		t.Fatalf("unexpected post-hook output %q", post)
+	}
+}
+
+func TestUploaderPostHookFails(t *testing.T) {
+	skipHooksOnWindows(t)
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, hookTestOpts(dir, func(opts *Options) {
+		opts.PostHook = "exit 1"
+	}))
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err == nil || err.Error() != "--post-hook failed: exit status 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rp.Uploaded) != 1 {
+		t.Fatalf("unexpected uploads %v", rp.FullDests())
+	}
+}
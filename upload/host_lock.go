@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	hostLockPollInterval = 1 * time.Second
+)
+
+// hostLock limits the number of artifacts processes uploading at once on
+// the same host by locking one of a fixed number of slot files, each
+// holding the pid of the process that locked it.  The operating system
+// releases the lock of a process that dies, so a slot left behind is
+// simply locked again.
+type hostLock struct {
+	Path string
+	Max  uint64
+
+	log  *logrus.Logger
+	slot string
+	file *os.File
+}
+
+func newHostLock(path string, max uint64, log *logrus.Logger) *hostLock {
+	if max == 0 {
+		max = 1
+	}
+
+	return &hostLock{
+		Path: path,
+		Max:  max,
+		log:  log,
+	}
+}
+
+// Acquire blocks until a slot is free
+func (hl *hostLock) Acquire() error {
+	waiting := false
+
+	for {
+		for i := uint64(0); i < hl.Max; i++ {
+			slot := fmt.Sprintf("%s.%d", hl.Path, i)
+
+			f, err := lockSlot(slot)
+			if err != nil {
+				return err
+			}
+
+			if f != nil {
+				if err := writeSlotPid(f); err != nil {
+					unlockSlot(f, slot)
+					return err
+				}
+
+				hl.slot = slot
+				hl.file = f
+				hl.log.WithField("slot", slot).Debug("acquired host lock")
+				return nil
+			}
+		}
+
+		if !waiting {
+			hl.log.WithFields(logrus.Fields{
+				"lock": hl.Path,
+				"max":  hl.Max,
+			}).Info("waiting for host lock")
+			waiting = true
+		}
+
+		time.Sleep(hostLockPollInterval)
+	}
+}
+
+// Release frees the locked slot, if any
+func (hl *hostLock) Release() error {
+	if hl.slot == "" {
+		return nil
+	}
+
+	err := unlockSlot(hl.file, hl.slot)
+	hl.slot = ""
+	hl.file = nil
+	return err
+}
+
+func writeSlotPid(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	return err
+}
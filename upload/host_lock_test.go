@@ -0,0 +1,208 @@
+package upload
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getHostLockDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "artifacts-host-lock")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return dir
+}
+
+func TestHostLockLimitsConcurrentHolders(t *testing.T) {
+	origInterval := hostLockPollInterval
+	hostLockPollInterval = 5 * time.Millisecond
+	defer func() { hostLockPollInterval = origInterval }()
+
+	dir := getHostLockDir(t)
+	defer os.RemoveAll(dir)
+
+	lockPath := filepath.Join(dir, "artifacts.lock")
+	mu := &sync.Mutex{}
+	holding := 0
+	maxHolding := 0
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock := newHostLock(lockPath, 2, getPanicLogger())
+			if err := lock.Acquire(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			mu.Lock()
+			holding++
+			if holding > maxHolding {
+				maxHolding = holding
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			holding--
+			mu.Unlock()
+
+			if err := lock.Release(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if maxHolding != 2 {
+		t.Fatalf("max concurrent holders %v != 2", maxHolding)
+	}
+
+	matches, _ := filepath.Glob(lockPath + ".*")
+	if len(matches) != 0 {
+		t.Fatalf("slots left behind: %v", matches)
+	}
+}
+
+func TestHostLockRemovesStaleSlot(t *testing.T) {
+	dir := getHostLockDir(t)
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lockPath := filepath.Join(dir, "artifacts.lock")
+	deadPid := strconv.Itoa(cmd.ProcessState.Pid())
+	err := ioutil.WriteFile(lockPath+".0", []byte(deadPid), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lock := newHostLock(lockPath, 1, getPanicLogger())
+	done := make(chan error)
+	go func() { done <- lock.Acquire() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stale slot was not reclaimed")
+	}
+
+	body, _ := ioutil.ReadFile(lockPath + ".0")
+	if string(body) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("slot pid %q != %v", body, os.Getpid())
+	}
+
+	lock.Release()
+}
+
+func TestHostLockReclaimsUnlockedSlotOfLiveProcess(t *testing.T) {
+	dir := getHostLockDir(t)
+	defer os.RemoveAll(dir)
+
+	// the pid is only informational, so a slot left behind by a process
+	// that is still running but gave up the lock is free
+	lockPath := filepath.Join(dir, "artifacts.lock")
+	err := ioutil.WriteFile(lockPath+".0", []byte(strconv.Itoa(os.Getppid())), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lock := newHostLock(lockPath, 1, getPanicLogger())
+	if err := lock.Acquire(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lock.Release()
+
+	other, err := lockSlot(lockPath + ".0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other != nil {
+		t.Fatalf("held slot was locked twice")
+	}
+}
+
+func TestUploaderUploadHostLock(t *testing.T) {
+	dir := getHostLockDir(t)
+	defer os.RemoveAll(dir)
+
+	lockPath := filepath.Join(dir, "artifacts.lock")
+	setUploaderEnv()
+	u := getTestUploader(nil, nil)
+	u.Opts.HostLock = lockPath
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(lockPath + ".0"); !os.IsNotExist(err) {
+		t.Fatalf("host lock slot was not released")
+	}
+}
+
+func TestHostLockAcrossProcesses(t *testing.T) {
+	dir := getHostLockDir(t)
+	defer os.RemoveAll(dir)
+
+	cmds := []*exec.Cmd{}
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHostLockHelperProcess$", "--", dir)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("helper process failed: %v", err)
+		}
+	}
+}
+
+// TestHostLockHelperProcess is run in a subprocess by
+// TestHostLockAcrossProcesses, and fails if another helper holds the lock
+// at the same time
+func TestHostLockHelperProcess(t *testing.T) {
+	if flag.NArg() != 1 {
+		return
+	}
+
+	dir := flag.Arg(0)
+
+	hostLockPollInterval = 5 * time.Millisecond
+	lock := newHostLock(filepath.Join(dir, "artifacts.lock"), 1, getPanicLogger())
+	if err := lock.Acquire(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lock.Release()
+
+	holding := filepath.Join(dir, "holding")
+	f, err := os.OpenFile(holding, os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatalf("another process holds the lock: %v", err)
+	}
+	f.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	os.Remove(holding)
+}
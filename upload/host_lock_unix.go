@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package upload
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockSlot opens and flocks the slot, returning nil if another process
+// holds it
+func lockSlot(slot string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(slot, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// the holder may have released and removed the slot between the
+		// open and the flock, leaving this lock on a file no one else sees
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		current, err := os.Stat(slot)
+		if err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// unlockSlot removes the slot while it is still locked, so that processes
+// waiting on it see that it is gone, and then unlocks it
+func unlockSlot(f *os.File, slot string) error {
+	err := os.Remove(slot)
+	f.Close()
+	return err
+}
@@ -0,0 +1,42 @@
+package upload
+
+import (
+	"os"
+	"syscall"
+)
+
+const errorSharingViolation syscall.Errno = 32
+
+// lockSlot opens the slot without sharing it, returning nil if another
+// process has it open
+func lockSlot(slot string) (*os.File, error) {
+	path, err := syscall.UTF16PtrFromString(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := syscall.CreateFile(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(h), slot), nil
+}
+
+// unlockSlot closes the slot and then removes it, unless another process
+// has opened it in the meantime
+func unlockSlot(f *os.File, slot string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	err := os.Remove(slot)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == errorSharingViolation {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package upload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HTTPClient is the client that the providers share, for those registered
+// with RegisterProvider to go through the same --http-proxy, --ca-cert,
+// and --upload-timeout, and be canceled along with the upload in progress
+func (opts *Options) HTTPClient() *http.Client {
+	return opts.httpClient()
+}
+
+// httpClient returns a client using the shared transport, or the default
+// transport if the options were never passed to newUploader.  Its
+// requests are canceled along with the upload in progress.
+func (opts *Options) httpClient() *http.Client {
+	transport := opts.transport
+	if transport == nil {
+		transport = newHTTPTransport(opts)
+	}
+	return &http.Client{Transport: &contextTransport{opts: opts, transport: transport}}
+}
+
+// newHTTPTransport sends requests through --http-proxy when it is given,
+// except for hosts matching NO_PROXY, and otherwise leaves proxying to the
+// usual environment variables.  It trusts the certificates in --ca-cert
+// along with the system's, and with --insecure-skip-verify, it accepts any
+// certificate.
+func newHTTPTransport(opts *Options) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	} else if opts.CACert != "" {
+		// Validate has already complained about a file that can't be used
+		if pool, err := loadCACert(opts.CACert); err == nil {
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+	}
+
+	if opts.HTTPProxy == "" {
+		return transport
+	}
+
+	proxyURL, err := parseHTTPProxy(opts.HTTPProxy)
+	if err != nil {
+		// Validate has already complained about it
+		return transport
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+
+	transport.Proxy = proxyFunc(proxyURL, noProxy)
+	return transport
+}
+
+// loadCACert is the system's root certificates along with those in the
+// PEM file
+func loadCACert(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --ca-cert: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("invalid --ca-cert %q: no PEM certificates found", filename)
+	}
+	return pool, nil
+}
+
+func parseHTTPProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --http-proxy: %v", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid --http-proxy %q: scheme must be http, https, or socks5", redactedProxy(proxyURL))
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid --http-proxy %q: no host given", redactedProxy(proxyURL))
+	}
+
+	return proxyURL, nil
+}
+
+// redactedProxy is the proxy url with its password, if it has one, left
+// out of error messages
+func redactedProxy(proxyURL *url.URL) string {
+	if proxyURL.User == nil {
+		return proxyURL.String()
+	}
+	if _, ok := proxyURL.User.Password(); !ok {
+		return proxyURL.String()
+	}
+
+	redacted := *proxyURL
+	redacted.User = url.UserPassword(proxyURL.User.Username(), "xxxxx")
+	return redacted.String()
+}
+
+// proxyFunc proxies every request to a host that doesn't match one of the
+// comma-separated NO_PROXY entries.  An entry is "*", an ip, a cidr, or a
+// domain name that also matches its subdomains (a leading "." matches
+// only subdomains), any of which may be followed by ":port".
+func proxyFunc(proxyURL *url.URL, noProxy string) func(*http.Request) (*url.URL, error) {
+	entries := []string{}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		for _, entry := range entries {
+			if noProxyMatch(entry, req.URL) {
+				return nil, nil
+			}
+		}
+		return proxyURL, nil
+	}
+}
+
+func noProxyMatch(entry string, u *url.URL) bool {
+	if entry == "*" {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && ipNet.Contains(ip)
+	}
+
+	entryHost, entryPort := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		entryHost, entryPort = h, p
+	}
+
+	if entryPort != "" && entryPort != port {
+		return false
+	}
+
+	if ip := net.ParseIP(entryHost); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+
+	if strings.HasPrefix(entryHost, ".") {
+		return strings.HasSuffix(host, entryHost)
+	}
+
+	return host == entryHost || strings.HasSuffix(host, "."+entryHost)
+}
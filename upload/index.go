@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const indexKey = "index.html"
+
+// indexTemplate lists the artifacts under a target path, linking to each
+// relative to the index so it works wherever the target path is
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<thead>
+<tr><th>Name</th><th>Size</th><th>Content type</th></tr>
+</thead>
+<tbody>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ContentType}}</td></tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+type indexPage struct {
+	Title   string
+	Entries []*indexEntry
+}
+
+type indexEntry struct {
+	Name        string
+	Href        string
+	Size        string
+	ContentType string
+}
+
+// indexArtifacts builds an index.html for each target path, listing the
+// artifacts this run uploaded under it.  A target path that got an
+// index.html of its own is left alone.
+func (u *uploader) indexArtifacts() ([]*artifact.Artifact, error) {
+	indexes := []*artifact.Artifact{}
+	for _, targetPath := range u.Opts.TargetPaths {
+		page := &indexPage{Title: targetPath, Entries: []*indexEntry{}}
+		clobbered := false
+
+		for _, a := range u.results {
+			if a.Prefix != targetPath || !a.UploadResult.OK {
+				continue
+			}
+
+			name := strings.TrimLeft(filepath.ToSlash(a.Dest), "/")
+			if name == indexKey {
+				clobbered = true
+				break
+			}
+
+			size, _ := a.Size()
+			page.Entries = append(page.Entries, &indexEntry{
+				Name:        name,
+				Href:        "./" + (&url.URL{Path: name}).EscapedPath(),
+				Size:        humanize.Bytes(size),
+				ContentType: a.ContentType(),
+			})
+		}
+
+		if clobbered {
+			u.log.WithField("target_path", targetPath).Warn("not writing index over an uploaded index.html")
+			continue
+		}
+
+		sort.Slice(page.Entries, func(i, j int) bool {
+			return page.Entries[i].Name < page.Entries[j].Name
+		})
+
+		body := &bytes.Buffer{}
+		if err := indexTemplate.Execute(body, page); err != nil {
+			return nil, err
+		}
+
+		indexes = append(indexes,
+			artifact.NewFromBytes(targetPath, indexKey, body.Bytes(), u.artifactOptions()))
+	}
+
+	return indexes, nil
+}
@@ -0,0 +1,110 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestUploadGenerateIndex(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a b.txt":    "aaaa",
+		"out/sub/app.js": "var x;",
+	})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"index-test/one", "index-test/two"}
+		opts.GenerateIndex = true
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, targetPath := range u.Opts.TargetPaths {
+		resp, err := testS3.Bucket("bucket").GetResponse(targetPath + "/index.html")
+		if err != nil {
+			t.Fatalf("index was not uploaded to %s: %v", targetPath, err)
+		}
+		resp.Body.Close()
+
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("index content type %q is not text/html", resp.Header.Get("Content-Type"))
+		}
+
+		body, err := testS3.Bucket("bucket").Get(targetPath + "/index.html")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, expected := range []string{
+			`<a href="./out/a%20b.txt">out/a b.txt</a>`,
+			`<a href="./out/sub/app.js">out/sub/app.js</a>`,
+			`<td>4B</td>`,
+			`<td>text/plain; charset=utf-8</td>`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("index for %s is missing %q:\n%s", targetPath, expected, body)
+			}
+		}
+
+		if strings.Count(string(body), "<a href") != 2 {
+			t.Fatalf("index for %s lists other artifacts:\n%s", targetPath, body)
+		}
+	}
+}
+
+func TestUploadGenerateIndexFailed(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":    "a",
+		"fail.txt": "f",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "fail.txt"}
+	opts.GenerateIndex = true
+
+	rp := &recordingProvider{FailSources: map[string]bool{
+		filepath.Join(dir, "fail.txt"): true,
+	}}
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, a := range rp.Uploaded {
+		if a.Dest == indexKey {
+			t.Fatalf("index was written despite a failed upload")
+		}
+	}
+}
+
+func TestIndexArtifactsPerm(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Perm = string(s3.PublicRead)
+	opts.TargetPaths = []string{"perm-test"}
+
+	u := newUploader(opts, getPanicLogger())
+	indexes, err := u.indexArtifacts()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(indexes) != 1 || indexes[0].Perm != s3.PublicRead {
+		t.Fatalf("index does not use the artifacts' acl: %#v", indexes)
+	}
+}
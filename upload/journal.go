@@ -0,0 +1,198 @@
+package upload
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	journalVersion = 1
+)
+
+// journalEntry is one line of a journal written via --record.  The format
+// is stable: fields may be added, but existing ones will not change
+// meaning without bumping the version.
+type journalEntry struct {
+	Version     int               `json:"version"`
+	Op          string            `json:"op"`
+	Source      string            `json:"source"`
+	TargetPath  string            `json:"target_path"`
+	Dest        string            `json:"dest"`
+	Key         string            `json:"key"`
+	Size        uint64            `json:"size"`
+	ContentType string            `json:"content_type"`
+	Perm        string            `json:"perm"`
+	Headers     map[string]string `json:"headers"`
+	SHA256      string            `json:"sha256"`
+}
+
+func newJournalEntry(opts *Options, a *artifact.Artifact) (*journalEntry, error) {
+	size, err := a.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := a.SHA256()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"Cache-Control": cacheControl(opts, a),
+	}
+
+	if a.ContentEncoding != "" {
+		headers["Content-Encoding"] = a.ContentEncoding
+	}
+
+	if a.ContentDisposition != "" {
+		headers["Content-Disposition"] = a.ContentDisposition
+	}
+
+	metadata, err := resolveMetadata(opts.Metadata, a)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range metadata {
+		headers[metadataHeaderPrefix+key] = value
+	}
+
+	return &journalEntry{
+		Version:     journalVersion,
+		Op:          "put",
+		Source:      a.Source,
+		TargetPath:  a.Prefix,
+		Dest:        a.Dest,
+		Key:         a.FullDest(),
+		Size:        size,
+		ContentType: a.ContentType(),
+		Perm:        string(a.Perm),
+		Headers:     headers,
+		SHA256:      digest,
+	}, nil
+}
+
+// journal writes entries as json, one per line
+type journal struct {
+	sync.Mutex
+	f *os.File
+}
+
+func createJournal(filename string) (*journal, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{f: f}, nil
+}
+
+func (j *journal) Write(entry *journalEntry) error {
+	j.Lock()
+	defer j.Unlock()
+
+	return json.NewEncoder(j.f).Encode(entry)
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+func readJournal(filename string) ([]*journalEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	entries := []*journalEntry{}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := &journalEntry{}
+		err = json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+
+		if entry.Version != journalVersion {
+			return nil, fmt.Errorf("%s:%d: unsupported journal version %d", filename, lineno, entry.Version)
+		}
+
+		if entry.Op != "put" {
+			return nil, fmt.Errorf("%s:%d: unknown journal op %q", filename, lineno, entry.Op)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// replayFeeder sends an artifact for each journal entry, stopping at the
+// first whose source no longer matches what was recorded
+// apply sets the recorded content type and headers on the artifact, so
+// that it's uploaded the way it was recorded
+func (entry *journalEntry) apply(a *artifact.Artifact) {
+	if entry.ContentType != "" {
+		a.SetContentType(entry.ContentType)
+	}
+
+	for header, value := range entry.Headers {
+		switch header {
+		case "Cache-Control":
+			a.CacheControl = value
+		case "Content-Encoding":
+			a.ContentEncoding = value
+		case "Content-Disposition":
+			a.ContentDisposition = value
+		default:
+			if !strings.HasPrefix(header, metadataHeaderPrefix) {
+				continue
+			}
+			if a.Metadata == nil {
+				a.Metadata = map[string]string{}
+			}
+			a.Metadata[strings.TrimPrefix(header, metadataHeaderPrefix)] = value
+		}
+	}
+}
+
+func (u *uploader) replayFeeder(entries []*journalEntry, artifacts chan *artifact.Artifact) {
+	artifactOpts := u.artifactOptions()
+
+	for _, entry := range entries {
+		opts := *artifactOpts
+		opts.Perm = s3.ACL(entry.Perm)
+		a := artifact.New(entry.TargetPath, entry.Source, entry.Dest, &opts)
+		entry.apply(a)
+
+		digest, err := a.SHA256()
+		if err == nil && digest != entry.SHA256 {
+			err = fmt.Errorf("%s has changed since it was recorded", entry.Source)
+		}
+
+		if err != nil {
+			u.feedErr = err
+			break
+		}
+
+		artifacts <- a
+	}
+
+	close(artifacts)
+}
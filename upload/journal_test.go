@@ -0,0 +1,127 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func recordTestJournal(t *testing.T) (string, string) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world",
+	})
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "sub/"}
+	opts.TargetPaths = []string{"t1"}
+	opts.Metadata = []string{"name={basename}"}
+	opts.Record = filepath.Join(dir, "journal.jsonl")
+
+	err := newUploader(opts, getPanicLogger()).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return dir, opts.Record
+}
+
+func TestRecordJournal(t *testing.T) {
+	dir, journalPath := recordTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	entries, err := readJournal(journalPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("entries %v != 2", len(entries))
+	}
+
+	sort.Sort(journalEntriesByKey(entries))
+	entry := entries[0]
+	if entry.Key != "t1/a.txt" || entry.Size != 5 || entry.Op != "put" {
+		t.Fatalf("unexpected entry: %#v", entry)
+	}
+
+	if entry.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected sha256: %v", entry.SHA256)
+	}
+
+	if entry.Headers["x-amz-meta-name"] != "a.txt" {
+		t.Fatalf("unexpected headers: %v", entry.Headers)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	dir, journalPath := recordTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Replay = journalPath
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dests := rp.FullDests()
+	sort.Strings(dests)
+	if !reflect.DeepEqual(dests, []string{"t1/a.txt", "t1/sub/b.txt"}) {
+		t.Fatalf("replayed %v != [t1/a.txt t1/sub/b.txt]", dests)
+	}
+
+	for _, a := range rp.Uploaded {
+		if a.Metadata["name"] != filepath.Base(a.Source) {
+			t.Fatalf("recorded metadata not replayed: %v", a.Metadata)
+		}
+	}
+}
+
+func TestReplayJournalChangedSource(t *testing.T) {
+	dir, journalPath := recordTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644)
+
+	opts := NewOptions()
+	opts.Replay = journalPath
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{}
+
+	if u.Upload() == nil {
+		t.Fatalf("changed source was replayed")
+	}
+}
+
+func TestReadJournalInvalid(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"bad-json.jsonl":    "{nope\n",
+		"bad-version.jsonl": `{"version": 9, "op": "put"}` + "\n",
+		"bad-op.jsonl":      `{"version": 1, "op": "delete"}` + "\n",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"bad-json.jsonl", "bad-version.jsonl", "bad-op.jsonl"} {
+		if _, err := readJournal(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%v: invalid journal was accepted", name)
+		}
+	}
+}
+
+type journalEntriesByKey []*journalEntry
+
+func (je journalEntriesByKey) Len() int           { return len(je) }
+func (je journalEntriesByKey) Less(i, j int) bool { return je[i].Key < je[j].Key }
+func (je journalEntriesByKey) Swap(i, j int)      { je[i], je[j] = je[j], je[i] }
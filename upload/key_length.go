@@ -0,0 +1,70 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const shortenedKeyHashLength = 16
+
+var keyLengthPolicies = map[string]bool{
+	"fail":    true,
+	"shorten": true,
+}
+
+// checkKeyLength fails for an artifact whose key is longer than
+// --max-key-length, or with the shorten policy, shortens its dest to fit
+// and keeps the key it would have had
+func (u *uploader) checkKeyLength(a *artifact.Artifact) error {
+	key := a.FullDest()
+	if u.Opts.MaxKeyLength == 0 || uint64(len(key)) <= u.Opts.MaxKeyLength {
+		return nil
+	}
+
+	if u.Opts.KeyLengthPolicy != "shorten" {
+		return fmt.Errorf("key %q is %d characters, longer than --max-key-length %d",
+			key, len(key), u.Opts.MaxKeyLength)
+	}
+
+	dest := strings.TrimLeft(path.Clean("/"+filepath.ToSlash(a.Dest)), "/")
+	dest, err := shortenKey(key, len(key)-len(dest), int(u.Opts.MaxKeyLength))
+	if err != nil {
+		return err
+	}
+
+	a.Dest = dest
+	a.OriginalKey = key
+
+	u.log.WithFields(logrus.Fields{
+		"key":          a.FullDest(),
+		"original_key": key,
+	}).Warn("shortened key to fit --max-key-length")
+
+	return nil
+}
+
+// shortenKey returns a dest that fits the full key in max characters,
+// along with the first prefixLen characters of the key that aren't part
+// of the dest, by replacing the end of its directory with a hash of the
+// whole key.  The basename, and so the extension, is kept as it was.
+func shortenKey(key string, prefixLen, max int) (string, error) {
+	dest := filepath.ToSlash(key[prefixLen:])
+	dir, base := path.Split(dest)
+
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])[:shortenedKeyHashLength]
+
+	keep := max - prefixLen - len(hash) - len("/") - len(base)
+	if keep < 0 {
+		return "", fmt.Errorf("key %q cannot be shortened to %d characters without changing its basename", key, max)
+	}
+
+	return dir[:keep] + hash + "/" + base, nil
+}
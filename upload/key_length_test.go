@@ -0,0 +1,137 @@
+package upload
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const longKeyDir = "reports/integration/suites/very/deeply/nested/output"
+
+func TestShortenKey(t *testing.T) {
+	key := "target/" + longKeyDir + "/results.xml"
+	prefixLen := len("target/")
+
+	shortened, err := shortenKey(key, prefixLen, 50)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len("target/"+shortened) != 50 {
+		t.Fatalf("shortened key %q is %v characters, not 50", "target/"+shortened, len("target/"+shortened))
+	}
+
+	if path.Base(shortened) != "results.xml" {
+		t.Fatalf("basename %q != results.xml", path.Base(shortened))
+	}
+
+	if !strings.HasPrefix(shortened, "reports/integr") {
+		t.Fatalf("shortened key %q does not start like the original", shortened)
+	}
+
+	again, _ := shortenKey(key, prefixLen, 50)
+	if again != shortened {
+		t.Fatalf("shortening is not stable: %q != %q", again, shortened)
+	}
+
+	other, _ := shortenKey("target/"+longKeyDir+"/other/results.xml", prefixLen, 50)
+	if other == shortened {
+		t.Fatalf("different keys were shortened to the same key %q", other)
+	}
+
+	_, err = shortenKey(key, prefixLen, 30)
+	if err == nil {
+		t.Fatalf("key was shortened without room for its basename")
+	}
+}
+
+func uploadLongKeys(t *testing.T, maxKeyLength uint64, policy string) (*uploader, string, error) {
+	dir := writeTestFiles(t, map[string]string{
+		longKeyDir + "/results.xml": "<results/>",
+		"short.txt":                 "short",
+	})
+
+	os.Clearenv()
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"reports/", "short.txt"}
+	opts.TargetPaths = []string{"keys"}
+	opts.MaxKeyLength = maxKeyLength
+	opts.KeyLengthPolicy = policy
+	opts.OutputManifest = filepath.Join(dir, "manifest.json")
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{}
+	return u, dir, u.Upload()
+}
+
+func TestUploaderKeyLengthUnderAndAtLimit(t *testing.T) {
+	full := len("keys/" + longKeyDir + "/results.xml")
+	for _, max := range []uint64{0, uint64(full), uint64(full + 1)} {
+		u, dir, err := uploadLongKeys(t, max, "fail")
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", max, err)
+		}
+
+		for _, a := range u.results {
+			if a.OriginalKey != "" {
+				t.Fatalf("%v was shortened with a limit of %v", a.OriginalKey, max)
+			}
+		}
+	}
+}
+
+func TestUploaderKeyLengthFail(t *testing.T) {
+	_, dir, err := uploadLongKeys(t, 40, "fail")
+	defer os.RemoveAll(dir)
+
+	if err == nil {
+		t.Fatalf("upload with a key over the limit succeeded")
+	}
+
+	expected := `key "keys/` + longKeyDir + `/results.xml" is 69 characters, longer than --max-key-length 40`
+	if err.Error() != expected {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploaderKeyLengthShorten(t *testing.T) {
+	u, dir, err := uploadLongKeys(t, 40, "shorten")
+	defer os.RemoveAll(dir)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m, err := readManifest(u.Opts.OutputManifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	shortened := 0
+	for _, entry := range m.Artifacts {
+		if len(entry.Key) > 40 {
+			t.Fatalf("key %q is over the limit", entry.Key)
+		}
+
+		if entry.OriginalKey == "" {
+			continue
+		}
+
+		shortened++
+		if entry.OriginalKey != "keys/"+longKeyDir+"/results.xml" {
+			t.Fatalf("original key %q was not kept", entry.OriginalKey)
+		}
+
+		if !strings.HasSuffix(entry.Key, "/results.xml") {
+			t.Fatalf("shortened key %q lost its basename", entry.Key)
+		}
+	}
+
+	if shortened != 1 {
+		t.Fatalf("shortened keys %v != 1", shortened)
+	}
+}
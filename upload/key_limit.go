@@ -0,0 +1,59 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// limitKeys resolves every artifact up front when --max-keys-per-prefix
+// is set, failing before anything is uploaded if any target path would
+// get more files than allowed
+func (u *uploader) limitKeys(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if u.Opts.MaxKeysPerPrefix == 0 {
+		return in, nil
+	}
+
+	counts := map[string]uint64{}
+	held := []*artifact.Artifact{}
+	exceeded := false
+
+	for a := range in {
+		counts[a.Prefix]++
+		if counts[a.Prefix] > u.Opts.MaxKeysPerPrefix {
+			exceeded = true
+		}
+
+		if !exceeded {
+			held = append(held, a)
+		}
+	}
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	if exceeded {
+		prefixes := []string{}
+		for prefix, count := range counts {
+			if count > u.Opts.MaxKeysPerPrefix {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		sort.Strings(prefixes)
+
+		return nil, fmt.Errorf("found %d files to upload under %q, more than --max-keys-per-prefix %d",
+			counts[prefixes[0]], prefixes[0], u.Opts.MaxKeysPerPrefix)
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for _, a := range held {
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
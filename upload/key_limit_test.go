@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeKeyLimitFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"a.txt":     "a",
+		"b.txt":     "b",
+		"sub/c.txt": "c",
+	})
+}
+
+func keyLimitOpts(dir string, limit uint64) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"a.txt", "b.txt", "sub/"}
+		opts.TargetPaths = []string{"one", "two"}
+		opts.MaxKeysPerPrefix = limit
+	}
+}
+
+func TestUploaderMaxKeysPerPrefixExceeded(t *testing.T) {
+	dir := writeKeyLimitFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, keyLimitOpts(dir, 2))
+	u.Provider = rp
+
+	err := u.Upload()
+	if err == nil {
+		t.Fatalf("upload exceeding --max-keys-per-prefix succeeded")
+	}
+
+	if !strings.Contains(err.Error(), "found 3 files") {
+		t.Fatalf("error does not give the count: %v", err)
+	}
+
+	if len(rp.FullDests()) != 0 {
+		t.Fatalf("artifacts were uploaded: %v", rp.FullDests())
+	}
+}
+
+func TestUploaderMaxKeysPerPrefixWithinLimit(t *testing.T) {
+	dir := writeKeyLimitFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, keyLimitOpts(dir, 3))
+	u.Provider = rp
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rp.FullDests()) != 6 {
+		t.Fatalf("uploaded %v != 6", len(rp.FullDests()))
+	}
+}
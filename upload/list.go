@@ -0,0 +1,422 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// ListOptions are the filters for List, all of which an object must pass
+// to be listed.  Zero values don't filter anything.
+type ListOptions struct {
+	// Glob matches the whole key, as for --upload-order-from
+	Glob      string
+	MinSize   uint64
+	MaxSize   uint64
+	OlderThan time.Duration
+	NewerThan time.Duration
+
+	// Prefix is listed under instead of the target paths
+	Prefix string
+	// Shallow lists only one level below each prefix
+	Shallow bool
+	// Format is text (the default) or json
+	Format string
+}
+
+// NewListOptions parses the --filter-* flags, with sizes such as "100MB"
+// and ages such as "36h" or "7d"
+func NewListOptions(glob, minSize, maxSize, olderThan, newerThan string) (*ListOptions, error) {
+	lo := &ListOptions{Glob: glob}
+
+	for _, f := range []struct {
+		Name  string
+		Value string
+		Dest  *uint64
+	}{
+		{"--filter-min-size", minSize, &lo.MinSize},
+		{"--filter-max-size", maxSize, &lo.MaxSize},
+	} {
+		if f.Value == "" {
+			continue
+		}
+
+		size, err := humanize.ParseBytes(f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", f.Name, f.Value, err)
+		}
+		*f.Dest = size
+	}
+
+	for _, f := range []struct {
+		Name  string
+		Value string
+		Dest  *time.Duration
+	}{
+		{"--filter-older-than", olderThan, &lo.OlderThan},
+		{"--filter-newer-than", newerThan, &lo.NewerThan},
+	} {
+		if f.Value == "" {
+			continue
+		}
+
+		age, err := parseAge(f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", f.Name, f.Value, err)
+		}
+		*f.Dest = age
+	}
+
+	if lo.MaxSize > 0 && lo.MinSize > lo.MaxSize {
+		return nil, fmt.Errorf("--filter-min-size %s is more than --filter-max-size %s",
+			humanize.Bytes(lo.MinSize), humanize.Bytes(lo.MaxSize))
+	}
+
+	return lo, nil
+}
+
+// parseAge is time.ParseDuration, plus whole days such as "7d"
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected a number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// Match reports whether the object passes every filter as of now
+func (lo *ListOptions) Match(key s3.Key, now time.Time) bool {
+	if lo.Glob != "" && !matchGlob(lo.Glob, key.Key) {
+		return false
+	}
+
+	size := uint64(key.Size)
+	if lo.MinSize > 0 && size < lo.MinSize {
+		return false
+	}
+	if lo.MaxSize > 0 && size > lo.MaxSize {
+		return false
+	}
+
+	if lo.OlderThan == 0 && lo.NewerThan == 0 {
+		return true
+	}
+
+	modified, err := time.Parse(time.RFC3339, key.LastModified)
+	if err != nil {
+		return false
+	}
+
+	age := now.Sub(modified)
+	if lo.OlderThan > 0 && age <= lo.OlderThan {
+		return false
+	}
+	if lo.NewerThan > 0 && age >= lo.NewerThan {
+		return false
+	}
+
+	return true
+}
+
+// RemoteObject is an object as an ObjectLister lists it back
+type RemoteObject struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	LastModified string `json:"last_modified"`
+	ContentType  string `json:"content_type,omitempty"`
+}
+
+// contentTypeProvider is implemented by the listing providers that don't
+// list content types, and need to be asked for each object's
+type contentTypeProvider interface {
+	remoteContentType(key string) (string, error)
+}
+
+// List writes each object under the target paths (or --prefix) that
+// passes the filters, sorted by key, as tab-separated lines of the key,
+// size, last modified time, and content type, or as a JSON object per
+// line with --format json.  Listing only one level down also lists the
+// prefixes below it, which aren't filtered.  It returns how many objects
+// were listed.
+func List(opts *Options, listOpts *ListOptions, out io.Writer, log *logrus.Logger) (int, error) {
+	return newUploader(opts, log).list(listOpts, out)
+}
+
+func (u *uploader) list(listOpts *ListOptions, out io.Writer) (int, error) {
+	switch listOpts.Format {
+	case "", "text", "json":
+	default:
+		return 0, fmt.Errorf("invalid --format %q (expected text or json)", listOpts.Format)
+	}
+
+	lp, ok := u.Provider.(ObjectLister)
+	if !ok {
+		return 0, fmt.Errorf("list is not supported by the %s provider", u.Provider.Name())
+	}
+
+	objects := map[string]*RemoteObject{}
+	dirs := map[string]bool{}
+	for _, prefix := range u.listPrefixes(listOpts.Prefix) {
+		listed, listedDirs, err := lp.ListRemote(prefix, !listOpts.Shallow)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, obj := range listed {
+			objects[obj.Key] = obj
+		}
+		for _, dir := range listedDirs {
+			dirs[dir] = true
+		}
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"remote": len(objects),
+		"dirs":   len(dirs),
+	}).Debug("listed remote objects")
+
+	now := time.Now()
+	matched := []*RemoteObject{}
+	for _, obj := range objects {
+		if listOpts.Match(s3.Key{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}, now) {
+			matched = append(matched, obj)
+		}
+	}
+
+	if err := u.listContentTypes(matched); err != nil {
+		return 0, err
+	}
+
+	names := []string{}
+	for _, obj := range matched {
+		names = append(names, obj.Key)
+	}
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	enc := json.NewEncoder(out)
+	for _, name := range names {
+		var err error
+		obj, isObject := objects[name]
+
+		switch {
+		case listOpts.Format == "json" && isObject:
+			err = enc.Encode(obj)
+		case listOpts.Format == "json":
+			err = enc.Encode(map[string]string{"prefix": name})
+		case isObject:
+			_, err = fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", obj.Key, obj.Size, obj.LastModified, obj.ContentType)
+		default:
+			_, err = fmt.Fprintln(out, name)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(matched), nil
+}
+
+// listPrefixes are the given prefix, or else those of the target paths
+func (u *uploader) listPrefixes(prefix string) []string {
+	if prefix != "" {
+		return []string{prefix}
+	}
+
+	prefixes := []string{}
+	for _, targetPath := range u.Opts.TargetPaths {
+		prefixes = append(prefixes, syncPrefix(targetPath))
+	}
+	return prefixes
+}
+
+// listContentTypes asks for the content type of each object that wasn't
+// listed with one, --concurrency at a time
+func (u *uploader) listContentTypes(objects []*RemoteObject) error {
+	cp, ok := u.Provider.(contentTypeProvider)
+	if !ok {
+		return nil
+	}
+
+	todo := make(chan *RemoteObject, len(objects))
+	for _, obj := range objects {
+		if obj.ContentType == "" {
+			todo <- obj
+		}
+	}
+	close(todo)
+
+	workers := u.Opts.Concurrency
+	if workers == 0 {
+		workers = 1
+	}
+
+	errs := make(chan error, workers)
+	for i := uint64(0); i < workers; i++ {
+		go func() {
+			for obj := range todo {
+				ctype, err := cp.remoteContentType(obj.Key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				obj.ContentType = ctype
+			}
+			errs <- nil
+		}()
+	}
+
+	var firstErr error
+	for i := uint64(0); i < workers; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s3p *s3Provider) ListRemote(prefix string, recursive bool) ([]*RemoteObject, []string, error) {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	delim := "/"
+	if recursive {
+		delim = ""
+	}
+
+	objects := []*RemoteObject{}
+	dirs := []string{}
+	marker := ""
+	for {
+		resp, err := bucket.List(prefix, delim, marker, 1000)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, key := range resp.Contents {
+			objects = append(objects, &RemoteObject{Key: key.Key, Size: key.Size, LastModified: key.LastModified})
+			marker = key.Key
+		}
+		for _, dir := range resp.CommonPrefixes {
+			dirs = append(dirs, dir)
+			if dir > marker {
+				marker = dir
+			}
+		}
+		if resp.NextMarker != "" {
+			marker = resp.NextMarker
+		}
+
+		if !resp.IsTruncated || (len(resp.Contents) == 0 && len(resp.CommonPrefixes) == 0) {
+			return objects, dirs, nil
+		}
+	}
+}
+
+func (s3p *s3Provider) remoteContentType(key string) (string, error) {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := bucket.Head(key)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("Content-Type"), nil
+}
+
+func (gp *gcsProvider) ListRemote(prefix string, recursive bool) ([]*RemoteObject, []string, error) {
+	token, err := gp.accessToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objects := []*RemoteObject{}
+	dirs := []string{}
+	pageToken := ""
+	for {
+		q := url.Values{"prefix": []string{prefix}}
+		if !recursive {
+			q.Set("delimiter", "/")
+		}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/storage/v1/b/%s/o?%s",
+			strings.TrimRight(gp.opts.GCSEndpoint, "/"), url.PathEscape(gp.opts.BucketName), q.Encode()), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		page := struct {
+			Items         []*gcsObject `json:"items"`
+			Prefixes      []string     `json:"prefixes"`
+			NextPageToken string       `json:"nextPageToken"`
+		}{}
+		if err := gp.getJSON(req, &page); err != nil {
+			return nil, nil, err
+		}
+
+		for _, item := range page.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, &RemoteObject{
+				Key:          item.Name,
+				Size:         size,
+				LastModified: item.Updated,
+				ContentType:  item.ContentType,
+			})
+		}
+		dirs = append(dirs, page.Prefixes...)
+
+		if page.NextPageToken == "" {
+			return objects, dirs, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (gp *gcsProvider) getJSON(req *http.Request, v interface{}) error {
+	resp, err := gp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("gcs list failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return categorize(FailureCredentials, err)
+		}
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,264 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+var (
+	listTestNow  = time.Date(2014, 10, 14, 12, 0, 0, 0, time.UTC)
+	listTestKeys = map[string]s3.Key{
+		"big-old": s3.Key{Key: "builds/1/app.tar.gz", Size: 200000000, LastModified: "2014-09-30T12:00:00.000Z"},
+		"big-new": s3.Key{Key: "builds/9/app.tar.gz", Size: 150000000, LastModified: "2014-10-14T11:00:00.000Z"},
+		"log-old": s3.Key{Key: "builds/1/logs/test.log", Size: 2000, LastModified: "2014-10-01T12:00:00.000Z"},
+		"log-new": s3.Key{Key: "builds/9/logs/test.log", Size: 5000, LastModified: "2014-10-14T09:00:00.000Z"},
+	}
+)
+
+func listTestMatches(t *testing.T, lo *ListOptions) []string {
+	matched := []string{}
+	for _, name := range []string{"big-old", "big-new", "log-old", "log-new"} {
+		if lo.Match(listTestKeys[name], listTestNow) {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
+
+func TestListOptionsPredicates(t *testing.T) {
+	for _, c := range []struct {
+		Args     []string
+		Expected string
+	}{
+		{[]string{"", "", "", "", ""}, "big-old big-new log-old log-new"},
+		{[]string{"**/*.log", "", "", "", ""}, "log-old log-new"},
+		{[]string{"builds/1/*", "", "", "", ""}, "big-old"},
+		{[]string{"", "100MB", "", "", ""}, "big-old big-new"},
+		{[]string{"", "", "4KB", "", ""}, "log-old"},
+		{[]string{"", "", "", "7d", ""}, "big-old log-old"},
+		{[]string{"", "", "", "", "2h"}, "big-new"},
+		{[]string{"", "", "", "", "1d"}, "big-new log-new"},
+	} {
+		lo, err := NewListOptions(c.Args[0], c.Args[1], c.Args[2], c.Args[3], c.Args[4])
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", c.Args, err)
+		}
+
+		if actual := strings.Join(listTestMatches(t, lo), " "); actual != c.Expected {
+			t.Errorf("%v matched %q != %q", c.Args, actual, c.Expected)
+		}
+	}
+}
+
+func TestListOptionsCombined(t *testing.T) {
+	for _, c := range []struct {
+		Args     []string
+		Expected string
+	}{
+		{[]string{"", "100MB", "", "7d", ""}, "big-old"},
+		{[]string{"**/*.log", "", "", "", "1d"}, "log-new"},
+		{[]string{"**/*.log", "3KB", "10KB", "", "1d"}, "log-new"},
+		{[]string{"builds/9/**", "100MB", "", "7d", ""}, ""},
+	} {
+		lo, err := NewListOptions(c.Args[0], c.Args[1], c.Args[2], c.Args[3], c.Args[4])
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", c.Args, err)
+		}
+
+		if actual := strings.Join(listTestMatches(t, lo), " "); actual != c.Expected {
+			t.Errorf("%v matched %q != %q", c.Args, actual, c.Expected)
+		}
+	}
+}
+
+func TestNewListOptionsInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		[]string{"", "lots", "", "", ""},
+		[]string{"", "", "-1", "", ""},
+		[]string{"", "", "", "a week", ""},
+		[]string{"", "", "", "", "xd"},
+		[]string{"", "10MB", "1MB", "", ""},
+	} {
+		if _, err := NewListOptions(args[0], args[1], args[2], args[3], args[4]); err == nil {
+			t.Errorf("invalid filters %v were accepted", args)
+		}
+	}
+}
+
+func TestListOptionsUnparseableTime(t *testing.T) {
+	lo := &ListOptions{OlderThan: time.Hour}
+	if lo.Match(s3.Key{Key: "k", LastModified: "yesterday"}, listTestNow) {
+		t.Fatalf("object with an unparseable time passed an age filter")
+	}
+}
+
+func TestList(t *testing.T) {
+	os.Clearenv()
+	b := testS3.Bucket("bucket")
+	for key, content := range map[string]string{
+		"list-test/a.txt":     "aaaa",
+		"list-test/sub/b.log": "bbbbbbbbbb",
+		"elsewhere/c.txt":     "c",
+	} {
+		if err := b.Put(key, []byte(content), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.TargetPaths = []string{"list-test"}
+	})
+
+	out := &bytes.Buffer{}
+	count, err := u.list(&ListOptions{MinSize: 2, NewerThan: time.Hour}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("listed %v objects != 2", count)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "list-test/a.txt\t4\t") ||
+		!strings.HasPrefix(lines[1], "list-test/sub/b.log\t10\t") {
+		t.Fatalf("unexpected listing %q", out.String())
+	}
+
+	out.Reset()
+	count, _ = u.list(&ListOptions{Glob: "**/*.log"}, out)
+	if count != 1 || !strings.HasPrefix(out.String(), "list-test/sub/b.log\t") {
+		t.Fatalf("unexpected glob listing %q", out.String())
+	}
+}
+
+func TestListRequiresS3(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	if _, err := newUploader(opts, getPanicLogger()).list(&ListOptions{}, &bytes.Buffer{}); err == nil {
+		t.Fatalf("list with the null provider was accepted")
+	}
+}
+
+func TestListShallow(t *testing.T) {
+	os.Clearenv()
+	b := testS3.Bucket("bucket")
+	for key, content := range map[string]string{
+		"shallow-test/a.txt":          "aaaa",
+		"shallow-test/1/b.log":        "bb",
+		"shallow-test/2/c.log":        "cc",
+		"shallow-test/2/deeper/d.log": "dd",
+	} {
+		if err := b.Put(key, []byte(content), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+	})
+
+	out := &bytes.Buffer{}
+	count, err := u.list(&ListOptions{Prefix: "shallow-test/", Shallow: true}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("listed %v objects != 1", count)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "shallow-test/1/" || lines[1] != "shallow-test/2/" ||
+		!strings.HasPrefix(lines[2], "shallow-test/a.txt\t4\t") || !strings.HasSuffix(lines[2], "\ttext/plain") {
+		t.Fatalf("unexpected listing %q", out.String())
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	os.Clearenv()
+	b := testS3.Bucket("bucket")
+	if err := b.Put("json-test/report.html", []byte("<html></html>"), "text/html", s3.Private); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+	})
+
+	out := &bytes.Buffer{}
+	if _, err := u.list(&ListOptions{Prefix: "json-test/", Format: "json"}, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	obj := &RemoteObject{}
+	if err := json.Unmarshal(out.Bytes(), obj); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if obj.Key != "json-test/report.html" || obj.Size != 13 || obj.ContentType != "text/html" || obj.LastModified == "" {
+		t.Fatalf("unexpected object %#v", obj)
+	}
+
+	if _, err := u.list(&ListOptions{Format: "diff"}, out); err == nil ||
+		err.Error() != `invalid --format "diff" (expected text or json)` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestListGCS(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{
+		"report.html":    "<html></html>",
+		"build.log":      "ok",
+		"logs/test.log":  "passed",
+		"logs/extra.log": "more",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "report.html", "build.log", "logs"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	count, err := u.list(&ListOptions{MinSize: 3}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if count != 3 || len(lines) != 3 || !strings.HasPrefix(lines[0], "gcs/logs/extra.log\t4\t2014-10-14T12:00:00.000Z\ttext/") ||
+		!strings.HasPrefix(lines[2], "gcs/report.html\t13\t") {
+		t.Fatalf("unexpected listing %q", out.String())
+	}
+
+	out.Reset()
+	count, err = u.list(&ListOptions{Shallow: true}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	if count != 2 || len(lines) != 3 || lines[1] != "gcs/logs/" {
+		t.Fatalf("unexpected shallow listing %q", out.String())
+	}
+
+	for _, token := range fg.tokens {
+		if token != "Bearer sekrit" {
+			t.Fatalf("authorization %q != Bearer sekrit", token)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package upload
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// pathListSeparator splits the lists of local paths given in one string,
+// such as $ARTIFACTS_PATHS: ":" as for the other lists, but ";" on
+// Windows, where a ":" follows each drive letter
+var pathListSeparator = string(filepath.ListSeparator)
+
+// pathListOpts are the slice options holding local paths
+var pathListOpts = map[string]bool{
+	"Paths": true,
+}
+
+// listSeparator is what a list given in one string is split on for the
+// option
+func listSeparator(fieldName string) string {
+	if pathListOpts[fieldName] {
+		return pathListSeparator
+	}
+	return ":"
+}
+
+// splitList splits a list given in one string for the option, trimming
+// each part and leaving out the empty ones
+func splitList(fieldName, value string) []string {
+	if fieldName == "Metadata" {
+		return splitMetadataList(value)
+	}
+
+	parts := []string{}
+	for _, part := range strings.Split(value, listSeparator(fieldName)) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// splitPathArg splits a path argument into the local path and the dest
+// after the first ":", if any, looking past the drive letter of a
+// Windows path such as C:\build\out:reports
+func splitPathArg(s string) (string, string) {
+	vol := len(filepath.VolumeName(s))
+	i := strings.Index(s[vol:], ":")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:vol+i], s[vol+i+1:]
+}
+
+// keyPath is a local path as part of an object key, with forward slashes
+// and without a volume name
+func keyPath(p string) string {
+	return filepath.ToSlash(strings.TrimPrefix(p, filepath.VolumeName(p)))
+}
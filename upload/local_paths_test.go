@@ -0,0 +1,41 @@
+package upload
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPathArg(t *testing.T) {
+	for arg, expected := range map[string][2]string{
+		"out":            {"out", ""},
+		"out/:reports":   {"out/", "reports"},
+		"-:stdin.txt":    {"-", "stdin.txt"},
+		"out:reports:to": {"out", "reports:to"},
+	} {
+		from, to := splitPathArg(arg)
+		if from != expected[0] || to != expected[1] {
+			t.Fatalf("%q split into %q, %q != %q", arg, from, to, expected)
+		}
+	}
+}
+
+func TestPathListSeparator(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	// as on Windows
+	defer func(sep string) { pathListSeparator = sep }(pathListSeparator)
+	pathListSeparator = ";"
+
+	os.Setenv("ARTIFACTS_PATHS", `C:\build\out;D:\logs:logs`)
+	os.Setenv("ARTIFACTS_EXCLUDES", "*.tmp:*.swp")
+	opts := NewOptions()
+
+	if !reflect.DeepEqual(opts.Paths, []string{`C:\build\out`, `D:\logs:logs`}) {
+		t.Fatalf("paths from env %q", opts.Paths)
+	}
+	if !reflect.DeepEqual(opts.Excludes, []string{"*.tmp", "*.swp"}) {
+		t.Fatalf("excludes from env %q", opts.Excludes)
+	}
+}
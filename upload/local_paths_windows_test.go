@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSplitPathArgWindows(t *testing.T) {
+	for arg, expected := range map[string][2]string{
+		`C:\build\out`:         {`C:\build\out`, ""},
+		`C:\build\out:reports`: {`C:\build\out`, "reports"},
+		`out\logs:logs`:        {`out\logs`, "logs"},
+	} {
+		from, to := splitPathArg(arg)
+		if from != expected[0] || to != expected[1] {
+			t.Fatalf("%q split into %q, %q != %q", arg, from, to, expected)
+		}
+	}
+}
+
+func TestKeyPathWindows(t *testing.T) {
+	for p, expected := range map[string]string{
+		`out\logs\a.log`:    "out/logs/a.log",
+		`C:\build\out\a.js`: "/build/out/a.js",
+	} {
+		if actual := keyPath(p); actual != expected {
+			t.Fatalf("key path of %q %q != %q", p, actual, expected)
+		}
+	}
+}
+
+func TestPathsFromEnvWindows(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	os.Setenv("ARTIFACTS_PATHS", `C:\build\out;D:\logs`)
+	if opts := NewOptions(); !reflect.DeepEqual(opts.Paths, []string{`C:\build\out`, `D:\logs`}) {
+		t.Fatalf("paths from env %q", opts.Paths)
+	}
+}
+
+func TestUploaderWindowsKeys(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/logs/a.log": "a",
+		"out/b.txt":      "b",
+	})
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{filepath.Join(dir, "out") + `:reports\win`}
+		opts.TargetPaths = []string{"windows-test"}
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dests := rp.FullDests()
+	sort.Strings(dests)
+	expected := []string{"windows-test/reports/win/b.txt", "windows-test/reports/win/logs/a.log"}
+	if !reflect.DeepEqual(dests, expected) {
+		t.Fatalf("keys %v != %v", dests, expected)
+	}
+}
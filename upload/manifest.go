@@ -0,0 +1,195 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	manifestVersion = 1
+)
+
+// manifest lists every artifact of a run along with the key it was
+// uploaded to, as written by --output-manifest
+type manifest struct {
+	Version   int              `json:"version"`
+	Artifacts []*manifestEntry `json:"artifacts"`
+}
+
+// manifestEntry is one artifact of a manifest.  Its source is relative to
+// the working dir, unless it was outside of it.
+type manifestEntry struct {
+	Source      string `json:"source"`
+	Key         string `json:"key"`
+	OriginalKey string `json:"original_key,omitempty"`
+	AliasOf     string `json:"alias_of,omitempty"`
+	URL         string `json:"url,omitempty"`
+	SignedURL   string `json:"signed_url,omitempty"`
+	Size        uint64 `json:"size"`
+	ContentType string `json:"content_type"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// newManifest lists the artifacts, including failed ones
+func newManifest(workingDir string, artifacts []*artifact.Artifact) *manifest {
+	m := &manifest{
+		Version:   manifestVersion,
+		Artifacts: []*manifestEntry{},
+	}
+
+	for _, a := range artifacts {
+		size, _ := a.Size()
+		status, errString := uploadStatus(a)
+		m.Artifacts = append(m.Artifacts, &manifestEntry{
+			Source:      filepath.ToSlash(relToWorkingDir(workingDir, a.Source)),
+			Key:         a.FullDest(),
+			OriginalKey: a.OriginalKey,
+			AliasOf:     a.AliasOf,
+			URL:         a.UploadResult.URL,
+			SignedURL:   a.UploadResult.SignedURL,
+			Size:        size,
+			ContentType: a.ContentType(),
+			Status:      status,
+			Error:       errString,
+			Metadata:    a.Metadata,
+		})
+	}
+
+	return m
+}
+
+func writeManifest(filename, workingDir string, artifacts []*artifact.Artifact) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(newManifest(workingDir, artifacts))
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// manifestArtifacts builds a manifest object for each target path listing
+// the artifacts uploaded under it.  These are only uploaded after all of
+// the other artifacts, so that consumers polling for the manifest never
+// see it before what it lists.
+func (u *uploader) manifestArtifacts() ([]*artifact.Artifact, error) {
+	manifests := []*artifact.Artifact{}
+	for _, targetPath := range u.Opts.TargetPaths {
+		listed := []*artifact.Artifact{}
+		for _, a := range u.manifestResults() {
+			if a.Prefix == targetPath {
+				listed = append(listed, a)
+			}
+		}
+
+		body, err := json.MarshalIndent(newManifest(u.Opts.WorkingDir, listed), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests,
+			artifact.NewFromBytes(targetPath, u.Opts.ManifestKey, append(body, '\n'), u.artifactOptions()))
+	}
+
+	return manifests, nil
+}
+
+func readManifest(filename string) (*manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	m := &manifest{}
+	err = json.NewDecoder(f).Decode(m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d", filename, m.Version)
+	}
+
+	for i, entry := range m.Artifacts {
+		if entry.Source == "" || entry.Key == "" {
+			return nil, fmt.Errorf("%s: artifact %d is missing its source or key", filename, i)
+		}
+	}
+
+	return m, nil
+}
+
+// republishedEntries are the manifest entries that were uploaded, with
+// their sources resolved against the working dir.  Those that failed
+// to upload are skipped, since their sources may never have been
+// complete.
+func (u *uploader) republishedEntries(m *manifest) []*manifestEntry {
+	entries := []*manifestEntry{}
+	for _, entry := range m.Artifacts {
+		if entry.Status != "uploaded" && entry.Status != "aliased" {
+			u.log.WithFields(logrus.Fields{
+				"source": entry.Source,
+				"key":    entry.Key,
+				"status": entry.Status,
+			}).Warn("skipping manifest entry that was not uploaded")
+			continue
+		}
+
+		resolved := *entry
+		resolved.Source = filepath.FromSlash(entry.Source)
+		if !filepath.IsAbs(resolved.Source) {
+			resolved.Source = filepath.Join(u.Opts.WorkingDir, resolved.Source)
+		}
+		entries = append(entries, &resolved)
+	}
+
+	return entries
+}
+
+// missingManifestSources reports the sources in the manifest that do not
+// exist, so that a republish fails before anything is uploaded
+func missingManifestSources(entries []*manifestEntry) error {
+	missing := []string{}
+	for _, entry := range entries {
+		if _, err := os.Stat(entry.Source); err != nil {
+			missing = append(missing, entry.Source)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("manifest sources do not exist: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// manifestFeeder sends an artifact for each manifest entry, uploading its
+// source to exactly the recorded key
+func (u *uploader) manifestFeeder(entries []*manifestEntry, artifacts chan *artifact.Artifact) {
+	artifactOpts := u.artifactOptions()
+
+	for _, entry := range entries {
+		artifacts <- artifact.New("", entry.Source, entry.Key, artifactOpts)
+	}
+
+	close(artifacts)
+}
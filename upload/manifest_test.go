@@ -0,0 +1,264 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeTestManifest(t *testing.T) (string, string) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world",
+	})
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "sub/"}
+	opts.TargetPaths = []string{"t1"}
+	opts.OutputManifest = filepath.Join(dir, "manifest.json")
+
+	err := newUploader(opts, getPanicLogger()).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return dir, opts.OutputManifest
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir, manifestPath := writeTestManifest(t)
+	defer os.RemoveAll(dir)
+
+	m, err := readManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(m.Artifacts) != 2 {
+		t.Fatalf("artifacts %v != 2", len(m.Artifacts))
+	}
+
+	for _, entry := range m.Artifacts {
+		if entry.Key == "t1/a.txt" && (entry.Size != 5 || entry.Status != "uploaded") {
+			t.Fatalf("unexpected entry: %#v", entry)
+		}
+	}
+}
+
+func TestUploadFromManifest(t *testing.T) {
+	dir, manifestPath := writeTestManifest(t)
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.FromManifest = manifestPath
+	opts.WorkingDir = dir
+	opts.TargetPaths = []string{"ignored"}
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dests := rp.FullDests()
+	sort.Strings(dests)
+	if !reflect.DeepEqual(dests, []string{"t1/a.txt", "t1/sub/b.txt"}) {
+		t.Fatalf("republished %v != [t1/a.txt t1/sub/b.txt]", dests)
+	}
+}
+
+func TestUploadFromManifestSkipsFailed(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "hello",
+		"manifest.json": `{"version": 1, "artifacts": [
+			{"source": "a.txt", "key": "t1/a.txt", "status": "uploaded"},
+			{"source": "gone.txt", "key": "t1/gone.txt", "status": "failed"}
+		]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.FromManifest = filepath.Join(dir, "manifest.json")
+	opts.WorkingDir = dir
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(rp.FullDests(), []string{"t1/a.txt"}) {
+		t.Fatalf("republished %v != [t1/a.txt]", rp.FullDests())
+	}
+}
+
+func TestUploadFromManifestMissingSource(t *testing.T) {
+	dir, manifestPath := writeTestManifest(t)
+	defer os.RemoveAll(dir)
+
+	err := os.Remove(filepath.Join(dir, "sub", "b.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts := NewOptions()
+	opts.FromManifest = manifestPath
+	opts.WorkingDir = dir
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err = u.Upload()
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "sub", "b.txt")) {
+		t.Fatalf("missing source was not reported: %v", err)
+	}
+
+	if len(rp.FullDests()) != 0 {
+		t.Fatalf("artifacts were uploaded: %v", rp.FullDests())
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"bad-json.json":    "{nope",
+		"bad-version.json": `{"version": 9, "artifacts": []}`,
+		"no-key.json":      `{"version": 1, "artifacts": [{"source": "a.txt"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, fi := range files {
+		if _, err := readManifest(filepath.Join(dir, fi.Name())); err == nil {
+			t.Fatalf("invalid manifest %v was accepted", fi.Name())
+		}
+	}
+}
+
+func uploadWithManifestKey(t *testing.T, includeFailed bool, fail string) (*recordingProvider, string) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world",
+	})
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "sub/"}
+	opts.TargetPaths = []string{"t1"}
+	opts.ManifestKey = "manifest.json"
+	opts.ManifestIncludeFailed = includeFailed
+	opts.SuccessMarker = "_SUCCESS"
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{FailSources: map[string]bool{}}
+	if fail != "" {
+		rp.FailSources[filepath.Join(dir, fail)] = true
+	}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return rp, dir
+}
+
+func uploadedManifest(t *testing.T, rp *recordingProvider, key string) *manifest {
+	for _, a := range rp.Uploaded {
+		if a.FullDest() != key {
+			continue
+		}
+
+		r, err := a.Reader()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		m := &manifest{}
+		err = json.NewDecoder(r).Decode(m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return m
+	}
+
+	return nil
+}
+
+func TestUploaderManifestKeyUploadedLast(t *testing.T) {
+	rp, dir := uploadWithManifestKey(t, false, "")
+	defer os.RemoveAll(dir)
+
+	dests := rp.FullDests()
+	if len(dests) != 4 {
+		t.Fatalf("uploaded %v != 4", dests)
+	}
+
+	if dests[2] != "t1/manifest.json" || dests[3] != "t1/_SUCCESS" {
+		t.Fatalf("manifest was not uploaded after the artifacts and before the marker: %v", dests)
+	}
+
+	m := uploadedManifest(t, rp, "t1/manifest.json")
+	keys := []string{}
+	for _, entry := range m.Artifacts {
+		keys = append(keys, entry.Key)
+	}
+	sort.Strings(keys)
+
+	if !reflect.DeepEqual(keys, []string{"t1/a.txt", "t1/sub/b.txt"}) {
+		t.Fatalf("manifest keys %v != [t1/a.txt t1/sub/b.txt]", keys)
+	}
+}
+
+func TestUploaderManifestKeySkippedOnFailure(t *testing.T) {
+	rp, dir := uploadWithManifestKey(t, false, "a.txt")
+	defer os.RemoveAll(dir)
+
+	if uploadedManifest(t, rp, "t1/manifest.json") != nil {
+		t.Fatalf("manifest was uploaded despite a failed artifact")
+	}
+}
+
+func TestUploaderManifestKeyIncludeFailed(t *testing.T) {
+	rp, dir := uploadWithManifestKey(t, true, "a.txt")
+	defer os.RemoveAll(dir)
+
+	m := uploadedManifest(t, rp, "t1/manifest.json")
+	if m == nil {
+		t.Fatalf("manifest was not uploaded")
+	}
+
+	statuses := map[string]string{}
+	for _, entry := range m.Artifacts {
+		statuses[entry.Key] = entry.Status
+	}
+
+	expected := map[string]string{"t1/a.txt": "failed", "t1/sub/b.txt": "uploaded"}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("manifest statuses %v != %v", statuses, expected)
+	}
+
+	for _, dest := range rp.FullDests() {
+		if dest == "t1/_SUCCESS" {
+			t.Fatalf("success marker was written despite a failed artifact")
+		}
+	}
+}
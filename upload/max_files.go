@@ -0,0 +1,66 @@
+package upload
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// countFile counts a file found by the walk against --max-files,
+// reporting whether it may still be queued.  Files past the limit are
+// counted but not queued, so that the error can give how many there are.
+func (u *uploader) countFile(source string) bool {
+	u.curSize.Lock()
+	defer u.curSize.Unlock()
+
+	u.curSize.Files++
+	if u.Opts.MaxFiles == 0 || u.curSize.Files <= u.Opts.MaxFiles {
+		return true
+	}
+
+	u.decide(source, false, "max-files", fmt.Sprintf("%d", u.Opts.MaxFiles))
+	return false
+}
+
+// maxFilesError fails the walk once it is done if it found more files
+// than --max-files allows
+func (u *uploader) maxFilesError() error {
+	if u.Opts.MaxFiles == 0 || u.curSize.Files <= u.Opts.MaxFiles {
+		return nil
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"files":     u.curSize.Files,
+		"max_files": u.Opts.MaxFiles,
+	}).Error("max-files would be exceeded")
+	return categorize(FailureSizeLimit,
+		fmt.Errorf("found %d files to upload, more than --max-files %d", u.curSize.Files, u.Opts.MaxFiles))
+}
+
+// limitFiles holds every artifact until the walk is done when --max-files
+// is set, so that nothing is uploaded if it finds too many files
+func (u *uploader) limitFiles(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if u.Opts.MaxFiles == 0 {
+		return in, nil
+	}
+
+	held := []*artifact.Artifact{}
+	for a := range in {
+		held = append(held, a)
+	}
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for _, a := range held {
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
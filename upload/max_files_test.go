@@ -0,0 +1,63 @@
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func maxFilesOpts(dir string, limit uint64) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"a.txt", "b.txt", "sub/"}
+		opts.TargetPaths = []string{"one", "two"}
+		opts.MaxFiles = limit
+	}
+}
+
+func TestUploaderMaxFilesExceeded(t *testing.T) {
+	dir := writeKeyLimitFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, maxFilesOpts(dir, 2))
+	u.Provider = rp
+
+	err := u.Upload()
+	if err == nil {
+		t.Fatalf("upload exceeding --max-files succeeded")
+	}
+
+	if !strings.Contains(err.Error(), "found 3 files to upload, more than --max-files 2") {
+		t.Fatalf("error does not give the count and limit: %v", err)
+	}
+
+	if FailureCategory(err) != FailureSizeLimit {
+		t.Fatalf("failure category %q != %q", FailureCategory(err), FailureSizeLimit)
+	}
+
+	if len(rp.FullDests()) != 0 {
+		t.Fatalf("artifacts were uploaded: %v", rp.FullDests())
+	}
+}
+
+func TestUploaderMaxFilesWithinLimit(t *testing.T) {
+	for _, limit := range []uint64{0, 3} {
+		dir := writeKeyLimitFiles(t)
+		defer os.RemoveAll(dir)
+
+		rp := &recordingProvider{}
+		u := getTestUploader(nil, maxFilesOpts(dir, limit))
+		u.Provider = rp
+
+		if err := u.Upload(); err != nil {
+			t.Fatalf("%v: unexpected error: %v", limit, err)
+		}
+
+		// files are counted once, however many target paths they go to
+		if len(rp.FullDests()) != 6 {
+			t.Fatalf("%v: uploaded %v != 6", limit, len(rp.FullDests()))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var (
+	templateTokenRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+	metadataKeyRegexp   = regexp.MustCompile(`^\s*[A-Za-z0-9_.-]+=`)
+	metadataTokens      = map[string]func(*artifact.Artifact) (string, error){
+		"size": func(a *artifact.Artifact) (string, error) {
+			size, err := a.Size()
+			return fmt.Sprintf("%d", size), err
+		},
+		"mtime": func(a *artifact.Artifact) (string, error) {
+			mtime, err := a.ModTime()
+			return mtime.UTC().Format(time.RFC3339), err
+		},
+		"basename": func(a *artifact.Artifact) (string, error) {
+			if a.Source == "" {
+				return filepath.Base(a.Dest), nil
+			}
+			return filepath.Base(a.Source), nil
+		},
+		"sha256": func(a *artifact.Artifact) (string, error) {
+			return a.SHA256()
+		},
+	}
+)
+
+// digestToken is the metadata token that needs the content read through
+const digestToken = "{sha256}"
+
+type metadataEntry struct {
+	Key      string
+	Template string
+}
+
+func parseMetadata(metadata []string) ([]*metadataEntry, error) {
+	entries := []*metadataEntry{}
+
+	for _, s := range metadata {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid metadata %q, expected key=value", s)
+		}
+
+		entries = append(entries, &metadataEntry{
+			Key:      strings.ToLower(strings.TrimSpace(parts[0])),
+			Template: parts[1],
+		})
+	}
+
+	return entries, nil
+}
+
+func validateMetadata(metadata []string) error {
+	entries, err := parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		expanded, err := expandBuildTemplate(entry.Template, &buildTemplateData{})
+		if err != nil {
+			return fmt.Errorf("invalid metadata template in %q: %v", entry.Key, err)
+		}
+
+		for _, match := range templateTokenRegexp.FindAllStringSubmatch(expanded, -1) {
+			if _, ok := metadataTokens[match[1]]; !ok {
+				return fmt.Errorf("unknown metadata token %q in %q", match[0], entry.Key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// expandMetadata executes the {{...}} templates in the metadata values
+// against the build, leaving the {size} and other per-artifact tokens for
+// resolveMetadata
+func expandMetadata(opts *Options, log *logrus.Logger) []string {
+	data := newBuildTemplateData(opts)
+
+	ret := []string{}
+	for _, s := range opts.Metadata {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) == 2 {
+			value, err := expandBuildTemplate(parts[1], data)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"metadata": s,
+					"err":      err,
+				}).Warn("not expanding metadata")
+			} else {
+				s = parts[0] + "=" + value
+			}
+		}
+		ret = append(ret, s)
+	}
+
+	return ret
+}
+
+// splitMetadataList splits a ':'-delimited list of metadata only before
+// the parts that start a new key=, so that values keep the ':' in urls and
+// times, as in url=https://example.com/x:built=12:30
+func splitMetadataList(value string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(value, ":") {
+		if len(parts) > 0 && strings.TrimSpace(part) != "" && !metadataKeyRegexp.MatchString(part) {
+			parts[len(parts)-1] += ":" + part
+			continue
+		}
+		parts = append(parts, part)
+	}
+
+	ret := []string{}
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			ret = append(ret, part)
+		}
+	}
+	return ret
+}
+
+// withoutDigestMetadata leaves out the metadata using {sha256} unless the
+// artifact's digest is already known, for providers that can store the
+// metadata again once the upload is done.  Reading the content through for
+// the upload hashes it, so that those entries can be sent afterwards
+// instead of reading the content through once more beforehand.  The bool
+// is whether any were left out.
+func withoutDigestMetadata(metadata []string, a *artifact.Artifact) ([]string, bool) {
+	if a.KnownSHA256() != "" {
+		return metadata, false
+	}
+
+	ret := []string{}
+	for _, s := range metadata {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) == 2 && strings.Contains(parts[1], digestToken) {
+			continue
+		}
+		ret = append(ret, s)
+	}
+
+	return ret, len(ret) < len(metadata)
+}
+
+// resolveMetadata expands the metadata templates for the artifact, with
+// the artifact's own metadata on top
+func resolveMetadata(metadata []string, a *artifact.Artifact) (map[string]string, error) {
+	entries, err := parseMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := map[string]string{}
+	for _, entry := range entries {
+		var tokenErr error
+		resolved[entry.Key] = templateTokenRegexp.ReplaceAllStringFunc(entry.Template, func(token string) string {
+			fn, ok := metadataTokens[strings.Trim(token, "{}")]
+			if !ok {
+				tokenErr = fmt.Errorf("unknown metadata token %q in %q", token, entry.Key)
+				return token
+			}
+
+			value, err := fn(a)
+			if err != nil {
+				tokenErr = err
+			}
+			return value
+		})
+
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+	}
+
+	for key, value := range a.Metadata {
+		resolved[key] = value
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	for s, valid := range map[string]bool{
+		"orig-mtime={mtime}":              true,
+		"info={basename} is {size} bytes": true,
+		"sum={sha256}":                    true,
+		"static=value":                    true,
+		"empty=":                          true,
+		"commit={{.Commit}}":              true,
+		"both={{.Branch}}/{size}":         true,
+		"nope={bogus}":                    false,
+		"nofield={{.Bogus}}":              false,
+		"unclosed={{.Commit":              false,
+		"novalue":                         false,
+		"=nokey":                          false,
+	} {
+		err := validateMetadata([]string{s})
+		if valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q: invalid metadata was accepted", s)
+		}
+	}
+}
+
+func TestResolveMetadata(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":     "hello",
+		"sub/b.bin": "hello, world",
+	})
+	defer os.RemoveAll(dir)
+
+	mtime := time.Date(2014, 6, 1, 12, 30, 0, 0, time.UTC)
+	metadata := []string{"Orig-Mtime={mtime}", "info={basename}:{size}", "sum={sha256}"}
+
+	for name, size := range map[string]string{"a.txt": "5", "sub/b.bin": "12"} {
+		source := filepath.Join(dir, filepath.FromSlash(name))
+		os.Chtimes(source, mtime, mtime)
+
+		body := "hello"
+		if size == "12" {
+			body = "hello, world"
+		}
+		digest := sha256.Sum256([]byte(body))
+
+		a := artifact.New("bucket", source, name, &artifact.Options{})
+		resolved, err := resolveMetadata(metadata, a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := map[string]string{
+			"orig-mtime": "2014-06-01T12:30:00Z",
+			"info":       filepath.Base(source) + ":" + size,
+			"sum":        hex.EncodeToString(digest[:]),
+		}
+
+		for k, v := range expected {
+			if resolved[k] != v {
+				t.Fatalf("%v: metadata %v %q != %q", name, k, resolved[k], v)
+			}
+		}
+	}
+}
+
+func TestExpandMetadata(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"TRAVIS":          "true",
+		"TRAVIS_COMMIT":   "abc123",
+		"TRAVIS_BUILD_ID": "99",
+	})
+
+	opts := NewOptions()
+	opts.Metadata = []string{
+		"commit={{.Commit}}",
+		"build={{.BuildID}}-{size}",
+		`missing={{.Env "UNSET"}}`,
+		"static=value",
+	}
+
+	expected := []string{"commit=abc123", "build=99-{size}", "missing=", "static=value"}
+	if actual := expandMetadata(opts, getPanicLogger()); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("metadata %v != %v", actual, expected)
+	}
+}
+
+func TestNewUploaderWarnsMetadataUnsupported(t *testing.T) {
+	os.Clearenv()
+	for provider, warns := range map[string]bool{"artifacts": true, "s3": false, "null": false} {
+		log, buf := getBufferLogger()
+		getTestUploader(log, func(opts *Options) {
+			opts.Provider = provider
+			opts.Metadata = []string{"commit={{.Commit}}"}
+		})
+
+		warned := strings.Contains(buf.String(), "provider does not store metadata")
+		if warned != warns {
+			t.Fatalf("%v: warned about metadata %v != %v\n%s", provider, warned, warns, buf.String())
+		}
+	}
+}
+
+func TestSplitMetadataList(t *testing.T) {
+	for value, expected := range map[string][]string{
+		"a=1:b=2":                       {"a=1", "b=2"},
+		"url=https://example.com/x:b=2": {"url=https://example.com/x", "b=2"},
+		"built=12:30:00":                {"built=12:30:00"},
+		" a=1 : :q=http://x?y=z:":       {"a=1", "q=http://x?y=z"},
+	} {
+		if actual := splitList("Metadata", value); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%q: %v != %v", value, actual, expected)
+		}
+	}
+}
+
+func TestWithoutDigestMetadata(t *testing.T) {
+	metadata := []string{"name={basename}", "sum={sha256}", "both={size}-{sha256}"}
+
+	a := artifact.NewFromBytes("bucket", "hello.txt", []byte("hello"), &artifact.Options{})
+	without, deferred := withoutDigestMetadata(metadata, a)
+	if !deferred || !reflect.DeepEqual(without, []string{"name={basename}"}) {
+		t.Fatalf("unexpected %v %v", without, deferred)
+	}
+
+	a.SHA256()
+	without, deferred = withoutDigestMetadata(metadata, a)
+	if deferred || !reflect.DeepEqual(without, metadata) {
+		t.Fatalf("unexpected %v %v once the digest is known", without, deferred)
+	}
+}
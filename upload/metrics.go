@@ -0,0 +1,329 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	prometheusNamespace = "artifacts"
+	statsdPrefix        = "artifacts"
+
+	// statsdPacketSize keeps each packet under the MTU of most networks
+	statsdPacketSize = 1432
+)
+
+// uploadDurationBuckets are the upper bounds, in seconds, of the upload
+// latency histogram
+var uploadDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// providerMetrics are what one provider did in a run
+type providerMetrics struct {
+	Uploaded uint64
+	Failed   uint64
+	Bytes    uint64
+	Retries  uint64
+
+	// Durations are the upload time of each artifact, for the histogram
+	// and for StatsD timers
+	Durations []time.Duration
+}
+
+// metrics counts what each provider uploads as the artifacts finish, and
+// sends it all once the run is done.  It is only created with
+// --metrics-file or --statsd-addr, so that nothing is counted otherwise.
+type metrics struct {
+	sync.Mutex
+	providers map[string]*providerMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{providers: map[string]*providerMetrics{}}
+}
+
+func (opts *Options) validateMetrics() error {
+	if opts.StatsdAddr == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(opts.StatsdAddr); err != nil {
+		return fmt.Errorf("invalid --statsd-addr %q, expected host:port: %v", opts.StatsdAddr, err)
+	}
+	return nil
+}
+
+// ArtifactDone counts the artifact's upload for the provider
+func (m *metrics) ArtifactDone(a *artifact.Artifact, provider string) {
+	size, _ := a.Size()
+
+	m.Lock()
+	defer m.Unlock()
+
+	pm, ok := m.providers[provider]
+	if !ok {
+		pm = &providerMetrics{}
+		m.providers[provider] = pm
+	}
+
+	if a.UploadResult.OK {
+		pm.Uploaded++
+		pm.Bytes += size
+	} else {
+		pm.Failed++
+	}
+	if a.UploadResult.Attempts > 1 {
+		pm.Retries += a.UploadResult.Attempts - 1
+	}
+	pm.Durations = append(pm.Durations, a.UploadResult.Duration)
+}
+
+// providerNames are the providers that uploaded anything, in order
+func (m *metrics) providerNames() []string {
+	names := []string{}
+	for name := range m.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runMetrics are the totals of a run, alongside those of each provider
+type runMetrics struct {
+	Duration         time.Duration
+	SkippedUnchanged uint64
+	Success          bool
+	Finished         time.Time
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writePrometheus writes the metrics in the Prometheus text exposition
+// format, as the node_exporter textfile collector reads it
+func (m *metrics) writePrometheus(w io.Writer, run *runMetrics) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var buf bytes.Buffer
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", prometheusNamespace, name, help, prometheusNamespace, name, kind)
+	}
+	perProvider := func(name, kind, help string, value func(*providerMetrics) uint64) {
+		family(name, kind, help)
+		for _, provider := range m.providerNames() {
+			fmt.Fprintf(&buf, "%s_%s{provider=%q} %d\n", prometheusNamespace, name, provider, value(m.providers[provider]))
+		}
+	}
+
+	perProvider("uploaded_bytes_total", "counter", "Bytes of artifacts uploaded.",
+		func(pm *providerMetrics) uint64 { return pm.Bytes })
+	perProvider("uploaded_total", "counter", "Artifacts uploaded.",
+		func(pm *providerMetrics) uint64 { return pm.Uploaded })
+	perProvider("upload_failures_total", "counter", "Artifacts that failed to upload.",
+		func(pm *providerMetrics) uint64 { return pm.Failed })
+	perProvider("upload_retries_total", "counter", "Upload attempts after the first.",
+		func(pm *providerMetrics) uint64 { return pm.Retries })
+
+	family("upload_duration_seconds", "histogram", "Time taken to upload each artifact, retries included.")
+	for _, provider := range m.providerNames() {
+		pm := m.providers[provider]
+
+		sum := 0.0
+		counts := make([]uint64, len(uploadDurationBuckets))
+		for _, d := range pm.Durations {
+			sum += d.Seconds()
+			for i, le := range uploadDurationBuckets {
+				if d.Seconds() <= le {
+					counts[i]++
+				}
+			}
+		}
+
+		for i, le := range uploadDurationBuckets {
+			fmt.Fprintf(&buf, "%s_upload_duration_seconds_bucket{provider=%q,le=%q} %d\n",
+				prometheusNamespace, provider, formatFloat(le), counts[i])
+		}
+		fmt.Fprintf(&buf, "%s_upload_duration_seconds_bucket{provider=%q,le=\"+Inf\"} %d\n",
+			prometheusNamespace, provider, len(pm.Durations))
+		fmt.Fprintf(&buf, "%s_upload_duration_seconds_sum{provider=%q} %s\n", prometheusNamespace, provider, formatFloat(sum))
+		fmt.Fprintf(&buf, "%s_upload_duration_seconds_count{provider=%q} %d\n", prometheusNamespace, provider, len(pm.Durations))
+	}
+
+	success := 0
+	if run.Success {
+		success = 1
+	}
+
+	family("skipped_unchanged_total", "counter", "Artifacts skipped by --skip-unchanged.")
+	fmt.Fprintf(&buf, "%s_skipped_unchanged_total %d\n", prometheusNamespace, run.SkippedUnchanged)
+	family("run_duration_seconds", "gauge", "Time taken by the last run.")
+	fmt.Fprintf(&buf, "%s_run_duration_seconds %s\n", prometheusNamespace, formatFloat(run.Duration.Seconds()))
+	family("run_success", "gauge", "Whether the last run uploaded everything.")
+	fmt.Fprintf(&buf, "%s_run_success %d\n", prometheusNamespace, success)
+	family("run_timestamp_seconds", "gauge", "When the last run finished.")
+	fmt.Fprintf(&buf, "%s_run_timestamp_seconds %d\n", prometheusNamespace, run.Finished.Unix())
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeMetricsFile writes the Prometheus metrics next to the file and
+// renames it over the file, so that a collector never reads half of it
+func (m *metrics) writeMetricsFile(filename string, run *runMetrics) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".artifacts-metrics")
+	if err != nil {
+		return err
+	}
+
+	err = m.writePrometheus(f, run)
+	if err == nil {
+		// temp files are only readable by their owner
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// statsdName makes the provider safe to use as part of a StatsD name
+func statsdName(s string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", ",", "_", " ", "_").Replace(s)
+}
+
+// statsdLines are the metrics as StatsD lines: counters for each
+// provider, a timer for each upload, and the run's totals
+func (m *metrics) statsdLines(run *runMetrics) []string {
+	m.Lock()
+	defer m.Unlock()
+
+	lines := []string{}
+	for _, provider := range m.providerNames() {
+		pm := m.providers[provider]
+		prefix := statsdPrefix + "." + statsdName(provider)
+
+		lines = append(lines,
+			fmt.Sprintf("%s.uploaded_bytes:%d|c", prefix, pm.Bytes),
+			fmt.Sprintf("%s.uploaded:%d|c", prefix, pm.Uploaded),
+			fmt.Sprintf("%s.failures:%d|c", prefix, pm.Failed),
+			fmt.Sprintf("%s.retries:%d|c", prefix, pm.Retries))
+		for _, d := range pm.Durations {
+			lines = append(lines, fmt.Sprintf("%s.upload_duration:%s|ms", prefix, formatFloat(float64(d)/float64(time.Millisecond))))
+		}
+	}
+
+	success := 0
+	if run.Success {
+		success = 1
+	}
+
+	return append(lines,
+		fmt.Sprintf("%s.skipped_unchanged:%d|c", statsdPrefix, run.SkippedUnchanged),
+		fmt.Sprintf("%s.run_duration:%s|ms", statsdPrefix, formatFloat(float64(run.Duration)/float64(time.Millisecond))),
+		fmt.Sprintf("%s.run_success:%d|g", statsdPrefix, success))
+}
+
+// sendStatsd sends the StatsD lines over UDP, as many to a packet as fit
+func (m *metrics) sendStatsd(addr string, run *runMetrics) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+
+	for _, line := range m.statsdLines(run) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	return flush()
+}
+
+// startMetrics creates the metrics when --metrics-file or --statsd-addr
+// is set, counting each destination of a fan-out apart
+func (u *uploader) startMetrics() {
+	if u.metrics != nil || (u.Opts.MetricsFile == "" && u.Opts.StatsdAddr == "") {
+		return
+	}
+
+	u.metrics = newMetrics()
+}
+
+// observeMetrics counts the artifact for the provider that uploaded it,
+// which for a fan-out its destinations have already done
+func (u *uploader) observeMetrics(a *artifact.Artifact) {
+	if u.metrics == nil {
+		return
+	}
+	if fp, ok := u.Provider.(*fanoutProvider); ok && fp.observe != nil {
+		return
+	}
+
+	u.metrics.ArtifactDone(a, u.providerName(a))
+}
+
+// finishMetrics writes and sends the metrics, logging rather than
+// failing the upload if that doesn't work
+func (u *uploader) finishMetrics(err error) {
+	if u.metrics == nil {
+		return
+	}
+
+	run := &runMetrics{
+		Duration:         time.Since(u.startTime),
+		SkippedUnchanged: atomic.LoadUint64(&u.skippedUnchanged),
+		Success:          err == nil && len(u.failedResults()) == 0,
+		Finished:         time.Now(),
+	}
+
+	if u.Opts.MetricsFile != "" {
+		if writeErr := u.metrics.writeMetricsFile(u.Opts.MetricsFile, run); writeErr != nil {
+			u.log.WithField("err", writeErr).Warn("failed to write metrics file")
+		}
+	}
+
+	if u.Opts.StatsdAddr != "" {
+		if sendErr := u.metrics.sendStatsd(u.Opts.StatsdAddr, run); sendErr != nil {
+			u.log.WithField("err", sendErr).Warn("failed to send statsd metrics")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package upload
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readMetricsFile(t *testing.T, filename string) string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(b)
+}
+
+func TestUploaderMetrics(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+		"out/b.txt": "bbbbbb",
+	})
+	defer os.RemoveAll(dir)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	metricsFile := filepath.Join(dir, "artifacts.prom")
+	err = getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"metrics-test"}
+		opts.MetricsFile = metricsFile
+		opts.StatsdAddr = conn.LocalAddr().String()
+	}).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prom := readMetricsFile(t, metricsFile)
+	for _, expected := range []string{
+		"# TYPE artifacts_uploaded_bytes_total counter\n",
+		`artifacts_uploaded_bytes_total{provider="s3"} 10` + "\n",
+		`artifacts_uploaded_total{provider="s3"} 2` + "\n",
+		`artifacts_upload_failures_total{provider="s3"} 0` + "\n",
+		"# TYPE artifacts_upload_duration_seconds histogram\n",
+		`artifacts_upload_duration_seconds_bucket{provider="s3",le="+Inf"} 2` + "\n",
+		`artifacts_upload_duration_seconds_count{provider="s3"} 2` + "\n",
+		"artifacts_run_success 1\n",
+	} {
+		if !strings.Contains(prom, expected) {
+			t.Fatalf("metrics file does not contain %q:\n%s", expected, prom)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, statsdPacketSize)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	for _, expected := range []string{
+		"artifacts.s3.uploaded_bytes:10|c",
+		"artifacts.s3.uploaded:2|c",
+		"artifacts.s3.failures:0|c",
+		"artifacts.run_success:1|g",
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == expected
+		}
+		if !found {
+			t.Fatalf("statsd lines %q do not include %q", lines, expected)
+		}
+	}
+}
+
+func TestUploaderMetricsFanout(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	metricsFile := filepath.Join(dir, "artifacts.prom")
+	u := getTestUploader(nil, fanoutTestOpts(dir))
+	u.Opts.MetricsFile = metricsFile
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prom := readMetricsFile(t, metricsFile)
+	for _, expected := range []string{
+		`artifacts_uploaded_total{provider="file"} 1` + "\n",
+		`artifacts_uploaded_total{provider="s3"} 1` + "\n",
+	} {
+		if !strings.Contains(prom, expected) {
+			t.Fatalf("metrics file does not contain %q:\n%s", expected, prom)
+		}
+	}
+	if strings.Contains(prom, `provider="s3,file"`) {
+		t.Fatalf("fan-out counted as a provider of its own:\n%s", prom)
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.StatsdAddr = "localhost"
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid --statsd-addr") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
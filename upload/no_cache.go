@@ -0,0 +1,49 @@
+package upload
+
+import "github.com/travis-ci/artifacts/artifact"
+
+// noCacheControl is the Cache-Control for --no-cache, forbidding caches
+// from storing the object at all as well as serving it stale
+const noCacheControl = "no-store, no-cache, must-revalidate"
+
+// applyNoCache sets noCacheControl on the artifact if --no-cache covers
+// it, unless something more specific already gave it a cache control.
+// Stdin is matched by its dest.
+func (u *uploader) applyNoCache(a *artifact.Artifact, relPath string) {
+	if relPath == stdinPath {
+		relPath = a.Dest
+	}
+
+	if a.CacheControl != "" || !u.noCache(relPath) {
+		return
+	}
+
+	a.CacheControl = noCacheControl
+}
+
+// noCache reports whether --no-cache covers the path, which is all paths
+// unless --no-cache-paths narrows it down
+func (u *uploader) noCache(relPath string) bool {
+	if !u.Opts.NoCache {
+		return false
+	}
+
+	if len(u.Opts.NoCachePaths) == 0 {
+		return true
+	}
+
+	for _, pattern := range u.Opts.NoCachePaths {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl is the artifact's own cache control, or --cache-control
+func cacheControl(opts *Options, a *artifact.Artifact) string {
+	if a.CacheControl != "" {
+		return a.CacheControl
+	}
+	return opts.CacheControl
+}
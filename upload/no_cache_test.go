@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func writeNoCacheFiles(t *testing.T) string {
+	os.Clearenv()
+	return writeTestFiles(t, map[string]string{
+		"secrets/token.txt": "hunter2",
+		"secrets/key.pem":   "-----BEGIN-----",
+		"public/index.html": "hello",
+	})
+}
+
+func noCacheOpts(dir string, noCachePaths []string) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"secrets/", "public/"}
+		opts.TargetPaths = []string{"nc"}
+		opts.CacheControl = "public, max-age=60"
+		opts.NoCache = true
+		opts.NoCachePaths = noCachePaths
+	}
+}
+
+func uploadedCacheControls(u *uploader, rp *recordingProvider) map[string]string {
+	controls := map[string]string{}
+	for _, a := range rp.Uploaded {
+		controls[a.FullDest()] = cacheControl(u.Opts, a)
+	}
+	return controls
+}
+
+func TestUploaderNoCache(t *testing.T) {
+	dir := writeNoCacheFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, noCacheOpts(dir, nil))
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"nc/secrets/token.txt": "no-store, no-cache, must-revalidate",
+		"nc/secrets/key.pem":   "no-store, no-cache, must-revalidate",
+		"nc/public/index.html": "no-store, no-cache, must-revalidate",
+	}
+	if actual := uploadedCacheControls(u, rp); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("cache controls %v != %v", actual, expected)
+	}
+}
+
+func TestUploaderNoCachePaths(t *testing.T) {
+	dir := writeNoCacheFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, noCacheOpts(dir, []string{"secrets/*.txt", "**/*.pem"}))
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"nc/secrets/token.txt": "no-store, no-cache, must-revalidate",
+		"nc/secrets/key.pem":   "no-store, no-cache, must-revalidate",
+		"nc/public/index.html": "public, max-age=60",
+	}
+	if actual := uploadedCacheControls(u, rp); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("cache controls %v != %v", actual, expected)
+	}
+}
+
+func TestS3ProviderNoCacheHeader(t *testing.T) {
+	dir := writeNoCacheFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, noCacheOpts(dir, []string{"secrets/"}))
+
+	for _, c := range [][]string{
+		[]string{"secrets/token.txt", "no-store, no-cache, must-revalidate"},
+		[]string{"public/index.html", "public, max-age=60"},
+	} {
+		a := artifact.New("nc", filepath.Join(dir, c[0]), filepath.Base(c[0]), u.artifactOptions())
+		u.applyNoCache(a, c[0])
+
+		headers, err := newS3Provider(u.Opts, getPanicLogger()).objectHeaders(u.Opts, a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !reflect.DeepEqual(headers["Cache-Control"], []string{c[1]}) {
+			t.Fatalf("%v cache control header %v != [%v]", c[0], headers["Cache-Control"], c[1])
+		}
+	}
+}
+
+func TestApplyNoCacheKeepsExplicitCacheControl(t *testing.T) {
+	dir := writeNoCacheFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, noCacheOpts(dir, nil))
+
+	a := artifact.New("nc", filepath.Join(dir, "secrets/token.txt"), "token.txt", u.artifactOptions())
+	a.CacheControl = "private, max-age=5"
+	u.applyNoCache(a, "secrets/token.txt")
+
+	if a.CacheControl != "private, max-age=5" {
+		t.Fatalf("explicit cache control was replaced with %q", a.CacheControl)
+	}
+}
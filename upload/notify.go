@@ -0,0 +1,216 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// notifyRetries is how many more times a notification is sent after a
+// response that might go better the next time
+const notifyRetries = 3
+
+// notifyPayload is the JSON posted to each --notify-url without a
+// --notify-template
+type notifyPayload struct {
+	Provider        string           `json:"provider"`
+	Bucket          string           `json:"bucket"`
+	Total           int              `json:"total"`
+	Uploaded        int              `json:"uploaded"`
+	Failed          int              `json:"failed"`
+	Bytes           uint64           `json:"bytes"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Artifacts       []*manifestEntry `json:"artifacts"`
+}
+
+// notifyError is a response to a notification outside of 2xx
+type notifyError struct {
+	URL        string
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (ne *notifyError) Error() string {
+	return fmt.Sprintf("notification to %s returned %s: %s", ne.URL, ne.Status, ne.Body)
+}
+
+func (opts *Options) validateNotify() error {
+	for _, notifyURL := range opts.NotifyURLs {
+		u, err := url.Parse(notifyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --notify-url %q (expected an http or https URL)", redactedURL(notifyURL))
+		}
+	}
+
+	if opts.NotifyTemplate != "" {
+		if len(opts.NotifyURLs) == 0 {
+			return fmt.Errorf("--notify-template requires --notify-url")
+		}
+
+		if _, err := parseNotifyTemplate(opts.NotifyTemplate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseNotifyTemplate parses --notify-template like --output-template,
+// with a json function on top for quoting values into a JSON payload
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	if strings.HasPrefix(text, "@") {
+		body, err := ioutil.ReadFile(text[1:])
+		if err != nil {
+			return nil, fmt.Errorf("notify template cannot be read: %v", err)
+		}
+		text = string(body)
+	}
+
+	tmpl, err := template.New("notify").Funcs(outputTemplateFuncs).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --notify-template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// notify posts the summary of the run to each --notify-url, warning about
+// those that can't be reached rather than failing the upload over them
+func (u *uploader) notify() {
+	if u.Opts.DryRun {
+		u.log.Info("not sending notifications in a dry run")
+		return
+	}
+
+	body, err := u.notifyBody()
+	if err != nil {
+		u.log.WithField("err", err).Error("failed to build notification")
+		return
+	}
+
+	client := u.Opts.httpClient()
+	for _, notifyURL := range u.Opts.NotifyURLs {
+		err := u.postNotification(client, notifyURL, body)
+		if err != nil {
+			u.log.WithFields(logrus.Fields{
+				"url": redactedURL(notifyURL),
+				"err": err,
+			}).Warn("failed to send notification")
+			continue
+		}
+
+		u.log.WithField("url", redactedURL(notifyURL)).Debug("sent notification")
+	}
+}
+
+func (u *uploader) notifyBody() ([]byte, error) {
+	result := u.outputTemplateResult(u.results)
+
+	if u.Opts.NotifyTemplate != "" {
+		tmpl, err := parseNotifyTemplate(u.Opts.NotifyTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		body := &bytes.Buffer{}
+		if err := tmpl.Execute(body, result); err != nil {
+			return nil, err
+		}
+		return body.Bytes(), nil
+	}
+
+	return json.Marshal(&notifyPayload{
+		Provider:        result.Provider,
+		Bucket:          result.Bucket,
+		Total:           result.Summary.Total,
+		Uploaded:        result.Summary.Uploaded,
+		Failed:          result.Summary.Failed,
+		Bytes:           result.Summary.Bytes,
+		DurationSeconds: result.Summary.Duration.Seconds(),
+		Artifacts:       result.Artifacts,
+	})
+}
+
+// postNotification posts the body, trying again after errors without a
+// response and responses that might go better the next time, such as 5xx
+func (u *uploader) postNotification(client *http.Client, notifyURL string, body []byte) error {
+	interval := u.Opts.retryInterval(defaultProviderRetryInterval)
+
+	for retries := uint64(0); ; retries++ {
+		err := postNotificationOnce(client, notifyURL, body)
+		if err == nil {
+			return nil
+		}
+
+		var ne *notifyError
+		if retries >= notifyRetries || (errors.As(err, &ne) && !retryableStatus(ne.StatusCode)) {
+			return err
+		}
+
+		sleep := u.Opts.retryBackoff(interval, retries+1)
+		u.log.WithFields(logrus.Fields{
+			"url":   redactedURL(notifyURL),
+			"retry": retries + 1,
+			"sleep": sleep,
+			"err":   err,
+		}).Debug("retrying notification")
+		if err := sleepContext(u.ctx, sleep); err != nil {
+			return err
+		}
+	}
+}
+
+func postNotificationOnce(client *http.Client, notifyURL string, body []byte) error {
+	req, err := http.NewRequest("POST", notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// the error would otherwise repeat the whole url
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("notification to %s failed: %v", redactedURL(notifyURL), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &notifyError{
+			URL:        redactedURL(notifyURL),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(respBody)),
+		}
+	}
+
+	return nil
+}
+
+// redactedURL leaves the path out of the url, since webhook urls such as
+// slack's carry their secret in it
+func redactedURL(notifyURL string) string {
+	u, err := url.Parse(notifyURL)
+	if err != nil || u.Host == "" {
+		return "<invalid url>"
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
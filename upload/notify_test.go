@@ -0,0 +1,186 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// notifyServer answers each notification with the next of its statuses,
+// then with 204s, keeping the bodies of those that got a 2xx
+type notifyServer struct {
+	Statuses []int
+	Requests int
+	Bodies   []string
+
+	lock sync.Mutex
+}
+
+func (ns *notifyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	ns.Requests++
+
+	status := http.StatusNoContent
+	if len(ns.Statuses) > 0 {
+		status, ns.Statuses = ns.Statuses[0], ns.Statuses[1:]
+	}
+	if status < 300 && r.Header.Get("Content-Type") == "application/json" {
+		ns.Bodies = append(ns.Bodies, string(body))
+	}
+	w.WriteHeader(status)
+}
+
+func notifyOpts(dir string, urls ...string) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"report.html"}
+		opts.TargetPaths = []string{"builds/1"}
+		opts.NotifyURLs = urls
+		opts.RetryInterval = 0
+		opts.retryIntervalSet = true
+	}
+}
+
+func TestUploaderNotify(t *testing.T) {
+	os.Clearenv()
+	flaky := &notifyServer{Statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}}
+	flakySrv := httptest.NewServer(flaky)
+	defer flakySrv.Close()
+
+	rejecting := &notifyServer{Statuses: []int{http.StatusNotFound}}
+	rejectingSrv := httptest.NewServer(rejecting)
+	defer rejectingSrv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	err := getTestUploader(nil, notifyOpts(dir, flakySrv.URL+"/hooks/secret", rejectingSrv.URL+"/gone")).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if flaky.Requests != 3 || len(flaky.Bodies) != 1 {
+		t.Fatalf("flaky server got %d requests, %d bodies", flaky.Requests, len(flaky.Bodies))
+	}
+
+	// a 404 won't go any better the next time
+	if rejecting.Requests != 1 {
+		t.Fatalf("rejecting server got %d requests", rejecting.Requests)
+	}
+
+	payload := &notifyPayload{}
+	if err := json.Unmarshal([]byte(flaky.Bodies[0]), payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if payload.Provider != "null" || payload.Total != 1 || payload.Uploaded != 1 || payload.Failed != 0 ||
+		payload.Bytes != uint64(len("<p>report</p>")) {
+		t.Fatalf("unexpected payload: %s", flaky.Bodies[0])
+	}
+
+	if len(payload.Artifacts) != 1 || payload.Artifacts[0].Key != "builds/1/report.html" ||
+		payload.Artifacts[0].Status != "uploaded" {
+		t.Fatalf("unexpected payload artifacts: %s", flaky.Bodies[0])
+	}
+}
+
+func TestUploaderNotifyTemplate(t *testing.T) {
+	os.Clearenv()
+	ns := &notifyServer{}
+	srv := httptest.NewServer(ns)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	err := getTestUploader(nil, func(opts *Options) {
+		notifyOpts(dir, srv.URL)(opts)
+		opts.NotifyTemplate = `{"text": {{json (printf "%d \"uploaded\" to %s" .Summary.Uploaded .Bucket)}}}`
+		opts.BucketName = "builds"
+	}).Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{"text": "1 \"uploaded\" to builds"}`
+	if len(ns.Bodies) != 1 || ns.Bodies[0] != expected {
+		t.Fatalf("bodies %q != [%q]", ns.Bodies, expected)
+	}
+}
+
+func TestUploaderNotifyDryRun(t *testing.T) {
+	os.Clearenv()
+	ns := &notifyServer{}
+	srv := httptest.NewServer(ns)
+	defer srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{"report.html": "<p>report</p>"})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		notifyOpts(dir, srv.URL)(opts)
+		opts.DryRun = true
+	})
+	u.stdout = ioutil.Discard
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ns.Requests != 0 {
+		t.Fatalf("dry run sent %d notifications", ns.Requests)
+	}
+}
+
+func TestNotifyURLOptions(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("ARTIFACTS_NOTIFY_URLS", "https://hooks.example.com/a  https://chat.example.com/b")
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	if len(opts.NotifyURLs) != 2 || opts.NotifyURLs[1] != "https://chat.example.com/b" {
+		t.Fatalf("notify urls from env %q", opts.NotifyURLs)
+	}
+
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{
+		"--notify-url", "https://hooks.example.com/services/T0/B0/x",
+		"--notify-url", "http://localhost:8080/hook",
+	}))
+	expected := []string{"https://hooks.example.com/services/T0/B0/x", "http://localhost:8080/hook"}
+	if strings.Join(opts.NotifyURLs, " ") != strings.Join(expected, " ") {
+		t.Fatalf("notify urls from cli %q != %q", opts.NotifyURLs, expected)
+	}
+
+	for _, tc := range []struct {
+		urls     []string
+		template string
+		msg      string
+	}{
+		{[]string{"not a url"}, "", "invalid --notify-url"},
+		{[]string{"ftp://example.com/x"}, "", "invalid --notify-url"},
+		{nil, `{"text": "hi"}`, "requires --notify-url"},
+		{[]string{"https://example.com/x"}, "{{.Nope", "invalid --notify-template"},
+	} {
+		opts := NewOptions()
+		opts.BucketName = "foo"
+		opts.Provider = "null"
+		opts.NotifyURLs = tc.urls
+		opts.NotifyTemplate = tc.template
+
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%#v: unexpected error: %v", tc, err)
+		}
+		if strings.Contains(err.Error(), "/x") {
+			t.Fatalf("%#v: error shows the url's path: %v", tc, err)
+		}
+	}
+}
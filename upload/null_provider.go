@@ -1,6 +1,7 @@
 package upload
 
 import (
+	"context"
 	"fmt"
 	"sort"
 
@@ -14,6 +15,7 @@ var (
 
 type nullProvider struct {
 	SourcesToFail []string
+	Journal       *journal
 
 	Log *logrus.Logger
 }
@@ -32,27 +34,47 @@ func newNullProvider(sourcesToFail []string, log *logrus.Logger) *nullProvider {
 	}
 }
 
-func (np *nullProvider) Upload(id string, opts *Options,
+func (np *nullProvider) Upload(ctx context.Context, id string, opts *Options,
 	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
 
 	sort.Strings(np.SourcesToFail)
 	lenSrc := len(np.SourcesToFail)
 
 	for a := range in {
+		a.UploadResult.Attempts++
 		idx := sort.SearchStrings(np.SourcesToFail, a.Source)
-		if idx < 0 || idx >= lenSrc {
+		if idx < lenSrc && np.SourcesToFail[idx] == a.Source {
 			a.UploadResult.OK = false
 			a.UploadResult.Err = errUploadFailed
 		} else {
 			a.UploadResult.OK = true
 		}
 		np.Log.WithField("artifact", a).Debug("not really uploading")
+
+		if a.UploadResult.OK && np.Journal != nil {
+			err := np.record(opts, a)
+			if err != nil {
+				a.UploadResult.OK = false
+				a.UploadResult.Err = err
+			}
+		}
 		out <- a
 	}
 
 	done <- true
 }
 
+func (np *nullProvider) record(opts *Options, a *artifact.Artifact) error {
+	entry, err := newJournalEntry(opts, a)
+	if err != nil {
+		return err
+	}
+
+	return np.Journal.Write(entry)
+}
+
 func (np *nullProvider) Name() string {
 	return "null"
 }
+
+func (np *nullProvider) storesMetadata() {}
@@ -0,0 +1,526 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyMediaType    = "application/vnd.oci.empty.v1+json"
+	ociArtifactType      = "application/vnd.travis-ci.artifacts.v1"
+	ociTitleAnnotation   = "org.opencontainers.image.title"
+
+	ociProviderRetries = 3
+)
+
+var (
+	ociProviderRetryInterval = 5 * time.Second
+
+	// ociStreamedDigestSize is the size from which blobs are hashed while
+	// they upload rather than in a pass of their own beforehand, giving up
+	// the check for a blob the registry already has
+	ociStreamedDigestSize uint64 = 32 * 1024 * 1024
+
+	ociEmptyConfig         = []byte("{}")
+	ociChallengeRegexp     = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	errOCINoUploadLocation = fmt.Errorf("registry did not return an upload location")
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	ArtifactType  string           `json:"artifactType"`
+	Config        *ociDescriptor   `json:"config"`
+	Layers        []*ociDescriptor `json:"layers"`
+}
+
+// ociProvider pushes each artifact as a blob to an OCI registry, following
+// the ORAS conventions, and tags a manifest listing them once all of the
+// artifacts have been pushed
+type ociProvider struct {
+	RetryInterval time.Duration
+
+	opts *Options
+	log  *logrus.Logger
+
+	ref    *ociRef
+	client *http.Client
+
+	authLock sync.Mutex
+	token    string
+
+	layersLock sync.Mutex
+	layers     []*ociDescriptor
+}
+
+func newOCIProvider(opts *Options, log *logrus.Logger) *ociProvider {
+	ref, err := parseOCIRef(opts.OCIRef)
+	if err != nil {
+		log.WithField("err", err).Warn("invalid oci reference")
+		ref = &ociRef{}
+	}
+
+	return &ociProvider{
+		RetryInterval: opts.retryInterval(ociProviderRetryInterval),
+
+		opts: opts,
+		log:  log,
+
+		ref:    ref,
+		client: opts.httpClient(),
+		layers: []*ociDescriptor{},
+	}
+}
+
+func (op *ociProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		start := time.Now()
+		err := op.uploadFile(ctx, opts, a)
+		a.UploadResult.Duration = time.Since(start)
+		if err != nil {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = err
+		} else {
+			a.UploadResult.OK = true
+		}
+		out <- a
+	}
+
+	done <- true
+	return
+}
+
+func (op *ociProvider) uploadFile(ctx context.Context, opts *Options, a *artifact.Artifact) error {
+	retries := uint64(0)
+
+	for {
+		a.UploadResult.Attempts++
+		err := op.rawUpload(a)
+		if err == nil {
+			return nil
+		}
+		if retryable(err) && retries < opts.Retries && !opts.pastRetryDeadline() && ctx.Err() == nil {
+			retries++
+			sleep := opts.retryBackoff(op.RetryInterval, retries)
+			op.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+func (op *ociProvider) rawUpload(a *artifact.Artifact) error {
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	desc := &ociDescriptor{
+		MediaType:   a.ContentType(),
+		Size:        int64(size),
+		Annotations: map[string]string{ociTitleAnnotation: a.FullDest()},
+	}
+
+	op.log.WithFields(logrus.Fields{
+		"ref": op.ref.String(),
+	}).Info(fmt.Sprintf("uploading: %s (size: %d)", a.Source, size))
+
+	if size >= ociStreamedDigestSize && a.KnownSHA256() == "" {
+		err = op.pushStreamedBlob(desc, a)
+	} else {
+		var digest string
+		digest, err = a.SHA256()
+		if err == nil {
+			desc.Digest = "sha256:" + digest
+			err = op.pushBlob(desc, func() (io.Reader, error) { return a.Reader() })
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	a.UploadResult.URL = op.baseURL() + "/blobs/" + desc.Digest
+
+	op.layersLock.Lock()
+	op.layers = append(op.layers, desc)
+	op.layersLock.Unlock()
+	return nil
+}
+
+// Finish pushes the manifest for everything uploaded, tagged with the
+// reference's tag
+func (op *ociProvider) Finish(opts *Options) error {
+	op.layersLock.Lock()
+	layers := append([]*ociDescriptor{}, op.layers...)
+	op.layersLock.Unlock()
+
+	sort.Sort(ociDescriptorsByTitle(layers))
+
+	config := &ociDescriptor{
+		MediaType: ociEmptyMediaType,
+		Digest:    "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+		Size:      int64(len(ociEmptyConfig)),
+	}
+
+	err := op.pushBlob(config, func() (io.Reader, error) { return bytes.NewReader(ociEmptyConfig), nil })
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  ociArtifactType,
+		Config:        config,
+		Layers:        layers,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := op.do("PUT", op.baseURL()+"/manifests/"+op.ref.Tag, ociManifestMediaType,
+		func() (io.Reader, error) { return bytes.NewReader(body), nil }, int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return op.responseError("manifest push", resp)
+	}
+
+	op.log.WithFields(logrus.Fields{
+		"ref":    op.ref.String(),
+		"layers": len(layers),
+	}).Info("pushed oci manifest")
+	return nil
+}
+
+func (op *ociProvider) pushBlob(desc *ociDescriptor, body func() (io.Reader, error)) error {
+	resp, err := op.do("HEAD", op.baseURL()+"/blobs/"+desc.Digest, "", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		op.log.WithField("digest", desc.Digest).Debug("blob already exists")
+		return nil
+	}
+
+	resp, err = op.do("POST", op.baseURL()+"/blobs/uploads/", "", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return op.responseError("blob upload start", resp)
+	}
+
+	location, err := op.uploadLocation(resp, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	resp, err = op.do("PUT", location, "application/octet-stream", body, desc.Size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return op.responseError("blob upload", resp)
+	}
+
+	return nil
+}
+
+// pushStreamedBlob sends the artifact's content in a single chunk, which
+// computes its digest as it goes, then completes the upload with the
+// digest, so that hashing overlaps with sending rather than preceding it
+func (op *ociProvider) pushStreamedBlob(desc *ociDescriptor, a *artifact.Artifact) error {
+	resp, err := op.do("POST", op.baseURL()+"/blobs/uploads/", "", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return op.responseError("blob upload start", resp)
+	}
+
+	location, err := op.uploadLocation(resp, "")
+	if err != nil {
+		return err
+	}
+
+	resp, err = op.do("PATCH", location, "application/octet-stream",
+		func() (io.Reader, error) { return a.Reader() }, desc.Size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return op.responseError("blob upload chunk", resp)
+	}
+
+	digest := a.KnownSHA256()
+	if digest == "" {
+		return fmt.Errorf("digest of %s was not computed while uploading it", a.FullDest())
+	}
+	desc.Digest = "sha256:" + digest
+
+	location, err = op.uploadLocation(resp, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	resp, err = op.do("PUT", location, "", nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return op.responseError("blob upload", resp)
+	}
+
+	return nil
+}
+
+func (op *ociProvider) uploadLocation(resp *http.Response, digest string) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errOCINoUploadLocation
+	}
+
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", err
+	}
+
+	if digest != "" {
+		q := u.Query()
+		q.Set("digest", digest)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// do sends the request, authenticating if the registry asks for it
+func (op *ociProvider) do(method, rawURL, ctype string, body func() (io.Reader, error), size int64) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if body != nil {
+			r, err := body()
+			if err != nil {
+				return nil, err
+			}
+			// the client closes the body once it's sent, so that a retry
+			// after logging in doesn't hold a second file open
+			if rc, ok := r.(io.ReadCloser); ok {
+				req.Body = rc
+			} else {
+				req.Body = ioutil.NopCloser(r)
+			}
+			req.ContentLength = size
+		}
+
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+
+		op.authorize(req)
+
+		resp, err := op.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		err = op.login(challenge)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (op *ociProvider) authorize(req *http.Request) {
+	op.authLock.Lock()
+	token := op.token
+	op.authLock.Unlock()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+
+	user, pass := op.credentials()
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+}
+
+func (op *ociProvider) credentials() (string, string) {
+	if op.opts.OCIUser != "" {
+		return op.opts.OCIUser, op.opts.OCIPass
+	}
+
+	user, pass, err := dockerConfigAuth(op.ref.Registry)
+	if err != nil {
+		op.log.WithField("err", err).Warn("failed to read docker config")
+	}
+	return user, pass
+}
+
+// login fetches a bearer token as described by the registry's challenge
+func (op *ociProvider) login(challenge string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("registry authentication failed")
+	}
+
+	params := map[string]string{}
+	for _, match := range ociChallengeRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	if params["realm"] == "" {
+		return fmt.Errorf("registry auth challenge has no realm: %q", challenge)
+	}
+
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	if params["scope"] == "" {
+		q.Set("scope", "repository:"+op.ref.Repository+":pull,push")
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	user, pass := op.credentials()
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+
+	resp, err := op.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return op.responseError("registry login", resp)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+
+	op.authLock.Lock()
+	defer op.authLock.Unlock()
+
+	op.token = token.Token
+	if op.token == "" {
+		op.token = token.AccessToken
+	}
+
+	if op.token == "" {
+		return fmt.Errorf("registry login returned no token")
+	}
+	return nil
+}
+
+func (op *ociProvider) baseURL() string {
+	scheme := "https"
+	if op.opts.OCIPlainHTTP {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, op.ref.Registry, op.ref.Repository)
+}
+
+func (op *ociProvider) responseError(what string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s failed: %s %s", what, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// RetryDefaults back off for longer than the other providers, since
+// registries tend to rate limit pushes
+func (op *ociProvider) RetryDefaults() (uint64, time.Duration) {
+	return ociProviderRetries, ociProviderRetryInterval
+}
+
+func (op *ociProvider) Name() string {
+	return "oci"
+}
+
+type ociDescriptorsByTitle []*ociDescriptor
+
+func (d ociDescriptorsByTitle) Len() int      { return len(d) }
+func (d ociDescriptorsByTitle) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d ociDescriptorsByTitle) Less(i, j int) bool {
+	return d[i].Annotations[ociTitleAnnotation] < d[j].Annotations[ociTitleAnnotation]
+}
@@ -0,0 +1,312 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeOCIRegistry implements just enough of the distribution API to push
+// blobs and manifests
+type fakeOCIRegistry struct {
+	User, Pass string
+	Bearer     bool
+	FailPuts   int
+
+	srv *httptest.Server
+
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	chunks    map[string][]byte
+	uploads   int
+	patches   int
+}
+
+func newFakeOCIRegistry() *fakeOCIRegistry {
+	reg := &fakeOCIRegistry{
+		User:      "user",
+		Pass:      "pass",
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		chunks:    map[string][]byte{},
+	}
+	reg.srv = httptest.NewServer(reg)
+	return reg
+}
+
+func (reg *fakeOCIRegistry) Host() string {
+	return strings.TrimPrefix(reg.srv.URL, "http://")
+}
+
+func (reg *fakeOCIRegistry) authorized(r *http.Request) bool {
+	if reg.Bearer {
+		return r.Header.Get("Authorization") == "Bearer sekrit"
+	}
+
+	user, pass, ok := r.BasicAuth()
+	return ok && user == reg.User && pass == reg.Pass
+}
+
+func (reg *fakeOCIRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if r.URL.Path == "/token" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != reg.User || pass != reg.Pass || r.URL.Query().Get("service") != "fake" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": "sekrit"}`)
+		return
+	}
+
+	if !reg.authorized(r) {
+		if reg.Bearer {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:team/build:pull,push"`, reg.srv.URL))
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/team/build/"), "/")
+
+	switch {
+	case r.Method == "HEAD" && parts[0] == "blobs":
+		if _, ok := reg.blobs[parts[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == "POST" && parts[0] == "blobs":
+		reg.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/team/build/blobs/uploads/%d?state=x", reg.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PATCH" && parts[0] == "blobs":
+		reg.patches++
+		body, _ := ioutil.ReadAll(r.Body)
+		reg.chunks[r.URL.Path] = append(reg.chunks[r.URL.Path], body...)
+		w.Header().Set("Location", r.URL.Path+"?state=x")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && parts[0] == "blobs":
+		if reg.FailPuts > 0 {
+			reg.FailPuts--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		body = append(reg.chunks[r.URL.Path], body...)
+		delete(reg.chunks, r.URL.Path)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+		if r.URL.Query().Get("digest") != digest || r.URL.Query().Get("state") != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.blobs[digest] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && parts[0] == "manifests":
+		if r.Header.Get("Content-Type") != ociManifestMediaType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		reg.manifests[parts[1]] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (reg *fakeOCIRegistry) Manifest(t *testing.T, tag string) *ociManifest {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	body, ok := reg.manifests[tag]
+	if !ok {
+		t.Fatalf("no manifest pushed for %v", tag)
+	}
+
+	m := &ociManifest{}
+	err := json.Unmarshal(body, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, desc := range append([]*ociDescriptor{m.Config}, m.Layers...) {
+		if _, ok := reg.blobs[desc.Digest]; !ok {
+			t.Fatalf("manifest references missing blob %v", desc.Digest)
+		}
+	}
+
+	return m
+}
+
+func uploadToFakeOCIRegistry(t *testing.T, reg *fakeOCIRegistry, user string) error {
+	dir := writeTestFiles(t, map[string]string{
+		"build.txt": "hello",
+		"sub/a.png": "\x89PNG\r\n\x1a\n",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "oci"
+	opts.OCIRef = reg.Host() + "/team/build:v1"
+	opts.OCIUser = user
+	opts.OCIPass = "pass"
+	opts.OCIPlainHTTP = true
+	opts.Retries = 1
+	opts.WorkingDir = dir
+	opts.Paths = []string{"build.txt", "sub/"}
+	opts.TargetPaths = []string{"out"}
+
+	err := opts.Validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider.(*ociProvider).RetryInterval = 0
+	return u.Upload()
+}
+
+func TestOCIProviderUpload(t *testing.T) {
+	reg := newFakeOCIRegistry()
+	defer reg.srv.Close()
+
+	err := uploadToFakeOCIRegistry(t, reg, "user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := reg.Manifest(t, "v1")
+	if m.SchemaVersion != 2 || m.Config.MediaType != ociEmptyMediaType {
+		t.Fatalf("unexpected manifest: %#v", m)
+	}
+
+	if len(m.Layers) != 2 {
+		t.Fatalf("layers %v != 2", len(m.Layers))
+	}
+
+	for i, expected := range [][]string{
+		[]string{"out/build.txt", "text/plain; charset=utf-8"},
+		[]string{"out/sub/a.png", "image/png"},
+	} {
+		layer := m.Layers[i]
+		if layer.Annotations[ociTitleAnnotation] != expected[0] {
+			t.Fatalf("layer %d title %v != %v", i, layer.Annotations[ociTitleAnnotation], expected[0])
+		}
+		if layer.MediaType != expected[1] {
+			t.Fatalf("layer %d media type %v != %v", i, layer.MediaType, expected[1])
+		}
+	}
+
+	if m.Layers[0].Digest != "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected digest: %v", m.Layers[0].Digest)
+	}
+}
+
+func TestOCIProviderUploadStreamedDigest(t *testing.T) {
+	defer func(size uint64) { ociStreamedDigestSize = size }(ociStreamedDigestSize)
+	ociStreamedDigestSize = 1
+
+	reg := newFakeOCIRegistry()
+	reg.FailPuts = 1
+	defer reg.srv.Close()
+
+	err := uploadToFakeOCIRegistry(t, reg, "user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := reg.Manifest(t, "v1")
+	if m.Layers[0].Digest != "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected digest: %v", m.Layers[0].Digest)
+	}
+
+	if reg.patches < 2 {
+		t.Fatalf("blobs were not streamed: %v patches", reg.patches)
+	}
+}
+
+func TestOCIProviderUploadBearerToken(t *testing.T) {
+	reg := newFakeOCIRegistry()
+	reg.Bearer = true
+	defer reg.srv.Close()
+
+	err := uploadToFakeOCIRegistry(t, reg, "user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(reg.Manifest(t, "v1").Layers) != 2 {
+		t.Fatalf("unexpected manifest layers")
+	}
+}
+
+func TestOCIProviderUploadRetries(t *testing.T) {
+	reg := newFakeOCIRegistry()
+	reg.FailPuts = 1
+	defer reg.srv.Close()
+
+	err := uploadToFakeOCIRegistry(t, reg, "user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(reg.Manifest(t, "v1").Layers) != 2 {
+		t.Fatalf("unexpected manifest layers")
+	}
+}
+
+func TestOCIProviderUploadBadCredentials(t *testing.T) {
+	reg := newFakeOCIRegistry()
+	defer reg.srv.Close()
+
+	err := uploadToFakeOCIRegistry(t, reg, "nope")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(reg.manifests) != 0 {
+		t.Fatalf("manifest pushed despite failed uploads")
+	}
+}
+
+func TestOCIProviderDockerConfigCredentials(t *testing.T) {
+	reg := newFakeOCIRegistry()
+	defer reg.srv.Close()
+
+	dir, err := ioutil.TempDir("", "artifacts-docker-config")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(dir+"/config.json", []byte(fmt.Sprintf(
+		`{"auths": {"%s": {"auth": "dXNlcjpwYXNz"}}}`, reg.Host())), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	err = uploadToFakeOCIRegistry(t, reg, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(reg.Manifest(t, "v1").Layers) != 2 {
+		t.Fatalf("unexpected manifest layers")
+	}
+}
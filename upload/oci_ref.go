@@ -0,0 +1,116 @@
+package upload
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ociRepoComponentRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+	ociTagRegexp           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+)
+
+// ociRef is a parsed registry.example.com/repo:tag reference
+type ociRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+}
+
+func (r *ociRef) String() string {
+	return r.Registry + "/" + r.Repository + ":" + r.Tag
+}
+
+func parseOCIRef(ref string) (*ociRef, error) {
+	if strings.Contains(ref, "@") {
+		return nil, fmt.Errorf("invalid oci reference %q: digest references cannot be pushed to", ref)
+	}
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || !(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return nil, fmt.Errorf("invalid oci reference %q: expected registry host/repository[:tag]", ref)
+	}
+
+	r := &ociRef{Registry: parts[0], Repository: parts[1], Tag: "latest"}
+
+	if i := strings.LastIndex(r.Repository, ":"); i > -1 {
+		r.Tag = r.Repository[i+1:]
+		r.Repository = r.Repository[:i]
+	}
+
+	for _, component := range strings.Split(r.Repository, "/") {
+		if !ociRepoComponentRegexp.MatchString(component) {
+			return nil, fmt.Errorf("invalid oci reference %q: bad repository name %q", ref, r.Repository)
+		}
+	}
+
+	if !ociTagRegexp.MatchString(r.Tag) {
+		return nil, fmt.Errorf("invalid oci reference %q: bad tag %q", ref, r.Tag)
+	}
+
+	return r, nil
+}
+
+func (opts *Options) validateOCI() error {
+	if opts.OCIRef == "" {
+		return fmt.Errorf("no oci reference given")
+	}
+
+	_, err := parseOCIRef(opts.OCIRef)
+	return err
+}
+
+// dockerConfigAuth looks up credentials for the registry in the docker
+// config file, as written by `docker login`
+func dockerConfigAuth(registry string) (string, string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	cfg := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+
+	err = json.Unmarshal(body, &cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid docker config: %v", err)
+	}
+
+	for _, key := range []string{registry, "https://" + registry, "http://" + registry} {
+		entry, ok := cfg.Auths[key]
+		if !ok || entry.Auth == "" {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid docker config auth for %s: %v", key, err)
+		}
+
+		creds := strings.SplitN(string(decoded), ":", 2)
+		if len(creds) != 2 {
+			return "", "", fmt.Errorf("invalid docker config auth for %s", key)
+		}
+
+		return creds[0], creds[1], nil
+	}
+
+	return "", "", nil
+}
@@ -0,0 +1,58 @@
+package upload
+
+import "testing"
+
+type ociRefCase struct {
+	ref      string
+	expected string
+	valid    bool
+}
+
+var ociRefCases = []*ociRefCase{
+	&ociRefCase{"registry.example.com/team/build:v1", "registry.example.com/team/build:v1", true},
+	&ociRefCase{"localhost:5000/build", "localhost:5000/build:latest", true},
+	&ociRefCase{"localhost/build:1.0", "localhost/build:1.0", true},
+	&ociRefCase{"ghcr.io/some-org/some_repo:v1.2-rc", "ghcr.io/some-org/some_repo:v1.2-rc", true},
+	&ociRefCase{"team/build:v1", "", false},
+	&ociRefCase{"build", "", false},
+	&ociRefCase{"registry.example.com/Team/build", "", false},
+	&ociRefCase{"registry.example.com/team/build:", "", false},
+	&ociRefCase{"registry.example.com/team/build:-v1", "", false},
+	&ociRefCase{"registry.example.com/team/build@sha256:abc", "", false},
+	&ociRefCase{"registry.example.com/", "", false},
+}
+
+func TestParseOCIRef(t *testing.T) {
+	for _, c := range ociRefCases {
+		ref, err := parseOCIRef(c.ref)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("invalid ref %q was accepted", c.ref)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", c.ref, err)
+			continue
+		}
+
+		if ref.String() != c.expected {
+			t.Errorf("ref %q != %q", ref.String(), c.expected)
+		}
+	}
+}
+
+func TestValidateOCI(t *testing.T) {
+	opts := NewOptions()
+	opts.Provider = "oci"
+
+	if opts.Validate() == nil {
+		t.Fatalf("missing oci reference was accepted")
+	}
+
+	opts.OCIRef = "localhost:5000/build:v1"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
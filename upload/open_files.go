@@ -0,0 +1,44 @@
+package upload
+
+import (
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// maxOpenFiles is --max-open-files, or half of the soft open file limit
+// so that sockets and everything else still have room.  It is 0, for no
+// limit, if the open file limit can't be found.
+func (opts *Options) maxOpenFiles() uint64 {
+	if opts.MaxOpenFiles > 0 {
+		return opts.MaxOpenFiles
+	}
+
+	limit := openFileLimit()
+	if limit == 0 {
+		return 0
+	}
+
+	if limit < 2 {
+		return 1
+	}
+
+	return limit / 2
+}
+
+// limitOpenFiles applies the open file budget, warning the first time an
+// upload has to wait for it
+func limitOpenFiles(opts *Options, log *logrus.Logger) {
+	max := opts.maxOpenFiles()
+	throttled := uint32(0)
+
+	artifact.LimitOpenFiles(max, func() {
+		if atomic.CompareAndSwapUint32(&throttled, 0, 1) {
+			log.WithField("max_open_files", max).Warn(
+				"throttling uploads to stay within the open file limit")
+			return
+		}
+		log.Debug("waiting for an open file to close")
+	})
+}
@@ -0,0 +1,119 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// openFilesProvider holds each artifact's file open for a while, counting
+// how many are open at once
+type openFilesProvider struct {
+	sync.Mutex
+	Open    int
+	MaxOpen int
+}
+
+func (op *openFilesProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		r, err := a.Reader()
+		if err != nil {
+			a.UploadResult.Err = err
+			out <- a
+			continue
+		}
+
+		op.Lock()
+		op.Open++
+		if op.Open > op.MaxOpen {
+			op.MaxOpen = op.Open
+		}
+		op.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		ioutil.ReadAll(r)
+
+		op.Lock()
+		op.Open--
+		op.Unlock()
+
+		r.(io.Closer).Close()
+		a.UploadResult.OK = true
+		out <- a
+	}
+
+	done <- true
+}
+
+func (op *openFilesProvider) Name() string {
+	return "open-files"
+}
+
+func TestUploaderMaxOpenFiles(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("f%d.txt", i)] = "content"
+	}
+	dir := writeTestFiles(t, files)
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = buf
+	log.Level = logrus.WarnLevel
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"."}
+	opts.Concurrency = 5
+	opts.MaxOpenFiles = 1
+	opts.TargetPaths = []string{"open-files"}
+
+	u := newUploader(opts, log)
+	defer artifact.LimitOpenFiles(0, nil)
+
+	op := &openFilesProvider{}
+	u.Provider = op
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) > 0 || len(u.results) != 10 {
+		t.Fatalf("uploads failed: %v of %v", len(u.failedResults()), len(u.results))
+	}
+
+	if op.MaxOpen != 1 {
+		t.Fatalf("max open files %v != 1", op.MaxOpen)
+	}
+
+	if strings.Count(buf.String(), "throttling uploads") != 1 {
+		t.Fatalf("throttling was not logged once:\n%s", buf.String())
+	}
+}
+
+func TestMaxOpenFilesDefault(t *testing.T) {
+	opts := NewOptions()
+	opts.MaxOpenFiles = 7
+	if opts.maxOpenFiles() != 7 {
+		t.Fatalf("max open files %v != 7", opts.maxOpenFiles())
+	}
+
+	opts.MaxOpenFiles = 0
+	if limit := openFileLimit(); limit > 1 && opts.maxOpenFiles() != limit/2 {
+		t.Fatalf("max open files %v != half of %v", opts.maxOpenFiles(), limit)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package upload
+
+import "syscall"
+
+// openFileLimit is the soft RLIMIT_NOFILE, or 0 if it can't be found
+func openFileLimit() uint64 {
+	rlim := &syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, rlim); err != nil {
+		return 0
+	}
+
+	return uint64(rlim.Cur)
+}
@@ -0,0 +1,7 @@
+package upload
+
+// openFileLimit is 0 since windows has no per-process limit on open
+// handles to speak of
+func openFileLimit() uint64 {
+	return 0
+}
@@ -1,14 +1,19 @@
 package upload
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
 	"github.com/travis-ci/artifacts/env"
 )
 
@@ -25,7 +30,124 @@ environment variable, which should be :-delimited.
 Paths may be either files or directories.  Any path provided will be walked for
 all child entries.  Each entry will have its mime type detected based first on
 the file extension, then by sniffing up to the first 512 bytes via the net/http
-function "DetectContentType".
+function "DetectContentType", unless --content-type-precedence puts the
+contents first.  Extensions given with --content-type skip detection.
+`
+
+	// SyncCommandDescription is the string used to describe the
+	// "sync" command in the command line help system
+	SyncCommandDescription = `
+Make the target paths mirror a set of local paths.  The paths are given and
+walked as for "upload", but only files that are new or whose size or md5 differ
+from the remote object are uploaded, so an interrupted sync may be re-run to
+pick up where it left off.
+
+With --delete, remote objects under the target paths that no longer have a
+local counterpart are deleted once everything has uploaded.  This is a dry run
+that only logs what would be deleted unless --confirm is also given.
+`
+
+	// ListCommandDescription is the string used to describe the
+	// "list" command in the command line help system
+	ListCommandDescription = `
+List the objects under the target paths, or under --prefix, one per line with
+the key, size in bytes, last modified time, and content type separated by tabs,
+or as JSON with --format json.  The --filter-* flags narrow the list down to
+objects that pass all of them, e.g. those over 100MB that are older than a
+week:
+
+    artifacts list --target-paths builds --filter-min-size 100MB --filter-older-than 7d
+
+With --recursive=false, only the objects directly under each prefix are listed,
+along with the "directories" below it, which end in /:
+
+    artifacts list --prefix builds/ --recursive=false
+`
+
+	// PruneCommandDescription is the string used to describe the
+	// "prune" command in the command line help system
+	PruneCommandDescription = `
+Delete the builds under the target paths, or under --prefix, that the retention
+rules don't keep.  Each prefix one level down (such as builds/123/) is taken to
+be a build, and is kept or deleted as a whole by the last modified time of its
+newest object.  --keep-last keeps that many of the newest builds, however old,
+and --older-than deletes builds older than that, so that together they delete
+only builds that are both:
+
+    artifacts prune --target-paths builds --keep-last 10 --older-than 30d
+
+With --dry-run, the builds that would be deleted are only logged.
+`
+
+	// WatchCommandDescription is the string used to describe the
+	// "watch" command in the command line help system
+	WatchCommandDescription = `
+Upload a set of local paths as "upload" would, and then keep uploading the files
+under them that are added or changed until interrupted.  The paths are polled,
+scanned every --interval rather than watched with filesystem events, and a file
+is uploaded once it has gone unchanged for --debounce, so that one still being
+written waits until it's done:
+
+    artifacts watch --target-paths reports/latest --debounce 10s reports/
+
+Each batch of files is uploaded like an upload of its own, with the same
+retries, and with --output-manifest, --notify-url, and the hooks run for every
+batch.  Files that fail to upload are tried again after another --debounce.
+The totals are logged every --summary-interval, and --status-addr serves them
+as JSON.
+`
+
+	// DeleteCommandDescription is the string used to describe the
+	// "delete" command in the command line help system
+	DeleteCommandDescription = `
+Delete the objects at one or more keys, or with --recursive, every object under
+one or more prefixes, each taken as a directory so that builds/1 leaves
+builds/10 alone:
+
+    artifacts delete --bucket my-bucket artifacts/123/456/build.log
+    artifacts delete --bucket my-bucket --recursive artifacts/123/456
+
+Deleting under a prefix asks first on a terminal, and needs --force otherwise.
+On s3, objects are deleted 1000 to a request.  With --dry-run, what would be
+deleted is only logged.
+`
+
+	// DownloadCommandDescription is the string used to describe the
+	// "download" command in the command line help system
+	DownloadCommandDescription = `
+Download every object under one or more key prefixes into a local directory,
+recreating the directory structure below each prefix, e.g.:
+
+    artifacts download --bucket my-bucket artifacts/123/456 ./artifacts
+    artifacts download --bucket my-bucket --target-dir ./artifacts artifacts/123/456 artifacts/123/457
+
+Without --target-dir, the last argument is the directory.  Objects are fetched
+--concurrency at a time, each retried up to --retries times.  Files that
+already exist with the object's size and md5 are skipped, so an interrupted
+download may be re-run to pick up where it left off.
+`
+
+	// ValidateCommandDescription is the string used to describe the
+	// "validate" command in the command line help system
+	ValidateCommandDescription = `
+Check the options, then that the bucket can be reached with the credentials
+and written to under the first target path, printing whether each check
+passed and exiting non-zero if any failed.  Nothing is uploaded, and the local
+paths are not walked, so this is a cheap check to make at the start of a build:
+
+    artifacts validate --bucket my-bucket --target-paths artifacts/123
+`
+
+	// VerifyCommandDescription is the string used to describe the
+	// "verify" command in the command line help system
+	VerifyCommandDescription = `
+Walk the same paths as "upload" and check that each artifact's object exists
+under the target paths with the same size, and the same md5 (for objects put
+in one piece) or --checksums sha256, printing a line for each one that is
+missing or mismatched and exiting non-zero if there are any, e.g. after
+publishing:
+
+    artifacts verify --bucket my-bucket --target-paths artifacts/123 build/
 `
 )
 
@@ -34,12 +156,43 @@ var (
 
 	optsMaps = map[string]map[string]string{
 		"cli": map[string]string{
-			"AccessKey":    "key, k",
-			"BucketName":   "bucket, b",
-			"CacheControl": "cache-control",
-			"Perm":         "permissions",
-			"SecretKey":    "secret, s",
-			"S3Region":     "s3-region",
+			"AccessKey":                  "key, k",
+			"BucketName":                 "bucket, b",
+			"CacheControl":               "cache-control",
+			"ConfigFile":                 "config",
+			"NoCache":                    "no-cache",
+			"NoCachePaths":               "no-cache-paths",
+			"HTTPProxy":                  "http-proxy",
+			"InsecureSkipVerify":         "insecure-skip-verify",
+			"CACert":                     "ca-cert",
+			"BandwidthSchedule":          "bandwidth-schedule",
+			"BandwidthScheduleTimezone":  "bandwidth-schedule-timezone",
+			"ContentTypeByExtensionOnly": "content-type-by-extension-only",
+			"ContentTypePrecedence":      "content-type-precedence",
+			"ContentTypes":               "content-type",
+			"DefaultContentType":         "default-content-type",
+			"ContentTypesFrom":           "content-types-from",
+			"Perm":                       "permissions",
+			"InheritBucketACL":           "inherit-bucket-acl",
+			"StorageClass":               "storage-class",
+			"ServerSideEncryption":       "sse",
+			"SSEKMSKeyID":                "sse-kms-key-id",
+			"SSECustomerKey":             "sse-c-key",
+			"SignedURLs":                 "signed-urls",
+			"SignedURLTTL":               "signed-url-ttl",
+			"RedirectLocations":          "redirect-location",
+			"AutoTagRun":                 "auto-tag-run",
+			"GrantRead":                  "grant-read",
+			"GrantFullControl":           "grant-full-control",
+			"SecretKey":                  "secret, s",
+			"UseInstanceRole":            "instance-role",
+			"SessionToken":               "session-token",
+			"AssumeRoleARN":              "assume-role-arn",
+			"AssumeRoleSessionName":      "assume-role-session-name",
+			"S3Region":                   "s3-region",
+			"S3Endpoint":                 "s3-endpoint, endpoint",
+			"S3ForcePathStyle":           "s3-force-path-style",
+			"S3VirtualHost":              "s3-virtual-host",
 
 			"RepoSlug":    "repo-slug, r",
 			"BuildNumber": "build-number",
@@ -47,24 +200,187 @@ var (
 			"JobNumber":   "job-number",
 			"JobID":       "job-id",
 
-			"Concurrency": "concurrency",
-			"MaxSize":     "max-size",
-			"Paths":       "",
-			"Provider":    "upload-provider, p",
-			"Retries":     "retries",
-			"TargetPaths": "target-paths, t",
-			"WorkingDir":  "working-dir",
+			"Concurrency":            "concurrency",
+			"MaxOpenFiles":           "max-open-files",
+			"Stream":                 "stream",
+			"Explain":                "explain",
+			"KeepGoingOnWalkError":   "keep-going-on-walk-error",
+			"FailFast":               "fail-fast",
+			"OnError":                "on-error",
+			"SymlinkMode":            "symlinks",
+			"FollowSymlinks":         "follow-symlinks",
+			"Bundle":                 "bundle",
+			"Archive":                "archive",
+			"BundleName":             "bundle-name, archive-name",
+			"BundleManifestInside":   "bundle-manifest-inside",
+			"MaxSize":                "max-size",
+			"MaxFileSize":            "max-file-size",
+			"TrimToFit":              "trim-to-fit",
+			"TrimOrder":              "trim-order",
+			"SizeBreakdown":          "size-breakdown",
+			"MaxFiles":               "max-files",
+			"MaxKeysPerPrefix":       "max-keys-per-prefix",
+			"MaxKeyLength":           "max-key-length",
+			"KeyLengthPolicy":        "key-length-policy",
+			"ExpectedCount":          "expected-count",
+			"ShardIndex":             "shard-index",
+			"ShardCount":             "shard-count",
+			"DuplicateKeys":          "duplicate-keys",
+			"CaseCollisions":         "case-collisions",
+			"VerifyHeaders":          "verify-headers",
+			"VerifyCacheControl":     "verify-cache-control",
+			"Metadata":               "metadata",
+			"ContentEncodingByExt":   "content-encoding-by-ext",
+			"Excludes":               "exclude",
+			"Includes":               "include",
+			"ContentEncodingKeepExt": "content-encoding-keep-ext",
+			"Gzip":                   "gzip",
+			"GzipTypes":              "gzip-types",
+			"MultipartThreshold":     "multipart-threshold",
+			"MultipartChunkSize":     "multipart-chunk-size",
+			"MaxConcurrentMultipart": "max-concurrent-multipart",
+			"StdinSize":              "stdin-size",
+			"Stdin":                  "stdin",
+			"StdinName":              "name",
+			"StdinStream":            "stdin-stream",
+			"TempDir":                "temp-dir",
+			"MinFreeDisk":            "min-free-disk",
+			"MaxBandwidth":           "max-bandwidth",
+			"MaxConnectionBandwidth": "max-connection-bandwidth",
+			"CompressParallel":       "compress-parallel",
+			"Paths":                  "",
+			"Provider":               "upload-provider, p",
+			"ProviderOptions":        "provider-option",
+			"Record":                 "record",
+			"Replay":                 "replay",
+			"StateFile":              "state-file",
+			"FromManifest":           "from-manifest",
+			"Retries":                "retries",
+			"RetryDeadline":          "retry-deadline",
+			"Timeout":                "timeout, total-timeout",
+			"UploadTimeout":          "upload-timeout",
+			"ShutdownGrace":          "shutdown-grace",
+			"RetryInterval":          "retry-interval, retry-base-delay",
+			"RetryIntervalMax":       "retry-interval-max, retry-max-delay",
+			"SlowUploadThreshold":    "slow-upload-threshold",
+			"ProgressJSON":           "progress-json",
+			"ProgressInterval":       "progress-interval",
+			"Progress":               "progress",
+			"OtelEndpoint":           "otel-endpoint",
+			"MetricsFile":            "metrics-file",
+			"StatsdAddr":             "statsd-addr",
+			"SuccessMarker":          "success-marker",
+			"SBOM":                   "sbom",
+			"ManifestKey":            "manifest-key",
+			"ManifestIncludeFailed":  "manifest-include-failed",
+			"GenerateIndex":          "index, generate-index",
+			"OutputCSV":              "output-csv",
+			"ResultFile":             "result-file, result-json",
+			"ExitCodeMap":            "exit-code-map",
+			"OutputManifest":         "output-manifest",
+			"OutputTemplate":         "output-template",
+			"HostLock":               "host-lock",
+			"HostLockMax":            "host-lock-max",
+			"TargetPaths":            "target-paths, t",
+			"UploadOrderFrom":        "upload-order-from",
+			"RoutesFrom":             "routes-from",
+			"HeaderRulesFrom":        "header-rules-from",
+			"ValidateOnly":           "validate-only",
+			"DryRun":                 "dry-run",
+			"DryRunFormat":           "format",
+			"AssertNoChanges":        "assert-no-changes",
+			"AssertNoExtraneous":     "assert-no-extraneous",
+			"SkipUnchanged":          "skip-unchanged",
+			"Dedup":                  "dedup",
+			"Delta":                  "delta",
+			"DeltaBlockSize":         "delta-block-size",
+			"DeltaMinSize":           "delta-min-size",
+			"Sync":                   "sync",
+			"SyncDelete":             "sync-delete",
+			"SyncConfirm":            "sync-confirm",
+			"Checksums":              "checksums",
+			"WriteChecksums":         "write-checksums",
+			"FailIfGrew":             "fail-if-grew",
+			"FailIfGrewPaths":        "fail-if-grew-paths",
+			"FailIfGrewTolerance":    "fail-if-grew-tolerance",
+			"WorkingDir":             "working-dir",
+
+			"ArtifactsSaveHost":         "save-host, H",
+			"ArtifactsAuthToken":        "auth-token, T",
+			"ArtifactsAuthTokenCommand": "auth-token-command",
+			"ArtifactsChunkSize":        "save-host-chunk-size",
 
-			"ArtifactsSaveHost":  "save-host, H",
-			"ArtifactsAuthToken": "auth-token, T",
+			"OCIRef":                  "oci-ref",
+			"OCIUser":                 "oci-user",
+			"OCIPass":                 "oci-pass",
+			"OCIPlainHTTP":            "oci-plain-http",
+			"GCSToken":                "gcs-token",
+			"GCSCredentials":          "gcs-credentials",
+			"GCSEndpoint":             "gcs-endpoint",
+			"IfGenerationMatch":       "if-generation-match",
+			"AzureAccount":            "azure-account",
+			"AzureKey":                "azure-key",
+			"AzureSASToken":           "azure-sas-token",
+			"AzureEndpoint":           "azure-endpoint",
+			"AzureContainer":          "azure-container",
+			"SFTPHost":                "sftp-host",
+			"SFTPPort":                "sftp-port",
+			"SFTPUser":                "sftp-user",
+			"SFTPKey":                 "sftp-key",
+			"SFTPPassword":            "sftp-password",
+			"SFTPKnownHosts":          "sftp-known-hosts",
+			"SFTPDir":                 "sftp-dir",
+			"FileRoot":                "file-root",
+			"FileFsync":               "file-fsync",
+			"GithubPRComment":         "github-pr-comment",
+			"GithubPRCommentRequired": "github-pr-comment-required",
+			"GithubToken":             "github-token",
+			"GithubRepo":              "github-repo",
+			"GithubPR":                "github-pr",
+			"GithubAPIURL":            "github-api-url",
+			"NotifyURLs":              "notify-url",
+			"NotifyTemplate":          "notify-template",
+			"PreHook":                 "pre-hook",
+			"PostHook":                "post-hook",
 		},
 		"doc": map[string]string{
-			"AccessKey":    "upload credentials key *REQUIRED*",
-			"BucketName":   "destination bucket *REQUIRED*",
-			"CacheControl": "artifact cache-control header value",
-			"Perm":         "artifact access permissions",
-			"SecretKey":    "upload credentials secret *REQUIRED*",
-			"S3Region":     "region used when storing to S3",
+			"AccessKey":                  "upload credentials key *REQUIRED* unless --instance-role or --assume-role-arn is set",
+			"BucketName":                 "destination bucket *REQUIRED*",
+			"CacheControl":               "artifact cache-control header value",
+			"ConfigFile":                 "JSON file of options, overridden by the environment and command line (default .artifacts.json in the working dir)",
+			"NoCache":                    "upload with Cache-Control: no-store, no-cache, must-revalidate, for artifacts that must never be cached",
+			"NoCachePaths":               "':'-delimited globs limiting --no-cache to matching paths",
+			"HTTPProxy":                  "proxy url (with optional user:pass@) that http providers send requests through, bypassed for hosts in NO_PROXY",
+			"InsecureSkipVerify":         "skip verifying the TLS certificates of http providers, e.g. for an internal MinIO with a self-signed certificate",
+			"CACert":                     "PEM file of root certificates to trust on top of the system's, e.g. for an internal CA",
+			"BandwidthSchedule":          "limit the combined upload rate by time of day, e.g. 09:00-17:00=5MB,else=unlimited",
+			"BandwidthScheduleTimezone":  "timezone of the --bandwidth-schedule times, e.g. America/New_York",
+			"ContentTypeByExtensionOnly": "detect content types from file extensions only, without reading file contents",
+			"ContentTypePrecedence":      "whether file extensions or contents decide content types, one of extension, sniff or override-only",
+			"ContentTypes":               "ext=type content type for files with the extension, e.g. .wasm=application/wasm, overriding both the extension and the contents (repeatable, or ':'-delimited)",
+			"DefaultContentType":         "content type of files whose extension and contents aren't recognized, instead of application/octet-stream",
+			"ContentTypesFrom":           "file of glob or .ext patterns, each followed by the content type of the files it matches",
+			"Perm":                       "artifact access permissions",
+			"InheritBucketACL":           "omit per-object ACLs so that the bucket policy governs access (ignores --permissions)",
+			"StorageClass":               "S3 storage class for uploaded objects, e.g. STANDARD_IA or GLACIER (uses the bucket default if empty)",
+			"ServerSideEncryption":       "S3 server-side encryption, AES256 (uses the bucket default if empty, aws:kms is not supported yet)",
+			"SSEKMSKeyID":                "KMS key id for --sse aws:kms, or the account's default key if not given",
+			"SSECustomerKey":             "base64 256-bit key that s3 encrypts objects with (SSE-C), which is needed again to download them",
+			"SignedURLs":                 "log a pre-signed GET url for each object uploaded to s3, also written to --result-file and --manifest",
+			"SignedURLTTL":               "how long --signed-urls work for (at most 168h with --sse aws:kms)",
+			"RedirectLocations":          "comma-separated key=location pairs, where each key under the target paths becomes a zero-byte object that S3 website hosting serves as a redirect to location",
+			"AutoTagRun":                 "tag every object with the build-id, commit, and branch of the detected CI build",
+			"GrantRead":                  "comma-separated grantees (id=, email=, or uri=) given read access to each object, instead of --permissions",
+			"GrantFullControl":           "comma-separated grantees (id=, email=, or uri=) given full control of each object, instead of --permissions",
+			"SecretKey":                  "upload credentials secret *REQUIRED* unless --instance-role or --assume-role-arn is set",
+			"UseInstanceRole":            "when no key and secret are given, get credentials from the environment, ~/.aws/credentials, or the EC2/ECS instance role",
+			"SessionToken":               "session token to go with temporary --key and --secret credentials, as from sts",
+			"AssumeRoleARN":              "arn of an iam role to assume with sts before uploading, using the given or found credentials",
+			"AssumeRoleSessionName":      "session name for --assume-role-arn (default artifacts, or artifacts-$TRAVIS_BUILD_NUMBER)",
+			"S3Region":                   "region used when storing to S3",
+			"S3Endpoint":                 "custom S3-compatible endpoint URL, which implies path-style addressing (--endpoint and $ARTIFACTS_ENDPOINT are deprecated aliases)",
+			"S3ForcePathStyle":           "always address the bucket in the URL path",
+			"S3VirtualHost":              "always address the bucket as a virtual host",
 
 			"RepoSlug":    "repo owner/name slug",
 			"BuildNumber": "build number",
@@ -72,24 +388,187 @@ var (
 			"JobNumber":   "job number",
 			"JobID":       "job id",
 
-			"Concurrency": "upload worker concurrency",
-			"MaxSize":     "max combined size of uploaded artifacts",
-			"Paths":       "",
-			"Provider":    "artifact upload provider (artifacts, s3, null)",
-			"Retries":     "number of upload retries per artifact",
-			"TargetPaths": "artifact target paths (':'-delimited)",
-			"WorkingDir":  "working directory",
+			"Concurrency":            "upload worker concurrency, or \"auto\" to tune it along with the multipart chunk size during the run",
+			"MaxOpenFiles":           "max number of source files open at once across all workers, or 0 for half of the soft open file limit",
+			"Stream":                 "keep only the failures and totals of the uploaded files in memory, for trees of very many files; options that need every file at once can't be used with it",
+			"Explain":                "log which rule included or excluded each candidate file",
+			"KeepGoingOnWalkError":   "log and skip files and directories that cannot be read",
+			"FailFast":               "stop the upload at the first artifact that fails, rather than uploading the rest and failing at the end",
+			"OnError":                "what to do when an artifact fails to upload: continue with the rest and fail at the end, or fail right away like --fail-fast",
+			"SymlinkMode":            "how to walk symlinks (follow, skip, ignore-dupes, preserve), or unset to upload symlinked files without walking symlinked directories",
+			"FollowSymlinks":         "walk symlinked directories, the same as --symlinks follow",
+			"Bundle":                 "upload everything as a single tar at --bundle-name, gzipped if --gzip is set, instead of as individual objects",
+			"Archive":                "upload everything as a single archive at --archive-name instead of as individual objects: tar, tar.gz, or zip",
+			"BundleName":             "key of the --bundle tar or --archive, where templates like {{.BuildNumber}} are expanded (.gz is appended with --gzip or --archive tar.gz, and .zip replaces .tar with --archive zip)",
+			"BundleManifestInside":   "add a MANIFEST.json listing the path, size, and sha256 of each file to the --bundle tar",
+			"MaxSize":                "max combined size of uploaded artifacts",
+			"MaxFileSize":            "max size of any one artifact, or 0 for no limit",
+			"TrimToFit":              "leave out artifacts, in --trim-order, until the rest fit --max-size and --max-file-size, rather than failing",
+			"TrimOrder":              "which artifacts --trim-to-fit leaves out first (largest, oldest)",
+			"SizeBreakdown":          "glob grouping files in the size breakdown logged when --max-size is exceeded, before the top directory of the rest (repeatable, or ':'-delimited)",
+			"MaxFiles":               "max number of files to upload, failing before anything is uploaded if more are found, or 0 for no limit",
+			"MaxKeysPerPrefix":       "max number of files to upload under each target path, or 0 for no limit",
+			"MaxKeyLength":           "longest key to upload to, or 0 for no limit",
+			"KeyLengthPolicy":        "what to do with keys longer than --max-key-length (fail, shorten)",
+			"ExpectedCount":          "fail before uploading unless this many files are found, given as N or MIN-MAX",
+			"ShardIndex":             "upload only the files in this shard, counting from 0, when splitting an upload across --shard-count jobs",
+			"ShardCount":             "number of jobs the files are split across, by a stable hash of each file's key",
+			"DuplicateKeys":          "what to do when more than one file would be uploaded to the same key (warn, fail, allow)",
+			"CaseCollisions":         "what to do when a key differs only by case from an object already in s3 (off, warn, fail)",
+			"VerifyHeaders":          "after uploading, fetch each object's headers and check its content type against what was sent (off, warn, fail)",
+			"VerifyCacheControl":     "also check the cache control with --verify-headers",
+			"Metadata":               "key=value object metadata, where values may use {size}, {mtime}, {basename}, {sha256}, and templates like {{.Commit}} (repeatable, or ':'-delimited before each key=)",
+			"ContentEncodingByExt":   "':'-delimited ext=encoding pairs (e.g. .gz=gzip:.br=br) setting Content-Encoding on already-compressed files, whose keys lose the extension",
+			"Excludes":               "glob of paths to skip, relative to the working dir, in addition to those in .artifactsignore (repeatable, or ':'-delimited)",
+			"Includes":               "glob of files to upload, relative to the working dir, skipping all others (repeatable, or ':'-delimited)",
+			"ContentEncodingKeepExt": "keep the compression extension in keys of files matched by --content-encoding-by-ext",
+			"Gzip":                   "gzip artifacts with compressible content types (text/*, json, xml, etc.) before uploading them with Content-Encoding: gzip",
+			"GzipTypes":              "content types, such as text/* or application/json, or file globs, such as *.log or coverage/**, for --gzip to compress instead of the compressible content types (repeatable, or ':'-delimited)",
+			"MultipartThreshold":     "artifacts at least this size are uploaded to S3 in parts (0 disables, except for those over the 5GB single put limit)",
+			"MultipartChunkSize":     "size of each part of a multipart upload to S3, at least 5MiB, grown as needed to fit S3's 10000 part limit",
+			"MaxConcurrentMultipart": "max number of files uploading in parts at once across all workers, or 0 for half of --concurrency",
+			"StdinSize":              "size of the \"-\" (stdin) path, which lets it stream straight to the upload instead of buffering to a temp file",
+			"Stdin":                  "upload stdin, the same as a \"-\" path",
+			"StdinName":              "name to upload stdin as, in place of \"stdin\"",
+			"StdinStream":            "stream stdin of unknown size straight to an s3 multipart upload instead of buffering it to a temp file",
+			"TempDir":                "directory for temp files, such as buffered stdin (defaults to the system temp dir)",
+			"MinFreeDisk":            "free space to leave on the temp dir filesystem, failing before writing temp files that would use it up (0 to skip the check)",
+			"MaxBandwidth":           "limit the combined upload rate of all workers to this size per second, e.g. 10MB (0 for unlimited)",
+			"MaxConnectionBandwidth": "limit each upload request to this size per second, e.g. 2MB, so that no one connection takes the whole --max-bandwidth (0 for unlimited)",
+			"CompressParallel":       "number of goroutines used to gzip each compressed artifact (1 compresses serially)",
+			"Paths":                  "",
+			"Provider":               "artifact upload provider (artifacts, s3, gcs, azure, sftp, file, oci, null), or several separated by commas to upload to each",
+			"ProviderOptions":        "provider.option=value for one provider of a fan-out --upload-provider, e.g. artifacts.target-paths=builds (repeatable, or ':'-delimited)",
+			"Record":                 "with the null provider, write a replayable journal of the intended uploads to this file",
+			"Replay":                 "upload the artifacts listed in a journal written with --record instead of walking paths",
+			"StateFile":              "file recording each artifact uploaded, so that a re-run skips those whose objects are still there with the same size and content",
+			"FromManifest":           "upload the sources listed in a manifest written with --output-manifest to their recorded keys instead of walking paths",
+			"Retries":                "number of upload retries per artifact (defaults to 4 for s3, 3 for oci, and 2 for artifacts)",
+			"RetryDeadline":          "stop retrying and fail the remaining artifacts once the upload has run this long (0 disables)",
+			"Timeout":                "cancel the whole upload, including uploads in flight, once it has run this long (0 disables)",
+			"UploadTimeout":          "fail an attempt at uploading an artifact whose request has gone on this long, to be retried like any other failure (0 disables)",
+			"ShutdownGrace":          "once interrupted, how long the uploads in flight get to finish before they are canceled too (0 cancels them right away)",
+			"RetryInterval":          "sleep before the first retry of an artifact, doubling with each retry after it up to --retry-interval-max, with jitter (defaults to 5s for oci)",
+			"RetryIntervalMax":       "longest sleep between retries, including one asked for with Retry-After (0 disables the cap)",
+			"SlowUploadThreshold":    "warn about any artifact that takes longer than this to upload",
+			"ProgressJSON":           "write newline-delimited json progress events to this file, or to a file descriptor given as fd:N",
+			"ProgressInterval":       "how often to log upload progress and write a --progress-json event (0 logs none, and writes events every 1s)",
+			"Progress":               "draw a progress bar with the bytes done, rate, and time left when stderr is a terminal, or else log progress every 10s unless --progress-interval is set",
+			"OtelEndpoint":           "send an OpenTelemetry trace of the upload to this OTLP/HTTP endpoint, e.g. http://localhost:4318",
+			"MetricsFile":            "write Prometheus metrics of the upload to this file at the end of the run, for the node_exporter textfile collector",
+			"StatsdAddr":             "send StatsD metrics of the upload to this host:port over UDP at the end of the run",
+			"SuccessMarker":          "name of empty marker object written to each target path after a fully successful upload",
+			"SBOM":                   "file uploaded to each target path as a companion object that every artifact references by key, url, and sha256 in its metadata and the manifest",
+			"ManifestKey":            "name of a JSON manifest object written to each target path once all other artifacts have uploaded",
+			"ManifestIncludeFailed":  "write the --manifest-key object even if some artifacts failed, listing them as failed",
+			"GenerateIndex":          "after a fully successful upload, write an index.html to each target path linking to the artifacts uploaded under it",
+			"OutputCSV":              "write a CSV report of all uploaded artifacts to this file",
+			"ResultFile":             "write a JSON summary of the run and every artifact's outcome to this file, or to stdout if \"-\"",
+			"ExitCodeMap":            "comma-separated category=code pairs overriding the exit codes of failure categories (validation=2, credentials=3, size-limit=4, partial-failure=5, total-failure=6, timeout=7, interrupted=8)",
+			"OutputManifest":         "write a JSON manifest of all uploaded artifacts to this file",
+			"OutputTemplate":         "Go text/template, or @file holding one, to write to stdout with the results of the upload",
+			"HostLock":               "lock file used to limit concurrent artifacts processes on this host",
+			"HostLockMax":            "max number of artifacts processes uploading at once when using --host-lock",
+			"TargetPaths":            "artifact target paths (':'-delimited), where {hostname} and {pid} are replaced and templates like {{.Branch}} are expanded",
+			"UploadOrderFrom":        "file listing paths or globs to upload first, in priority order",
+			"RoutesFrom":             "file of rules sending matching files to another provider, bucket, or storage class",
+			"HeaderRulesFrom":        "file of rules setting Cache-Control, Content-Type, Content-Disposition, or x-amz-meta-* headers on matching files",
+			"ValidateOnly":           "check the options and that the paths resolve to files, then exit without uploading",
+			"DryRun":                 "print the operations an upload would make, compared to the objects already in s3, without uploading anything",
+			"DryRunFormat":           "output format for --dry-run and list: text, diff (sorted and stable, for checking in as a golden file, --dry-run only), or json (one object per line)",
+			"AssertNoChanges":        "with --dry-run, fail listing every key that would be added or changed, to detect drift from the bucket",
+			"AssertNoExtraneous":     "with --assert-no-changes, also fail on objects under the target paths that no local file would be uploaded to",
+			"SkipUnchanged":          "skip artifacts whose objects already have the same md5 etag, falling back to uploading when the object is missing or the provider reports no etag",
+			"Dedup":                  "upload content found more than once in a run only once: alias (lists the others in the manifest as aliases) or copy (makes the others with s3 server-side copies)",
+			"Delta":                  "upload files of at least --delta-min-size as blocks and a patch manifest, sending only the blocks that changed since the last upload (s3 only)",
+			"DeltaBlockSize":         "size of the blocks that --delta compares and uploads",
+			"DeltaMinSize":           "smallest file that --delta uploads as blocks, smaller ones being uploaded whole",
+			"Sync":                   "upload only new and changed files, comparing each to its object by size and md5, as the sync command does",
+			"SyncDelete":             "with --sync, also delete the objects under the target paths that no longer exist locally (dry run unless --sync-confirm is set)",
+			"SyncConfirm":            "with --sync-delete, actually delete the objects, as --confirm does for the sync command",
+			"Checksums":              "send Content-MD5 with each upload to S3, so that S3 checks what it received, and store each artifact's sha256 as object metadata",
+			"WriteChecksums":         "upload a SHA256SUMS file listing the sha256 of every uploaded artifact to each target path",
+			"FailIfGrew":             "fail artifacts that are larger than the objects they would overwrite by more than --fail-if-grew-tolerance",
+			"FailIfGrewPaths":        "':'-delimited globs limiting --fail-if-grew to matching paths",
+			"FailIfGrewTolerance":    "how much larger than its object an artifact may be with --fail-if-grew, in bytes (e.g. 10KB) or as a percentage (e.g. 5%)",
+			"WorkingDir":             "working directory",
+
+			"ArtifactsSaveHost":         "artifact save host",
+			"ArtifactsAuthToken":        "artifact save auth token",
+			"ArtifactsAuthTokenCommand": "command that prints the artifact save auth token, run again whenever the save host rejects the token",
+			"ArtifactsChunkSize":        "put artifacts larger than this to the save host in chunks of this size, each retried on its own (0 disables)",
 
-			"ArtifactsSaveHost":  "artifact save host",
-			"ArtifactsAuthToken": "artifact save auth token",
+			"OCIRef":                  "OCI registry reference to push artifacts to, e.g. registry.example.com/repo:tag",
+			"OCIUser":                 "OCI registry username (defaults to docker config credentials)",
+			"OCIPass":                 "OCI registry password",
+			"OCIPlainHTTP":            "use plain http rather than https for the OCI registry",
+			"GCSToken":                "OAuth2 access token for Google Cloud Storage, e.g. from gcloud auth print-access-token",
+			"GCSCredentials":          "Google service account JSON key, or the path to one",
+			"GCSEndpoint":             "Google Cloud Storage API endpoint",
+			"IfGenerationMatch":       "only upload to gcs objects still at this generation, or 0 to only create new objects",
+			"AzureAccount":            "Azure storage account name",
+			"AzureKey":                "Azure storage account key (base64)",
+			"AzureSASToken":           "Azure shared access signature token, used instead of --azure-key",
+			"AzureEndpoint":           "Azure Blob Storage endpoint, if not https://<account>.blob.core.windows.net",
+			"AzureContainer":          "Azure Blob Storage container, if not --bucket",
+			"SFTPHost":                "SFTP server to upload to, for the sftp provider",
+			"SFTPPort":                "SFTP server port",
+			"SFTPUser":                "SFTP username (defaults to the ssh config's, or the local user)",
+			"SFTPKey":                 "path to the SFTP private key (defaults to the ssh config's and agent's)",
+			"SFTPPassword":            "SFTP password, used when no key is accepted",
+			"SFTPKnownHosts":          "known_hosts file to check the SFTP server's host key against (defaults to ~/.ssh/known_hosts)",
+			"SFTPDir":                 "remote directory to upload under, if not --bucket (relative to the login directory unless absolute)",
+			"FileRoot":                "directory to copy artifacts into, if not --bucket, for the file provider",
+			"FileFsync":               "fsync each copied artifact and its directory before it counts as uploaded",
+			"GithubPRComment":         "post or update a comment listing the uploaded artifact urls on the github pull request",
+			"GithubPRCommentRequired": "fail the upload if the github pull request comment cannot be posted",
+			"GithubToken":             "github token used to comment on the pull request",
+			"GithubRepo":              "github repository (owner/repo) of the pull request",
+			"GithubPR":                "github pull request number, detected from GITHUB_REF under github actions",
+			"GithubAPIURL":            "github api url",
+			"NotifyURLs":              "POST a JSON summary of the run to this url once it is over (may be given more than once)",
+			"NotifyTemplate":          "text/template for the --notify-url payload instead of the JSON summary, or @ and the name of a file holding one",
+			"PreHook":                 "shell command to run in the working dir before walking the paths, failing the upload if it fails",
+			"PostHook":                "shell command to run in the working dir once the upload is done, with its results in ARTIFACTS_HOOK_* environment variables",
 		},
 		"env": map[string]string{
-			"AccessKey":    "ARTIFACTS_KEY,ARTIFACTS_AWS_ACCESS_KEY,AWS_ACCESS_KEY_ID,AWS_ACCESS_KEY",
-			"BucketName":   "ARTIFACTS_BUCKET,ARTIFACTS_S3_BUCKET",
-			"CacheControl": "ARTIFACTS_CACHE_CONTROL",
-			"Perm":         "ARTIFACTS_PERMISSIONS",
-			"SecretKey":    "ARTIFACTS_SECRET,ARTIFACTS_AWS_SECRET_KEY,AWS_SECRET_ACCESS_KEY,AWS_SECRET_KEY",
-			"S3Region":     "ARTIFACTS_REGION,ARTIFACTS_S3_REGION",
+			"AccessKey":                  "ARTIFACTS_KEY,ARTIFACTS_AWS_ACCESS_KEY,AWS_ACCESS_KEY_ID,AWS_ACCESS_KEY",
+			"BucketName":                 "ARTIFACTS_BUCKET,ARTIFACTS_S3_BUCKET",
+			"CacheControl":               "ARTIFACTS_CACHE_CONTROL",
+			"ConfigFile":                 "ARTIFACTS_CONFIG",
+			"NoCache":                    "ARTIFACTS_NO_CACHE",
+			"NoCachePaths":               "ARTIFACTS_NO_CACHE_PATHS",
+			"HTTPProxy":                  "ARTIFACTS_HTTP_PROXY",
+			"InsecureSkipVerify":         "ARTIFACTS_INSECURE_SKIP_VERIFY",
+			"CACert":                     "ARTIFACTS_CA_CERT",
+			"BandwidthSchedule":          "ARTIFACTS_BANDWIDTH_SCHEDULE",
+			"BandwidthScheduleTimezone":  "ARTIFACTS_BANDWIDTH_SCHEDULE_TIMEZONE",
+			"ContentTypeByExtensionOnly": "ARTIFACTS_CONTENT_TYPE_BY_EXTENSION_ONLY",
+			"ContentTypePrecedence":      "ARTIFACTS_CONTENT_TYPE_PRECEDENCE",
+			"ContentTypes":               "ARTIFACTS_CONTENT_TYPES",
+			"DefaultContentType":         "ARTIFACTS_DEFAULT_CONTENT_TYPE",
+			"ContentTypesFrom":           "ARTIFACTS_CONTENT_TYPES_FROM",
+			"Perm":                       "ARTIFACTS_PERMISSIONS",
+			"InheritBucketACL":           "ARTIFACTS_INHERIT_BUCKET_ACL",
+			"StorageClass":               "ARTIFACTS_STORAGE_CLASS",
+			"ServerSideEncryption":       "ARTIFACTS_SSE",
+			"SSEKMSKeyID":                "ARTIFACTS_SSE_KMS_KEY_ID",
+			"SSECustomerKey":             "ARTIFACTS_SSE_C_KEY",
+			"SignedURLs":                 "ARTIFACTS_SIGNED_URLS",
+			"SignedURLTTL":               "ARTIFACTS_SIGNED_URL_TTL",
+			"RedirectLocations":          "ARTIFACTS_REDIRECT_LOCATION",
+			"AutoTagRun":                 "ARTIFACTS_AUTO_TAG_RUN",
+			"GrantRead":                  "ARTIFACTS_GRANT_READ",
+			"GrantFullControl":           "ARTIFACTS_GRANT_FULL_CONTROL",
+			"SecretKey":                  "ARTIFACTS_SECRET,ARTIFACTS_AWS_SECRET_KEY,AWS_SECRET_ACCESS_KEY,AWS_SECRET_KEY",
+			"UseInstanceRole":            "ARTIFACTS_INSTANCE_ROLE",
+			"SessionToken":               "ARTIFACTS_SESSION_TOKEN,AWS_SESSION_TOKEN,AWS_SECURITY_TOKEN",
+			"AssumeRoleARN":              "ARTIFACTS_ASSUME_ROLE_ARN",
+			"AssumeRoleSessionName":      "ARTIFACTS_ASSUME_ROLE_SESSION_NAME",
+			"S3Region":                   "ARTIFACTS_REGION,ARTIFACTS_S3_REGION",
+			"S3Endpoint":                 "ARTIFACTS_S3_ENDPOINT,ARTIFACTS_ENDPOINT",
+			"S3ForcePathStyle":           "ARTIFACTS_S3_FORCE_PATH_STYLE",
+			"S3VirtualHost":              "ARTIFACTS_S3_VIRTUAL_HOST",
 
 			"RepoSlug":    "ARTIFACTS_REPO_SLUG,TRAVIS_REPO_SLUG",
 			"BuildNumber": "ARTIFACTS_BUILD_NUMBER,TRAVIS_BUILD_NUMBER",
@@ -97,24 +576,187 @@ var (
 			"JobNumber":   "ARTIFACTS_JOB_NUMBER,TRAVIS_JOB_NUMBER",
 			"JobID":       "ARTIFACTS_JOB_ID,TRAVIS_JOB_ID",
 
-			"Concurrency": "ARTIFACTS_CONCURRENCY",
-			"MaxSize":     "ARTIFACTS_MAX_SIZE",
-			"Paths":       "ARTIFACTS_PATHS",
-			"Provider":    "ARTIFACTS_UPLOAD_PROVIDER",
-			"Retries":     "ARTIFACTS_RETRIES",
-			"TargetPaths": "ARTIFACTS_TARGET_PATHS",
-			"WorkingDir":  "ARTIFACTS_WORKING_DIR,TRAVIS_BUILD_DIR,PWD",
+			"Concurrency":            "ARTIFACTS_CONCURRENCY",
+			"MaxOpenFiles":           "ARTIFACTS_MAX_OPEN_FILES",
+			"Stream":                 "ARTIFACTS_STREAM",
+			"Explain":                "ARTIFACTS_EXPLAIN",
+			"KeepGoingOnWalkError":   "ARTIFACTS_KEEP_GOING_ON_WALK_ERROR",
+			"FailFast":               "ARTIFACTS_FAIL_FAST",
+			"OnError":                "ARTIFACTS_ON_ERROR",
+			"SymlinkMode":            "ARTIFACTS_SYMLINKS",
+			"FollowSymlinks":         "ARTIFACTS_FOLLOW_SYMLINKS",
+			"Bundle":                 "ARTIFACTS_BUNDLE",
+			"Archive":                "ARTIFACTS_ARCHIVE",
+			"BundleName":             "ARTIFACTS_BUNDLE_NAME,ARTIFACTS_ARCHIVE_NAME",
+			"BundleManifestInside":   "ARTIFACTS_BUNDLE_MANIFEST_INSIDE",
+			"MaxSize":                "ARTIFACTS_MAX_SIZE",
+			"MaxFileSize":            "ARTIFACTS_MAX_FILE_SIZE",
+			"TrimToFit":              "ARTIFACTS_TRIM_TO_FIT",
+			"TrimOrder":              "ARTIFACTS_TRIM_ORDER",
+			"SizeBreakdown":          "ARTIFACTS_SIZE_BREAKDOWN",
+			"MaxFiles":               "ARTIFACTS_MAX_FILES",
+			"MaxKeysPerPrefix":       "ARTIFACTS_MAX_KEYS_PER_PREFIX",
+			"MaxKeyLength":           "ARTIFACTS_MAX_KEY_LENGTH",
+			"KeyLengthPolicy":        "ARTIFACTS_KEY_LENGTH_POLICY",
+			"ExpectedCount":          "ARTIFACTS_EXPECTED_COUNT",
+			"ShardIndex":             "ARTIFACTS_SHARD_INDEX",
+			"ShardCount":             "ARTIFACTS_SHARD_COUNT",
+			"DuplicateKeys":          "ARTIFACTS_DUPLICATE_KEYS",
+			"CaseCollisions":         "ARTIFACTS_CASE_COLLISIONS",
+			"VerifyHeaders":          "ARTIFACTS_VERIFY_HEADERS",
+			"VerifyCacheControl":     "ARTIFACTS_VERIFY_CACHE_CONTROL",
+			"Metadata":               "ARTIFACTS_METADATA",
+			"ContentEncodingByExt":   "ARTIFACTS_CONTENT_ENCODING_BY_EXT",
+			"Excludes":               "ARTIFACTS_EXCLUDES,ARTIFACTS_EXCLUDE",
+			"Includes":               "ARTIFACTS_INCLUDES,ARTIFACTS_INCLUDE",
+			"ContentEncodingKeepExt": "ARTIFACTS_CONTENT_ENCODING_KEEP_EXT",
+			"Gzip":                   "ARTIFACTS_GZIP",
+			"GzipTypes":              "ARTIFACTS_GZIP_TYPES",
+			"MultipartThreshold":     "ARTIFACTS_MULTIPART_THRESHOLD",
+			"MultipartChunkSize":     "ARTIFACTS_MULTIPART_CHUNK_SIZE",
+			"MaxConcurrentMultipart": "ARTIFACTS_MAX_CONCURRENT_MULTIPART",
+			"StdinSize":              "ARTIFACTS_STDIN_SIZE",
+			"Stdin":                  "ARTIFACTS_STDIN",
+			"StdinName":              "ARTIFACTS_STDIN_NAME",
+			"StdinStream":            "ARTIFACTS_STDIN_STREAM",
+			"TempDir":                "ARTIFACTS_TEMP_DIR",
+			"MinFreeDisk":            "ARTIFACTS_MIN_FREE_DISK",
+			"MaxBandwidth":           "ARTIFACTS_MAX_BANDWIDTH",
+			"MaxConnectionBandwidth": "ARTIFACTS_MAX_CONNECTION_BANDWIDTH",
+			"CompressParallel":       "ARTIFACTS_COMPRESS_PARALLEL",
+			"Paths":                  "ARTIFACTS_PATHS",
+			"Provider":               "ARTIFACTS_UPLOAD_PROVIDER",
+			"ProviderOptions":        "ARTIFACTS_PROVIDER_OPTIONS",
+			"Record":                 "ARTIFACTS_RECORD",
+			"Replay":                 "ARTIFACTS_REPLAY",
+			"StateFile":              "ARTIFACTS_STATE_FILE",
+			"FromManifest":           "ARTIFACTS_FROM_MANIFEST",
+			"Retries":                "ARTIFACTS_RETRIES",
+			"RetryDeadline":          "ARTIFACTS_RETRY_DEADLINE",
+			"Timeout":                "ARTIFACTS_TIMEOUT,ARTIFACTS_TOTAL_TIMEOUT",
+			"UploadTimeout":          "ARTIFACTS_UPLOAD_TIMEOUT",
+			"ShutdownGrace":          "ARTIFACTS_SHUTDOWN_GRACE",
+			"RetryInterval":          "ARTIFACTS_RETRY_INTERVAL,ARTIFACTS_RETRY_BASE_DELAY",
+			"RetryIntervalMax":       "ARTIFACTS_RETRY_INTERVAL_MAX,ARTIFACTS_RETRY_MAX_DELAY",
+			"SlowUploadThreshold":    "ARTIFACTS_SLOW_UPLOAD_THRESHOLD",
+			"ProgressJSON":           "ARTIFACTS_PROGRESS_JSON",
+			"ProgressInterval":       "ARTIFACTS_PROGRESS_INTERVAL",
+			"Progress":               "ARTIFACTS_PROGRESS",
+			"OtelEndpoint":           "ARTIFACTS_OTEL_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT",
+			"MetricsFile":            "ARTIFACTS_METRICS_FILE",
+			"StatsdAddr":             "ARTIFACTS_STATSD_ADDR",
+			"SuccessMarker":          "ARTIFACTS_SUCCESS_MARKER",
+			"SBOM":                   "ARTIFACTS_SBOM",
+			"ManifestKey":            "ARTIFACTS_MANIFEST_KEY",
+			"ManifestIncludeFailed":  "ARTIFACTS_MANIFEST_INCLUDE_FAILED",
+			"GenerateIndex":          "ARTIFACTS_INDEX",
+			"OutputCSV":              "ARTIFACTS_OUTPUT_CSV",
+			"ResultFile":             "ARTIFACTS_RESULT_FILE,ARTIFACTS_RESULT_JSON",
+			"ExitCodeMap":            "ARTIFACTS_EXIT_CODE_MAP",
+			"OutputManifest":         "ARTIFACTS_OUTPUT_MANIFEST",
+			"OutputTemplate":         "ARTIFACTS_OUTPUT_TEMPLATE",
+			"HostLock":               "ARTIFACTS_HOST_LOCK",
+			"HostLockMax":            "ARTIFACTS_HOST_LOCK_MAX",
+			"TargetPaths":            "ARTIFACTS_TARGET_PATHS",
+			"UploadOrderFrom":        "ARTIFACTS_UPLOAD_ORDER_FROM",
+			"RoutesFrom":             "ARTIFACTS_ROUTES_FROM",
+			"HeaderRulesFrom":        "ARTIFACTS_HEADER_RULES_FROM",
+			"ValidateOnly":           "ARTIFACTS_VALIDATE_ONLY",
+			"DryRun":                 "ARTIFACTS_DRY_RUN",
+			"DryRunFormat":           "ARTIFACTS_DRY_RUN_FORMAT",
+			"AssertNoChanges":        "ARTIFACTS_ASSERT_NO_CHANGES",
+			"AssertNoExtraneous":     "ARTIFACTS_ASSERT_NO_EXTRANEOUS",
+			"SkipUnchanged":          "ARTIFACTS_SKIP_UNCHANGED",
+			"Dedup":                  "ARTIFACTS_DEDUP",
+			"Delta":                  "ARTIFACTS_DELTA",
+			"DeltaBlockSize":         "ARTIFACTS_DELTA_BLOCK_SIZE",
+			"DeltaMinSize":           "ARTIFACTS_DELTA_MIN_SIZE",
+			"Sync":                   "ARTIFACTS_SYNC",
+			"SyncDelete":             "ARTIFACTS_SYNC_DELETE",
+			"SyncConfirm":            "ARTIFACTS_SYNC_CONFIRM",
+			"Checksums":              "ARTIFACTS_CHECKSUMS",
+			"WriteChecksums":         "ARTIFACTS_WRITE_CHECKSUMS",
+			"FailIfGrew":             "ARTIFACTS_FAIL_IF_GREW",
+			"FailIfGrewPaths":        "ARTIFACTS_FAIL_IF_GREW_PATHS",
+			"FailIfGrewTolerance":    "ARTIFACTS_FAIL_IF_GREW_TOLERANCE",
+			"WorkingDir":             "ARTIFACTS_WORKING_DIR,TRAVIS_BUILD_DIR,PWD",
 
-			"ArtifactsSaveHost":  "ARTIFACTS_SAVE_HOST",
-			"ArtifactsAuthToken": "ARTIFACTS_AUTH_TOKEN",
+			"ArtifactsSaveHost":         "ARTIFACTS_SAVE_HOST",
+			"ArtifactsAuthToken":        "ARTIFACTS_AUTH_TOKEN",
+			"ArtifactsAuthTokenCommand": "ARTIFACTS_AUTH_TOKEN_COMMAND",
+			"ArtifactsChunkSize":        "ARTIFACTS_SAVE_HOST_CHUNK_SIZE",
+
+			"OCIRef":                  "ARTIFACTS_OCI_REF",
+			"OCIUser":                 "ARTIFACTS_OCI_USER",
+			"OCIPass":                 "ARTIFACTS_OCI_PASS",
+			"OCIPlainHTTP":            "ARTIFACTS_OCI_PLAIN_HTTP",
+			"GCSToken":                "ARTIFACTS_GCS_TOKEN,GOOGLE_OAUTH_ACCESS_TOKEN",
+			"GCSCredentials":          "ARTIFACTS_GCS_CREDENTIALS,GOOGLE_APPLICATION_CREDENTIALS",
+			"GCSEndpoint":             "ARTIFACTS_GCS_ENDPOINT",
+			"IfGenerationMatch":       "ARTIFACTS_IF_GENERATION_MATCH",
+			"AzureAccount":            "ARTIFACTS_AZURE_ACCOUNT,ARTIFACTS_AZURE_STORAGE_ACCOUNT,AZURE_STORAGE_ACCOUNT",
+			"AzureKey":                "ARTIFACTS_AZURE_KEY,ARTIFACTS_AZURE_STORAGE_KEY,AZURE_STORAGE_KEY",
+			"AzureSASToken":           "ARTIFACTS_AZURE_SAS_TOKEN,AZURE_STORAGE_SAS_TOKEN",
+			"AzureEndpoint":           "ARTIFACTS_AZURE_ENDPOINT",
+			"AzureContainer":          "ARTIFACTS_AZURE_CONTAINER",
+			"SFTPHost":                "ARTIFACTS_SFTP_HOST",
+			"SFTPPort":                "ARTIFACTS_SFTP_PORT",
+			"SFTPUser":                "ARTIFACTS_SFTP_USER,ARTIFACTS_SFTP_USERNAME",
+			"SFTPKey":                 "ARTIFACTS_SFTP_KEY",
+			"SFTPPassword":            "ARTIFACTS_SFTP_PASSWORD",
+			"SFTPKnownHosts":          "ARTIFACTS_SFTP_KNOWN_HOSTS",
+			"SFTPDir":                 "ARTIFACTS_SFTP_DIR",
+			"FileRoot":                "ARTIFACTS_FILE_ROOT",
+			"FileFsync":               "ARTIFACTS_FILE_FSYNC",
+			"GithubPRComment":         "ARTIFACTS_GITHUB_PR_COMMENT",
+			"GithubPRCommentRequired": "ARTIFACTS_GITHUB_PR_COMMENT_REQUIRED",
+			"GithubToken":             "ARTIFACTS_GITHUB_TOKEN,GITHUB_TOKEN",
+			"GithubRepo":              "ARTIFACTS_GITHUB_REPO,GITHUB_REPOSITORY",
+			"GithubPR":                "ARTIFACTS_GITHUB_PR",
+			"GithubAPIURL":            "ARTIFACTS_GITHUB_API_URL,GITHUB_API_URL",
+			"NotifyURLs":              "ARTIFACTS_NOTIFY_URLS,ARTIFACTS_NOTIFY_URL",
+			"NotifyTemplate":          "ARTIFACTS_NOTIFY_TEMPLATE",
+			"PreHook":                 "ARTIFACTS_PRE_HOOK",
+			"PostHook":                "ARTIFACTS_POST_HOOK",
 		},
 		"default": map[string]string{
-			"AccessKey":    "",
-			"BucketName":   "",
-			"CacheControl": "private",
-			"Perm":         "private",
-			"SecretKey":    "",
-			"S3Region":     "us-east-1",
+			"AccessKey":                  "",
+			"BucketName":                 "",
+			"CacheControl":               "private",
+			"ConfigFile":                 "",
+			"NoCache":                    "false",
+			"NoCachePaths":               "",
+			"HTTPProxy":                  "",
+			"InsecureSkipVerify":         "false",
+			"CACert":                     "",
+			"BandwidthSchedule":          "",
+			"BandwidthScheduleTimezone":  "Local",
+			"ContentTypeByExtensionOnly": "false",
+			"ContentTypePrecedence":      "extension",
+			"ContentTypes":               "",
+			"DefaultContentType":         "",
+			"ContentTypesFrom":           "",
+			"Perm":                       "private",
+			"InheritBucketACL":           "false",
+			"StorageClass":               "",
+			"ServerSideEncryption":       "",
+			"SSEKMSKeyID":                "",
+			"SSECustomerKey":             "",
+			"SignedURLs":                 "false",
+			"SignedURLTTL":               "24h",
+			"RedirectLocations":          "",
+			"AutoTagRun":                 "false",
+			"GrantRead":                  "",
+			"GrantFullControl":           "",
+			"SecretKey":                  "",
+			"UseInstanceRole":            "false",
+			"SessionToken":               "",
+			"AssumeRoleARN":              "",
+			"AssumeRoleSessionName":      "",
+			"S3Region":                   "us-east-1",
+			"S3Endpoint":                 "",
+			"S3ForcePathStyle":           "false",
+			"S3VirtualHost":              "false",
 
 			"RepoSlug":    "",
 			"BuildNumber": "",
@@ -122,28 +764,191 @@ var (
 			"JobNumber":   "",
 			"JobID":       "",
 
-			"Concurrency": "5",
-			"MaxSize":     fmt.Sprintf("%d", 1024*1024*1000),
-			"Paths":       "",
-			"Provider":    "s3",
-			"Retries":     "2",
-			"TargetPaths": "artifacts/$TRAVIS_BUILD_NUMBER/$TRAVIS_JOB_NUMBER",
-			"WorkingDir":  ".",
+			"Concurrency":            "5",
+			"MaxOpenFiles":           "0",
+			"Stream":                 "false",
+			"Explain":                "false",
+			"KeepGoingOnWalkError":   "false",
+			"FailFast":               "false",
+			"OnError":                "continue",
+			"SymlinkMode":            "",
+			"FollowSymlinks":         "false",
+			"Bundle":                 "false",
+			"Archive":                "",
+			"BundleName":             "artifacts/build-{{.BuildNumber}}.tar",
+			"BundleManifestInside":   "false",
+			"MaxSize":                fmt.Sprintf("%d", 1024*1024*1000),
+			"MaxFileSize":            "0",
+			"TrimToFit":              "false",
+			"TrimOrder":              "largest",
+			"SizeBreakdown":          "",
+			"MaxFiles":               "0",
+			"MaxKeysPerPrefix":       "0",
+			"MaxKeyLength":           "0",
+			"KeyLengthPolicy":        "fail",
+			"ExpectedCount":          "",
+			"ShardIndex":             "0",
+			"ShardCount":             "1",
+			"DuplicateKeys":          "warn",
+			"CaseCollisions":         "off",
+			"VerifyHeaders":          "off",
+			"VerifyCacheControl":     "false",
+			"Metadata":               "",
+			"ContentEncodingByExt":   "",
+			"Excludes":               "",
+			"Includes":               "",
+			"ContentEncodingKeepExt": "false",
+			"Gzip":                   "false",
+			"GzipTypes":              "",
+			"MultipartThreshold":     fmt.Sprintf("%d", 1024*1024*100),
+			"MultipartChunkSize":     fmt.Sprintf("%d", 1024*1024*5),
+			"MaxConcurrentMultipart": "0",
+			"StdinSize":              "0",
+			"Stdin":                  "false",
+			"StdinName":              "",
+			"StdinStream":            "false",
+			"TempDir":                "",
+			"MinFreeDisk":            "0",
+			"MaxBandwidth":           "0",
+			"MaxConnectionBandwidth": "0",
+			"CompressParallel":       "1",
+			"Paths":                  "",
+			"Provider":               "s3",
+			"ProviderOptions":        "",
+			"Record":                 "",
+			"Replay":                 "",
+			"StateFile":              "",
+			"FromManifest":           "",
+			"Retries":                "2",
+			"RetryDeadline":          "0",
+			"Timeout":                "0",
+			"UploadTimeout":          "0",
+			"ShutdownGrace":          "0",
+			"RetryInterval":          "3s",
+			"RetryIntervalMax":       "1m",
+			"SlowUploadThreshold":    "1m",
+			"ProgressJSON":           "",
+			"ProgressInterval":       "0",
+			"Progress":               "false",
+			"OtelEndpoint":           "",
+			"MetricsFile":            "",
+			"StatsdAddr":             "",
+			"SuccessMarker":          "",
+			"SBOM":                   "",
+			"ManifestKey":            "",
+			"ManifestIncludeFailed":  "false",
+			"GenerateIndex":          "false",
+			"OutputCSV":              "",
+			"ResultFile":             "",
+			"ExitCodeMap":            "",
+			"OutputManifest":         "",
+			"OutputTemplate":         "",
+			"HostLock":               "",
+			"HostLockMax":            "1",
+			"TargetPaths":            "artifacts/$TRAVIS_BUILD_NUMBER/$TRAVIS_JOB_NUMBER",
+			"UploadOrderFrom":        "",
+			"RoutesFrom":             "",
+			"HeaderRulesFrom":        "",
+			"ValidateOnly":           "false",
+			"DryRun":                 "false",
+			"DryRunFormat":           "text",
+			"AssertNoChanges":        "false",
+			"AssertNoExtraneous":     "false",
+			"SkipUnchanged":          "false",
+			"Dedup":                  "",
+			"Delta":                  "false",
+			"DeltaBlockSize":         fmt.Sprintf("%d", 1024*1024*4),
+			"DeltaMinSize":           fmt.Sprintf("%d", 1024*1024*64),
+			"Sync":                   "false",
+			"SyncDelete":             "false",
+			"SyncConfirm":            "false",
+			"Checksums":              "false",
+			"WriteChecksums":         "false",
+			"FailIfGrew":             "false",
+			"FailIfGrewPaths":        "",
+			"FailIfGrewTolerance":    "",
+			"WorkingDir":             ".",
+
+			"ArtifactsSaveHost":         "",
+			"ArtifactsAuthToken":        "",
+			"ArtifactsAuthTokenCommand": "",
+			"ArtifactsChunkSize":        "0",
 
-			"ArtifactsSaveHost":  "",
-			"ArtifactsAuthToken": "",
+			"OCIRef":                  "",
+			"OCIUser":                 "",
+			"OCIPass":                 "",
+			"OCIPlainHTTP":            "false",
+			"GCSToken":                "",
+			"GCSCredentials":          "",
+			"GCSEndpoint":             "https://storage.googleapis.com",
+			"IfGenerationMatch":       "",
+			"AzureAccount":            "",
+			"AzureKey":                "",
+			"AzureSASToken":           "",
+			"AzureEndpoint":           "",
+			"AzureContainer":          "",
+			"SFTPHost":                "",
+			"SFTPPort":                "22",
+			"SFTPUser":                "",
+			"SFTPKey":                 "",
+			"SFTPPassword":            "",
+			"SFTPKnownHosts":          "",
+			"SFTPDir":                 "",
+			"FileRoot":                "",
+			"FileFsync":               "false",
+			"GithubPRComment":         "false",
+			"GithubPRCommentRequired": "false",
+			"GithubToken":             "",
+			"GithubRepo":              "",
+			"GithubPR":                "0",
+			"GithubAPIURL":            "https://api.github.com",
+			"NotifyURLs":              "",
+			"NotifyTemplate":          "",
+			"PreHook":                 "",
+			"PostHook":                "",
 		},
 	}
 )
 
 // Options is used in the call to Upload
 type Options struct {
-	AccessKey    string
-	BucketName   string
-	CacheControl string
-	Perm         string
-	SecretKey    string
-	S3Region     string
+	AccessKey                  string
+	BucketName                 string
+	CacheControl               string
+	ConfigFile                 string
+	NoCache                    bool
+	NoCachePaths               []string
+	HTTPProxy                  string
+	InsecureSkipVerify         bool
+	CACert                     string
+	BandwidthSchedule          string
+	BandwidthScheduleTimezone  string
+	ContentTypeByExtensionOnly bool
+	ContentTypePrecedence      string
+	ContentTypes               map[string]string
+	DefaultContentType         string
+	ContentTypesFrom           string
+	Perm                       string
+	InheritBucketACL           bool
+	StorageClass               string
+	ServerSideEncryption       string
+	SSEKMSKeyID                string
+	SSECustomerKey             string
+	SignedURLs                 bool
+	SignedURLTTL               time.Duration
+	RedirectLocations          string
+	AutoTagRun                 bool
+	GrantRead                  string
+	GrantFullControl           string
+	SecretKey                  string
+	UseInstanceRole            bool
+	SessionToken               string
+	AssumeRoleARN              string
+	AssumeRoleSessionName      string
+	S3Region                   string
+	S3Endpoint                 string
+	S3ForcePathStyle           bool
+	S3VirtualHost              bool
 
 	RepoSlug    string
 	BuildNumber string
@@ -151,16 +956,274 @@ type Options struct {
 	JobNumber   string
 	JobID       string
 
-	Concurrency uint64
-	MaxSize     uint64
-	Paths       []string
-	Provider    string
-	Retries     uint64
-	TargetPaths []string
-	WorkingDir  string
+	Concurrency            uint64
+	MaxOpenFiles           uint64
+	Stream                 bool
+	Explain                bool
+	KeepGoingOnWalkError   bool
+	FailFast               bool
+	OnError                string
+	SymlinkMode            string
+	FollowSymlinks         bool
+	Bundle                 bool
+	Archive                string
+	BundleName             string
+	BundleManifestInside   bool
+	MaxSize                uint64
+	MaxFileSize            uint64
+	TrimToFit              bool
+	TrimOrder              string
+	SizeBreakdown          []string
+	MaxFiles               uint64
+	MaxKeysPerPrefix       uint64
+	MaxKeyLength           uint64
+	KeyLengthPolicy        string
+	ExpectedCount          string
+	ShardIndex             uint64
+	ShardCount             uint64
+	DuplicateKeys          string
+	CaseCollisions         string
+	VerifyHeaders          string
+	VerifyCacheControl     bool
+	Metadata               []string
+	ContentEncodingByExt   []string
+	Excludes               []string
+	Includes               []string
+	ContentEncodingKeepExt bool
+	Gzip                   bool
+	GzipTypes              []string
+	MultipartThreshold     uint64
+	MultipartChunkSize     uint64
+	MaxConcurrentMultipart uint64
+	StdinSize              uint64
+	Stdin                  bool
+	StdinName              string
+	StdinStream            bool
+	TempDir                string
+	MinFreeDisk            uint64
+	MaxBandwidth           uint64
+	MaxConnectionBandwidth uint64
+	CompressParallel       uint64
+	Paths                  []string
+	Provider               string
+	ProviderOptions        []string
+	Record                 string
+	Replay                 string
+	StateFile              string
+	FromManifest           string
+	Retries                uint64
+	RetryDeadline          time.Duration
+	Timeout                time.Duration
+	UploadTimeout          time.Duration
+	ShutdownGrace          time.Duration
+	RetryInterval          time.Duration
+	RetryIntervalMax       time.Duration
+	SlowUploadThreshold    time.Duration
+	ProgressJSON           string
+	ProgressInterval       time.Duration
+	Progress               bool
+	OtelEndpoint           string
+	MetricsFile            string
+	StatsdAddr             string
+	SuccessMarker          string
+	SBOM                   string
+	ManifestKey            string
+	ManifestIncludeFailed  bool
+	GenerateIndex          bool
+	OutputCSV              string
+	ResultFile             string
+	ExitCodeMap            string
+	OutputManifest         string
+	OutputTemplate         string
+	HostLock               string
+	HostLockMax            uint64
+	TargetPaths            []string
+	UploadOrderFrom        string
+	RoutesFrom             string
+	HeaderRulesFrom        string
+	ValidateOnly           bool
+	DryRun                 bool
+	DryRunFormat           string
+	AssertNoChanges        bool
+	AssertNoExtraneous     bool
+	SkipUnchanged          bool
+	Dedup                  string
+	Delta                  bool
+	DeltaBlockSize         uint64
+	DeltaMinSize           uint64
+	Sync                   bool
+	SyncDelete             bool
+	SyncConfirm            bool
+	Checksums              bool
+	WriteChecksums         bool
+	FailIfGrew             bool
+	FailIfGrewPaths        []string
+	FailIfGrewTolerance    string
+	WorkingDir             string
+
+	ArtifactsSaveHost         string
+	ArtifactsAuthToken        string
+	ArtifactsAuthTokenCommand string
+	ArtifactsChunkSize        uint64
+
+	OCIRef       string
+	OCIUser      string
+	OCIPass      string
+	OCIPlainHTTP bool
+
+	GCSToken          string
+	GCSCredentials    string
+	GCSEndpoint       string
+	IfGenerationMatch string
+
+	AzureAccount   string
+	AzureKey       string
+	AzureSASToken  string
+	AzureEndpoint  string
+	AzureContainer string
+
+	SFTPHost       string
+	SFTPPort       uint64
+	SFTPUser       string
+	SFTPKey        string
+	SFTPPassword   string
+	SFTPKnownHosts string
+	SFTPDir        string
+
+	FileRoot  string
+	FileFsync bool
+
+	GithubPRComment         bool
+	GithubPRCommentRequired bool
+	GithubToken             string
+	GithubRepo              string
+	GithubPR                uint64
+	GithubAPIURL            string
+
+	NotifyURLs     []string
+	NotifyTemplate string
+
+	PreHook  string
+	PostHook string
+
+	retryDeadlineAt time.Time
+
+	// retriesSet is whether --retries was given in any form, and
+	// retriesDefault is the value it had before, so that the provider's
+	// own default only replaces a value nobody asked for
+	retriesSet     bool
+	retriesDefault uint64
+
+	// retryIntervalSet is whether --retry-interval was given in any form,
+	// since the providers have their own defaults otherwise
+	retryIntervalSet bool
+
+	// concurrencyAuto is whether --concurrency was given as "auto", which
+	// leaves Concurrency at its default for the commands that don't tune
+	concurrencyAuto bool
+
+	// headerRules are the header_rules given inline in a config, which
+	// apply before those of --header-rules-from
+	headerRules []*headerRule
+
+	// transport is shared by the http providers so that they all go
+	// through the same proxy and reuse connections
+	transport http.RoundTripper
+
+	// sent counts the bytes of the request bodies in flight, for progress
+	sent *sentBytes
+
+	// ctx is the context of the upload in progress, which its requests
+	// are canceled along with
+	ctx context.Context
+}
+
+// repeatableOpts are the slice options whose flag may be given more
+// than once
+var repeatableOpts = map[string]bool{
+	"ContentTypes": true,
+	"Excludes":     true,
+	"Includes":     true,
+	"GzipTypes":    true,
+	"Metadata":     true,
+
+	"ProviderOptions": true,
+	"SizeBreakdown":   true,
+}
+
+// urlListOpts are the repeatable slice options holding urls, which can't
+// be split on ":" like the others, so each flag is taken whole and their
+// env vars are split on whitespace instead
+var urlListOpts = map[string]bool{
+	"NotifyURLs": true,
+}
+
+// durationType is the type of the int64 options that are durations, as
+// opposed to plain integers
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// sizeOpts are the uint options that may be given humanized, e.g. 10MB
+var sizeOpts = map[string]bool{
+	"MaxSize":            true,
+	"MaxFileSize":        true,
+	"MultipartThreshold": true,
+	"MultipartChunkSize": true,
+	"StdinSize":          true,
+	"MinFreeDisk":        true,
+	"MaxBandwidth":       true,
+
+	"MaxConnectionBandwidth": true,
+	"ArtifactsChunkSize":     true,
+	"DeltaBlockSize":         true,
+	"DeltaMinSize":           true,
+}
+
+// rateOpts are the size options that are per second, which may say so,
+// e.g. 10MB/s
+var rateOpts = map[string]bool{
+	"MaxBandwidth":           true,
+	"MaxConnectionBandwidth": true,
+}
+
+// parseSizeOpt reads the value of one of the sizeOpts, humanized or not
+func parseSizeOpt(fieldName, value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if rateOpts[fieldName] {
+		value = strings.TrimSuffix(value, "/s")
+	}
+
+	if strings.ContainsAny(value, sizeChars) {
+		return humanize.ParseBytes(value)
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// pairsMap turns key=value pairs into a map, keeping malformed pairs as
+// keys without values for Validate to reject
+func pairsMap(pairs []string) map[string]string {
+	m := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 {
+			m[key] = ""
+			continue
+		}
+		m[key] = strings.TrimSpace(parts[1])
+	}
+	return m
+}
+
+// repeatableFlag is a cli.StringSliceFlag that shows its help like the
+// other string flags.  Its env var is only shown, since the cli package
+// would split it on "," and reset already splits it on ":".
+type repeatableFlag struct {
+	cli.StringSliceFlag
+	envVar string
+}
 
-	ArtifactsSaveHost  string
-	ArtifactsAuthToken string
+func (f repeatableFlag) String() string {
+	return fmt.Sprintf("--%s \t%s [$%s]", f.Name, f.Usage, f.envVar)
 }
 
 // NewOptions makes some *Options with defaults!
@@ -189,9 +1252,32 @@ func (opts *Options) Flags() []cli.Flag {
 			continue
 		}
 
+		envVar := strings.Split(optsMaps["env"][tf.Name], ",")[0]
+
+		if f.Kind() == reflect.Bool {
+			flags = append(flags, cli.BoolFlag{
+				Name:   name,
+				EnvVar: envVar,
+				Usage:  optsMaps["doc"][tf.Name],
+			})
+			continue
+		}
+
+		if repeatableOpts[tf.Name] || urlListOpts[tf.Name] {
+			flags = append(flags, repeatableFlag{
+				StringSliceFlag: cli.StringSliceFlag{
+					Name:  name,
+					Value: &cli.StringSlice{},
+					Usage: optsMaps["doc"][tf.Name],
+				},
+				envVar: envVar,
+			})
+			continue
+		}
+
 		flags = append(flags, cli.StringFlag{
 			Name:   name,
-			EnvVar: strings.Split(optsMaps["env"][tf.Name], ",")[0],
+			EnvVar: envVar,
 			Usage: fmt.Sprintf("%v (default %q)",
 				optsMaps["doc"][tf.Name],
 				fmt.Sprintf("%v", f.Interface())),
@@ -234,16 +1320,63 @@ func (opts *Options) reset() {
 			uintVal, err := strconv.ParseUint(dflt, 10, 64)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: %v", err)
+			} else if sizeOpts[tf.Name] {
+				// sizes may be humanized in the environment too
+				if b, err := parseSizeOpt(tf.Name, value); err == nil {
+					uintVal = b
+				}
+				f.SetUint(uintVal)
 			} else {
 				f.SetUint(env.Uint(envVar, uintVal))
 			}
+		case reflect.Bool:
+			boolVal, err := strconv.ParseBool(dflt)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v", err)
+			} else {
+				f.SetBool(env.Bool(envVar, boolVal))
+			}
+		case reflect.Int64:
+			if f.Type() != durationType {
+				intVal, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v", err)
+				} else {
+					f.SetInt(intVal)
+				}
+				break
+			}
+			durVal, err := time.ParseDuration(dflt)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v", err)
+			} else {
+				f.SetInt(int64(env.Duration(envVar, durVal)))
+			}
 		case reflect.Slice:
-			sliceValue := env.Slice(envVar, ":", strings.Split(":", dflt))
+			if urlListOpts[tf.Name] {
+				f.Set(reflect.ValueOf(strings.Fields(value)))
+				break
+			}
+			if tf.Name == "Metadata" {
+				f.Set(reflect.ValueOf(splitList(tf.Name, value)))
+				break
+			}
+			sliceValue := env.Slice(envVar, listSeparator(tf.Name), strings.Split(":", dflt))
 			f.Set(reflect.ValueOf(sliceValue))
+		case reflect.Map:
+			f.Set(reflect.ValueOf(pairsMap(env.Slice(envVar, ":", []string{}))))
 		default:
 			panic(fmt.Sprintf("unknown kind wat: %v", k))
 		}
 	}
+
+	opts.retriesSet = isSetInEnv("Retries")
+	opts.retriesDefault = opts.Retries
+	opts.retryIntervalSet = isSetInEnv("RetryInterval")
+	opts.concurrencyAuto = false
+	if value, _ := env.CascadeMatch(strings.Split(optsMaps["env"]["Concurrency"], ","), ""); value != "" {
+		opts.setConcurrency(value)
+	}
 }
 
 // UpdateFromCLI overlays a *cli.Context onto internal options
@@ -266,30 +1399,54 @@ func (opts *Options) UpdateFromCLI(c *cli.Context) {
 		}
 
 		name := nameParts[0]
+
+		if f.Kind() == reflect.Bool {
+			// --flag=false turns off a flag that a config file or the
+			// environment turned on
+			for _, part := range nameParts {
+				if c.IsSet(strings.TrimSpace(part)) {
+					f.SetBool(c.Bool(name))
+				}
+			}
+			if c.Bool(name) {
+				f.SetBool(true)
+			}
+			continue
+		}
+
+		if urlListOpts[tf.Name] {
+			if values := c.StringSlice(name); len(values) > 0 {
+				f.Set(reflect.ValueOf(values))
+			}
+			continue
+		}
+
+		if repeatableOpts[tf.Name] {
+			values := []string{}
+			for _, value := range c.StringSlice(name) {
+				values = append(values, splitList(tf.Name, value)...)
+			}
+			if len(values) > 0 && f.Kind() == reflect.Map {
+				f.Set(reflect.ValueOf(pairsMap(values)))
+			} else if len(values) > 0 {
+				f.Set(reflect.ValueOf(values))
+			}
+			continue
+		}
+
 		value := c.String(name)
 		if value == "" {
 			continue
 		}
 
-		switch name {
-		case "concurrency", "retries":
-			intVal, err := strconv.ParseUint(value, 10, 64)
-			if err == nil {
-				f.SetUint(intVal)
-			}
-		case "max-size":
-			if strings.ContainsAny(value, sizeChars) {
-				b, err := humanize.ParseBytes(value)
-				if err == nil {
-					opts.MaxSize = b
-				}
-			} else {
-				intVal, err := strconv.ParseUint(value, 10, 64)
-				if err == nil {
-					opts.MaxSize = intVal
-				}
+		switch {
+		case sizeOpts[tf.Name]:
+			if b, err := parseSizeOpt(tf.Name, value); err == nil {
+				f.SetUint(b)
 			}
-		case "target-paths":
+		case tf.Name == "Concurrency":
+			opts.setConcurrency(value)
+		case name == "target-paths":
 			tp := []string{}
 			for _, part := range strings.Split(value, ":") {
 				trimmed := strings.TrimSpace(part)
@@ -299,36 +1456,410 @@ func (opts *Options) UpdateFromCLI(c *cli.Context) {
 			}
 			opts.TargetPaths = tp
 		default:
-			if f.Kind() == reflect.String {
+			switch f.Kind() {
+			case reflect.String:
 				f.SetString(value)
+			case reflect.Uint64:
+				intVal, err := strconv.ParseUint(value, 10, 64)
+				if err == nil {
+					f.SetUint(intVal)
+				}
+			case reflect.Int64:
+				if f.Type() != durationType {
+					intVal, err := strconv.ParseInt(value, 10, 64)
+					if err == nil {
+						f.SetInt(intVal)
+					}
+					break
+				}
+				durVal, err := time.ParseDuration(value)
+				if err == nil {
+					f.SetInt(int64(durVal))
+				}
+			case reflect.Slice:
+				f.Set(reflect.ValueOf(splitList(tf.Name, value)))
 			}
 		}
 	}
 
+	if c.IsSet("retries") {
+		opts.retriesSet = true
+	}
+
+	if c.IsSet("retry-interval") {
+		opts.retryIntervalSet = true
+	}
+
 	for _, arg := range c.Args() {
 		opts.Paths = append(opts.Paths, arg)
 	}
 }
 
 // Validate checks for validity!
+var contentTypePrecedences = map[string]bool{
+	artifact.ContentTypePrecedenceExtension:    true,
+	artifact.ContentTypePrecedenceSniff:        true,
+	artifact.ContentTypePrecedenceOverrideOnly: true,
+}
+
+// Validate checks the options, failing in the validation category
 func (opts *Options) Validate() error {
+	return categorize(FailureValidation, opts.validate())
+}
+
+func (opts *Options) validate() error {
+	if opts.UploadOrderFrom != "" {
+		if _, err := os.Stat(opts.UploadOrderFrom); err != nil {
+			return fmt.Errorf("upload order file cannot be read: %v", err)
+		}
+	}
+
+	if opts.BandwidthSchedule != "" {
+		if _, err := parseBandwidthSchedule(opts.BandwidthSchedule, opts.BandwidthScheduleTimezone); err != nil {
+			return err
+		}
+	}
+
+	if err := validateTargetPaths(opts); err != nil {
+		return err
+	}
+
+	if opts.OutputTemplate != "" {
+		if _, err := parseOutputTemplate(opts.OutputTemplate); err != nil {
+			return err
+		}
+	}
+
+	if opts.ProgressInterval < 0 {
+		return fmt.Errorf("--progress-interval must not be negative")
+	}
+
+	if opts.RoutesFrom != "" {
+		if _, err := loadRoutes(opts.RoutesFrom); err != nil {
+			return fmt.Errorf("routes file cannot be loaded: %v", err)
+		}
+	}
+
+	if opts.HeaderRulesFrom != "" {
+		if _, err := loadHeaderRules(opts.HeaderRulesFrom); err != nil {
+			return fmt.Errorf("header rules file cannot be loaded: %v", err)
+		}
+	}
+
+	if opts.Record != "" && opts.Provider != "null" {
+		return fmt.Errorf("--record requires the null provider")
+	}
+
+	if opts.Record != "" && opts.Replay != "" {
+		return fmt.Errorf("--record and --replay cannot both be set")
+	}
+
+	if opts.Replay != "" {
+		if _, err := os.Stat(opts.Replay); err != nil {
+			return fmt.Errorf("replay journal cannot be read: %v", err)
+		}
+	}
+
+	if err := opts.validateSSE(); err != nil {
+		return err
+	}
+
+	if opts.OnError != "continue" && opts.OnError != "fail" {
+		return fmt.Errorf("invalid --on-error %q (expected continue or fail)", opts.OnError)
+	}
+
+	if err := opts.validateSignedURLs(); err != nil {
+		return err
+	}
+
+	if err := opts.validateNotify(); err != nil {
+		return err
+	}
+
+	if opts.SBOM != "" {
+		fi, err := os.Stat(opts.SBOM)
+		if err != nil {
+			return fmt.Errorf("sbom cannot be read: %v", err)
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("sbom %s is a directory", opts.SBOM)
+		}
+	}
+
+	if !dryRunFormats[opts.DryRunFormat] {
+		return fmt.Errorf("unknown --format %q (expected text, diff, or json)", opts.DryRunFormat)
+	}
+
+	if opts.AssertNoChanges && !opts.DryRun {
+		return fmt.Errorf("--assert-no-changes requires --dry-run")
+	}
+
+	if opts.AssertNoChanges && opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--assert-no-changes requires the s3 provider")
+	}
+
+	if len(opts.GzipTypes) > 0 && !opts.Gzip {
+		return fmt.Errorf("--gzip-types requires --gzip")
+	}
+
+	if opts.SyncDelete && !opts.Sync {
+		return fmt.Errorf("--sync-delete requires --sync")
+	}
+
+	if opts.SyncConfirm && !opts.SyncDelete {
+		return fmt.Errorf("--sync-confirm requires --sync-delete")
+	}
+
+	if opts.Sync && opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--sync requires the s3 provider")
+	}
+
+	if err := opts.validateDedup(); err != nil {
+		return err
+	}
+
+	if err := opts.validateDelta(); err != nil {
+		return err
+	}
+
+	if err := opts.validateMetrics(); err != nil {
+		return err
+	}
+
+	if err := opts.validateStream(); err != nil {
+		return err
+	}
+
+	if opts.AssertNoExtraneous && !opts.AssertNoChanges {
+		return fmt.Errorf("--assert-no-extraneous requires --assert-no-changes")
+	}
+
+	if _, err := parseGrowthTolerance(opts.FailIfGrewTolerance); err != nil {
+		return err
+	}
+
+	if _, err := parseExitCodeMap(opts.ExitCodeMap); err != nil {
+		return err
+	}
+
+	if err := validateContentTypes(opts.ContentTypes); err != nil {
+		return err
+	}
+
+	if err := opts.validateDefaultContentType(); err != nil {
+		return err
+	}
+
+	if opts.ContentTypesFrom != "" {
+		if _, _, err := loadContentTypes(opts.ContentTypesFrom); err != nil {
+			return fmt.Errorf("content types file cannot be loaded: %v", err)
+		}
+	}
+
+	if !contentTypePrecedences[opts.ContentTypePrecedence] {
+		return fmt.Errorf("unknown --content-type-precedence %q (expected extension, sniff, or override-only)", opts.ContentTypePrecedence)
+	}
+
+	if opts.ContentTypeByExtensionOnly && opts.ContentTypePrecedence != artifact.ContentTypePrecedenceExtension {
+		return fmt.Errorf("--content-type-by-extension-only requires --content-type-precedence extension")
+	}
+
+	if !keyLengthPolicies[opts.KeyLengthPolicy] {
+		return fmt.Errorf("unknown --key-length-policy %q (expected fail or shorten)", opts.KeyLengthPolicy)
+	}
+
+	if _, err := parseExpectedCount(opts.ExpectedCount); err != nil {
+		return err
+	}
+
+	if opts.ShardCount == 0 {
+		return fmt.Errorf("--shard-count must be at least 1")
+	}
+
+	if opts.ShardIndex >= opts.ShardCount {
+		return fmt.Errorf("--shard-index %d must be less than --shard-count %d", opts.ShardIndex, opts.ShardCount)
+	}
+
+	if !verifyHeadersPolicies[opts.VerifyHeaders] {
+		return fmt.Errorf("unknown --verify-headers policy %q (expected off, warn, or fail)", opts.VerifyHeaders)
+	}
+
+	if !caseCollisionsPolicies[opts.CaseCollisions] {
+		return fmt.Errorf("unknown --case-collisions policy %q (expected off, warn, or fail)", opts.CaseCollisions)
+	}
+
+	if opts.AutoTagRun && opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--auto-tag-run requires the s3 provider")
+	}
+
+	if opts.RedirectLocations != "" {
+		if opts.Provider != "s3" && opts.Provider != "" {
+			return fmt.Errorf("--redirect-location requires the s3 provider")
+		}
+
+		if _, err := parseRedirectLocations(opts.RedirectLocations); err != nil {
+			return err
+		}
+	}
+
+	if opts.CaseCollisions != "off" && opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--case-collisions requires the s3 provider")
+	}
+
+	if !symlinkModes[opts.SymlinkMode] {
+		return fmt.Errorf("unknown --symlinks mode %q (expected follow, skip, ignore-dupes, or preserve)", opts.SymlinkMode)
+	}
+
+	if opts.FollowSymlinks && opts.SymlinkMode != "" && opts.SymlinkMode != "follow" {
+		return fmt.Errorf("--follow-symlinks conflicts with --symlinks %s", opts.SymlinkMode)
+	}
+
+	if opts.Archive != "" && !archiveFormats[opts.Archive] {
+		return fmt.Errorf("unknown --archive %q (expected tar, tar.gz, or zip)", opts.Archive)
+	}
+
+	if opts.bundling() {
+		if err := validateBundleName(opts.BundleName); err != nil {
+			return err
+		}
+
+		if opts.RedirectLocations != "" {
+			return fmt.Errorf("--redirect-location cannot be combined with --bundle")
+		}
+	} else if opts.BundleManifestInside {
+		return fmt.Errorf("--bundle-manifest-inside requires --bundle")
+	}
+
+	if !duplicateKeysPolicies[opts.DuplicateKeys] {
+		return fmt.Errorf("unknown --duplicate-keys policy %q (expected warn, fail, or allow)", opts.DuplicateKeys)
+	}
+
+	if opts.GithubPRComment && opts.GithubPRCommentRequired {
+		if _, err := opts.githubPR(); err != nil {
+			return err
+		}
+	}
+
+	if opts.HTTPProxy != "" {
+		if _, err := parseHTTPProxy(opts.HTTPProxy); err != nil {
+			return err
+		}
+	}
+
+	if opts.CACert != "" {
+		if _, err := loadCACert(opts.CACert); err != nil {
+			return err
+		}
+	}
+
+	if opts.TempDir != "" {
+		if fi, err := os.Stat(opts.TempDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("temp dir %q is not a directory", opts.TempDir)
+		}
+	}
+
+	if opts.StdinSize > 0 && opts.readsStdin() && len(opts.TargetPaths) > 1 {
+		return fmt.Errorf("--stdin-size can only stream stdin to a single target path")
+	}
+
+	if err := opts.validateStdin(); err != nil {
+		return err
+	}
+
+	if opts.FromManifest != "" && opts.Replay != "" {
+		return fmt.Errorf("--from-manifest and --replay cannot both be set")
+	}
+
+	if opts.FromManifest != "" {
+		if _, err := os.Stat(opts.FromManifest); err != nil {
+			return fmt.Errorf("manifest cannot be read: %v", err)
+		}
+	}
+
+	if err := opts.validateSizeBudget(); err != nil {
+		return err
+	}
+
+	if err := validateMetadata(opts.Metadata); err != nil {
+		return err
+	}
+
+	if _, err := parseContentEncodings(opts.ContentEncodingByExt); err != nil {
+		return err
+	}
+
+	if opts.IfGenerationMatch != "" && opts.Provider != "gcs" {
+		return fmt.Errorf("--if-generation-match only works with the gcs provider")
+	}
+
+	if opts.fanout() {
+		return opts.validateFanout()
+	}
+
+	return opts.validateProvider()
+}
+
+// validateProvider checks the options that only the upload provider uses
+func (opts *Options) validateProvider() error {
 	if opts.Provider == "s3" {
 		return opts.validateS3()
 	}
 
+	if opts.Provider == "oci" {
+		return opts.validateOCI()
+	}
+
+	if opts.Provider == "gcs" {
+		return opts.validateGCS()
+	}
+
+	if opts.Provider == "azure" {
+		return opts.validateAzure()
+	}
+
+	if opts.Provider == "sftp" {
+		return opts.validateSFTP()
+	}
+
+	if opts.Provider == "file" && opts.fileRoot() == "" {
+		return fmt.Errorf("no destination root given (--file-root or --bucket)")
+	}
+
 	return nil
 }
 
 func (opts *Options) validateS3() error {
+	if opts.S3ForcePathStyle && opts.S3VirtualHost {
+		return fmt.Errorf("--s3-force-path-style and --s3-virtual-host cannot both be set")
+	}
+
+	if opts.S3Endpoint != "" {
+		u, err := url.Parse(opts.S3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --s3-endpoint %q (expected an http or https URL)", opts.S3Endpoint)
+		}
+	}
+
+	if _, err := opts.s3GrantHeaders(); err != nil {
+		return err
+	}
+
+	if opts.MultipartChunkSize < uint64(defaultMultipartPartSize) || opts.MultipartChunkSize > maxSinglePutSize {
+		return fmt.Errorf("--multipart-chunk-size must be between 5MiB and 5GiB, not %s", humanize.IBytes(opts.MultipartChunkSize))
+	}
+
 	if opts.BucketName == "" {
 		return fmt.Errorf("no bucket name given")
 	}
 
-	if opts.AccessKey == "" {
+	// with --instance-role, missing credentials are looked for once the
+	// upload starts
+	findsCredentials := opts.UseInstanceRole || opts.AssumeRoleARN != ""
+	if opts.AccessKey == "" && !findsCredentials {
 		return fmt.Errorf("no access key given")
 	}
 
-	if opts.SecretKey == "" {
+	if opts.SecretKey == "" && !findsCredentials {
 		return fmt.Errorf("no secret key given")
 	}
 
@@ -1,8 +1,12 @@
 package upload
 
 import (
+	"flag"
 	"os"
+	"reflect"
 	"testing"
+
+	"github.com/codegangsta/cli"
 )
 
 func TestOptionsValidate(t *testing.T) {
@@ -15,6 +19,28 @@ func TestOptionsValidate(t *testing.T) {
 	}
 }
 
+func TestOptionsValidateContentTypePrecedence(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	opts.ContentTypePrecedence = "sniff"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.ContentTypeByExtensionOnly = true
+	if opts.Validate() == nil {
+		t.Fatalf("--content-type-by-extension-only was accepted with sniff precedence")
+	}
+
+	opts.ContentTypeByExtensionOnly = false
+	opts.ContentTypePrecedence = "magic"
+	if opts.Validate() == nil {
+		t.Fatalf("unknown --content-type-precedence was accepted")
+	}
+}
+
 func TestOptionsValidateS3(t *testing.T) {
 	os.Clearenv()
 	opts := NewOptions()
@@ -54,3 +80,143 @@ func TestOptionsValidateS3(t *testing.T) {
 		t.Fatalf("valid s3 options were deemed invalid")
 	}
 }
+
+func getOptionsCLIContext(t *testing.T, args []string) *cli.Context {
+	set := flag.NewFlagSet("upload", flag.ContinueOnError)
+	for _, f := range DefaultOptions.Flags() {
+		f.Apply(set)
+	}
+
+	if err := set.Parse(args); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return cli.NewContext(cli.NewApp(), set, set)
+}
+
+func TestOptionsUpdateFromCLI(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{
+		"--concurrency", "3",
+		"--host-lock-max", "4",
+		"--max-size", "2MB",
+		"--explain",
+		"--bucket", "foo",
+		"some/path",
+	}))
+
+	if opts.Concurrency != 3 {
+		t.Fatalf("concurrency %v != 3", opts.Concurrency)
+	}
+
+	if opts.HostLockMax != 4 {
+		t.Fatalf("host lock max %v != 4", opts.HostLockMax)
+	}
+
+	if opts.MaxSize != 2000000 {
+		t.Fatalf("max size %v != 2000000", opts.MaxSize)
+	}
+
+	if !opts.Explain {
+		t.Fatalf("explain was not set")
+	}
+
+	if opts.BucketName != "foo" {
+		t.Fatalf("bucket name %v != foo", opts.BucketName)
+	}
+
+	if len(opts.Paths) != 1 || opts.Paths[0] != "some/path" {
+		t.Fatalf("paths %v != [some/path]", opts.Paths)
+	}
+}
+
+func TestOptionsUpdateFromCLIBoolFalse(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{"ARTIFACTS_EXPLAIN": "true", "ARTIFACTS_GZIP": "true"})
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{"--explain=false"}))
+
+	if opts.Explain {
+		t.Fatalf("explain was not turned off")
+	}
+
+	if !opts.Gzip {
+		t.Fatalf("gzip was turned off")
+	}
+}
+
+func TestOptionsUpdateFromCLIRepeatedExclude(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{
+		"--exclude", "node_modules/",
+		"--exclude", "*.tmp:.git/",
+		"some/path",
+	}))
+
+	expected := []string{"node_modules/", "*.tmp", ".git/"}
+	if !reflect.DeepEqual(opts.Excludes, expected) {
+		t.Fatalf("excludes %v != %v", opts.Excludes, expected)
+	}
+}
+
+func TestOptionsExcludesFromEnv(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{"ARTIFACTS_EXCLUDES": "node_modules/:coverage/tmp/"})
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	expected := []string{"node_modules/", "coverage/tmp/"}
+	if !reflect.DeepEqual(opts.Excludes, expected) {
+		t.Fatalf("excludes %v != %v", opts.Excludes, expected)
+	}
+}
+
+func TestOptionsContentTypes(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{
+		"--content-type", ".wasm=application/wasm",
+		"--content-type", "log=text/plain; charset=utf-8:.map=application/json",
+	}))
+
+	expected := map[string]string{
+		".wasm": "application/wasm",
+		"log":   "text/plain; charset=utf-8",
+		".map":  "application/json",
+	}
+	if !reflect.DeepEqual(opts.ContentTypes, expected) {
+		t.Fatalf("content types %v != %v", opts.ContentTypes, expected)
+	}
+
+	setenvs(map[string]string{"ARTIFACTS_CONTENT_TYPES": ".wasm=application/wasm:.LOG=text/plain"})
+	defer os.Clearenv()
+
+	opts = NewOptions()
+	expected = map[string]string{".wasm": "application/wasm", ".LOG": "text/plain"}
+	if !reflect.DeepEqual(opts.ContentTypes, expected) {
+		t.Fatalf("content types from env %v != %v", opts.ContentTypes, expected)
+	}
+
+	if !reflect.DeepEqual(contentTypesByExt(opts.ContentTypes), map[string]string{
+		".wasm": "application/wasm",
+		".log":  "text/plain",
+	}) {
+		t.Fatalf("extensions were not normalized: %v", contentTypesByExt(opts.ContentTypes))
+	}
+}
+
+func TestOptionsValidateContentTypes(t *testing.T) {
+	os.Clearenv()
+	for _, bad := range []string{"wasm", ".wasm=", "=application/wasm", ".wasm=not a type;;"} {
+		opts := NewOptions()
+		opts.Provider = "null"
+		opts.UpdateFromCLI(getOptionsCLIContext(t, []string{"--content-type", bad}))
+		if err := opts.Validate(); err == nil {
+			t.Fatalf("invalid --content-type %q was accepted", bad)
+		}
+	}
+}
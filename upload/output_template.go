@@ -0,0 +1,101 @@
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// outputTemplateFuncs are available to --output-template on top of the
+// text/template builtins
+var outputTemplateFuncs = template.FuncMap{
+	"humanize":  humanize.Bytes,
+	"urlencode": url.QueryEscape,
+	"pathescape": func(s string) string {
+		return (&url.URL{Path: s}).EscapedPath()
+	},
+}
+
+// outputTemplateResult is what --output-template is executed against
+type outputTemplateResult struct {
+	Provider  string
+	Bucket    string
+	Artifacts []*manifestEntry
+	Summary   *outputTemplateSummary
+}
+
+type outputTemplateSummary struct {
+	Total    int
+	Uploaded int
+	Failed   int
+	Bytes    uint64
+	Duration time.Duration
+}
+
+// parseOutputTemplate parses --output-template, which is either the
+// template itself or "@" and the name of a file holding it
+func parseOutputTemplate(text string) (*template.Template, error) {
+	if strings.HasPrefix(text, "@") {
+		body, err := ioutil.ReadFile(text[1:])
+		if err != nil {
+			return nil, fmt.Errorf("output template cannot be read: %v", err)
+		}
+		text = string(body)
+	}
+
+	tmpl, err := template.New("output").Funcs(outputTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --output-template: %v", err)
+	}
+	return tmpl, nil
+}
+
+func (u *uploader) outputTemplateResult(results []*artifact.Artifact) *outputTemplateResult {
+	// results arrive in the order uploads finish, so they are sorted to
+	// keep the output stable between runs
+	m := newManifest(u.Opts.WorkingDir, results)
+	sort.SliceStable(m.Artifacts, func(i, j int) bool {
+		return m.Artifacts[i].Key < m.Artifacts[j].Key
+	})
+
+	summary := &outputTemplateSummary{
+		Total:    len(m.Artifacts) + int(u.streamed.Uploaded),
+		Uploaded: int(u.streamed.Uploaded),
+		Bytes:    u.streamed.Bytes,
+		Duration: time.Since(u.startTime),
+	}
+
+	for _, entry := range m.Artifacts {
+		if entry.Status == "uploaded" {
+			summary.Uploaded++
+			summary.Bytes += entry.Size
+		} else {
+			summary.Failed++
+		}
+	}
+
+	return &outputTemplateResult{
+		Provider:  u.Opts.Provider,
+		Bucket:    u.Opts.BucketName,
+		Artifacts: m.Artifacts,
+		Summary:   summary,
+	}
+}
+
+// writeOutputTemplate executes --output-template against the results of
+// the run, writing to stdout
+func (u *uploader) writeOutputTemplate() error {
+	tmpl, err := parseOutputTemplate(u.Opts.OutputTemplate)
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(u.stdout, u.outputTemplateResult(u.results))
+}
@@ -0,0 +1,93 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testOutputTemplate = `{{.Provider}} {{.Bucket}}: {{.Summary.Uploaded}}/{{.Summary.Total}} uploaded, {{humanize .Summary.Bytes}}
+{{range .Artifacts}}{{.Status}} {{.Key}} {{.Size}} ?key={{urlencode .Key}}
+{{end}}`
+
+func TestUploaderOutputTemplate(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a b.txt":  "aaaa",
+		"fail.txt": "ff",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.BucketName = "my-bucket"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a b.txt", "fail.txt"}
+	opts.TargetPaths = []string{"out"}
+	opts.Concurrency = 1
+	opts.OutputTemplate = testOutputTemplate
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{FailSources: map[string]bool{
+		filepath.Join(dir, "fail.txt"): true,
+	}}
+	out := &bytes.Buffer{}
+	u.stdout = out
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "null my-bucket: 1/2 uploaded, 4B\n" +
+		"uploaded out/a b.txt 4 ?key=out%2Fa+b.txt\n" +
+		"failed out/fail.txt 2 ?key=out%2Ffail.txt\n"
+	if out.String() != expected {
+		t.Fatalf("output %q != %q", out.String(), expected)
+	}
+}
+
+func TestParseOutputTemplate(t *testing.T) {
+	if _, err := parseOutputTemplate("{{.Summary.Total"); err == nil {
+		t.Fatalf("invalid template was accepted")
+	}
+
+	if _, err := parseOutputTemplate("{{nope .Bucket}}"); err == nil {
+		t.Fatalf("template with an unknown func was accepted")
+	}
+
+	if _, err := parseOutputTemplate("@/nonexistent/template"); err == nil {
+		t.Fatalf("missing template file was accepted")
+	}
+
+	f, err := ioutil.TempFile("", "artifacts-output-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{{pathescape \"a b/c\"}}")
+	f.Close()
+
+	tmpl, err := parseOutputTemplate("@" + f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	tmpl.Execute(out, nil)
+	if out.String() != "a%20b/c" {
+		t.Fatalf("output %q != a%%20b/c", out.String())
+	}
+}
+
+func TestValidateOutputTemplate(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.OutputTemplate = "{{range}}"
+
+	if opts.Validate() == nil {
+		t.Fatalf("invalid --output-template was accepted")
+	}
+}
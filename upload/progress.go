@@ -0,0 +1,223 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	progressFDPrefix = "fd:"
+
+	// defaultProgressJSONInterval is how often --progress-json events are
+	// written unless --progress-interval is set
+	defaultProgressJSONInterval = time.Second
+)
+
+// progressEvent is one line of --progress-json output, a snapshot of the
+// whole upload rather than of any one artifact.  The totals only cover
+// the artifacts found so far until TotalsFinal is set.
+type progressEvent struct {
+	Time             time.Time `json:"time"`
+	TotalFiles       uint64    `json:"total_files"`
+	TotalBytes       uint64    `json:"total_bytes"`
+	TotalsFinal      bool      `json:"totals_final"`
+	CompletedFiles   uint64    `json:"completed_files"`
+	FailedFiles      uint64    `json:"failed_files"`
+	BytesTransferred uint64    `json:"bytes_transferred"`
+	BytesInFlight    uint64    `json:"bytes_in_flight"`
+	Rate             float64   `json:"bytes_per_second"`
+	ETA              float64   `json:"eta_seconds,omitempty"`
+	Done             bool      `json:"done"`
+}
+
+// progressTracker counts the artifacts heading to and coming back from
+// the workers, and every interval until stopped writes a progressEvent to
+// out and logs it to log, if they are set
+type progressTracker struct {
+	sync.Mutex
+	out      io.Writer
+	log      *logrus.Logger
+	interval time.Duration
+
+	event     progressEvent
+	sent      *sentBytes
+	startTime time.Time
+	lastBytes uint64
+	lastTime  time.Time
+
+	stop    chan bool
+	stopped chan bool
+}
+
+func newProgressTracker(out io.Writer, log *logrus.Logger, interval time.Duration) *progressTracker {
+	now := time.Now()
+	return &progressTracker{
+		out:       out,
+		log:       log,
+		interval:  interval,
+		startTime: now,
+		lastTime:  now,
+		stop:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+}
+
+// openProgressOutput opens the --progress-json destination, which is
+// either a file descriptor given as "fd:N" or a file to create
+func openProgressOutput(dest string) (io.WriteCloser, error) {
+	if !strings.HasPrefix(dest, progressFDPrefix) {
+		return os.Create(dest)
+	}
+
+	fd, err := strconv.ParseUint(strings.TrimPrefix(dest, progressFDPrefix), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid progress file descriptor %q", dest)
+	}
+
+	return os.NewFile(uintptr(fd), dest), nil
+}
+
+// Start writes events every interval in the background
+func (pt *progressTracker) Start() {
+	go func() {
+		ticker := time.NewTicker(pt.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pt.emit(false)
+			case <-pt.stop:
+				pt.emit(true)
+				pt.stopped <- true
+				return
+			}
+		}
+	}()
+}
+
+// Stop writes the final event, once the workers are done
+func (pt *progressTracker) Stop() {
+	pt.stop <- true
+	<-pt.stopped
+}
+
+// Filter counts the artifacts on their way to the workers
+func (pt *progressTracker) Filter(in chan *artifact.Artifact) chan *artifact.Artifact {
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			size, _ := a.Size()
+
+			pt.Lock()
+			pt.event.TotalFiles++
+			pt.event.TotalBytes += size
+			pt.Unlock()
+
+			out <- a
+		}
+
+		pt.Lock()
+		pt.event.TotalsFinal = true
+		pt.Unlock()
+
+		close(out)
+	}()
+
+	return out
+}
+
+// Completed counts an artifact the workers are done with
+func (pt *progressTracker) Completed(a *artifact.Artifact) {
+	size, _ := a.Size()
+
+	pt.Lock()
+	defer pt.Unlock()
+
+	if !a.UploadResult.OK {
+		pt.event.FailedFiles++
+		return
+	}
+
+	pt.event.CompletedFiles++
+	pt.event.BytesTransferred += size
+}
+
+// snapshot is the upload so far, with the bytes of the uploads in flight,
+// and how long it has been going
+func (pt *progressTracker) snapshot() (progressEvent, time.Duration) {
+	pt.Lock()
+	defer pt.Unlock()
+
+	event := pt.event
+	event.BytesInFlight = pt.sent.InFlight()
+	return event, time.Since(pt.startTime)
+}
+
+func (pt *progressTracker) emit(done bool) {
+	pt.Lock()
+	defer pt.Unlock()
+
+	now := time.Now()
+	event := pt.event
+	event.Time = now.UTC()
+	event.Done = done
+	if !done {
+		event.BytesInFlight = pt.sent.InFlight()
+	}
+
+	if elapsed := now.Sub(pt.lastTime).Seconds(); elapsed > 0 {
+		event.Rate = float64(event.BytesTransferred-pt.lastBytes) / elapsed
+	}
+	pt.lastBytes = event.BytesTransferred
+	pt.lastTime = now
+
+	// the eta is over the average rate of the whole upload, which is
+	// steadier than the rate since the last event
+	if elapsed := now.Sub(pt.startTime).Seconds(); !done && event.TotalsFinal && elapsed > 0 && event.BytesTransferred > 0 {
+		average := float64(event.BytesTransferred) / elapsed
+		event.ETA = float64(event.TotalBytes-event.BytesTransferred) / average
+	}
+
+	if pt.out != nil {
+		// errors are ignored so that a reader going away doesn't stop the
+		// upload
+		line, _ := json.Marshal(event)
+		pt.out.Write(append(line, '\n'))
+	}
+
+	// the summary of the upload says how it ended, so only the events
+	// along the way are logged
+	if pt.log != nil && !done {
+		pt.log.WithFields(event.logFields()).Info("upload progress")
+	}
+}
+
+// logFields are the fields of the progress log event, with the counts
+// as done out of total and percentages of the totals so far
+func (event *progressEvent) logFields() logrus.Fields {
+	fields := logrus.Fields{
+		"files":        fmt.Sprintf("%d/%d", event.CompletedFiles, event.TotalFiles),
+		"failed":       event.FailedFiles,
+		"bytes":        fmt.Sprintf("%s/%s", humanize.Bytes(event.BytesTransferred), humanize.Bytes(event.TotalBytes)),
+		"percent":      pctMax(event.BytesTransferred, event.TotalBytes),
+		"rate":         humanize.Bytes(uint64(event.Rate)) + "/s",
+		"totals_final": event.TotalsFinal,
+	}
+
+	if event.ETA > 0 {
+		fields["eta"] = (time.Duration(event.ETA) * time.Second).String()
+	}
+
+	return fields
+}
@@ -0,0 +1,222 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// progressBarInterval is how often the --progress bar is redrawn
+	progressBarInterval = 250 * time.Millisecond
+
+	// defaultProgressLogInterval is how often --progress logs where there
+	// is no terminal to draw on, unless --progress-interval is set
+	defaultProgressLogInterval = 10 * time.Second
+
+	progressBarWidth = 30
+)
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// sentBytes counts the bytes read into request bodies that haven't been
+// closed yet, which is how far along the uploads in flight are
+type sentBytes struct {
+	inFlight int64
+}
+
+func (sb *sentBytes) InFlight() uint64 {
+	if sb == nil {
+		return 0
+	}
+
+	if n := atomic.LoadInt64(&sb.inFlight); n > 0 {
+		return uint64(n)
+	}
+	return 0
+}
+
+// countSent wraps the transport to count the bytes of request bodies in
+// flight, when progress is being reported
+func countSent(opts *Options, transport http.RoundTripper) http.RoundTripper {
+	if !opts.Progress && opts.ProgressJSON == "" && opts.ProgressInterval == 0 {
+		return transport
+	}
+
+	opts.sent = &sentBytes{}
+	return &sentTransport{transport: transport, sent: opts.sent}
+}
+
+type sentTransport struct {
+	transport http.RoundTripper
+	sent      *sentBytes
+}
+
+func (st *sentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return st.transport.RoundTrip(req)
+	}
+
+	body := &sentBody{ReadCloser: req.Body, sent: st.sent}
+	counted := req.Clone(req.Context())
+	counted.Body = body
+
+	resp, err := st.transport.RoundTrip(counted)
+	body.Done()
+	return resp, err
+}
+
+// sentBody adds what is read from it to the bytes in flight, and takes it
+// back off once the response is in, by which time the artifact is about
+// to be counted as done or the request is to be retried
+type sentBody struct {
+	io.ReadCloser
+	sent *sentBytes
+
+	sync.Mutex
+	read int64
+	done bool
+}
+
+func (sb *sentBody) Read(p []byte) (int, error) {
+	n, err := sb.ReadCloser.Read(p)
+	if n > 0 {
+		sb.Lock()
+		if !sb.done {
+			sb.read += int64(n)
+			atomic.AddInt64(&sb.sent.inFlight, int64(n))
+		}
+		sb.Unlock()
+	}
+	return n, err
+}
+
+// Done takes what was read back off the bytes in flight
+func (sb *sentBody) Done() {
+	sb.Lock()
+	defer sb.Unlock()
+
+	if !sb.done {
+		atomic.AddInt64(&sb.sent.inFlight, -sb.read)
+		sb.done = true
+	}
+}
+
+// progressBar redraws a line on the terminal with how far along the
+// upload is, counting the uploads in flight as far as they've got
+type progressBar struct {
+	pt  *progressTracker
+	out io.Writer
+
+	// shown is the most bytes drawn so far, so that the bar doesn't go
+	// back when a part of a multipart upload is done before the rest
+	shown uint64
+
+	stop    chan bool
+	stopped chan bool
+}
+
+func newProgressBar(pt *progressTracker, out io.Writer) *progressBar {
+	return &progressBar{
+		pt:      pt,
+		out:     out,
+		stop:    make(chan bool),
+		stopped: make(chan bool),
+	}
+}
+
+// Start redraws the bar every progressBarInterval in the background
+func (pb *progressBar) Start() {
+	go func() {
+		ticker := time.NewTicker(progressBarInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pb.draw(false)
+			case <-pb.stop:
+				pb.draw(true)
+				pb.stopped <- true
+				return
+			}
+		}
+	}()
+}
+
+// Stop draws the bar a last time and moves past it
+func (pb *progressBar) Stop() {
+	pb.stop <- true
+	<-pb.stopped
+}
+
+func (pb *progressBar) draw(done bool) {
+	event, elapsed := pb.pt.snapshot()
+
+	bytes := event.BytesTransferred + event.BytesInFlight
+	if event.TotalBytes > 0 && bytes > event.TotalBytes {
+		bytes = event.TotalBytes
+	}
+	if bytes < pb.shown {
+		bytes = pb.shown
+	}
+	pb.shown = bytes
+
+	end := "\r"
+	if done {
+		end = "\n"
+	}
+	fmt.Fprint(pb.out, "\r"+progressBarLine(event, bytes, elapsed)+"\x1b[K"+end)
+}
+
+// progressBarLine is the bar with the files and bytes done, the average
+// rate, and once every file has been found, the time left
+func progressBarLine(event progressEvent, bytes uint64, elapsed time.Duration) string {
+	filled, percent := 0, uint64(0)
+	if event.TotalBytes > 0 {
+		filled = int(bytes * progressBarWidth / event.TotalBytes)
+		percent = bytes * 100 / event.TotalBytes
+	} else if event.TotalsFinal && event.CompletedFiles+event.FailedFiles == event.TotalFiles {
+		// nothing but empty files
+		filled, percent = progressBarWidth, 100
+	}
+
+	// the totals are of what's been found so far until they are final
+	more := "+"
+	if event.TotalsFinal {
+		more = ""
+	}
+	total := humanize.Bytes(event.TotalBytes) + more
+	files := fmt.Sprintf("%d/%d%s files", event.CompletedFiles+event.FailedFiles, event.TotalFiles, more)
+
+	line := fmt.Sprintf("[%s%s] %3d%% %s %s/%s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		percent, files, humanize.Bytes(bytes), total)
+
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		rate := float64(bytes) / seconds
+		line += fmt.Sprintf(" %s/s", humanize.Bytes(uint64(rate)))
+
+		if event.TotalsFinal && rate > 0 && bytes < event.TotalBytes {
+			eta := time.Duration(float64(event.TotalBytes-bytes)/rate) * time.Second
+			line += " ETA " + eta.String()
+		}
+	}
+
+	if event.FailedFiles > 0 {
+		line += fmt.Sprintf(" (%d failed)", event.FailedFiles)
+	}
+
+	return line
+}
@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressBarLine(t *testing.T) {
+	event := progressEvent{
+		TotalFiles:       4,
+		TotalBytes:       4000,
+		TotalsFinal:      true,
+		CompletedFiles:   1,
+		BytesTransferred: 1000,
+	}
+
+	line := progressBarLine(event, 1000, 2*time.Second)
+	expected := "[=======                       ]  25% 1/4 files 1.0KB/4.0KB 500B/s ETA 6s"
+	if line != expected {
+		t.Fatalf("progress bar %q != %q", line, expected)
+	}
+
+	event.TotalsFinal = false
+	event.FailedFiles = 1
+	line = progressBarLine(event, 1000, 2*time.Second)
+	if !strings.Contains(line, "2/4+ files") || !strings.Contains(line, "4.0KB+") ||
+		strings.Contains(line, "ETA") || !strings.HasSuffix(line, "(1 failed)") {
+		t.Fatalf("unexpected progress bar %q before the totals are final", line)
+	}
+}
+
+func TestUploaderProgressBar(t *testing.T) {
+	dir := writeProgressFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		progressOpts(dir, "")(opts)
+		opts.ProgressInterval = 0
+		opts.Progress = true
+	})
+	u.Provider = newPacedProvider(dir)
+	out := &bytes.Buffer{}
+	u.stderr = out
+	u.terminal = true
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	drawn := out.String()
+	if !strings.HasSuffix(drawn, "\n") {
+		t.Fatalf("progress bar %q was not finished with a newline", drawn)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(drawn, "\n"), "\r")
+	last := lines[len(lines)-1]
+	if !strings.HasPrefix(last, "["+strings.Repeat("=", 22)) || !strings.Contains(last, "4/4 files") ||
+		!strings.Contains(last, "(1 failed)") {
+		t.Fatalf("unexpected final progress bar %q", last)
+	}
+}
+
+func TestUploaderProgressWithoutTerminal(t *testing.T) {
+	dir := writeProgressFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		progressOpts(dir, "")(opts)
+		opts.ProgressInterval = 0
+		opts.Progress = true
+	})
+	u.Provider = newPacedProvider(dir)
+	out := &bytes.Buffer{}
+	u.stderr = out
+	u.terminal = false
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if out.Len() != 0 || u.progressBar != nil {
+		t.Fatalf("progress bar %q drawn without a terminal", out.String())
+	}
+
+	if u.progress == nil || u.progress.log == nil || u.progress.interval != defaultProgressLogInterval {
+		t.Fatalf("progress not logged every %v without a terminal", defaultProgressLogInterval)
+	}
+}
+
+func TestSentBytes(t *testing.T) {
+	inFlight := make(chan uint64, 1)
+	opts := NewOptions()
+	opts.Progress = true
+
+	var transport http.RoundTripper
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		inFlight <- opts.sent.InFlight()
+	}))
+	defer srv.Close()
+
+	transport = countSent(opts, http.DefaultTransport)
+	resp, err := (&http.Client{Transport: transport}).Post(srv.URL, "text/plain", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if n := <-inFlight; n != 10 {
+		t.Fatalf("bytes in flight %v != 10 during the request", n)
+	}
+
+	if n := opts.sent.InFlight(); n != 0 {
+		t.Fatalf("bytes in flight %v != 0 after the request", n)
+	}
+}
@@ -0,0 +1,291 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// pacedProvider records its uploads, each after the same delay
+type pacedProvider struct {
+	recordingProvider
+	Delay time.Duration
+}
+
+func (pp *pacedProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	pacedIn := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			time.Sleep(pp.Delay)
+			pacedIn <- a
+		}
+		close(pacedIn)
+	}()
+
+	pp.recordingProvider.Upload(ctx, id, opts, pacedIn, out, done)
+}
+
+func readProgressEvents(t *testing.T, filename string) []*progressEvent {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	events := []*progressEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := &progressEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			t.Fatalf("malformed progress event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func progressOpts(dir, dest string) func(*Options) {
+	return func(opts *Options) {
+		opts.WorkingDir = dir
+		opts.Paths = []string{"a.txt", "b.txt", "c.txt", "fail.txt"}
+		opts.TargetPaths = []string{"progress"}
+		opts.Concurrency = 2
+		opts.ProgressJSON = dest
+		opts.ProgressInterval = 5 * time.Millisecond
+	}
+}
+
+func newPacedProvider(dir string) *pacedProvider {
+	return &pacedProvider{
+		recordingProvider: recordingProvider{FailSources: map[string]bool{
+			filepath.Join(dir, "fail.txt"): true,
+		}},
+		Delay: 20 * time.Millisecond,
+	}
+}
+
+func writeProgressFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"a.txt":    "aaaa",
+		"b.txt":    "bbbbbb",
+		"c.txt":    "cc",
+		"fail.txt": "nope",
+	})
+}
+
+func TestUploaderProgressJSON(t *testing.T) {
+	dir := writeProgressFiles(t)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "progress.json")
+	u := getTestUploader(nil, progressOpts(dir, dest))
+	u.Provider = newPacedProvider(dir)
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	events := readProgressEvents(t, dest)
+	if len(events) < 3 {
+		t.Fatalf("progress events %v < 3", len(events))
+	}
+
+	var last *progressEvent
+	for i, event := range events {
+		if event.Done != (i == len(events)-1) {
+			t.Fatalf("event %v done %v", i, event.Done)
+		}
+
+		if last != nil {
+			if event.Time.Before(last.Time) {
+				t.Fatalf("event %v went back in time", i)
+			}
+
+			if event.CompletedFiles < last.CompletedFiles || event.BytesTransferred < last.BytesTransferred {
+				t.Fatalf("event %v went backwards: %#v after %#v", i, event, last)
+			}
+		}
+
+		if event.Rate < 0 {
+			t.Fatalf("event %v rate %v < 0", i, event.Rate)
+		}
+
+		last = event
+	}
+
+	expected := progressEvent{
+		TotalFiles:       4,
+		TotalBytes:       16,
+		TotalsFinal:      true,
+		CompletedFiles:   3,
+		FailedFiles:      1,
+		BytesTransferred: 12,
+		Done:             true,
+	}
+	last.Time = time.Time{}
+	last.Rate = 0
+	if *last != expected {
+		t.Fatalf("final event %#v != %#v", last, expected)
+	}
+
+	if events[0].Done || events[0].CompletedFiles+events[0].FailedFiles == 4 {
+		t.Fatalf("first event was not written mid-upload: %#v", events[0])
+	}
+}
+
+func TestUploaderProgressJSONFD(t *testing.T) {
+	dir := writeProgressFiles(t)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "progress.json")
+	f, err := os.Create(dest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	u := getTestUploader(nil, progressOpts(dir, "fd:"+fdString(f)))
+	u.Provider = newPacedProvider(dir)
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	events := readProgressEvents(t, dest)
+	if len(events) == 0 || !events[len(events)-1].Done {
+		t.Fatalf("no final progress event written to the fd: %#v", events)
+	}
+}
+
+func TestUploaderProgressLog(t *testing.T) {
+	dir := writeProgressFiles(t)
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	log.Level = logrus.InfoLevel
+	u := getTestUploader(log, progressOpts(dir, ""))
+	u.Provider = newPacedProvider(dir)
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "upload progress") {
+		t.Fatalf("no progress logged: %q", buf.String())
+	}
+
+	for _, field := range []string{"files=", "bytes=", "percent=", "rate=", "totals_final="} {
+		if !strings.Contains(buf.String(), field) {
+			t.Fatalf("progress log is missing %s: %q", field, buf.String())
+		}
+	}
+}
+
+func TestUploaderProgressLogDisabled(t *testing.T) {
+	dir := writeProgressFiles(t)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "progress.json")
+	log, buf := getBufferLogger()
+	log.Level = logrus.InfoLevel
+	u := getTestUploader(log, func(opts *Options) {
+		progressOpts(dir, dest)(opts)
+		opts.ProgressInterval = 0
+	})
+	u.Provider = newPacedProvider(dir)
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "upload progress") {
+		t.Fatalf("progress logged with --progress-interval 0: %q", buf.String())
+	}
+
+	events := readProgressEvents(t, dest)
+	if len(events) == 0 || !events[len(events)-1].Done {
+		t.Fatalf("no final progress event written: %#v", events)
+	}
+}
+
+func TestProgressEventETA(t *testing.T) {
+	out := &bytes.Buffer{}
+	pt := newProgressTracker(out, nil, time.Second)
+	pt.startTime = time.Now().Add(-2 * time.Second)
+	pt.event = progressEvent{TotalFiles: 3, TotalBytes: 300, TotalsFinal: true, CompletedFiles: 1, BytesTransferred: 100}
+	pt.emit(false)
+
+	event := &progressEvent{}
+	if err := json.Unmarshal(out.Bytes(), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 100 bytes in 2s leaves 4s for the other 200
+	if event.ETA < 4 || event.ETA > 4.5 {
+		t.Fatalf("eta %v is not about 4s", event.ETA)
+	}
+
+	fields := event.logFields()
+	if fields["files"] != "1/3" || fields["eta"] != "4s" {
+		t.Fatalf("unexpected log fields %#v", fields)
+	}
+}
+
+func TestOpenProgressOutputInvalidFD(t *testing.T) {
+	_, err := openProgressOutput("fd:three")
+	if err == nil {
+		t.Fatalf("invalid fd was accepted")
+	}
+
+	if err.Error() != `invalid progress file descriptor "fd:three"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProgressTrackerConcurrentCompletions(t *testing.T) {
+	f, err := os.Create(filepath.Join(os.TempDir(), "artifacts-progress-test.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	pt := newProgressTracker(f, nil, time.Millisecond)
+	pt.Start()
+
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 50; j++ {
+				a := artifact.NewFromBytes("", "x", []byte("xx"), &artifact.Options{})
+				a.UploadResult.OK = true
+				pt.Completed(a)
+			}
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	pt.Stop()
+
+	events := readProgressEvents(t, f.Name())
+	last := events[len(events)-1]
+	if last.CompletedFiles != 400 || last.BytesTransferred != 800 {
+		t.Fatalf("final event %#v != 400 files and 800 bytes", last)
+	}
+}
+
+func fdString(f *os.File) string {
+	return strconv.FormatUint(uint64(f.Fd()), 10)
+}
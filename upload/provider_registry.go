@@ -0,0 +1,74 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ProviderFactory makes the provider for an upload whose --upload-provider
+// is the name the factory was registered under
+type ProviderFactory func(opts *Options, log *logrus.Logger) Provider
+
+var (
+	providersLock     sync.RWMutex
+	providerFactories = map[string]ProviderFactory{}
+)
+
+func init() {
+	for name, factory := range map[string]ProviderFactory{
+		"artifacts": func(opts *Options, log *logrus.Logger) Provider { return newArtifactsProvider(opts, log) },
+		"s3":        func(opts *Options, log *logrus.Logger) Provider { return newS3Provider(opts, log) },
+		"null":      func(opts *Options, log *logrus.Logger) Provider { return newNullProvider(nil, log) },
+		"oci":       func(opts *Options, log *logrus.Logger) Provider { return newOCIProvider(opts, log) },
+		"gcs":       func(opts *Options, log *logrus.Logger) Provider { return newGCSProvider(opts, log) },
+		"azure":     func(opts *Options, log *logrus.Logger) Provider { return newAzureProvider(opts, log) },
+		"sftp":      func(opts *Options, log *logrus.Logger) Provider { return newSFTPProvider(opts, log) },
+		"file":      func(opts *Options, log *logrus.Logger) Provider { return newFileProvider(opts, log) },
+	} {
+		RegisterProvider(name, factory)
+	}
+}
+
+// RegisterProvider makes a provider available under a name, both to
+// --upload-provider and to routes, so that programs embedding the upload
+// package can add backends of their own.  Like database/sql.Register, it
+// panics if the name is empty or already taken, including by the
+// providers that come with the package.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	if name == "" || factory == nil {
+		panic("upload: RegisterProvider needs a name and a factory")
+	}
+
+	if _, ok := providerFactories[name]; ok {
+		panic(fmt.Sprintf("upload: RegisterProvider called twice for provider %q", name))
+	}
+
+	providerFactories[name] = factory
+}
+
+// ProviderNames are the names the providers are registered under, sorted
+func ProviderNames() []string {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+
+	names := []string{}
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupProvider(name string) (ProviderFactory, bool) {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+
+	factory, ok := providerFactories[name]
+	return factory, ok
+}
@@ -0,0 +1,60 @@
+package upload
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestRegisterProvider(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{"out/a.txt": "a"})
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	RegisterProvider("registry-test", func(opts *Options, log *logrus.Logger) Provider {
+		return rp
+	})
+	defer func() {
+		providersLock.Lock()
+		delete(providerFactories, "registry-test")
+		providersLock.Unlock()
+	}()
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "registry-test"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"builds/1"}
+	})
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(rp.FullDests(), []string{"builds/1/out/a.txt"}) {
+		t.Fatalf("uploaded %v != [builds/1/out/a.txt]", rp.FullDests())
+	}
+
+	if _, err := parseRoute("*.log provider=registry-test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := strings.Join(ProviderNames(), " ")
+	if !strings.Contains(names, "registry-test") || !strings.Contains(names, "s3") {
+		t.Fatalf("provider names %q", names)
+	}
+
+	for _, name := range []string{"registry-test", "s3", ""} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("registering %q did not panic", name)
+				}
+			}()
+			RegisterProvider(name, func(opts *Options, log *logrus.Logger) Provider { return rp })
+		}()
+	}
+}
@@ -0,0 +1,225 @@
+package upload
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// PruneOptions are the retention rules for Prune.  Each build's objects
+// are expected under a prefix of their own below the target paths (such
+// as builds/123/), and are pruned together.
+type PruneOptions struct {
+	// Prefix is pruned under instead of the target paths
+	Prefix string
+	// OlderThan prunes the builds whose newest object is older than this
+	OlderThan time.Duration
+	// KeepLast keeps this many of the newest builds, however old
+	KeepLast int
+}
+
+// PruneResult counts what Prune did, or with --dry-run, what it would
+// have done
+type PruneResult struct {
+	Pruned  int
+	Kept    int
+	Deleted int
+	Bytes   uint64
+	DryRun  bool
+}
+
+// pruneGroup is a build's objects, under the same prefix one level below
+// the one being pruned (or an object directly under it by itself)
+type pruneGroup struct {
+	Name    string
+	Keys    []string
+	Bytes   uint64
+	Newest  time.Time
+	Unknown bool
+}
+
+// NewPruneOptions parses the --older-than age, such as "30d", and checks
+// that there is a rule to prune by
+func NewPruneOptions(prefix, olderThan string, keepLast int) (*PruneOptions, error) {
+	po := &PruneOptions{Prefix: prefix, KeepLast: keepLast}
+
+	if olderThan != "" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --older-than %q: %v", olderThan, err)
+		}
+		po.OlderThan = age
+	}
+
+	if keepLast < 0 {
+		return nil, fmt.Errorf("invalid --keep-last %d", keepLast)
+	}
+
+	if po.OlderThan == 0 && po.KeepLast == 0 {
+		return nil, fmt.Errorf("prune needs --older-than, --keep-last, or both")
+	}
+
+	return po, nil
+}
+
+// Prune deletes the builds under the target paths (or --prefix) that the
+// retention rules don't keep.  With both rules, only builds that are past
+// the newest --keep-last and older than --older-than are deleted.  With
+// --dry-run, what would be deleted is only logged.
+func Prune(opts *Options, pruneOpts *PruneOptions, log *logrus.Logger) (*PruneResult, error) {
+	return newUploader(opts, log).prune(pruneOpts, time.Now())
+}
+
+func (u *uploader) prune(pruneOpts *PruneOptions, now time.Time) (*PruneResult, error) {
+	result := &PruneResult{DryRun: u.Opts.DryRun}
+
+	lp, canList := u.Provider.(ObjectLister)
+	dp, canDelete := u.Provider.(ObjectDeleter)
+	if !canList || !canDelete {
+		return result, fmt.Errorf("prune is not supported by the %s provider", u.Provider.Name())
+	}
+
+	for _, prefix := range u.listPrefixes(pruneOpts.Prefix) {
+		objects, _, err := lp.ListRemote(prefix, true)
+		if err != nil {
+			return result, err
+		}
+
+		for i, group := range pruneGroups(prefix, objects) {
+			if !pruneOpts.prunes(i, group, now) {
+				result.Kept++
+				continue
+			}
+
+			log := u.log.WithFields(logrus.Fields{
+				"prefix":  group.Name,
+				"objects": len(group.Keys),
+				"newest":  group.Newest.Format(time.RFC3339),
+			})
+			if u.Opts.DryRun {
+				log.Info("would prune (dry run)")
+			} else {
+				log.Info("pruning")
+			}
+
+			for _, key := range group.Keys {
+				if !u.Opts.DryRun {
+					if err := dp.DeleteRemote(key); err != nil {
+						return result, err
+					}
+				}
+				result.Deleted++
+			}
+
+			result.Pruned++
+			result.Bytes += group.Bytes
+		}
+	}
+
+	return result, nil
+}
+
+// prunes reports whether the group, which is the nth newest, is deleted.
+// A group with a last modified time that can't be parsed is never too
+// old.
+func (po *PruneOptions) prunes(n int, group *pruneGroup, now time.Time) bool {
+	if po.KeepLast > 0 && n < po.KeepLast {
+		return false
+	}
+
+	if po.OlderThan == 0 {
+		return true
+	}
+
+	return !group.Unknown && now.Sub(group.Newest) > po.OlderThan
+}
+
+// pruneGroups groups the objects by the prefix they're under one level
+// below the given one, newest first
+func pruneGroups(prefix string, objects []*RemoteObject) []*pruneGroup {
+	byName := map[string]*pruneGroup{}
+	for _, obj := range objects {
+		name := obj.Key
+		if i := strings.Index(obj.Key[len(prefix):], "/"); i >= 0 {
+			name = obj.Key[:len(prefix)+i+1]
+		}
+
+		group, ok := byName[name]
+		if !ok {
+			group = &pruneGroup{Name: name}
+			byName[name] = group
+		}
+
+		group.Keys = append(group.Keys, obj.Key)
+		group.Bytes += uint64(obj.Size)
+
+		modified, err := time.Parse(time.RFC3339, obj.LastModified)
+		if err != nil {
+			group.Unknown = true
+		} else if modified.After(group.Newest) {
+			group.Newest = modified
+		}
+	}
+
+	groups := []*pruneGroup{}
+	for _, group := range byName {
+		sort.Strings(group.Keys)
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Unknown != groups[j].Unknown {
+			return groups[i].Unknown
+		}
+		if !groups[i].Newest.Equal(groups[j].Newest) {
+			return groups[i].Newest.After(groups[j].Newest)
+		}
+		return groups[i].Name > groups[j].Name
+	})
+
+	return groups
+}
+
+func (s3p *s3Provider) DeleteRemote(key string) error {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return err
+	}
+
+	return bucket.Del(key)
+}
+
+func (gp *gcsProvider) DeleteRemote(key string) error {
+	token, err := gp.accessToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/storage/v1/b/%s/o/%s",
+		strings.TrimRight(gp.opts.GCSEndpoint, "/"), url.PathEscape(gp.opts.BucketName), url.PathEscape(key)), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := gp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return categorize(FailureCredentials, fmt.Errorf("gcs delete of %s failed: %s", key, resp.Status))
+	}
+	return fmt.Errorf("gcs delete of %s failed: %s", key, resp.Status)
+}
@@ -0,0 +1,186 @@
+package upload
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestNewPruneOptions(t *testing.T) {
+	po, err := NewPruneOptions("", "30d", 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if po.OlderThan != 30*24*time.Hour || po.KeepLast != 5 {
+		t.Fatalf("unexpected options %#v", po)
+	}
+
+	for _, c := range []struct {
+		OlderThan string
+		KeepLast  int
+		Err       string
+	}{
+		{"", 0, "prune needs --older-than, --keep-last, or both"},
+		{"a while", 0, `invalid --older-than "a while": `},
+		{"", -1, "invalid --keep-last -1"},
+	} {
+		_, err := NewPruneOptions("", c.OlderThan, c.KeepLast)
+		if err == nil || !strings.HasPrefix(err.Error(), c.Err) {
+			t.Fatalf("unexpected error for %#v: %v", c, err)
+		}
+	}
+}
+
+func TestPruneGroups(t *testing.T) {
+	groups := pruneGroups("builds/", []*RemoteObject{
+		{Key: "builds/1/app.tar.gz", Size: 100, LastModified: "2014-09-01T12:00:00.000Z"},
+		{Key: "builds/1/logs/test.log", Size: 10, LastModified: "2014-09-02T12:00:00.000Z"},
+		{Key: "builds/2/app.tar.gz", Size: 200, LastModified: "2014-10-01T12:00:00.000Z"},
+		{Key: "builds/3/app.tar.gz", Size: 300, LastModified: "2014-10-14T12:00:00.000Z"},
+		{Key: "builds/latest.txt", Size: 1, LastModified: "2014-10-13T12:00:00.000Z"},
+		{Key: "builds/odd/app.tar.gz", Size: 5, LastModified: "yesterday"},
+	})
+
+	names := []string{}
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+
+	if strings.Join(names, " ") != "builds/odd/ builds/3/ builds/latest.txt builds/2/ builds/1/" {
+		t.Fatalf("unexpected groups %v", names)
+	}
+
+	if groups[4].Bytes != 110 || len(groups[4].Keys) != 2 ||
+		!groups[4].Newest.Equal(time.Date(2014, 9, 2, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected group %#v", groups[4])
+	}
+
+	now := time.Date(2014, 10, 14, 13, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		Opts   PruneOptions
+		Pruned string
+	}{
+		{PruneOptions{KeepLast: 3}, "builds/2/ builds/1/"},
+		{PruneOptions{OlderThan: 7 * 24 * time.Hour}, "builds/2/ builds/1/"},
+		{PruneOptions{OlderThan: 24 * time.Hour}, "builds/latest.txt builds/2/ builds/1/"},
+		{PruneOptions{KeepLast: 4, OlderThan: 36 * time.Hour}, "builds/1/"},
+	} {
+		pruned := []string{}
+		for i, group := range groups {
+			if c.Opts.prunes(i, group, now) {
+				pruned = append(pruned, group.Name)
+			}
+		}
+
+		if strings.Join(pruned, " ") != c.Pruned {
+			t.Fatalf("pruned %v with %#v, expected %s", pruned, c.Opts, c.Pruned)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	os.Clearenv()
+	b := testS3.Bucket("bucket")
+	for _, key := range []string{
+		"prune-test/1/app.tar.gz",
+		"prune-test/1/logs/test.log",
+		"prune-test/2/app.tar.gz",
+		"prune-test/3/app.tar.gz",
+		"prune-other/1/app.tar.gz",
+	} {
+		if err := b.Put(key, []byte("content"), "text/plain", s3.Private); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.TargetPaths = []string{"prune-test"}
+		opts.DryRun = true
+	})
+
+	later := time.Now().Add(48 * time.Hour)
+	result, err := u.prune(&PruneOptions{KeepLast: 1, OlderThan: 24 * time.Hour}, later)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !result.DryRun || result.Pruned != 2 || result.Kept != 1 || result.Deleted != 3 || result.Bytes != 21 {
+		t.Fatalf("unexpected dry run result %#v", result)
+	}
+
+	if keys := pruneTestKeys(t, b); len(keys) != 5 {
+		t.Fatalf("dry run deleted objects: %v", keys)
+	}
+
+	u.Opts.DryRun = false
+	if _, err := u.prune(&PruneOptions{KeepLast: 1, OlderThan: 24 * time.Hour}, later); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := pruneTestKeys(t, b)
+	if strings.Join(keys, " ") != "prune-other/1/app.tar.gz prune-test/3/app.tar.gz" {
+		t.Fatalf("unexpected remaining objects %v", keys)
+	}
+
+	result, _ = u.prune(&PruneOptions{OlderThan: 24 * time.Hour}, time.Now())
+	if result.Pruned != 0 || result.Kept != 1 {
+		t.Fatalf("pruned new builds: %#v", result)
+	}
+}
+
+func pruneTestKeys(t *testing.T, b *s3.Bucket) []string {
+	resp, err := b.List("prune-", "", "", 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := []string{}
+	for _, key := range resp.Contents {
+		keys = append(keys, key.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPruneGCS(t *testing.T) {
+	fg := newFakeGCS()
+	defer fg.srv.Close()
+
+	dir := writeTestFiles(t, map[string]string{
+		"1/build.log": "old",
+		"2/build.log": "new",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, gcsTestOpts(fg, dir, "", "1", "2"))
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := u.prune(&PruneOptions{KeepLast: 1}, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Pruned != 1 || len(fg.objects) != 1 || fg.objects["gcs/2/build.log"] == nil {
+		t.Fatalf("unexpected result %#v, with objects %v", result, fg.objects)
+	}
+}
+
+func TestPruneRequiresDeletion(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	_, err := newUploader(opts, getPanicLogger()).prune(&PruneOptions{KeepLast: 1}, time.Now())
+	if err == nil || err.Error() != "prune is not supported by the null provider" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// redirectRule makes the object at Key, relative to each target path,
+// redirect to Location when served by S3 website hosting
+type redirectRule struct {
+	Key      string
+	Location string
+
+	matched bool
+}
+
+// parseRedirectLocations parses comma-separated key=location pairs.  S3
+// only accepts locations that are absolute paths or http(s) urls.
+func parseRedirectLocations(spec string) ([]*redirectRule, error) {
+	rules := []*redirectRule{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid --redirect-location %q (expected key=location)", pair)
+		}
+
+		key := strings.Trim(strings.TrimSpace(parts[0]), "/")
+		location := strings.TrimSpace(parts[1])
+		if !strings.HasPrefix(location, "/") &&
+			!strings.HasPrefix(location, "http://") &&
+			!strings.HasPrefix(location, "https://") {
+			return nil, fmt.Errorf("--redirect-location for %q must start with /, http://, or https://, not %q", key, location)
+		}
+
+		rules = append(rules, &redirectRule{Key: key, Location: location})
+	}
+
+	return rules, nil
+}
+
+// applyRedirect sets the redirect location on a zero-byte artifact whose
+// dest has a rule.  Artifacts with content are uploaded as they are,
+// since S3 would serve the redirect and never the content.
+func (u *uploader) applyRedirect(a *artifact.Artifact) error {
+	if a.RedirectLocation != "" {
+		return nil
+	}
+
+	dest := strings.Trim(filepath.ToSlash(a.Dest), "/")
+	for _, rule := range u.redirects {
+		if rule.Key != dest {
+			continue
+		}
+
+		rule.matched = true
+
+		size, err := a.Size()
+		if err != nil {
+			return err
+		}
+
+		if size > 0 {
+			u.log.WithFields(logrus.Fields{
+				"dest": a.Dest,
+				"size": size,
+			}).Warn("not redirecting artifact with content")
+			return nil
+		}
+
+		a.RedirectLocation = rule.Location
+		return nil
+	}
+
+	return nil
+}
+
+// queueRedirects queues a zero-byte object under each target path for
+// every rule that no walked file matched
+func (u *uploader) queueRedirects(artifacts chan *artifact.Artifact) error {
+	for _, rule := range u.redirects {
+		if rule.matched {
+			continue
+		}
+
+		for _, targetPath := range u.Opts.TargetPaths {
+			a := artifact.NewFromBytes(targetPath, rule.Key, nil, u.artifactOptions())
+			a.RedirectLocation = rule.Location
+
+			u.log.WithFields(logrus.Fields{
+				"dest":     a.FullDest(),
+				"location": rule.Location,
+			}).Debug("queueing redirect")
+
+			if err := u.queue(a, rule.Key, artifacts); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
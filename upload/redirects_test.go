@@ -0,0 +1,119 @@
+package upload
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestParseRedirectLocations(t *testing.T) {
+	rules, err := parseRedirectLocations("latest=/builds/42/index.html, /docs/=https://example.com/docs,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []*redirectRule{
+		&redirectRule{Key: "latest", Location: "/builds/42/index.html"},
+		&redirectRule{Key: "docs", Location: "https://example.com/docs"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("rules %#v != %#v", rules, expected)
+	}
+
+	for _, spec := range []string{"latest", "=/somewhere", "latest=builds/42"} {
+		if _, err := parseRedirectLocations(spec); err == nil {
+			t.Fatalf("invalid redirect %q was accepted", spec)
+		}
+	}
+}
+
+func TestOptionsValidateRedirectLocation(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "s3"
+	opts.AccessKey = "AKIAFAKE"
+	opts.SecretKey = "fake"
+	opts.BucketName = "foo"
+	opts.RedirectLocations = "latest=/builds/42/"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.RedirectLocations = "latest=builds/42/"
+	if opts.Validate() == nil {
+		t.Fatalf("relative redirect location was accepted")
+	}
+
+	opts.RedirectLocations = "latest=/builds/42/"
+	opts.Provider = "gcs"
+	if opts.Validate() == nil {
+		t.Fatalf("--redirect-location was accepted without s3")
+	}
+}
+
+func TestUploadRedirectLocations(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"site/index.html": "<html></html>",
+		"site/old.html":   "",
+		"site/moved.html": "still here",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"site/"}
+	opts.TargetPaths = []string{"www"}
+	opts.RedirectLocations = "site/old.html=/site/index.html,site/moved.html=/site/index.html,latest=/builds/42/"
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byDest := map[string]*artifact.Artifact{}
+	for _, a := range rp.Uploaded {
+		byDest[a.FullDest()] = a
+	}
+
+	if len(rp.Uploaded) != 4 {
+		t.Fatalf("uploaded %v artifacts != 4", len(rp.Uploaded))
+	}
+
+	for dest, location := range map[string]string{
+		"www/site/index.html": "",
+		"www/site/old.html":   "/site/index.html",
+		"www/site/moved.html": "",
+		"www/latest":          "/builds/42/",
+	} {
+		a, ok := byDest[dest]
+		if !ok {
+			t.Fatalf("%v was not uploaded", dest)
+		}
+
+		if a.RedirectLocation != location {
+			t.Fatalf("%v redirect location %q != %q", dest, a.RedirectLocation, location)
+		}
+	}
+
+	size, err := byDest["www/latest"].Size()
+	if err != nil || size != 0 {
+		t.Fatalf("redirect object size %v != 0 (err %v)", size, err)
+	}
+
+	s3p := newS3Provider(u.Opts, getPanicLogger())
+	headers, _ := s3p.objectHeaders(u.Opts, byDest["www/latest"])
+	if !reflect.DeepEqual(headers["x-amz-website-redirect-location"], []string{"/builds/42/"}) {
+		t.Fatalf("redirect header %v != [/builds/42/]", headers["x-amz-website-redirect-location"])
+	}
+
+	headers, _ = s3p.objectHeaders(u.Opts, byDest["www/site/index.html"])
+	if _, ok := headers["x-amz-website-redirect-location"]; ok {
+		t.Fatalf("redirect header was set without a redirect location")
+	}
+}
@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// UploadResult is the outcome of an upload, for programs driving it.
+// --result-file writes it as JSON.
+type UploadResult struct {
+	// Count is the number of artifacts tried, Bytes those of the ones
+	// uploaded, and Failures the number that failed
+	Count            int               `json:"count"`
+	Succeeded        int               `json:"succeeded"`
+	Bytes            uint64            `json:"bytes"`
+	Failures         int               `json:"failures"`
+	SkippedUnchanged uint64            `json:"skipped_unchanged"`
+	DurationSeconds  float64           `json:"duration_seconds"`
+	Artifacts        []*ArtifactResult `json:"artifacts"`
+}
+
+// ArtifactResult is the outcome of one artifact's upload.  SHA256 is
+// left out for streams that were never read through.
+type ArtifactResult struct {
+	Source          string  `json:"source"`
+	Dest            string  `json:"dest"`
+	URL             string  `json:"url,omitempty"`
+	SignedURL       string  `json:"signed_url,omitempty"`
+	ContentType     string  `json:"content_type"`
+	Size            uint64  `json:"size"`
+	SHA256          string  `json:"sha256,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Attempts        uint64  `json:"attempts"`
+	Retries         uint64  `json:"retries"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// UploadWithResult uploads like Upload, also returning what happened to
+// each artifact
+func UploadWithResult(ctx context.Context, opts *Options, log *logrus.Logger) (*UploadResult, error) {
+	u := newUploader(opts, log)
+	u.ctx = ctx
+	err := u.Upload()
+	if err == nil {
+		err = u.failureError()
+	}
+	return u.uploadResult(), err
+}
+
+func (u *uploader) uploadResult() *UploadResult {
+	result := &UploadResult{
+		SkippedUnchanged: atomic.LoadUint64(&u.skippedUnchanged),
+		DurationSeconds:  time.Since(u.startTime).Seconds(),
+		Artifacts:        []*ArtifactResult{},
+	}
+
+	for _, a := range u.results {
+		entry := newArtifactResult(a)
+		result.Artifacts = append(result.Artifacts, entry)
+
+		result.Count++
+		if a.UploadResult.OK {
+			result.Succeeded++
+			result.Bytes += entry.Size
+		} else {
+			result.Failures++
+		}
+	}
+
+	// results arrive in the order uploads finish, so they are sorted to
+	// keep the document stable between runs
+	sort.SliceStable(result.Artifacts, func(i, j int) bool {
+		return result.Artifacts[i].Dest < result.Artifacts[j].Dest
+	})
+
+	return result
+}
+
+func newArtifactResult(a *artifact.Artifact) *ArtifactResult {
+	size, _ := a.Size()
+	status, errString := uploadStatus(a)
+
+	retries := uint64(0)
+	if a.UploadResult.Attempts > 1 {
+		retries = a.UploadResult.Attempts - 1
+	}
+
+	// the digest is usually known from reading the content through for
+	// the upload, and otherwise, e.g. for files uploaded in parts, the
+	// file is read again
+	sum := a.KnownSHA256()
+	if sum == "" && !a.IsStream() {
+		sum, _ = a.SHA256()
+	}
+
+	return &ArtifactResult{
+		Source:          a.Source,
+		Dest:            a.FullDest(),
+		URL:             a.UploadResult.URL,
+		SignedURL:       a.UploadResult.SignedURL,
+		ContentType:     a.ContentType(),
+		Size:            size,
+		SHA256:          sum,
+		DurationSeconds: a.UploadResult.Duration.Seconds(),
+		Attempts:        a.UploadResult.Attempts,
+		Retries:         retries,
+		Status:          status,
+		Error:           errString,
+	}
+}
+
+// writeResultFile writes the result of the run to --result-file, or to
+// stdout if it is "-"
+func (u *uploader) writeResultFile() error {
+	if u.Opts.ResultFile == "-" {
+		return writeUploadResult(u.stdout, u.uploadResult())
+	}
+
+	f, err := os.Create(u.Opts.ResultFile)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if err := writeUploadResult(f, u.uploadResult()); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func writeUploadResult(w io.Writer, result *UploadResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -0,0 +1,158 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestUploaderResultFile(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":    "aaaa",
+		"fail.txt": "ff",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "fail.txt"}
+	opts.TargetPaths = []string{"out"}
+	opts.ResultFile = "-"
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{FailSources: map[string]bool{
+		filepath.Join(dir, "fail.txt"): true,
+	}}
+	out := &bytes.Buffer{}
+	u.stdout = out
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := &UploadResult{}
+	if err := json.Unmarshal(out.Bytes(), result); err != nil {
+		t.Fatalf("stdout is not a single json document: %v\n%s", err, out.String())
+	}
+
+	if result.Count != 2 || result.Succeeded != 1 || result.Bytes != 4 || result.Failures != 1 {
+		t.Fatalf("totals %d/%d/%d/%d != 2 artifacts, 1 succeeded, 4 bytes, 1 failure",
+			result.Count, result.Succeeded, result.Bytes, result.Failures)
+	}
+
+	if len(result.Artifacts) != 2 {
+		t.Fatalf("artifacts %v != 2", len(result.Artifacts))
+	}
+
+	a, fail := result.Artifacts[0], result.Artifacts[1]
+	if a.Source != filepath.Join(dir, "a.txt") || a.Dest != "out/a.txt" || a.Size != 4 || a.Status != "uploaded" {
+		t.Fatalf("unexpected result for a.txt: %#v", a)
+	}
+
+	if a.ContentType != "text/plain; charset=utf-8" {
+		t.Fatalf("content type %q != text/plain; charset=utf-8", a.ContentType)
+	}
+
+	// sha256 of "aaaa"
+	if a.SHA256 != "61be55a8e2f6b4e172338bddf184d6dbee29c98853e0a0485ecee7f27b9af0b4" {
+		t.Fatalf("unexpected sha256 %q", a.SHA256)
+	}
+
+	if fail.Dest != "out/fail.txt" || fail.Status != "failed" || fail.Error == "" {
+		t.Fatalf("unexpected result for fail.txt: %#v", fail)
+	}
+}
+
+func TestUploadWithResult(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "a",
+	})
+	defer os.RemoveAll(dir)
+
+	resultFile := filepath.Join(dir, "result.json")
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt"}
+	opts.ResultFile = resultFile
+
+	result, err := UploadWithResult(context.Background(), opts, getPanicLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Count != 1 || result.Artifacts[0].Retries != 0 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+
+	f, err := os.Open(resultFile)
+	if err != nil {
+		t.Fatalf("result file was not written: %v", err)
+	}
+	defer f.Close()
+
+	written := &UploadResult{}
+	if err := json.NewDecoder(f).Decode(written); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if written.Count != 1 || written.Artifacts[0].Status != "uploaded" {
+		t.Fatalf("unexpected result file: %#v", written)
+	}
+}
+
+func TestUploadWithResultWithoutLog(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "a",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt"}
+
+	result, err := UploadWithResult(context.Background(), opts, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Succeeded != 1 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+}
+
+func TestNewArtifactResult(t *testing.T) {
+	a := artifact.NewFromBytes("", "retried.txt", []byte("abc"), &artifact.Options{})
+	a.UploadResult.OK = true
+	a.UploadResult.Attempts = 3
+	a.UploadResult.Duration = 1500 * time.Millisecond
+	a.UploadResult.URL = "https://bucket.s3.amazonaws.com/retried.txt"
+
+	entry := newArtifactResult(a)
+	if entry.Attempts != 3 || entry.Retries != 2 {
+		t.Fatalf("attempts %v, retries %v != 3, 2", entry.Attempts, entry.Retries)
+	}
+
+	if entry.URL != a.UploadResult.URL {
+		t.Fatalf("url %q != %q", entry.URL, a.UploadResult.URL)
+	}
+
+	if entry.DurationSeconds != 1.5 {
+		t.Fatalf("duration %v != 1.5", entry.DurationSeconds)
+	}
+
+	if entry.Size != 3 || entry.Status != "uploaded" {
+		t.Fatalf("unexpected result: %#v", entry)
+	}
+}
@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/client"
+)
+
+// retryInterval is --retry-interval if it was given, or the provider's own
+// default otherwise
+func (opts *Options) retryInterval(providerDefault time.Duration) time.Duration {
+	if opts.retryIntervalSet {
+		return opts.RetryInterval
+	}
+	return providerDefault
+}
+
+// applyRetryDefaults takes the provider's own retries and retry interval
+// in place of any that nobody asked for
+func (opts *Options) applyRetryDefaults(p Provider) {
+	rd, ok := p.(retryDefaulter)
+	if !ok {
+		return
+	}
+
+	retries, interval := rd.RetryDefaults()
+	if !opts.retriesSet && opts.Retries == opts.retriesDefault {
+		opts.Retries = retries
+	}
+	if !opts.retryIntervalSet {
+		opts.RetryInterval = interval
+	}
+}
+
+// retryBackoff is how long to sleep before the given retry, counting from
+// 1.  The base interval doubles with each retry up to --retry-interval-max,
+// and up to half of it is random, so that workers throttled at the same
+// time don't all retry at the same time.
+func (opts *Options) retryBackoff(base time.Duration, retry uint64) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	max := opts.RetryIntervalMax
+	sleep := base
+	for i := uint64(1); i < retry; i++ {
+		if max > 0 && sleep >= max || sleep*2 < sleep {
+			break
+		}
+		sleep *= 2
+	}
+
+	if max > 0 && sleep > max {
+		sleep = max
+	}
+
+	half := sleep / 2
+	return half + time.Duration(rand.Int63n(int64(sleep-half)+1))
+}
+
+// retrySleep is retryBackoff, unless the failed attempt was answered with
+// a Retry-After, which is waited out instead, up to --retry-interval-max
+func (opts *Options) retrySleep(base time.Duration, retry uint64, err error) time.Duration {
+	var putErr *client.PutError
+	if errors.As(err, &putErr) && putErr.RetryAfter > 0 {
+		if opts.RetryIntervalMax > 0 && putErr.RetryAfter > opts.RetryIntervalMax {
+			return opts.RetryIntervalMax
+		}
+		return putErr.RetryAfter
+	}
+
+	return opts.retryBackoff(base, retry)
+}
+
+// retryable reports whether trying again might get past the error.  Bad
+// credentials and requests the backend rejects as they are won't, while
+// throttling, timeouts, server errors, and errors without a status might.
+func retryable(err error) bool {
+	switch FailureCategory(err) {
+	case FailureCredentials, FailureValidation, FailureSizeLimit:
+		return false
+	}
+
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		return s3Err.Code == "RequestTimeout" || retryableStatus(s3Err.StatusCode)
+	}
+
+	var putErr *client.PutError
+	if errors.As(err, &putErr) {
+		return retryableStatus(putErr.StatusCode)
+	}
+
+	return true
+}
+
+func retryableStatus(code int) bool {
+	return code == 0 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
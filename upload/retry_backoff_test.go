@@ -0,0 +1,202 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+	"github.com/travis-ci/artifacts/client"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	opts := NewOptions()
+	opts.RetryIntervalMax = 10 * time.Second
+
+	for _, tc := range []struct {
+		retry    uint64
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 4 * time.Second, 8 * time.Second},
+		{5, 5 * time.Second, 10 * time.Second},
+		{64, 5 * time.Second, 10 * time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			sleep := opts.retryBackoff(time.Second, tc.retry)
+			if sleep < tc.min || sleep > tc.max {
+				t.Fatalf("retry %v slept %v, not within %v-%v", tc.retry, sleep, tc.min, tc.max)
+			}
+		}
+	}
+
+	if sleep := opts.retryBackoff(0, 3); sleep != 0 {
+		t.Fatalf("zero base interval slept %v", sleep)
+	}
+
+	opts.RetryIntervalMax = 0
+	if sleep := opts.retryBackoff(time.Hour, 200); sleep < 0 {
+		t.Fatalf("uncapped backoff overflowed to %v", sleep)
+	}
+}
+
+func TestRetryIntervalOption(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	if newS3Provider(opts, getPanicLogger()).RetryInterval != defaultProviderRetryInterval {
+		t.Fatalf("unset --retry-interval replaced the provider default")
+	}
+
+	if newOCIProvider(opts, getPanicLogger()).RetryInterval != ociProviderRetryInterval {
+		t.Fatalf("unset --retry-interval replaced the oci default")
+	}
+
+	opts = NewOptions()
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{"--retry-interval", "250ms"}))
+	if newOCIProvider(opts, getPanicLogger()).RetryInterval != 250*time.Millisecond {
+		t.Fatalf("--retry-interval was replaced by the provider default")
+	}
+
+	os.Setenv("ARTIFACTS_RETRY_INTERVAL", "7s")
+	opts = NewOptions()
+	if newS3Provider(opts, getPanicLogger()).RetryInterval != 7*time.Second {
+		t.Fatalf("$ARTIFACTS_RETRY_INTERVAL was not used")
+	}
+}
+
+func TestS3ProviderRetryBacksOff(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Retries = 3
+	opts.RetryIntervalMax = 40 * time.Millisecond
+
+	s3p := newS3Provider(opts, getPanicLogger())
+	s3p.RetryInterval = 10 * time.Millisecond
+
+	a := artifact.NewFromBytes("", "backoff.txt", []byte("x"), &artifact.Options{})
+
+	// s3 is always slowing down, so every attempt fails and the sleeps
+	// between them add up to at least half of 10ms + 20ms + 40ms
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "<Error><Code>SlowDown</Code></Error>")
+	}))
+	defer srv.Close()
+	bucket := s3.New(aws.Auth{AccessKey: "AKIAFOO", SecretKey: "bar"},
+		aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL}).Bucket("bucket")
+
+	start := time.Now()
+	if err := s3p.uploadFile(context.Background(), opts, bucket, a); err == nil {
+		t.Fatalf("upload to a throttling s3 succeeded")
+	}
+
+	if a.UploadResult.Attempts != 4 {
+		t.Fatalf("attempts %v != 4", a.UploadResult.Attempts)
+	}
+
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("retries took %v, which is too quick to have backed off", elapsed)
+	}
+}
+
+func TestS3ProviderDoesNotRetryMissingBucket(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Retries = 3
+
+	s3p := newS3Provider(opts, getPanicLogger())
+	s3p.RetryInterval = 0
+
+	a := artifact.NewFromBytes("", "missing.txt", []byte("x"), &artifact.Options{})
+	if err := s3p.uploadFile(context.Background(), opts, testS3.Bucket("no-such-bucket"), a); err == nil {
+		t.Fatalf("upload to a missing bucket succeeded")
+	}
+
+	if a.UploadResult.Attempts != 1 {
+		t.Fatalf("attempts %v != 1 for a missing bucket", a.UploadResult.Attempts)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("connection reset"), true},
+		{&s3.Error{StatusCode: 503, Code: "SlowDown"}, true},
+		{&s3.Error{StatusCode: 500, Code: "InternalError"}, true},
+		{&s3.Error{StatusCode: 400, Code: "RequestTimeout"}, true},
+		{&s3.Error{StatusCode: 403, Code: "AccessDenied"}, false},
+		{&s3.Error{StatusCode: 404, Code: "NoSuchBucket"}, false},
+		{&client.PutError{StatusCode: 429}, true},
+		{&client.PutError{StatusCode: 502}, true},
+		{&client.PutError{StatusCode: 403}, false},
+		{categorize(FailureCredentials, fmt.Errorf("no auth")), false},
+	} {
+		if retryable(tc.err) != tc.retryable {
+			t.Fatalf("retryable(%v) != %v", tc.err, tc.retryable)
+		}
+	}
+}
+
+func TestRetrySleepRetryAfter(t *testing.T) {
+	opts := NewOptions()
+	opts.RetryIntervalMax = time.Minute
+
+	if sleep := opts.retrySleep(time.Second, 1, &client.PutError{StatusCode: 503, RetryAfter: 20 * time.Second}); sleep != 20*time.Second {
+		t.Fatalf("sleep %v != the 20s asked for", sleep)
+	}
+
+	if sleep := opts.retrySleep(time.Second, 1, &client.PutError{StatusCode: 503, RetryAfter: time.Hour}); sleep != time.Minute {
+		t.Fatalf("sleep %v != the 1m --retry-interval-max", sleep)
+	}
+
+	if sleep := opts.retrySleep(time.Second, 1, fmt.Errorf("boom")); sleep < 500*time.Millisecond || sleep > time.Second {
+		t.Fatalf("sleep %v is not the backoff", sleep)
+	}
+}
+
+func TestArtifactsProviderDoesNotRetryRejected(t *testing.T) {
+	opts := NewOptions()
+	opts.Retries = 3
+	ap := newArtifactsProvider(opts, getPanicLogger())
+	ap.RetryInterval = 0
+
+	putter := &failingPutter{Err: &client.PutError{StatusCode: 403, Status: "403 Forbidden"}}
+	a := artifact.NewFromBytes("prefix", "out.txt", []byte("0123456789"), &artifact.Options{})
+	if err := ap.uploadFile(context.Background(), putter, a); err == nil {
+		t.Fatalf("no error for a rejected put")
+	}
+
+	if putter.Puts != 1 {
+		t.Fatalf("rejected put was tried %v times", putter.Puts)
+	}
+
+	putter = &failingPutter{Err: &client.PutError{StatusCode: 503, Status: "503 Service Unavailable"}}
+	ap.uploadFile(context.Background(), putter, a)
+	if putter.Puts != 4 {
+		t.Fatalf("unavailable put was tried %v times, not 4", putter.Puts)
+	}
+}
+
+type failingPutter struct {
+	Err  error
+	Puts int
+}
+
+func (fp *failingPutter) PutArtifact(a *artifact.Artifact) error {
+	fp.Puts++
+	return fp.Err
+}
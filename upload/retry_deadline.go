@@ -0,0 +1,50 @@
+package upload
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var (
+	errRetryDeadline = fmt.Errorf("retry deadline exceeded")
+)
+
+func (opts *Options) startRetryDeadline(start time.Time) {
+	opts.retryDeadlineAt = time.Time{}
+	if opts.RetryDeadline > 0 {
+		opts.retryDeadlineAt = start.Add(opts.RetryDeadline)
+	}
+}
+
+// pastRetryDeadline reports whether the upload has run longer than the
+// retry deadline, after which nothing is retried
+func (opts *Options) pastRetryDeadline() bool {
+	return !opts.retryDeadlineAt.IsZero() && time.Now().After(opts.retryDeadlineAt)
+}
+
+// deadlineFilter passes artifacts along to the workers until the retry
+// deadline, after which the rest are failed without being attempted
+func (u *uploader) deadlineFilter(in chan *artifact.Artifact, failed chan *artifact.Artifact) chan *artifact.Artifact {
+	if u.Opts.RetryDeadline == 0 {
+		return in
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			if u.Opts.pastRetryDeadline() {
+				a.UploadResult.OK = false
+				a.UploadResult.Err = errRetryDeadline
+				failed <- a
+				continue
+			}
+
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out
+}
@@ -0,0 +1,86 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestS3ProviderStopsRetryingAfterDeadline(t *testing.T) {
+	attempts := int64(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+	}))
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.Retries = 1000
+	opts.RetryDeadline = 50 * time.Millisecond
+	opts.startRetryDeadline(time.Now())
+
+	s3p := newS3Provider(opts, getPanicLogger())
+	s3p.RetryInterval = 5 * time.Millisecond
+	conn := s3.New(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"},
+		aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	a := artifact.NewFromBytes("bucket", "hello.txt", []byte("hello"), &artifact.Options{})
+
+	start := time.Now()
+	err := s3p.uploadFile(context.Background(), opts, conn.Bucket("bucket"), a)
+	if err == nil {
+		t.Fatalf("upload to failing server succeeded")
+	}
+
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("retries continued past the deadline: %v", time.Since(start))
+	}
+
+	if atomic.LoadInt64(&attempts) >= 1000 {
+		t.Fatalf("all %v retries were attempted", attempts)
+	}
+}
+
+func TestUploaderFailsRemainingAfterDeadline(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Concurrency = 1
+	opts.Paths = []string{dir}
+	opts.TargetPaths = []string{"t1"}
+	opts.RetryDeadline = time.Nanosecond
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	u.Upload()
+
+	if len(rp.Uploaded) != 0 {
+		t.Fatalf("artifacts attempted after deadline: %v", rp.FullDests())
+	}
+
+	if len(u.results) != 2 {
+		t.Fatalf("results %v != 2", len(u.results))
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.Err != errRetryDeadline {
+			t.Fatalf("unexpected result error: %v", a.UploadResult.Err)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package upload
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const contentTypeRoutePrefix = "content-type:"
+
+// route sends artifacts matching a glob, or a content type given as
+// "content-type:<pattern>", to a destination other than the default
+type route struct {
+	Pattern     string
+	Destination *routeDestination
+}
+
+// routeDestination overrides the provider, bucket, and storage class of
+// the upload options, leaving anything empty as it was
+type routeDestination struct {
+	Provider     string
+	BucketName   string
+	StorageClass string
+}
+
+func (rd *routeDestination) String() string {
+	parts := []string{}
+	if rd.Provider != "" {
+		parts = append(parts, "provider="+rd.Provider)
+	}
+	if rd.BucketName != "" {
+		parts = append(parts, "bucket="+rd.BucketName)
+	}
+	if rd.StorageClass != "" {
+		parts = append(parts, "storage-class="+rd.StorageClass)
+	}
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, " ")
+}
+
+// loadRoutes reads one route per line, as a pattern followed by
+// key=value destination fields, skipping blank lines and lines starting
+// with "#", e.g.:
+//
+//	*.log                   bucket=cold-logs storage-class=GLACIER
+//	content-type:text/html  provider=artifacts
+func loadRoutes(filename string) ([]*route, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	routes := []*route{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r, err := parseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		routes = append(routes, r)
+	}
+
+	return routes, scanner.Err()
+}
+
+func parseRoute(line string) (*route, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("route %q has no destination", line)
+	}
+
+	r := &route{
+		Pattern:     strings.TrimPrefix(fields[0], "./"),
+		Destination: &routeDestination{},
+	}
+
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid route destination %q, expected key=value", field)
+		}
+
+		switch parts[0] {
+		case "provider":
+			if _, ok := lookupProvider(parts[1]); !ok {
+				return nil, fmt.Errorf("unknown route provider %q", parts[1])
+			}
+			r.Destination.Provider = parts[1]
+		case "bucket":
+			r.Destination.BucketName = parts[1]
+		case "storage-class":
+			r.Destination.StorageClass = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown route destination key %q", parts[0])
+		}
+	}
+
+	return r, nil
+}
+
+func (r *route) Match(a *artifact.Artifact, relPath string) bool {
+	if strings.HasPrefix(r.Pattern, contentTypeRoutePrefix) {
+		ctype := strings.TrimSpace(strings.SplitN(a.ContentType(), ";", 2)[0])
+		ok, err := path.Match(strings.TrimPrefix(r.Pattern, contentTypeRoutePrefix), ctype)
+		return err == nil && ok
+	}
+
+	return matchGlob(r.Pattern, relPath)
+}
+
+// routingProvider hands each artifact to the provider for the first
+// route it matches, or to the default provider if it matches none, and
+// counts the results per destination
+type routingProvider struct {
+	opts *Options
+	log  *logrus.Logger
+
+	routes   []*route
+	fallback Provider
+
+	newProvider func(*Options, *logrus.Logger) Provider
+
+	sync.Mutex
+	providers map[string]Provider
+	destOpts  map[string]*Options
+	counts    map[string]*routeCount
+}
+
+type routeCount struct {
+	Uploaded int
+	Failed   int
+}
+
+func newRoutingProvider(opts *Options, log *logrus.Logger, routes []*route, fallback Provider) *routingProvider {
+	return &routingProvider{
+		opts: opts,
+		log:  log,
+
+		routes:   routes,
+		fallback: fallback,
+
+		newProvider: newProvider,
+
+		providers: map[string]Provider{},
+		destOpts:  map[string]*Options{},
+		counts:    map[string]*routeCount{},
+	}
+}
+
+// destination returns the name, provider, and options for an artifact
+func (rp *routingProvider) destination(a *artifact.Artifact) (string, Provider, *Options) {
+	relPath := a.Dest
+	if a.Source != "" {
+		relPath = relToWorkingDir(rp.opts.WorkingDir, a.Source)
+	}
+
+	var dest *routeDestination
+	for _, r := range rp.routes {
+		if r.Match(a, relPath) {
+			dest = r.Destination
+			break
+		}
+	}
+
+	if dest == nil {
+		return "default", rp.fallback, rp.opts
+	}
+
+	name := dest.String()
+
+	rp.Lock()
+	defer rp.Unlock()
+
+	if p, ok := rp.providers[name]; ok {
+		return name, p, rp.destOpts[name]
+	}
+
+	opts := *rp.opts
+	if dest.Provider != "" {
+		opts.Provider = dest.Provider
+	}
+	if dest.BucketName != "" {
+		opts.BucketName = dest.BucketName
+	}
+	if dest.StorageClass != "" {
+		opts.StorageClass = dest.StorageClass
+	}
+
+	p := rp.newProvider(&opts, rp.log)
+	rp.providers[name] = p
+	rp.destOpts[name] = &opts
+	return name, p, &opts
+}
+
+// Upload starts a worker of each destination's provider on demand, and
+// feeds it the artifacts routed to it
+func (rp *routingProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	workers := map[string]chan *artifact.Artifact{}
+	wg := &sync.WaitGroup{}
+
+	for a := range in {
+		name, p, destOpts := rp.destination(a)
+
+		workerIn, ok := workers[name]
+		if !ok {
+			workerIn = make(chan *artifact.Artifact)
+			workers[name] = workerIn
+
+			wg.Add(1)
+			go rp.work(ctx, id, name, p, destOpts, workerIn, out, wg)
+		}
+
+		workerIn <- a
+	}
+
+	for _, workerIn := range workers {
+		close(workerIn)
+	}
+
+	wg.Wait()
+	done <- true
+}
+
+// work runs one destination's worker, counting and passing along its
+// results until it is done
+func (rp *routingProvider) work(ctx context.Context, id, name string, p Provider, opts *Options,
+	in, out chan *artifact.Artifact, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	workerOut := make(chan *artifact.Artifact)
+	workerDone := make(chan bool)
+	go p.Upload(ctx, id, opts, in, workerOut, workerDone)
+
+	for {
+		select {
+		case a := <-workerOut:
+			if a != nil {
+				rp.countResult(name, a)
+			}
+			out <- a
+		case <-workerDone:
+			return
+		}
+	}
+}
+
+func (rp *routingProvider) countResult(name string, a *artifact.Artifact) {
+	rp.Lock()
+	defer rp.Unlock()
+
+	c, ok := rp.counts[name]
+	if !ok {
+		c = &routeCount{}
+		rp.counts[name] = c
+	}
+
+	if a.UploadResult.OK {
+		c.Uploaded++
+	} else {
+		c.Failed++
+	}
+}
+
+func (rp *routingProvider) Name() string {
+	return "routing"
+}
+
+// Finish finishes each destination's provider that needs it
+func (rp *routingProvider) Finish(opts *Options) error {
+	if finisher, ok := rp.fallback.(uploadFinisher); ok {
+		if err := finisher.Finish(opts); err != nil {
+			return err
+		}
+	}
+
+	rp.Lock()
+	defer rp.Unlock()
+
+	for name, p := range rp.providers {
+		if finisher, ok := p.(uploadFinisher); ok {
+			if err := finisher.Finish(rp.destOpts[name]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FetchHeaders asks the artifact's destination provider for the headers
+// it was stored with
+func (rp *routingProvider) FetchHeaders(opts *Options, a *artifact.Artifact) (http.Header, error) {
+	_, p, destOpts := rp.destination(a)
+
+	fetcher, ok := p.(HeaderFetcher)
+	if !ok {
+		return nil, fmt.Errorf("--verify-headers is not supported by the %s provider", p.Name())
+	}
+
+	return fetcher.FetchHeaders(destOpts, a)
+}
+
+// LogCounts logs how many artifacts went to each destination
+func (rp *routingProvider) LogCounts() {
+	rp.Lock()
+	defer rp.Unlock()
+
+	names := []string{}
+	for name := range rp.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rp.log.WithFields(logrus.Fields{
+			"destination": name,
+			"uploaded":    rp.counts[name].Uploaded,
+			"failed":      rp.counts[name].Failed,
+		}).Info("uploaded to destination")
+	}
+}
@@ -0,0 +1,191 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func writeRoutesFile(t *testing.T, dir, content string) string {
+	filename := filepath.Join(dir, "routes.txt")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return filename
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	routes, err := loadRoutes(writeRoutesFile(t, dir, `
+# logs are rarely read
+./logs/**/*.log  bucket=cold storage-class=GLACIER
+
+content-type:text/html provider=artifacts
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(routes) != 2 {
+		t.Fatalf("routes %v != 2", len(routes))
+	}
+
+	if routes[0].Pattern != "logs/**/*.log" {
+		t.Fatalf("pattern %q != logs/**/*.log", routes[0].Pattern)
+	}
+
+	if !reflect.DeepEqual(routes[0].Destination, &routeDestination{BucketName: "cold", StorageClass: "GLACIER"}) {
+		t.Fatalf("unexpected destination: %#v", routes[0].Destination)
+	}
+
+	if routes[1].Destination.String() != "provider=artifacts" {
+		t.Fatalf("destination %q != provider=artifacts", routes[1].Destination.String())
+	}
+}
+
+func TestLoadRoutesInvalid(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	for content, msg := range map[string]string{
+		"*.log":               "has no destination",
+		"*.log bucket":        "expected key=value",
+		"*.log region=eu":     "unknown route destination key",
+		"*.log provider=ftp":  "unknown route provider",
+		"*.log bucket=":       "expected key=value",
+		"\n\n*.txt nope=nope": "routes.txt:3:",
+	} {
+		_, err := loadRoutes(writeRoutesFile(t, dir, content))
+		if err == nil {
+			t.Fatalf("invalid route %q was accepted", content)
+		}
+
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("error for %q does not contain %q: %v", content, msg, err)
+		}
+	}
+}
+
+func TestUploaderRoutes(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"logs/build.log":  "log",
+		"logs/test.log":   "log",
+		"report.html":     "<html><body>report</body></html>",
+		"coverage.out":    "cover",
+		"junk/failed.log": "log",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{dir}
+	opts.TargetPaths = []string{"routed"}
+	opts.Concurrency = 2
+	opts.RoutesFrom = writeRoutesFile(t, dir, strings.Join([]string{
+		"logs/*.log bucket=cold storage-class=GLACIER",
+		"**/*.log bucket=cold",
+		"content-type:text/html bucket=web",
+	}, "\n"))
+
+	fallback := &recordingProvider{}
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = fallback
+
+	routed := map[string]*recordingProvider{}
+	routedOpts := map[string]*Options{}
+	routes, err := loadRoutes(opts.RoutesFrom)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rp := newRoutingProvider(opts, u.log, routes, fallback)
+	rp.newProvider = func(opts *Options, log *logrus.Logger) Provider {
+		key := opts.BucketName + "/" + opts.StorageClass
+		routed[key] = &recordingProvider{FailSources: map[string]bool{
+			filepath.Join(dir, "junk", "failed.log"): true,
+		}}
+		routedOpts[key] = opts
+		return routed[key]
+	}
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for key, expected := range map[string][]string{
+		"cold/GLACIER": []string{"logs/build.log", "logs/test.log"},
+		"cold/":        []string{"junk/failed.log"},
+		"web/":         []string{"report.html"},
+	} {
+		if routed[key] == nil {
+			t.Fatalf("nothing was routed to %s", key)
+		}
+
+		sources := routed[key].Sources(dir)
+		sort.Strings(sources)
+		if !reflect.DeepEqual(sources, expected) {
+			t.Fatalf("%s sources %v != %v", key, sources, expected)
+		}
+	}
+
+	if len(routed) != 3 {
+		t.Fatalf("destinations %v != 3", len(routed))
+	}
+
+	if routedOpts["web/"].BucketName != "web" || opts.BucketName == "web" {
+		t.Fatalf("route options were not copied: %#v", routedOpts["web/"])
+	}
+
+	sources := fallback.Sources(dir)
+	sort.Strings(sources)
+	if !reflect.DeepEqual(sources, []string{"coverage.out", "routes.txt"}) {
+		t.Fatalf("default sources %v != [coverage.out routes.txt]", sources)
+	}
+
+	for name, expected := range map[string]routeCount{
+		"bucket=cold storage-class=GLACIER": routeCount{Uploaded: 2},
+		"bucket=cold":                       routeCount{Failed: 1},
+		"bucket=web":                        routeCount{Uploaded: 1},
+		"default":                           routeCount{Uploaded: 2},
+	} {
+		if rp.counts[name] == nil || *rp.counts[name] != expected {
+			t.Fatalf("%s counts %#v != %#v", name, rp.counts[name], expected)
+		}
+	}
+
+	if len(u.failedResults()) != 1 {
+		t.Fatalf("failed results %v != 1", len(u.failedResults()))
+	}
+}
+
+func TestS3ProviderStorageClassHeader(t *testing.T) {
+	opts := NewOptions()
+	s3p := newS3Provider(opts, getPanicLogger())
+	a := artifact.New("bucket", "/tmp/whatever.txt", "whatever.txt", &artifact.Options{})
+
+	headers, err := s3p.objectHeaders(opts, a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := headers["x-amz-storage-class"]; ok {
+		t.Fatalf("storage class header set without --storage-class")
+	}
+
+	opts.StorageClass = "STANDARD_IA"
+	headers, _ = s3p.objectHeaders(opts, a)
+	if !reflect.DeepEqual(headers["x-amz-storage-class"], []string{"STANDARD_IA"}) {
+		t.Fatalf("storage class header %v != [STANDARD_IA]", headers["x-amz-storage-class"])
+	}
+}
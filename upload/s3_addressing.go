@@ -0,0 +1,95 @@
+package upload
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/aws"
+)
+
+var (
+	dnsCompliantBucketRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+)
+
+// s3UsePathStyle decides whether the bucket is addressed in the URL path
+// rather than as a virtual host.  Unless overridden, path style is used
+// for custom endpoints, since many S3-compatible stores only support it,
+// and for bucket names that are not valid in a hostname or that contain
+// dots, since those do not match the wildcard TLS certificate.
+func s3UsePathStyle(opts *Options) bool {
+	if opts.S3ForcePathStyle {
+		return true
+	}
+
+	if opts.S3VirtualHost {
+		return false
+	}
+
+	if opts.S3Endpoint != "" {
+		return true
+	}
+
+	return !isDNSCompliantBucket(opts.BucketName) || strings.Contains(opts.BucketName, ".")
+}
+
+// warnDeprecatedEndpoint warns about $ARTIFACTS_ENDPOINT, which is only
+// still read as an alias of $ARTIFACTS_S3_ENDPOINT, and is ignored when
+// both are set
+func warnDeprecatedEndpoint(log *logrus.Logger) {
+	if os.Getenv("ARTIFACTS_ENDPOINT") == "" {
+		return
+	}
+
+	if os.Getenv("ARTIFACTS_S3_ENDPOINT") != "" {
+		log.Warn("ignoring $ARTIFACTS_ENDPOINT, which is deprecated, in favor of $ARTIFACTS_S3_ENDPOINT")
+		return
+	}
+	log.Warn("$ARTIFACTS_ENDPOINT is deprecated, use $ARTIFACTS_S3_ENDPOINT instead")
+}
+
+func isDNSCompliantBucket(name string) bool {
+	if !dnsCompliantBucketRegexp.MatchString(name) {
+		return false
+	}
+
+	if strings.Contains(name, "..") || net.ParseIP(name) != nil {
+		return false
+	}
+
+	return true
+}
+
+// s3AddressRegion returns a copy of the region using the custom endpoint
+// if one is given, and with the bucket endpoint set for virtual hosts
+func s3AddressRegion(region aws.Region, opts *Options) aws.Region {
+	if opts.S3Endpoint != "" {
+		region.S3Endpoint = strings.TrimRight(opts.S3Endpoint, "/")
+	}
+
+	region.S3BucketEndpoint = ""
+	if s3UsePathStyle(opts) {
+		return region
+	}
+
+	u, err := url.Parse(region.S3Endpoint)
+	if err != nil || u.Host == "" {
+		return region
+	}
+
+	region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host + strings.TrimRight(u.Path, "/")
+	return region
+}
+
+// s3ObjectURL is where the object can be found under the region's
+// addressing style
+func s3ObjectURL(region aws.Region, bucketName, dest string) string {
+	if region.S3BucketEndpoint != "" {
+		return strings.Replace(region.S3BucketEndpoint, "${bucket}", bucketName, -1) + "/" + dest
+	}
+
+	return region.S3Endpoint + "/" + bucketName + "/" + dest
+}
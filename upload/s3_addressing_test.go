@@ -0,0 +1,92 @@
+package upload
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+type s3AddressingCase struct {
+	bucket      string
+	endpoint    string
+	pathStyle   bool
+	virtualHost bool
+	expected    string
+}
+
+var s3AddressingCases = []*s3AddressingCase{
+	&s3AddressingCase{"my-bucket", "", false, false, "https://my-bucket.s3.amazonaws.com/foo"},
+	&s3AddressingCase{"my.dotted.bucket", "", false, false, "https://s3.amazonaws.com/my.dotted.bucket/foo"},
+	&s3AddressingCase{"My_Bucket", "", false, false, "https://s3.amazonaws.com/My_Bucket/foo"},
+	&s3AddressingCase{"192.168.1.1", "", false, false, "https://s3.amazonaws.com/192.168.1.1/foo"},
+	&s3AddressingCase{"my-bucket", "http://minio.local:9000/", false, false, "http://minio.local:9000/my-bucket/foo"},
+	&s3AddressingCase{"my-bucket", "", true, false, "https://s3.amazonaws.com/my-bucket/foo"},
+	&s3AddressingCase{"my-bucket", "http://minio.local:9000", false, true, "http://my-bucket.minio.local:9000/foo"},
+	&s3AddressingCase{"my.dotted.bucket", "", false, true, "https://my.dotted.bucket.s3.amazonaws.com/foo"},
+}
+
+func TestS3AddressRegion(t *testing.T) {
+	for _, c := range s3AddressingCases {
+		opts := NewOptions()
+		opts.BucketName = c.bucket
+		opts.S3Endpoint = c.endpoint
+		opts.S3ForcePathStyle = c.pathStyle
+		opts.S3VirtualHost = c.virtualHost
+
+		region := s3AddressRegion(aws.Regions["us-east-1"], opts)
+		actual := s3ObjectURL(region, c.bucket, "foo")
+		if actual != c.expected {
+			t.Errorf("%#v: url %v != %v", c, actual, c.expected)
+		}
+	}
+}
+
+func TestValidateS3AddressingOverrides(t *testing.T) {
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.AccessKey = "AZ"
+	opts.SecretKey = "ZA"
+	opts.S3ForcePathStyle = true
+	opts.S3VirtualHost = true
+
+	if opts.Validate() == nil {
+		t.Fatalf("conflicting addressing overrides were accepted")
+	}
+}
+
+func TestValidateS3Endpoint(t *testing.T) {
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.AccessKey = "AZ"
+	opts.SecretKey = "ZA"
+
+	for _, endpoint := range []string{"http://minio.local:9000", "https://nyc3.digitaloceanspaces.com"} {
+		opts.S3Endpoint = endpoint
+		if err := opts.Validate(); err != nil {
+			t.Fatalf("endpoint %q was rejected: %v", endpoint, err)
+		}
+	}
+
+	for _, endpoint := range []string{"minio.local:9000", "ftp://minio.local", "http://", "http://[::1"} {
+		opts.S3Endpoint = endpoint
+		if opts.Validate() == nil {
+			t.Fatalf("invalid endpoint %q was accepted", endpoint)
+		}
+	}
+}
+
+func TestS3EndpointEnvAlias(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	os.Setenv("ARTIFACTS_ENDPOINT", "http://minio.local:9000")
+	if opts := NewOptions(); opts.S3Endpoint != "http://minio.local:9000" {
+		t.Fatalf("endpoint %q was not read from $ARTIFACTS_ENDPOINT", opts.S3Endpoint)
+	}
+
+	os.Setenv("ARTIFACTS_S3_ENDPOINT", "https://nyc3.digitaloceanspaces.com")
+	if opts := NewOptions(); opts.S3Endpoint != "https://nyc3.digitaloceanspaces.com" {
+		t.Fatalf("endpoint %q was not read from $ARTIFACTS_S3_ENDPOINT first", opts.S3Endpoint)
+	}
+}
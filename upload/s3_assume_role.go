@@ -0,0 +1,286 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+var (
+	// stsEndpoint and stsRegion are vars so that tests can stand in for
+	// sts
+	stsEndpoint = "https://sts.amazonaws.com"
+	stsRegion   = "us-east-1"
+)
+
+const (
+	stsAPIVersion          = "2011-06-15"
+	assumeRoleDuration     = "3600"
+	sigV4Algorithm         = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat        = "20060102T150405Z"
+	sigV4DateFormat        = "20060102"
+	sigV4UnsignedPayload   = "UNSIGNED-PAYLOAD"
+	stsContentType         = "application/x-www-form-urlencoded; charset=utf-8"
+	defaultRoleSessionName = "artifacts"
+)
+
+// assumeRoleResponse is as much of the AssumeRole response as is needed
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+// stsErrorResponse is the error sts answers a failed request with
+type stsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// baseAuth is --key and --secret, with --session-token for temporary
+// credentials, or else, with --instance-role or --assume-role-arn, the
+// credentials found the way the aws tools find them
+func (s3p *s3Provider) baseAuth(accessKey, secretKey string) (aws.Auth, error) {
+	if (s3p.opts.UseInstanceRole || s3p.opts.AssumeRoleARN != "") && (accessKey == "" || secretKey == "") {
+		return s3p.instanceRoleAuth()
+	}
+
+	s3p.log.Debug("creating new auth")
+	auth, err := aws.GetAuth(accessKey, secretKey)
+	if err != nil {
+		return auth, categorize(FailureCredentials, err)
+	}
+
+	if s3p.opts.SessionToken != "" {
+		auth.Token = s3p.opts.SessionToken
+	}
+	return auth, nil
+}
+
+// assumedRoleAuth is the temporary credentials of --assume-role-arn, got
+// with the base credentials.  They are kept for the rest of the run, and
+// last an hour.
+func (s3p *s3Provider) assumedRoleAuth(base aws.Auth) (aws.Auth, error) {
+	s3p.authLock.Lock()
+	defer s3p.authLock.Unlock()
+
+	if s3p.assumedAuth != nilAuth {
+		return s3p.assumedAuth, nil
+	}
+
+	auth, expiration, err := assumeRole(s3p.opts.httpClient(), base, s3p.opts.AssumeRoleARN, s3p.opts.roleSessionName())
+	if err != nil {
+		return nilAuth, err
+	}
+
+	s3p.log.WithFields(map[string]interface{}{
+		"role":       s3p.opts.AssumeRoleARN,
+		"expiration": expiration,
+	}).Debug("assumed role")
+	s3p.assumedAuth = auth
+	return auth, nil
+}
+
+// roleSessionName is --assume-role-session-name, or one naming the build
+// when there is one, which shows up in cloudtrail
+func (opts *Options) roleSessionName() string {
+	if opts.AssumeRoleSessionName != "" {
+		return opts.AssumeRoleSessionName
+	}
+
+	if build := os.Getenv("TRAVIS_BUILD_NUMBER"); build != "" {
+		return defaultRoleSessionName + "-" + build
+	}
+
+	return defaultRoleSessionName
+}
+
+func assumeRole(client *http.Client, base aws.Auth, roleARN, sessionName string) (aws.Auth, string, error) {
+	form := url.Values{
+		"Action":          []string{"AssumeRole"},
+		"Version":         []string{stsAPIVersion},
+		"RoleArn":         []string{roleARN},
+		"RoleSessionName": []string{sessionName},
+		"DurationSeconds": []string{assumeRoleDuration},
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", strings.TrimRight(stsEndpoint, "/")+"/", strings.NewReader(body))
+	if err != nil {
+		return nilAuth, "", err
+	}
+	req.Header.Set("Content-Type", stsContentType)
+	signV4(req, base, stsRegion, "sts", body, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nilAuth, "", fmt.Errorf("could not assume role %s: %v", roleARN, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		stsErr := &stsErrorResponse{}
+		xml.Unmarshal(respBody, stsErr)
+		err := fmt.Errorf("could not assume role %s: %s %s: %s", roleARN, resp.Status, stsErr.Code, stsErr.Message)
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusBadRequest {
+			return nilAuth, "", categorize(FailureCredentials, err)
+		}
+		return nilAuth, "", err
+	}
+
+	assumed := &assumeRoleResponse{}
+	if err := xml.Unmarshal(respBody, assumed); err != nil {
+		return nilAuth, "", fmt.Errorf("invalid assume role response: %v", err)
+	}
+
+	cred := assumed.Credentials
+	if cred.AccessKeyID == "" || cred.SecretAccessKey == "" {
+		return nilAuth, "", fmt.Errorf("assume role response for %s has no credentials", roleARN)
+	}
+
+	return aws.Auth{AccessKey: cred.AccessKeyID, SecretKey: cred.SecretAccessKey, Token: cred.SessionToken}, cred.Expiration, nil
+}
+
+// signV4 signs the request with signature version 4, which sts requires,
+// over its host and x-amz-* headers and the given body
+func signV4(req *http.Request, auth aws.Auth, region, service, body string, now time.Time) {
+	signV4Payload(req, auth, region, service, sha256Hex(body), now)
+}
+
+// signV4Payload is signV4 for a payload hash rather than a body, such as
+// sigV4UnsignedPayload for an s3 body that is only read once it is sent
+func signV4Payload(req *http.Request, auth aws.Auth, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	if auth.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", auth.Token)
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// goamz escapes the path into Opaque the way aws does, sometimes along
+	// with the host
+	path := req.URL.EscapedPath()
+	if req.URL.Opaque != "" {
+		path = req.URL.Opaque
+		if strings.HasPrefix(path, "//") {
+			path = "/" + strings.SplitN(path[2:], "/", 2)[1]
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQueryV4(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := sigV4Scope(region, service, now)
+	signature := sigV4Signature(auth.SecretKey, region, service, now, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, auth.AccessKey, scope, signedHeaders, signature))
+}
+
+// sigV4Scope is the date, region, and service that a signature is good
+// for
+func sigV4Scope(region, service string, now time.Time) string {
+	return strings.Join([]string{now.Format(sigV4DateFormat), region, service, "aws4_request"}, "/")
+}
+
+// sigV4Signature signs the canonical request with a key derived from the
+// secret for the scope
+func sigV4Signature(secretKey, region, service string, now time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		sigV4Scope(region, service, now),
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), now.Format(sigV4DateFormat))
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQueryV4 is the query sorted by key and value, with both
+// escaped the way aws does, spaces as %20
+func canonicalQueryV4(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return awsQueryEscape(keys[i]) < awsQueryEscape(keys[j]) })
+
+	params := []string{}
+	for _, k := range keys {
+		values := []string{}
+		for _, v := range query[k] {
+			values = append(values, awsQueryEscape(v))
+		}
+		sort.Strings(values)
+
+		for _, v := range values {
+			params = append(params, awsQueryEscape(k)+"="+v)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func awsQueryEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,227 @@
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+var testAssumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAASSUMED</AccessKeyId>
+      <SecretAccessKey>assumedsecret</SecretAccessKey>
+      <SessionToken>assumedtoken</SessionToken>
+      <Expiration>2014-10-14T19:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+// fakeSTS answers AssumeRole for requests signed with the one secret it
+// knows, checking the signature the way sts would
+type fakeSTS struct {
+	srv    *httptest.Server
+	secret string
+
+	lock     sync.Mutex
+	requests int
+	form     map[string]string
+	token    string
+}
+
+func withFakeSTS(secret string) (*fakeSTS, func()) {
+	fs := &fakeSTS{secret: secret, form: map[string]string{}}
+	fs.srv = httptest.NewServer(fs)
+
+	origEndpoint := stsEndpoint
+	stsEndpoint = fs.srv.URL
+
+	return fs, func() {
+		stsEndpoint = origEndpoint
+		fs.srv.Close()
+	}
+}
+
+func (fs *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.requests++
+
+	body, _ := ioutil.ReadAll(r.Body)
+	signed := r.Header.Get("Authorization")
+
+	check, _ := http.NewRequest(r.Method, fs.srv.URL+r.URL.Path, strings.NewReader(string(body)))
+	for k, v := range r.Header {
+		if k != "Authorization" {
+			check.Header[k] = v
+		}
+	}
+	date, _ := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	accessKey := strings.SplitN(strings.TrimPrefix(signed, sigV4Algorithm+" Credential="), "/", 2)[0]
+	signV4(check, aws.Auth{AccessKey: accessKey, SecretKey: fs.secret, Token: r.Header.Get("X-Amz-Security-Token")},
+		stsRegion, "sts", string(body), date)
+
+	if signed == "" || check.Header.Get("Authorization") != signed {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Code>SignatureDoesNotMatch</Code><Message>bad signature</Message></Error></ErrorResponse>`)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	r.ParseForm()
+	for k := range r.PostForm {
+		fs.form[k] = r.PostForm.Get(k)
+	}
+	fs.token = r.Header.Get("X-Amz-Security-Token")
+	w.Write([]byte(testAssumeRoleResponse))
+}
+
+func assumeRoleProvider() *s3Provider {
+	opts := NewOptions()
+	opts.AssumeRoleARN = "arn:aws:iam::123456789012:role/uploader"
+	return newS3Provider(opts, getPanicLogger())
+}
+
+func TestAssumeRoleAuth(t *testing.T) {
+	os.Clearenv()
+	fs, done := withFakeSTS("givensecret")
+	defer done()
+
+	s3p := assumeRoleProvider()
+	for i := 0; i < 2; i++ {
+		auth, err := s3p.getAuth("AKIAGIVEN", "givensecret")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if auth.AccessKey != "ASIAASSUMED" || auth.SecretKey != "assumedsecret" || auth.Token != "assumedtoken" {
+			t.Fatalf("unexpected auth %#v", auth)
+		}
+	}
+
+	if fs.requests != 1 {
+		t.Fatalf("sts requests %v != 1", fs.requests)
+	}
+
+	for k, v := range map[string]string{
+		"Action":          "AssumeRole",
+		"Version":         stsAPIVersion,
+		"RoleArn":         "arn:aws:iam::123456789012:role/uploader",
+		"RoleSessionName": "artifacts",
+		"DurationSeconds": "3600",
+	} {
+		if fs.form[k] != v {
+			t.Fatalf("%s %q != %q", k, fs.form[k], v)
+		}
+	}
+}
+
+func TestAssumeRoleAuthSessionName(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("TRAVIS_BUILD_NUMBER", "42")
+	fs, done := withFakeSTS("givensecret")
+	defer done()
+
+	s3p := assumeRoleProvider()
+	if _, err := s3p.getAuth("AKIAGIVEN", "givensecret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fs.form["RoleSessionName"] != "artifacts-42" {
+		t.Fatalf("session name %q != artifacts-42", fs.form["RoleSessionName"])
+	}
+
+	s3p = assumeRoleProvider()
+	s3p.opts.AssumeRoleSessionName = "deploy"
+	if _, err := s3p.getAuth("AKIAGIVEN", "givensecret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fs.form["RoleSessionName"] != "deploy" {
+		t.Fatalf("session name %q != deploy", fs.form["RoleSessionName"])
+	}
+}
+
+func TestAssumeRoleAuthRejected(t *testing.T) {
+	os.Clearenv()
+	_, done := withFakeSTS("othersecret")
+	defer done()
+
+	_, err := assumeRoleProvider().getAuth("AKIAGIVEN", "givensecret")
+	if err == nil || FailureCategory(err) != FailureCredentials {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAssumeRoleAuthWithEnvironmentCredentials(t *testing.T) {
+	fs, done := withFakeSTS("envsecret")
+	defer done()
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("metadata requested despite credentials in the environment")
+	})()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "ASIAENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	os.Setenv("AWS_SESSION_TOKEN", "envtoken")
+
+	auth, err := assumeRoleProvider().getAuth("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.AccessKey != "ASIAASSUMED" {
+		t.Fatalf("unexpected auth %#v", auth)
+	}
+
+	if fs.token != "envtoken" {
+		t.Fatalf("sts security token %q != envtoken", fs.token)
+	}
+}
+
+func TestSessionTokenAuth(t *testing.T) {
+	os.Clearenv()
+	s3p := newS3Provider(NewOptions(), getPanicLogger())
+	s3p.opts.SessionToken = "giventoken"
+
+	auth, err := s3p.getAuth("ASIAGIVEN", "givensecret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.AccessKey != "ASIAGIVEN" || auth.Token != "giventoken" {
+		t.Fatalf("unexpected auth %#v", auth)
+	}
+}
+
+func TestSessionTokenFromEnv(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("AWS_SESSION_TOKEN", "envtoken")
+
+	opts := NewOptions()
+	if opts.SessionToken != "envtoken" {
+		t.Fatalf("session token %q != envtoken", opts.SessionToken)
+	}
+}
+
+func TestValidateAssumeRoleWithoutKeys(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.AssumeRoleARN = "arn:aws:iam::123456789012:role/uploader"
+
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
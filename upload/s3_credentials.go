@@ -0,0 +1,199 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+var (
+	// instanceMetadataURL and containerCredentialsURL are vars so that
+	// tests can stand in for the services
+	instanceMetadataURL     = "http://169.254.169.254/latest"
+	containerCredentialsURL = "http://169.254.170.2"
+
+	// instanceMetadataTimeout is short, since off of ec2 there is nothing
+	// to answer at all
+	instanceMetadataTimeout = 2 * time.Second
+)
+
+const (
+	instanceMetadataTokenTTL = "21600"
+)
+
+// instanceCredentials are credentials as served by both the ec2 instance
+// metadata service and the ecs container credentials endpoint
+type instanceCredentials struct {
+	Code            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
+
+// instanceRoleAuth looks for credentials for --instance-role the way the
+// aws tools do: in the environment, then ~/.aws/credentials, then from
+// the ecs task role or the ec2 instance role.  The first found is kept
+// for the rest of the run.
+func (s3p *s3Provider) instanceRoleAuth() (aws.Auth, error) {
+	s3p.authLock.Lock()
+	defer s3p.authLock.Unlock()
+
+	if s3p.roleAuth != nilAuth {
+		return s3p.roleAuth, nil
+	}
+
+	auth, source, err := findAWSCredentials()
+	if err != nil {
+		return nilAuth, categorize(FailureCredentials, err)
+	}
+
+	s3p.log.WithField("source", source).Debug("found aws credentials")
+	s3p.roleAuth = auth
+	return auth, nil
+}
+
+func findAWSCredentials() (aws.Auth, string, error) {
+	if auth, err := aws.EnvAuth(); err == nil {
+		// goamz only knows the older name for the session token
+		if auth.Token == "" {
+			auth.Token = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		return auth, "environment", nil
+	}
+
+	if auth, err := aws.SharedAuth(); err == nil {
+		return auth, "shared credentials file", nil
+	}
+
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		auth, err := containerRoleAuth()
+		return auth, "ecs task role", err
+	}
+
+	auth, err := ec2RoleAuth()
+	if err != nil {
+		return nilAuth, "", fmt.Errorf("no aws credentials in the environment or shared credentials file, and %v", err)
+	}
+	return auth, "ec2 instance role", nil
+}
+
+func metadataClient() *http.Client {
+	// the metadata services are link-local, so never go through a proxy
+	return &http.Client{
+		Timeout:   instanceMetadataTimeout,
+		Transport: &http.Transport{},
+	}
+}
+
+func containerRoleAuth() (aws.Auth, error) {
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if url == "" {
+		url = containerCredentialsURL + os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nilAuth, fmt.Errorf("invalid ecs credentials url %q: %v", url, err)
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	body, status, err := metadataGet(req)
+	if err != nil {
+		return nilAuth, fmt.Errorf("could not reach the ecs credentials endpoint at %s: %v", url, err)
+	}
+	if status != http.StatusOK {
+		return nilAuth, fmt.Errorf("the ecs credentials endpoint at %s returned %d", url, status)
+	}
+
+	return parseInstanceCredentials(body)
+}
+
+// ec2RoleAuth gets the credentials of the instance's role, using a
+// session token if the metadata service hands one out (imdsv2) and going
+// without otherwise (imdsv1)
+func ec2RoleAuth() (aws.Auth, error) {
+	client := metadataClient()
+
+	token := ""
+	req, _ := http.NewRequest("PUT", instanceMetadataURL+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", instanceMetadataTokenTTL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nilAuth, fmt.Errorf("could not reach the ec2 instance metadata service at %s (is this an ec2 instance?): %v",
+			instanceMetadataURL, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		token = strings.TrimSpace(string(body))
+	}
+
+	get := func(path string) ([]byte, int, error) {
+		req, _ := http.NewRequest("GET", instanceMetadataURL+"/meta-data/iam/security-credentials/"+path, nil)
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		return metadataGet(req)
+	}
+
+	body, status, err := get("")
+	if err != nil {
+		return nilAuth, fmt.Errorf("could not reach the ec2 instance metadata service at %s: %v", instanceMetadataURL, err)
+	}
+
+	role := strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0])
+	if status == http.StatusNotFound || (status == http.StatusOK && role == "") {
+		return nilAuth, fmt.Errorf("the ec2 instance has no iam role attached")
+	}
+	if status != http.StatusOK {
+		return nilAuth, fmt.Errorf("the ec2 instance metadata service returned %d for the instance role", status)
+	}
+
+	body, status, err = get(role)
+	if err != nil {
+		return nilAuth, fmt.Errorf("could not reach the ec2 instance metadata service at %s: %v", instanceMetadataURL, err)
+	}
+	if status != http.StatusOK {
+		return nilAuth, fmt.Errorf("the ec2 instance metadata service returned %d for the credentials of role %q", status, role)
+	}
+
+	return parseInstanceCredentials(body)
+}
+
+func metadataGet(req *http.Request) ([]byte, int, error) {
+	resp, err := metadataClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
+
+func parseInstanceCredentials(body []byte) (aws.Auth, error) {
+	cred := &instanceCredentials{}
+	if err := json.Unmarshal(body, cred); err != nil {
+		return nilAuth, fmt.Errorf("invalid instance role credentials: %v", err)
+	}
+
+	// ecs leaves the code out, and ec2 says Success
+	if cred.Code != "" && cred.Code != "Success" {
+		return nilAuth, fmt.Errorf("instance role credentials are unavailable: %s", cred.Code)
+	}
+
+	if cred.AccessKeyID == "" || cred.SecretAccessKey == "" {
+		return nilAuth, fmt.Errorf("instance role credentials are missing the key or secret")
+	}
+
+	return aws.Auth{AccessKey: cred.AccessKeyID, SecretKey: cred.SecretAccessKey, Token: cred.Token}, nil
+}
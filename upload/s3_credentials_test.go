@@ -0,0 +1,192 @@
+package upload
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testInstanceCredentials = `{
+  "Code": "Success",
+  "Type": "AWS-HMAC",
+  "AccessKeyId": "ASIAROLE",
+  "SecretAccessKey": "rolesecret",
+  "Token": "roletoken",
+  "Expiration": "2014-10-14T18:00:00Z"
+}`
+
+// withInstanceMetadata points the ec2 and ecs credential lookups at the
+// handler, with nothing in the environment or shared credentials file
+func withInstanceMetadata(t *testing.T, handler http.HandlerFunc) func() {
+	os.Clearenv()
+	dir, err := ioutil.TempDir("", "artifacts-credentials-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	os.Setenv("HOME", dir)
+
+	server := httptest.NewServer(handler)
+	origMetadata, origContainer := instanceMetadataURL, containerCredentialsURL
+	instanceMetadataURL = server.URL + "/latest"
+	containerCredentialsURL = server.URL
+
+	return func() {
+		instanceMetadataURL, containerCredentialsURL = origMetadata, origContainer
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func instanceRoleProvider() *s3Provider {
+	opts := NewOptions()
+	opts.UseInstanceRole = true
+	return newS3Provider(opts, getPanicLogger())
+}
+
+func TestInstanceRoleAuthEC2(t *testing.T) {
+	requests := []string{}
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "PUT" {
+			w.Write([]byte("sessiontoken"))
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "sessiontoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("builder\n"))
+		case "/latest/meta-data/iam/security-credentials/builder":
+			w.Write([]byte(testInstanceCredentials))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})()
+
+	s3p := instanceRoleProvider()
+	auth, err := s3p.getAuth("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.AccessKey != "ASIAROLE" || auth.SecretKey != "rolesecret" || auth.Token != "roletoken" {
+		t.Fatalf("unexpected auth %#v", auth)
+	}
+
+	// the credentials are looked up once for all of the workers
+	if _, err := s3p.getAuth("", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("metadata requests %v != 3", requests)
+	}
+}
+
+func TestInstanceRoleAuthNoRole(t *testing.T) {
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})()
+
+	_, err := instanceRoleProvider().getAuth("", "")
+	if err == nil || !strings.Contains(err.Error(), "the ec2 instance has no iam role attached") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if FailureCategory(err) != FailureCredentials {
+		t.Fatalf("error %v is not a credentials failure", err)
+	}
+}
+
+func TestInstanceRoleAuthUnreachable(t *testing.T) {
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {})()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	instanceMetadataURL = server.URL
+	server.Close()
+
+	_, err := instanceRoleProvider().getAuth("", "")
+	if err == nil || !strings.Contains(err.Error(), "could not reach the ec2 instance metadata service") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestInstanceRoleAuthECS(t *testing.T) {
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/credentials/task" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"AccessKeyId": "ASIATASK", "SecretAccessKey": "tasksecret", "Token": "tasktoken"}`))
+	})()
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/task")
+
+	auth, err := instanceRoleProvider().getAuth("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.AccessKey != "ASIATASK" || auth.Token != "tasktoken" {
+		t.Fatalf("unexpected auth %#v", auth)
+	}
+}
+
+func TestInstanceRoleAuthSharedFile(t *testing.T) {
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("metadata requested despite a shared credentials file")
+	})()
+
+	awsDir := filepath.Join(os.Getenv("HOME"), ".aws")
+	os.Mkdir(awsDir, 0755)
+	err := ioutil.WriteFile(filepath.Join(awsDir, "credentials"),
+		[]byte("[default]\naws_access_key_id = AKIASHARED\naws_secret_access_key = sharedsecret\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	auth, err := instanceRoleProvider().getAuth("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.AccessKey != "AKIASHARED" || auth.SecretKey != "sharedsecret" {
+		t.Fatalf("unexpected auth %#v", auth)
+	}
+}
+
+func TestInstanceRoleAuthExplicitKeys(t *testing.T) {
+	defer withInstanceMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("metadata requested despite explicit keys")
+	})()
+
+	auth, err := instanceRoleProvider().getAuth("AKIAGIVEN", "givensecret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.AccessKey != "AKIAGIVEN" {
+		t.Fatalf("unexpected auth %#v", auth)
+	}
+}
+
+func TestValidateInstanceRoleWithoutKeys(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.BucketName = "foo"
+
+	if err := opts.Validate(); err == nil || err.Error() != "no access key given" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.UseInstanceRole = true
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
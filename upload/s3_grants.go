@@ -0,0 +1,92 @@
+package upload
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	s3CanonicalIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	s3EmailRegexp       = regexp.MustCompile(`^[^@\s"]+@[^@\s"]+$`)
+	s3GranteeURIRegexp  = regexp.MustCompile(`^https?://[^\s"]+$`)
+)
+
+// s3GrantHeaders builds the x-amz-grant-* headers for the grant options.
+// S3 does not accept these alongside a canned ACL, so --permissions is
+// not sent when any are given.
+func (opts *Options) s3GrantHeaders() (map[string][]string, error) {
+	headers := map[string][]string{}
+
+	for header, spec := range map[string]string{
+		"x-amz-grant-read":         opts.GrantRead,
+		"x-amz-grant-full-control": opts.GrantFullControl,
+	} {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+
+		grantees, err := parseS3Grantees(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		headers[header] = []string{strings.Join(grantees, ", ")}
+	}
+
+	return headers, nil
+}
+
+func (opts *Options) hasS3Grants() bool {
+	return strings.TrimSpace(opts.GrantRead) != "" || strings.TrimSpace(opts.GrantFullControl) != ""
+}
+
+// parseS3Grantees turns a comma-separated list of grantees into the form
+// used in grant headers.  Each grantee is "id=<canonical user id>",
+// "email=<address>", or "uri=<group uri>", or else a bare canonical id or
+// email address.
+func parseS3Grantees(spec string) ([]string, error) {
+	grantees := []string{}
+
+	for _, grantee := range strings.Split(spec, ",") {
+		grantee = strings.TrimSpace(grantee)
+		if grantee == "" {
+			continue
+		}
+
+		kind, value := "", grantee
+		if parts := strings.SplitN(grantee, "=", 2); len(parts) == 2 {
+			kind, value = strings.ToLower(parts[0]), parts[1]
+		} else if s3CanonicalIDRegexp.MatchString(grantee) {
+			kind = "id"
+		} else if s3EmailRegexp.MatchString(grantee) {
+			kind = "email"
+		}
+
+		switch kind {
+		case "id":
+			if !s3CanonicalIDRegexp.MatchString(value) {
+				return nil, fmt.Errorf("invalid grantee %q: canonical ids are 64 hex characters", grantee)
+			}
+			grantees = append(grantees, fmt.Sprintf(`id="%s"`, value))
+		case "email", "emailaddress":
+			if !s3EmailRegexp.MatchString(value) {
+				return nil, fmt.Errorf("invalid grantee %q: bad email address", grantee)
+			}
+			grantees = append(grantees, fmt.Sprintf(`emailAddress="%s"`, value))
+		case "uri":
+			if !s3GranteeURIRegexp.MatchString(value) {
+				return nil, fmt.Errorf("invalid grantee %q: bad uri", grantee)
+			}
+			grantees = append(grantees, fmt.Sprintf(`uri="%s"`, value))
+		default:
+			return nil, fmt.Errorf("invalid grantee %q: expected id=, email=, or uri=", grantee)
+		}
+	}
+
+	if len(grantees) == 0 {
+		return nil, fmt.Errorf("no grantees in %q", spec)
+	}
+
+	return grantees, nil
+}
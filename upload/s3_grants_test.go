@@ -0,0 +1,92 @@
+package upload
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+const (
+	testCanonicalID = "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be"
+)
+
+type s3GranteeCase struct {
+	spec     string
+	expected []string
+}
+
+var s3GranteeCases = []*s3GranteeCase{
+	&s3GranteeCase{"id=" + testCanonicalID, []string{`id="` + testCanonicalID + `"`}},
+	&s3GranteeCase{testCanonicalID, []string{`id="` + testCanonicalID + `"`}},
+	&s3GranteeCase{"email=ops@example.com", []string{`emailAddress="ops@example.com"`}},
+	&s3GranteeCase{"ops@example.com", []string{`emailAddress="ops@example.com"`}},
+	&s3GranteeCase{
+		"uri=http://acs.amazonaws.com/groups/global/AllUsers, id=" + testCanonicalID,
+		[]string{`uri="http://acs.amazonaws.com/groups/global/AllUsers"`, `id="` + testCanonicalID + `"`},
+	},
+	&s3GranteeCase{"id=nope", nil},
+	&s3GranteeCase{"email=nope", nil},
+	&s3GranteeCase{"uri=ftp://example.com", nil},
+	&s3GranteeCase{"group=everyone", nil},
+	&s3GranteeCase{"somebody", nil},
+	&s3GranteeCase{" , ", nil},
+}
+
+func TestParseS3Grantees(t *testing.T) {
+	for _, c := range s3GranteeCases {
+		grantees, err := parseS3Grantees(c.spec)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("invalid grantees %q were accepted: %v", c.spec, grantees)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", c.spec, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(grantees, c.expected) {
+			t.Errorf("grantees %v != %v", grantees, c.expected)
+		}
+	}
+}
+
+func TestValidateS3Grants(t *testing.T) {
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.AccessKey = "key"
+	opts.SecretKey = "secret"
+	opts.GrantRead = "somebody"
+
+	if opts.Validate() == nil {
+		t.Fatalf("invalid grantee was accepted")
+	}
+}
+
+func TestS3ProviderGrantHeaders(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.GrantRead = "uri=http://acs.amazonaws.com/groups/global/AllUsers"
+	opts.GrantFullControl = "id=" + testCanonicalID
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	if req.Header.Get("X-Amz-Grant-Read") != `uri="http://acs.amazonaws.com/groups/global/AllUsers"` {
+		t.Fatalf("unexpected grant read header: %q", req.Header.Get("X-Amz-Grant-Read"))
+	}
+
+	if req.Header.Get("X-Amz-Grant-Full-Control") != `id="`+testCanonicalID+`"` {
+		t.Fatalf("unexpected grant full control header: %q", req.Header.Get("X-Amz-Grant-Full-Control"))
+	}
+
+	if _, ok := req.Header["X-Amz-Acl"]; ok {
+		t.Fatalf("canned acl was sent with grants: %v", req.Header.Get("X-Amz-Acl"))
+	}
+}
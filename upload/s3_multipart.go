@@ -0,0 +1,331 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// defaultMultipartPartSize is the smallest part size S3 accepts for
+	// all but the last part
+	defaultMultipartPartSize = int64(5 * 1024 * 1024)
+)
+
+var (
+	multipartPartConcurrency = 4
+
+	// maxSinglePutSize is the largest object S3 accepts in a single put,
+	// and maxMultipartParts the most parts in a multipart upload
+	maxSinglePutSize  = uint64(5 * 1024 * 1024 * 1024)
+	maxMultipartParts = int64(10000)
+)
+
+// useMultipart is true for artifacts of at least --multipart-threshold,
+// and for those too big for a single put even if multipart is disabled
+func (s3p *s3Provider) useMultipart(opts *Options, a *artifact.Artifact, size uint64) bool {
+	return ((opts.MultipartThreshold > 0 && size >= opts.MultipartThreshold) || size > maxSinglePutSize) &&
+		(a.Source != "" || a.IsStream()) &&
+		int64(size) > s3p.ChunkSize()
+}
+
+// partSize is the provider's part size, grown as needed to fit the
+// artifact into as many parts as S3 allows
+func (s3p *s3Provider) partSize(size int64) int64 {
+	partSize := s3p.ChunkSize()
+	if min := (size + maxMultipartParts - 1) / maxMultipartParts; min > partSize {
+		partSize = min
+	}
+	return partSize
+}
+
+// maxConcurrentMultipart is --max-concurrent-multipart, or half of the
+// most workers --concurrency allows, since each multipart upload has parts
+// of its own in flight
+func (opts *Options) maxConcurrentMultipart() uint64 {
+	if opts.MaxConcurrentMultipart > 0 {
+		return opts.MaxConcurrentMultipart
+	}
+
+	workers := opts.maxWorkers()
+	if workers < 2 {
+		return 1
+	}
+
+	return workers / 2
+}
+
+// multipartUpload uploads the artifact in parts read concurrently from a
+// single open file, aborting the multipart upload if any part fails
+func (s3p *s3Provider) multipartUpload(ctx context.Context, opts *Options, b *s3.Bucket, a *artifact.Artifact, ctype string, size int64) error {
+	s3p.multipartSlots <- true
+	defer func() { <-s3p.multipartSlots }()
+
+	if a.SizeUnknown() {
+		return s3p.unsizedMultipartUpload(ctx, opts, b, a, ctype)
+	}
+
+	if a.IsStream() {
+		return s3p.streamedMultipartUpload(ctx, opts, b, a, ctype, size)
+	}
+
+	release := artifact.AcquireOpenFile()
+	defer release()
+
+	f, err := s3p.openFile(a.ContentSource())
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	dest := a.FullDest()
+	multi, err := b.InitMulti(dest, ctype, a.Perm)
+	if err != nil {
+		return err
+	}
+
+	partSize := s3p.partSize(size)
+	nParts := int((size + partSize - 1) / partSize)
+	parts := make([]s3.Part, nParts)
+	errs := make(chan error, nParts)
+	sem := make(chan bool, multipartPartConcurrency)
+	wg := &sync.WaitGroup{}
+
+	s3p.log.WithFields(logrus.Fields{
+		"artifact":  a.Source,
+		"parts":     nParts,
+		"part_size": partSize,
+	}).Debug("starting multipart upload")
+
+	for i := 0; i < nParts; i++ {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		wg.Add(1)
+		go func(i int, section *io.SectionReader) {
+			defer wg.Done()
+
+			sem <- true
+			defer func() { <-sem }()
+
+			part, err := s3p.uploadPart(ctx, opts, multi, i+1, section)
+			if err != nil {
+				errs <- err
+				return
+			}
+			parts[i] = part
+		}(i, io.NewSectionReader(f, offset, length))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		if abortErr := detachedMulti(multi).Abort(); abortErr != nil {
+			s3p.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"err":      abortErr,
+			}).Warn("failed to abort multipart upload")
+		}
+		return err
+	}
+
+	return multi.Complete(parts)
+}
+
+// streamedMultipartUpload uploads a stream artifact one part at a time,
+// holding only the current part in memory, and aborts the multipart
+// upload if the stream does not hold exactly the expected size
+func (s3p *s3Provider) streamedMultipartUpload(ctx context.Context, opts *Options, b *s3.Bucket, a *artifact.Artifact, ctype string, size int64) error {
+	r, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	dest := a.FullDest()
+	multi, err := b.InitMulti(dest, ctype, a.Perm)
+	if err != nil {
+		return err
+	}
+
+	partSize := s3p.partSize(size)
+	nParts := int((size + partSize - 1) / partSize)
+	parts := make([]s3.Part, 0, nParts)
+	buf, release := partBuffer(partSize)
+	defer release()
+
+	s3p.log.WithFields(logrus.Fields{
+		"artifact":  a.Dest,
+		"parts":     nParts,
+		"part_size": partSize,
+	}).Debug("starting streamed multipart upload")
+
+	abort := func(err error) error {
+		if abortErr := detachedMulti(multi).Abort(); abortErr != nil {
+			s3p.log.WithFields(logrus.Fields{
+				"artifact": a.Dest,
+				"err":      abortErr,
+			}).Warn("failed to abort multipart upload")
+		}
+		return err
+	}
+
+	for i := 0; i < nParts; i++ {
+		length := partSize
+		if remaining := size - int64(i)*partSize; remaining < length {
+			length = remaining
+		}
+
+		n, err := io.ReadFull(r, buf[:length])
+		if err != nil {
+			return abort(err)
+		}
+
+		part, err := s3p.uploadPart(ctx, opts, multi, i+1, io.NewSectionReader(bytes.NewReader(buf[:n]), 0, int64(n)))
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, part)
+	}
+
+	// reading past the end makes the stream report any extra bytes
+	if _, err := r.Read(buf[:1]); err != nil && err != io.EOF {
+		return abort(err)
+	}
+
+	return multi.Complete(parts)
+}
+
+// unsizedMultipartUpload uploads a stream of unknown size one part at a
+// time as it arrives, holding only the current part in memory, until the
+// stream ends.  Since the number of parts isn't known up front, every part
+// is the provider's part size, which limits the stream to as many parts
+// as S3 allows, and the stream is also held to --max-size.
+func (s3p *s3Provider) unsizedMultipartUpload(ctx context.Context, opts *Options, b *s3.Bucket, a *artifact.Artifact, ctype string) error {
+	r, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	dest := a.FullDest()
+	multi, err := b.InitMulti(dest, ctype, a.Perm)
+	if err != nil {
+		return err
+	}
+
+	partSize := s3p.ChunkSize()
+	s3p.log.WithFields(logrus.Fields{
+		"artifact":  a.Dest,
+		"part_size": partSize,
+	}).Debug("starting multipart upload of unknown size")
+
+	abort := func(err error) error {
+		if abortErr := detachedMulti(multi).Abort(); abortErr != nil {
+			s3p.log.WithFields(logrus.Fields{
+				"artifact": a.Dest,
+				"err":      abortErr,
+			}).Warn("failed to abort multipart upload")
+		}
+		return err
+	}
+
+	parts := []s3.Part{}
+	buf, release := partBuffer(partSize)
+	defer release()
+	total := uint64(0)
+
+	for i := int64(1); ; i++ {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return abort(err)
+		}
+
+		// a stream ending on a part boundary leaves nothing for another
+		if n == 0 && len(parts) > 0 {
+			break
+		}
+
+		total += uint64(n)
+		if total > opts.MaxSize {
+			return abort(categorize(FailureSizeLimit,
+				fmt.Errorf("stream is larger than the max-size of %s", humanize.Bytes(opts.MaxSize))))
+		}
+
+		if i > maxMultipartParts {
+			return abort(fmt.Errorf("stream is larger than %d parts of %s", maxMultipartParts,
+				humanize.Bytes(uint64(partSize))))
+		}
+
+		part, err := s3p.uploadPart(ctx, opts, multi, int(i), io.NewSectionReader(bytes.NewReader(buf[:n]), 0, int64(n)))
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, part)
+
+		if last {
+			break
+		}
+	}
+
+	return multi.Complete(parts)
+}
+
+func (s3p *s3Provider) uploadPart(ctx context.Context, opts *Options, multi *s3.Multi, n int, section *io.SectionReader) (s3.Part, error) {
+	retries := uint64(0)
+
+	for {
+		part, err := multi.PutPart(n, section)
+		if err == nil {
+			return part, nil
+		}
+
+		if !retryable(err) || retries >= opts.Retries || opts.pastRetryDeadline() || ctx.Err() != nil {
+			return part, err
+		}
+
+		retries++
+		sleep := opts.retryBackoff(s3p.RetryInterval, retries)
+		s3p.log.WithFields(logrus.Fields{
+			"part":  n,
+			"retry": retries,
+			"sleep": sleep,
+			"err":   err,
+		}).Debug("retrying part")
+		if err := sleepContext(ctx, sleep); err != nil {
+			return part, err
+		}
+	}
+}
+
+// detachedMulti is the multipart upload with its requests detached from
+// the upload's context, so that it can still be aborted, and its parts
+// not left behind, once the upload is canceled
+func detachedMulti(multi *s3.Multi) *s3.Multi {
+	conn := *multi.Bucket.S3
+	baseClient := conn.HTTPClient
+	conn.HTTPClient = func() *http.Client {
+		client := *http.DefaultClient
+		if baseClient != nil {
+			client = *baseClient()
+		}
+		client.Transport = &detachedTransport{transport: client.Transport}
+		return &client
+	}
+
+	bucket := *multi.Bucket
+	bucket.S3 = &conn
+	return &s3.Multi{Bucket: &bucket, Key: multi.Key, UploadId: multi.UploadId}
+}
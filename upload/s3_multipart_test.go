@@ -0,0 +1,407 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// multipartS3Server implements just enough of the S3 multipart upload api
+// to exercise the s3 provider
+type multipartS3Server struct {
+	sync.Mutex
+	Parts     map[string]string
+	Headers   map[string]http.Header
+	Completed bool
+	Aborted   bool
+	FailPart  string
+	failed    bool
+
+	// PartDelay keeps multipart uploads in flight long enough to overlap,
+	// and Active and MaxActive count how many were in flight at once
+	PartDelay time.Duration
+	Active    int
+	MaxActive int
+}
+
+func (ms *multipartS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("partNumber") != "" {
+		time.Sleep(ms.PartDelay)
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	switch {
+	case r.Method == "POST" && q["uploads"] != nil:
+		ms.Headers["init"] = r.Header
+		ms.Active++
+		if ms.Active > ms.MaxActive {
+			ms.MaxActive = ms.Active
+		}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>up-1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == "PUT" && q.Get("partNumber") != "":
+		n := q.Get("partNumber")
+		body, _ := ioutil.ReadAll(r.Body)
+		if n == ms.FailPart && !ms.failed {
+			ms.failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "<Error><Code>SlowDown</Code></Error>")
+			return
+		}
+		ms.Parts[n] = string(body)
+		w.Header().Set("ETag", `"etag-`+n+`"`)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		ms.Completed = true
+		ms.Active--
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		ms.Aborted = true
+		ms.Active--
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		ms.Headers["put"] = r.Header
+	}
+}
+
+func getMultipartTestProvider(t *testing.T, retries uint64) (*s3Provider, *multipartS3Server, *httptest.Server, *int) {
+	ms := &multipartS3Server{Parts: map[string]string{}, Headers: map[string]http.Header{}}
+	srv := httptest.NewServer(ms)
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.Retries = retries
+	opts.MultipartThreshold = 10
+
+	s3p := newS3Provider(opts, getPanicLogger())
+	s3p.RetryInterval = 0
+	s3p.MultipartPartSize = 4
+	s3p.overrideConn = s3.New(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"},
+		aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	opens := 0
+	s3p.openFile = func(name string) (*os.File, error) {
+		opens++
+		return os.Open(name)
+	}
+
+	return s3p, ms, srv, &opens
+}
+
+func uploadMultipartTestFile(t *testing.T, s3p *s3Provider, content string) error {
+	dir := writeTestFiles(t, map[string]string{"big.bin": content})
+	defer os.RemoveAll(dir)
+
+	a := artifact.New("bucket", filepath.Join(dir, "big.bin"), "big.bin", &artifact.Options{
+		Perm: s3.PublicRead,
+	})
+
+	b := s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket")
+	return s3p.rawUpload(context.Background(), s3p.opts, b, a)
+}
+
+func TestS3ProviderMultipartUpload(t *testing.T) {
+	s3p, ms, srv, opens := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+
+	err := uploadMultipartTestFile(t, s3p, "0123456789abcdefghij!")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if *opens != 1 {
+		t.Fatalf("file opened %v times != 1", *opens)
+	}
+
+	expected := map[string]string{"1": "0123", "2": "4567", "3": "89ab", "4": "cdef", "5": "ghij", "6": "!"}
+	for n, body := range expected {
+		if ms.Parts[n] != body {
+			t.Fatalf("part %v %q != %q", n, ms.Parts[n], body)
+		}
+	}
+
+	if !ms.Completed || ms.Aborted {
+		t.Fatalf("multipart upload not completed (completed=%v aborted=%v)", ms.Completed, ms.Aborted)
+	}
+
+	if ms.Headers["init"].Get("Cache-Control") != s3p.opts.CacheControl {
+		t.Fatalf("cache control %q != %q", ms.Headers["init"].Get("Cache-Control"), s3p.opts.CacheControl)
+	}
+}
+
+func TestS3ProviderMultipartUploadRetriesPart(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 1)
+	defer srv.Close()
+	ms.FailPart = "2"
+
+	err := uploadMultipartTestFile(t, s3p, strings.Repeat("x", 12))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ms.Parts["2"] != "xxxx" || !ms.Completed {
+		t.Fatalf("failed part was not retried: %v", ms.Parts)
+	}
+}
+
+func TestS3ProviderMultipartUploadAbortsOnFailure(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+	ms.FailPart = "2"
+
+	err := uploadMultipartTestFile(t, s3p, strings.Repeat("x", 12))
+	if err == nil {
+		t.Fatalf("failed part did not fail the upload")
+	}
+
+	if !ms.Aborted || ms.Completed {
+		t.Fatalf("multipart upload not aborted (completed=%v aborted=%v)", ms.Completed, ms.Aborted)
+	}
+}
+
+func TestS3ProviderSmallFileSkipsMultipart(t *testing.T) {
+	s3p, ms, srv, opens := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+
+	err := uploadMultipartTestFile(t, s3p, "tiny")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if *opens != 0 || len(ms.Parts) != 0 || ms.Headers["put"] == nil {
+		t.Fatalf("small file did not use a single put")
+	}
+}
+
+func TestS3ProviderMultipartUploadGrowsPartSize(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+
+	defer func(n int64) { maxMultipartParts = n }(maxMultipartParts)
+	maxMultipartParts = 3
+
+	err := uploadMultipartTestFile(t, s3p, "0123456789abcdefghij!")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{"1": "0123456", "2": "789abcd", "3": "efghij!"}
+	if len(ms.Parts) != len(expected) {
+		t.Fatalf("parts %v != %v", ms.Parts, expected)
+	}
+
+	for n, body := range expected {
+		if ms.Parts[n] != body {
+			t.Fatalf("part %v %q != %q", n, ms.Parts[n], body)
+		}
+	}
+}
+
+func TestS3ProviderMultipartUploadOverSinglePutLimit(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+	s3p.opts.MultipartThreshold = 0
+
+	defer func(n uint64) { maxSinglePutSize = n }(maxSinglePutSize)
+	maxSinglePutSize = 8
+
+	err := uploadMultipartTestFile(t, s3p, "0123456")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(ms.Parts) != 0 || ms.Headers["put"] == nil {
+		t.Fatalf("file under the single put limit did not use a single put")
+	}
+
+	err = uploadMultipartTestFile(t, s3p, "0123456789abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(ms.Parts) != 4 || !ms.Completed {
+		t.Fatalf("file over the single put limit was not uploaded in parts: %v", ms.Parts)
+	}
+}
+
+func TestS3ProviderStreamedMultipartUpload(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+
+	content := "0123456789abcdefghij!"
+	a := artifact.NewFromStream("bucket", "big.bin", strings.NewReader(content), uint64(len(content)), &artifact.Options{
+		Perm: s3.PublicRead,
+	})
+
+	b := s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket")
+	if err := s3p.rawUpload(context.Background(), s3p.opts, b, a); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(ms.Parts) != 6 || ms.Parts["1"] != "0123" || ms.Parts["6"] != "!" {
+		t.Fatalf("unexpected parts: %v", ms.Parts)
+	}
+
+	if !ms.Completed || ms.Aborted {
+		t.Fatalf("multipart upload not completed (completed=%v aborted=%v)", ms.Completed, ms.Aborted)
+	}
+}
+
+func TestS3ProviderStreamedMultipartUploadSizeMismatch(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+
+	a := artifact.NewFromStream("bucket", "big.bin", strings.NewReader(strings.Repeat("x", 13)), 12, &artifact.Options{})
+
+	b := s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket")
+	if err := s3p.rawUpload(context.Background(), s3p.opts, b, a); err == nil {
+		t.Fatalf("oversized stream did not fail the upload")
+	}
+
+	if !ms.Aborted || ms.Completed {
+		t.Fatalf("multipart upload not aborted (completed=%v aborted=%v)", ms.Completed, ms.Aborted)
+	}
+}
+
+func TestS3ProviderUnsizedMultipartUpload(t *testing.T) {
+	for content, expected := range map[string]map[string]string{
+		"0123456789!": {"1": "0123", "2": "4567", "3": "89!"},
+		// the stream ends with its last full part
+		"01234567": {"1": "0123", "2": "4567"},
+		"":         {"1": ""},
+	} {
+		s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+
+		a := artifact.NewFromUnsizedStream("bucket", "build.log", strings.NewReader(content), &artifact.Options{})
+		b := s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket")
+		if err := s3p.rawUpload(context.Background(), s3p.opts, b, a); err != nil {
+			t.Fatalf("%q: unexpected error: %v", content, err)
+		}
+		srv.Close()
+
+		if !reflect.DeepEqual(ms.Parts, expected) || !ms.Completed || ms.Aborted {
+			t.Fatalf("%q: parts %v != %v (completed=%v aborted=%v)", content, ms.Parts, expected, ms.Completed, ms.Aborted)
+		}
+
+		if size, _ := a.Size(); size != uint64(len(content)) {
+			t.Fatalf("%q: size after upload %v != %v", content, size, len(content))
+		}
+	}
+}
+
+func TestS3ProviderUnsizedMultipartUploadMaxSize(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+	s3p.opts.MaxSize = 10
+
+	a := artifact.NewFromUnsizedStream("bucket", "build.log", strings.NewReader(strings.Repeat("x", 11)), &artifact.Options{})
+	b := s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket")
+	err := s3p.rawUpload(context.Background(), s3p.opts, b, a)
+	if err == nil || FailureCategory(err) != FailureSizeLimit {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !ms.Aborted || ms.Completed {
+		t.Fatalf("multipart upload not aborted (completed=%v aborted=%v)", ms.Completed, ms.Aborted)
+	}
+}
+
+func TestS3ProviderMaxConcurrentMultipart(t *testing.T) {
+	s3p, ms, srv, _ := getMultipartTestProvider(t, 0)
+	defer srv.Close()
+	ms.PartDelay = 5 * time.Millisecond
+
+	s3p.opts.Concurrency = 6
+	s3p.opts.MaxConcurrentMultipart = 2
+	s3p.multipartSlots = make(chan bool, s3p.opts.maxConcurrentMultipart())
+	s3p.overrideAuth = aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}
+	s3p.openFile = os.Open
+
+	files := map[string]string{}
+	for i := 0; i < 6; i++ {
+		files[fmt.Sprintf("big-%d.bin", i)] = strings.Repeat("x", 12)
+	}
+	dir := writeTestFiles(t, files)
+	defer os.RemoveAll(dir)
+
+	in := make(chan *artifact.Artifact)
+	out := make(chan *artifact.Artifact)
+	done := make(chan bool)
+
+	for i := 0; i < 6; i++ {
+		go s3p.Upload(context.Background(), fmt.Sprintf("%d", i), s3p.opts, in, out, done)
+	}
+
+	go func() {
+		for name := range files {
+			in <- artifact.New("bucket", filepath.Join(dir, name), name, &artifact.Options{})
+		}
+		close(in)
+	}()
+
+	finished := 0
+	for finished < 6 {
+		select {
+		case a := <-out:
+			if !a.UploadResult.OK {
+				t.Fatalf("upload failed: %v", a.UploadResult.Err)
+			}
+		case <-done:
+			finished++
+		}
+	}
+
+	if ms.MaxActive != 2 {
+		t.Fatalf("max active multipart uploads %v != 2", ms.MaxActive)
+	}
+}
+
+func TestMaxConcurrentMultipartDefault(t *testing.T) {
+	opts := NewOptions()
+	for concurrency, expected := range map[uint64]uint64{1: 1, 2: 1, 5: 2, 10: 5} {
+		opts.Concurrency = concurrency
+		if opts.maxConcurrentMultipart() != expected {
+			t.Fatalf("concurrency %v: max concurrent multipart %v != %v",
+				concurrency, opts.maxConcurrentMultipart(), expected)
+		}
+	}
+}
+
+func TestMultipartChunkSizeOption(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	os.Setenv("ARTIFACTS_MULTIPART_CHUNK_SIZE", "67108864")
+	opts := NewOptions()
+	if s3p := newS3Provider(opts, getPanicLogger()); s3p.MultipartPartSize != 64*1024*1024 {
+		t.Fatalf("part size %v != 64MiB", s3p.MultipartPartSize)
+	}
+
+	opts.Provider = "s3"
+	opts.BucketName = "bucket"
+	opts.AccessKey = "whatever"
+	opts.SecretKey = "whatever"
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.MultipartChunkSize = 1024 * 1024
+	err := opts.Validate()
+	if err == nil || err.Error() != "--multipart-chunk-size must be between 5MiB and 5GiB, not 1.0MiB" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
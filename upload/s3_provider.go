@@ -1,7 +1,13 @@
 package upload
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -11,32 +17,70 @@ import (
 	"github.com/travis-ci/artifacts/artifact"
 )
 
+const (
+	s3ProviderRetries = 4
+)
+
 var (
 	nilAuth aws.Auth
 )
 
 type s3Provider struct {
-	RetryInterval time.Duration
+	RetryInterval     time.Duration
+	MultipartPartSize int64
 
 	opts *Options
 	log  *logrus.Logger
 
 	overrideConn *s3.S3
 	overrideAuth aws.Auth
+
+	// roleAuth is the credentials found for --instance-role, shared by
+	// all of the workers
+	roleAuth aws.Auth
+	// assumedAuth is the temporary credentials of --assume-role-arn
+	assumedAuth aws.Auth
+	authLock    sync.Mutex
+
+	openFile func(string) (*os.File, error)
+
+	// multipartSlots is shared by all of the workers, so that only so
+	// many big files are uploading their parts at once
+	multipartSlots chan bool
+
+	// runTagging is the x-amz-tagging header for --auto-tag-run
+	runTagging string
 }
 
 func newS3Provider(opts *Options, log *logrus.Logger) *s3Provider {
+	runTagging := ""
+	if opts.AutoTagRun {
+		runTagging = autoRunTagging(log)
+	}
+
+	partSize := int64(opts.MultipartChunkSize)
+	if partSize == 0 {
+		partSize = defaultMultipartPartSize
+	}
+
 	return &s3Provider{
-		RetryInterval: defaultProviderRetryInterval,
+		RetryInterval:     opts.retryInterval(defaultProviderRetryInterval),
+		MultipartPartSize: partSize,
 
 		opts: opts,
 		log:  log,
 
 		overrideAuth: nilAuth,
+
+		openFile: os.Open,
+
+		multipartSlots: make(chan bool, opts.maxConcurrentMultipart()),
+
+		runTagging: runTagging,
 	}
 }
 
-func (s3p *s3Provider) Upload(id string, opts *Options, in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+func (s3p *s3Provider) Upload(ctx context.Context, id string, opts *Options, in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
 	auth, err := s3p.getAuth(opts.AccessKey, opts.SecretKey)
 
 	if err != nil {
@@ -60,12 +104,17 @@ func (s3p *s3Provider) Upload(id string, opts *Options, in chan *artifact.Artifa
 	}
 
 	for a := range in {
-		err := s3p.uploadFile(opts, bucket, a)
+		start := time.Now()
+		err := s3p.uploadFile(ctx, opts, bucket, a)
+		a.UploadResult.Duration = time.Since(start)
 		if err != nil {
 			a.UploadResult.OK = false
 			a.UploadResult.Err = err
 		} else {
 			a.UploadResult.OK = true
+			if opts.SignedURLs {
+				s3p.signURL(conn, opts, a, time.Now())
+			}
 		}
 		out <- a
 	}
@@ -74,22 +123,28 @@ func (s3p *s3Provider) Upload(id string, opts *Options, in chan *artifact.Artifa
 	return
 }
 
-func (s3p *s3Provider) uploadFile(opts *Options, b *s3.Bucket, a *artifact.Artifact) error {
+func (s3p *s3Provider) uploadFile(ctx context.Context, opts *Options, b *s3.Bucket, a *artifact.Artifact) error {
 	retries := uint64(0)
 
 	for {
-		err := s3p.rawUpload(opts, b, a)
+		a.UploadResult.Attempts++
+		err := s3p.rawUpload(ctx, opts, b, a)
 		if err == nil {
 			return nil
 		}
-		if retries < opts.Retries {
+		if retryable(err) && retries < opts.Retries && !opts.pastRetryDeadline() && ctx.Err() == nil && !a.IsStream() {
 			retries++
+			sleep := opts.retryBackoff(s3p.RetryInterval, retries)
 			s3p.log.WithFields(logrus.Fields{
 				"artifact": a.Source,
 				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
 				"err":      err,
 			}).Debug("retrying")
-			time.Sleep(s3p.RetryInterval)
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
 			continue
 		} else {
 			return err
@@ -98,21 +153,18 @@ func (s3p *s3Provider) uploadFile(opts *Options, b *s3.Bucket, a *artifact.Artif
 	return nil
 }
 
-func (s3p *s3Provider) rawUpload(opts *Options, b *s3.Bucket, a *artifact.Artifact) error {
+func (s3p *s3Provider) rawUpload(ctx context.Context, opts *Options, b *s3.Bucket, a *artifact.Artifact) error {
 	dest := a.FullDest()
-	reader, err := a.Reader()
-	if err != nil {
-		return err
-	}
-
 	ctype := a.ContentType()
 	size, err := a.Size()
 	if err != nil {
 		return err
 	}
 
+	a.UploadResult.URL = s3ObjectURL(s3p.getRegion(), b.Name, dest)
+
 	s3p.log.WithFields(logrus.Fields{
-		"download_url": fmt.Sprintf("%s/%s/%s", s3p.getRegion().S3Endpoint, b.Name, dest),
+		"download_url": a.UploadResult.URL,
 	}).Info(fmt.Sprintf("uploading: %s (size: %s)", a.Source, humanize.Bytes(size)))
 
 	s3p.log.WithFields(logrus.Fields{
@@ -122,28 +174,186 @@ func (s3p *s3Provider) rawUpload(opts *Options, b *s3.Bucket, a *artifact.Artifa
 		"dest":             dest,
 		"bucket":           b.Name,
 		"content_type":     ctype,
-		"cache_control":    opts.CacheControl,
+		"cache_control":    cacheControl(opts, a),
 	}).Debug("more artifact details")
 
-	err = b.PutReaderHeader(dest, reader, int64(size),
-		map[string][]string{
-			"Content-Type":  []string{ctype},
-			"Cache-Control": []string{opts.CacheControl},
-		}, a.Perm)
+	multipart := a.SizeUnknown() || s3p.useMultipart(opts, a, size)
+	checksums, err := checksumHeaders(opts, a, !multipart)
+	if err != nil {
+		return err
+	}
+
+	// the parts of a multipart upload are read out of order, and a copy
+	// with sse-c would need the key sent twice over, so those are hashed
+	// for {sha256} beforehand
+	metadata, deferred := opts.Metadata, false
+	if !multipart && opts.SSECustomerKey == "" {
+		metadata, deferred = withoutDigestMetadata(opts.Metadata, a)
+	}
+
+	headers, err := s3p.headersWithMetadata(opts, a, metadata)
 	if err != nil {
 		return err
 	}
 
+	for key, value := range checksums {
+		headers[key] = value
+	}
+
+	if multipart {
+		return s3p.multipartUpload(ctx, opts, s3p.withMultipartHeaders(b, headers), a, ctype, int64(size))
+	}
+
+	reader, err := a.Reader()
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	headers["Content-Type"] = []string{ctype}
+
+	err = b.PutReaderHeader(dest, reader, int64(size), headers, a.Perm)
+	if err != nil {
+		return err
+	}
+
+	if deferred {
+		// the object is copied onto itself to store the metadata that
+		// waited for the upload to hash the content
+		s3p.log.WithField("dest", dest).Debug("storing metadata with the uploaded digest")
+		return s3p.putCopy(opts, b, a, dest)
+	}
+
 	return nil
 }
 
 func (s3p *s3Provider) getConn(auth aws.Auth) *s3.S3 {
+	var conn *s3.S3
 	if s3p.overrideConn != nil {
 		s3p.log.WithField("conn", s3p.overrideConn).Debug("using override connection")
-		return s3p.overrideConn
+		conn = s3p.overrideConn
+	} else {
+		conn = s3.New(auth, s3p.getRegion())
+	}
+
+	client := s3p.opts.httpClient()
+	withClient := *conn
+	withClient.HTTPClient = func() *http.Client { return client }
+	conn = &withClient
+
+	transport := &s3RequestTransport{
+		Auth:       conn.Auth,
+		BucketName: s3p.opts.BucketName,
+		OmitACL:    s3p.opts.InheritBucketACL || s3p.opts.hasS3Grants(),
 	}
 
-	return s3.New(auth, s3p.getRegion())
+	if transport.OmitACL {
+		s3p.log.Debug("omitting per-object acl")
+	}
+
+	if s3p.opts.signsV4() {
+		// s3 only accepts kms requests signed with version 4
+		transport.V4Region = conn.Region.Name
+		s3p.log.WithField("region", transport.V4Region).Debug("signing with signature version 4")
+	}
+
+	if s3p.opts.SSECustomerKey != "" {
+		transport.CustomerKeyHeaders = sseCustomerKeyHeaders(s3p.opts.SSECustomerKey)
+	}
+
+	return wrapS3Conn(conn, transport)
+}
+
+// objectHeaders are the headers stored with each object, apart from its
+// content type
+func (s3p *s3Provider) objectHeaders(opts *Options, a *artifact.Artifact) (map[string][]string, error) {
+	return s3p.headersWithMetadata(opts, a, opts.Metadata)
+}
+
+// headersWithMetadata are the object's headers with the given metadata
+// rather than all of --metadata
+func (s3p *s3Provider) headersWithMetadata(opts *Options, a *artifact.Artifact, metadata []string) (map[string][]string, error) {
+	headers := map[string][]string{
+		"Cache-Control": []string{cacheControl(opts, a)},
+	}
+
+	if a.ContentEncoding != "" {
+		headers["Content-Encoding"] = []string{a.ContentEncoding}
+	}
+
+	if a.ContentDisposition != "" {
+		headers["Content-Disposition"] = []string{a.ContentDisposition}
+	}
+
+	if a.RedirectLocation != "" {
+		headers["x-amz-website-redirect-location"] = []string{a.RedirectLocation}
+	}
+
+	if opts.StorageClass != "" {
+		headers["x-amz-storage-class"] = []string{opts.StorageClass}
+	}
+
+	for key, value := range sseHeaders(opts) {
+		headers[key] = value
+	}
+
+	if s3p.runTagging != "" {
+		headers["x-amz-tagging"] = []string{s3p.runTagging}
+	}
+
+	resolved, err := resolveMetadata(metadata, a)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range resolved {
+		headers[metadataHeaderPrefix+key] = []string{value}
+	}
+
+	grants, err := opts.s3GrantHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range grants {
+		headers[key] = value
+	}
+
+	return headers, nil
+}
+
+// withMultipartHeaders returns a copy of the bucket that adds the headers
+// when initiating multipart uploads, since goamz only sends the content
+// type and acl
+func (s3p *s3Provider) withMultipartHeaders(b *s3.Bucket, headers map[string][]string) *s3.Bucket {
+	return wrapS3Conn(b.S3, &s3RequestTransport{
+		Auth:             b.S3.Auth,
+		BucketName:       b.Name,
+		MultipartHeaders: http.Header(headers),
+	}).Bucket(b.Name)
+}
+
+func wrapS3Conn(conn *s3.S3, transport *s3RequestTransport) *s3.S3 {
+	wrappedConn := *conn
+	baseClient := conn.HTTPClient
+	wrappedConn.HTTPClient = func() *http.Client {
+		client := http.DefaultClient
+		if baseClient != nil {
+			client = baseClient()
+		}
+
+		wrappedTransport := *transport
+		wrappedTransport.Transport = client.Transport
+
+		wrapped := *client
+		wrapped.Transport = &wrappedTransport
+		return &wrapped
+	}
+
+	return &wrappedConn
 }
 
 func (s3p *s3Provider) getAuth(accessKey, secretKey string) (aws.Auth, error) {
@@ -152,13 +362,23 @@ func (s3p *s3Provider) getAuth(accessKey, secretKey string) (aws.Auth, error) {
 		return s3p.overrideAuth, nil
 	}
 
-	s3p.log.Debug("creating new auth")
-	return aws.GetAuth(accessKey, secretKey)
+	auth, err := s3p.baseAuth(accessKey, secretKey)
+	if err != nil || s3p.opts.AssumeRoleARN == "" {
+		return auth, err
+	}
+
+	return s3p.assumedRoleAuth(auth)
 }
 
 func (s3p *s3Provider) getRegion() aws.Region {
 	region, ok := aws.Regions[s3p.opts.S3Region]
 
+	// S3-compatible stores name their own regions, so any name goes
+	// along with a custom endpoint
+	if !ok && s3p.opts.S3Endpoint != "" {
+		region, ok = aws.Region{Name: s3p.opts.S3Region}, true
+	}
+
 	if !ok {
 		s3p.log.WithFields(logrus.Fields{
 			"region":  s3p.opts.S3Region,
@@ -167,9 +387,44 @@ func (s3p *s3Provider) getRegion() aws.Region {
 		region = aws.Regions[DefaultOptions.S3Region]
 	}
 
-	return region
+	return s3AddressRegion(region, s3p.opts)
+}
+
+// RetryDefaults are more aggressive than the other providers', since S3
+// errors are nearly always transient
+func (s3p *s3Provider) RetryDefaults() (uint64, time.Duration) {
+	return s3ProviderRetries, defaultProviderRetryInterval
 }
 
 func (s3p *s3Provider) Name() string {
 	return "s3"
 }
+
+func (s3p *s3Provider) storesMetadata() {}
+
+// ChunkSize is the part size of the multipart uploads started from now on
+func (s3p *s3Provider) ChunkSize() int64 {
+	return atomic.LoadInt64(&s3p.MultipartPartSize)
+}
+
+// SetChunkSize changes the part size of the multipart uploads started
+// from now on, for --concurrency auto
+func (s3p *s3Provider) SetChunkSize(size int64) {
+	atomic.StoreInt64(&s3p.MultipartPartSize, size)
+}
+
+// FetchHeaders returns the headers the artifact's object was stored with
+func (s3p *s3Provider) FetchHeaders(opts *Options, a *artifact.Artifact) (http.Header, error) {
+	auth, err := s3p.getAuth(opts.AccessKey, opts.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s3p.getConn(auth).Bucket(opts.BucketName).Head(a.FullDest())
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+	return resp.Header, nil
+}
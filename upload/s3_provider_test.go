@@ -1,7 +1,12 @@
 package upload
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,6 +34,22 @@ func init() {
 	}
 }
 
+// clearTestS3Prefix deletes what an earlier run of a test left under its
+// prefix in the shared fake bucket, so that it passes with -count > 1
+func clearTestS3Prefix(t *testing.T, prefix string) {
+	b := testS3.Bucket("bucket")
+	resp, err := b.List(prefix, "", "", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, key := range resp.Contents {
+		if err := b.Del(key.Key); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
 type localS3Server struct {
 	Auth   aws.Auth
 	Region aws.Region
@@ -80,7 +101,7 @@ func TestS3ProviderUpload(t *testing.T) {
 	out := make(chan *artifact.Artifact)
 	done := make(chan bool)
 
-	go s3p.Upload("test-0", opts, in, out, done)
+	go s3p.Upload(context.Background(), "test-0", opts, in, out, done)
 
 	go func() {
 		for _, p := range testArtifactPaths {
@@ -93,8 +114,10 @@ func TestS3ProviderUpload(t *testing.T) {
 				RepoSlug: "owner/foo",
 			})
 
-			in <- a
+			// printed before the worker owns it and starts filling in
+			// its result
 			fmt.Printf("---> Fed artifact: %#v\n", a)
+			in <- a
 		}
 		close(in)
 	}()
@@ -131,3 +154,154 @@ func TestS3ProviderRegionOption(t *testing.T) {
 		}
 	}
 }
+
+func TestS3ProviderRegionWithEndpoint(t *testing.T) {
+	opts := NewOptions()
+	opts.S3Endpoint = "https://nyc3.digitaloceanspaces.com/"
+	opts.S3Region = "nyc3"
+
+	region := newS3Provider(opts, getPanicLogger()).getRegion()
+	if region.Name != "nyc3" || region.S3Endpoint != "https://nyc3.digitaloceanspaces.com" {
+		t.Fatalf("unexpected region %#v", region)
+	}
+}
+
+type capturedS3Request struct {
+	Method string
+	Header http.Header
+	URL    *url.URL
+}
+
+func getCapturingS3Server(t *testing.T) (*httptest.Server, chan *capturedS3Request) {
+	reqs := make(chan *capturedS3Request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- &capturedS3Request{Method: r.Method, Header: r.Header, URL: r.URL}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return srv, reqs
+}
+
+func uploadOneToS3(t *testing.T, opts *Options, region aws.Region) {
+	s3p := newS3Provider(opts, getPanicLogger())
+	s3p.RetryInterval = 0
+	s3p.overrideConn = s3.New(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}, region)
+
+	a := artifact.NewFromBytes("bucket", "hello.txt", []byte("hello"), &artifact.Options{
+		Perm:     s3.PublicRead,
+		RepoSlug: "owner/foo",
+	})
+
+	err := s3p.rawUpload(context.Background(), opts, s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket"), a)
+	if err != nil {
+		t.Fatalf("unexpected upload error: %v", err)
+	}
+}
+
+func TestS3ProviderInheritBucketACL(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.InheritBucketACL = true
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	if _, ok := req.Header["X-Amz-Acl"]; ok {
+		t.Fatalf("acl header was sent: %v", req.Header.Get("X-Amz-Acl"))
+	}
+
+	if req.Header.Get("Authorization") == "" {
+		t.Fatalf("request was not signed")
+	}
+}
+
+func TestS3ProviderSendsACLByDefault(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	if req.Header.Get("X-Amz-Acl") != string(s3.PublicRead) {
+		t.Fatalf("acl header %q != %q", req.Header.Get("X-Amz-Acl"), s3.PublicRead)
+	}
+}
+
+func TestSignS3RequestMatchesGoamz(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	captured := <-reqs
+	expected := captured.Header.Get("Authorization")
+
+	header := http.Header{}
+	for k, v := range captured.Header {
+		header[k] = v
+	}
+	header.Del("Authorization")
+
+	req := &http.Request{
+		Method: captured.Method,
+		URL:    &url.URL{Host: strings.TrimPrefix(srv.URL, "http://"), Opaque: captured.URL.EscapedPath()},
+		Header: header,
+	}
+	signS3Request(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}, "bucket", req)
+
+	if req.Header.Get("Authorization") != expected {
+		t.Fatalf("authorization %q != %q", req.Header.Get("Authorization"), expected)
+	}
+}
+
+func TestS3ProviderUploadMetadata(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.Metadata = []string{"name={basename}", "bytes={size}"}
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	if req.Header.Get("X-Amz-Meta-Name") != "hello.txt" {
+		t.Fatalf("name metadata %q != hello.txt", req.Header.Get("X-Amz-Meta-Name"))
+	}
+
+	if req.Header.Get("X-Amz-Meta-Bytes") != "5" {
+		t.Fatalf("bytes metadata %q != 5", req.Header.Get("X-Amz-Meta-Bytes"))
+	}
+}
+
+func TestS3ProviderUploadDigestMetadata(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.Metadata = []string{"name={basename}", "sum={sha256}"}
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	// the put is hashed as it is sent, and the copy stores the digest
+	put, copied := <-reqs, <-reqs
+	if put.Header.Get("X-Amz-Meta-Sum") != "" || put.Header.Get("X-Amz-Meta-Name") != "hello.txt" {
+		t.Fatalf("unexpected put headers %v", put.Header)
+	}
+
+	if copied.Header.Get("X-Amz-Copy-Source") != "/bucket/bucket/hello.txt" ||
+		copied.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" ||
+		copied.Header.Get("X-Amz-Meta-Name") != "hello.txt" ||
+		copied.Header.Get("X-Amz-Meta-Sum") != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected copy headers %v", copied.Header)
+	}
+}
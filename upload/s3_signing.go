@@ -0,0 +1,220 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+var (
+	// s3ParamsToSign mirrors the subresources that goamz includes when
+	// signing requests
+	s3ParamsToSign = map[string]bool{
+		"acl":                          true,
+		"delete":                       true,
+		"location":                     true,
+		"logging":                      true,
+		"notification":                 true,
+		"partNumber":                   true,
+		"policy":                       true,
+		"requestPayment":               true,
+		"torrent":                      true,
+		"uploadId":                     true,
+		"uploads":                      true,
+		"versionId":                    true,
+		"versioning":                   true,
+		"versions":                     true,
+		"response-content-type":        true,
+		"response-content-language":    true,
+		"response-expires":             true,
+		"response-cache-control":       true,
+		"response-content-disposition": true,
+		"response-content-encoding":    true,
+	}
+)
+
+// s3RequestTransport adjusts requests prepared by goamz where goamz has
+// no way to do so itself, re-signing them afterward.  It removes the
+// canned ACL header that goamz always sends when OmitACL is set, so that
+// buckets with ACLs disabled accept the request and the bucket policy
+// governs access, it adds MultipartHeaders to requests that initiate
+// multipart uploads, and it adds CustomerKeyHeaders to every request for
+// an object other than completing or deleting one.  With V4Region set,
+// requests are signed with signature version 4 for that region rather
+// than goamz's version 2.
+type s3RequestTransport struct {
+	Auth       aws.Auth
+	BucketName string
+	Transport  http.RoundTripper
+
+	OmitACL            bool
+	MultipartHeaders   http.Header
+	CustomerKeyHeaders http.Header
+	V4Region           string
+}
+
+func (t *s3RequestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	_, hasACL := req.Header["x-amz-acl"]
+	omitACL := t.OmitACL && hasACL
+	initMulti := len(t.MultipartHeaders) > 0 && isInitMultiRequest(req)
+	customerKey := len(t.CustomerKeyHeaders) > 0 && t.isCustomerKeyRequest(req)
+
+	if !omitACL && !initMulti && !customerKey && t.V4Region == "" {
+		return transport.RoundTrip(req)
+	}
+
+	modified := *req
+	modified.Header = http.Header{}
+	for k, v := range req.Header {
+		if omitACL && k == "x-amz-acl" {
+			continue
+		}
+		modified.Header[k] = v
+	}
+
+	if initMulti {
+		for k, v := range t.MultipartHeaders {
+			modified.Header[k] = v
+		}
+	}
+
+	if customerKey {
+		for k, v := range t.CustomerKeyHeaders {
+			modified.Header[k] = v
+		}
+	}
+
+	if t.V4Region != "" {
+		if t.Auth.SecretKey != "" {
+			signV4Payload(&modified, t.Auth, t.V4Region, "s3", sigV4UnsignedPayload, time.Now())
+		}
+		return transport.RoundTrip(&modified)
+	}
+
+	signS3Request(t.Auth, t.BucketName, &modified)
+	return transport.RoundTrip(&modified)
+}
+
+// isCustomerKeyRequest reports whether s3 needs the sse-c key for the
+// request, which is any for an object's content or headers.  Completing
+// a multipart upload and deleting an object go without it.
+func (t *s3RequestTransport) isCustomerKeyRequest(req *http.Request) bool {
+	path := req.URL.Opaque
+	if path == "" {
+		path = req.URL.EscapedPath()
+	}
+	if strings.HasPrefix(path, "//") {
+		path = "/" + strings.SplitN(path[2:]+"/", "/", 2)[1]
+	}
+
+	key := strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(req.URL.Host, t.BucketName+".") {
+		key = strings.TrimPrefix(key, t.BucketName)
+		key = strings.TrimPrefix(key, "/")
+	}
+	if key == "" {
+		return false
+	}
+
+	switch req.Method {
+	case "PUT", "GET", "HEAD":
+		return true
+	case "POST":
+		return isInitMultiRequest(req)
+	}
+	return false
+}
+
+func isInitMultiRequest(req *http.Request) bool {
+	if req.Method != "POST" {
+		return false
+	}
+
+	_, ok := req.URL.Query()["uploads"]
+	return ok
+}
+
+// signS3Request (re-)signs a request prepared by goamz using the same
+// signature version 2 scheme
+func signS3Request(auth aws.Auth, bucketName string, req *http.Request) {
+	if auth.SecretKey == "" {
+		return
+	}
+
+	var md5, ctype, date string
+	amz := []string{}
+
+	for k, v := range req.Header {
+		switch strings.ToLower(k) {
+		case "content-md5":
+			md5 = v[0]
+		case "content-type":
+			ctype = v[0]
+		case "date":
+			date = v[0]
+		case "authorization":
+			continue
+		default:
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-") {
+				amz = append(amz, strings.ToLower(k)+":"+strings.Join(v, ","))
+			}
+		}
+	}
+
+	for _, a := range amz {
+		if strings.HasPrefix(a, "x-amz-date:") {
+			date = ""
+		}
+	}
+
+	xamz := ""
+	if len(amz) > 0 {
+		sort.Strings(amz)
+		xamz = strings.Join(amz, "\n") + "\n"
+	}
+
+	canonicalPath := req.URL.Opaque
+	if canonicalPath == "" {
+		canonicalPath = req.URL.EscapedPath()
+	}
+	if bucketName != "" && strings.HasPrefix(req.URL.Host, bucketName+".") {
+		canonicalPath = "/" + bucketName + canonicalPath
+	}
+
+	params := []string{}
+	for k, v := range req.URL.Query() {
+		if !s3ParamsToSign[k] {
+			continue
+		}
+		for _, vi := range v {
+			if vi == "" {
+				params = append(params, k)
+			} else {
+				params = append(params, k+"="+vi)
+			}
+		}
+	}
+	if len(params) > 0 {
+		sort.Strings(params)
+		canonicalPath = canonicalPath + "?" + strings.Join(params, "&")
+	}
+
+	payload := req.Method + "\n" + md5 + "\n" + ctype + "\n" + date + "\n" + xamz + canonicalPath
+	hash := hmac.New(sha1.New, []byte(auth.SecretKey))
+	hash.Write([]byte(payload))
+
+	req.Header["Authorization"] = []string{
+		"AWS " + auth.AccessKey + ":" + base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+	}
+}
@@ -0,0 +1,81 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	sbomKeyMetadata    = "sbom-key"
+	sbomURLMetadata    = "sbom-url"
+	sbomSHA256Metadata = "sbom-sha256"
+)
+
+// uploadSBOMs uploads --sbom to each target path ahead of the artifacts,
+// returning the metadata referencing it for the artifacts under each
+// target path.  The SBOM's content is never looked at beyond hashing it.
+func (u *uploader) uploadSBOMs() (map[string]map[string]string, error) {
+	if len(u.Opts.TargetPaths) == 0 {
+		return nil, fmt.Errorf("--sbom requires a target path")
+	}
+
+	sboms := []*artifact.Artifact{}
+	for _, targetPath := range u.Opts.TargetPaths {
+		sboms = append(sboms,
+			artifact.New(targetPath, u.Opts.SBOM, filepath.Base(u.Opts.SBOM), u.artifactOptions()))
+	}
+
+	sum, err := sboms[0].SHA256()
+	if err != nil {
+		return nil, err
+	}
+
+	if failed := u.uploadExtra(sboms); len(failed) > 0 {
+		return nil, fmt.Errorf("failed to upload sbom to %s: %v",
+			failed[0].FullDest(), failed[0].UploadResult.Err)
+	}
+
+	refs := map[string]map[string]string{}
+	for _, a := range sboms {
+		ref := map[string]string{
+			sbomKeyMetadata:    a.FullDest(),
+			sbomSHA256Metadata: sum,
+		}
+		if a.UploadResult.URL != "" {
+			ref[sbomURLMetadata] = a.UploadResult.URL
+		}
+		refs[a.Prefix] = ref
+
+		u.log.WithFields(logrus.Fields{
+			"key":    a.FullDest(),
+			"sha256": sum,
+		}).Debug("uploaded sbom")
+	}
+
+	return refs, nil
+}
+
+// sbomFilter adds the reference to the SBOM under its target path to each
+// artifact's metadata
+func (u *uploader) sbomFilter(in chan *artifact.Artifact, refs map[string]map[string]string) chan *artifact.Artifact {
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			if ref, ok := refs[a.Prefix]; ok {
+				if a.Metadata == nil {
+					a.Metadata = map[string]string{}
+				}
+				for key, value := range ref {
+					a.Metadata[key] = value
+				}
+			}
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out
+}
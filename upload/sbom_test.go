@@ -0,0 +1,111 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadSBOM(t *testing.T) {
+	os.Clearenv()
+	sbom := `{"spdxVersion": "SPDX-2.3"}`
+	dir := writeTestFiles(t, map[string]string{
+		"out/app":        "binary",
+		"sbom.spdx.json": sbom,
+	})
+	defer os.RemoveAll(dir)
+
+	sum := sha256.Sum256([]byte(sbom))
+	expectedSum := hex.EncodeToString(sum[:])
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"sbom-test"}
+		opts.SBOM = filepath.Join(dir, "sbom.spdx.json")
+		opts.OutputManifest = filepath.Join(dir, "manifest.json")
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, err := testS3.Bucket("bucket").Get("sbom-test/sbom.spdx.json")
+	if err != nil {
+		t.Fatalf("sbom was not uploaded: %v", err)
+	}
+
+	if string(body) != sbom {
+		t.Fatalf("sbom %q != %q", body, sbom)
+	}
+
+	resp, err := testS3.Bucket("bucket").Head("sbom-test/out/app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("x-amz-meta-sbom-key") != "sbom-test/sbom.spdx.json" {
+		t.Fatalf("sbom key metadata %q != sbom-test/sbom.spdx.json", resp.Header.Get("x-amz-meta-sbom-key"))
+	}
+
+	if resp.Header.Get("x-amz-meta-sbom-sha256") != expectedSum {
+		t.Fatalf("sbom sha256 metadata %q != %q", resp.Header.Get("x-amz-meta-sbom-sha256"), expectedSum)
+	}
+
+	if resp.Header.Get("x-amz-meta-sbom-url") == "" {
+		t.Fatalf("missing sbom url metadata")
+	}
+
+	manifestBody, err := ioutil.ReadFile(u.Opts.OutputManifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(manifestBody, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, entry := range m.Artifacts {
+		if entry.Key != "sbom-test/out/app" {
+			continue
+		}
+
+		if entry.Metadata["sbom-key"] != "sbom-test/sbom.spdx.json" || entry.Metadata["sbom-sha256"] != expectedSum {
+			t.Fatalf("manifest entry does not reference the sbom: %#v", entry.Metadata)
+		}
+		return
+	}
+
+	t.Fatalf("artifact missing from manifest: %s", manifestBody)
+}
+
+func TestSBOMValidation(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.SBOM = "/nonexistent/sbom.json"
+
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("missing sbom was accepted")
+	}
+
+	dir := writeTestFiles(t, map[string]string{"sbom.json": "{}"})
+	defer os.RemoveAll(dir)
+
+	opts.SBOM = dir
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("sbom dir was accepted")
+	}
+
+	opts.SBOM = filepath.Join(dir, "sbom.json")
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// sftpControlPersist is how many seconds the shared ssh connection
+	// outlives the last upload through it
+	sftpControlPersist = "5"
+
+	sftpAskpassScript = "#!/bin/sh\nprintf '%s\\n' \"$ARTIFACTS_SFTP_PASSWORD\"\n"
+)
+
+// sftpProvider mirrors the artifacts onto a server's filesystem by running
+// the system's sftp client in batch mode, one batch per artifact.  The
+// batches of each worker share one ssh connection through a control
+// socket, so that only the first of them has to log in.
+type sftpProvider struct {
+	RetryInterval time.Duration
+
+	opts *Options
+	log  *logrus.Logger
+
+	// command is sftp, or a stand-in for it in tests
+	command []string
+}
+
+// sftpSession is a worker's scratch directory, holding its control
+// socket, batch files, and the content of artifacts without a file of
+// their own, along with the remote directories it has made so far
+type sftpSession struct {
+	dir  string
+	made map[string]bool
+	n    int
+}
+
+func newSFTPProvider(opts *Options, log *logrus.Logger) *sftpProvider {
+	return &sftpProvider{
+		RetryInterval: opts.retryInterval(defaultProviderRetryInterval),
+
+		opts:    opts,
+		log:     log,
+		command: []string{"sftp"},
+	}
+}
+
+func (opts *Options) validateSFTP() error {
+	if opts.SFTPHost == "" {
+		return fmt.Errorf("no sftp host given")
+	}
+
+	if strings.HasPrefix(opts.SFTPHost, "-") || strings.ContainsAny(opts.SFTPHost, " \t\n@/") {
+		return fmt.Errorf("invalid --sftp-host %q (expected a host name or address)", opts.SFTPHost)
+	}
+
+	if opts.SFTPPort == 0 || opts.SFTPPort > 65535 {
+		return fmt.Errorf("invalid --sftp-port %d", opts.SFTPPort)
+	}
+
+	if strings.ContainsAny(opts.SFTPUser, " \t\n@") {
+		return fmt.Errorf("invalid --sftp-user %q", opts.SFTPUser)
+	}
+
+	if opts.SFTPKey != "" {
+		if _, err := os.Stat(opts.SFTPKey); err != nil {
+			return fmt.Errorf("sftp key cannot be read: %v", err)
+		}
+	}
+
+	if err := checkSFTPPath(opts.sftpDir()); err != nil {
+		return fmt.Errorf("invalid --sftp-dir: %v", err)
+	}
+
+	return nil
+}
+
+// sftpDir is --sftp-dir, or else --bucket, or else the login directory
+func (opts *Options) sftpDir() string {
+	if opts.SFTPDir != "" {
+		return opts.SFTPDir
+	}
+	if opts.BucketName != "" {
+		return opts.BucketName
+	}
+	return "."
+}
+
+// checkSFTPPath rejects what can't be put in a batch file as it is, since
+// sftp keeps some backslashes and unquotes others
+func checkSFTPPath(p string) error {
+	if strings.ContainsAny(p, "'\\\n\r") {
+		return fmt.Errorf("%q cannot contain quotes, backslashes, or newlines", p)
+	}
+	return nil
+}
+
+func (sp *sftpProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	s, sessionErr := sp.newSession()
+	if sessionErr == nil {
+		defer os.RemoveAll(s.dir)
+	}
+
+	for a := range in {
+		start := time.Now()
+		err := sessionErr
+		if err == nil {
+			err = sp.uploadFile(ctx, opts, s, a)
+		}
+		a.UploadResult.Duration = time.Since(start)
+		if err != nil {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = err
+		} else {
+			a.UploadResult.OK = true
+		}
+		out <- a
+	}
+
+	done <- true
+	return
+}
+
+func (sp *sftpProvider) newSession() (*sftpSession, error) {
+	dir, err := ioutil.TempDir("", "artifacts-sftp")
+	if err != nil {
+		return nil, err
+	}
+
+	if sp.opts.SFTPPassword != "" {
+		err := ioutil.WriteFile(filepath.Join(dir, "askpass"), []byte(sftpAskpassScript), 0700)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	return &sftpSession{dir: dir, made: map[string]bool{}}, nil
+}
+
+func (sp *sftpProvider) uploadFile(ctx context.Context, opts *Options, s *sftpSession, a *artifact.Artifact) error {
+	retries := uint64(0)
+
+	for {
+		a.UploadResult.Attempts++
+		err := sp.rawUpload(ctx, opts, s, a)
+		if err == nil {
+			return nil
+		}
+		// a refused login or a path the server won't take won't get any
+		// better by trying again, while a dropped connection might
+		if retryable(err) && retries < opts.Retries &&
+			!opts.pastRetryDeadline() && ctx.Err() == nil && !a.IsStream() {
+			retries++
+			sleep := opts.retryBackoff(sp.RetryInterval, retries)
+			sp.log.WithFields(logrus.Fields{
+				"artifact": a.Source,
+				"retry":    retries,
+				"attempt":  a.UploadResult.Attempts + 1,
+				"sleep":    sleep,
+				"err":      err,
+			}).Debug("retrying")
+			if err := sleepContext(ctx, sleep); err != nil {
+				return err
+			}
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+func (sp *sftpProvider) rawUpload(ctx context.Context, opts *Options, s *sftpSession, a *artifact.Artifact) error {
+	remote := path.Join(opts.sftpDir(), a.FullDest())
+	if err := checkSFTPPath(remote); err != nil {
+		return categorize(FailureValidation, fmt.Errorf("cannot upload over sftp: %v", err))
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	a.UploadResult.URL = opts.sftpURL(remote)
+
+	sp.log.WithFields(logrus.Fields{
+		"download_url": a.UploadResult.URL,
+	}).Info(fmt.Sprintf("uploading: %s (size: %d)", a.Source, size))
+
+	s.n++
+	local, err := s.localContent(a, s.n)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(local)
+
+	// mkdir fails for directories that are already there, so failures
+	// are ignored with "-", and put fails instead if one is really missing
+	batch := &bytes.Buffer{}
+	dirs := sftpParents(remote)
+	for _, dir := range dirs {
+		if !s.made[dir] {
+			fmt.Fprintf(batch, "-mkdir '%s'\n", dir)
+		}
+	}
+	fmt.Fprintf(batch, "put -p '%s' '%s'\n", local, remote)
+
+	batchFile := filepath.Join(s.dir, fmt.Sprintf("batch-%d", s.n))
+	if err := ioutil.WriteFile(batchFile, batch.Bytes(), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(batchFile)
+
+	if err := sp.run(ctx, opts, s, batchFile); err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		s.made[dir] = true
+	}
+
+	sp.log.WithField("path", remote).Debug("uploaded over sftp")
+	return nil
+}
+
+// localContent is a file in the session with the artifact's content, with
+// the modes and modification time that put -p gives the remote file.
+// Plain files are linked rather than copied.
+func (s *sftpSession) localContent(a *artifact.Artifact, n int) (string, error) {
+	local := filepath.Join(s.dir, fmt.Sprintf("content-%d", n))
+
+	if a.Source != "" && a.ContentSource() == a.Source && !a.IsStream() {
+		source, err := filepath.Abs(a.Source)
+		if err != nil {
+			return "", err
+		}
+		return local, os.Symlink(source, local)
+	}
+
+	mode := localFileMode(a)
+
+	reader, err := a.Reader()
+	if err != nil {
+		return "", err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	f, err := os.OpenFile(local, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = copyPooled(f, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(local)
+		return "", err
+	}
+
+	if err := os.Chmod(local, mode); err != nil {
+		return "", err
+	}
+
+	if modTime, err := a.ModTime(); err == nil && !modTime.IsZero() {
+		os.Chtimes(local, modTime, modTime)
+	}
+
+	return local, nil
+}
+
+// run runs the batch file through sftp, over the session's shared
+// connection once there is one
+func (sp *sftpProvider) run(ctx context.Context, opts *Options, s *sftpSession, batchFile string) error {
+	args := append([]string{}, sp.command[1:]...)
+	args = append(args,
+		"-P", strconv.FormatUint(opts.SFTPPort, 10),
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath="+filepath.Join(s.dir, "control"),
+		"-o", "ControlPersist="+sftpControlPersist,
+		"-o", "StrictHostKeyChecking=yes",
+	)
+	if opts.SFTPUser != "" {
+		args = append(args, "-o", "User="+opts.SFTPUser)
+	}
+	if opts.SFTPKey != "" {
+		args = append(args, "-i", opts.SFTPKey, "-o", "IdentitiesOnly=yes")
+	}
+	if opts.SFTPKnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+opts.SFTPKnownHosts)
+	}
+	if opts.SFTPPassword != "" {
+		// -b turns on batch mode, which won't ask for a password, unless
+		// it was turned off first
+		args = append(args, "-o", "BatchMode=no", "-o", "NumberOfPasswordPrompts=1")
+	}
+	if opts.MaxConnectionBandwidth > 0 {
+		kbits := opts.MaxConnectionBandwidth * 8 / 1000
+		if kbits == 0 {
+			kbits = 1
+		}
+		args = append(args, "-l", strconv.FormatUint(kbits, 10))
+	}
+	args = append(args, "-b", batchFile, opts.SFTPHost)
+
+	cmd := exec.CommandContext(ctx, sp.command[0], args...)
+	cmd.Env = os.Environ()
+	if opts.SFTPPassword != "" {
+		// the password is only ever in the environment, for the askpass
+		// script to print
+		cmd.Env = append(cmd.Env,
+			"ARTIFACTS_SFTP_PASSWORD="+opts.SFTPPassword,
+			"SSH_ASKPASS="+filepath.Join(s.dir, "askpass"),
+			"SSH_ASKPASS_REQUIRE=force")
+		if os.Getenv("DISPLAY") == "" {
+			cmd.Env = append(cmd.Env, "DISPLAY=:0")
+		}
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		return categorize(FailureValidation, fmt.Errorf("the sftp provider needs the sftp command: %v", err))
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return sftpError(err, output)
+}
+
+// sftpError categorizes a failed batch by what sftp said about it
+func sftpError(err error, output []byte) error {
+	msg := strings.TrimSpace(string(output))
+	if len(msg) > 1024 {
+		msg = msg[len(msg)-1024:]
+	}
+	failed := fmt.Errorf("sftp upload failed: %v: %s", err, msg)
+
+	switch {
+	case strings.Contains(msg, "Permission denied ("),
+		strings.Contains(msg, "Too many authentication failures"):
+		return categorize(FailureCredentials, failed)
+	case strings.Contains(msg, "Host key verification failed"),
+		strings.Contains(msg, "No such file or directory"),
+		strings.Contains(msg, "Permission denied"):
+		return categorize(FailureValidation, failed)
+	}
+
+	return failed
+}
+
+// sftpParents are the directories above the remote path, outermost first
+func sftpParents(remote string) []string {
+	dirs := []string{}
+	for dir := path.Dir(remote); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// sftpURL is where the remote path is, as an sftp:// url, where a path
+// relative to the login directory starts with "/~/"
+func (opts *Options) sftpURL(remote string) string {
+	if !strings.HasPrefix(remote, "/") {
+		remote = "/~/" + remote
+	}
+
+	u := &url.URL{
+		Scheme: "sftp",
+		Host:   net.JoinHostPort(opts.SFTPHost, strconv.FormatUint(opts.SFTPPort, 10)),
+		Path:   remote,
+	}
+	if opts.SFTPUser != "" {
+		u.User = url.User(opts.SFTPUser)
+	}
+	return u.String()
+}
+
+// RetryDefaults are those of the s3 provider, since a dropped connection
+// is as likely to go through the next time
+func (sp *sftpProvider) RetryDefaults() (uint64, time.Duration) {
+	return s3ProviderRetries, defaultProviderRetryInterval
+}
+
+func (sp *sftpProvider) Name() string {
+	return "sftp"
+}
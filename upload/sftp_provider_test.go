@@ -0,0 +1,340 @@
+package upload
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// sftpHelperEnv is the environment TestSFTPHelperProcess was run with,
+// taken before init clears it
+var sftpHelperEnv = os.Environ()
+
+func getSFTPHelperEnv(name string) string {
+	for _, kv := range sftpHelperEnv {
+		if strings.HasPrefix(kv, name+"=") {
+			return strings.TrimPrefix(kv, name+"=")
+		}
+	}
+	return ""
+}
+
+// getTestSFTPProvider runs TestSFTPHelperProcess in place of sftp, which
+// logs what it was run with to the returned file
+func getTestSFTPProvider(t *testing.T, opts *Options) (*sftpProvider, string) {
+	logDir, err := ioutil.TempDir("", "artifacts-sftp-log")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	os.Setenv("ARTIFACTS_SFTP_HELPER", logDir)
+
+	sp := newSFTPProvider(opts, getPanicLogger())
+	sp.RetryInterval = 0
+	sp.command = []string{os.Args[0], "-test.run=^TestSFTPHelperProcess$", "--"}
+	return sp, filepath.Join(logDir, "log")
+}
+
+func runTestSFTPUpload(sp *sftpProvider, opts *Options, artifacts ...*artifact.Artifact) []*artifact.Artifact {
+	in := make(chan *artifact.Artifact, len(artifacts))
+	out := make(chan *artifact.Artifact, len(artifacts))
+	done := make(chan bool, 1)
+
+	for _, a := range artifacts {
+		in <- a
+	}
+	close(in)
+
+	sp.Upload(context.Background(), "test-0", opts, in, out, done)
+	<-done
+	close(out)
+
+	results := []*artifact.Artifact{}
+	for a := range out {
+		results = append(results, a)
+	}
+	return results
+}
+
+func TestSFTPProviderUpload(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"bin/tool":      "#!/bin/sh\n",
+		"logs/test.log": "ok\n",
+		"key":           "not really a key",
+	})
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("ARTIFACTS_SFTP_HELPER")
+
+	os.Chmod(filepath.Join(dir, "bin/tool"), 0755)
+
+	opts := NewOptions()
+	opts.Provider = "sftp"
+	opts.SFTPHost = "deploy.example.com"
+	opts.SFTPPort = 2222
+	opts.SFTPUser = "deploy"
+	opts.SFTPKey = filepath.Join(dir, "key")
+	opts.SFTPDir = filepath.Join(dir, "remote")
+
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sp, logFile := getTestSFTPProvider(t, opts)
+	defer os.RemoveAll(filepath.Dir(logFile))
+
+	artifactOpts := &artifact.Options{}
+	results := runTestSFTPUpload(sp, opts,
+		artifact.New("1/1.1", filepath.Join(dir, "bin/tool"), "bin/tool", artifactOpts),
+		artifact.New("1/1.1", filepath.Join(dir, "logs/test.log"), "logs/test.log", artifactOpts),
+		artifact.NewFromBytes("1/1.1", "logs/index.html", []byte("<html></html>"), artifactOpts))
+
+	for _, a := range results {
+		if !a.UploadResult.OK {
+			t.Fatalf("%s failed: %v", a.Dest, a.UploadResult.Err)
+		}
+	}
+
+	expectedURL := "sftp://deploy@deploy.example.com:2222" + filepath.Join(dir, "remote/1/1.1/bin/tool")
+	if results[0].UploadResult.URL != expectedURL {
+		t.Fatalf("url %q != %q", results[0].UploadResult.URL, expectedURL)
+	}
+
+	for name, expected := range map[string]string{
+		"1/1.1/bin/tool":        "#!/bin/sh\n",
+		"1/1.1/logs/test.log":   "ok\n",
+		"1/1.1/logs/index.html": "<html></html>",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(opts.SFTPDir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(b) != expected {
+			t.Fatalf("%s content %q != %q", name, string(b), expected)
+		}
+	}
+
+	for name, expected := range map[string]os.FileMode{
+		"1/1.1/bin/tool":        0755,
+		"1/1.1/logs/test.log":   0644,
+		"1/1.1/logs/index.html": 0644,
+	} {
+		fi, err := os.Stat(filepath.Join(opts.SFTPDir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode().Perm() != expected {
+			t.Fatalf("%s mode %v != %v", name, fi.Mode().Perm(), expected)
+		}
+	}
+
+	b, _ := ioutil.ReadFile(logFile)
+	log := string(b)
+
+	for _, expected := range []string{
+		"-P 2222", "-o User=deploy", "-i " + opts.SFTPKey, "-o StrictHostKeyChecking=yes",
+		"deploy.example.com\n",
+	} {
+		if !strings.Contains(log, expected) {
+			t.Fatalf("sftp was not run with %q:\n%s", expected, log)
+		}
+	}
+
+	// each worker makes a directory at most once
+	if n := strings.Count(log, "-mkdir '"+filepath.Join(opts.SFTPDir, "1/1.1/logs")+"'"); n != 1 {
+		t.Fatalf("logs directory was made %d times:\n%s", n, log)
+	}
+}
+
+func TestSFTPProviderPassword(t *testing.T) {
+	defer os.Unsetenv("ARTIFACTS_SFTP_HELPER")
+
+	opts := NewOptions()
+	opts.SFTPHost = "deploy.example.com"
+	opts.SFTPPassword = "hunter2"
+	opts.SFTPDir = "uploads"
+
+	sp, logFile := getTestSFTPProvider(t, opts)
+	defer os.RemoveAll(filepath.Dir(logFile))
+
+	os.Setenv("ARTIFACTS_SFTP_HELPER_REMOTE", filepath.Dir(logFile))
+	defer os.Unsetenv("ARTIFACTS_SFTP_HELPER_REMOTE")
+
+	results := runTestSFTPUpload(sp, opts,
+		artifact.NewFromBytes("", "a.txt", []byte("a"), &artifact.Options{}))
+	if !results[0].UploadResult.OK {
+		t.Fatalf("unexpected error: %v", results[0].UploadResult.Err)
+	}
+
+	if results[0].UploadResult.URL != "sftp://deploy.example.com:22/~/uploads/a.txt" {
+		t.Fatalf("unexpected url %q", results[0].UploadResult.URL)
+	}
+
+	b, _ := ioutil.ReadFile(logFile)
+	log := string(b)
+	if args := strings.SplitN(log, "\n", 2)[0]; strings.Contains(args, "hunter2") {
+		t.Fatalf("password was passed as an argument: %s", args)
+	}
+	if !strings.Contains(log, "askpass: hunter2\n") || !strings.Contains(log, "-o BatchMode=no") {
+		t.Fatalf("password was not given to askpass:\n%s", log)
+	}
+}
+
+func TestSFTPProviderRetries(t *testing.T) {
+	defer os.Unsetenv("ARTIFACTS_SFTP_HELPER")
+	defer os.Unsetenv("ARTIFACTS_SFTP_HELPER_FAIL")
+
+	for msg, expected := range map[string]struct {
+		attempts uint64
+		category string
+	}{
+		"Connection closed":                            {3, ""},
+		"deploy@host: Permission denied (publickey).":  {1, FailureCredentials},
+		"Host key verification failed.":                {1, FailureValidation},
+		`dest open "/srv/a.txt": Permission denied`:    {1, FailureValidation},
+		"ssh: connect to host host port 22: timed out": {3, ""},
+	} {
+		opts := NewOptions()
+		opts.SFTPHost = "host"
+		opts.Retries = 2
+
+		sp, logFile := getTestSFTPProvider(t, opts)
+		os.Setenv("ARTIFACTS_SFTP_HELPER_FAIL", msg)
+
+		results := runTestSFTPUpload(sp, opts,
+			artifact.NewFromBytes("", "a.txt", []byte("a"), &artifact.Options{}))
+		os.RemoveAll(filepath.Dir(logFile))
+
+		a := results[0]
+		if a.UploadResult.OK {
+			t.Fatalf("%q: upload was expected to fail", msg)
+		}
+		if a.UploadResult.Attempts != expected.attempts {
+			t.Fatalf("%q: attempts %d != %d", msg, a.UploadResult.Attempts, expected.attempts)
+		}
+		if FailureCategory(a.UploadResult.Err) != expected.category {
+			t.Fatalf("%q: category %q != %q", msg, FailureCategory(a.UploadResult.Err), expected.category)
+		}
+		if !strings.Contains(a.UploadResult.Err.Error(), msg) {
+			t.Fatalf("%q: unexpected error: %v", msg, a.UploadResult.Err)
+		}
+	}
+}
+
+func TestValidateSFTP(t *testing.T) {
+	for _, tc := range []struct {
+		host, user, dir string
+		port            uint64
+		msg             string
+	}{
+		{"deploy.example.com", "deploy", "/srv/artifacts", 22, ""},
+		{"::1", "", "", 22, ""},
+		{"", "", "", 22, "no sftp host given"},
+		{"-oProxyCommand=x", "", "", 22, "invalid --sftp-host"},
+		{"deploy@host", "", "", 22, "invalid --sftp-host"},
+		{"host", "", "", 0, "invalid --sftp-port"},
+		{"host", "", "", 70000, "invalid --sftp-port"},
+		{"host", "de ploy", "", 22, "invalid --sftp-user"},
+		{"host", "", "it's", 22, "invalid --sftp-dir"},
+	} {
+		opts := NewOptions()
+		opts.Provider = "sftp"
+		opts.SFTPHost = tc.host
+		opts.SFTPUser = tc.user
+		opts.SFTPDir = tc.dir
+		opts.SFTPPort = tc.port
+
+		err := opts.Validate()
+		if tc.msg == "" && err != nil {
+			t.Fatalf("%#v: unexpected error: %v", tc, err)
+		}
+		if tc.msg != "" && (err == nil || !strings.Contains(err.Error(), tc.msg)) {
+			t.Fatalf("%#v: unexpected error: %v", tc, err)
+		}
+	}
+}
+
+// TestSFTPHelperProcess is run in place of sftp by the sftp provider
+// tests.  It runs the batch against the local filesystem, relative to
+// $ARTIFACTS_SFTP_HELPER_REMOTE, or fails with
+// $ARTIFACTS_SFTP_HELPER_FAIL.
+func TestSFTPHelperProcess(t *testing.T) {
+	logDir := getSFTPHelperEnv("ARTIFACTS_SFTP_HELPER")
+	if logDir == "" || flag.NArg() == 0 {
+		return
+	}
+
+	log, err := os.OpenFile(filepath.Join(logDir, "log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer log.Close()
+
+	fmt.Fprintln(log, strings.Join(flag.Args(), " "))
+
+	if askpass := getSFTPHelperEnv("SSH_ASKPASS"); askpass != "" {
+		cmd := exec.Command(askpass)
+		cmd.Env = sftpHelperEnv
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fmt.Fprintf(log, "askpass: %s", out)
+	}
+
+	if msg := getSFTPHelperEnv("ARTIFACTS_SFTP_HELPER_FAIL"); msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(255)
+	}
+
+	batchFile := ""
+	for i, arg := range flag.Args() {
+		if arg == "-b" {
+			batchFile = flag.Arg(i + 1)
+		}
+	}
+
+	batch, err := ioutil.ReadFile(batchFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Fprint(log, string(batch))
+
+	remote := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(getSFTPHelperEnv("ARTIFACTS_SFTP_HELPER_REMOTE"), p)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(batch)), "\n") {
+		fields := strings.Split(line, "'")
+		switch strings.TrimSpace(fields[0]) {
+		case "-mkdir":
+			os.Mkdir(remote(fields[1]), 0755)
+		case "put -p":
+			b, err := ioutil.ReadFile(fields[1])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			fi, err := os.Stat(fields[1])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := ioutil.WriteFile(remote(fields[3]), b, fi.Mode().Perm()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			os.Chmod(remote(fields[3]), fi.Mode().Perm())
+		default:
+			t.Fatalf("unexpected batch line %q", line)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package upload
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+)
+
+// shardOf assigns the artifact dest to one of count shards by its FNV-1a
+// hash, which depends only on the slash-separated dest, so that every job
+// given the same files agrees on which one uploads each of them
+func shardOf(dest string, count uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.TrimLeft(filepath.ToSlash(dest), "/")))
+	return h.Sum64() % count
+}
+
+// inShard reports whether the artifact dest belongs to this job's shard
+func (u *uploader) inShard(dest string) bool {
+	if u.Opts.ShardCount <= 1 {
+		return true
+	}
+	return shardOf(dest, u.Opts.ShardCount) == u.Opts.ShardIndex
+}
+
+func (u *uploader) shardDetail() string {
+	return fmt.Sprintf("%d/%d", u.Opts.ShardIndex, u.Opts.ShardCount)
+}
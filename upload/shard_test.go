@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestShardOfStable(t *testing.T) {
+	if shardOf("/index.html", 7) != shardOf("index.html", 7) {
+		t.Fatalf("leading slash changed the shard")
+	}
+
+	// these must never change, or jobs running different versions would
+	// disagree about which of them uploads each file
+	for dest, shard := range map[string]uint64{
+		"a.txt":     2,
+		"b.txt":     3,
+		"docs/c.md": 3,
+		"docs/d.md": 0,
+	} {
+		if shardOf(dest, 4) != shard {
+			t.Fatalf("shard of %q %v != %v", dest, shardOf(dest, 4), shard)
+		}
+	}
+}
+
+func TestUploaderShards(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 40; i++ {
+		files[fmt.Sprintf("dir%d/file%d.txt", i%3, i)] = "x"
+	}
+	dir := writeTestFiles(t, files)
+	defer os.RemoveAll(dir)
+
+	const shardCount = 4
+	seen := map[string]uint64{}
+	for index := uint64(0); index < shardCount; index++ {
+		os.Clearenv()
+		opts := NewOptions()
+		opts.WorkingDir = dir
+		opts.Paths = []string{dir}
+		opts.TargetPaths = []string{"sharded"}
+		opts.ShardIndex = index
+		opts.ShardCount = shardCount
+
+		fake := &recordingProvider{}
+		u := newUploader(opts, getPanicLogger())
+		u.Provider = fake
+		if err := u.Upload(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(fake.Uploaded) == 0 {
+			t.Fatalf("shard %v uploaded nothing", index)
+		}
+
+		for _, source := range fake.Sources(dir) {
+			if other, ok := seen[source]; ok {
+				t.Fatalf("%v uploaded by shards %v and %v", source, other, index)
+			}
+			seen[source] = index
+		}
+	}
+
+	missing := []string{}
+	for name := range files {
+		if _, ok := seen[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	if len(missing) > 0 {
+		t.Fatalf("not uploaded by any shard: %v", strings.Join(missing, ", "))
+	}
+}
+
+func TestValidateShards(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.BucketName = "foo"
+	opts.ShardIndex = 2
+	opts.ShardCount = 2
+
+	err := opts.Validate()
+	if err == nil || err.Error() != "--shard-index 2 must be less than --shard-count 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.ShardIndex = 0
+	opts.ShardCount = 0
+	err = opts.Validate()
+	if err == nil || err.Error() != "--shard-count must be at least 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
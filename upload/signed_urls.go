@@ -0,0 +1,125 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// maxSignedURLTTLV4 is the longest s3 honors a url signed with version 4
+const maxSignedURLTTLV4 = 7 * 24 * time.Hour
+
+// signsV4 reports whether s3 requests are signed with signature version
+// 4, which s3 only requires of kms requests
+func (opts *Options) signsV4() bool {
+	return opts.ServerSideEncryption == sseKMS
+}
+
+// validateSignedURLs checks that --signed-urls can work, which they can't
+// for SSE-C objects, since downloading those takes the key in headers
+func (opts *Options) validateSignedURLs() error {
+	if !opts.SignedURLs {
+		return nil
+	}
+
+	if opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--signed-urls requires the s3 provider")
+	}
+
+	if opts.SSECustomerKey != "" {
+		return fmt.Errorf("--signed-urls cannot be used along with --sse-c-key, since downloading takes the key")
+	}
+
+	if opts.SignedURLTTL <= 0 {
+		return fmt.Errorf("--signed-url-ttl must be positive")
+	}
+
+	if opts.signsV4() && opts.SignedURLTTL > maxSignedURLTTLV4 {
+		return fmt.Errorf("--signed-url-ttl must be at most %v with --sse %s", maxSignedURLTTLV4, sseKMS)
+	}
+
+	return nil
+}
+
+// signURL sets and logs the artifact's signed url, signed the same way as
+// the requests that uploaded it.  It works until the ttl is up, or until
+// temporary credentials expire, whichever is first.
+func (s3p *s3Provider) signURL(conn *s3.S3, opts *Options, a *artifact.Artifact, now time.Time) {
+	a.UploadResult.SignedURL = presignS3URL(conn.Auth, conn.Region, opts.BucketName, a.FullDest(),
+		opts.signsV4(), opts.SignedURLTTL, now)
+
+	s3p.log.WithFields(logrus.Fields{
+		"artifact":   a.FullDest(),
+		"expires":    now.Add(opts.SignedURLTTL).UTC().Format(time.RFC3339),
+		"signed_url": a.UploadResult.SignedURL,
+	}).Info("signed url")
+}
+
+// presignS3URL is a url that GETs the key without credentials of its own
+// until the ttl is up
+func presignS3URL(auth aws.Auth, region aws.Region, bucketName, key string, v4 bool, ttl time.Duration, now time.Time) string {
+	escapedKey := awsPathEscape(key)
+
+	u, _ := url.Parse(s3ObjectURL(region, bucketName, escapedKey))
+
+	query := url.Values{}
+	if v4 {
+		now = now.UTC()
+		query.Set("X-Amz-Algorithm", sigV4Algorithm)
+		query.Set("X-Amz-Credential", auth.AccessKey+"/"+sigV4Scope(region.Name, "s3", now))
+		query.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+		query.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+		query.Set("X-Amz-SignedHeaders", "host")
+		if auth.Token != "" {
+			query.Set("X-Amz-Security-Token", auth.Token)
+		}
+
+		canonicalRequest := strings.Join([]string{
+			"GET",
+			u.EscapedPath(),
+			canonicalQueryV4(query),
+			"host:" + u.Host + "\n",
+			"host",
+			sigV4UnsignedPayload,
+		}, "\n")
+		u.RawQuery = canonicalQueryV4(query) + "&X-Amz-Signature=" +
+			sigV4Signature(auth.SecretKey, region.Name, "s3", now, canonicalRequest)
+		return u.String()
+	}
+
+	expires := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	amz := ""
+	if auth.Token != "" {
+		amz = "x-amz-security-token:" + auth.Token + "\n"
+		query.Set("x-amz-security-token", auth.Token)
+	}
+
+	hash := hmac.New(sha1.New, []byte(auth.SecretKey))
+	hash.Write([]byte("GET\n\n\n" + expires + "\n" + amz + "/" + bucketName + "/" + escapedKey))
+
+	query.Set("AWSAccessKeyId", auth.AccessKey)
+	query.Set("Expires", expires)
+	query.Set("Signature", base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// awsPathEscape escapes a key the way aws does, leaving only unreserved
+// characters and slashes as they are
+func awsPathEscape(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = awsQueryEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,211 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// sizeGroup is what the files of one group of the size breakdown add to
+// the total
+type sizeGroup struct {
+	Name  string
+	Size  uint64
+	Files uint64
+}
+
+func (opts *Options) validateSizeBudget() error {
+	if opts.TrimOrder != "largest" && opts.TrimOrder != "oldest" {
+		return fmt.Errorf("unknown --trim-order %q, expected largest or oldest", opts.TrimOrder)
+	}
+
+	if opts.TrimToFit && opts.bundling() {
+		return fmt.Errorf("--trim-to-fit cannot leave files out of a bundle, which --max-size holds as a whole")
+	}
+
+	for _, pattern := range opts.SizeBreakdown {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid --size-breakdown glob %q: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// sizeGroupName is the group of the size breakdown that a file falls in:
+// the first --size-breakdown glob it matches, or else the top directory
+// of its path relative to the working dir
+func (u *uploader) sizeGroupName(relPath string) string {
+	for _, pattern := range u.Opts.SizeBreakdown {
+		if matchGlob(pattern, relPath) {
+			return pattern
+		}
+	}
+
+	parts := strings.SplitN(filepath.ToSlash(relPath), "/", 2)
+	if len(parts) < 2 {
+		return "."
+	}
+	return parts[0] + "/"
+}
+
+// countSize adds an artifact's size to its group of the breakdown, with
+// curSize held
+func (u *uploader) countSize(relPath string, size uint64) {
+	if u.curSize.Groups == nil {
+		u.curSize.Groups = map[string]*sizeGroup{}
+	}
+
+	name := u.sizeGroupName(relPath)
+	g, ok := u.curSize.Groups[name]
+	if !ok {
+		g = &sizeGroup{Name: name}
+		u.curSize.Groups[name] = g
+	}
+	g.Size += size
+	g.Files++
+}
+
+// logSizeBreakdown logs what each group adds to the total, largest first
+func (u *uploader) logSizeBreakdown(level logrus.Level) {
+	groups := []*sizeGroup{}
+	for _, g := range u.curSize.Groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+		return groups[i].Name < groups[j].Name
+	})
+
+	total := uint64(0)
+	for _, g := range groups {
+		total += g.Size
+	}
+
+	for _, g := range groups {
+		entry := u.log.WithFields(logrus.Fields{
+			"group":   g.Name,
+			"size":    humanize.Bytes(g.Size),
+			"files":   g.Files,
+			"percent": fmt.Sprintf("%.1f%%", 100*float64(g.Size)/float64(total)),
+		})
+		if level == logrus.ErrorLevel {
+			entry.Error("size of artifacts by group")
+		} else {
+			entry.Info("size of artifacts by group")
+		}
+	}
+}
+
+// maxSizeError fails the walk once it is done if the artifacts it found
+// add up to more than --max-size, giving what each group contributed
+func (u *uploader) maxSizeError() error {
+	if !u.curSize.Exceeded {
+		return nil
+	}
+
+	u.logSizeBreakdown(logrus.ErrorLevel)
+	return categorize(FailureSizeLimit, fmt.Errorf("max-size would be exceeded: found %s of artifacts to upload, more than --max-size %s",
+		humanize.Bytes(u.curSize.Current), humanize.Bytes(u.Opts.MaxSize)))
+}
+
+// trimToFit holds every artifact until the walk is done when --trim-to-fit
+// is set, and then leaves out the largest or oldest of them until the
+// rest fit --max-size
+func (u *uploader) trimToFit(in chan *artifact.Artifact) (chan *artifact.Artifact, error) {
+	if !u.Opts.TrimToFit {
+		return in, nil
+	}
+
+	held := []*artifact.Artifact{}
+	for a := range in {
+		held = append(held, a)
+	}
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	if u.curSize.Current > u.Opts.MaxSize {
+		u.logSizeBreakdown(logrus.InfoLevel)
+		held = u.trim(held)
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for _, a := range held {
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// trim leaves out artifacts in --trim-order until the rest fit, keeping
+// the order of those that are left
+func (u *uploader) trim(held []*artifact.Artifact) []*artifact.Artifact {
+	type candidate struct {
+		a       *artifact.Artifact
+		size    uint64
+		modTime time.Time
+	}
+
+	candidates := []*candidate{}
+	for _, a := range held {
+		size, _ := a.Size()
+		modTime, _ := a.ModTime()
+		candidates = append(candidates, &candidate{a: a, size: size, modTime: modTime})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if u.Opts.TrimOrder == "oldest" {
+			return candidates[i].modTime.Before(candidates[j].modTime)
+		}
+		return candidates[i].size > candidates[j].size
+	})
+
+	dropped := map[*artifact.Artifact]bool{}
+	droppedSize := uint64(0)
+	for _, c := range candidates {
+		if u.curSize.Current <= u.Opts.MaxSize {
+			break
+		}
+
+		dropped[c.a] = true
+		droppedSize += c.size
+		u.curSize.Current -= c.size
+
+		u.log.WithFields(logrus.Fields{
+			"artifact":      c.a.FullDest(),
+			"artifact_size": humanize.Bytes(c.size),
+			"modified":      c.modTime.Format(time.RFC3339),
+		}).Warn("leaving out artifact to fit --max-size")
+		u.decide(artifactSourceName(c.a), false, "trim-to-fit", humanize.Bytes(u.Opts.MaxSize))
+	}
+
+	kept := []*artifact.Artifact{}
+	for _, a := range held {
+		if !dropped[a] {
+			kept = append(kept, a)
+		}
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"dropped":      len(dropped),
+		"dropped_size": humanize.Bytes(droppedSize),
+		"total_size":   humanize.Bytes(u.curSize.Current),
+		"max_size":     humanize.Bytes(u.Opts.MaxSize),
+	}).Warn(fmt.Sprintf("left out %d artifacts (%s) to fit --max-size %s",
+		len(dropped), humanize.Bytes(droppedSize), humanize.Bytes(u.Opts.MaxSize)))
+
+	return kept
+}
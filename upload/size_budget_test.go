@@ -0,0 +1,159 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSizeBudgetFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"build/a.txt": "aaaa",
+		"build/b.txt": "bbbb",
+		"logs/x.log":  "0123456789",
+		"top.txt":     "t",
+	})
+}
+
+func sizeBudgetOpts(dir string, maxSize uint64) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"."}
+		opts.TargetPaths = []string{"budget"}
+		opts.MaxSize = maxSize
+	}
+}
+
+func TestUploaderMaxSizeBreakdown(t *testing.T) {
+	os.Clearenv()
+	dir := writeSizeBudgetFiles(t)
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	rp := &recordingProvider{}
+	u := getTestUploader(log, sizeBudgetOpts(dir, 6))
+	u.Opts.SizeBreakdown = []string{"**/*.log"}
+	u.Provider = rp
+
+	err := u.Upload()
+	if err == nil || !strings.Contains(err.Error(), "found 19B of artifacts to upload, more than --max-size 6B") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if FailureCategory(err) != FailureSizeLimit {
+		t.Fatalf("failure category %q != %q", FailureCategory(err), FailureSizeLimit)
+	}
+
+	// files are uploaded as they are found, up to the limit
+	if dests := rp.FullDests(); !reflect.DeepEqual(dests, []string{"budget/build/a.txt"}) {
+		t.Fatalf("artifacts uploaded %v != [budget/build/a.txt]", dests)
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "size of artifacts by group") {
+			lines = append(lines, line)
+		}
+	}
+
+	// largest first
+	for i, expected := range [][]string{
+		{`group="**/*.log"`, `size="10B"`, `files=1`, `percent="52.6%"`},
+		{`group="build/"`, `size="8B"`, `files=2`, `percent="42.1%"`},
+		{`group="."`, `size="1B"`, `files=1`, `percent="5.3%"`},
+	} {
+		if len(lines) != 3 {
+			t.Fatalf("breakdown lines %v != 3: %s", len(lines), buf.String())
+		}
+		for _, field := range expected {
+			if !strings.Contains(lines[i], field) {
+				t.Fatalf("breakdown line %d does not contain %s: %s", i, field, lines[i])
+			}
+		}
+	}
+}
+
+func TestUploaderMaxFileSize(t *testing.T) {
+	os.Clearenv()
+	dir := writeSizeBudgetFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, sizeBudgetOpts(dir, 1000))
+	u.Opts.MaxFileSize = 5
+
+	err := u.Upload()
+	if err == nil || !strings.Contains(err.Error(), "logs/x.log is 10B, more than --max-file-size 5B") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if FailureCategory(err) != FailureSizeLimit {
+		t.Fatalf("failure category %q != %q", FailureCategory(err), FailureSizeLimit)
+	}
+}
+
+func TestUploaderTrimToFit(t *testing.T) {
+	for _, tc := range []struct {
+		order       string
+		maxFileSize uint64
+		maxSize     uint64
+		expected    []string
+	}{
+		{"largest", 0, 10, []string{"budget/build/a.txt", "budget/build/b.txt", "budget/top.txt"}},
+		{"largest", 0, 5, []string{"budget/build/b.txt", "budget/top.txt"}},
+		{"oldest", 0, 10, []string{"budget/logs/x.log"}},
+		{"oldest", 5, 10, []string{"budget/build/a.txt", "budget/build/b.txt", "budget/top.txt"}},
+		{"oldest", 5, 6, []string{"budget/build/b.txt", "budget/top.txt"}},
+	} {
+		os.Clearenv()
+		dir := writeSizeBudgetFiles(t)
+		defer os.RemoveAll(dir)
+
+		// oldest to newest: a.txt, b.txt, top.txt, x.log
+		for i, name := range []string{"build/a.txt", "build/b.txt", "top.txt", "logs/x.log"} {
+			mtime := time.Date(2000+i, 1, 1, 0, 0, 0, 0, time.UTC)
+			if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rp := &recordingProvider{}
+		u := getTestUploader(nil, sizeBudgetOpts(dir, tc.maxSize))
+		u.Opts.MaxFileSize = tc.maxFileSize
+		u.Opts.TrimToFit = true
+		u.Opts.TrimOrder = tc.order
+		u.Provider = rp
+
+		if err := u.Upload(); err != nil {
+			t.Fatalf("%s %v: unexpected error: %v", tc.order, tc.maxSize, err)
+		}
+
+		uploaded := rp.FullDests()
+		sort.Strings(uploaded)
+		if !reflect.DeepEqual(uploaded, tc.expected) {
+			t.Fatalf("%s %v: uploaded %v != %v", tc.order, tc.maxSize, uploaded, tc.expected)
+		}
+	}
+}
+
+func TestValidateSizeBudget(t *testing.T) {
+	for _, tc := range []struct {
+		configure func(*Options)
+		msg       string
+	}{
+		{func(opts *Options) { opts.TrimOrder = "newest" }, "unknown --trim-order"},
+		{func(opts *Options) { opts.TrimToFit = true; opts.Bundle = true }, "--trim-to-fit cannot"},
+		{func(opts *Options) { opts.SizeBreakdown = []string{"[logs"} }, "invalid --size-breakdown"},
+	} {
+		opts := NewOptions()
+		opts.Provider = "null"
+		tc.configure(opts)
+
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%v: unexpected error: %v", tc.msg, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package upload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// unchangedFilter drops artifacts whose objects already have the same
+// content when --skip-unchanged is set, checking --concurrency of them at
+// a time.  Providers that can't fetch an object's headers get everything.
+func (u *uploader) unchangedFilter(in chan *artifact.Artifact) chan *artifact.Artifact {
+	if !u.Opts.SkipUnchanged {
+		return in
+	}
+
+	fetcher, ok := u.Provider.(HeaderFetcher)
+	if !ok {
+		u.log.WithField("provider", u.Provider.Name()).Warn(
+			"--skip-unchanged is not supported by the provider, uploading everything")
+		return in
+	}
+
+	workers := int(u.Opts.Concurrency)
+	if workers < 1 {
+		workers = 1
+	}
+
+	out := make(chan *artifact.Artifact)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range in {
+				if u.remoteUnchanged(fetcher, a) {
+					u.log.WithField("key", a.FullDest()).Debug("unchanged, skipping")
+					atomic.AddUint64(&u.skippedUnchanged, 1)
+					continue
+				}
+				out <- a
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// remoteUnchanged reports whether the artifact's object exists with an
+// etag matching the artifact's md5.  Objects that are missing or were
+// uploaded in parts, and so have no md5 etag, count as changed.
+func (u *uploader) remoteUnchanged(fetcher HeaderFetcher, a *artifact.Artifact) bool {
+	headers, err := fetcher.FetchHeaders(u.Opts, a)
+	if err != nil {
+		u.log.WithFields(logrus.Fields{
+			"key": a.FullDest(),
+			"err": err,
+		}).Debug("no remote object to compare, uploading")
+		return false
+	}
+
+	etag := strings.Trim(headers.Get("ETag"), `"`)
+	if etag == "" || strings.Contains(etag, "-") {
+		return false
+	}
+
+	if length := headers.Get("Content-Length"); length != "" {
+		size, err := a.Size()
+		if remoteSize, perr := strconv.ParseUint(length, 10, 64); err != nil || perr != nil || size != remoteSize {
+			return false
+		}
+	}
+
+	sum, err := artifactMD5(a)
+	return err == nil && sum == etag
+}
+
+// logSummary logs how many artifacts were uploaded, left alone by
+// --skip-unchanged, and failed
+func (u *uploader) logSummary(failed int) {
+	uploaded := u.resultCount() - failed
+	skipped := atomic.LoadUint64(&u.skippedUnchanged)
+
+	// canceled artifacts are counted apart from the ones that failed
+	canceled := 0
+	for _, a := range u.failedResults() {
+		if isCanceled(a.UploadResult.Err) {
+			canceled++
+		}
+	}
+	failed -= canceled
+
+	u.log.WithFields(logrus.Fields{
+		"uploaded":          uploaded,
+		"skipped_unchanged": skipped,
+		"failed":            failed,
+		"canceled":          canceled,
+	}).Info(fmt.Sprintf("uploaded %d, skipped (unchanged) %d, failed %d, canceled %d",
+		uploaded, skipped, failed, canceled))
+}
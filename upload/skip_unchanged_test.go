@@ -0,0 +1,143 @@
+package upload
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func skipUnchangedTestUpload(t *testing.T, dir string, skip bool) *uploader {
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"skip-unchanged-test"}
+		opts.SkipUnchanged = skip
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return u
+}
+
+func uploadedDests(u *uploader) []string {
+	dests := []string{}
+	for _, a := range u.results {
+		dests = append(dests, a.FullDest())
+	}
+	sort.Strings(dests)
+	return dests
+}
+
+func TestUploadSkipUnchanged(t *testing.T) {
+	clearTestS3Prefix(t, "skip-unchanged-test/")
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "a",
+		"out/b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	u := skipUnchangedTestUpload(t, dir, true)
+	expected := []string{"skip-unchanged-test/out/a.txt", "skip-unchanged-test/out/b.txt"}
+	if !reflect.DeepEqual(uploadedDests(u), expected) {
+		t.Fatalf("first upload %v != %v", uploadedDests(u), expected)
+	}
+
+	err := ioutil.WriteFile(filepath.Join(dir, "out", "b.txt"), []byte("bb"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "out", "c.txt"), []byte("c"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u = skipUnchangedTestUpload(t, dir, true)
+	expected = []string{"skip-unchanged-test/out/b.txt", "skip-unchanged-test/out/c.txt"}
+	if !reflect.DeepEqual(uploadedDests(u), expected) {
+		t.Fatalf("second upload %v != %v", uploadedDests(u), expected)
+	}
+
+	if u.skippedUnchanged != 1 {
+		t.Fatalf("skipped %v != 1", u.skippedUnchanged)
+	}
+
+	u = skipUnchangedTestUpload(t, dir, false)
+	if len(u.results) != 3 || u.skippedUnchanged != 0 {
+		t.Fatalf("skipped %v of %v without --skip-unchanged", u.skippedUnchanged, len(u.results))
+	}
+}
+
+func TestUploadSkipUnchangedUnsupportedProvider(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "a",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"out/"}
+	opts.SkipUnchanged = true
+
+	rp := &recordingProvider{}
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(rp.Sources(dir), []string{"out/a.txt"}) {
+		t.Fatalf("uploaded %v != [out/a.txt]", rp.Sources(dir))
+	}
+}
+
+type fixedHeaderFetcher struct {
+	Headers http.Header
+	Err     error
+}
+
+func (f *fixedHeaderFetcher) FetchHeaders(opts *Options, a *artifact.Artifact) (http.Header, error) {
+	return f.Headers, f.Err
+}
+
+func TestRemoteUnchanged(t *testing.T) {
+	u := newUploader(NewOptions(), getPanicLogger())
+	a := artifact.NewFromBytes("", "a.txt", []byte("a"), &artifact.Options{})
+
+	for _, tc := range []struct {
+		desc      string
+		fetcher   *fixedHeaderFetcher
+		unchanged bool
+	}{
+		{"matching etag", &fixedHeaderFetcher{Headers: http.Header{
+			"Etag":           {`"0cc175b9c0f1b6a831c399e269772661"`},
+			"Content-Length": {"1"},
+		}}, true},
+		{"different etag", &fixedHeaderFetcher{Headers: http.Header{
+			"Etag": {`"92eb5ffee6ae2fec3ad71c777531578f"`},
+		}}, false},
+		{"different size", &fixedHeaderFetcher{Headers: http.Header{
+			"Etag":           {`"0cc175b9c0f1b6a831c399e269772661"`},
+			"Content-Length": {"2"},
+		}}, false},
+		{"multipart etag", &fixedHeaderFetcher{Headers: http.Header{
+			"Etag": {`"0cc175b9c0f1b6a831c399e269772661-2"`},
+		}}, false},
+		{"no etag", &fixedHeaderFetcher{Headers: http.Header{}}, false},
+		{"missing object", &fixedHeaderFetcher{Err: errUploadFailed}, false},
+	} {
+		if u.remoteUnchanged(tc.fetcher, a) != tc.unchanged {
+			t.Fatalf("%s: unchanged != %v", tc.desc, tc.unchanged)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	slowestUploadsCount = 5
+)
+
+type artifactsByDuration []*artifact.Artifact
+
+func (ad artifactsByDuration) Len() int      { return len(ad) }
+func (ad artifactsByDuration) Swap(i, j int) { ad[i], ad[j] = ad[j], ad[i] }
+func (ad artifactsByDuration) Less(i, j int) bool {
+	return ad[i].UploadResult.Duration > ad[j].UploadResult.Duration
+}
+
+func (u *uploader) isSlow(a *artifact.Artifact) bool {
+	return u.Opts.SlowUploadThreshold > 0 && a.UploadResult.Duration > u.Opts.SlowUploadThreshold
+}
+
+// checkSlowUpload warns about the artifact if it took longer than the
+// slow upload threshold
+func (u *uploader) checkSlowUpload(a *artifact.Artifact) {
+	if !u.isSlow(a) {
+		return
+	}
+
+	u.log.WithFields(slowUploadFields(a)).Warn(fmt.Sprintf("slow upload: %s", a.Source))
+}
+
+// logSlowestUploads lists the slowest uploads once the run is done, but
+// only if any of them were slow enough to warn about
+func (u *uploader) logSlowestUploads() {
+	slowest := artifactsByDuration{}
+	anySlow := false
+	for _, a := range append(append([]*artifact.Artifact{}, u.results...), u.streamed.slowest...) {
+		slowest = append(slowest, a)
+		if u.isSlow(a) {
+			anySlow = true
+		}
+	}
+
+	if !anySlow {
+		return
+	}
+
+	sort.Stable(slowest)
+	if len(slowest) > slowestUploadsCount {
+		slowest = slowest[:slowestUploadsCount]
+	}
+
+	for i, a := range slowest {
+		u.log.WithFields(slowUploadFields(a)).Info(
+			fmt.Sprintf("slowest upload #%d: %s", i+1, a.Source))
+	}
+}
+
+func slowUploadFields(a *artifact.Artifact) logrus.Fields {
+	size, _ := a.Size()
+	duration := a.UploadResult.Duration
+
+	throughput := "n/a"
+	if duration > 0 {
+		throughput = humanize.Bytes(uint64(float64(size)/duration.Seconds())) + "/s"
+	}
+
+	return logrus.Fields{
+		"path":       a.FullDest(),
+		"size":       humanize.Bytes(size),
+		"duration":   duration,
+		"throughput": throughput,
+	}
+}
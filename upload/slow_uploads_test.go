@@ -0,0 +1,109 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// slowProvider takes its time uploading some sources
+type slowProvider struct {
+	Delays map[string]time.Duration
+}
+
+func (sp *slowProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		start := time.Now()
+		time.Sleep(sp.Delays[filepath.Base(a.Source)])
+		a.UploadResult.OK = true
+		a.UploadResult.Duration = time.Since(start)
+		out <- a
+	}
+
+	done <- true
+}
+
+func (sp *slowProvider) Name() string {
+	return "slow"
+}
+
+func TestUploaderSlowUploads(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"fast.txt": "fast",
+		"slow.txt": "slow",
+	})
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = buf
+	log.Level = logrus.InfoLevel
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"fast.txt", "slow.txt"}
+	opts.SlowUploadThreshold = 50 * time.Millisecond
+
+	u := newUploader(opts, log)
+	u.Provider = &slowProvider{Delays: map[string]time.Duration{"slow.txt": 100 * time.Millisecond}}
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	output := buf.String()
+	if strings.Count(output, "slow upload: ") != 1 || !strings.Contains(output, "slow upload: "+filepath.Join(dir, "slow.txt")) {
+		t.Fatalf("slow upload was not warned about in:\n%s", output)
+	}
+
+	if strings.Contains(output, "slow upload: "+filepath.Join(dir, "fast.txt")) {
+		t.Fatalf("fast upload was warned about in:\n%s", output)
+	}
+
+	if !strings.Contains(output, "slowest upload #1: "+filepath.Join(dir, "slow.txt")) ||
+		!strings.Contains(output, "slowest upload #2: "+filepath.Join(dir, "fast.txt")) {
+		t.Fatalf("slowest uploads were not summarized in:\n%s", output)
+	}
+
+	if !strings.Contains(output, "throughput=") {
+		t.Fatalf("throughput was not logged in:\n%s", output)
+	}
+}
+
+func TestUploaderNoSlowUploads(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"fast.txt": "fast"})
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = buf
+	log.Level = logrus.InfoLevel
+
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.WorkingDir = dir
+	opts.Paths = []string{"fast.txt"}
+
+	u := newUploader(opts, log)
+	u.Provider = &slowProvider{}
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "slow") {
+		t.Fatalf("unexpected slow upload logging in:\n%s", buf.String())
+	}
+}
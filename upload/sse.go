@@ -0,0 +1,79 @@
+package upload
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+const (
+	sseAES256 = "AES256"
+	sseKMS    = "aws:kms"
+
+	sseCustomerKeySize = 32
+)
+
+// validateSSE checks --sse against the algorithms s3 knows, and that a
+// kms key id is only given along with aws:kms
+func (opts *Options) validateSSE() error {
+	switch opts.ServerSideEncryption {
+	case "", sseAES256, sseKMS:
+	default:
+		return fmt.Errorf("unknown --sse algorithm %q (expected %s or %s)",
+			opts.ServerSideEncryption, sseAES256, sseKMS)
+	}
+
+	if opts.SSEKMSKeyID != "" && opts.ServerSideEncryption != sseKMS {
+		return fmt.Errorf("--sse-kms-key-id requires --sse %s", sseKMS)
+	}
+
+	if opts.SSECustomerKey == "" {
+		return nil
+	}
+
+	if opts.ServerSideEncryption != "" {
+		return fmt.Errorf("--sse-c-key cannot be used along with --sse, since s3 encrypts with one or the other")
+	}
+
+	if opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--sse-c-key requires the s3 provider")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(opts.SSECustomerKey)
+	if err != nil || len(key) != sseCustomerKeySize {
+		return fmt.Errorf("--sse-c-key must be a base64 %d-byte key, e.g. from openssl rand -base64 %d", sseCustomerKeySize, sseCustomerKeySize)
+	}
+
+	return nil
+}
+
+// sseHeaders are the headers asking s3 to encrypt an object.  Without a
+// key id, aws:kms uses the account's default kms key.
+func sseHeaders(opts *Options) map[string][]string {
+	headers := map[string][]string{}
+	if opts.ServerSideEncryption == "" {
+		return headers
+	}
+
+	headers["x-amz-server-side-encryption"] = []string{opts.ServerSideEncryption}
+	if opts.ServerSideEncryption == sseKMS && opts.SSEKMSKeyID != "" {
+		headers["x-amz-server-side-encryption-aws-kms-key-id"] = []string{opts.SSEKMSKeyID}
+	}
+
+	return headers
+}
+
+// sseCustomerKeyHeaders are the headers giving s3 the --sse-c-key, which
+// it encrypts the object with and then forgets, so that they are needed
+// on every request for the object's content
+func sseCustomerKeyHeaders(encodedKey string) http.Header {
+	key, _ := base64.StdEncoding.DecodeString(encodedKey)
+	sum := md5.Sum(key)
+
+	return http.Header{
+		"x-amz-server-side-encryption-customer-algorithm": []string{sseAES256},
+		"x-amz-server-side-encryption-customer-key":       []string{encodedKey},
+		"x-amz-server-side-encryption-customer-key-md5":   []string{base64.StdEncoding.EncodeToString(sum[:])},
+	}
+}
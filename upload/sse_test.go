@@ -0,0 +1,265 @@
+package upload
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestS3ProviderSSEHeaders(t *testing.T) {
+	opts := NewOptions()
+	s3p := newS3Provider(opts, getPanicLogger())
+	a := artifact.New("bucket", "/tmp/whatever.txt", "whatever.txt", &artifact.Options{})
+
+	for _, tc := range []struct {
+		sse, keyID, algorithm, headerKeyID string
+	}{
+		{"", "", "", ""},
+		{"AES256", "", "AES256", ""},
+		{"aws:kms", "", "aws:kms", ""},
+		{"aws:kms", "alias/artifacts", "aws:kms", "alias/artifacts"},
+	} {
+		opts.ServerSideEncryption = tc.sse
+		opts.SSEKMSKeyID = tc.keyID
+
+		headers, err := s3p.objectHeaders(opts, a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if tc.algorithm == "" {
+			if _, ok := headers["x-amz-server-side-encryption"]; ok {
+				t.Fatalf("sse header set without --sse")
+			}
+		} else if !reflect.DeepEqual(headers["x-amz-server-side-encryption"], []string{tc.algorithm}) {
+			t.Fatalf("sse header %v != [%v]", headers["x-amz-server-side-encryption"], tc.algorithm)
+		}
+
+		keyID, ok := headers["x-amz-server-side-encryption-aws-kms-key-id"]
+		if tc.headerKeyID == "" && ok {
+			t.Fatalf("kms key id header set to %v for --sse %q without a key id", keyID, tc.sse)
+		}
+		if tc.headerKeyID != "" && !reflect.DeepEqual(keyID, []string{tc.headerKeyID}) {
+			t.Fatalf("kms key id header %v != [%v]", keyID, tc.headerKeyID)
+		}
+	}
+}
+
+func TestOptionsValidateSSE(t *testing.T) {
+	for _, tc := range []struct {
+		sse, keyID string
+		ok         bool
+	}{
+		{"", "", true},
+		{"AES256", "", true},
+		{"aws:kms", "", true},
+		{"aws:kms", "alias/artifacts", true},
+		{"aes256", "", false},
+		{"rot13", "", false},
+		{"AES256", "alias/artifacts", false},
+		{"", "alias/artifacts", false},
+	} {
+		opts := NewOptions()
+		opts.Provider = "null"
+		opts.ServerSideEncryption = tc.sse
+		opts.SSEKMSKeyID = tc.keyID
+
+		err := opts.Validate()
+		if tc.ok && err != nil {
+			t.Fatalf("--sse %q --sse-kms-key-id %q: unexpected error: %v", tc.sse, tc.keyID, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("--sse %q --sse-kms-key-id %q was accepted", tc.sse, tc.keyID)
+		}
+	}
+}
+
+func TestOptionsValidateSSEWithS3(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+
+	for _, tc := range []struct {
+		sse, keyID, customerKey string
+		msg                     string
+	}{
+		{"AES256", "", "", ""},
+		{"aws:kms", "", "", ""},
+		{"aws:kms", "alias/artifacts", "", ""},
+		{"", "", key, ""},
+		{"AES256", "", key, "cannot be used along with --sse"},
+		{"", "alias/artifacts", key, "requires --sse aws:kms"},
+		{"", "", "not base64!", "base64 32-byte key"},
+		{"", "", base64.StdEncoding.EncodeToString([]byte("short")), "base64 32-byte key"},
+	} {
+		opts := NewOptions()
+		opts.Provider = "s3"
+		opts.BucketName = "bucket"
+		opts.AccessKey = "whatever"
+		opts.SecretKey = "whatever"
+		opts.ServerSideEncryption = tc.sse
+		opts.SSEKMSKeyID = tc.keyID
+		opts.SSECustomerKey = tc.customerKey
+
+		err := opts.Validate()
+		if tc.msg == "" && err != nil {
+			t.Fatalf("--sse %q --sse-kms-key-id %q: unexpected error: %v", tc.sse, tc.keyID, err)
+		}
+		if tc.msg != "" && (err == nil || !strings.Contains(err.Error(), tc.msg)) {
+			t.Fatalf("--sse %q --sse-kms-key-id %q --sse-c-key %q: unexpected error: %v", tc.sse, tc.keyID, tc.customerKey, err)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Provider = "gcs"
+	opts.SSECustomerKey = key
+	if err := opts.validateSSE(); err == nil || !strings.Contains(err.Error(), "requires the s3 provider") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestS3ProviderSSEKMSSignedV4(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.ServerSideEncryption = "aws:kms"
+	opts.SSEKMSKeyID = "alias/artifacts"
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	if req.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "alias/artifacts" {
+		t.Fatalf("kms key id header %q != alias/artifacts", req.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	}
+
+	signed := req.Header.Get("Authorization")
+	if !strings.HasPrefix(signed, sigV4Algorithm+" Credential=whatever/") || !strings.Contains(signed, "/faux-region-9001/s3/aws4_request") {
+		t.Fatalf("request was not signed with version 4 for the region: %q", signed)
+	}
+
+	if !strings.Contains(signed, "x-amz-server-side-encryption-aws-kms-key-id") {
+		t.Fatalf("signature does not cover the kms key id header: %q", signed)
+	}
+
+	// the signature the server would compute matches
+	srvURL, _ := url.Parse(srv.URL)
+	check := &http.Request{Method: req.Method, URL: &url.URL{Host: srvURL.Host, Path: req.URL.Path}, Header: http.Header{}}
+	for k, v := range req.Header {
+		if k != "Authorization" {
+			check.Header[k] = v
+		}
+	}
+	date, _ := time.Parse(sigV4TimeFormat, req.Header.Get("X-Amz-Date"))
+	signV4Payload(check, aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}, "faux-region-9001", "s3", sigV4UnsignedPayload, date)
+	if check.Header.Get("Authorization") != signed {
+		t.Fatalf("signature %q != %q", signed, check.Header.Get("Authorization"))
+	}
+}
+
+func TestS3ProviderSSECustomerKey(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	rawKey := []byte(strings.Repeat("k", 32))
+	sum := md5.Sum(rawKey)
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.SSECustomerKey = base64.StdEncoding.EncodeToString(rawKey)
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	for k, v := range map[string]string{
+		"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+		"X-Amz-Server-Side-Encryption-Customer-Key":       opts.SSECustomerKey,
+		"X-Amz-Server-Side-Encryption-Customer-Key-Md5":   base64.StdEncoding.EncodeToString(sum[:]),
+	} {
+		if req.Header.Get(k) != v {
+			t.Fatalf("%s %q != %q", k, req.Header.Get(k), v)
+		}
+	}
+
+	if _, ok := req.Header["X-Amz-Server-Side-Encryption"]; ok {
+		t.Fatalf("sse header sent along with the customer key")
+	}
+}
+
+func TestS3CustomerKeyRequests(t *testing.T) {
+	transport := &s3RequestTransport{BucketName: "bucket"}
+
+	for _, tc := range []struct {
+		method, url string
+		expected    bool
+	}{
+		{"PUT", "https://s3.amazonaws.com/bucket/a.txt", true},
+		{"HEAD", "https://bucket.s3.amazonaws.com/a.txt", true},
+		{"GET", "https://bucket.s3.amazonaws.com/a.txt", true},
+		{"POST", "https://bucket.s3.amazonaws.com/a.txt?uploads=", true},
+		{"PUT", "https://bucket.s3.amazonaws.com/a.txt?partNumber=1&uploadId=x", true},
+		{"POST", "https://bucket.s3.amazonaws.com/a.txt?uploadId=x", false},
+		{"DELETE", "https://bucket.s3.amazonaws.com/a.txt", false},
+		{"GET", "https://s3.amazonaws.com/bucket/?prefix=a", false},
+		{"GET", "https://bucket.s3.amazonaws.com/?prefix=a", false},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		if actual := transport.isCustomerKeyRequest(req); actual != tc.expected {
+			t.Fatalf("%s %s: customer key request %v != %v", tc.method, tc.url, actual, tc.expected)
+		}
+	}
+}
+
+func TestCanonicalQueryV4(t *testing.T) {
+	query := url.Values{
+		"uploads":  []string{""},
+		"prefix":   []string{"a b/c~"},
+		"a-b":      []string{"2", "1"},
+		"a":        []string{"x"},
+		"max-keys": []string{"1000"},
+	}
+
+	expected := "a=x&a-b=1&a-b=2&max-keys=1000&prefix=a%20b%2Fc~&uploads="
+	if actual := canonicalQueryV4(query); actual != expected {
+		t.Fatalf("canonical query %q != %q", actual, expected)
+	}
+}
+
+func TestS3ProviderSSESigned(t *testing.T) {
+	srv, reqs := getCapturingS3Server(t)
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.BucketName = "bucket"
+	opts.ServerSideEncryption = "AES256"
+
+	uploadOneToS3(t, opts, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	req := <-reqs
+	if req.Header.Get("X-Amz-Server-Side-Encryption") != "AES256" {
+		t.Fatalf("sse header %q != AES256", req.Header.Get("X-Amz-Server-Side-Encryption"))
+	}
+
+	// the signature the server would compute covers the sse header
+	signed := &http.Request{Method: req.Method, URL: req.URL, Header: http.Header{}}
+	for k, v := range req.Header {
+		signed.Header[k] = v
+	}
+	signS3Request(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}, "bucket", signed)
+	if signed.Header.Get("Authorization") != req.Header.Get("Authorization") {
+		t.Fatalf("signature %q != %q", req.Header.Get("Authorization"), signed.Header.Get("Authorization"))
+	}
+
+	delete(signed.Header, "X-Amz-Server-Side-Encryption")
+	signS3Request(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}, "bucket", signed)
+	if signed.Header.Get("Authorization") == req.Header.Get("Authorization") {
+		t.Fatalf("signature does not cover the sse header")
+	}
+}
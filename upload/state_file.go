@@ -0,0 +1,219 @@
+package upload
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// stateEntry is a line of a --state-file, recording an artifact that was
+// uploaded
+type stateEntry struct {
+	Key    string `json:"key"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// stateFile is appended to as each artifact uploads, so that it is up to
+// date however a run ends, and holds what earlier runs recorded
+type stateFile struct {
+	sync.Mutex
+	f        *os.File
+	uploaded map[string]*stateEntry
+}
+
+// openStateFile reads what earlier runs recorded in the state file, if it
+// exists, and opens it to be appended to.  A line cut short by a run that
+// died mid-write is ignored.
+func openStateFile(filename string) (*stateFile, error) {
+	sf := &stateFile{uploaded: map[string]*stateEntry{}}
+
+	if f, err := os.Open(filename); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			entry := &stateEntry{}
+			if json.Unmarshal(scanner.Bytes(), entry) != nil || entry.Key == "" {
+				continue
+			}
+			sf.uploaded[entry.Key] = entry
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// a line cut short is ended, so that the next one isn't lost with it
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte("\n"))
+		}
+	}
+
+	sf.f = f
+	return sf, nil
+}
+
+// Record appends the uploaded artifact.  Streams can't be read again for
+// their sha256 unless it was worked out while uploading.
+func (sf *stateFile) Record(a *artifact.Artifact) error {
+	sum := a.KnownSHA256()
+	if sum == "" && !a.IsStream() {
+		var err error
+		sum, err = a.SHA256()
+		if err != nil {
+			return err
+		}
+	}
+
+	size, err := a.Size()
+	if err != nil || sum == "" {
+		return err
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+
+	entry := &stateEntry{Key: a.FullDest(), Size: size, SHA256: sum}
+	sf.uploaded[entry.Key] = entry
+	return json.NewEncoder(sf.f).Encode(entry)
+}
+
+func (sf *stateFile) get(key string) *stateEntry {
+	sf.Lock()
+	defer sf.Unlock()
+
+	return sf.uploaded[key]
+}
+
+func (sf *stateFile) Close() error {
+	return sf.f.Close()
+}
+
+// recordState records the artifact in the --state-file once it has
+// uploaded
+func (u *uploader) recordState(a *artifact.Artifact) {
+	if u.state == nil || !a.UploadResult.OK {
+		return
+	}
+
+	if err := u.state.Record(a); err != nil {
+		u.log.WithFields(logrus.Fields{
+			"key": a.FullDest(),
+			"err": err,
+		}).Warn("could not record artifact in --state-file")
+	}
+}
+
+// resumeFilter drops the artifacts that the --state-file says an earlier
+// run uploaded, as long as they haven't changed since and their objects
+// are still there with the same size and md5 etag, checking
+// --concurrency of them at a time.  Providers that can't fetch an
+// object's headers get everything.
+func (u *uploader) resumeFilter(in chan *artifact.Artifact) chan *artifact.Artifact {
+	if u.state == nil || len(u.state.uploaded) == 0 {
+		return in
+	}
+
+	fetcher, ok := u.Provider.(HeaderFetcher)
+	if !ok {
+		u.log.WithField("provider", u.Provider.Name()).Warn(
+			"--state-file can't check the objects of the provider, uploading everything")
+		return in
+	}
+
+	workers := int(u.Opts.Concurrency)
+	if workers < 1 {
+		workers = 1
+	}
+
+	out := make(chan *artifact.Artifact)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range in {
+				if u.alreadyUploaded(fetcher, a) {
+					u.log.WithField("key", a.FullDest()).Debug("already uploaded, skipping")
+					atomic.AddUint64(&u.skippedResumed, 1)
+					continue
+				}
+				out <- a
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+		if skipped := atomic.LoadUint64(&u.skippedResumed); skipped > 0 {
+			u.log.WithField("state_file", u.Opts.StateFile).Info(
+				fmt.Sprintf("skipped %d artifacts already uploaded", skipped))
+		}
+	}()
+
+	return out
+}
+
+// alreadyUploaded reports whether the state file records the artifact
+// with the same size and sha256 it has now, and its object still has that
+// size, and an etag that is its md5 unless it was uploaded in parts
+func (u *uploader) alreadyUploaded(fetcher HeaderFetcher, a *artifact.Artifact) bool {
+	entry := u.state.get(a.FullDest())
+	if entry == nil || a.IsStream() {
+		return false
+	}
+
+	size, err := a.Size()
+	if err != nil || size != entry.Size {
+		return false
+	}
+
+	sum, err := a.SHA256()
+	if err != nil || sum != entry.SHA256 {
+		return false
+	}
+
+	headers, err := fetcher.FetchHeaders(u.Opts, a)
+	if err != nil {
+		u.log.WithFields(logrus.Fields{
+			"key": a.FullDest(),
+			"err": err,
+		}).Debug("recorded object is gone, uploading")
+		return false
+	}
+
+	if length := headers.Get("Content-Length"); length != "" {
+		remoteSize, err := strconv.ParseUint(length, 10, 64)
+		if err != nil || remoteSize != size {
+			return false
+		}
+	}
+
+	etag := strings.Trim(headers.Get("ETag"), `"`)
+	if etag == "" || strings.Contains(etag, "-") {
+		return true
+	}
+
+	md5sum, err := artifactMD5(a)
+	return err == nil && md5sum == etag
+}
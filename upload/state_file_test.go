@@ -0,0 +1,89 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func stateFileTestUpload(t *testing.T, dir, stateFile string) *uploader {
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"state-file-test"}
+		opts.StateFile = stateFile
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return u
+}
+
+func TestUploadStateFile(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "a",
+		"out/b.txt": "b",
+		"out/c.txt": "c",
+	})
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	u := stateFileTestUpload(t, dir, stateFile)
+	if len(u.results) != 3 || u.skippedResumed != 0 {
+		t.Fatalf("first upload skipped %v of %v", u.skippedResumed, len(u.results))
+	}
+
+	b, _ := ioutil.ReadFile(stateFile)
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 3 {
+		t.Fatalf("unexpected state file %q", b)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "out", "b.txt"), []byte("bb"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := testS3.Bucket("bucket").Del("state-file-test/out/c.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a line cut short by a run that died mid-write
+	f, _ := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"key": "state-file-test/out/d.t`)
+	f.Close()
+
+	u = stateFileTestUpload(t, dir, stateFile)
+	expected := []string{"state-file-test/out/b.txt", "state-file-test/out/c.txt"}
+	if !reflect.DeepEqual(uploadedDests(u), expected) {
+		t.Fatalf("resumed upload %v != %v", uploadedDests(u), expected)
+	}
+
+	if u.skippedResumed != 1 {
+		t.Fatalf("skipped %v != 1", u.skippedResumed)
+	}
+
+	u = stateFileTestUpload(t, dir, stateFile)
+	if len(u.results) != 0 || u.skippedResumed != 3 {
+		t.Fatalf("third upload skipped %v, uploaded %v", u.skippedResumed, uploadedDests(u))
+	}
+
+	u = stateFileTestUpload(t, dir, "")
+	if len(u.results) != 3 {
+		t.Fatalf("uploaded %v without --state-file", uploadedDests(u))
+	}
+}
+
+func TestOpenStateFileUnreadable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "artifacts-state-file")
+	defer os.RemoveAll(dir)
+
+	if _, err := openStateFile(filepath.Join(dir, "missing", "state.json")); err == nil {
+		t.Fatalf("state file in a missing directory was accepted")
+	}
+}
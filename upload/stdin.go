@@ -0,0 +1,166 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	// stdinPath is the path that stands for stdin, optionally followed by
+	// ":dest" like any other path
+	stdinPath = "-"
+
+	defaultStdinDest = "stdin"
+)
+
+// queueStdin queues an artifact for stdin for each target path.  When
+// --stdin-size or --stdin-stream is given, stdin is streamed straight to
+// the one target path, and otherwise it is buffered to a temp file first.
+func (u *uploader) queueStdin(artifacts chan *artifact.Artifact) error {
+	artifactOpts := u.artifactOptions()
+
+	// stdin can only be read once, so a dry run plans it without reading it
+	if u.Opts.DryRun && u.Opts.StdinSize == 0 && !u.Opts.StdinStream {
+		for _, targetPath := range u.Opts.TargetPaths {
+			a := artifact.NewFromUnsizedStream(targetPath, u.stdinDest, u.stdin, artifactOpts)
+			if err := u.queueStdinArtifact(a, artifacts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if u.Opts.StdinSize > 0 {
+		a := artifact.NewFromStream(u.Opts.TargetPaths[0], u.stdinDest, u.stdin, u.Opts.StdinSize, artifactOpts)
+		return u.queueStdinArtifact(a, artifacts)
+	}
+
+	if u.Opts.StdinStream {
+		a := artifact.NewFromUnsizedStream(u.Opts.TargetPaths[0], u.stdinDest, u.stdin, artifactOpts)
+		return u.queueStdinArtifact(a, artifacts)
+	}
+
+	// stdin's size isn't known, so this can only check that the temp dir
+	// isn't already short of space
+	f, err := u.tempFile("artifacts-stdin", 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, u.stdin)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, targetPath := range u.Opts.TargetPaths {
+		err := u.queueStdinArtifact(artifact.New(targetPath, f.Name(), u.stdinDest, artifactOpts), artifacts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *uploader) queueStdinArtifact(a *artifact.Artifact, artifacts chan *artifact.Artifact) error {
+	size, err := a.Size()
+	if err != nil {
+		return err
+	}
+
+	u.curSize.Lock()
+	u.curSize.Current += size
+	exceeded := u.curSize.Current > u.Opts.MaxSize && !u.Opts.bundling()
+	u.curSize.Unlock()
+
+	if exceeded {
+		msg := "max-size would be exceeded"
+		u.log.WithFields(logrus.Fields{
+			"artifact":      stdinPath,
+			"artifact_size": humanize.Bytes(size),
+			"max_size":      humanize.Bytes(u.Opts.MaxSize),
+		}).Error(msg)
+		u.decide(stdinPath, false, "max-size", humanize.Bytes(u.Opts.MaxSize))
+		return fmt.Errorf(msg)
+	}
+
+	u.decide(stdinPath, true, "path", stdinPath)
+	return u.queue(a, stdinPath, artifacts)
+}
+
+func (u *uploader) removeTempFiles() {
+	u.tempFilesLock.Lock()
+	defer u.tempFilesLock.Unlock()
+
+	for _, name := range u.tempFiles {
+		err := os.Remove(name)
+		if err != nil {
+			u.log.WithFields(logrus.Fields{
+				"file": name,
+				"err":  err,
+			}).Warn("failed to remove temp file")
+		}
+	}
+	u.tempFiles = nil
+}
+
+// readsStdin reports whether stdin is uploaded, by --stdin or a "-" path
+func (opts *Options) readsStdin() bool {
+	return opts.Stdin || hasStdinPath(opts.Paths)
+}
+
+// stdinName is --name, or else the default name for stdin
+func (opts *Options) stdinName() string {
+	if opts.StdinName != "" {
+		return opts.StdinName
+	}
+	return defaultStdinDest
+}
+
+func (opts *Options) validateStdin() error {
+	if opts.StdinName != "" && !opts.readsStdin() {
+		return fmt.Errorf("--name requires --stdin or a - path")
+	}
+
+	if !opts.StdinStream {
+		return nil
+	}
+
+	if !opts.readsStdin() {
+		return fmt.Errorf("--stdin-stream requires --stdin or a - path")
+	}
+
+	if opts.StdinSize > 0 {
+		return fmt.Errorf("--stdin-stream cannot be used with --stdin-size, which already streams stdin")
+	}
+
+	if opts.Provider != "s3" && opts.Provider != "" {
+		return fmt.Errorf("--stdin-stream requires the s3 provider")
+	}
+
+	if len(opts.TargetPaths) > 1 {
+		return fmt.Errorf("--stdin-stream can only stream stdin to a single target path")
+	}
+
+	return nil
+}
+
+func hasStdinPath(paths []string) bool {
+	for _, p := range paths {
+		if p == stdinPath || len(p) > 1 && p[:2] == stdinPath+":" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func stdinTestOpts(dir string, size uint64) func(*Options) {
+	return func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"-:from-stdin.txt"}
+		opts.TargetPaths = []string{"stdin-test"}
+		opts.StdinSize = size
+	}
+}
+
+func TestUploaderStdinWithSize(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, stdinTestOpts(dir, 19))
+	u.stdin = strings.NewReader("streamed from stdin")
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.results) != 1 || !u.results[0].UploadResult.OK {
+		t.Fatalf("stdin was not uploaded: %#v", u.results)
+	}
+
+	body, err := testS3.Bucket("bucket").Get("stdin-test/from-stdin.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(body) != "streamed from stdin" {
+		t.Fatalf("uploaded body %q != %q", string(body), "streamed from stdin")
+	}
+}
+
+func TestUploaderStdinSizeMismatch(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	for _, size := range []uint64{10, 30} {
+		u := getTestUploader(nil, stdinTestOpts(dir, size))
+		u.stdin = strings.NewReader("streamed from stdin")
+		u.Opts.TargetPaths = []string{"stdin-mismatch"}
+		u.Upload()
+
+		if len(u.results) != 1 || u.results[0].UploadResult.OK {
+			t.Fatalf("size %v: mismatched stdin did not fail: %#v", size, u.results)
+		}
+
+		if !strings.Contains(u.results[0].UploadResult.Err.Error(), "expected") {
+			t.Fatalf("size %v: unexpected error: %v", size, u.results[0].UploadResult.Err)
+		}
+
+		if _, err := testS3.Bucket("bucket").Get("stdin-mismatch/from-stdin.txt"); err == nil {
+			t.Fatalf("size %v: mismatched stdin was uploaded", size)
+		}
+	}
+}
+
+func TestUploaderStdinBuffered(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, stdinTestOpts(dir, 0))
+	u.stdin = strings.NewReader("buffered")
+	u.Opts.TargetPaths = []string{"stdin-buffered-1", "stdin-buffered-2"}
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"stdin-buffered-1/from-stdin.txt", "stdin-buffered-2/from-stdin.txt"} {
+		body, err := testS3.Bucket("bucket").Get(key)
+		if err != nil || string(body) != "buffered" {
+			t.Fatalf("%v: body %q, err %v", key, string(body), err)
+		}
+	}
+
+	if len(u.tempFiles) != 0 {
+		t.Fatalf("temp files were not removed: %v", u.tempFiles)
+	}
+}
+
+func TestValidateStdinSizeSingleTargetPath(t *testing.T) {
+	opts := NewOptions()
+	opts.Paths = []string{"-"}
+	opts.TargetPaths = []string{"one", "two"}
+	opts.StdinSize = 10
+
+	err := opts.Validate()
+	if err == nil || !strings.Contains(err.Error(), "--stdin-size") {
+		t.Fatalf("--stdin-size with two target paths was accepted: %v", err)
+	}
+}
+
+func TestUploaderStdinFlag(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		stdinTestOpts(dir, 0)(opts)
+		opts.Paths = nil
+		opts.Stdin = true
+		opts.StdinName = "build.log"
+	})
+	u.stdin = strings.NewReader("piped")
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, err := testS3.Bucket("bucket").Get("stdin-test/build.log")
+	if err != nil || string(body) != "piped" {
+		t.Fatalf("body %q, err %v", string(body), err)
+	}
+}
+
+func TestValidateStdinStream(t *testing.T) {
+	for _, tc := range []struct {
+		configure func(*Options)
+		msg       string
+	}{
+		{func(opts *Options) { opts.Paths = nil; opts.StdinName = "build.log" }, "--name requires"},
+		{func(opts *Options) { opts.Paths = nil }, "--stdin-stream requires --stdin"},
+		{func(opts *Options) { opts.StdinSize = 10 }, "cannot be used with --stdin-size"},
+		{func(opts *Options) { opts.Provider = "gcs" }, "requires the s3 provider"},
+		{func(opts *Options) { opts.TargetPaths = []string{"one", "two"} }, "single target path"},
+	} {
+		opts := NewOptions()
+		opts.BucketName = "bucket"
+		opts.Paths = []string{"-"}
+		opts.StdinStream = true
+		tc.configure(opts)
+
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%v: unexpected error: %v", tc.msg, err)
+		}
+	}
+}
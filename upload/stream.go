@@ -0,0 +1,85 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// streamedResults counts the artifacts that --stream uploaded without
+// keeping them, along with the slowest few for the end of the run
+type streamedResults struct {
+	Uploaded uint64
+	Bytes    uint64
+
+	slowest artifactsByDuration
+}
+
+// validateStream refuses the options that need every file before the
+// upload starts or every artifact after it's done, which --stream keeps
+// none of
+func (opts *Options) validateStream() error {
+	if !opts.Stream {
+		return nil
+	}
+
+	for _, opt := range []struct {
+		flag string
+		set  bool
+	}{
+		{"--duplicate-keys fail", opts.DuplicateKeys == "fail"},
+		{"--case-collisions", opts.CaseCollisions != "off" && opts.CaseCollisions != ""},
+		{"--expected-count", opts.ExpectedCount != ""},
+		{"--max-files", opts.MaxFiles > 0},
+		{"--max-keys-per-prefix", opts.MaxKeysPerPrefix > 0},
+		{"--trim-to-fit", opts.TrimToFit},
+		{"--upload-order-from", opts.UploadOrderFrom != ""},
+		{"--symlinks ignore-dupes", opts.symlinkMode() == "ignore-dupes"},
+		{"--explain", opts.Explain},
+		{"--sync", opts.Sync},
+		{"--dedup", opts.Dedup != ""},
+		{"--verify-headers", opts.VerifyHeaders != "off" && opts.VerifyHeaders != ""},
+		{"--output-manifest", opts.OutputManifest != ""},
+		{"--output-csv", opts.OutputCSV != ""},
+		{"--output-template", opts.OutputTemplate != ""},
+		{"--result-file", opts.ResultFile != ""},
+		{"--manifest-key", opts.ManifestKey != ""},
+		{"--generate-index", opts.GenerateIndex},
+		{"--write-checksums", opts.WriteChecksums},
+		{"--notify-url", len(opts.NotifyURLs) > 0},
+		{"--github-pr-comment", opts.GithubPRComment},
+		{"--otel-endpoint", opts.OtelEndpoint != ""},
+	} {
+		if opt.set {
+			return fmt.Errorf("--stream cannot be used with %s, which needs every artifact at once", opt.flag)
+		}
+	}
+
+	return nil
+}
+
+// addResult keeps the artifact among the results, or with --stream, only
+// counts it unless it failed
+func (u *uploader) addResult(a *artifact.Artifact) {
+	if !u.Opts.Stream || !a.UploadResult.OK {
+		u.results = append(u.results, a)
+		return
+	}
+
+	size, _ := a.Size()
+	u.streamed.Uploaded++
+	u.streamed.Bytes += size
+
+	u.streamed.slowest = append(u.streamed.slowest, a)
+	sort.Stable(u.streamed.slowest)
+	if len(u.streamed.slowest) > slowestUploadsCount {
+		u.streamed.slowest = u.streamed.slowest[:slowestUploadsCount]
+	}
+}
+
+// resultCount is how many artifacts the run is done with, counting those
+// that --stream didn't keep
+func (u *uploader) resultCount() int {
+	return len(u.results) + int(u.streamed.Uploaded)
+}
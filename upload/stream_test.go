@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// lateFileProvider writes a file for the walk to find once the first
+// artifact reaches it
+type lateFileProvider struct {
+	recordingProvider
+	once   sync.Once
+	create func()
+}
+
+func (lp *lateFileProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	started := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			lp.once.Do(lp.create)
+			started <- a
+		}
+		close(started)
+	}()
+
+	lp.recordingProvider.Upload(ctx, id, opts, started, out, done)
+}
+
+func writeStreamFiles(t *testing.T) string {
+	files := map[string]string{}
+	for i := 0; i < 30; i++ {
+		files[fmt.Sprintf("out/a/%02d.txt", i)] = "aaaa"
+	}
+	files["out/z/first.txt"] = "zzzz"
+	return writeTestFiles(t, files)
+}
+
+func TestUploaderStream(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		os.Clearenv()
+		dir := writeStreamFiles(t)
+		defer os.RemoveAll(dir)
+
+		u := getTestUploader(nil, func(opts *Options) {
+			opts.WorkingDir = dir
+			opts.Paths = []string{"out/"}
+			opts.TargetPaths = []string{"stream-test"}
+			opts.Concurrency = 1
+			opts.Stream = stream
+		})
+		lp := &lateFileProvider{create: func() {
+			ioutil.WriteFile(filepath.Join(dir, "out", "z", "late.txt"), []byte("late"), 0644)
+		}}
+		lp.FailSources = map[string]bool{filepath.Join(dir, "out", "a", "07.txt"): true}
+		u.Provider = lp
+
+		if err := u.Upload(); err != nil {
+			t.Fatalf("stream %v: unexpected error: %v", stream, err)
+		}
+
+		// either way the upload starts before the walk is done, but only a
+		// streamed one keeps only the failure
+		late := strings.Contains(strings.Join(lp.FullDests(), " "), "stream-test/out/z/late.txt")
+		if !late {
+			t.Fatalf("stream %v: did not find the file written during the upload", stream)
+		}
+
+		if stream {
+			if len(u.results) != 1 || u.streamed.Uploaded != 31 || u.streamed.Bytes != 124 {
+				t.Fatalf("kept %d results, counted %#v", len(u.results), u.streamed)
+			}
+		} else if len(u.results) != 32 {
+			t.Fatalf("kept %d results", len(u.results))
+		}
+		if err := u.failureError(); err == nil || !strings.HasPrefix(err.Error(), "1 of 32 artifacts failed") {
+			t.Fatalf("stream %v: unexpected error: %v", stream, err)
+		}
+	}
+}
+
+func TestValidateStream(t *testing.T) {
+	opts := NewOptions()
+	opts.AccessKey = "AKIAFOO"
+	opts.SecretKey = "bar"
+	opts.BucketName = "foo"
+	opts.Stream = true
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.OutputManifest = "manifest.json"
+	err := opts.Validate()
+	if err == nil || err.Error() != "--stream cannot be used with --output-manifest, which needs every artifact at once" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCopyPooled(t *testing.T) {
+	src := bytes.Repeat([]byte("0123456789"), copyBufferSize/4)
+	var dst bytes.Buffer
+	n, err := copyPooled(&dst, bytes.NewReader(src))
+	if err != nil || n != int64(len(src)) || !bytes.Equal(dst.Bytes(), src) {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+
+	buf, release := partBuffer(1024)
+	if len(buf) != 1024 {
+		t.Fatalf("part buffer of %d bytes", len(buf))
+	}
+	release()
+}
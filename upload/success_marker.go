@@ -0,0 +1,17 @@
+package upload
+
+import (
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// successMarkers builds one empty marker artifact per target path, which
+// is only uploaded once everything else has been uploaded successfully so
+// that consumers never see a partial prefix as complete
+func (u *uploader) successMarkers() []*artifact.Artifact {
+	markers := []*artifact.Artifact{}
+	for _, targetPath := range u.Opts.TargetPaths {
+		markers = append(markers,
+			artifact.NewFromBytes(targetPath, u.Opts.SuccessMarker, nil, u.artifactOptions()))
+	}
+	return markers
+}
@@ -0,0 +1,71 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeSuccessMarkerFiles(t *testing.T) string {
+	return writeTestFiles(t, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+	})
+}
+
+func successMarkerOpts(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.Concurrency = 1
+		opts.Paths = []string{dir}
+		opts.TargetPaths = []string{"t1", "t2"}
+		opts.SuccessMarker = "_SUCCESS"
+	}
+}
+
+func TestUploaderSuccessMarker(t *testing.T) {
+	dir := writeSuccessMarkerFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, successMarkerOpts(dir))
+	u.Provider = rp
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dests := rp.FullDests()
+	if len(dests) != 6 {
+		t.Fatalf("uploaded %v != 6: %v", len(dests), dests)
+	}
+
+	if !reflect.DeepEqual(dests[4:], []string{"t1/_SUCCESS", "t2/_SUCCESS"}) {
+		t.Fatalf("success markers not uploaded last: %v", dests)
+	}
+
+	size, _ := rp.Uploaded[4].Size()
+	if size != 0 {
+		t.Fatalf("success marker size %v != 0", size)
+	}
+}
+
+func TestUploaderSuccessMarkerNotWrittenOnFailure(t *testing.T) {
+	dir := writeSuccessMarkerFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, successMarkerOpts(dir))
+	u.Provider = rp
+
+	rp.FailSources = map[string]bool{filepath.Join(dir, "b.txt"): true}
+
+	u.Upload()
+
+	for _, dest := range rp.FullDests() {
+		if filepath.Base(dest) == "_SUCCESS" {
+			t.Fatalf("success marker written despite failure: %v", dest)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// symlinkTargetMetadataKey is the metadata that --symlinks preserve keeps
+// a symlink's target in
+const symlinkTargetMetadataKey = "symlink-target"
+
+// symlinkModes are the values of --symlinks, where "" leaves symlinks to
+// the walk as before, which uploads symlinked files as what they point to
+// and doesn't walk symlinked directories
+var symlinkModes = map[string]bool{
+	"":             true,
+	"follow":       true,
+	"skip":         true,
+	"ignore-dupes": true,
+	"preserve":     true,
+}
+
+// symlinkMode is --symlinks, or follow for --follow-symlinks
+func (opts *Options) symlinkMode() string {
+	if opts.SymlinkMode == "" && opts.FollowSymlinks {
+		return "follow"
+	}
+	return opts.SymlinkMode
+}
+
+// symlinkArtifact is the zero-byte object that --symlinks preserve uploads
+// in place of a symlink, with the symlink's target in its metadata
+func symlinkArtifact(prefix, dest, target string, opts *artifact.Options) *artifact.Artifact {
+	a := artifact.NewFromBytes(prefix, dest, []byte{}, opts)
+	a.Metadata = map[string]string{symlinkTargetMetadataKey: target}
+	return a
+}
+
+// walkSymlink skips the symlink, or walks what it points to as if it were
+// at the symlink's path.  A symlinked directory containing the symlink, or
+// containing any directory the walk went through to get to it, is skipped,
+// since walking it would never end.
+func (u *uploader) walkSymlink(source string, walkFn filepath.WalkFunc) error {
+	if u.Opts.symlinkMode() == "skip" {
+		u.log.WithField("path", source).Debug("skipping symlink")
+		u.decide(source, false, "symlink", "skip")
+		return nil
+	}
+
+	target, err := filepath.EvalSymlinks(source)
+	if os.IsNotExist(err) {
+		u.log.WithField("path", source).Warn("skipping broken symlink")
+		u.decide(source, false, "symlink", "broken")
+		return nil
+	}
+	if err != nil {
+		return u.handleWalkError(source, nil, err)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return u.handleWalkError(source, nil, err)
+	}
+
+	if !info.IsDir() {
+		return walkFn(source, info, nil)
+	}
+
+	if containsWalk(source, target) {
+		u.log.WithFields(logrus.Fields{
+			"path":   source,
+			"target": target,
+		}).Warn("skipping symlink to a directory containing it")
+		u.decide(source, false, "symlink", "cycle")
+		return nil
+	}
+
+	return filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(target, p)
+		if relErr != nil {
+			return relErr
+		}
+		return walkFn(filepath.Join(source, rel), info, err)
+	})
+}
+
+// containsWalk reports whether the target dir contains where any directory
+// above source really is, which for a source under another symlinked
+// directory can be somewhere the target won't contain lexically
+func containsWalk(source, target string) bool {
+	dir, err := filepath.Abs(filepath.Dir(source))
+	if err != nil {
+		return false
+	}
+
+	for {
+		if real, err := filepath.EvalSymlinks(dir); err == nil && containsPath(target, real) {
+			return true
+		}
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// seenCanonically reports whether --symlinks ignore-dupes has already
+// seen the file at the canonical path of source, remembering it if not
+func (u *uploader) seenCanonically(source string) bool {
+	if u.Opts.symlinkMode() != "ignore-dupes" {
+		return false
+	}
+
+	canonical, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return false
+	}
+
+	if first, ok := u.canonical[canonical]; ok {
+		u.log.WithFields(logrus.Fields{
+			"path":  source,
+			"first": first,
+		}).Debug("skipping file already seen by its canonical path")
+		u.decide(source, false, "symlink", "duplicate of "+first)
+		return true
+	}
+
+	u.canonical[canonical] = source
+	return false
+}
+
+// containsPath reports whether p is dir or somewhere below it
+func containsPath(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
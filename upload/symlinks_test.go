@@ -0,0 +1,244 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeSymlinkFiles writes a directory and symlinks to it, one of its
+// files, and, from inside it, its parent
+func writeSymlinkFiles(t *testing.T) string {
+	dir := writeTestFiles(t, map[string]string{
+		"out/real/a.txt": "a",
+		"out/real/b.txt": "b",
+	})
+
+	for link, target := range map[string]string{
+		"out/link-dir":   "real",
+		"out/link-file":  "real/a.txt",
+		"out/real/cycle": "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Skipf("cannot make symlinks: %v", err)
+		}
+	}
+
+	return dir
+}
+
+func symlinkUploadedKeys(t *testing.T, mode string) []string {
+	dir := writeSymlinkFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"links"}
+		opts.SymlinkMode = mode
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("%v: unexpected error: %v", mode, err)
+	}
+
+	keys := rp.FullDests()
+	sort.Strings(keys)
+	return keys
+}
+
+func TestUploaderSymlinks(t *testing.T) {
+	for mode, expected := range map[string][]string{
+		"skip": []string{"links/out/real/a.txt", "links/out/real/b.txt"},
+		"follow": []string{
+			"links/out/link-dir/a.txt",
+			"links/out/link-dir/b.txt",
+			"links/out/link-file",
+			"links/out/real/a.txt",
+			"links/out/real/b.txt",
+		},
+		// the walk reaches link-dir before real, so real's files are the
+		// ones skipped
+		"ignore-dupes": []string{"links/out/link-dir/a.txt", "links/out/link-dir/b.txt"},
+		"preserve": []string{
+			"links/out/link-dir",
+			"links/out/link-file",
+			"links/out/real/a.txt",
+			"links/out/real/b.txt",
+			"links/out/real/cycle",
+		},
+	} {
+		if actual := symlinkUploadedKeys(t, mode); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%v: uploaded %v != %v", mode, actual, expected)
+		}
+	}
+}
+
+func TestUploaderSymlinksDefault(t *testing.T) {
+	for _, key := range symlinkUploadedKeys(t, "") {
+		if key == "links/out/link-dir/a.txt" {
+			t.Fatalf("symlinked directory was walked without --symlinks")
+		}
+	}
+}
+
+func TestValidateSymlinkMode(t *testing.T) {
+	opts := NewOptions()
+	opts.SymlinkMode = "sometimes"
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("unknown --symlinks mode was accepted")
+	}
+
+	opts.SymlinkMode = "skip"
+	opts.FollowSymlinks = true
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("--follow-symlinks was accepted with --symlinks skip")
+	}
+}
+
+func TestUploaderFollowSymlinks(t *testing.T) {
+	dir := writeSymlinkFiles(t)
+	defer os.RemoveAll(dir)
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"links"}
+		opts.FollowSymlinks = true
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := rp.FullDests()
+	sort.Strings(keys)
+	if expected := symlinkUploadedKeys(t, "follow"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("uploaded %v != %v", keys, expected)
+	}
+}
+
+func TestUploaderSymlinksMutualCycle(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"out/a/a.txt": "a",
+		"out/b/b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	for link, target := range map[string]string{
+		"out/a/to-b": "../b",
+		"out/b/to-a": "../a",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Skipf("cannot make symlinks: %v", err)
+		}
+	}
+
+	rp := &recordingProvider{}
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.Provider = "null"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"links"}
+		opts.SymlinkMode = "follow"
+	})
+	u.Provider = rp
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := rp.FullDests()
+	sort.Strings(keys)
+	expected := []string{
+		"links/out/a/a.txt",
+		"links/out/a/to-b/b.txt",
+		"links/out/b/b.txt",
+		"links/out/b/to-a/a.txt",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("uploaded %v != %v", keys, expected)
+	}
+}
+
+func TestUploaderSymlinksPreserveDownload(t *testing.T) {
+	dir := writeSymlinkFiles(t)
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"preserve-test"}
+		opts.SymlinkMode = "preserve"
+	})
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resp, err := testS3.Bucket("bucket").Head("preserve-test/out/link-file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if target := resp.Header.Get("x-amz-meta-symlink-target"); target != "real/a.txt" {
+		t.Fatalf("symlink-target %q != %q", target, "real/a.txt")
+	}
+	if resp.ContentLength != 0 {
+		t.Fatalf("symlink object is %v bytes", resp.ContentLength)
+	}
+
+	dest, err := ioutil.TempDir("", "artifacts-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	dlOpts := &DownloadOptions{Prefix: "preserve-test/out", Dest: dest}
+	if _, err := getTestUploader(nil, downloadOpts).download(dlOpts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for link, expected := range map[string]string{
+		"link-dir":   "real",
+		"link-file":  "real/a.txt",
+		"real/cycle": "..",
+	} {
+		target, err := os.Readlink(filepath.Join(dest, filepath.FromSlash(link)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if target != expected {
+			t.Fatalf("%v target %q != %q", link, target, expected)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "link-file"))
+	if err != nil || string(content) != "a" {
+		t.Fatalf("link-file content %q: %v", content, err)
+	}
+
+	// a target outside of the dest dir is left as the empty object
+	dlOpts = &DownloadOptions{Prefix: "preserve-test/out/real", Dest: filepath.Join(dest, "real-only")}
+	if _, err := getTestUploader(nil, downloadOpts).download(dlOpts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dest, "real-only", "cycle"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fi.Mode().IsRegular() || fi.Size() != 0 {
+		t.Fatalf("symlink out of the dest dir was restored as %v", fi.Mode())
+	}
+}
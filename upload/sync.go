@@ -0,0 +1,317 @@
+package upload
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// SyncOptions are the options for Sync on top of the upload options
+type SyncOptions struct {
+	// Delete removes remote objects that have no local counterpart
+	Delete bool
+	// Confirm must be set for Delete to remove anything, otherwise the
+	// objects that would be deleted are only logged
+	Confirm bool
+}
+
+// SyncResult counts what Sync did, or in the case of deletions without
+// Confirm, what it would have done
+type SyncResult struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Deleted   int
+	DryRun    bool
+}
+
+// remoteIndex holds the objects under the target paths, so that only new
+// and changed files are uploaded.  Seen holds the keys this run wrote or
+// compared, and Kept the keys and prefixes (ending in "/") of the paths it
+// skipped on purpose, neither of which are deleted.
+type remoteIndex struct {
+	Keys   map[string]s3.Key
+	Seen   map[string]bool
+	Kept   []string
+	Result *SyncResult
+}
+
+// Sync makes the target paths mirror the local paths, uploading only new
+// and changed files
+func Sync(opts *Options, syncOpts *SyncOptions, log *logrus.Logger) (*SyncResult, error) {
+	return newUploader(opts, log).sync(syncOpts)
+}
+
+func (u *uploader) sync(syncOpts *SyncOptions) (*SyncResult, error) {
+	s3p, ok := u.Provider.(*s3Provider)
+	if !ok {
+		return nil, fmt.Errorf("sync requires the s3 provider")
+	}
+
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := listTargetPaths(bucket, u.Opts.TargetPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	u.remote = &remoteIndex{
+		Keys:   keys,
+		Seen:   map[string]bool{},
+		Result: &SyncResult{DryRun: syncOpts.Delete && !syncOpts.Confirm},
+	}
+
+	u.log.WithField("remote", len(u.remote.Keys)).Debug("listed remote objects")
+
+	err = u.Upload()
+	if err != nil {
+		return u.remote.Result, err
+	}
+
+	if failed := u.failedResults(); len(failed) > 0 {
+		return u.remote.Result, categorize(FailureCategory(u.failureError()),
+			fmt.Errorf("not syncing deletions, %d files failed to upload", len(failed)))
+	}
+
+	if !syncOpts.Delete {
+		return u.remote.Result, nil
+	}
+
+	return u.remote.Result, u.syncDeletions(bucket, syncOpts.Confirm)
+}
+
+// syncUpload is an upload with --sync, which is what the sync command
+// runs too, with its --delete and --confirm as --sync-delete and
+// --sync-confirm
+func (u *uploader) syncUpload() error {
+	result, err := u.sync(&SyncOptions{Delete: u.Opts.SyncDelete, Confirm: u.Opts.SyncConfirm})
+	if err != nil {
+		return err
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"added":     result.Added,
+		"updated":   result.Updated,
+		"unchanged": result.Unchanged,
+		"deleted":   result.Deleted,
+		"dry_run":   result.DryRun,
+	}).Info("sync complete")
+
+	return u.failureError()
+}
+
+func (u *uploader) syncDeletions(bucket *s3.Bucket, confirm bool) error {
+	stale := []string{}
+	for key := range u.remote.Keys {
+		if !u.remote.Seen[key] && !u.remote.kept(key) && u.keyInShard(key) {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+
+	for _, key := range stale {
+		if !confirm {
+			u.log.WithField("key", key).Info("would delete (pass --confirm to delete)")
+			u.remote.Result.Deleted++
+			continue
+		}
+
+		u.log.WithField("key", key).Info("deleting")
+		err := bucket.Del(key)
+		if err != nil {
+			return err
+		}
+		u.remote.Result.Deleted++
+	}
+
+	return nil
+}
+
+// see marks the key as written by this run, so that it is not deleted
+func (u *uploader) see(key string) {
+	if u.remote != nil {
+		u.remote.Seen[key] = true
+	}
+}
+
+// keep protects the remote objects of a path skipped by an exclude or a
+// walk error from deletion, since the local file was not missing
+func (u *uploader) keep(dest string, isDir bool) {
+	if u.remote == nil {
+		return
+	}
+
+	for _, targetPath := range u.Opts.TargetPaths {
+		key := (&artifact.Artifact{Prefix: targetPath, Dest: dest}).FullDest()
+		if isDir {
+			key = syncPrefix(key)
+		}
+		u.remote.Kept = append(u.remote.Kept, key)
+	}
+}
+
+func (ri *remoteIndex) kept(key string) bool {
+	for _, k := range ri.Kept {
+		if key == k || (strings.HasSuffix(k, "/") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyInShard reports whether the remote key belongs to this job's shard,
+// since the keys of other shards are left to the jobs that upload them
+func (u *uploader) keyInShard(key string) bool {
+	if u.Opts.ShardCount <= 1 {
+		return true
+	}
+
+	for _, targetPath := range u.Opts.TargetPaths {
+		prefix := syncPrefix(targetPath)
+		if strings.HasPrefix(key, prefix) {
+			return u.inShard(strings.TrimPrefix(key, prefix))
+		}
+	}
+	return false
+}
+
+func (u *uploader) failedResults() []*artifact.Artifact {
+	failed := []*artifact.Artifact{}
+	for _, a := range u.results {
+		if !a.UploadResult.OK {
+			failed = append(failed, a)
+		}
+	}
+	return failed
+}
+
+// changedFilter drops artifacts that match their remote objects when
+// syncing, and passes everything along otherwise
+func (u *uploader) changedFilter(in chan *artifact.Artifact) chan *artifact.Artifact {
+	if u.remote == nil {
+		return in
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			key := a.FullDest()
+			u.see(key)
+
+			remote, ok := u.remote.Keys[key]
+			if !ok {
+				u.remote.Result.Added++
+				out <- a
+				continue
+			}
+
+			if !remoteChanged(a, remote) {
+				u.log.WithField("key", key).Debug("unchanged, skipping")
+				u.remote.Result.Unchanged++
+				continue
+			}
+
+			u.remote.Result.Updated++
+			out <- a
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// remoteChanged compares the artifact to its remote object by size and
+// md5.  An object uploaded in parts has an etag that is not the md5 of its
+// contents, so it is always treated as changed.
+func remoteChanged(a *artifact.Artifact, remote s3.Key) bool {
+	size, err := a.Size()
+	if err != nil || int64(size) != remote.Size {
+		return true
+	}
+
+	etag := strings.Trim(remote.ETag, `"`)
+	if strings.Contains(etag, "-") {
+		return true
+	}
+
+	sum, err := artifactMD5(a)
+	return err != nil || sum != etag
+}
+
+// artifactMD5 is the hex md5 of the content the artifact uploads, which is
+// what S3 reports as the etag of objects not uploaded in parts
+func artifactMD5(a *artifact.Artifact) (string, error) {
+	r, err := a.Reader()
+	if err != nil {
+		return "", err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	hash := md5.New()
+	if _, err := copyPooled(hash, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s3p *s3Provider) bucket() (*s3.Bucket, error) {
+	auth, err := s3p.getAuth(s3p.opts.AccessKey, s3p.opts.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3p.getConn(auth).Bucket(s3p.opts.BucketName), nil
+}
+
+// listTargetPaths returns the objects under all of the target paths by key
+func listTargetPaths(bucket *s3.Bucket, targetPaths []string) (map[string]s3.Key, error) {
+	keys := map[string]s3.Key{}
+	for _, targetPath := range targetPaths {
+		err := listS3Keys(bucket, syncPrefix(targetPath), keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func listS3Keys(bucket *s3.Bucket, prefix string, keys map[string]s3.Key) error {
+	marker := ""
+	for {
+		resp, err := bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range resp.Contents {
+			keys[key.Key] = key
+			marker = key.Key
+		}
+
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return nil
+		}
+	}
+}
+
+func syncPrefix(targetPath string) string {
+	prefix := strings.Trim(targetPath, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
@@ -0,0 +1,280 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func syncTestDir(t *testing.T, dir string, syncOpts *SyncOptions, configure ...func(*Options)) *SyncResult {
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"out/"}
+		opts.TargetPaths = []string{"sync-test"}
+		for _, f := range configure {
+			f(opts)
+		}
+	})
+
+	result, err := u.sync(syncOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return result
+}
+
+func syncTestRemoteKeys(t *testing.T, prefix ...string) []string {
+	if len(prefix) == 0 {
+		prefix = []string{"sync-test/"}
+	}
+
+	resp, err := testS3.Bucket("bucket").List(prefix[0], "", "", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := []string{}
+	for _, key := range resp.Contents {
+		keys = append(keys, key.Key)
+	}
+	return keys
+}
+
+func TestSync(t *testing.T) {
+	clearTestS3Prefix(t, "sync-test/")
+
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt":     "a",
+		"out/sub/b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	result := syncTestDir(t, dir, &SyncOptions{})
+	if !reflect.DeepEqual(result, &SyncResult{Added: 2}) {
+		t.Fatalf("first sync %#v != 2 added", result)
+	}
+
+	err := ioutil.WriteFile(filepath.Join(dir, "out", "sub", "b.txt"), []byte("bb"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "out", "c.txt"), []byte("c"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "out", "a.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result = syncTestDir(t, dir, &SyncOptions{Delete: true})
+	if !reflect.DeepEqual(result, &SyncResult{Added: 1, Updated: 1, Deleted: 1, DryRun: true}) {
+		t.Fatalf("dry run sync %#v != 1 added, 1 updated, 1 deleted", result)
+	}
+
+	expected := []string{"sync-test/out/a.txt", "sync-test/out/c.txt", "sync-test/out/sub/b.txt"}
+	if !reflect.DeepEqual(syncTestRemoteKeys(t), expected) {
+		t.Fatalf("remote keys %v != %v", syncTestRemoteKeys(t), expected)
+	}
+
+	result = syncTestDir(t, dir, &SyncOptions{Delete: true, Confirm: true})
+	if !reflect.DeepEqual(result, &SyncResult{Unchanged: 2, Deleted: 1}) {
+		t.Fatalf("confirmed sync %#v != 2 unchanged, 1 deleted", result)
+	}
+
+	expected = []string{"sync-test/out/c.txt", "sync-test/out/sub/b.txt"}
+	if !reflect.DeepEqual(syncTestRemoteKeys(t), expected) {
+		t.Fatalf("remote keys %v != %v", syncTestRemoteKeys(t), expected)
+	}
+}
+
+func TestSyncRequiresS3(t *testing.T) {
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	_, err := newUploader(opts, getPanicLogger()).sync(&SyncOptions{})
+	if err == nil {
+		t.Fatalf("sync with the null provider was accepted")
+	}
+}
+
+func TestSyncDeleteKeepsExtraKeys(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"out/a.txt": "a"})
+	defer os.RemoveAll(dir)
+
+	marker := func(opts *Options) {
+		opts.TargetPaths = []string{"sync-marker-test"}
+		opts.SuccessMarker = "_SUCCESS"
+	}
+
+	syncTestDir(t, dir, &SyncOptions{Delete: true, Confirm: true}, marker)
+	result := syncTestDir(t, dir, &SyncOptions{Delete: true, Confirm: true}, marker)
+	if !reflect.DeepEqual(result, &SyncResult{Unchanged: 1}) {
+		t.Fatalf("second sync %#v != 1 unchanged", result)
+	}
+
+	expected := []string{"sync-marker-test/_SUCCESS", "sync-marker-test/out/a.txt"}
+	if keys := syncTestRemoteKeys(t, "sync-marker-test/"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("remote keys %v != %v", keys, expected)
+	}
+}
+
+func TestSyncDeleteKeepsExcludedPaths(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt":      "a",
+		"out/b.tmp":      "b",
+		"out/skip/c.txt": "c",
+	})
+	defer os.RemoveAll(dir)
+
+	target := func(opts *Options) {
+		opts.TargetPaths = []string{"sync-exclude-test"}
+	}
+
+	syncTestDir(t, dir, &SyncOptions{}, target)
+	result := syncTestDir(t, dir, &SyncOptions{Delete: true, Confirm: true}, target, func(opts *Options) {
+		opts.Excludes = []string{"*.tmp", "skip/"}
+	})
+	if !reflect.DeepEqual(result, &SyncResult{Unchanged: 1}) {
+		t.Fatalf("excluding sync %#v != 1 unchanged", result)
+	}
+
+	expected := []string{"sync-exclude-test/out/a.txt", "sync-exclude-test/out/b.tmp", "sync-exclude-test/out/skip/c.txt"}
+	if keys := syncTestRemoteKeys(t, "sync-exclude-test/"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("remote keys %v != %v", keys, expected)
+	}
+}
+
+func TestSyncDeleteOnlyInShard(t *testing.T) {
+	files := map[string]string{}
+	other := 0
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		files["out/"+name+".txt"] = name
+		if shardOf("out/"+name+".txt", 2) != 0 {
+			other++
+		}
+	}
+	if other == 0 {
+		t.Fatalf("no test file is in shard 1")
+	}
+
+	dir := writeTestFiles(t, files)
+	defer os.RemoveAll(dir)
+
+	target := func(opts *Options) {
+		opts.TargetPaths = []string{"sync-shard-test"}
+	}
+
+	syncTestDir(t, dir, &SyncOptions{}, target)
+	result := syncTestDir(t, dir, &SyncOptions{Delete: true, Confirm: true}, target, func(opts *Options) {
+		opts.ShardIndex = 0
+		opts.ShardCount = 2
+	})
+	if result.Deleted != 0 || result.Unchanged != len(files)-other {
+		t.Fatalf("shard sync %#v deleted or compared files of other shards", result)
+	}
+
+	if keys := syncTestRemoteKeys(t, "sync-shard-test/"); len(keys) != len(files) {
+		t.Fatalf("remote keys %v != %d keys", keys, len(files))
+	}
+}
+
+func TestRemoteChangedMultipart(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"a.txt": "a"})
+	defer os.RemoveAll(dir)
+
+	a := artifact.New("", filepath.Join(dir, "a.txt"), "a.txt", &artifact.Options{})
+	sum, err := artifactMD5(a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if remoteChanged(a, s3.Key{Size: 1, ETag: `"` + sum + `"`}) {
+		t.Fatalf("object with the same md5 was changed")
+	}
+
+	if !remoteChanged(a, s3.Key{Size: 1, ETag: `"` + sum + `-2"`}) {
+		t.Fatalf("object uploaded in parts was unchanged")
+	}
+}
+
+func TestUploadSync(t *testing.T) {
+	clearTestS3Prefix(t, "upload-sync-test/")
+
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "a",
+		"out/b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	syncUpload := func() *uploader {
+		u := getTestUploader(nil, func(opts *Options) {
+			opts.BucketName = "bucket"
+			opts.WorkingDir = dir
+			opts.Paths = []string{"out/"}
+			opts.TargetPaths = []string{"upload-sync-test"}
+			opts.Sync = true
+			opts.SyncDelete = true
+			opts.SyncConfirm = true
+		})
+
+		if err := u.syncUpload(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return u
+	}
+
+	if u := syncUpload(); len(u.results) != 2 {
+		t.Fatalf("first sync uploaded %v", uploadedDests(u))
+	}
+
+	if err := os.Remove(filepath.Join(dir, "out", "a.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u := syncUpload()
+	if len(u.results) != 0 || !reflect.DeepEqual(u.remote.Result, &SyncResult{Unchanged: 1, Deleted: 1}) {
+		t.Fatalf("second sync uploaded %v with %#v", uploadedDests(u), u.remote.Result)
+	}
+
+	expected := []string{"upload-sync-test/out/b.txt"}
+	if keys := syncTestRemoteKeys(t, "upload-sync-test/"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("remote keys %v != %v", keys, expected)
+	}
+}
+
+func TestValidateSyncOptions(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.AccessKey, opts.SecretKey, opts.BucketName = "key", "secret", "bucket"
+
+	opts.SyncDelete = true
+	if err := opts.Validate(); err == nil || err.Error() != "--sync-delete requires --sync" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.Sync = true
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.SyncDelete, opts.SyncConfirm = false, true
+	if err := opts.Validate(); err == nil || err.Error() != "--sync-confirm requires --sync-delete" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts.SyncDelete = true
+
+	opts.Provider = "gcs"
+	if err := opts.Validate(); err == nil || err.Error() != "--sync requires the s3 provider" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	unknownHostname = "unknown-host"
+)
+
+var (
+	targetPathHostname = os.Hostname
+)
+
+// expandTargetPaths executes the templates in the target paths against
+// the build, keeping any that cannot be executed as they are, and then
+// replaces their build tokens, keeping any that are unset as they are
+func expandTargetPaths(opts *Options, log *logrus.Logger) []string {
+	data := newBuildTemplateData(opts)
+
+	ret := []string{}
+	for _, targetPath := range opts.TargetPaths {
+		expanded, err := expandBuildTemplate(targetPath, data)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"target_path": targetPath,
+				"err":         err,
+			}).Warn("not expanding target path")
+			expanded = targetPath
+		}
+
+		expanded, unset := expandBuildTokens(expanded, data)
+		if len(unset) > 0 {
+			log.WithFields(logrus.Fields{
+				"target_path": targetPath,
+				"unset":       strings.Join(unset, ", "),
+			}).Warn("not replacing unset tokens in target path")
+		}
+		ret = append(ret, expanded)
+	}
+
+	return ret
+}
+
+// buildTokens are the {name} tokens in target paths that are replaced with
+// the build's fields, along with {env:NAME}
+var buildTokens = map[string]func(*buildTemplateData) string{
+	"repo":         func(d *buildTemplateData) string { return d.RepoSlug },
+	"branch":       func(d *buildTemplateData) string { return d.Branch },
+	"commit":       func(d *buildTemplateData) string { return d.Commit },
+	"build_number": func(d *buildTemplateData) string { return d.BuildNumber },
+	"build_id":     func(d *buildTemplateData) string { return d.BuildID },
+	"job_number":   func(d *buildTemplateData) string { return d.JobNumber },
+	"job_id":       func(d *buildTemplateData) string { return d.JobID },
+}
+
+const envTokenPrefix = "env:"
+
+// expandBuildTokens replaces the build tokens, such as {branch}, and
+// {env:NAME} tokens in the target path, returning the ones the build
+// doesn't say anything for, which are left as they are.  Other text in
+// braces, like {hostname}, is left for resolveTargetPaths.
+func expandBuildTokens(targetPath string, data *buildTemplateData) (string, []string) {
+	unset := []string{}
+	expanded := templateTokenRegexp.ReplaceAllStringFunc(targetPath, func(match string) string {
+		name := match[1 : len(match)-1]
+
+		value := ""
+		if strings.HasPrefix(name, envTokenPrefix) {
+			value = data.Env(strings.TrimPrefix(name, envTokenPrefix))
+		} else if token, ok := buildTokens[name]; ok {
+			value = token(data)
+		} else {
+			return match
+		}
+
+		if value == "" {
+			unset = append(unset, match)
+			return match
+		}
+		return value
+	})
+
+	return expanded, unset
+}
+
+// validateTargetPaths checks that the templates in the target paths parse
+// and only use fields that exist, and that the build says something for
+// every build token in them
+func validateTargetPaths(opts *Options) error {
+	data := newBuildTemplateData(opts)
+	for _, targetPath := range opts.TargetPaths {
+		if _, err := expandBuildTemplate(targetPath, &buildTemplateData{}); err != nil {
+			return fmt.Errorf("invalid target path %q: %v", targetPath, err)
+		}
+
+		expanded, _ := expandBuildTemplate(targetPath, data)
+		if _, unset := expandBuildTokens(expanded, data); len(unset) > 0 {
+			return fmt.Errorf("invalid target path %q: %s not set in this build", targetPath, strings.Join(unset, ", "))
+		}
+	}
+	return nil
+}
+
+// resolveTargetPaths replaces the {hostname} and {pid} tokens in the
+// target paths so that parallel nodes can upload to disjoint prefixes.
+// Other text in braces is left as is.
+func resolveTargetPaths(targetPaths []string, log *logrus.Logger) []string {
+	tokens := map[string]func() string{
+		"hostname": func() string {
+			hostname, err := targetPathHostname()
+			if err != nil || hostname == "" {
+				log.WithField("err", err).Warn(
+					fmt.Sprintf("failed to get hostname, using %q instead", unknownHostname))
+				return unknownHostname
+			}
+			return hostname
+		},
+		"pid": func() string {
+			return fmt.Sprintf("%d", os.Getpid())
+		},
+	}
+
+	resolved := map[string]string{}
+	ret := []string{}
+	for _, targetPath := range targetPaths {
+		ret = append(ret, templateTokenRegexp.ReplaceAllStringFunc(targetPath, func(match string) string {
+			name := match[1 : len(match)-1]
+			if value, ok := resolved[name]; ok {
+				return value
+			}
+
+			token, ok := tokens[name]
+			if !ok {
+				return match
+			}
+
+			resolved[name] = token()
+			return resolved[name]
+		}))
+	}
+
+	return ret
+}
@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveTargetPaths(t *testing.T) {
+	defer func() { targetPathHostname = os.Hostname }()
+	targetPathHostname = func() (string, error) { return "node-3", nil }
+
+	actual := resolveTargetPaths([]string{
+		"runs/{hostname}/",
+		"runs/{hostname}-{pid}",
+		"artifacts/1/1.2",
+		"weird/{unknown}/{hostname}",
+	}, getPanicLogger())
+
+	pid := os.Getpid()
+	expected := []string{
+		"runs/node-3/",
+		fmt.Sprintf("runs/node-3-%d", pid),
+		"artifacts/1/1.2",
+		"weird/{unknown}/node-3",
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("target paths %v != %v", actual, expected)
+	}
+}
+
+func TestResolveTargetPathsHostnameError(t *testing.T) {
+	defer func() { targetPathHostname = os.Hostname }()
+	targetPathHostname = func() (string, error) { return "", fmt.Errorf("no hostname") }
+
+	actual := resolveTargetPaths([]string{"runs/{hostname}"}, getPanicLogger())
+	if !reflect.DeepEqual(actual, []string{"runs/unknown-host"}) {
+		t.Fatalf("target paths %v != [runs/unknown-host]", actual)
+	}
+}
+
+func TestNewUploaderResolvesTargetPaths(t *testing.T) {
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.TargetPaths = []string{"runs/{pid}"}
+
+	u := newUploader(opts, getPanicLogger())
+	expected := []string{fmt.Sprintf("runs/%d", os.Getpid())}
+	if !reflect.DeepEqual(u.Opts.TargetPaths, expected) {
+		t.Fatalf("target paths %v != %v", u.Opts.TargetPaths, expected)
+	}
+}
+
+func TestExpandTargetPaths(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"TRAVIS":              "true",
+		"TRAVIS_BRANCH":       "main",
+		"TRAVIS_COMMIT":       "abc123",
+		"TRAVIS_BUILD_NUMBER": "42",
+		"NIGHTLY":             "yes",
+	})
+
+	opts := NewOptions()
+	opts.TargetPaths = []string{
+		"builds/{{.Branch}}/{{.BuildNumber}}",
+		`commits/{{.Commit}}/{{.Env "NIGHTLY"}}`,
+		`empty/{{.JobID}}/{{.Env "UNSET"}}/end`,
+		"literal/{hostname}/1.2",
+	}
+
+	expected := []string{
+		"builds/main/42",
+		"commits/abc123/yes",
+		"empty///end",
+		"literal/{hostname}/1.2",
+	}
+	if actual := expandTargetPaths(opts, getPanicLogger()); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("target paths %v != %v", actual, expected)
+	}
+}
+
+func TestValidateTargetPathTemplates(t *testing.T) {
+	for _, targetPath := range []string{"builds/{{.Branch", "builds/{{.Nope}}"} {
+		opts := NewOptions()
+		opts.TargetPaths = []string{targetPath}
+		if err := opts.Validate(); err == nil {
+			t.Fatalf("invalid target path %q was accepted", targetPath)
+		}
+	}
+
+	opts := NewOptions()
+	opts.TargetPaths = []string{"builds/{{.BuildNumber}}", "runs/{hostname}"}
+	if err := opts.Validate(); err != nil && strings.Contains(err.Error(), "target path") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestExpandTargetPathTokens(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"TRAVIS":              "true",
+		"TRAVIS_BRANCH":       "main",
+		"TRAVIS_REPO_SLUG":    "owner/repo",
+		"TRAVIS_BUILD_NUMBER": "42",
+		"DEPLOY_ENV":          "staging",
+	})
+
+	opts := NewOptions()
+	opts.TargetPaths = []string{
+		"builds/{repo}/{branch}/{build_number}/",
+		"deploys/{env:DEPLOY_ENV}/{hostname}",
+		"unset/{job_id}/{env:UNSET}",
+	}
+
+	expected := []string{
+		"builds/owner/repo/main/42/",
+		"deploys/staging/{hostname}",
+		"unset/{job_id}/{env:UNSET}",
+	}
+	if actual := expandTargetPaths(opts, getPanicLogger()); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("target paths %v != %v", actual, expected)
+	}
+}
+
+func TestValidateTargetPathTokens(t *testing.T) {
+	os.Clearenv()
+	setenvs(map[string]string{
+		"TRAVIS":              "true",
+		"TRAVIS_BRANCH":       "main",
+		"TRAVIS_BUILD_NUMBER": "42",
+	})
+
+	opts := NewOptions()
+	opts.TargetPaths = []string{"builds/{branch}/{build_number}", "runs/{hostname}"}
+	if err := validateTargetPaths(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.TargetPaths = []string{"builds/{branch}/{job_id}/{env:NOPE}"}
+	err := validateTargetPaths(opts)
+	if err == nil || err.Error() != `invalid target path "builds/{branch}/{job_id}/{env:NOPE}": {job_id}, {env:NOPE} not set in this build` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
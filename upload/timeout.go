@@ -0,0 +1,230 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// startRunContext derives the context of an upload from the caller's,
+// canceling it after --timeout if there is one.  Requests made through
+// httpClient use it until the returned func stops it.
+func (opts *Options) startRunContext(parent context.Context) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, opts.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	prev := opts.ctx
+	opts.ctx = ctx
+	return ctx, func() {
+		cancel()
+		opts.ctx = prev
+	}
+}
+
+// startGraceContext is the caller's context, except that with
+// --shutdown-grace, canceling the caller's leaves the uploads in flight
+// that long to finish before they are canceled too.  cancelFilter goes by
+// the caller's context, so nothing new is started in the meantime.
+func (opts *Options) startGraceContext(parent context.Context, log *logrus.Logger) (context.Context, func()) {
+	if opts.ShutdownGrace <= 0 {
+		return parent, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(withoutCancel{parent})
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+
+		log.WithField("grace", opts.ShutdownGrace).Warn("interrupted, letting the uploads in flight finish")
+		if sleepContext(ctx, opts.ShutdownGrace) == nil {
+			log.Warn("canceling the uploads still in flight (--shutdown-grace)")
+		}
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+// withoutCancel has the values of the context it wraps, but is never
+// canceled and has no deadline
+type withoutCancel struct {
+	parent context.Context
+}
+
+func (wc withoutCancel) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (wc withoutCancel) Done() <-chan struct{}             { return nil }
+func (wc withoutCancel) Err() error                        { return nil }
+func (wc withoutCancel) Value(key interface{}) interface{} { return wc.parent.Value(key) }
+
+// interrupted reports whether the caller canceled the upload, as the
+// command does on SIGINT or SIGTERM
+func (u *uploader) interrupted() bool {
+	return u.ctx != nil && errors.Is(u.ctx.Err(), context.Canceled)
+}
+
+// runContext is the context of the upload in progress, if any
+func (opts *Options) runContext() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// isCanceled reports whether the error came from the upload being canceled
+// or timing out
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// sleepContext sleeps for d, or until the context is canceled, in which
+// case it returns the context's error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancelFilter passes artifacts along to the workers until the upload is
+// canceled or the caller interrupts it, after which the rest are failed
+// without being attempted, including one that was waiting on a worker
+func (u *uploader) cancelFilter(ctx context.Context, in chan *artifact.Artifact, failed chan *artifact.Artifact) chan *artifact.Artifact {
+	caller := u.ctx
+	if caller == nil {
+		caller = context.Background()
+	}
+
+	canceled := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return caller.Err()
+	}
+
+	out := make(chan *artifact.Artifact)
+	go func() {
+		for a := range in {
+			err := canceled()
+			if err == nil {
+				select {
+				case out <- a:
+					continue
+				case <-ctx.Done():
+				case <-caller.Done():
+				}
+				err = canceled()
+			}
+
+			a.UploadResult.OK = false
+			a.UploadResult.Err = err
+			failed <- a
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// contextTransport gives requests made without a context of their own the
+// context of the upload in progress, and with --upload-timeout, bounds the
+// requests that send artifacts
+type contextTransport struct {
+	opts      *Options
+	transport http.RoundTripper
+}
+
+func (ct *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ct.opts.ctx != nil && req.Context() == context.Background() {
+		req = req.WithContext(ct.opts.ctx)
+	}
+
+	if ct.opts.UploadTimeout > 0 && (req.Method == "PUT" || req.Method == "POST") &&
+		req.Context().Value(detachedKey{}) == nil {
+		return ct.roundTripWithTimeout(req)
+	}
+
+	return ct.transport.RoundTrip(req)
+}
+
+// roundTripWithTimeout fails the request once it has gone on for
+// --upload-timeout with an error that is retried like any other, rather
+// than one that looks like the whole upload was canceled.  The timeout
+// covers reading the response too.
+func (ct *contextTransport) roundTripWithTimeout(req *http.Request) (*http.Response, error) {
+	parent := req.Context()
+	ctx, cancel := context.WithTimeout(parent, ct.opts.UploadTimeout)
+
+	timedOut := func(err error) error {
+		if err != nil && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("upload attempt timed out after %v (--upload-timeout)", ct.opts.UploadTimeout)
+		}
+		return err
+	}
+
+	resp, err := ct.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, timedOut(err)
+	}
+
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, cancel: cancel, timedOut: timedOut}
+	return resp, nil
+}
+
+// timeoutBody is the body of a response to a request with --upload-timeout,
+// which stops the timeout once it is closed
+type timeoutBody struct {
+	io.ReadCloser
+	cancel   context.CancelFunc
+	timedOut func(error) error
+}
+
+func (tb *timeoutBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err == io.EOF {
+		return n, err
+	}
+	return n, tb.timedOut(err)
+}
+
+func (tb *timeoutBody) Close() error {
+	defer tb.cancel()
+	return tb.ReadCloser.Close()
+}
+
+// detachedKey marks the context of requests that go out even once the
+// upload is canceled
+type detachedKey struct{}
+
+// detachedTransport gives requests a context of their own, which
+// contextTransport leaves alone
+type detachedTransport struct {
+	transport http.RoundTripper
+}
+
+func (dt *detachedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := dt.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req.WithContext(context.WithValue(context.Background(), detachedKey{}, true)))
+}
@@ -0,0 +1,367 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+func TestUploadTimeout(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bb",
+		"c.txt": "c",
+	})
+	defer os.RemoveAll(dir)
+
+	// the server never answers, so only the timeout ends the upload, and
+	// each request's context is only done once the client hangs up
+	hungUp := make(chan bool, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+		hungUp <- true
+	}))
+	defer srv.Close()
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"a.txt", "b.txt", "c.txt"}
+		opts.Concurrency = 1
+		opts.Retries = 2
+		opts.Timeout = 200 * time.Millisecond
+	})
+	s3p := u.Provider.(*s3Provider)
+	s3p.RetryInterval = time.Minute
+	s3p.overrideConn = s3.New(s3p.overrideAuth,
+		aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	start := time.Now()
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("upload took %v despite a 200ms timeout", elapsed)
+	}
+
+	if len(u.results) != 3 {
+		t.Fatalf("results %v != 3", len(u.results))
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.OK || !isCanceled(a.UploadResult.Err) {
+			t.Fatalf("%s was not canceled: %v", a.Source, a.UploadResult.Err)
+		}
+	}
+
+	if code := ExitCode(u.failureError(), ""); code != 7 {
+		t.Fatalf("exit code %v != 7 after timing out", code)
+	}
+
+	if u.Opts.ctx != nil {
+		t.Fatalf("run context outlived the upload")
+	}
+
+	select {
+	case <-hungUp:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection was left open after timing out")
+	}
+}
+
+func TestUploadAttemptTimeout(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bb",
+	})
+	defer os.RemoveAll(dir)
+
+	// the first put of each key never gets an answer
+	lock := &sync.Mutex{}
+	hung := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+
+		lock.Lock()
+		first := !hung[r.URL.Path]
+		hung[r.URL.Path] = true
+		lock.Unlock()
+
+		if first {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	for _, retries := range []uint64{1, 0} {
+		lock.Lock()
+		hung = map[string]bool{}
+		lock.Unlock()
+
+		u := getTestUploader(nil, func(opts *Options) {
+			opts.BucketName = "bucket"
+			opts.WorkingDir = dir
+			opts.Paths = []string{"a.txt", "b.txt"}
+			opts.Retries = retries
+			opts.UploadTimeout = 100 * time.Millisecond
+		})
+		s3p := u.Provider.(*s3Provider)
+		s3p.overrideConn = s3.New(s3p.overrideAuth,
+			aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+		err := u.Upload()
+		if retries == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, a := range u.results {
+				if a.UploadResult.OK || isCanceled(a.UploadResult.Err) ||
+					!strings.Contains(fmt.Sprintf("%v", a.UploadResult.Err), "--upload-timeout") {
+					t.Fatalf("%s: unexpected result: %v", a.Source, a.UploadResult.Err)
+				}
+			}
+			if code := ExitCode(u.failureError(), ""); code == 7 {
+				t.Fatalf("exit code %v is the one for --timeout", code)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, a := range u.results {
+			if !a.UploadResult.OK || a.UploadResult.Attempts != 2 {
+				t.Fatalf("%s: ok=%v after %d attempts: %v", a.Source, a.UploadResult.OK,
+					a.UploadResult.Attempts, a.UploadResult.Err)
+			}
+		}
+	}
+}
+
+func TestUploadContextCanceled(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bb",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "b.txt"}
+
+	rp := &recordingProvider{}
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = rp
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u.ctx = ctx
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rp.Uploaded) != 0 {
+		t.Fatalf("uploaded %v artifacts after being canceled", len(rp.Uploaded))
+	}
+
+	for _, entry := range u.uploadResult().Artifacts {
+		if entry.Status != "canceled" {
+			t.Fatalf("%s status %q != canceled", entry.Dest, entry.Status)
+		}
+	}
+
+	if err := u.failureError(); FailureCategory(err) != FailureInterrupted {
+		t.Fatalf("canceled upload error %v is not an interrupted failure", err)
+	}
+}
+
+func testGraceUploader(t *testing.T, dir string, handler http.HandlerFunc, grace time.Duration) (*uploader, func()) {
+	srv := httptest.NewServer(handler)
+
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{"a.txt", "b.txt"}
+		opts.Concurrency = 1
+		opts.Retries = 0
+		opts.ShutdownGrace = grace
+	})
+	s3p := u.Provider.(*s3Provider)
+	s3p.overrideConn = s3.New(s3p.overrideAuth,
+		aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+	return u, srv.Close
+}
+
+func TestUploadShutdownGrace(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bb",
+	})
+	defer os.RemoveAll(dir)
+
+	// the first upload is interrupted while in flight, and finishes anyway
+	ctx, cancel := context.WithCancel(context.Background())
+	u, done := testGraceUploader(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("ETag", `"abc"`)
+	}, 5*time.Second)
+	defer done()
+	u.ctx = ctx
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	statuses := map[string]string{}
+	for _, entry := range u.uploadResult().Artifacts {
+		statuses[entry.Dest] = entry.Status
+	}
+	if len(statuses) != 2 || !strings.Contains(fmt.Sprint(statuses), "uploaded") ||
+		!strings.Contains(fmt.Sprint(statuses), "canceled") {
+		t.Fatalf("unexpected statuses %v, expected one uploaded and one canceled", statuses)
+	}
+
+	if code := ExitCode(u.failureError(), ""); code != 8 {
+		t.Fatalf("exit code %v != 8 after being interrupted", code)
+	}
+}
+
+func TestUploadShutdownGraceRunsOut(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bb",
+	})
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u, done := testGraceUploader(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		cancel()
+		<-r.Context().Done()
+	}, 100*time.Millisecond)
+	defer done()
+	u.ctx = ctx
+
+	start := time.Now()
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("upload took %v despite a 100ms grace", elapsed)
+	}
+
+	for _, a := range u.results {
+		if a.UploadResult.OK || !isCanceled(a.UploadResult.Err) {
+			t.Fatalf("%s was not canceled: %v", a.Source, a.UploadResult.Err)
+		}
+	}
+}
+
+func TestContextTransport(t *testing.T) {
+	var seen context.Context
+	opts := NewOptions()
+	opts.transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		seen = req.Context()
+		return &http.Response{StatusCode: 204, Body: http.NoBody}, nil
+	})
+
+	ctx, stop := opts.startRunContext(context.Background())
+	req, _ := http.NewRequest("GET", "http://artifacts.example.invalid/", nil)
+	if _, err := opts.httpClient().Transport.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if seen != ctx {
+		t.Fatalf("request did not get the run context")
+	}
+
+	own, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := opts.httpClient().Transport.RoundTrip(req.WithContext(own)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if seen != own {
+		t.Fatalf("request's own context was replaced")
+	}
+
+	stop()
+	if ctx.Err() == nil {
+		t.Fatalf("run context not canceled when stopped")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestS3ProviderMultipartUploadTimeout(t *testing.T) {
+	s3p, _, srv, _ := getMultipartTestProvider(t, 2)
+	srv.Close()
+
+	aborted := make(chan bool, 1)
+	hangSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case r.Method == "POST" && q["uploads"] != nil:
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>up-1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "DELETE":
+			aborted <- true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			ioutil.ReadAll(r.Body)
+			<-r.Context().Done()
+		}
+	}))
+	defer hangSrv.Close()
+
+	s3p.RetryInterval = time.Minute
+	s3p.overrideConn = s3.New(aws.Auth{AccessKey: "whatever", SecretKey: "whatever"},
+		aws.Region{Name: "faux-region-9001", S3Endpoint: hangSrv.URL})
+	s3p.opts.Timeout = 200 * time.Millisecond
+
+	ctx, stop := s3p.opts.startRunContext(context.Background())
+	defer stop()
+
+	dir := writeTestFiles(t, map[string]string{"big.bin": strings.Repeat("x", 12)})
+	defer os.RemoveAll(dir)
+
+	a := artifact.New("bucket", filepath.Join(dir, "big.bin"), "big.bin", &artifact.Options{})
+	b := s3p.getConn(s3p.overrideConn.Auth).Bucket("bucket")
+	if err := s3p.uploadFile(ctx, s3p.opts, b, a); !isCanceled(err) {
+		t.Fatalf("error %v is not from timing out", err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("multipart upload was not aborted after timing out")
+	}
+}
@@ -0,0 +1,276 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const (
+	otlpTracesPath   = "/v1/traces"
+	otlpServiceName  = "artifacts"
+	otlpScopeName    = "github.com/travis-ci/artifacts"
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+	otlpKindInternal = 1
+)
+
+// traceparentRegexp matches a W3C trace context header, as passed along
+// in $TRACEPARENT by tools that trace the whole build
+var traceparentRegexp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// span is a finished unit of traced work, one for the run and one per
+// artifact
+type span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+}
+
+// spanExporter sends the spans of a run somewhere, all at once when the
+// run is done
+type spanExporter interface {
+	ExportSpans([]*span) error
+}
+
+// tracer collects a root span for the run, and a child span for each
+// artifact as its upload finishes.  It is only created with
+// --otel-endpoint, so that nothing is collected otherwise.
+type tracer struct {
+	exporter spanExporter
+
+	root *span
+
+	sync.Mutex
+	spans []*span
+}
+
+func newTracer(exporter spanExporter, parent string) *tracer {
+	root := &span{
+		TraceID:    randomHex(16),
+		SpanID:     randomHex(8),
+		Name:       "artifacts upload",
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+
+	if m := traceparentRegexp.FindStringSubmatch(parent); m != nil {
+		root.TraceID, root.ParentID = m[1], m[2]
+	}
+
+	return &tracer{exporter: exporter, root: root, spans: []*span{}}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ArtifactDone adds a span for the artifact's upload, which started its
+// duration ago
+func (t *tracer) ArtifactDone(a *artifact.Artifact, provider string) {
+	size, _ := a.Size()
+	end := time.Now()
+
+	s := &span{
+		TraceID:  t.root.TraceID,
+		SpanID:   randomHex(8),
+		ParentID: t.root.SpanID,
+		Name:     "upload " + a.FullDest(),
+		Start:    end.Add(-a.UploadResult.Duration),
+		End:      end,
+		Attributes: map[string]interface{}{
+			"artifact.key":      a.FullDest(),
+			"artifact.source":   artifactSourceName(a),
+			"artifact.size":     int64(size),
+			"artifact.attempts": int64(a.UploadResult.Attempts),
+			"artifact.provider": provider,
+		},
+	}
+
+	if !a.UploadResult.OK {
+		s.Err = a.UploadResult.Err
+		if s.Err == nil {
+			s.Err = fmt.Errorf("upload failed")
+		}
+	}
+
+	t.Lock()
+	t.spans = append(t.spans, s)
+	t.Unlock()
+}
+
+// Finish ends the root span and exports it along with every artifact's
+func (t *tracer) Finish(opts *Options, results []*artifact.Artifact, err error) error {
+	failed := int64(0)
+	for _, a := range results {
+		if !a.UploadResult.OK {
+			failed++
+		}
+	}
+
+	t.root.End = time.Now()
+	t.root.Err = err
+	t.root.Attributes["artifacts.provider"] = opts.Provider
+	t.root.Attributes["artifacts.bucket"] = opts.BucketName
+	t.root.Attributes["artifacts.target_paths"] = strings.Join(opts.TargetPaths, ":")
+	t.root.Attributes["artifacts.files"] = int64(len(results))
+	t.root.Attributes["artifacts.failed"] = failed
+
+	t.Lock()
+	spans := append([]*span{t.root}, t.spans...)
+	t.Unlock()
+
+	return t.exporter.ExportSpans(spans)
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector, JSON encoded
+type otlpExporter struct {
+	URL    string
+	Client *http.Client
+}
+
+func newOTLPExporter(endpoint string, client *http.Client) *otlpExporter {
+	url := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(url, otlpTracesPath) {
+		url += otlpTracesPath
+	}
+	return &otlpExporter{URL: url, Client: client}
+}
+
+func (oe *otlpExporter) ExportSpans(spans []*span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := oe.Client.Post(oe.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("trace export failed: %s %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+// otlpRequest lays the spans out as an ExportTraceServiceRequest, in the
+// protobuf JSON mapping that OTLP/HTTP collectors accept
+func otlpRequest(spans []*span) map[string]interface{} {
+	otlpSpans := []map[string]interface{}{}
+	for _, s := range spans {
+		status := map[string]interface{}{"code": otlpStatusOK}
+		if s.Err != nil {
+			status = map[string]interface{}{"code": otlpStatusError, "message": s.Err.Error()}
+		}
+
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              otlpKindInternal,
+			"startTimeUnixNano": fmt.Sprintf("%d", s.Start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprintf("%d", s.End.UnixNano()),
+			"attributes":        otlpAttributes(s.Attributes),
+			"status":            status,
+		}
+		if s.ParentID != "" {
+			otlpSpan["parentSpanId"] = s.ParentID
+		}
+
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": otlpServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": otlpScopeName},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	keys := []string{}
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	otlpAttrs := []interface{}{}
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attrs[key].(type) {
+		case int64:
+			// 64-bit ints are strings in the protobuf JSON mapping
+			value = map[string]interface{}{"intValue": fmt.Sprintf("%d", v)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+		}
+
+		otlpAttrs = append(otlpAttrs, map[string]interface{}{"key": key, "value": value})
+	}
+	return otlpAttrs
+}
+
+// startTracing creates the tracer when --otel-endpoint is set
+func (u *uploader) startTracing() {
+	if u.tracer != nil || u.Opts.OtelEndpoint == "" {
+		return
+	}
+
+	u.tracer = newTracer(newOTLPExporter(u.Opts.OtelEndpoint, u.Opts.httpClient()), os.Getenv("TRACEPARENT"))
+}
+
+// finishTracing exports the trace, logging rather than failing the
+// upload if that doesn't work
+func (u *uploader) finishTracing(err error) {
+	if u.tracer == nil {
+		return
+	}
+
+	if exportErr := u.tracer.Finish(u.Opts, u.results, err); exportErr != nil {
+		u.log.WithField("err", exportErr).Warn("failed to export trace")
+	}
+}
+
+// providerName names the provider that uploaded the artifact, looking
+// through --routes-from to the destination it was routed to
+func (u *uploader) providerName(a *artifact.Artifact) string {
+	if rp, ok := u.Provider.(*routingProvider); ok {
+		_, p, _ := rp.destination(a)
+		return p.Name()
+	}
+	return u.Provider.Name()
+}
@@ -0,0 +1,168 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memoryExporter keeps exported spans around for inspection
+type memoryExporter struct {
+	Spans []*span
+}
+
+func (me *memoryExporter) ExportSpans(spans []*span) error {
+	me.Spans = append(me.Spans, spans...)
+	return nil
+}
+
+func TestTracingSpans(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":    "aaaa",
+		"fail.txt": "ff",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.WorkingDir = dir
+	opts.Paths = []string{"a.txt", "fail.txt"}
+	opts.TargetPaths = []string{"traced"}
+
+	u := newUploader(opts, getPanicLogger())
+	u.Provider = &recordingProvider{FailSources: map[string]bool{
+		filepath.Join(dir, "fail.txt"): true,
+	}}
+
+	me := &memoryExporter{}
+	u.tracer = newTracer(me, "")
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(me.Spans) != 3 {
+		t.Fatalf("exported %d spans != 3", len(me.Spans))
+	}
+
+	root := me.Spans[0]
+	if root.ParentID != "" {
+		t.Fatalf("root span has parent %q", root.ParentID)
+	}
+	if root.Attributes["artifacts.files"] != int64(2) || root.Attributes["artifacts.failed"] != int64(1) {
+		t.Fatalf("unexpected root attributes: %v", root.Attributes)
+	}
+
+	byKey := map[string]*span{}
+	for _, s := range me.Spans[1:] {
+		if s.TraceID != root.TraceID || s.ParentID != root.SpanID {
+			t.Fatalf("span %q is not a child of the root span", s.Name)
+		}
+		byKey[s.Attributes["artifact.key"].(string)] = s
+	}
+
+	a := byKey["traced/a.txt"]
+	if a == nil {
+		t.Fatalf("no span for traced/a.txt: %v", byKey)
+	}
+	if a.Err != nil {
+		t.Fatalf("unexpected span error: %v", a.Err)
+	}
+	if a.Attributes["artifact.size"] != int64(4) {
+		t.Fatalf("size %v != 4", a.Attributes["artifact.size"])
+	}
+	if a.Attributes["artifact.provider"] != "recording" {
+		t.Fatalf("provider %v != recording", a.Attributes["artifact.provider"])
+	}
+	if _, ok := a.Attributes["artifact.attempts"]; !ok {
+		t.Fatalf("no attempts attribute: %v", a.Attributes)
+	}
+
+	if f := byKey["traced/fail.txt"]; f == nil || f.Err != errUploadFailed {
+		t.Fatalf("failed upload span has no error: %v", f)
+	}
+}
+
+func TestTracingTraceparent(t *testing.T) {
+	tr := newTracer(&memoryExporter{}, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if tr.root.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Fatalf("trace id %q was not taken from traceparent", tr.root.TraceID)
+	}
+	if tr.root.ParentID != "b7ad6b7169203331" {
+		t.Fatalf("parent id %q was not taken from traceparent", tr.root.ParentID)
+	}
+
+	tr = newTracer(&memoryExporter{}, "garbage")
+	if len(tr.root.TraceID) != 32 || tr.root.ParentID != "" {
+		t.Fatalf("bad traceparent was used: %#v", tr.root)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	os.Clearenv()
+	u := newUploader(NewOptions(), getPanicLogger())
+	u.startTracing()
+	if u.tracer != nil {
+		t.Fatalf("tracer created without --otel-endpoint")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var path, contentType string
+	var payload map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+	}))
+	defer server.Close()
+
+	tr := newTracer(newOTLPExporter(server.URL, http.DefaultClient), "")
+	if err := tr.Finish(NewOptions(), nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if path != "/v1/traces" {
+		t.Fatalf("path %q != /v1/traces", path)
+	}
+	if contentType != "application/json" {
+		t.Fatalf("content type %q != application/json", contentType)
+	}
+
+	resourceSpans := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	spans := scopeSpans["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans != 1", len(spans))
+	}
+
+	root := spans[0].(map[string]interface{})
+	if root["traceId"] != tr.root.TraceID || root["spanId"] != tr.root.SpanID {
+		t.Fatalf("unexpected span ids: %v", root)
+	}
+	if _, ok := root["parentSpanId"]; ok {
+		t.Fatalf("root span has a parent: %v", root)
+	}
+}
+
+func TestOTLPExporterFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	oe := newOTLPExporter(server.URL+"/v1/traces", http.DefaultClient)
+	if oe.URL != server.URL+"/v1/traces" {
+		t.Fatalf("url %q has a doubled path", oe.URL)
+	}
+
+	if err := oe.ExportSpans([]*span{}); err == nil {
+		t.Fatalf("failed export returned no error")
+	}
+}
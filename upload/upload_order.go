@@ -0,0 +1,68 @@
+package upload
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// uploadOrder prioritizes artifacts by the first of its paths or globs
+// that they match, with unmatched artifacts going last
+type uploadOrder struct {
+	Patterns []string
+}
+
+type orderedArtifact struct {
+	Artifact *artifact.Artifact
+	Priority int
+}
+
+type orderedArtifacts []*orderedArtifact
+
+func (oa orderedArtifacts) Len() int           { return len(oa) }
+func (oa orderedArtifacts) Less(i, j int) bool { return oa[i].Priority < oa[j].Priority }
+func (oa orderedArtifacts) Swap(i, j int)      { oa[i], oa[j] = oa[j], oa[i] }
+
+// loadUploadOrder reads one path or glob per line, skipping blank lines
+// and lines starting with "#"
+func loadUploadOrder(filename string) (*uploadOrder, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	uo := &uploadOrder{Patterns: []string{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uo.Patterns = append(uo.Patterns, strings.TrimPrefix(line, "./"))
+	}
+
+	return uo, scanner.Err()
+}
+
+// Priority returns the index of the first matching pattern, or the
+// number of patterns if none match
+func (uo *uploadOrder) Priority(relPath string) int {
+	for i, pattern := range uo.Patterns {
+		if matchGlob(pattern, relPath) {
+			return i
+		}
+	}
+
+	return len(uo.Patterns)
+}
+
+// Sort orders the artifacts by priority, keeping the relative order of
+// artifacts with the same priority
+func (uo *uploadOrder) Sort(oa orderedArtifacts) {
+	sort.Stable(oa)
+}
@@ -0,0 +1,86 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadUploadOrder(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"order.txt": "# critical stuff first\nindex.html\n\n./assets/\n",
+	})
+	defer os.RemoveAll(dir)
+
+	uo, err := loadUploadOrder(filepath.Join(dir, "order.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(uo.Patterns, []string{"index.html", "assets/"}) {
+		t.Fatalf("patterns %v != [index.html assets/]", uo.Patterns)
+	}
+
+	for relPath, priority := range map[string]int{
+		"index.html":       0,
+		"assets/app.css":   1,
+		"docs/index.html":  2,
+		"anything/else.js": 2,
+	} {
+		if uo.Priority(relPath) != priority {
+			t.Fatalf("priority of %v %v != %v", relPath, uo.Priority(relPath), priority)
+		}
+	}
+}
+
+func TestUploaderUploadOrder(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":          "a",
+		"assets/app.css": "body {}",
+		"b.txt":          "b",
+		"index.html":     "<html></html>",
+	})
+	defer os.RemoveAll(dir)
+
+	orderFile := filepath.Join(dir, "..", filepath.Base(dir)+"-order.txt")
+	err := ioutil.WriteFile(orderFile, []byte("index.html\nassets/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(orderFile)
+
+	opts := NewOptions()
+	opts.Concurrency = 1
+	opts.Paths = []string{dir}
+	opts.TargetPaths = []string{"ordered"}
+	opts.WorkingDir = dir
+	opts.UploadOrderFrom = orderFile
+
+	u := newUploader(opts, getPanicLogger())
+	rp := &recordingProvider{}
+	u.Provider = rp
+
+	err = u.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"index.html", "assets/app.css", "a.txt", "b.txt"}
+	actual := rp.Sources(dir)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("upload order %v != %v", actual, expected)
+	}
+}
+
+func TestOptionsValidateUploadOrderFrom(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.UploadOrderFrom = "/this/had/better/not/exist"
+
+	if opts.Validate() == nil {
+		t.Fatalf("missing upload order file was deemed valid")
+	}
+}
@@ -1,11 +1,83 @@
 package upload
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/travis-ci/artifacts/artifact"
 )
 
-type uploadProvider interface {
-	Upload(string, *Options,
+// Provider is a backend that artifacts are uploaded to.  Upload is run by
+// each of the --concurrency workers with the id of the worker, and takes
+// artifacts from the first channel until it is closed, sending each one
+// to the second once its UploadResult is filled in, then sends true on
+// the last.  The context is canceled when the upload times out or is
+// interrupted.  Providers may implement the other interfaces here, such
+// as ObjectLister, to support more than uploading.
+type Provider interface {
+	Upload(context.Context, string, *Options,
 		chan *artifact.Artifact, chan *artifact.Artifact, chan bool)
 	Name() string
 }
+
+// retryDefaulter is implemented by providers that declare how many times
+// to retry an artifact, and how long to wait in between, unless --retries
+// is given
+type retryDefaulter interface {
+	RetryDefaults() (uint64, time.Duration)
+}
+
+// uploadFinisher is implemented by providers that need to do more work
+// once every artifact has been uploaded successfully
+type uploadFinisher interface {
+	Finish(*Options) error
+}
+
+// HeaderFetcher is implemented by providers that can fetch the headers
+// an artifact was stored with, for --verify-headers, --skip-unchanged, and
+// the verify command.  An object that doesn't exist fails with an
+// *s3.Error with a 404 status.
+type HeaderFetcher interface {
+	FetchHeaders(*Options, *artifact.Artifact) (http.Header, error)
+}
+
+// ObjectLister is implemented by the providers whose objects can be
+// listed back, for the list and prune commands.  Unless recursive, only
+// the objects directly under the prefix are listed, along with the
+// prefixes ending in / below them.
+type ObjectLister interface {
+	ListRemote(prefix string, recursive bool) ([]*RemoteObject, []string, error)
+}
+
+// ObjectDeleter is implemented by the providers that can delete the
+// objects they list, for the prune command
+type ObjectDeleter interface {
+	DeleteRemote(key string) error
+}
+
+// destinationChecker is implemented by providers that can check that their
+// destination can be reached and written to, for the validate command
+type destinationChecker interface {
+	CheckDestination(*Options) []*destinationCheck
+}
+
+// objectCopier is implemented by providers that can copy an object they
+// were sent to another key without sending its content again, for --dedup
+// copy
+type objectCopier interface {
+	CopyObject(ctx context.Context, opts *Options, a *artifact.Artifact, sourceKey string) error
+}
+
+// chunkSizer is implemented by providers that upload in parts of a size
+// that may change during the run, for --concurrency auto
+type chunkSizer interface {
+	ChunkSize() int64
+	SetChunkSize(int64)
+}
+
+// metadataStorer is implemented by providers that store --metadata with
+// each object, which the others upload without
+type metadataStorer interface {
+	storesMetadata()
+}
@@ -1,11 +1,16 @@
 package upload
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
 )
 
 type testPath struct {
@@ -85,3 +90,77 @@ func setenvs(e map[string]string) error {
 
 	return nil
 }
+
+type recordingProvider struct {
+	sync.Mutex
+	Uploaded    []*artifact.Artifact
+	FailSources map[string]bool
+}
+
+func (rp *recordingProvider) Upload(ctx context.Context, id string, opts *Options,
+	in chan *artifact.Artifact, out chan *artifact.Artifact, done chan bool) {
+
+	for a := range in {
+		rp.Lock()
+		rp.Uploaded = append(rp.Uploaded, a)
+		rp.Unlock()
+
+		if rp.FailSources[a.Source] {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = errUploadFailed
+		} else {
+			a.UploadResult.OK = true
+		}
+		out <- a
+	}
+
+	done <- true
+}
+
+func (rp *recordingProvider) Name() string {
+	return "recording"
+}
+
+func (rp *recordingProvider) Sources(root string) []string {
+	rp.Lock()
+	defer rp.Unlock()
+
+	sources := []string{}
+	for _, a := range rp.Uploaded {
+		rel, _ := filepath.Rel(root, a.Source)
+		sources = append(sources, filepath.ToSlash(rel))
+	}
+	return sources
+}
+
+func (rp *recordingProvider) FullDests() []string {
+	rp.Lock()
+	defer rp.Unlock()
+
+	dests := []string{}
+	for _, a := range rp.Uploaded {
+		dests = append(dests, a.FullDest())
+	}
+	return dests
+}
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "artifacts-test-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
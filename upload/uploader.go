@@ -1,7 +1,10 @@
 package upload
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,25 +26,105 @@ type uploader struct {
 	Opts          *Options
 	Paths         *path.Set
 	RetryInterval time.Duration
-	Provider      uploadProvider
+	Provider      Provider
 
 	log       *logrus.Logger
 	curSize   *maxSizeTracker
 	startTime time.Time
+
+	feedErr      error
+	walkErrCount uint64
+	canonical    map[string]string
+	duplicates   []*duplicate
+	aliases      []*artifact.Artifact
+
+	order    *uploadOrder
+	excludes *excludes
+	includes *includes
+	ordered  orderedArtifacts
+
+	contentEncodings []*contentEncodingEntry
+	redirects        []*redirectRule
+	headerRules      []*headerRule
+	contentTypes     map[string]string
+	contentTypeRules []*contentTypeRule
+
+	decisions []*walkDecision
+	results   []*artifact.Artifact
+
+	remote      *remoteIndex
+	progress    *progressTracker
+	progressBar *progressBar
+	tracer      *tracer
+	metrics     *metrics
+
+	stdin     io.Reader
+	stdout    io.Writer
+	stderr    io.Writer
+	terminal  bool
+	stdinDest string
+	gzipped   map[string]string
+	gzipStats gzipStats
+
+	// tempFiles are removed at the end of the upload, and may be added to
+	// by the workers, such as when gzipping
+	tempFiles     []string
+	tempFilesLock sync.Mutex
+
+	skippedUnchanged uint64
+	skippedResumed   uint64
+
+	// streamed counts the artifacts that --stream didn't keep in results
+	streamed streamedResults
+
+	// state is the --state-file, if any
+	state *stateFile
+
+	// firstFailure is the artifact that stopped the upload with --fail-fast
+	firstFailure *artifact.Artifact
+
+	// ctx is the caller's context, which the upload is canceled along with
+	ctx context.Context
+
+	// watchOnly, when set by a watch, narrows the walk down to these
+	// sources, the ones that changed
+	watchOnly map[string]bool
 }
 
 type maxSizeTracker struct {
 	sync.Mutex
 	Current uint64
+	Files   uint64
+
+	// Exceeded is set once Current goes past --max-size, and Groups
+	// breaks Current down for the error
+	Exceeded bool
+	Groups   map[string]*sizeGroup
 }
 
-// Upload does the deed!
-func Upload(opts *Options, log *logrus.Logger) error {
-	return newUploader(opts, log).Upload()
+// Upload does the deed!  Artifacts failing to upload fail it in the
+// partial-failure or total-failure category, or the credentials or timeout
+// category if that is why they failed.  Canceling the context, or running
+// past --timeout, stops the uploads in flight and fails the rest.  With
+// --sync, only new and changed files are uploaded, as by Sync.
+func Upload(ctx context.Context, opts *Options, log *logrus.Logger) error {
+	u := newUploader(opts, log)
+	u.ctx = ctx
+	if opts.Sync {
+		return u.syncUpload()
+	}
+
+	if err := u.Upload(); err != nil {
+		return err
+	}
+	return u.failureError()
 }
 
 func newUploader(opts *Options, log *logrus.Logger) *uploader {
-	var provider uploadProvider
+	if log == nil {
+		log = logrus.New()
+		log.Out = ioutil.Discard
+	}
 
 	if opts.CacheControl == "" {
 		opts.CacheControl = defaultPublicCacheControl
@@ -51,19 +134,23 @@ func newUploader(opts *Options, log *logrus.Logger) *uploader {
 		opts.Provider = "s3"
 	}
 
-	switch opts.Provider {
-	case "artifacts":
-		provider = newArtifactsProvider(opts, log)
-	case "s3":
-		provider = newS3Provider(opts, log)
-	case "null":
-		provider = newNullProvider(nil, log)
-	default:
-		log.WithFields(logrus.Fields{
-			"provider": opts.Provider,
-		}).Warn("unrecognized provider, using s3 instead")
-		provider = newS3Provider(opts, log)
+	opts.TargetPaths = resolveTargetPaths(expandTargetPaths(opts, log), log)
+	opts.Metadata = expandMetadata(opts, log)
+	opts.transport = countSent(opts, limitBandwidth(opts, log, newHTTPTransport(opts)))
+	if opts.InsecureSkipVerify {
+		log.Warn("not verifying tls certificates (--insecure-skip-verify)")
 	}
+	warnDeprecatedEndpoint(log)
+	limitOpenFiles(opts, log)
+
+	provider := newProvider(opts, log)
+	if !providerStoresMetadata(provider) && len(opts.Metadata) > 0 {
+		log.WithField("provider", provider.Name()).Warn("provider does not store metadata, ignoring --metadata")
+	}
+	if !providerStoresMetadata(provider) && opts.symlinkMode() == "preserve" {
+		log.WithField("provider", provider.Name()).Warn("provider does not store metadata, symlinks will be uploaded as empty files")
+	}
+	opts.applyRetryDefaults(provider)
 
 	u := &uploader{
 		Opts:     opts,
@@ -72,29 +159,325 @@ func newUploader(opts *Options, log *logrus.Logger) *uploader {
 
 		log:       log,
 		startTime: time.Now(),
+		ctx:       context.Background(),
+
+		stdin:    os.Stdin,
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+		terminal: isTerminal(os.Stderr),
+	}
+
+	contentEncodings, err := parseContentEncodings(opts.ContentEncodingByExt)
+	if err != nil {
+		log.WithField("err", err).Warn("ignoring invalid content encodings")
+	}
+	u.contentEncodings = contentEncodings
+
+	redirects, err := parseRedirectLocations(opts.RedirectLocations)
+	if err != nil {
+		log.WithField("err", err).Warn("ignoring invalid redirect locations")
+	}
+	u.redirects = redirects
+
+	// --content-type wins over the extensions of --content-types-from
+	contentTypes := map[string]string{}
+	if opts.ContentTypesFrom != "" {
+		byExt, rules, err := loadContentTypes(opts.ContentTypesFrom)
+		if err != nil {
+			log.WithField("err", err).Warn("ignoring content types file")
+		}
+		for ext, ctype := range contentTypesByExt(byExt) {
+			contentTypes[ext] = ctype
+		}
+		u.contentTypeRules = rules
+	}
+	for ext, ctype := range contentTypesByExt(opts.ContentTypes) {
+		contentTypes[ext] = ctype
+	}
+	u.contentTypes = contentTypesByExt(contentTypes)
+
+	u.headerRules = opts.headerRules
+	if opts.HeaderRulesFrom != "" {
+		headerRules, err := loadHeaderRules(opts.HeaderRulesFrom)
+		if err != nil {
+			log.WithField("err", err).Warn("ignoring header rules")
+		}
+		u.headerRules = append(append([]*headerRule{}, opts.headerRules...), headerRules...)
 	}
 
 	for _, s := range opts.Paths {
-		parts := strings.SplitN(s, ":", 2)
-		if len(parts) < 2 {
-			parts = append(parts, "")
+		from, to := splitPathArg(s)
+
+		if from == stdinPath {
+			u.stdinDest = to
+			if u.stdinDest == "" {
+				u.stdinDest = opts.stdinName()
+			}
+			continue
 		}
 
-		p := path.New(opts.WorkingDir, parts[0], parts[1])
+		p := path.New(opts.WorkingDir, from, to)
 		log.WithFields(logrus.Fields{"path": p}).Debug("adding path")
 		u.Paths.Add(p)
 	}
 
+	if opts.Stdin && u.stdinDest == "" {
+		u.stdinDest = opts.stdinName()
+	}
+
 	return u
 }
 
-func (u *uploader) Upload() error {
+func newProvider(opts *Options, log *logrus.Logger) Provider {
+	if opts.fanout() {
+		return newFanoutProvider(opts, log)
+	}
+
+	factory, ok := lookupProvider(opts.Provider)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"provider": opts.Provider,
+		}).Warn("unrecognized provider, using s3 instead")
+		factory, _ = lookupProvider("s3")
+	}
+	return factory(opts, log)
+}
+
+func (u *uploader) Upload() (err error) {
 	u.log.Debug("starting upload")
 	u.startTime = time.Now()
+	u.Opts.startRetryDeadline(u.startTime)
+	defer u.removeTempFiles()
+
+	graceCtx, stopGrace := u.Opts.startGraceContext(u.ctx, u.log)
+	defer stopGrace()
+
+	ctx, stop := u.Opts.startRunContext(graceCtx)
+	defer stop()
+
+	ctx, stopFast := u.Opts.startFailFast(ctx)
+	defer stopFast()
+
+	u.startTracing()
+	defer func() { u.finishTracing(err) }()
+
+	u.startMetrics()
+	defer func() { u.finishMetrics(err) }()
+
+	defer func() { err = u.postHook(err) }()
+
+	if u.Opts.HostLock != "" {
+		lock := newHostLock(u.Opts.HostLock, u.Opts.HostLockMax, u.log)
+		if err := lock.Acquire(); err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	if err := u.preHook(ctx); err != nil {
+		return err
+	}
+
+	if u.Opts.UploadOrderFrom != "" {
+		order, err := loadUploadOrder(u.Opts.UploadOrderFrom)
+		if err != nil {
+			return err
+		}
+		u.order = order
+		u.log.WithField("patterns", order.Patterns).Debug("loaded upload order")
+	}
+
+	if u.Opts.VerifyHeaders != "off" && !u.Opts.DryRun {
+		if _, err := u.headerFetcher(); err != nil {
+			return err
+		}
+	}
+
+	var routes []*route
+	if u.Opts.RoutesFrom != "" {
+		r, err := loadRoutes(u.Opts.RoutesFrom)
+		if err != nil {
+			return err
+		}
+		routes = r
+		u.log.WithField("routes", len(routes)).Debug("loaded routes")
+	}
+
+	if u.Opts.ProgressJSON != "" || u.Opts.ProgressInterval > 0 || u.Opts.Progress {
+		var out io.Writer
+		var log *logrus.Logger
+		interval := u.Opts.ProgressInterval
+
+		// without a terminal to draw the bar on, --progress logs instead
+		if u.Opts.Progress && !u.terminal && interval == 0 {
+			interval = defaultProgressLogInterval
+		}
+
+		if interval > 0 {
+			log = u.log
+		} else {
+			interval = defaultProgressJSONInterval
+		}
+
+		if u.Opts.ProgressJSON != "" {
+			f, err := openProgressOutput(u.Opts.ProgressJSON)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		u.progress = newProgressTracker(out, log, interval)
+		u.progress.sent = u.Opts.sent
+
+		if u.Opts.Progress && u.terminal {
+			u.progressBar = newProgressBar(u.progress, u.stderr)
+		}
+	}
+
+	if u.Opts.Record != "" {
+		np, ok := u.Provider.(*nullProvider)
+		if !ok {
+			return fmt.Errorf("--record requires the null provider")
+		}
+
+		j, err := createJournal(u.Opts.Record)
+		if err != nil {
+			return err
+		}
+		defer j.Close()
+		np.Journal = j
+	}
+
+	if u.Opts.StateFile != "" && !u.Opts.DryRun {
+		sf, err := openStateFile(u.Opts.StateFile)
+		if err != nil {
+			return err
+		}
+		defer sf.Close()
+		u.state = sf
+	}
+
+	var inChan chan *artifact.Artifact
+	if u.Opts.Replay != "" {
+		entries, err := readJournal(u.Opts.Replay)
+		if err != nil {
+			return err
+		}
+		inChan = make(chan *artifact.Artifact)
+		go u.replayFeeder(entries, inChan)
+	} else if u.Opts.FromManifest != "" {
+		m, err := readManifest(u.Opts.FromManifest)
+		if err != nil {
+			return err
+		}
+		entries := u.republishedEntries(m)
+		if err := missingManifestSources(entries); err != nil {
+			return err
+		}
+		inChan = make(chan *artifact.Artifact)
+		go u.manifestFeeder(entries, inChan)
+	} else {
+		inChan = u.files()
+	}
+
+	inChan, err = u.checkExpectedCount(inChan)
+	if err != nil {
+		return err
+	}
+
+	inChan, err = u.limitKeys(inChan)
+	if err != nil {
+		return err
+	}
+
+	inChan, err = u.limitFiles(inChan)
+	if err != nil {
+		return err
+	}
+
+	inChan, err = u.trimToFit(inChan)
+	if err != nil {
+		return err
+	}
+
+	inChan, err = u.checkDuplicateKeys(inChan)
+	if err != nil {
+		return err
+	}
+
+	inChan, err = u.checkCaseCollisions(inChan)
+	if err != nil {
+		return err
+	}
+
+	inChan, err = u.bundle(inChan)
+	if err != nil {
+		return err
+	}
+
+	if u.Opts.Delta && !u.Opts.DryRun {
+		if dp, ok := u.Provider.(downloadProvider); ok {
+			u.Provider = newDeltaProvider(u.Opts, u.log, u.Provider, dp)
+		}
+	}
+
+	if fp, ok := u.Provider.(*fanoutProvider); ok && !u.Opts.DryRun {
+		defer fp.LogCounts()
+		if u.metrics != nil {
+			fp.observe = u.metrics.ArtifactDone
+		}
+	}
+
+	if routes != nil && !u.Opts.DryRun {
+		if _, ok := u.Provider.(*routingProvider); !ok {
+			rp := newRoutingProvider(u.Opts, u.log, routes, u.Provider)
+			u.Provider = rp
+			defer rp.LogCounts()
+		}
+	}
+
+	if u.Opts.DryRun {
+		if _, ok := u.Provider.(*dryRunProvider); !ok {
+			dp, dpErr := u.newDryRunProvider()
+			if dpErr != nil {
+				return dpErr
+			}
+			u.Provider = dp
+			defer dp.LogTotal(u.Opts)
+			defer func() {
+				if err == nil {
+					err = u.writeDryRun(dp)
+				}
+			}()
+		}
+	}
+
+	if u.Opts.SBOM != "" {
+		refs, err := u.uploadSBOMs()
+		if err != nil {
+			return err
+		}
+		inChan = u.sbomFilter(inChan, refs)
+	}
+
 	done := make(chan bool)
 	allDone := uint64(0)
-	inChan := u.files()
 	outChan := make(chan *artifact.Artifact)
+	inChan = u.changedFilter(inChan)
+	inChan = u.unchangedFilter(inChan)
+	inChan = u.resumeFilter(inChan)
+	inChan = u.dedupFilter(inChan)
+	inChan, err = u.grewFilter(inChan, outChan)
+	if err != nil {
+		return err
+	}
+	if u.progress != nil {
+		inChan = u.progress.Filter(inChan)
+	}
+	inChan = u.deadlineFilter(inChan, outChan)
+	inChan = u.cancelFilter(ctx, inChan, outChan)
 	failed := []*artifact.Artifact{}
 
 	defer func() {
@@ -102,6 +485,7 @@ func (u *uploader) Upload() error {
 			return
 		}
 
+		sortArtifacts(failed)
 		for _, a := range failed {
 			u.log.WithFields(logrus.Fields{
 				"err": a.UploadResult.Err,
@@ -109,6 +493,62 @@ func (u *uploader) Upload() error {
 		}
 	}()
 
+	if !u.Opts.DryRun {
+		defer func() { u.logSummary(len(failed)) }()
+	}
+
+	defer u.logSlowestUploads()
+	defer u.logGzipped()
+
+	if u.Opts.OutputManifest != "" {
+		defer func() {
+			err := writeManifest(u.Opts.OutputManifest, u.Opts.WorkingDir, u.manifestResults())
+			if err != nil {
+				u.log.WithFields(logrus.Fields{
+					"file": u.Opts.OutputManifest,
+					"err":  err,
+				}).Error("failed to write manifest")
+			}
+		}()
+	}
+
+	if u.Opts.OutputTemplate != "" {
+		defer func() {
+			err := u.writeOutputTemplate()
+			if err != nil {
+				u.log.WithField("err", err).Error("failed to write output template")
+			}
+		}()
+	}
+
+	if u.Opts.OutputCSV != "" {
+		defer func() {
+			err := writeCSVReport(u.Opts.OutputCSV, u.results)
+			if err != nil {
+				u.log.WithFields(logrus.Fields{
+					"file": u.Opts.OutputCSV,
+					"err":  err,
+				}).Error("failed to write csv report")
+			}
+		}()
+	}
+
+	if len(u.Opts.NotifyURLs) > 0 {
+		defer u.notify()
+	}
+
+	if u.Opts.ResultFile != "" {
+		defer func() {
+			err := u.writeResultFile()
+			if err != nil {
+				u.log.WithFields(logrus.Fields{
+					"file": u.Opts.ResultFile,
+					"err":  err,
+				}).Error("failed to write result file")
+			}
+		}()
+	}
+
 	u.log.WithFields(logrus.Fields{
 		"bucket":        u.Opts.BucketName,
 		"cache_control": u.Opts.CacheControl,
@@ -118,36 +558,203 @@ func (u *uploader) Upload() error {
 	u.log.WithFields(logrus.Fields{
 		"working_dir":  u.Opts.WorkingDir,
 		"target_paths": u.Opts.TargetPaths,
-		"concurrency":  u.Opts.Concurrency,
+		"concurrency":  u.concurrencyField(),
 		"max_size":     u.Opts.MaxSize,
 		"retries":      u.Opts.Retries,
 	}).Debug("other upload settings")
 
-	for i := uint64(0); i < u.Opts.Concurrency; i++ {
-		u.log.WithFields(logrus.Fields{
-			"uploader": i,
-		}).Debug("starting uploader worker")
+	if u.progress != nil {
+		u.progress.Start()
+	}
+	if u.progressBar != nil {
+		u.progressBar.Start()
+	}
+
+	workers := u.Opts.Concurrency
+	var tuner *autoTuner
+	var tune <-chan time.Time
+	if u.Opts.concurrencyAuto {
+		tuner = u.startAutoTuner(ctx, inChan, outChan, done)
+		defer tuner.Stop()
+		workers, tune = tuner.Started(), tuner.C()
+	} else {
+		for i := uint64(0); i < u.Opts.Concurrency; i++ {
+			u.log.WithFields(logrus.Fields{
+				"uploader": i,
+			}).Debug("starting uploader worker")
 
-		go u.Provider.Upload(fmt.Sprintf("%d", i), u.Opts, inChan, outChan, done)
+			go u.Provider.Upload(ctx, fmt.Sprintf("%d", i), u.Opts, inChan, outChan, done)
+		}
 	}
 
-	for {
+	for allDone < workers {
 		select {
 		case outArtifact := <-outChan:
-			if outArtifact != nil && !outArtifact.UploadResult.OK {
+			if outArtifact == nil {
+				continue
+			}
+			u.addResult(outArtifact)
+			u.recordState(outArtifact)
+			u.checkSlowUpload(outArtifact)
+			if u.tracer != nil {
+				u.tracer.ArtifactDone(outArtifact, u.providerName(outArtifact))
+			}
+			u.observeMetrics(outArtifact)
+			if u.progress != nil {
+				u.progress.Completed(outArtifact)
+			}
+			if !outArtifact.UploadResult.OK {
 				failed = append(failed, outArtifact)
 			}
+			if u.failedFast(outArtifact) {
+				stopFast()
+			}
+			if tuner != nil {
+				tuner.Completed(outArtifact)
+			}
+		case <-tune:
+			tuner.Tune()
+			workers = tuner.Started()
 		case <-done:
 			allDone++
-			if allDone >= u.Opts.Concurrency {
-				return nil
+		}
+	}
+
+	sortArtifacts(u.results)
+
+	if u.progressBar != nil {
+		u.progressBar.Stop()
+	}
+	if u.progress != nil {
+		u.progress.Stop()
+	}
+
+	if u.feedErr != nil {
+		return u.feedErr
+	}
+
+	mismatched, err := u.verifyHeaders(u.results)
+	if err != nil {
+		return err
+	}
+	failed = append(failed, mismatched...)
+	failed = append(failed, u.finishDuplicates(ctx)...)
+
+	if finisher, ok := u.Provider.(uploadFinisher); ok {
+		if len(failed) > 0 {
+			u.log.WithField("failed", len(failed)).Warn(
+				fmt.Sprintf("not finishing %s upload", u.Provider.Name()))
+		} else {
+			err := finisher.Finish(u.Opts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if u.Opts.WriteChecksums {
+		if len(failed) > 0 {
+			u.log.WithField("failed", len(failed)).Warn("not writing " + checksumsKey)
+		} else {
+			sums, err := u.checksumArtifacts()
+			if err != nil {
+				return err
+			}
+
+			failed = append(failed, u.uploadExtra(sums)...)
+		}
+	}
+
+	if u.Opts.ManifestKey != "" {
+		if len(failed) > 0 && !u.Opts.ManifestIncludeFailed {
+			u.log.WithField("failed", len(failed)).Warn("not writing manifest")
+		} else {
+			manifests, err := u.manifestArtifacts()
+			if err != nil {
+				return err
 			}
+
+			failed = append(failed, u.uploadExtra(manifests)...)
+		}
+	}
+
+	if u.Opts.GenerateIndex {
+		if len(failed) > 0 {
+			u.log.WithField("failed", len(failed)).Warn("not writing index")
+		} else {
+			indexes, err := u.indexArtifacts()
+			if err != nil {
+				return err
+			}
+
+			failed = append(failed, u.uploadExtra(indexes)...)
 		}
 	}
 
+	if u.Opts.GithubPRComment && u.Opts.DryRun {
+		u.log.Info("not commenting on pull request in a dry run")
+	} else if u.Opts.GithubPRComment {
+		err := u.commentOnPR()
+		if err != nil && u.Opts.GithubPRCommentRequired {
+			return err
+		}
+
+		if err != nil {
+			u.log.WithField("err", err).Warn("failed to comment on pull request")
+		}
+	}
+
+	if u.Opts.SuccessMarker != "" {
+		if len(failed) > 0 {
+			u.log.WithField("failed", len(failed)).Warn("not writing success marker")
+			return nil
+		}
+
+		failed = append(failed, u.uploadExtra(u.successMarkers())...)
+	}
+
 	return nil
 }
 
+// uploadExtra uploads generated artifacts after the main run using a
+// single worker, returning any that failed
+func (u *uploader) uploadExtra(artifacts []*artifact.Artifact) []*artifact.Artifact {
+	in := make(chan *artifact.Artifact)
+	out := make(chan *artifact.Artifact)
+	done := make(chan bool)
+	failed := []*artifact.Artifact{}
+
+	go u.Provider.Upload(u.Opts.runContext(), "extra", u.Opts, in, out, done)
+
+	go func() {
+		for _, a := range artifacts {
+			u.see(a.FullDest())
+			in <- a
+		}
+		close(in)
+	}()
+
+	for {
+		select {
+		case a := <-out:
+			if a == nil {
+				continue
+			}
+			u.results = append(u.results, a)
+			u.checkSlowUpload(a)
+			if u.tracer != nil {
+				u.tracer.ArtifactDone(a, u.providerName(a))
+			}
+			u.observeMetrics(a)
+			if !a.UploadResult.OK {
+				failed = append(failed, a)
+			}
+		case <-done:
+			return failed
+		}
+	}
+}
+
 func (u *uploader) artifactFeederLoop(path *path.Path, artifacts chan *artifact.Artifact) error {
 	to, from, root := path.To, path.From, path.Root
 	u.log.WithField("path", path).Debug("incoming path")
@@ -157,22 +764,10 @@ func (u *uploader) artifactFeederLoop(path *path.Path, artifacts chan *artifact.
 		u.log.WithField("root", root).Debug("path is dir, so setting root to root+from")
 	}
 
-	artifactOpts := &artifact.Options{
-		Perm:        s3.ACL(u.Opts.Perm),
-		RepoSlug:    u.Opts.RepoSlug,
-		BuildNumber: u.Opts.BuildNumber,
-		BuildID:     u.Opts.BuildID,
-		JobNumber:   u.Opts.JobNumber,
-		JobID:       u.Opts.JobID,
-	}
-
-	filepath.Walk(path.Fullpath(), func(source string, info os.FileInfo, err error) error {
-		if info != nil && info.IsDir() {
-			u.log.WithField("path", source).Debug("skipping directory")
-			return nil
-		}
+	artifactOpts := u.artifactOptions()
 
-		relPath := strings.Replace(strings.Replace(source, root, "", -1), root+"/", "", -1)
+	destOf := func(source string) (string, string) {
+		relPath := strings.Replace(strings.Replace(source, root, "", -1), root+string(filepath.Separator), "", -1)
 		dest := relPath
 		if len(to) > 0 {
 			if path.IsDir() {
@@ -181,67 +776,287 @@ func (u *uploader) artifactFeederLoop(path *path.Path, artifacts chan *artifact.
 				dest = to
 			}
 		}
+		return relPath, keyPath(dest)
+	}
+
+	var walkFn filepath.WalkFunc
+	walkFn = func(source string, info os.FileInfo, err error) error {
+		if info != nil && u.excludes != nil {
+			if pattern, excluded := u.excludes.Excluded(relToWorkingDir(u.Opts.WorkingDir, source), info.IsDir()); excluded {
+				u.log.WithFields(logrus.Fields{
+					"path":    source,
+					"pattern": pattern,
+				}).Debug("skipping excluded path")
+				u.decide(source, false, "exclude", pattern)
+				_, dest := destOf(source)
+				u.keep(dest, info.IsDir())
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		linkTarget := ""
+		if err == nil && info != nil && info.Mode()&os.ModeSymlink != 0 {
+			if u.Opts.symlinkMode() == "preserve" {
+				linkTarget, err = os.Readlink(source)
+			} else if u.Opts.symlinkMode() != "" {
+				return u.walkSymlink(source, walkFn)
+			}
+		}
+
+		if err == nil && info != nil && !info.IsDir() && linkTarget == "" {
+			err = checkReadable(source)
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			_, dest := destOf(source)
+			u.keep(dest, info != nil && info.IsDir())
+			return u.handleWalkError(source, info, err)
+		}
+
+		if info != nil && info.IsDir() {
+			u.log.WithField("path", source).Debug("skipping directory")
+			return nil
+		}
+
+		relPath, dest := destOf(source)
+
+		if _, included := u.includes.Included(relToWorkingDir(u.Opts.WorkingDir, source)); !included {
+			u.log.WithField("path", source).Debug("skipping path not matching --include")
+			u.decide(source, false, "include", strings.Join(u.includes.Patterns, ":"))
+			u.keep(dest, false)
+			return nil
+		}
+
+		if u.watchOnly != nil && !u.watchOnly[source] {
+			return nil
+		}
+
+		if u.seenCanonically(source) {
+			return nil
+		}
+
+		if !u.inShard(dest) {
+			u.log.WithField("path", source).Debug("skipping file in another shard")
+			u.decide(source, false, "shard", u.shardDetail())
+			return nil
+		}
+
+		if !u.countFile(source) {
+			return nil
+		}
 
+		rule, detail := "path", path.From
 		for _, targetPath := range u.Opts.TargetPaths {
 			err := func() error {
 				u.curSize.Lock()
 				defer u.curSize.Unlock()
 
 				a := artifact.New(targetPath, source, dest, artifactOpts)
+				if linkTarget != "" {
+					a = symlinkArtifact(targetPath, dest, linkTarget, artifactOpts)
+				}
+				if err := u.applyGzip(a); err != nil {
+					return err
+				}
 
 				size, err := a.Size()
 				if err != nil {
 					return err
 				}
 
-				u.curSize.Current += size
 				logFields := logrus.Fields{
-					"current_size":     humanize.Bytes(u.curSize.Current),
+					"current_size":     humanize.Bytes(u.curSize.Current + size),
 					"max_size":         humanize.Bytes(u.Opts.MaxSize),
 					"percent_max_size": pctMax(size, u.Opts.MaxSize),
 					"artifact":         relPath,
 					"artifact_size":    humanize.Bytes(size),
 				}
 
-				if u.curSize.Current > u.Opts.MaxSize {
-					msg := "max-size would be exceeded"
-					u.log.WithFields(logFields).Error(msg)
-					return fmt.Errorf(msg)
+				if u.Opts.MaxFileSize > 0 && size > u.Opts.MaxFileSize {
+					rule, detail = "max-file-size", humanize.Bytes(u.Opts.MaxFileSize)
+					if u.Opts.TrimToFit {
+						u.log.WithFields(logFields).Warn("leaving out artifact larger than --max-file-size")
+						return nil
+					}
+					u.log.WithFields(logFields).Error("max-file-size would be exceeded")
+					return categorize(FailureSizeLimit, fmt.Errorf("%s is %s, more than --max-file-size %s",
+						relPath, humanize.Bytes(size), humanize.Bytes(u.Opts.MaxFileSize)))
+				}
+
+				u.curSize.Current += size
+				u.countSize(relToWorkingDir(u.Opts.WorkingDir, source), size)
+
+				// a bundle is held to --max-size as a whole once it's written,
+				// and --trim-to-fit decides what fits once the walk is done.
+				// Past the limit, files are sized but not queued, so that the
+				// error can say where all of the total comes from.
+				if (u.curSize.Exceeded || u.curSize.Current > u.Opts.MaxSize) && !u.Opts.bundling() && !u.Opts.TrimToFit {
+					if !u.curSize.Exceeded {
+						u.log.WithFields(logFields).Error("max-size would be exceeded")
+					}
+					u.curSize.Exceeded = true
+					rule, detail = "max-size", humanize.Bytes(u.Opts.MaxSize)
+					return nil
 				}
 
 				u.log.WithFields(logFields).Debug("queueing artifact")
-				artifacts <- a
-				return nil
+				return u.queue(a, relToWorkingDir(u.Opts.WorkingDir, source), artifacts)
 			}()
 			if err != nil {
 				return err
 			}
+			if rule != "path" {
+				break
+			}
 		}
+
+		u.decide(source, rule == "path", rule, detail)
 		return nil
-	})
+	}
+
+	return filepath.Walk(path.Fullpath(), walkFn)
+}
+
+func (u *uploader) artifactOptions() *artifact.Options {
+	return &artifact.Options{
+		Perm:        s3.ACL(u.Opts.Perm),
+		RepoSlug:    u.Opts.RepoSlug,
+		BuildNumber: u.Opts.BuildNumber,
+		BuildID:     u.Opts.BuildID,
+		JobNumber:   u.Opts.JobNumber,
+		JobID:       u.Opts.JobID,
+
+		ContentTypeByExtensionOnly: u.Opts.ContentTypeByExtensionOnly,
+		ContentTypePrecedence:      u.Opts.ContentTypePrecedence,
+		ContentTypes:               u.contentTypes,
+		DefaultContentType:         u.Opts.DefaultContentType,
+	}
+}
+
+func (u *uploader) handleWalkError(source string, info os.FileInfo, err error) error {
+	logFields := logrus.Fields{
+		"path": source,
+		"err":  err,
+	}
+
+	if !u.Opts.KeepGoingOnWalkError {
+		u.log.WithFields(logFields).Error("failed to read path")
+		u.decide(source, false, "unreadable", err.Error())
+		return err
+	}
+
+	u.walkErrCount++
+	u.log.WithFields(logFields).Warn("skipping path that could not be read")
+	u.decide(source, false, "unreadable", err.Error())
+
+	if info != nil && info.IsDir() {
+		return filepath.SkipDir
+	}
 
 	return nil
 }
 
 func (u *uploader) artifactFeeder(artifacts chan *artifact.Artifact) error {
 	u.curSize = &maxSizeTracker{Current: uint64(0)}
+	u.canonical = map[string]string{}
+
+	ex, err := newExcludes(u.Opts.WorkingDir, u.Opts.Excludes)
+	if err != nil {
+		u.feedErr = err
+		close(artifacts)
+		return err
+	}
+	u.excludes = ex
+	u.includes = newIncludes(u.Opts.Includes)
 
 	i := 0
 	for _, path := range u.Paths.All() {
-		u.artifactFeederLoop(path, artifacts)
+		err := u.artifactFeederLoop(path, artifacts)
+		if err != nil {
+			u.feedErr = err
+			break
+		}
 		i++
 	}
 
+	if u.feedErr == nil {
+		u.feedErr = u.maxFilesError()
+	}
+
+	if u.feedErr == nil {
+		u.feedErr = u.maxSizeError()
+	}
+
+	if u.stdinDest != "" && u.feedErr == nil {
+		u.feedErr = u.queueStdin(artifacts)
+	}
+
+	if len(u.redirects) > 0 && u.feedErr == nil {
+		u.feedErr = u.queueRedirects(artifacts)
+	}
+
+	if u.order != nil && u.feedErr == nil {
+		u.order.Sort(u.ordered)
+		for _, oa := range u.ordered {
+			artifacts <- oa.Artifact
+		}
+	}
+
 	u.log.WithFields(logrus.Fields{
 		"total_size":   humanize.Bytes(u.curSize.Current),
 		"count":        i,
+		"skipped":      u.walkErrCount,
 		"time_elapsed": time.Since(u.startTime),
 	}).Debug("done feeding artifacts")
 
 	close(artifacts)
+	return u.feedErr
+}
+
+// queue sends the artifact along right away, unless there is an upload
+// order to follow, in which case it is held until the walk is done
+func (u *uploader) queue(a *artifact.Artifact, relPath string, artifacts chan *artifact.Artifact) error {
+	u.applyContentEncoding(a)
+	u.applyContentTypeRules(a, relPath)
+	u.applyHeaderRules(a, relPath)
+	u.applyNoCache(a, relPath)
+	if err := u.applyRedirect(a); err != nil {
+		return err
+	}
+
+	if err := u.checkKeyLength(a); err != nil {
+		u.log.WithField("err", err).Error("key is too long")
+		u.decide(artifactSourceName(a), false, "max-key-length", fmt.Sprintf("%d", u.Opts.MaxKeyLength))
+		return err
+	}
+
+	if u.order == nil {
+		artifacts <- a
+		return nil
+	}
+
+	u.ordered = append(u.ordered, &orderedArtifact{
+		Artifact: a,
+		Priority: u.order.Priority(relPath),
+	})
 	return nil
 }
 
+func checkReadable(source string) error {
+	release := artifact.AcquireOpenFile()
+	defer release()
+
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
 func (u *uploader) files() chan *artifact.Artifact {
 	artifacts := make(chan *artifact.Artifact)
 	go u.artifactFeeder(artifacts)
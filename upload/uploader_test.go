@@ -1,10 +1,16 @@
 package upload
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/aws"
 )
 
 var (
@@ -31,17 +37,55 @@ func getPanicLogger() *logrus.Logger {
 	return log
 }
 
-func getTestUploader() *uploader {
-	setUploaderEnv()
+// getTestUploader is an uploader on options from the environment, changed
+// by configure if given, logging to log or nowhere if it is nil.  Its
+// s3 providers talk to testS3, and no provider waits between retries.
+func getTestUploader(log *logrus.Logger, configure func(*Options)) *uploader {
+	if log == nil {
+		log = getPanicLogger()
+	}
+
+	opts := NewOptions()
+	if configure != nil {
+		configure(opts)
+	}
 
-	log := getPanicLogger()
-	u := newUploader(NewOptions(), log)
-	u.Provider = newNullProvider(nil, log)
+	u := newUploader(opts, log)
+	useTestProvider(u.Provider)
 	return u
 }
 
+// useTestProvider points the provider, or each one it fans out to, at
+// testS3, without waiting between retries
+func useTestProvider(p Provider) {
+	switch p := p.(type) {
+	case *fanoutProvider:
+		for _, dest := range p.dests {
+			useTestProvider(dest.Provider)
+		}
+	case *s3Provider:
+		p.RetryInterval = 0
+		p.overrideConn = testS3
+		p.overrideAuth = aws.Auth{AccessKey: "whatever", SecretKey: "whatever"}
+	case *gcsProvider:
+		p.RetryInterval = 0
+	case *azureProvider:
+		p.RetryInterval = 0
+	}
+}
+
+// getBufferLogger logs warnings and errors to the returned buffer
+func getBufferLogger() (*logrus.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	log := logrus.New()
+	log.Out = buf
+	log.Level = logrus.WarnLevel
+	return log, buf
+}
+
 func TestNewUploader(t *testing.T) {
-	u := getTestUploader()
+	setUploaderEnv()
+	u := getTestUploader(nil, nil)
 	if u == nil {
 		t.Errorf("options are %v", u)
 	}
@@ -87,6 +131,67 @@ func TestNewUploaderProviderOptions(t *testing.T) {
 	}
 }
 
+func TestNewUploaderProviderRetryDefaults(t *testing.T) {
+	os.Clearenv()
+	for provider, retries := range map[string]uint64{
+		"s3":        4,
+		"oci":       3,
+		"artifacts": 2,
+		"null":      2,
+	} {
+		opts := NewOptions()
+		opts.Provider = provider
+		u := newUploader(opts, getPanicLogger())
+		if u.Opts.Retries != retries {
+			t.Fatalf("%s provider retries %v != %v", provider, u.Opts.Retries, retries)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Provider = "oci"
+	if interval := newUploader(opts, getPanicLogger()).Opts.RetryInterval; interval != ociProviderRetryInterval {
+		t.Fatalf("oci provider retry interval %v != %v", interval, ociProviderRetryInterval)
+	}
+
+	opts = NewOptions()
+	opts.Provider = "oci"
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{"--retry-interval", "1s"}))
+	if interval := newUploader(opts, getPanicLogger()).Opts.RetryInterval; interval != time.Second {
+		t.Fatalf("--retry-interval %v was replaced by the provider default", interval)
+	}
+}
+
+func TestNewUploaderExplicitRetries(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	opts := NewOptions()
+	opts.Retries = 7
+	if newUploader(opts, getPanicLogger()).Opts.Retries != 7 {
+		t.Fatalf("explicit retries were replaced by the provider default")
+	}
+
+	opts = NewOptions()
+	opts.UpdateFromCLI(getOptionsCLIContext(t, []string{"--retries", "2"}))
+	if newUploader(opts, getPanicLogger()).Opts.Retries != 2 {
+		t.Fatalf("--retries was replaced by the provider default")
+	}
+
+	opts = NewOptions()
+	if err := opts.UpdateFromConfig(map[string]interface{}{"retries": float64(2)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if newUploader(opts, getPanicLogger()).Opts.Retries != 2 {
+		t.Fatalf("config retries were replaced by the provider default")
+	}
+
+	os.Setenv("ARTIFACTS_RETRIES", "2")
+	opts = NewOptions()
+	if newUploader(opts, getPanicLogger()).Opts.Retries != 2 {
+		t.Fatalf("$ARTIFACTS_RETRIES was replaced by the provider default")
+	}
+}
+
 func TestNewUploaderUnsetCacheControlOption(t *testing.T) {
 	opts := NewOptions()
 	opts.CacheControl = ""
@@ -98,14 +203,15 @@ func TestNewUploaderUnsetCacheControlOption(t *testing.T) {
 
 func TestUpload(t *testing.T) {
 	setUploaderEnv()
-	err := Upload(NewOptions(), getPanicLogger())
+	err := Upload(context.Background(), NewOptions(), getPanicLogger())
 	if err != nil {
 		t.Errorf("go boom: %v", err)
 	}
 }
 
 func TestUploaderUpload(t *testing.T) {
-	u := getTestUploader()
+	setUploaderEnv()
+	u := getTestUploader(nil, nil)
 	if u == nil {
 		t.Errorf("options are %v", u)
 	}
@@ -115,3 +221,66 @@ func TestUploaderUpload(t *testing.T) {
 		t.Errorf("failed to not really upload: %v", err)
 	}
 }
+
+// writeWalkErrorFiles writes a dir with an unreadable file and an
+// unreadable subdir, along with a readable file
+func writeWalkErrorFiles(t *testing.T) string {
+	if os.Geteuid() == 0 {
+		t.Skip("unreadable paths are readable by root")
+	}
+
+	dir, err := ioutil.TempDir("", "artifacts-test-walk-error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"ok", "unreadable", "locked/inner"} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, p), []byte("something\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Chmod(filepath.Join(dir, "unreadable"), 0000)
+	os.Chmod(filepath.Join(dir, "locked"), 0000)
+	return dir
+}
+
+func walkErrorOpts(dir string, keepGoing bool) func(*Options) {
+	return func(opts *Options) {
+		opts.Provider = "null"
+		opts.Paths = []string{dir}
+		opts.TargetPaths = []string{"walk"}
+		opts.KeepGoingOnWalkError = keepGoing
+	}
+}
+
+func TestUploaderUploadWalkError(t *testing.T) {
+	u := getTestUploader(nil, walkErrorOpts(writeWalkErrorFiles(t), false))
+
+	err := u.Upload()
+	if err == nil {
+		t.Fatalf("unreadable paths did not fail the upload")
+	}
+
+	if !os.IsPermission(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploaderUploadKeepGoingOnWalkError(t *testing.T) {
+	u := getTestUploader(nil, walkErrorOpts(writeWalkErrorFiles(t), true))
+
+	err := u.Upload()
+	if err != nil {
+		t.Fatalf("unreadable paths failed the upload: %v", err)
+	}
+
+	if u.walkErrCount != 2 {
+		t.Fatalf("skipped count %v != 2", u.walkErrCount)
+	}
+}
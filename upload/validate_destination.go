@@ -0,0 +1,130 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+const validateKeyName = ".artifacts-validate"
+
+// destinationCheck is one of the checks made by the validate command,
+// which passed if Err is nil and it wasn't skipped
+type destinationCheck struct {
+	Name    string
+	Err     error
+	Skipped bool
+}
+
+// ValidateDestination checks the options, then that the provider's
+// destination can be reached and written to with them, without uploading
+// anything.  It writes whether each check passed to out, one per line, and
+// returns the error of the first that failed.
+func ValidateDestination(opts *Options, out io.Writer, log *logrus.Logger) error {
+	checks := []*destinationCheck{
+		&destinationCheck{Name: "options", Err: opts.Validate()},
+	}
+
+	if checks[0].Err == nil {
+		u := newUploader(opts, log)
+		if dc, ok := u.Provider.(destinationChecker); ok {
+			checks = append(checks, dc.CheckDestination(opts)...)
+		} else {
+			checks = append(checks, &destinationCheck{
+				Name:    fmt.Sprintf("destination: the %s provider cannot be checked", u.Provider.Name()),
+				Skipped: true,
+			})
+		}
+	}
+
+	var firstErr error
+	failed := 0
+	for _, check := range checks {
+		switch {
+		case check.Skipped:
+			fmt.Fprintf(out, "skip %s\n", check.Name)
+		case check.Err == nil:
+			fmt.Fprintf(out, "pass %s\n", check.Name)
+		default:
+			fmt.Fprintf(out, "fail %s: %v\n", check.Name, check.Err)
+			if firstErr == nil {
+				firstErr = check.Err
+			}
+			failed++
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d checks failed: %w", failed, len(checks), firstErr)
+	}
+	return nil
+}
+
+// CheckDestination makes a HEAD request on the bucket, then starts a
+// multipart upload under the first target path and aborts it, which
+// takes the same permission as uploading without leaving an object behind
+func (s3p *s3Provider) CheckDestination(opts *Options) []*destinationCheck {
+	bucket, err := s3p.bucket()
+	if err != nil {
+		return []*destinationCheck{&destinationCheck{Name: "credentials", Err: err}}
+	}
+
+	checks := []*destinationCheck{&destinationCheck{Name: "credentials"}}
+
+	headCheck := &destinationCheck{Name: fmt.Sprintf("bucket %s is reachable", opts.BucketName)}
+	checks = append(checks, headCheck)
+
+	resp, err := bucket.Head("")
+	if err != nil {
+		headCheck.Err = s3BucketError(opts.BucketName, err)
+		return checks
+	}
+	resp.Body.Close()
+
+	targetPath := ""
+	if len(opts.TargetPaths) > 0 {
+		targetPath = opts.TargetPaths[0]
+	}
+	key := (&artifact.Artifact{Prefix: targetPath, Dest: validateKeyName}).FullDest()
+
+	writeCheck := &destinationCheck{Name: fmt.Sprintf("bucket %s is writable at %s", opts.BucketName, key)}
+	checks = append(checks, writeCheck)
+
+	multi, err := bucket.InitMulti(key, "application/octet-stream", s3.ACL(opts.Perm))
+	if err != nil {
+		writeCheck.Err = s3BucketError(opts.BucketName, err)
+		return checks
+	}
+
+	if err := multi.Abort(); err != nil {
+		s3p.log.WithFields(logrus.Fields{
+			"key": key,
+			"err": err,
+		}).Warn("failed to abort the multipart upload started to check the bucket")
+	}
+
+	return checks
+}
+
+// s3BucketError explains the statuses that a HEAD request gets without a
+// body to say what went wrong
+func s3BucketError(bucketName string, err error) error {
+	var s3Err *s3.Error
+	if !errors.As(err, &s3Err) {
+		return err
+	}
+
+	switch s3Err.StatusCode {
+	case http.StatusForbidden:
+		return categorize(FailureCredentials,
+			fmt.Errorf("access to bucket %s is denied with these credentials: %v", bucketName, err))
+	case http.StatusNotFound:
+		return fmt.Errorf("bucket %s does not exist: %v", bucketName, err)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func validateDestinationOpts(opts *Options) {
+	opts.BucketName = "bucket"
+	opts.AccessKey = "whatever"
+	opts.SecretKey = "whatever"
+	opts.TargetPaths = []string{"validate-test"}
+}
+
+func TestS3ProviderCheckDestination(t *testing.T) {
+	os.Clearenv()
+	ms := &multipartS3Server{Parts: map[string]string{}, Headers: map[string]http.Header{}}
+	srv := httptest.NewServer(ms)
+	defer srv.Close()
+
+	u := getTestUploader(nil, validateDestinationOpts)
+	s3p := u.Provider.(*s3Provider)
+	s3p.overrideConn = s3.New(s3p.overrideAuth, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	checks := s3p.CheckDestination(u.Opts)
+	if len(checks) != 3 {
+		t.Fatalf("checks %v != 3", len(checks))
+	}
+
+	for _, check := range checks {
+		if check.Err != nil {
+			t.Fatalf("check %q failed: %v", check.Name, check.Err)
+		}
+	}
+
+	if !strings.HasSuffix(checks[2].Name, "validate-test/.artifacts-validate") {
+		t.Fatalf("write check %q does not name the key", checks[2].Name)
+	}
+
+	if !ms.Aborted || ms.Completed {
+		t.Fatalf("multipart upload was not aborted: aborted=%v completed=%v", ms.Aborted, ms.Completed)
+	}
+}
+
+func TestS3ProviderCheckDestinationDenied(t *testing.T) {
+	os.Clearenv()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	u := getTestUploader(nil, validateDestinationOpts)
+	s3p := u.Provider.(*s3Provider)
+	s3p.overrideConn = s3.New(s3p.overrideAuth, aws.Region{Name: "faux-region-9001", S3Endpoint: srv.URL})
+
+	checks := s3p.CheckDestination(u.Opts)
+	last := checks[len(checks)-1]
+	if last.Err == nil || FailureCategory(last.Err) != FailureCredentials {
+		t.Fatalf("denied bucket check %q error %v is not a credentials failure", last.Name, last.Err)
+	}
+}
+
+func TestValidateDestination(t *testing.T) {
+	os.Clearenv()
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	buf := &bytes.Buffer{}
+	if err := ValidateDestination(opts, buf, getPanicLogger()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "pass options\nskip destination: the null provider cannot be checked\n"
+	if buf.String() != expected {
+		t.Fatalf("output %q != %q", buf.String(), expected)
+	}
+
+	opts = NewOptions()
+	opts.Provider = "null"
+	opts.ProgressInterval = -time.Second
+
+	buf = &bytes.Buffer{}
+	err := ValidateDestination(opts, buf, getPanicLogger())
+	if err == nil || FailureCategory(err) != FailureValidation {
+		t.Fatalf("invalid options error %v is not a validation failure", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "fail options: ") {
+		t.Fatalf("output %q does not fail the options", buf.String())
+	}
+}
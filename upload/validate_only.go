@@ -0,0 +1,75 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ValidateOnly checks the options and resolves the paths to the files
+// that would be uploaded, without contacting the provider.  It returns
+// the number of files found.
+func ValidateOnly(opts *Options, log *logrus.Logger) (int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+
+	return newUploader(opts, log).resolve()
+}
+
+func (u *uploader) resolve() (int, error) {
+	missing := []string{}
+	for _, p := range u.Paths.All() {
+		if _, err := os.Stat(p.Fullpath()); err != nil {
+			missing = append(missing, p.From)
+		}
+	}
+
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("paths do not exist: %s", strings.Join(missing, ", "))
+	}
+
+	if u.Opts.UploadOrderFrom != "" {
+		order, err := loadUploadOrder(u.Opts.UploadOrderFrom)
+		if err != nil {
+			return 0, err
+		}
+		u.order = order
+	}
+
+	// stdin can only be read once, so it is counted without reading it
+	stdinCount := 0
+	if u.stdinDest != "" {
+		stdinCount = 1
+		u.stdinDest = ""
+	}
+
+	sources := map[string]bool{}
+	for a := range u.files() {
+		sources[a.Source] = true
+	}
+
+	if u.feedErr != nil {
+		return 0, u.feedErr
+	}
+
+	count := len(sources) + stdinCount
+	if count == 0 {
+		return 0, fmt.Errorf("no files found to upload")
+	}
+
+	expected, err := parseExpectedCount(u.Opts.ExpectedCount)
+	if err != nil {
+		return 0, err
+	}
+
+	if expected != nil {
+		if err := expected.Check(uint64(count)); err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,64 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func getValidateOnlyOptions(paths ...string) *Options {
+	opts := NewOptions()
+	opts.Provider = "null"
+	opts.Paths = paths
+	opts.TargetPaths = []string{"t1", "t2"}
+	opts.ValidateOnly = true
+	return opts
+}
+
+func TestValidateOnly(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	count, err := ValidateOnly(getValidateOnlyOptions(dir), getPanicLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("file count %v != 2", count)
+	}
+}
+
+func TestValidateOnlyInvalid(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"a.txt": "a"})
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty")
+	os.Mkdir(empty, 0755)
+
+	noBucket := getValidateOnlyOptions(dir)
+	noBucket.Provider = "s3"
+
+	badOrder := getValidateOnlyOptions(dir)
+	badOrder.UploadOrderFrom = filepath.Join(dir, "nope")
+
+	tooBig := getValidateOnlyOptions(dir)
+	tooBig.MaxSize = 0
+
+	for desc, opts := range map[string]*Options{
+		"missing bucket":      noBucket,
+		"missing order file":  badOrder,
+		"missing path":        getValidateOnlyOptions(dir, filepath.Join(dir, "nonexistent")),
+		"no files":            getValidateOnlyOptions(empty),
+		"max size exceeded":   tooBig,
+		"no paths whatsoever": getValidateOnlyOptions(),
+	} {
+		_, err := ValidateOnly(opts, getPanicLogger())
+		if err == nil {
+			t.Errorf("%s: invalid config was accepted", desc)
+		}
+	}
+}
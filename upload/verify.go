@@ -0,0 +1,182 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// VerifyResult counts how the artifacts compared to their remote objects.
+// SizeOnly are the objects whose size matched but that have neither an
+// md5 etag nor a --checksums sha256 to compare the content with.
+type VerifyResult struct {
+	Verified   int
+	SizeOnly   int
+	Missing    int
+	Mismatched int
+	Errored    int
+}
+
+// verifyOutcome is how one artifact compared to its remote object
+type verifyOutcome struct {
+	Key    string
+	Status string
+	Reason string
+}
+
+// Verify walks the paths as upload would, and checks that the object of
+// each artifact exists with the same size and checksum, writing a line to
+// w for each one that doesn't.  It fails if any are missing or mismatched.
+func Verify(opts *Options, w io.Writer, log *logrus.Logger) (*VerifyResult, error) {
+	return newUploader(opts, log).verify(w)
+}
+
+func (u *uploader) verify(w io.Writer) (*VerifyResult, error) {
+	defer u.removeTempFiles()
+
+	fetcher, ok := u.Provider.(HeaderFetcher)
+	if !ok {
+		return nil, fmt.Errorf("verify is not supported by the %s provider", u.Provider.Name())
+	}
+
+	// stdin is gone once it has been uploaded, so there's nothing to compare
+	if u.stdinDest != "" {
+		u.log.Warn("not verifying stdin")
+		u.stdinDest = ""
+	}
+
+	workers := int(u.Opts.Concurrency)
+	if workers < 1 {
+		workers = 1
+	}
+
+	in := u.files()
+	outcomes := []*verifyOutcome{}
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range in {
+				outcome := u.verifyArtifact(fetcher, a)
+				lock.Lock()
+				outcomes = append(outcomes, outcome)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if u.feedErr != nil {
+		return nil, u.feedErr
+	}
+
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].Key < outcomes[j].Key })
+
+	result := &VerifyResult{}
+	for _, outcome := range outcomes {
+		switch outcome.Status {
+		case "ok":
+			result.Verified++
+			continue
+		case "size-only":
+			result.SizeOnly++
+			u.log.WithField("key", outcome.Key).Debug("only the size could be compared")
+			continue
+		case "missing":
+			result.Missing++
+		case "mismatched":
+			result.Mismatched++
+		default:
+			result.Errored++
+		}
+
+		line := fmt.Sprintf("%s %s", outcome.Status, outcome.Key)
+		if outcome.Reason != "" {
+			line += ": " + outcome.Reason
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return result, err
+		}
+	}
+
+	if bad := result.Missing + result.Mismatched + result.Errored; bad > 0 {
+		return result, fmt.Errorf("%d of %d artifacts are missing, mismatched, or could not be checked",
+			bad, len(outcomes))
+	}
+
+	return result, nil
+}
+
+// verifyArtifact compares the artifact to the headers of its object: the
+// size always, then the md5 etag of an object put in one piece, or the
+// sha256 that --checksums stores with each object
+func (u *uploader) verifyArtifact(fetcher HeaderFetcher, a *artifact.Artifact) *verifyOutcome {
+	key := a.FullDest()
+
+	if u.Opts.deltaApplies(a) {
+		return u.verifyDelta(a)
+	}
+
+	headers, err := fetcher.FetchHeaders(u.Opts, a)
+	if err != nil {
+		var s3Err *s3.Error
+		if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+			return &verifyOutcome{Key: key, Status: "missing"}
+		}
+		return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+	}
+
+	if length := headers.Get("Content-Length"); length != "" {
+		remoteSize, err := strconv.ParseUint(length, 10, 64)
+		if err == nil && remoteSize != size {
+			return &verifyOutcome{Key: key, Status: "mismatched",
+				Reason: fmt.Sprintf("size %d != %d", remoteSize, size)}
+		}
+	}
+
+	// objects encrypted with kms or a customer key have etags that aren't
+	// the md5 of their content, and those uploaded in parts have a dash
+	etag := strings.Trim(headers.Get("ETag"), `"`)
+	if etag != "" && !strings.Contains(etag, "-") &&
+		u.Opts.ServerSideEncryption != sseKMS && u.Opts.SSECustomerKey == "" {
+		sum, err := artifactMD5(a)
+		if err != nil {
+			return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+		}
+		if sum != etag {
+			return &verifyOutcome{Key: key, Status: "mismatched", Reason: fmt.Sprintf("md5 %s != %s", etag, sum)}
+		}
+		return &verifyOutcome{Key: key, Status: "ok"}
+	}
+
+	if remoteSum := headers.Get("x-amz-meta-" + sha256MetadataKey); remoteSum != "" {
+		sum, err := a.SHA256()
+		if err != nil {
+			return &verifyOutcome{Key: key, Status: "error", Reason: err.Error()}
+		}
+		if sum != remoteSum {
+			return &verifyOutcome{Key: key, Status: "mismatched",
+				Reason: fmt.Sprintf("sha256 %s != %s", remoteSum, sum)}
+		}
+		return &verifyOutcome{Key: key, Status: "ok"}
+	}
+
+	return &verifyOutcome{Key: key, Status: "size-only"}
+}
@@ -0,0 +1,130 @@
+package upload
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+var verifyHeadersPolicies = map[string]bool{
+	"off":  true,
+	"warn": true,
+	"fail": true,
+}
+
+// headerMismatch is a header an object was stored with that differs from
+// the one it was uploaded with
+type headerMismatch struct {
+	Header   string
+	Expected string
+	Actual   string
+}
+
+func (hm *headerMismatch) String() string {
+	return fmt.Sprintf("%s %q != %q", hm.Header, hm.Actual, hm.Expected)
+}
+
+// verifyHeaders fetches the headers of each uploaded artifact and checks
+// them against what was sent, unless --verify-headers is off.  With the
+// fail policy, mismatched artifacts are marked as failed and returned.
+func (u *uploader) verifyHeaders(results []*artifact.Artifact) ([]*artifact.Artifact, error) {
+	if u.Opts.VerifyHeaders == "off" || u.Opts.DryRun {
+		return nil, nil
+	}
+
+	fetcher, err := u.headerFetcher()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := []*artifact.Artifact{}
+	for _, a := range results {
+		if !a.UploadResult.OK {
+			continue
+		}
+
+		if a.IsStream() {
+			u.log.WithField("dest", a.FullDest()).Debug("not verifying the headers of a stream")
+			continue
+		}
+
+		mismatches, err := u.headerMismatches(fetcher, a)
+		if err != nil {
+			u.log.WithFields(logrus.Fields{
+				"dest": a.FullDest(),
+				"err":  err,
+			}).Warn("failed to fetch headers")
+
+			if u.Opts.VerifyHeaders == "fail" {
+				a.UploadResult.OK = false
+				a.UploadResult.Err = err
+				failed = append(failed, a)
+			}
+			continue
+		}
+
+		if len(mismatches) == 0 {
+			continue
+		}
+
+		descs := []string{}
+		for _, m := range mismatches {
+			u.log.WithFields(logrus.Fields{
+				"dest":     a.FullDest(),
+				"header":   m.Header,
+				"expected": m.Expected,
+				"actual":   m.Actual,
+			}).Warn("object was stored with a different header")
+			descs = append(descs, m.String())
+		}
+
+		if u.Opts.VerifyHeaders == "fail" {
+			a.UploadResult.OK = false
+			a.UploadResult.Err = fmt.Errorf("stored headers differ: %s", strings.Join(descs, ", "))
+			failed = append(failed, a)
+		}
+	}
+
+	return failed, nil
+}
+
+func (u *uploader) headerFetcher() (HeaderFetcher, error) {
+	fetcher, ok := u.Provider.(HeaderFetcher)
+	if !ok {
+		return nil, fmt.Errorf("--verify-headers is not supported by the %s provider", u.Provider.Name())
+	}
+	return fetcher, nil
+}
+
+func (u *uploader) headerMismatches(fetcher HeaderFetcher, a *artifact.Artifact) ([]*headerMismatch, error) {
+	headers, err := fetcher.FetchHeaders(u.Opts, a)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := map[string]string{"Content-Type": a.ContentType()}
+	if u.Opts.VerifyCacheControl {
+		expected["Cache-Control"] = cacheControl(u.Opts, a)
+	}
+
+	mismatches := []*headerMismatch{}
+	for _, header := range []string{"Content-Type", "Cache-Control"} {
+		value, ok := expected[header]
+		if !ok {
+			continue
+		}
+
+		actual := headers.Get(header)
+		if !strings.EqualFold(strings.TrimSpace(actual), strings.TrimSpace(value)) {
+			mismatches = append(mismatches, &headerMismatch{
+				Header:   header,
+				Expected: value,
+				Actual:   actual,
+			})
+		}
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,172 @@
+package upload
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/artifacts/artifact"
+)
+
+// manglingProvider stores some artifacts with a different content type
+type manglingProvider struct {
+	recordingProvider
+	Mangle map[string]string
+}
+
+func (mp *manglingProvider) FetchHeaders(opts *Options, a *artifact.Artifact) (http.Header, error) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-cache")
+	headers.Set("Content-Type", a.ContentType())
+	if ctype, ok := mp.Mangle[a.FullDest()]; ok {
+		headers.Set("Content-Type", ctype)
+	}
+	return headers, nil
+}
+
+func verifyHeadersOpts(dir, policy string) func(*Options) {
+	return func(opts *Options) {
+		opts.WorkingDir = dir
+		opts.Paths = []string{"index.html", "app.js"}
+		opts.TargetPaths = []string{"verify"}
+		opts.VerifyHeaders = policy
+	}
+}
+
+func mangleIndexHTML() *manglingProvider {
+	return &manglingProvider{Mangle: map[string]string{
+		"verify/index.html": "application/octet-stream",
+	}}
+}
+
+func writeVerifyHeadersFiles(t *testing.T) string {
+	os.Clearenv()
+	return writeTestFiles(t, map[string]string{
+		"index.html": "<html></html>",
+		"app.js":     "var x;",
+	})
+}
+
+func TestUploaderVerifyHeadersWarn(t *testing.T) {
+	dir := writeVerifyHeadersFiles(t)
+	defer os.RemoveAll(dir)
+
+	log, buf := getBufferLogger()
+	u := getTestUploader(log, verifyHeadersOpts(dir, "warn"))
+	u.Provider = mangleIndexHTML()
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("failed results %v != 0", len(u.failedResults()))
+	}
+
+	out := buf.String()
+	if strings.Count(out, "object was stored with a different header") != 1 {
+		t.Fatalf("mismatch was not warned about once: %q", out)
+	}
+
+	for _, field := range []string{`dest="verify/index.html"`, `header="Content-Type"`, `actual="application/octet-stream"`} {
+		if !strings.Contains(out, field) {
+			t.Fatalf("warning does not contain %q: %q", field, out)
+		}
+	}
+}
+
+func TestUploaderVerifyHeadersFail(t *testing.T) {
+	dir := writeVerifyHeadersFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, verifyHeadersOpts(dir, "fail"))
+	u.Provider = mangleIndexHTML()
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	failed := u.failedResults()
+	if len(failed) != 1 {
+		t.Fatalf("failed results %v != 1", len(failed))
+	}
+
+	if failed[0].FullDest() != "verify/index.html" {
+		t.Fatalf("failed dest %v != verify/index.html", failed[0].FullDest())
+	}
+
+	if !strings.Contains(failed[0].UploadResult.Err.Error(), `Content-Type "application/octet-stream" != "text/html; charset=utf-8"`) {
+		t.Fatalf("unexpected error: %v", failed[0].UploadResult.Err)
+	}
+}
+
+func TestUploaderVerifyHeadersCacheControl(t *testing.T) {
+	dir := writeVerifyHeadersFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, verifyHeadersOpts(dir, "fail"))
+	u.Provider = mangleIndexHTML()
+	u.Provider.(*manglingProvider).Mangle = map[string]string{}
+	u.Opts.VerifyCacheControl = true
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 2 {
+		t.Fatalf("failed results %v != 2", len(u.failedResults()))
+	}
+}
+
+func TestUploaderVerifyHeadersUnsupported(t *testing.T) {
+	dir := writeVerifyHeadersFiles(t)
+	defer os.RemoveAll(dir)
+
+	u := getTestUploader(nil, verifyHeadersOpts(dir, "warn"))
+	u.Provider = mangleIndexHTML()
+	fake := &recordingProvider{}
+	u.Provider = fake
+
+	err := u.Upload()
+	if err == nil {
+		t.Fatalf("upload with an unsupported provider succeeded")
+	}
+
+	if err.Error() != "--verify-headers is not supported by the recording provider" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fake.Uploaded) != 0 {
+		t.Fatalf("uploaded %v artifacts before checking the provider", len(fake.Uploaded))
+	}
+}
+
+func TestS3ProviderVerifyHeaders(t *testing.T) {
+	dir := writeVerifyHeadersFiles(t)
+	defer os.RemoveAll(dir)
+
+	os.Clearenv()
+	u := getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = []string{filepath.Join(dir, "index.html")}
+		opts.TargetPaths = []string{"verify-s3"}
+		opts.VerifyHeaders = "fail"
+	})
+
+	if err := u.Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(u.failedResults()) != 0 {
+		t.Fatalf("stored content type did not match: %v", u.failedResults()[0].UploadResult.Err)
+	}
+
+	headers, err := u.Provider.(*s3Provider).FetchHeaders(u.Opts, u.results[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if headers.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("content type %q != text/html; charset=utf-8", headers.Get("Content-Type"))
+	}
+}
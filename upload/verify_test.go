@@ -0,0 +1,74 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func verifyTestUploader(dir string, paths ...string) *uploader {
+	return getTestUploader(nil, func(opts *Options) {
+		opts.BucketName = "bucket"
+		opts.WorkingDir = dir
+		opts.Paths = paths
+		opts.TargetPaths = []string{"verify-test"}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+		"out/b.txt": "bbbb",
+	})
+	defer os.RemoveAll(dir)
+
+	if err := verifyTestUploader(dir, "out/").Upload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	result, err := verifyTestUploader(dir, "out/").verify(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Verified != 2 || out.Len() != 0 {
+		t.Fatalf("verified %v, output %q", result.Verified, out.String())
+	}
+
+	// the same size with other content, and a file never uploaded
+	if err := ioutil.WriteFile(filepath.Join(dir, "out/b.txt"), []byte("BBBB"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "out/c.txt"), []byte("c"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out.Reset()
+	result, err = verifyTestUploader(dir, "out/").verify(out)
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 artifacts") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Verified != 1 || result.Mismatched != 1 || result.Missing != 1 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "mismatched verify-test/out/b.txt: md5 ") ||
+		lines[1] != "missing verify-test/out/c.txt" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestVerifyUnsupportedProvider(t *testing.T) {
+	opts := NewOptions()
+	opts.Provider = "null"
+
+	_, err := newUploader(opts, getPanicLogger()).verify(ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "not supported by the null provider") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
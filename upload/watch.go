@@ -0,0 +1,389 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/artifacts/artifact"
+	"github.com/travis-ci/artifacts/path"
+)
+
+const (
+	// DefaultWatchInterval is how often watch scans its paths
+	DefaultWatchInterval = 2 * time.Second
+	// DefaultWatchDebounce is how long watch waits for a file to stop
+	// changing
+	DefaultWatchDebounce = 5 * time.Second
+	// DefaultWatchSummaryInterval is how often watch logs its totals
+	DefaultWatchSummaryInterval = 5 * time.Minute
+)
+
+// WatchOptions are how Watch looks for changes and reports on them
+type WatchOptions struct {
+	// Interval is how often the paths are scanned for changes
+	Interval time.Duration
+	// Debounce is how long a file has to go unchanged before it is
+	// uploaded, so that one still being written isn't
+	Debounce time.Duration
+	// SummaryInterval is how often the totals so far are logged, or never
+	// if 0
+	SummaryInterval time.Duration
+	// StatusAddr is the host:port to serve the status as JSON on, if any
+	StatusAddr string
+}
+
+// NewWatchOptions checks the durations and address given to watch
+func NewWatchOptions(interval, debounce, summaryInterval time.Duration, statusAddr string) (*WatchOptions, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid --interval %v, expected more than 0", interval)
+	}
+	if debounce < 0 {
+		return nil, fmt.Errorf("invalid --debounce %v", debounce)
+	}
+	if summaryInterval < 0 {
+		return nil, fmt.Errorf("invalid --summary-interval %v", summaryInterval)
+	}
+	if statusAddr != "" {
+		if _, _, err := net.SplitHostPort(statusAddr); err != nil {
+			return nil, fmt.Errorf("invalid --status-addr %q, expected host:port: %v", statusAddr, err)
+		}
+	}
+
+	return &WatchOptions{
+		Interval:        interval,
+		Debounce:        debounce,
+		SummaryInterval: summaryInterval,
+		StatusAddr:      statusAddr,
+	}, nil
+}
+
+// watchStatus is what the watch has done so far, as logged in the
+// summaries and served on --status-addr
+type watchStatus struct {
+	Started     time.Time  `json:"started"`
+	Scans       uint64     `json:"scans"`
+	LastScan    *time.Time `json:"last_scan,omitempty"`
+	Watched     int        `json:"watched"`
+	Pending     int        `json:"pending"`
+	Batches     uint64     `json:"batches"`
+	Uploaded    uint64     `json:"uploaded"`
+	Failed      uint64     `json:"failed"`
+	Bytes       uint64     `json:"bytes"`
+	LastUpload  *time.Time `json:"last_upload,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// watchedFile is a file as last scanned, and whether it has changed since
+// it was uploaded
+type watchedFile struct {
+	Size    int64
+	ModTime time.Time
+
+	// Pending is set while the file has changed since its last upload,
+	// and ChangedAt is when it was last seen changing
+	Pending   bool
+	ChangedAt time.Time
+}
+
+// watcher scans the paths of an upload every --interval, and uploads the
+// files that were added or changed once they have sat unchanged for
+// --debounce
+type watcher struct {
+	opts      *Options
+	watchOpts *WatchOptions
+	log       *logrus.Logger
+	paths     []*path.Path
+
+	lock   sync.Mutex
+	files  map[string]*watchedFile
+	status watchStatus
+}
+
+func newWatcher(opts *Options, watchOpts *WatchOptions, log *logrus.Logger) *watcher {
+	return &watcher{
+		opts:      opts,
+		watchOpts: watchOpts,
+		log:       log,
+		paths:     newUploader(opts, log).Paths.All(),
+		files:     map[string]*watchedFile{},
+	}
+}
+
+// Watch uploads the paths as "upload" would, and then keeps uploading the
+// files under them that are added or changed until the context is
+// canceled.  Each batch of changed files is uploaded as an upload of its
+// own, with the same retries, providers, and reports.
+func Watch(ctx context.Context, opts *Options, watchOpts *WatchOptions, log *logrus.Logger) error {
+	if opts.Stdin {
+		return fmt.Errorf("watch cannot upload stdin")
+	}
+	for _, s := range opts.Paths {
+		if from, _ := splitPathArg(s); from == stdinPath {
+			return fmt.Errorf("watch cannot upload stdin")
+		}
+	}
+	if len(opts.Paths) == 0 {
+		return fmt.Errorf("watch needs at least one path")
+	}
+	if opts.Stream {
+		return fmt.Errorf("watch cannot be used with --stream, since it needs the results of each batch")
+	}
+
+	return newWatcher(opts, watchOpts, log).run(ctx)
+}
+
+func (w *watcher) run(ctx context.Context) error {
+	w.status.Started = time.Now()
+
+	if w.watchOpts.StatusAddr != "" {
+		stop, err := w.serveStatus(w.watchOpts.StatusAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	w.log.WithFields(logrus.Fields{
+		"paths":    w.opts.Paths,
+		"interval": w.watchOpts.Interval,
+		"debounce": w.watchOpts.Debounce,
+	}).Info("watching for changes")
+
+	scan := time.NewTicker(w.watchOpts.Interval)
+	defer scan.Stop()
+
+	var summary <-chan time.Time
+	if w.watchOpts.SummaryInterval > 0 {
+		t := time.NewTicker(w.watchOpts.SummaryInterval)
+		defer t.Stop()
+		summary = t.C
+	}
+
+	w.scan(ctx, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			w.logSummary("stopped watching")
+			return nil
+		case now := <-scan.C:
+			w.scan(ctx, now)
+		case <-summary:
+			w.logSummary("watch summary")
+		}
+	}
+}
+
+// scan walks the paths for files that were added or changed, and uploads
+// those that haven't changed for --debounce since
+func (w *watcher) scan(ctx context.Context, now time.Time) {
+	found, err := w.walk()
+	if err != nil {
+		w.log.WithField("err", err).Error("failed to scan paths")
+		w.lock.Lock()
+		w.status.LastError, w.status.LastErrorAt = err.Error(), &now
+		w.lock.Unlock()
+		return
+	}
+
+	w.lock.Lock()
+	batch := map[string]bool{}
+	for source, info := range found {
+		wf, ok := w.files[source]
+		if !ok || wf.Size != info.Size() || !wf.ModTime.Equal(info.ModTime()) {
+			changedAt := now
+			if !ok {
+				wf = &watchedFile{}
+				w.files[source] = wf
+
+				// a file found already written counts as changed when it
+				// was, so that settled files go up in the first batch
+				if info.ModTime().Before(now) {
+					changedAt = info.ModTime()
+				}
+			}
+			wf.Size, wf.ModTime = info.Size(), info.ModTime()
+			wf.Pending, wf.ChangedAt = true, changedAt
+		}
+
+		if wf.Pending && now.Sub(wf.ChangedAt) >= w.watchOpts.Debounce {
+			batch[source] = true
+		}
+	}
+	for source := range w.files {
+		if _, ok := found[source]; !ok {
+			delete(w.files, source)
+		}
+	}
+	w.status.Scans++
+	w.status.LastScan = &now
+	w.lock.Unlock()
+
+	if len(batch) > 0 && ctx.Err() == nil {
+		w.upload(ctx, batch, now)
+	}
+
+	w.lock.Lock()
+	w.status.Watched, w.status.Pending = len(w.files), 0
+	for _, wf := range w.files {
+		if wf.Pending {
+			w.status.Pending++
+		}
+	}
+	w.lock.Unlock()
+}
+
+// walk finds the files under the paths, leaving out those excluded with
+// --exclude.  Paths that don't exist yet are watched for in later scans.
+func (w *watcher) walk() (map[string]os.FileInfo, error) {
+	ex, err := newExcludes(w.opts.WorkingDir, w.opts.Excludes)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]os.FileInfo{}
+	for _, p := range w.paths {
+		err := filepath.Walk(p.Fullpath(), func(source string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if ex != nil {
+				if _, excluded := ex.Excluded(relToWorkingDir(w.opts.WorkingDir, source), info.IsDir()); excluded {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+
+			if !info.IsDir() {
+				found[source] = info
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
+
+// upload uploads the batch of changed files, which stay pending to be
+// tried again after another --debounce if they fail
+func (w *watcher) upload(ctx context.Context, batch map[string]bool, now time.Time) {
+	sources := []string{}
+	for source := range batch {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	w.log.WithField("files", len(sources)).Info("uploading changed files")
+	w.log.WithField("sources", sources).Debug("changed files")
+
+	u := newUploader(w.opts, w.log)
+	u.ctx = ctx
+	u.watchOnly = batch
+	err := u.Upload()
+
+	failed := map[string]bool{}
+	uploaded := uint64(0)
+	for _, a := range u.results {
+		if !a.UploadResult.OK {
+			failed[a.Source] = true
+			continue
+		}
+		if size, sizeErr := a.Size(); sizeErr == nil {
+			uploaded += size
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.status.Batches++
+	w.status.Bytes += uploaded
+	for _, source := range sources {
+		wf, ok := w.files[source]
+		if !ok {
+			continue
+		}
+		if err != nil || failed[source] || !uploadedSource(u.results, source) {
+			w.status.Failed++
+			wf.ChangedAt = now
+			continue
+		}
+		w.status.Uploaded++
+		wf.Pending = false
+	}
+
+	if err != nil {
+		w.log.WithField("err", err).Error("failed to upload changed files")
+		w.status.LastError, w.status.LastErrorAt = err.Error(), &now
+		return
+	}
+	w.status.LastUpload = &now
+}
+
+// uploadedSource is whether the source was uploaded at all, since those
+// left out by --include or the like aren't among the results
+func uploadedSource(results []*artifact.Artifact, source string) bool {
+	for _, a := range results {
+		if a.Source == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *watcher) currentStatus() watchStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.status
+}
+
+func (w *watcher) logSummary(msg string) {
+	status := w.currentStatus()
+	w.log.WithFields(logrus.Fields{
+		"watched":  status.Watched,
+		"pending":  status.Pending,
+		"batches":  status.Batches,
+		"uploaded": status.Uploaded,
+		"failed":   status.Failed,
+		"bytes":    status.Bytes,
+	}).Info(msg)
+}
+
+// ServeHTTP serves the status as JSON
+func (w *watcher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(w.currentStatus())
+}
+
+// serveStatus serves the status on the address until stopped
+func (w *watcher) serveStatus(addr string) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot serve status on %s: %v", addr, err)
+	}
+
+	server := &http.Server{Handler: w}
+	go server.Serve(l)
+
+	w.log.WithField("addr", l.Addr().String()).Info("serving watch status")
+	return func() { server.Close() }, nil
+}
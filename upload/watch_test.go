@@ -0,0 +1,201 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTestWatcher(dir string, debounce time.Duration) *watcher {
+	opts := NewOptions()
+	opts.Provider = "file"
+	opts.FileRoot = filepath.Join(dir, "share")
+	opts.WorkingDir = dir
+	opts.Paths = []string{"out/"}
+	opts.TargetPaths = []string{"watch-test"}
+	opts.Excludes = []string{"*.tmp"}
+
+	return newWatcher(opts, &WatchOptions{Interval: time.Second, Debounce: debounce}, getPanicLogger())
+}
+
+func writeWatchedFile(t *testing.T, dir, name, content string, modTime time.Time) {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func readWatchedUpload(t *testing.T, dir, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "share", "watch-test", name))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(b)
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "first",
+	})
+	defer os.RemoveAll(dir)
+
+	t0 := time.Now().Truncate(time.Second)
+	writeWatchedFile(t, dir, "out/a.txt", "first", t0)
+	writeWatchedFile(t, dir, "out/b.txt", "settled", t0.Add(-time.Minute))
+
+	ctx := context.Background()
+	w := getTestWatcher(dir, 10*time.Second)
+
+	// the settled file goes up in the first scan, the fresh one waits
+	w.scan(ctx, t0)
+	if readWatchedUpload(t, dir, "out/b.txt") != "settled" || readWatchedUpload(t, dir, "out/a.txt") != "" {
+		t.Fatalf("unexpected first batch: %#v", w.currentStatus())
+	}
+
+	// changing it starts the wait over
+	writeWatchedFile(t, dir, "out/a.txt", "second", t0.Add(5*time.Second))
+	writeWatchedFile(t, dir, "out/c.tmp", "excluded", t0.Add(-time.Minute))
+	w.scan(ctx, t0.Add(6*time.Second))
+	w.scan(ctx, t0.Add(15*time.Second))
+	if readWatchedUpload(t, dir, "out/a.txt") != "" {
+		t.Fatalf("uploaded before the debounce: %#v", w.currentStatus())
+	}
+
+	w.scan(ctx, t0.Add(16*time.Second))
+	if content := readWatchedUpload(t, dir, "out/a.txt"); content != "second" {
+		t.Fatalf("unexpected upload %q", content)
+	}
+
+	w.scan(ctx, t0.Add(30*time.Second))
+	status := w.currentStatus()
+	if status.Batches != 2 || status.Uploaded != 2 || status.Failed != 0 || status.Bytes != 13 ||
+		status.Watched != 2 || status.Pending != 0 || status.Scans != 5 {
+		t.Fatalf("unexpected status %#v", status)
+	}
+	if readWatchedUpload(t, dir, "out/c.tmp") != "" {
+		t.Fatalf("uploaded an excluded file")
+	}
+}
+
+func TestWatcherRetriesFailures(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	t0 := time.Now().Add(2 * time.Second)
+	w := getTestWatcher(dir, time.Second)
+	w.opts.MaxSize = 1
+
+	w.scan(context.Background(), t0)
+	status := w.currentStatus()
+	if status.Failed != 1 || status.Pending != 1 || !strings.Contains(status.LastError, "max-size") {
+		t.Fatalf("unexpected status %#v", status)
+	}
+
+	w.opts.MaxSize = 1024
+	w.scan(context.Background(), t0.Add(500*time.Millisecond))
+	if readWatchedUpload(t, dir, "out/a.txt") != "" {
+		t.Fatalf("tried again before the debounce")
+	}
+
+	w.scan(context.Background(), t0.Add(time.Second))
+	if readWatchedUpload(t, dir, "out/a.txt") != "aaaa" || w.currentStatus().Pending != 0 {
+		t.Fatalf("not tried again: %#v", w.currentStatus())
+	}
+}
+
+func TestWatcherStatus(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	w := getTestWatcher(dir, 0)
+	w.scan(context.Background(), time.Now())
+
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+
+	status := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status["uploaded"] != 1.0 || status["bytes"] != 4.0 || status["last_upload"] == nil {
+		t.Fatalf("unexpected status %v", status)
+	}
+	if _, ok := status["last_error"]; ok {
+		t.Fatalf("unexpected status %v", status)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	os.Clearenv()
+	dir := writeTestFiles(t, map[string]string{
+		"out/a.txt": "aaaa",
+	})
+	defer os.RemoveAll(dir)
+
+	w := getTestWatcher(dir, 0)
+	w.watchOpts.Interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Watch(ctx, w.opts, w.watchOpts, w.log) }()
+
+	writeWatchedFile(t, dir, "out/b.txt", "bbbb", time.Now().Add(-time.Minute))
+	for i := 0; readWatchedUpload(t, dir, "out/b.txt") == "" && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if readWatchedUpload(t, dir, "out/a.txt") != "aaaa" || readWatchedUpload(t, dir, "out/b.txt") != "bbbb" {
+		t.Fatalf("added file not uploaded")
+	}
+}
+
+func TestWatchOptions(t *testing.T) {
+	for _, tc := range []struct {
+		interval, debounce time.Duration
+		statusAddr         string
+		err                string
+	}{
+		{time.Second, time.Second, "localhost:8080", ""},
+		{0, time.Second, "", "invalid --interval 0s, expected more than 0"},
+		{time.Second, -time.Second, "", "invalid --debounce -1s"},
+		{time.Second, 0, "8080", `invalid --status-addr "8080"`},
+	} {
+		_, err := NewWatchOptions(tc.interval, tc.debounce, 0, tc.statusAddr)
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.HasPrefix(err.Error(), tc.err)) {
+			t.Fatalf("%#v: unexpected error: %v", tc, err)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Paths = []string{"-"}
+	if err := Watch(context.Background(), opts, &WatchOptions{}, getPanicLogger()); err == nil ||
+		err.Error() != "watch cannot upload stdin" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}